@@ -0,0 +1,329 @@
+package arbitrum
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/state/snapshot"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/rlp"
+	"github.com/chainupcloud/arb-geth/rpc"
+	flag "github.com/spf13/pflag"
+)
+
+type AccountWatchConfig struct {
+	MaxAccounts int `koanf:"max-accounts"`
+}
+
+var DefaultAccountWatchConfig = AccountWatchConfig{
+	MaxAccounts: 1_000_000,
+}
+
+func AccountWatchConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Int(prefix+".max-accounts", DefaultAccountWatchConfig.MaxAccounts, "number of accounts a single account changes subscription may watch (0=unlimited)")
+}
+
+var errUnknownAccountWatch = errors.New("unknown account changes subscription")
+
+type AccountWatchArgs struct {
+	Addresses []common.Address                 `json:"addresses"`
+	Slots     map[common.Address][]common.Hash `json:"slots"` // storage slots watched, the accounts being watched too
+}
+
+type AccountChange struct {
+	Address common.Address              `json:"address"`
+	Deleted bool                        `json:"deleted,omitempty"`
+	Balance *hexutil.Big                `json:"balance"`
+	Nonce   hexutil.Uint64              `json:"nonce"`
+	Storage map[common.Hash]common.Hash `json:"storage,omitempty"` // changed watched slots with their new values
+}
+
+type AccountChanges struct {
+	Number     hexutil.Uint64   `json:"number"`
+	Hash       common.Hash      `json:"hash"`
+	ParentHash common.Hash      `json:"parentHash"`
+	Accounts   []*AccountChange `json:"accounts"`
+	// set if the diff of the block couldn't be computed from the snapshot, the watched accounts having to be re-read
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+type watchedAccount struct {
+	address common.Address
+	slots   map[common.Hash]common.Hash // hashed slot to slot
+}
+
+// accountWatch is the set of accounts watched by a subscription, keyed by address hash as the snapshot is
+type accountWatch struct {
+	lock     sync.RWMutex
+	accounts map[common.Hash]*watchedAccount
+	limit    int
+}
+
+func (w *accountWatch) add(args *AccountWatchArgs) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	watch := func(address common.Address) (*watchedAccount, error) {
+		hash := crypto.Keccak256Hash(address.Bytes())
+		if account, ok := w.accounts[hash]; ok {
+			return account, nil
+		}
+		if w.limit > 0 && len(w.accounts) >= w.limit {
+			return nil, fmt.Errorf("too many watched accounts, the limit is %d", w.limit)
+		}
+		account := &watchedAccount{address: address}
+		w.accounts[hash] = account
+		return account, nil
+	}
+	for _, address := range args.Addresses {
+		if _, err := watch(address); err != nil {
+			return err
+		}
+	}
+	for address, slots := range args.Slots {
+		account, err := watch(address)
+		if err != nil {
+			return err
+		}
+		if account.slots == nil {
+			account.slots = make(map[common.Hash]common.Hash, len(slots))
+		}
+		for _, slot := range slots {
+			account.slots[crypto.Keccak256Hash(slot.Bytes())] = slot
+		}
+	}
+	return nil
+}
+
+func (w *accountWatch) remove(addresses []common.Address) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, address := range addresses {
+		delete(w.accounts, crypto.Keccak256Hash(address.Bytes()))
+	}
+}
+
+// changes diffs the watched accounts touched by the block against its parent, reading both states from the snapshot
+func (w *accountWatch) changes(snaps *snapshot.Tree, header *types.Header, parentRoot common.Hash) *AccountChanges {
+	res := &AccountChanges{
+		Number:     hexutil.Uint64(header.Number.Uint64()),
+		Hash:       header.Hash(),
+		ParentHash: header.ParentHash,
+		Accounts:   []*AccountChange{},
+	}
+	if header.Root == parentRoot {
+		return res
+	}
+	changes, err := snaps.Changes(header.Root)
+	post, pre := snaps.Snapshot(header.Root), snaps.Snapshot(parentRoot)
+	if err != nil || changes.Parent != parentRoot || post == nil || pre == nil {
+		res.Incomplete = true
+		return res
+	}
+	touched := make(map[common.Hash]struct{}, len(changes.Accounts))
+	for hash := range changes.Destructs {
+		touched[hash] = struct{}{}
+	}
+	for hash := range changes.Accounts {
+		touched[hash] = struct{}{}
+	}
+	for hash := range changes.Storage {
+		touched[hash] = struct{}{}
+	}
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	for hash := range touched {
+		account, ok := w.accounts[hash]
+		if !ok {
+			continue
+		}
+		change, err := diffWatchedAccount(pre, post, hash, account, changes)
+		if err != nil {
+			res.Incomplete = true
+			continue
+		}
+		if change != nil {
+			res.Accounts = append(res.Accounts, change)
+		}
+	}
+	sort.Slice(res.Accounts, func(i, j int) bool {
+		return bytes.Compare(res.Accounts[i].Address[:], res.Accounts[j].Address[:]) < 0
+	})
+	return res
+}
+
+func diffWatchedAccount(pre, post snapshot.Snapshot, hash common.Hash, account *watchedAccount, changes *snapshot.Changes) (*AccountChange, error) {
+	before, err := pre.Account(hash)
+	if err != nil {
+		return nil, err
+	}
+	after, err := post.Account(hash)
+	if err != nil {
+		return nil, err
+	}
+	change := &AccountChange{Address: account.address, Balance: (*hexutil.Big)(new(big.Int))}
+	if after != nil {
+		change.Balance = (*hexutil.Big)(after.Balance)
+		change.Nonce = hexutil.Uint64(after.Nonce)
+	}
+	changed := (before == nil) != (after == nil)
+	if before != nil && after != nil {
+		changed = before.Nonce != after.Nonce || before.Balance.Cmp(after.Balance) != 0
+	}
+	change.Deleted = before != nil && after == nil
+	_, destructed := changes.Destructs[hash]
+	slots := changes.Storage[hash]
+	for slotHash, slot := range account.slots {
+		if _, ok := slots[slotHash]; !ok && !destructed {
+			continue
+		}
+		old, err := pre.Storage(hash, slotHash)
+		if err != nil {
+			return nil, err
+		}
+		value, err := post.Storage(hash, slotHash)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(old, value) {
+			continue
+		}
+		if change.Storage == nil {
+			change.Storage = make(map[common.Hash]common.Hash)
+		}
+		var word common.Hash
+		if len(value) > 0 {
+			_, content, _, err := rlp.Split(value)
+			if err != nil {
+				return nil, err
+			}
+			word = common.BytesToHash(content)
+		}
+		change.Storage[slot] = word
+	}
+	if !changed && change.Storage == nil {
+		return nil, nil
+	}
+	return change, nil
+}
+
+// accountWatches tracks the watched accounts of the live subscriptions, for them to be updated by id
+type accountWatches struct {
+	lock    sync.Mutex
+	watches map[rpc.ID]*accountWatch
+}
+
+func newAccountWatches() *accountWatches {
+	return &accountWatches{watches: make(map[rpc.ID]*accountWatch)}
+}
+
+func (w *accountWatches) get(id rpc.ID) (*accountWatch, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	watch, ok := w.watches[id]
+	if !ok {
+		return nil, errUnknownAccountWatch
+	}
+	return watch, nil
+}
+
+func (w *accountWatches) set(id rpc.ID, watch *accountWatch) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if watch == nil {
+		delete(w.watches, id)
+	} else {
+		w.watches[id] = watch
+	}
+}
+
+// AccountChanges streams, for every canonical block, the balance, nonce and watched storage slots of the watched
+// accounts it changed, diffed against its parent from the snapshot diff layers. The diffs are relative to the
+// parent hash, for clients to detect reorgs, and flagged incomplete if the snapshot no longer holds the block.
+func (api *ArbAPI) AccountChanges(ctx context.Context, args AccountWatchArgs) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	bc := api.b.BlockChain()
+	snaps := bc.Snapshots()
+	if snaps == nil {
+		return nil, errors.New("account changes require snapshots")
+	}
+	watch := &accountWatch{
+		accounts: make(map[common.Hash]*watchedAccount),
+		limit:    api.b.b.config.AccountWatch.MaxAccounts,
+	}
+	if err := watch.add(&args); err != nil {
+		return nil, err
+	}
+	rpcSub := notifier.CreateSubscription()
+	api.b.b.accountWatches.set(rpcSub.ID, watch)
+	events := make(chan core.ChainEvent, 128)
+	sub := bc.SubscribeChainEvent(events)
+	go func() {
+		defer sub.Unsubscribe()
+		defer api.b.b.accountWatches.set(rpcSub.ID, nil)
+		for {
+			select {
+			case ev := <-events:
+				header := ev.Block.Header()
+				parent := bc.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+				var changes *AccountChanges
+				if parent == nil {
+					changes = &AccountChanges{
+						Number:     hexutil.Uint64(header.Number.Uint64()),
+						Hash:       ev.Hash,
+						ParentHash: header.ParentHash,
+						Accounts:   []*AccountChange{},
+						Incomplete: true,
+					}
+				} else {
+					changes = watch.changes(snaps, header, parent.Root)
+				}
+				if err := notifier.Notify(rpcSub.ID, changes); err != nil {
+					return
+				}
+			case <-sub.Err():
+				return
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
+
+// WatchAccounts adds accounts and storage slots to those watched by an account changes subscription
+func (api *ArbAPI) WatchAccounts(id rpc.ID, args AccountWatchArgs) error {
+	watch, err := api.b.b.accountWatches.get(id)
+	if err != nil {
+		return err
+	}
+	return watch.add(&args)
+}
+
+// UnwatchAccounts stops an account changes subscription watching accounts, along with their storage slots
+func (api *ArbAPI) UnwatchAccounts(id rpc.ID, addresses []common.Address) error {
+	watch, err := api.b.b.accountWatches.get(id)
+	if err != nil {
+		return err
+	}
+	watch.remove(addresses)
+	return nil
+}
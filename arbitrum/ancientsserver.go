@@ -0,0 +1,39 @@
+package arbitrum
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// AncientsServerConfig serves the chain ancients over http in the layout read by the nodes using this one as their
+// remote ancients source (--datadir.ancient.remote)
+type AncientsServerConfig struct {
+	Enable bool   `koanf:"enable"`
+	Path   string `koanf:"path"`
+}
+
+var DefaultAncientsServerConfig = AncientsServerConfig{
+	Enable: false,
+	Path:   "/ancients",
+}
+
+func AncientsServerConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultAncientsServerConfig.Enable, "serve the chain ancients over http, as the remote ancients source of other nodes")
+	f.String(prefix+".path", DefaultAncientsServerConfig.Path, "path of the http ancients endpoint")
+}
+
+func (c *AncientsServerConfig) Validate() error {
+	if c.Enable && (!strings.HasPrefix(c.Path, "/") || c.Path == "/") {
+		return fmt.Errorf("invalid ancients endpoint path %q, must start with / and not be the root", c.Path)
+	}
+	return nil
+}
+
+// ancientsHandler serves the ancients below the configured path, at <path>/<kind>/<number>
+func ancientsHandler(config *AncientsServerConfig, handler http.Handler) (string, http.Handler) {
+	path := strings.TrimRight(config.Path, "/")
+	return path + "/", http.StripPrefix(path, handler)
+}
@@ -7,11 +7,11 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/chainupcloud/arb-geth"
 	"github.com/chainupcloud/arb-geth/arbitrum_types"
-	"github.com/chainupcloud/arb-geth/eth"
 	"github.com/chainupcloud/arb-geth/eth/tracers"
 	"github.com/chainupcloud/arb-geth/log"
 
@@ -28,6 +28,7 @@ import (
 	"github.com/chainupcloud/arb-geth/ethdb"
 	"github.com/chainupcloud/arb-geth/event"
 	"github.com/chainupcloud/arb-geth/internal/ethapi"
+	"github.com/chainupcloud/arb-geth/internal/quota"
 	"github.com/chainupcloud/arb-geth/params"
 	"github.com/chainupcloud/arb-geth/rpc"
 )
@@ -36,7 +37,9 @@ type APIBackend struct {
 	b *Backend
 
 	fallbackClient types.FallbackClient
+	callCache      *ethapi.CallCache
 	sync           SyncProgressBackend
+	syncStatus     atomic.Pointer[SyncStatusProvider] // set once, read by the eth_syncing handlers
 }
 
 type timeoutFallbackClient struct {
@@ -95,6 +98,9 @@ func createRegisterAPIBackend(backend *Backend, filterConfig filters.Config, fal
 		b:              backend,
 		fallbackClient: fallbackClient,
 	}
+	if config := backend.config.CallCache; config.Enable {
+		backend.apiBackend.callCache = ethapi.NewCallCache(config.Size, config.TTL)
+	}
 	filterSystem := filters.NewFilterSystem(backend.apiBackend, filterConfig)
 	backend.stack.RegisterAPIs(backend.apiBackend.GetAPIs(filterSystem))
 	return filterSystem, nil
@@ -125,6 +131,36 @@ func (a *APIBackend) GetAPIs(filterSystem *filters.FilterSystem) []rpc.API {
 		Public:    true,
 	})
 
+	apis = append(apis, rpc.API{
+		Namespace: "arb",
+		Version:   "1.0",
+		Service:   NewArbAPI(a),
+		Public:    true,
+	})
+
+	apis = append(apis, rpc.API{
+		Namespace: "arbdebug",
+		Version:   "1.0",
+		Service:   NewArbDebugAPI(a),
+		Public:    false,
+	})
+
+	apis = append(apis, rpc.API{
+		Namespace: "admin",
+		Version:   "1.0",
+		Service:   NewHealthAPI(a),
+		Public:    false,
+	})
+
+	if a.b.stateMirrorSource != nil {
+		apis = append(apis, rpc.API{
+			Namespace: "statemirror",
+			Version:   "1.0",
+			Service:   NewStateMirrorAPI(a),
+			Public:    false,
+		})
+	}
+
 	apis = append(apis, rpc.API{
 		Namespace: "net",
 		Version:   "1.0",
@@ -166,7 +202,16 @@ func (a *APIBackend) SyncProgressMap() map[string]interface{} {
 		res["error"] = "sync object not set in apibackend"
 		return res
 	}
-	return a.sync.SyncProgressMap()
+	progress := a.sync.SyncProgressMap()
+	if len(progress) == 0 {
+		return progress
+	}
+	res := make(map[string]interface{}, len(progress))
+	for key, value := range progress {
+		res[key] = value
+	}
+	a.addSyncStages(res)
+	return res
 }
 
 func (a *APIBackend) SyncProgress() ethereum.SyncProgress {
@@ -331,6 +376,11 @@ func (a *APIBackend) UnprotectedAllowed() bool {
 	return a.b.config.TxAllowUnprotected
 }
 
+// ConditionalSignatureRequired tells whether the conditions of conditional transactions must be signed by their sender
+func (a *APIBackend) ConditionalSignatureRequired() bool {
+	return a.b.config.TxConditionalRequireSignature
+}
+
 // Blockchain API
 func (a *APIBackend) SetHead(number uint64) {
 	panic("not implemented") // TODO: Implement
@@ -349,12 +399,18 @@ func (a *APIBackend) blockNumberToUint(ctx context.Context, number rpc.BlockNumb
 		return a.BlockChain().CurrentBlock().Number.Uint64(), nil
 	}
 	if number == rpc.SafeBlockNumber {
+		if safe := a.BlockChain().CurrentSafeBlock(); safe != nil {
+			return safe.Number.Uint64(), nil
+		}
 		if a.sync == nil {
 			return 0, errors.New("block number not supported: object not set")
 		}
 		return a.sync.SafeBlockNumber(ctx)
 	}
 	if number == rpc.FinalizedBlockNumber {
+		if final := a.BlockChain().CurrentFinalBlock(); final != nil {
+			return final.Number.Uint64(), nil
+		}
 		if a.sync == nil {
 			return 0, errors.New("block number not supported: object not set")
 		}
@@ -444,47 +500,196 @@ func (a *APIBackend) stateAndHeaderFromHeader(ctx context.Context, header *types
 		return nil, header, types.ErrUseFallback
 	}
 	bc := a.BlockChain()
+	ctx, _ = log.WithTrace(ctx, "state-at-header", "block", header.Number)
+	// rolling the snapshot back is preferred to replaying blocks, and costs no recreation budget
+	if state := a.rolledBackState(ctx, header); state != nil {
+		return state, header, nil
+	}
+	maxDepth, overridden := maxRecreateStateDepthFromContext(ctx)
+	if !overridden {
+		// an explicit budget replaces the recreation limits along with the default depth
+		maxDepth = a.b.config.MaxRecreateStateDepth
+		if _, err := a.checkRecreationCost(ctx, header, 0); err != nil {
+			return nil, nil, err
+		}
+	}
 	stateFor := func(header *types.Header) (*state.StateDB, error) {
 		return bc.StateAt(header.Root)
 	}
-	state, lastHeader, err := FindLastAvailableState(ctx, bc, stateFor, header, nil, a.b.config.MaxRecreateStateDepth)
+	state, lastHeader, err := findLastAvailableStateWithinStride(ctx, bc, stateFor, header, bc.SparseArchiveStride(), maxDepth)
 	if err != nil {
+		if ctx.Err() == nil && (maxDepth == 0 || errors.Is(err, ErrDepthLimitExceeded)) {
+			err = &StateNotAvailableError{Block: header.Number.Uint64(), MaxDepth: maxDepth, err: err}
+		}
 		return nil, nil, err
 	}
+	meterStateReads(ctx, state)
 	if lastHeader == header {
 		return state, header, nil
 	}
-	state, err = AdvanceStateUpToBlock(ctx, bc, state, header, lastHeader, nil)
-	if err != nil {
+	// the replayed gas is only known as it goes, it's charged to the quota of the caller block by block
+	if err := quota.Check(ctx, quota.StateRecreationGas); err != nil {
 		return nil, nil, err
 	}
+	replayed, done := a.b.recreationBacklog.start(header.Number.Uint64() - lastHeader.Number.Uint64())
+	defer done()
+	jobCtx, job, unregister := a.b.recreationJobs.start(ctx, lastHeader.Number.Uint64(), header.Number.Uint64(), true)
+	defer unregister()
+	opts := &AdvanceStateOptions{
+		BlockReplayed: func(block *types.Block, l2GasUsed uint64, elapsed time.Duration) {
+			a.b.recreationThroughput.update(l2GasUsed, elapsed)
+			quota.Record(ctx, quota.StateRecreationGas, l2GasUsed)
+			recordRecreation(ctx, 1, l2GasUsed)
+			job.replayed(block.NumberU64(), l2GasUsed)
+			replayed()
+		},
+		PrefetchWorkers:       a.b.config.RecreationPrefetchWorkers,
+		PersistRetained:       true,
+		SnapshotSliceAccounts: a.b.config.RecreationSnapshotSlice.accounts(),
+		SnapshotSliceMaxSlots: a.b.config.RecreationSnapshotSlice.MaxSlots,
+	}
+	if a.b.config.RecreationRecordPreimages {
+		opts.PreimageDB = a.ChainDb()
+	}
+	state, err = AdvanceStateUpToBlock(jobCtx, bc, state, header, lastHeader, nil, opts)
+	if err != nil {
+		return nil, nil, job.err(err)
+	}
+	// the job context ends with the recreation, the state outlives it
+	state.SetContext(ctx)
+	meterStateReads(ctx, state)
 	return state, header, err
 }
 
 func (a *APIBackend) StateAndHeaderByNumber(ctx context.Context, number rpc.BlockNumber) (*state.StateDB, *types.Header, error) {
+	if number == rpc.PendingBlockNumber {
+		if statedb, header, err := a.pendingStateAndHeader(ctx); statedb != nil || err != nil {
+			return statedb, header, err
+		}
+	}
 	header, err := a.HeaderByNumber(ctx, number)
 	return a.stateAndHeaderFromHeader(ctx, header, err)
 }
 
 func (a *APIBackend) StateAndHeaderByNumberOrHash(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash) (*state.StateDB, *types.Header, error) {
+	if number, isnum := blockNrOrHash.Number(); isnum && number == rpc.PendingBlockNumber {
+		if statedb, header, err := a.pendingStateAndHeader(ctx); statedb != nil || err != nil {
+			return statedb, header, err
+		}
+	}
 	header, err := a.HeaderByNumberOrHash(ctx, blockNrOrHash)
 	return a.stateAndHeaderFromHeader(ctx, header, err)
 }
 
+// pendingStateAndHeader returns the state of the block the sequencer is building, or nil if the node isn't building
+// one, in which case the pending state is the latest block state
+func (a *APIBackend) pendingStateAndHeader(ctx context.Context) (*state.StateDB, *types.Header, error) {
+	provider, ok := a.b.arb.(PendingStateProvider)
+	if !ok {
+		return nil, nil, nil
+	}
+	header, statedb, err := provider.PendingState(ctx)
+	if err != nil || statedb == nil || header == nil {
+		return nil, nil, err
+	}
+	return statedb, header, nil
+}
+
 func (a *APIBackend) StateAtBlock(ctx context.Context, block *types.Block, reexec uint64, base *state.StateDB, checkLive bool, preferDisk bool) (statedb *state.StateDB, release tracers.StateReleaseFunc, err error) {
 	if !a.BlockChain().Config().IsArbitrumNitro(block.Number()) {
 		return nil, nil, types.ErrUseFallback
 	}
-	// DEV: This assumes that `StateAtBlock` only accesses the blockchain and chainDb fields
-	return eth.NewArbEthereum(a.b.arb.BlockChain(), a.ChainDb()).StateAtBlock(ctx, block, reexec, base, checkLive, preferDisk)
+	ctx, _ = log.WithTrace(ctx, "state-at-block", "block", block.Number())
+	pinner := a.b.statePinner
+	if pinner == nil || base != nil {
+		return a.stateAtBlock(ctx, block, reexec, base, checkLive, preferDisk)
+	}
+	hot := pinner.record(block.Hash())
+	if statedb, release := pinner.get(block.Hash()); statedb != nil {
+		return statedb, release, nil
+	}
+	statedb, release, err = a.stateAtBlock(ctx, block, reexec, base, checkLive, preferDisk)
+	if err != nil || !hot || a.BlockChain().HasState(block.Root()) {
+		// states available on disk are cheap to get, there's no point in pinning them
+		return statedb, release, err
+	}
+	if pinner.pin(block.Hash(), block.NumberU64(), statedb, release) {
+		// the pinner now owns the state, hand out a tracked copy of it
+		statedb, release = pinner.get(block.Hash())
+	}
+	return statedb, release, nil
+}
+
+// stateAtBlock recreates the state by re-executing up to reexec blocks, unless that is estimated to exceed the recreation
+// limits or reexec, the error then reporting the nearest block whose state is affordable
+func (a *APIBackend) stateAtBlock(ctx context.Context, block *types.Block, reexec uint64, base *state.StateDB, checkLive bool, preferDisk bool) (*state.StateDB, tracers.StateReleaseFunc, error) {
+	if stride := a.BlockChain().SparseArchiveStride(); reexec < stride {
+		// sparse archive nodes may need to go back a whole stride to find a state
+		reexec = stride
+	}
+	var estimate *StateRecreationEstimate
+	if base == nil {
+		var err error
+		estimate, err = a.checkRecreationCost(ctx, block.Header(), reexec)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if estimate != nil && estimate.Blocks > 0 {
+		if err := quota.Reserve(ctx, quota.StateRecreationGas, uint64(estimate.L2Gas)); err != nil {
+			return nil, nil, err
+		}
+	}
+	jobCtx := ctx
+	var job *recreationJob
+	if base == nil && !a.BlockChain().HasState(block.Root()) {
+		var blocks uint64
+		if estimate != nil {
+			blocks = uint64(estimate.Blocks)
+		}
+		_, done := a.b.recreationBacklog.start(blocks)
+		defer done()
+		var unregister func()
+		jobCtx, job, unregister = a.b.recreationJobs.start(ctx, block.NumberU64()-blocks, block.NumberU64(), false)
+		defer unregister()
+	}
+	start := time.Now()
+	statedb, release, err := a.b.ethereum.StateAtBlock(jobCtx, block, reexec, base, checkLive, preferDisk)
+	if job != nil {
+		if err = job.err(err); err == nil {
+			// the job context ends with the recreation, the state outlives it
+			statedb.SetContext(ctx)
+		}
+	}
+	if err == nil && estimate != nil && estimate.Blocks > 0 {
+		a.b.recreationThroughput.update(uint64(estimate.L2Gas), time.Since(start))
+		recordRecreation(ctx, uint64(estimate.Blocks), uint64(estimate.L2Gas))
+	}
+	if err == nil {
+		meterStateReads(ctx, statedb)
+	}
+	return statedb, release, err
 }
 
 func (a *APIBackend) StateAtTransaction(ctx context.Context, block *types.Block, txIndex int, reexec uint64) (*core.Message, vm.BlockContext, *state.StateDB, tracers.StateReleaseFunc, error) {
 	if !a.BlockChain().Config().IsArbitrumNitro(block.Number()) {
 		return nil, vm.BlockContext{}, nil, nil, types.ErrUseFallback
 	}
-	// DEV: This assumes that `StateAtTransaction` only accesses the blockchain and chainDb fields
-	return eth.NewArbEthereum(a.b.arb.BlockChain(), a.ChainDb()).StateAtTransaction(ctx, block, txIndex, reexec)
+	ctx, _ = log.WithTrace(ctx, "state-at-transaction", "block", block.Number(), "tx", txIndex)
+	if (a.b.statePinner != nil || a.b.config.RecreationLimits.enabled()) && block.NumberU64() > 0 {
+		// go through StateAtBlock, so that the parent state may be served from or become pinned,
+		// and its recreation is checked against the recreation limits
+		parent := a.BlockChain().GetBlock(block.ParentHash(), block.NumberU64()-1)
+		if parent == nil {
+			return nil, vm.BlockContext{}, nil, nil, fmt.Errorf("parent %#x not found", block.ParentHash())
+		}
+		statedb, release, err := a.StateAtBlock(ctx, parent, reexec, nil, true, false)
+		if err != nil {
+			return nil, vm.BlockContext{}, nil, nil, err
+		}
+		return a.b.ethereum.StateAtTransactionFromParent(ctx, block, txIndex, statedb, release)
+	}
+	return a.b.ethereum.StateAtTransaction(ctx, block, txIndex, reexec)
 }
 
 func (a *APIBackend) GetReceipts(ctx context.Context, hash common.Hash) (types.Receipts, error) {
@@ -583,6 +788,14 @@ func (a *APIBackend) GetLogs(ctx context.Context, hash common.Hash, number uint6
 	return rawdb.ReadLogs(a.ChainDb(), hash, number, a.ChainConfig()), nil
 }
 
+func (a *APIBackend) HeadersByRange(ctx context.Context, from, count uint64) ([]*types.Header, error) {
+	return a.BlockChain().GetHeadersByRange(from, count), nil
+}
+
+func (a *APIBackend) ReceiptsByRange(ctx context.Context, from, count uint64) ([]types.Receipts, error) {
+	return a.BlockChain().GetReceiptsByRange(from, count), nil
+}
+
 func (a *APIBackend) ServiceFilter(ctx context.Context, session *bloombits.MatcherSession) {
 	for i := 0; i < bloomFilterThreads; i++ {
 		go session.Multiplex(bloomRetrievalBatch, bloomRetrievalWait, a.b.bloomRequests)
@@ -617,3 +830,7 @@ func (b *APIBackend) PendingBlockAndReceipts() (*types.Block, types.Receipts) {
 func (b *APIBackend) FallbackClient() types.FallbackClient {
 	return b.fallbackClient
 }
+
+func (b *APIBackend) CallCache() *ethapi.CallCache {
+	return b.callCache
+}
@@ -0,0 +1,289 @@
+package arbitrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+// ArbAPI offers arbitrum specific RPC methods
+type ArbAPI struct {
+	b *APIBackend
+}
+
+func NewArbAPI(b *APIBackend) *ArbAPI {
+	return &ArbAPI{b}
+}
+
+type BlockGasBreakdown struct {
+	Number            hexutil.Uint64 `json:"number"`
+	Hash              common.Hash    `json:"hash"`
+	TxCount           hexutil.Uint64 `json:"txCount"`
+	GasUsed           hexutil.Uint64 `json:"gasUsed"`
+	GasUsedForL1      hexutil.Uint64 `json:"gasUsedForL1"`
+	GasUsedForL2      hexutil.Uint64 `json:"gasUsedForL2"`
+	BaseFee           *hexutil.Big   `json:"baseFee"`
+	L1FeesPaid        *hexutil.Big   `json:"l1FeesPaid"`
+	L1BaseFeeEstimate *hexutil.Big   `json:"l1BaseFeeEstimate,omitempty"`
+}
+
+// GetBlockGasBreakdown returns the split between L1 and L2 gas used in a block, computed from its receipts
+func (api *ArbAPI) GetBlockGasBreakdown(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash) (*BlockGasBreakdown, error) {
+	header, err := api.b.HeaderByNumberOrHash(ctx, blockNrOrHash)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, errors.New("header not found")
+	}
+	return api.gasBreakdown(header)
+}
+
+// GetBlockRangeGasBreakdown returns the gas breakdown of each block in the inclusive range [fromBlock, toBlock]
+func (api *ArbAPI) GetBlockRangeGasBreakdown(ctx context.Context, fromBlock, toBlock rpc.BlockNumber) ([]*BlockGasBreakdown, error) {
+	from, err := api.b.blockNumberToUint(ctx, fromBlock)
+	if err != nil {
+		return nil, err
+	}
+	to, err := api.b.blockNumberToUint(ctx, toBlock)
+	if err != nil {
+		return nil, err
+	}
+	if from > to {
+		return nil, fmt.Errorf("invalid block range: from %d is after to %d", from, to)
+	}
+	if limit := api.b.b.config.GasBreakdownMaxBlockCount; limit > 0 && to-from+1 > limit {
+		return nil, fmt.Errorf("block range too large: %d blocks requested, limit is %d", to-from+1, limit)
+	}
+	results := make([]*BlockGasBreakdown, 0, to-from+1)
+	for number := from; number <= to; number++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		header := api.b.BlockChain().GetHeaderByNumber(number)
+		if header == nil {
+			return nil, fmt.Errorf("header not found for block %d", number)
+		}
+		breakdown, err := api.gasBreakdown(header)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, breakdown)
+	}
+	return results, nil
+}
+
+type RawBlockTransactions struct {
+	Number       hexutil.Uint64  `json:"number"`
+	Hash         common.Hash     `json:"hash"`
+	Transactions []hexutil.Bytes `json:"transactions"`
+	Receipts     []hexutil.Bytes `json:"receipts,omitempty"`
+}
+
+type RawTransactionsResult struct {
+	Blocks []*RawBlockTransactions `json:"blocks"`
+	// Next is the first block of the range not returned because of the response size limit, if any
+	Next *hexutil.Uint64 `json:"next,omitempty"`
+}
+
+// GetRawTransactionsByBlock returns the binary encoded transactions, and optionally receipts, of each block in the
+// inclusive range [fromBlock, toBlock]. Once the response size limit is reached the remaining blocks are left out,
+// and the first of them is reported so that the caller can resume from there. The first block is always returned.
+func (api *ArbAPI) GetRawTransactionsByBlock(ctx context.Context, fromBlock, toBlock rpc.BlockNumber, includeReceipts *bool) (*RawTransactionsResult, error) {
+	from, err := api.b.blockNumberToUint(ctx, fromBlock)
+	if err != nil {
+		return nil, err
+	}
+	to, err := api.b.blockNumberToUint(ctx, toBlock)
+	if err != nil {
+		return nil, err
+	}
+	if from > to {
+		return nil, fmt.Errorf("invalid block range: from %d is after to %d", from, to)
+	}
+	config := api.b.b.config
+	if limit := config.RawTransactionsMaxBlockCount; limit > 0 && to-from+1 > limit {
+		return nil, fmt.Errorf("block range too large: %d blocks requested, limit is %d", to-from+1, limit)
+	}
+	withReceipts := includeReceipts != nil && *includeReceipts
+	bc := api.b.BlockChain()
+	result := &RawTransactionsResult{Blocks: make([]*RawBlockTransactions, 0, to-from+1)}
+	var size uint64
+	for number := from; number <= to; number++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		block := bc.GetBlockByNumber(number)
+		if block == nil {
+			return nil, fmt.Errorf("block %d not found", number)
+		}
+		raw := &RawBlockTransactions{
+			Number:       hexutil.Uint64(number),
+			Hash:         block.Hash(),
+			Transactions: make([]hexutil.Bytes, 0, len(block.Transactions())),
+		}
+		var blockSize uint64
+		for _, tx := range block.Transactions() {
+			enc, err := tx.MarshalBinary()
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode transaction %v: %w", tx.Hash(), err)
+			}
+			raw.Transactions = append(raw.Transactions, enc)
+			blockSize += uint64(len(enc))
+		}
+		if withReceipts {
+			receipts := bc.GetReceiptsByHash(block.Hash())
+			if receipts == nil {
+				return nil, fmt.Errorf("failed to get receipts for block %d hash %v", number, block.Hash())
+			}
+			raw.Receipts = make([]hexutil.Bytes, 0, len(receipts))
+			for _, receipt := range receipts {
+				enc, err := receipt.MarshalBinary()
+				if err != nil {
+					return nil, fmt.Errorf("failed to encode receipt of transaction %v: %w", receipt.TxHash, err)
+				}
+				raw.Receipts = append(raw.Receipts, enc)
+				blockSize += uint64(len(enc))
+			}
+		}
+		if limit := config.RawTransactionsMaxResponseSize; limit > 0 && number > from && size+blockSize > limit {
+			next := hexutil.Uint64(number)
+			result.Next = &next
+			break
+		}
+		size += blockSize
+		result.Blocks = append(result.Blocks, raw)
+	}
+	return result, nil
+}
+
+type SequencerQueueStatusResult struct {
+	QueueDepth              hexutil.Uint64 `json:"queueDepth"`
+	EstimatedInclusionDelay float64        `json:"estimatedInclusionDelaySeconds"`
+	InboxBatchCount         hexutil.Uint64 `json:"inboxBatchCount"`
+	InboxMessageCount       hexutil.Uint64 `json:"inboxMessageCount"`
+	L1BlockNumber           hexutil.Uint64 `json:"l1BlockNumber"`
+}
+
+// SequencerQueueStatus reports the sequencer queue depth, the estimated inclusion delay of a transaction submitted now,
+// and the latest L1 inbox position known to the node, so that submitters can route transactions based on congestion
+func (api *ArbAPI) SequencerQueueStatus(ctx context.Context) (*SequencerQueueStatusResult, error) {
+	status, err := api.b.b.arb.SequencerQueueStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if status == nil {
+		return nil, errors.New("sequencer queue status not available")
+	}
+	return &SequencerQueueStatusResult{
+		QueueDepth:              hexutil.Uint64(status.QueueDepth),
+		EstimatedInclusionDelay: status.InclusionDelay.Seconds(),
+		InboxBatchCount:         hexutil.Uint64(status.InboxBatchCount),
+		InboxMessageCount:       hexutil.Uint64(status.InboxMessageCount),
+		L1BlockNumber:           hexutil.Uint64(status.L1BlockNumber),
+	}, nil
+}
+
+// PinnedTracedStates lists the recreated states currently pinned because their blocks are frequently traced
+func (api *ArbAPI) PinnedTracedStates(ctx context.Context) ([]PinnedTracedState, error) {
+	pinner := api.b.b.statePinner
+	if pinner == nil {
+		return nil, errors.New("traced state pinning not enabled")
+	}
+	return pinner.list(), nil
+}
+
+// blockFees sums up the gas and fees of the receipts of a block
+type blockFees struct {
+	gasUsed      uint64
+	gasUsedForL1 uint64
+	gasUsedForL2 uint64
+	l1FeesPaid   *big.Int
+	feesPaid     *big.Int
+}
+
+func sumBlockFees(receipts types.Receipts) *blockFees {
+	fees := &blockFees{l1FeesPaid: new(big.Int), feesPaid: new(big.Int)}
+	for _, receipt := range receipts {
+		fees.gasUsed += receipt.GasUsed
+		fees.gasUsedForL1 += receipt.GasUsedForL1
+		if receipt.GasUsed > receipt.GasUsedForL1 {
+			fees.gasUsedForL2 += receipt.GasUsed - receipt.GasUsedForL1
+		}
+		if receipt.EffectiveGasPrice != nil {
+			fee := new(big.Int).SetUint64(receipt.GasUsedForL1)
+			fees.l1FeesPaid.Add(fees.l1FeesPaid, fee.Mul(fee, receipt.EffectiveGasPrice))
+			fee = new(big.Int).SetUint64(receipt.GasUsed)
+			fees.feesPaid.Add(fees.feesPaid, fee.Mul(fee, receipt.EffectiveGasPrice))
+		}
+	}
+	return fees
+}
+
+func (api *ArbAPI) gasBreakdown(header *types.Header) (*BlockGasBreakdown, error) {
+	bc := api.b.BlockChain()
+	receipts := bc.GetReceiptsByHash(header.Hash())
+	if receipts == nil {
+		return nil, fmt.Errorf("failed to get receipts for block %d hash %v", header.Number, header.Hash())
+	}
+	fees := sumBlockFees(receipts)
+	breakdown := &BlockGasBreakdown{
+		Number:       hexutil.Uint64(header.Number.Uint64()),
+		Hash:         header.Hash(),
+		TxCount:      hexutil.Uint64(len(receipts)),
+		GasUsed:      hexutil.Uint64(fees.gasUsed),
+		GasUsedForL1: hexutil.Uint64(fees.gasUsedForL1),
+		GasUsedForL2: hexutil.Uint64(fees.gasUsedForL2),
+		BaseFee:      (*hexutil.Big)(header.BaseFee),
+		L1FeesPaid:   (*hexutil.Big)(fees.l1FeesPaid),
+	}
+	// the L1 base fee estimate the block's transactions were charged with is the one of its parent's state, it's only
+	// reported when that state is readily available
+	if parent := bc.GetHeader(header.ParentHash, header.Number.Uint64()-1); parent != nil && core.GetArbOSL1PricePerUnit != nil {
+		if statedb, err := bc.StateAt(parent.Root); err == nil {
+			if l1BaseFee, err := core.GetArbOSL1PricePerUnit(statedb); err == nil {
+				breakdown.L1BaseFeeEstimate = (*hexutil.Big)(l1BaseFee)
+			}
+		}
+	}
+	return breakdown, nil
+}
+
+type L1ConfirmedBlock struct {
+	Number        hexutil.Uint64  `json:"number"`
+	Hash          common.Hash     `json:"hash"`
+	L1BlockNumber *hexutil.Uint64 `json:"l1BlockNumber,omitempty"`
+}
+
+type L1ConfirmedHeads struct {
+	Safe      *L1ConfirmedBlock `json:"safe"`
+	Finalized *L1ConfirmedBlock `json:"finalized"`
+}
+
+// GetL1ConfirmedHeads returns the safe and finalized blocks, along with the L1 blocks confirming them when set by L1
+func (api *ArbAPI) GetL1ConfirmedHeads() *L1ConfirmedHeads {
+	bc := api.b.BlockChain()
+	confirmed := func(header *types.Header, l1BlockNumber uint64, ok bool) *L1ConfirmedBlock {
+		if header == nil {
+			return nil
+		}
+		block := &L1ConfirmedBlock{Number: hexutil.Uint64(header.Number.Uint64()), Hash: header.Hash()}
+		if ok {
+			block.L1BlockNumber = (*hexutil.Uint64)(&l1BlockNumber)
+		}
+		return block
+	}
+	safeL1, safeOk := bc.SafeL1BlockNumber()
+	finalL1, finalOk := bc.FinalizedL1BlockNumber()
+	return &L1ConfirmedHeads{
+		Safe:      confirmed(bc.CurrentSafeBlock(), safeL1, safeOk),
+		Finalized: confirmed(bc.CurrentFinalBlock(), finalL1, finalOk),
+	}
+}
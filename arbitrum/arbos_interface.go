@@ -2,9 +2,11 @@ package arbitrum
 
 import (
 	"context"
+	"time"
 
 	"github.com/chainupcloud/arb-geth/arbitrum_types"
 	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/state"
 	"github.com/chainupcloud/arb-geth/core/types"
 )
 
@@ -12,4 +14,25 @@ type ArbInterface interface {
 	PublishTransaction(ctx context.Context, tx *types.Transaction, options *arbitrum_types.ConditionalOptions) error
 	BlockChain() *core.BlockChain
 	ArbNode() interface{}
+	// SequencerQueueStatus reports the congestion of the sequencer and the latest L1 inbox position the node knows about.
+	// Nodes not sequencing transactions themselves may return an error.
+	SequencerQueueStatus(ctx context.Context) (*SequencerQueueStatus, error)
+}
+
+// PendingStateProvider may be implemented by the ArbInterface of a sequencer, so that requests for the pending block
+// state see the transactions it accepted but didn't seal into a block yet, instead of the latest block state
+type PendingStateProvider interface {
+	// PendingState returns the header the pending block is being built with, and a copy of the state after the
+	// transactions accepted so far which the caller may modify freely. Both are nil if no block is being built.
+	PendingState(ctx context.Context) (*types.Header, *state.StateDB, error)
+}
+
+type SequencerQueueStatus struct {
+	QueueDepth     uint64        // transactions queued but not sequenced yet
+	InclusionDelay time.Duration // estimated time before a transaction submitted now gets sequenced
+
+	// latest position of the L1 inbox read by the node
+	InboxBatchCount   uint64 // sequencer batches posted to the inbox
+	InboxMessageCount uint64 // messages, including delayed ones, covered by those batches
+	L1BlockNumber     uint64 // L1 block the position was read at
 }
@@ -0,0 +1,105 @@
+package arbitrum
+
+import (
+	"context"
+	"errors"
+	"math/big"
+
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/internal/ethapi"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+// ArbOSVersionExecution is the outcome of executing a transaction under the rules of an ArbOS version
+type ArbOSVersionExecution struct {
+	ArbOSVersion hexutil.Uint64 `json:"arbOSVersion"`
+	GasUsed      hexutil.Uint64 `json:"gasUsed"`
+	Fee          *hexutil.Big   `json:"fee"` // gas used priced at the block's base fee, tips aren't paid on Arbitrum
+	Failed       bool           `json:"failed"`
+	Error        string         `json:"error,omitempty"`
+	ReturnData   hexutil.Bytes  `json:"returnData"`
+}
+
+// ArbOSVersionComparison reports how executing the same transaction at the same state differs between two ArbOS versions
+type ArbOSVersionComparison struct {
+	BlockNumber  hexutil.Uint64         `json:"blockNumber"`
+	BaseFee      *hexutil.Big           `json:"baseFee"`
+	From         *ArbOSVersionExecution `json:"from"`
+	To           *ArbOSVersionExecution `json:"to"`
+	GasUsedDelta *hexutil.Big           `json:"gasUsedDelta"` // to minus from, may be negative
+	FeeDelta     *hexutil.Big           `json:"feeDelta"`
+	SameOutcome  bool                   `json:"sameOutcome"` // whether both succeeded or failed alike and returned the same data
+}
+
+// CompareArbOSVersions executes the transaction at the state of the given block (latest by default) under the rules
+// of two ArbOS versions, and reports the differences in gas used and fees, e.g. to estimate the impact of an upgrade
+func (api *ArbAPI) CompareArbOSVersions(ctx context.Context, args ethapi.TransactionArgs, fromVersion, toVersion hexutil.Uint64, blockNrOrHash *rpc.BlockNumberOrHash) (*ArbOSVersionComparison, error) {
+	if core.OverrideArbOSVersion == nil {
+		return nil, errors.New("simulating other ArbOS versions is not supported by this node")
+	}
+	bNrOrHash := rpc.BlockNumberOrHashWithNumber(rpc.LatestBlockNumber)
+	if blockNrOrHash != nil {
+		bNrOrHash = *blockNrOrHash
+	}
+	header, err := api.b.HeaderByNumberOrHash(ctx, bNrOrHash)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, errors.New("header not found")
+	}
+	// pin the block by hash, so both executions start from the same state
+	bNrOrHash = rpc.BlockNumberOrHashWithHash(header.Hash(), false)
+	baseFee := header.BaseFee
+	if baseFee == nil {
+		baseFee = new(big.Int)
+	}
+
+	from, err := api.b.executeAtArbOSVersion(ctx, args, bNrOrHash, uint64(fromVersion), baseFee)
+	if err != nil {
+		return nil, err
+	}
+	to, err := api.b.executeAtArbOSVersion(ctx, args, bNrOrHash, uint64(toVersion), baseFee)
+	if err != nil {
+		return nil, err
+	}
+	gasUsedDelta := new(big.Int).Sub(new(big.Int).SetUint64(uint64(to.GasUsed)), new(big.Int).SetUint64(uint64(from.GasUsed)))
+	feeDelta := new(big.Int).Sub(to.Fee.ToInt(), from.Fee.ToInt())
+	return &ArbOSVersionComparison{
+		BlockNumber:  hexutil.Uint64(header.Number.Uint64()),
+		BaseFee:      (*hexutil.Big)(baseFee),
+		From:         from,
+		To:           to,
+		GasUsedDelta: (*hexutil.Big)(gasUsedDelta),
+		FeeDelta:     (*hexutil.Big)(feeDelta),
+		SameOutcome:  from.Failed == to.Failed && from.Error == to.Error && string(from.ReturnData) == string(to.ReturnData),
+	}, nil
+}
+
+func (a *APIBackend) executeAtArbOSVersion(ctx context.Context, args ethapi.TransactionArgs, blockNrOrHash rpc.BlockNumberOrHash, version uint64, baseFee *big.Int) (*ArbOSVersionExecution, error) {
+	arbOSVersion := hexutil.Uint64(version)
+	overrides := &ethapi.BlockOverrides{ArbOSVersion: &arbOSVersion}
+	// gas estimation mode charges the L1 costs of the transaction like it would be when sequenced
+	result, err := ethapi.DoCall(ctx, a, args, blockNrOrHash, nil, overrides, a.RPCEVMTimeout(), a.RPCGasCap(), core.MessageGasEstimationMode)
+	if err != nil && result == nil {
+		return nil, err
+	}
+	execution := &ArbOSVersionExecution{
+		ArbOSVersion: arbOSVersion,
+		GasUsed:      hexutil.Uint64(result.UsedGas),
+		Fee:          (*hexutil.Big)(new(big.Int).Mul(new(big.Int).SetUint64(result.UsedGas), baseFee)),
+		Failed:       err != nil || result.Failed(),
+		ReturnData:   result.Return(),
+	}
+	switch {
+	case err != nil:
+		execution.Error = err.Error()
+	case len(result.Revert()) > 0:
+		execution.Error = NewRevertReason(result).Error()
+		execution.ReturnData = result.Revert()
+	case result.Err != nil:
+		execution.Error = result.Err.Error()
+	}
+	return execution, nil
+}
@@ -2,16 +2,27 @@ package arbitrum
 
 import (
 	"context"
+	"errors"
+	"sync/atomic"
+	"time"
 
 	"github.com/chainupcloud/arb-geth/arbitrum_types"
 	"github.com/chainupcloud/arb-geth/core"
 	"github.com/chainupcloud/arb-geth/core/bloombits"
+	"github.com/chainupcloud/arb-geth/core/logindex"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
 	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/eth"
+	"github.com/chainupcloud/arb-geth/eth/ethconfig"
 	"github.com/chainupcloud/arb-geth/eth/filters"
+	"github.com/chainupcloud/arb-geth/eth/tracers/plugin"
 	"github.com/chainupcloud/arb-geth/ethdb"
 	"github.com/chainupcloud/arb-geth/event"
+	"github.com/chainupcloud/arb-geth/internal/quota"
 	"github.com/chainupcloud/arb-geth/internal/shutdowncheck"
 	"github.com/chainupcloud/arb-geth/node"
+	"github.com/chainupcloud/arb-geth/node/grpcstream"
+	"github.com/chainupcloud/arb-geth/rpc"
 )
 
 type Backend struct {
@@ -21,13 +32,33 @@ type Backend struct {
 	config     *Config
 	chainDb    ethdb.Database
 
-	txFeed event.Feed
-	scope  event.SubscriptionScope
+	txFeed        event.Feed
+	droppedTxFeed event.Feed
+	publishedTxs  *publishedTxs // Accepted transactions not sequenced yet
+	scope         event.SubscriptionScope
 
 	bloomRequests chan chan *bloombits.Retrieval // Channel receiving bloom data retrieval requests
 	bloomIndexer  *core.ChainIndexer             // Bloom indexer operating during block imports
+	logIndexer    *logindex.Indexer              // Log index following the chain, if enabled
+
+	ethereum *eth.Ethereum // eth backend around the blockchain, used for state recreation
 
 	shutdownTracker *shutdowncheck.ShutdownTracker
+	chainGapChecker *chainGapChecker
+	sideChainPruner *sideChainPruner
+	statePinner     *tracedStatePinner
+	receiptFormat   *receiptFormat
+	accountWatches  *accountWatches
+	grpcStream      *grpcstream.Server
+
+	stateMirrorSource   *stateMirrorSource
+	stateMirrorFollower *stateMirrorFollower
+
+	recreationThroughput *recreationThroughput
+	recreationBacklog    *recreationBacklog
+	recreationJobs       *recreationJobs
+	slowQueries          *slowQueryLog
+	preparingShutdown    atomic.Bool
 
 	chanTxs      chan *types.Transaction
 	chanClose    chan struct{} //close coroutine
@@ -45,6 +76,12 @@ func NewBackend(stack *node.Node, config *Config, chainDb ethdb.Database, publis
 		bloomIndexer:  core.NewBloomIndexer(chainDb, config.BloomBitsBlocks, config.BloomConfirms),
 
 		shutdownTracker: shutdowncheck.NewShutdownTracker(chainDb),
+		accountWatches:  newAccountWatches(),
+		publishedTxs:    newPublishedTxs(),
+
+		recreationThroughput: &recreationThroughput{},
+		recreationBacklog:    &recreationBacklog{},
+		recreationJobs:       newRecreationJobs(),
 
 		chanTxs:      make(chan *types.Transaction, 100),
 		chanClose:    make(chan struct{}),
@@ -59,11 +96,127 @@ func NewBackend(stack *node.Node, config *Config, chainDb ethdb.Database, publis
 		backend.stack.ApplyAPIFilter(rpcFilter)
 	}
 
+	if err := plugin.LoadAll(config.TracerPlugins.Paths, config.TracerPlugins.Limits()); err != nil {
+		return nil, nil, err
+	}
+
+	if config.ChainGapCheck.Enable {
+		backend.chainGapChecker = newChainGapChecker(&config.ChainGapCheck, backend.arb.BlockChain())
+	}
+
+	if config.SideChainPruning.Enable {
+		if err := config.SideChainPruning.Validate(); err != nil {
+			return nil, nil, err
+		}
+		backend.sideChainPruner = newSideChainPruner(&config.SideChainPruning, backend.arb.BlockChain())
+	}
+
+	if config.TracedStatePinning.Enable {
+		backend.statePinner = newTracedStatePinner(&config.TracedStatePinning)
+	}
+
+	if config.StateMirror.Serve {
+		backend.stateMirrorSource = newStateMirrorSource(&config.StateMirror, backend.arb.BlockChain())
+	}
+
+	if config.StateMirror.Source != "" {
+		follower, err := newStateMirrorFollower(&config.StateMirror, backend.arb.BlockChain())
+		if err != nil {
+			return nil, nil, err
+		}
+		backend.stateMirrorFollower = follower
+	}
+
+	if err := config.RecreationSnapshotSlice.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	if config.SnapshotThrottle.Enable {
+		if err := config.SnapshotThrottle.Validate(); err != nil {
+			return nil, nil, err
+		}
+		if snaps := backend.arb.BlockChain().Snapshots(); snaps != nil {
+			snaps.SetGenerationThrottle(newSnapshotThrottle(&config.SnapshotThrottle, rpc.Load))
+		}
+	}
+
+	if config.LogIndex.Enable {
+		backend.logIndexer = newLogIndexer(&config.LogIndex, chainDb, backend.arb.BlockChain())
+	}
+
+	if config.CodeIndex.Enable {
+		backend.arb.BlockChain().SetCodeIndexing(true)
+	}
+
+	if config.TransferIndex.Enable {
+		backend.arb.BlockChain().SetTransferIndexing(true, config.TransferIndex.Retention)
+	}
+
+	if workers := config.ParallelExecution.workers(); workers > 1 {
+		backend.arb.BlockChain().SetParallelExecution(workers)
+	}
+
+	for _, path := range config.RevertDecoding.ErrorABIs {
+		if err := defaultRevertDecoder.RegisterFile(path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	receiptFormat, err := setupReceiptFormat(&config.ReceiptFormat, chainDb, backend.arb.BlockChain())
+	if err != nil {
+		return nil, nil, err
+	}
+	backend.receiptFormat = receiptFormat
+
+	if config.Quota.Enable {
+		engine, err := config.Quota.engine()
+		if err != nil {
+			return nil, nil, err
+		}
+		quota.SetDefault(engine)
+	}
+
+	if config.SlowQuery.Enable {
+		if err := config.SlowQuery.Validate(); err != nil {
+			return nil, nil, err
+		}
+		backend.slowQueries = newSlowQueryLog(&config.SlowQuery)
+		rpc.SetCallObserver(backend.slowQueries.observe)
+	}
+
+	backend.ethereum = eth.NewArbEthereum(backend.arb.BlockChain(), chainDb, &eth.ArbEthereumConfig{
+		GPO:                 ethconfig.Defaults.GPO,
+		RPCGasCap:           config.RPCGasCap,
+		RPCEVMTimeout:       config.RPCEVMTimeout,
+		RPCTxFeeCap:         config.RPCTxFeeCap,
+		FilterLogCacheSize:  config.FilterLogCacheSize,
+		AllowUnprotectedTxs: config.TxAllowUnprotected,
+		ExtRPCEnabled:       stack.Config().ExtRPCEnabled(),
+		BloomIndexer:        backend.bloomIndexer,
+		BloomRequests:       backend.bloomRequests,
+	})
+
 	backend.bloomIndexer.Start(backend.arb.BlockChain())
 	filterSystem, err := createRegisterAPIBackend(backend, filterConfig, config.ClassicRedirect, config.ClassicRedirectTimeout)
 	if err != nil {
 		return nil, nil, err
 	}
+	if err := config.Health.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if config.Health.Enable {
+		stack.RegisterHandler("Arbitrum health", config.Health.Path, &healthHandler{backend.apiBackend})
+	}
+	if err := config.AncientsServer.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if config.AncientsServer.Enable {
+		path, handler := ancientsHandler(&config.AncientsServer, rawdb.RemoteAncientsHandler(chainDb))
+		stack.RegisterHandler("Arbitrum ancients", path, handler)
+	}
+	if config.GRPCStream.Enable {
+		backend.grpcStream = newGRPCStreamServer(&config.GRPCStream, backend.apiBackend)
+	}
 	return backend, filterSystem, nil
 }
 
@@ -76,7 +229,15 @@ func (b *Backend) ChainDb() ethdb.Database {
 }
 
 func (b *Backend) EnqueueL2Message(ctx context.Context, tx *types.Transaction, options *arbitrum_types.ConditionalOptions) error {
-	return b.arb.PublishTransaction(ctx, tx, options)
+	err := b.arb.PublishTransaction(ctx, tx, options)
+	// a transaction the client gave up waiting for may still be sequenced
+	if err != nil && !errors.Is(err, context.Canceled) {
+		b.ReportDroppedTransaction(tx, dropReason(err), err)
+	}
+	if err == nil {
+		b.publishedTxs.add(tx, time.Now())
+	}
+	return err
 }
 
 func (b *Backend) SubscribeNewTxsEvent(ch chan<- core.NewTxsEvent) event.Subscription {
@@ -96,6 +257,34 @@ func (b *Backend) Start() error {
 	b.startBloomHandlers(b.config.BloomBitsBlocks)
 	b.shutdownTracker.MarkStartup()
 	b.shutdownTracker.Start()
+	if b.chainGapChecker != nil {
+		b.chainGapChecker.start(b.chanClose)
+	}
+	if b.sideChainPruner != nil {
+		b.sideChainPruner.start(b.chanClose)
+	}
+	if b.stateMirrorSource != nil {
+		b.stateMirrorSource.start(b.chanClose)
+	}
+	if b.stateMirrorFollower != nil {
+		b.stateMirrorFollower.start(b.chanClose)
+	}
+	if b.logIndexer != nil {
+		b.logIndexer.Start()
+	}
+	b.receiptFormat.start(b.chanClose)
+	b.trackPublishedTxs(b.chanClose)
+	if b.config.CodeIndex.Enable && b.config.CodeIndex.Backfill {
+		startCodeIndexBackfill(&b.config.CodeIndex, b.arb.BlockChain(), b.chanClose)
+	}
+	if cache := b.apiBackend.CallCache(); cache != nil {
+		pruneCallCache(cache, b.arb.BlockChain(), b.chanClose)
+	}
+	if b.grpcStream != nil {
+		if err := b.grpcStream.Start(); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -104,6 +293,19 @@ func (b *Backend) Stop() error {
 	b.scope.Close()
 	b.bloomIndexer.Close()
 	b.shutdownTracker.Stop()
+	if b.statePinner != nil {
+		b.statePinner.close()
+	}
+	if b.logIndexer != nil {
+		b.logIndexer.Stop()
+	}
+	if b.grpcStream != nil {
+		b.grpcStream.Stop()
+	}
+	quota.SetDefault(nil)
+	if b.slowQueries != nil {
+		rpc.SetCallObserver(nil)
+	}
 	b.chainDb.Close()
 	close(b.chanClose)
 	return nil
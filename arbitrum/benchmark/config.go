@@ -0,0 +1,125 @@
+package benchmark
+
+import (
+	"errors"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/arbitrum"
+	flag "github.com/spf13/pflag"
+)
+
+// Config selects the captured blocks to replay, the cache and database settings to replay them
+// with, and the load generated against the RPC server afterwards
+type Config struct {
+	EraFiles  []string `koanf:"era-files"`
+	BatchSize int      `koanf:"batch-size"`
+
+	Database DatabaseConfig   `koanf:"database"`
+	Cache    CacheConfig      `koanf:"cache"`
+	RPC      RPCLoadConfig    `koanf:"rpc"`
+	Recreate RecreationConfig `koanf:"recreation"`
+}
+
+type DatabaseConfig struct {
+	// Directory of the database to replay onto, it must hold the state of the block preceding the captured span
+	Directory string `koanf:"directory"`
+	Ancient   string `koanf:"ancient"`
+	Engine    string `koanf:"engine"`
+	Cache     int    `koanf:"cache"`
+	Handles   int    `koanf:"handles"`
+}
+
+type CacheConfig struct {
+	TrieCleanCache int           `koanf:"trie-clean-cache"`
+	TrieDirtyCache int           `koanf:"trie-dirty-cache"`
+	TrieTimeLimit  time.Duration `koanf:"trie-time-limit"`
+	SnapshotCache  int           `koanf:"snapshot-cache"`
+	TriesInMemory  uint64        `koanf:"tries-in-memory"`
+	Archive        bool          `koanf:"archive"`
+	CommitWorkers  int           `koanf:"commit-workers"`
+	CodeCache      int           `koanf:"code-cache"`
+	CodeAdmission  bool          `koanf:"code-admission"`
+}
+
+type RPCLoadConfig struct {
+	// URL of a node serving the captured span to load, no load is generated if empty
+	URL         string        `koanf:"url"`
+	Concurrency int           `koanf:"concurrency"`
+	Duration    time.Duration `koanf:"duration"`
+	Methods     []string      `koanf:"methods"`
+}
+
+type RecreationConfig struct {
+	// Number of blocks of the captured span to recreate the state of, evenly spread
+	Samples         int   `koanf:"samples"`
+	MaxDepth        int64 `koanf:"max-depth"`
+	PrefetchWorkers int   `koanf:"prefetch-workers"`
+}
+
+var DefaultConfig = Config{
+	BatchSize: 256,
+	Database: DatabaseConfig{
+		Cache:   2048,
+		Handles: 512,
+	},
+	Cache: CacheConfig{
+		TrieCleanCache: 600,
+		TrieDirtyCache: 1024,
+		TrieTimeLimit:  time.Hour,
+		SnapshotCache:  400,
+		TriesInMemory:  128,
+		CodeCache:      64,
+		CodeAdmission:  true,
+	},
+	RPC: RPCLoadConfig{
+		Concurrency: 16,
+		Duration:    time.Minute,
+		Methods:     []string{"eth_blockNumber", "eth_getBlockByNumber", "eth_getBalance", "eth_getTransactionReceipt"},
+	},
+	Recreate: RecreationConfig{
+		Samples:  8,
+		MaxDepth: arbitrum.InfiniteMaxRecreateStateDepth,
+	},
+}
+
+func ConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.StringSlice(prefix+".era-files", DefaultConfig.EraFiles, "era1 files holding the captured span of blocks to replay, in order")
+	f.Int(prefix+".batch-size", DefaultConfig.BatchSize, "number of blocks imported at once")
+	f.String(prefix+".database.directory", DefaultConfig.Database.Directory, "database to replay onto, holding the state of the block preceding the captured span")
+	f.String(prefix+".database.ancient", DefaultConfig.Database.Ancient, "ancient store of the database (default = inside the database directory)")
+	f.String(prefix+".database.engine", DefaultConfig.Database.Engine, "database engine, leveldb or pebble (default = the one of the existing database)")
+	f.Int(prefix+".database.cache", DefaultConfig.Database.Cache, "database cache in MB")
+	f.Int(prefix+".database.handles", DefaultConfig.Database.Handles, "number of files the database may keep open")
+	f.Int(prefix+".cache.trie-clean-cache", DefaultConfig.Cache.TrieCleanCache, "clean trie cache in MB")
+	f.Int(prefix+".cache.trie-dirty-cache", DefaultConfig.Cache.TrieDirtyCache, "dirty trie cache in MB")
+	f.Duration(prefix+".cache.trie-time-limit", DefaultConfig.Cache.TrieTimeLimit, "maximum block processing time before the dirty tries are flushed")
+	f.Int(prefix+".cache.snapshot-cache", DefaultConfig.Cache.SnapshotCache, "snapshot cache in MB (0=snapshots disabled)")
+	f.Uint64(prefix+".cache.tries-in-memory", DefaultConfig.Cache.TriesInMemory, "number of recent block states kept in memory")
+	f.Bool(prefix+".cache.archive", DefaultConfig.Cache.Archive, "persist the state of every block")
+	f.Int(prefix+".cache.commit-workers", DefaultConfig.Cache.CommitWorkers, "number of goroutines committing storage tries in parallel with the rest of the state commit (0 or 1=sequential commit)")
+	f.Int(prefix+".cache.code-cache", DefaultConfig.Cache.CodeCache, "contract code cache in MB")
+	f.Bool(prefix+".cache.code-admission", DefaultConfig.Cache.CodeAdmission, "only cache the codes read more often than the codes they'd evict")
+	f.String(prefix+".rpc.url", DefaultConfig.RPC.URL, "RPC server to generate load against after the replay (empty = no load)")
+	f.Int(prefix+".rpc.concurrency", DefaultConfig.RPC.Concurrency, "number of concurrent RPC clients")
+	f.Duration(prefix+".rpc.duration", DefaultConfig.RPC.Duration, "duration of the RPC load")
+	f.StringSlice(prefix+".rpc.methods", DefaultConfig.RPC.Methods, "RPC methods called by the synthetic load")
+	f.Int(prefix+".recreation.samples", DefaultConfig.Recreate.Samples, "number of blocks of the replayed span to recreate the state of (0=no recreation)")
+	f.Int64(prefix+".recreation.max-depth", DefaultConfig.Recreate.MaxDepth, "maximum l2 gas replayed to recreate a state (-1=unlimited)")
+	f.Int(prefix+".recreation.prefetch-workers", DefaultConfig.Recreate.PrefetchWorkers, "number of goroutines prefetching the state read by recreations")
+}
+
+func (c *Config) Validate() error {
+	if len(c.EraFiles) == 0 {
+		return errors.New("no era files to replay")
+	}
+	if c.Database.Directory == "" {
+		return errors.New("no database directory")
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("batch size must be positive")
+	}
+	if c.RPC.URL != "" && c.RPC.Concurrency <= 0 {
+		return errors.New("rpc concurrency must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package benchmark
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/rlp"
+	"github.com/golang/snappy"
+)
+
+// e2store entry types used by era1 files
+const (
+	eraTypeVersion           = 0x3265
+	eraTypeCompressedHeader  = 0x03
+	eraTypeCompressedBody    = 0x04
+	eraTypeCompressedReceipt = 0x05
+	eraTypeTotalDifficulty   = 0x06
+	eraTypeAccumulator       = 0x07
+	eraTypeBlockIndex        = 0x3266
+)
+
+// eraEntryHeaderSize is the size of the header of an e2store entry: type, length and reserved bytes
+const eraEntryHeaderSize = 8
+
+// eraMaxEntrySize bounds the length of an entry, so that a corrupted length doesn't make the reader
+// allocate gigabytes. Compressed blocks are far smaller
+const eraMaxEntrySize = 64 * 1024 * 1024
+
+var errEraMissingBody = errors.New("era header without body")
+
+// eraReader reads the blocks of an era1 file in order.
+// Only the headers and bodies are decoded, the receipts are regenerated by the replay.
+type eraReader struct {
+	r      *bufio.Reader
+	header *types.Header // header waiting for its body
+}
+
+func newEraReader(r io.Reader) *eraReader {
+	return &eraReader{r: bufio.NewReader(r)}
+}
+
+// entry reads the next e2store entry
+func (e *eraReader) entry() (uint16, []byte, error) {
+	var head [eraEntryHeaderSize]byte
+	if _, err := io.ReadFull(e.r, head[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, fmt.Errorf("truncated era entry: %w", err)
+		}
+		return 0, nil, err
+	}
+	typ := binary.LittleEndian.Uint16(head[0:2])
+	length := binary.LittleEndian.Uint32(head[2:6])
+	if reserved := binary.LittleEndian.Uint16(head[6:8]); reserved != 0 {
+		return 0, nil, fmt.Errorf("invalid era entry of type %#x: reserved bytes set", typ)
+	}
+	if length > eraMaxEntrySize {
+		return 0, nil, fmt.Errorf("era entry of type %#x too large: %d bytes, limit %d", typ, length, eraMaxEntrySize)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(e.r, data); err != nil {
+		return 0, nil, fmt.Errorf("truncated era entry of type %#x: %w", typ, err)
+	}
+	return typ, data, nil
+}
+
+// decompress decodes the snappy framed, rlp encoded value of an entry
+func decompress(data []byte, val interface{}) error {
+	return rlp.Decode(snappy.NewReader(bytes.NewReader(data)), val)
+}
+
+// next returns the next block of the file, or io.EOF once all were read
+func (e *eraReader) next() (*types.Block, error) {
+	for {
+		typ, data, err := e.entry()
+		if err == io.EOF {
+			if e.header != nil {
+				return nil, errEraMissingBody
+			}
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case eraTypeCompressedHeader:
+			if e.header != nil {
+				return nil, errEraMissingBody
+			}
+			header := new(types.Header)
+			if err := decompress(data, header); err != nil {
+				return nil, fmt.Errorf("invalid era header: %w", err)
+			}
+			e.header = header
+
+		case eraTypeCompressedBody:
+			if e.header == nil {
+				return nil, errors.New("era body without header")
+			}
+			body := new(types.Body)
+			if err := decompress(data, body); err != nil {
+				return nil, fmt.Errorf("invalid era body of block %d: %w", e.header.Number, err)
+			}
+			block := types.NewBlockWithHeader(e.header).WithBody(body.Transactions, body.Uncles)
+			e.header = nil
+			return block, nil
+
+		case eraTypeVersion, eraTypeCompressedReceipt, eraTypeTotalDifficulty, eraTypeAccumulator, eraTypeBlockIndex:
+			// not needed to replay the blocks
+		default:
+			return nil, fmt.Errorf("unknown era entry type %#x", typ)
+		}
+	}
+}
+
+// readEraFiles calls fn with the blocks of the era files, in the order of the files
+func readEraFiles(paths []string, fn func(*types.Block) error) error {
+	for _, path := range paths {
+		if err := readEraFile(path, fn); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func readEraFile(path string, fn func(*types.Block) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := newEraReader(file)
+	for {
+		block, err := reader.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+}
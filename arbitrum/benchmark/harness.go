@@ -0,0 +1,250 @@
+// Package benchmark replays a captured span of blocks against configurable cache and database
+// settings, and measures the import throughput, the RPC latencies under synthetic load and the
+// state recreation timings, so that performance regressions can be tracked across versions.
+package benchmark
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/arbitrum"
+	"github.com/chainupcloud/arb-geth/consensus"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Report holds the results of a benchmark run
+type Report struct {
+	Import     ImportReport      `json:"import"`
+	RPC        []MethodLatencies `json:"rpc,omitempty"`
+	Recreation *RecreationReport `json:"recreation,omitempty"`
+}
+
+type ImportReport struct {
+	First    uint64        `json:"first"` // first block imported
+	Last     uint64        `json:"last"`  // last block imported
+	Blocks   uint64        `json:"blocks"`
+	Skipped  uint64        `json:"skipped"` // blocks of the span already present in the database
+	Txs      uint64        `json:"txs"`
+	Gas      uint64        `json:"gas"`
+	Duration time.Duration `json:"duration"`
+
+	BlocksPerSecond float64 `json:"blocksPerSecond"`
+	MGasPerSecond   float64 `json:"mgasPerSecond"`
+}
+
+type RecreationReport struct {
+	Samples        []RecreationSample `json:"samples"`
+	Mean           time.Duration      `json:"mean"`
+	Max            time.Duration      `json:"max"`
+	BlocksReplayed uint64             `json:"blocksReplayed"`
+}
+
+type RecreationSample struct {
+	Block    uint64        `json:"block"`
+	From     uint64        `json:"from"` // block the state was recreated from
+	Duration time.Duration `json:"duration"`
+	Err      string        `json:"error,omitempty"`
+}
+
+// Harness runs the benchmark. The consensus engine and the chain config are provided by the
+// caller, as replaying Arbitrum blocks requires the ArbOS engine.
+type Harness struct {
+	config      *Config
+	chainConfig *params.ChainConfig
+	engine      consensus.Engine
+}
+
+func New(config *Config, chainConfig *params.ChainConfig, engine consensus.Engine) (*Harness, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Harness{
+		config:      config,
+		chainConfig: chainConfig,
+		engine:      engine,
+	}, nil
+}
+
+func (h *Harness) openDatabase() (ethdb.Database, error) {
+	return rawdb.Open(rawdb.OpenOptions{
+		Type:              h.config.Database.Engine,
+		Directory:         h.config.Database.Directory,
+		AncientsDirectory: h.config.Database.Ancient,
+		Namespace:         "benchmark/db/",
+		Cache:             h.config.Database.Cache,
+		Handles:           h.config.Database.Handles,
+	})
+}
+
+func (h *Harness) cacheConfig() *core.CacheConfig {
+	return &core.CacheConfig{
+		TrieCleanLimit:    h.config.Cache.TrieCleanCache,
+		TrieDirtyLimit:    h.config.Cache.TrieDirtyCache,
+		TrieDirtyDisabled: h.config.Cache.Archive,
+		TrieTimeLimit:     h.config.Cache.TrieTimeLimit,
+		SnapshotLimit:     h.config.Cache.SnapshotCache,
+		TriesInMemory:     h.config.Cache.TriesInMemory,
+		TrieCommitWorkers: h.config.Cache.CommitWorkers,
+
+		CodeCacheLimit:       h.config.Cache.CodeCache,
+		CodeCacheNoAdmission: !h.config.Cache.CodeAdmission,
+		TrieRetention:        time.Minute,
+		SnapshotWait:         true,
+	}
+}
+
+// Run imports the captured span, then generates the RPC load if configured, and recreates the
+// state of blocks of the span
+func (h *Harness) Run(ctx context.Context) (*Report, error) {
+	db, err := h.openDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	bc, err := core.NewBlockChain(db, h.cacheConfig(), h.chainConfig, nil, nil, h.engine, vm.Config{}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer bc.Stop()
+
+	report := &Report{}
+	if err := h.runImport(ctx, bc, &report.Import); err != nil {
+		return report, fmt.Errorf("import failed: %w", err)
+	}
+	if h.config.RPC.URL != "" {
+		latencies, err := runRPCLoad(ctx, &h.config.RPC, report.Import.First, report.Import.Last)
+		if err != nil {
+			return report, fmt.Errorf("rpc load failed: %w", err)
+		}
+		report.RPC = latencies
+	}
+	if h.config.Recreate.Samples > 0 && report.Import.Blocks > 0 {
+		report.Recreation = h.runRecreation(ctx, bc, report.Import.First, report.Import.Last)
+	}
+	return report, nil
+}
+
+var errInterrupted = errors.New("interrupted")
+
+func (h *Harness) runImport(ctx context.Context, bc *core.BlockChain, report *ImportReport) error {
+	var (
+		batch   = make(types.Blocks, 0, h.config.BatchSize)
+		elapsed time.Duration
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		start := time.Now()
+		if index, err := bc.InsertChain(batch); err != nil {
+			return fmt.Errorf("invalid block %d: %w", batch[index].NumberU64(), err)
+		}
+		elapsed += time.Since(start)
+		for _, block := range batch {
+			report.Txs += uint64(len(block.Transactions()))
+			report.Gas += block.GasUsed()
+		}
+		report.Blocks += uint64(len(batch))
+		report.Last = batch[len(batch)-1].NumberU64()
+		log.Info("Imported benchmark blocks", "last", report.Last, "blocks", report.Blocks, "elapsed", elapsed)
+		batch = batch[:0]
+		return nil
+	}
+	err := readEraFiles(h.config.EraFiles, func(block *types.Block) error {
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		if bc.HasBlockAndState(block.Hash(), block.NumberU64()) {
+			report.Skipped++
+			return nil
+		}
+		if report.Blocks == 0 && len(batch) == 0 {
+			report.First = block.NumberU64()
+		}
+		batch = append(batch, block)
+		if len(batch) < h.config.BatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	report.Duration = elapsed
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		report.BlocksPerSecond = float64(report.Blocks) / seconds
+		report.MGasPerSecond = float64(report.Gas) / 1e6 / seconds
+	}
+	return err
+}
+
+// runRecreation recreates the state of blocks evenly spread over the imported span, from the
+// closest state available in the database
+func (h *Harness) runRecreation(ctx context.Context, bc *core.BlockChain, first, last uint64) *RecreationReport {
+	var (
+		report  = &RecreationReport{}
+		samples = uint64(h.config.Recreate.Samples)
+		span    = last - first + 1
+		total   time.Duration
+	)
+	if samples > span {
+		samples = span
+	}
+	stateFor := func(header *types.Header) (*state.StateDB, error) {
+		return bc.StateAt(header.Root)
+	}
+	opts := &arbitrum.AdvanceStateOptions{
+		PrefetchWorkers: h.config.Recreate.PrefetchWorkers,
+		BlockReplayed: func(*types.Block, uint64, time.Duration) {
+			report.BlocksReplayed++
+		},
+	}
+	for i := uint64(1); i <= samples && ctx.Err() == nil; i++ {
+		header := bc.GetHeaderByNumber(first + span*i/samples - 1)
+		if header == nil {
+			continue
+		}
+		sample := RecreationSample{Block: header.Number.Uint64()}
+		start := time.Now()
+		statedb, available, err := arbitrum.FindLastAvailableState(ctx, bc, stateFor, header, nil, h.config.Recreate.MaxDepth)
+		if err == nil {
+			sample.From = available.Number.Uint64()
+			if available.Hash() != header.Hash() {
+				_, err = arbitrum.AdvanceStateUpToBlock(ctx, bc, statedb, header, available, nil, opts)
+			}
+		}
+		sample.Duration = time.Since(start)
+		if err != nil {
+			sample.Err = err.Error()
+		} else {
+			total += sample.Duration
+			if sample.Duration > report.Max {
+				report.Max = sample.Duration
+			}
+		}
+		report.Samples = append(report.Samples, sample)
+	}
+	if succeeded := len(report.Samples) - failedSamples(report.Samples); succeeded > 0 {
+		report.Mean = total / time.Duration(succeeded)
+	}
+	return report
+}
+
+func failedSamples(samples []RecreationSample) int {
+	failed := 0
+	for _, sample := range samples {
+		if sample.Err != "" {
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,118 @@
+package benchmark
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+	"github.com/chainupcloud/arb-geth/rlp"
+	"github.com/golang/snappy"
+)
+
+// writeEraEntry appends an e2store entry to buf
+func writeEraEntry(buf *bytes.Buffer, typ uint16, data []byte) {
+	var head [eraEntryHeaderSize]byte
+	binary.LittleEndian.PutUint16(head[0:2], typ)
+	binary.LittleEndian.PutUint32(head[2:6], uint32(len(data)))
+	buf.Write(head[:])
+	buf.Write(data)
+}
+
+// writeEraCompressed appends an entry holding the snappy framed rlp encoding of val to buf
+func writeEraCompressed(t *testing.T, buf *bytes.Buffer, typ uint16, val interface{}) {
+	var data bytes.Buffer
+	w := snappy.NewBufferedWriter(&data)
+	if err := rlp.Encode(w, val); err != nil {
+		t.Fatalf("failed to encode era entry: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to compress era entry: %v", err)
+	}
+	writeEraEntry(buf, typ, data.Bytes())
+}
+
+// Tests that the harness imports a span of blocks from an era file and recreates states of it
+func TestHarnessSmoke(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &core.Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  core.GenesisAlloc{address: {Balance: big.NewInt(params.Ether)}},
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := core.GenerateChainWithGenesis(gspec, ethash.NewFaker(), 16, func(i int, gen *core.BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(gen.TxNonce(address), common.Address{0xaa}, big.NewInt(1), params.TxGas, gen.BaseFee(), nil), signer, key)
+		gen.AddTx(tx)
+	})
+	var era bytes.Buffer
+	writeEraEntry(&era, eraTypeVersion, nil)
+	for _, block := range blocks {
+		writeEraCompressed(t, &era, eraTypeCompressedHeader, block.Header())
+		writeEraCompressed(t, &era, eraTypeCompressedBody, &types.Body{Transactions: block.Transactions(), Uncles: block.Uncles()})
+	}
+	dir := t.TempDir()
+	eraFile := filepath.Join(dir, "span.era1")
+	if err := os.WriteFile(eraFile, era.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The database to replay onto only holds the genesis
+	config := DefaultConfig
+	config.EraFiles = []string{eraFile}
+	config.BatchSize = 5
+	config.Database.Directory = filepath.Join(dir, "db")
+	config.Database.Cache, config.Database.Handles = 16, 16
+	config.Recreate.Samples = 2
+
+	db, err := rawdb.Open(rawdb.OpenOptions{Directory: config.Database.Directory, Cache: 16, Handles: 16})
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	gspec.MustCommit(db)
+	db.Close()
+
+	harness, err := New(&config, gspec.Config, ethash.NewFaker())
+	if err != nil {
+		t.Fatalf("failed to create harness: %v", err)
+	}
+	report, err := harness.Run(context.Background())
+	if err != nil {
+		t.Fatalf("benchmark failed: %v", err)
+	}
+	if report.Import.First != 1 || report.Import.Last != 16 || report.Import.Blocks != 16 || report.Import.Txs != 16 {
+		t.Errorf("wrong import report: %+v", report.Import)
+	}
+	if report.Recreation == nil || len(report.Recreation.Samples) != 2 {
+		t.Fatalf("wrong recreation report: %+v", report.Recreation)
+	}
+	for _, sample := range report.Recreation.Samples {
+		if sample.Err != "" {
+			t.Errorf("recreation of block %d failed: %s", sample.Block, sample.Err)
+		}
+	}
+}
+
+// Tests that an entry claiming an oversized length is rejected before being allocated
+func TestEraEntryTooLarge(t *testing.T) {
+	var head [eraEntryHeaderSize]byte
+	binary.LittleEndian.PutUint16(head[0:2], eraTypeCompressedBody)
+	binary.LittleEndian.PutUint32(head[2:6], 0xffffffff)
+
+	_, err := newEraReader(bytes.NewReader(head[:])).next()
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("have error %v, want entry too large", err)
+	}
+}
@@ -0,0 +1,183 @@
+package benchmark
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+// MethodLatencies summarizes the latencies of the calls to an RPC method
+type MethodLatencies struct {
+	Method string        `json:"method"`
+	Calls  int           `json:"calls"`
+	Errors int           `json:"errors"`
+	Mean   time.Duration `json:"mean"`
+	P50    time.Duration `json:"p50"`
+	P90    time.Duration `json:"p90"`
+	P99    time.Duration `json:"p99"`
+	Max    time.Duration `json:"max"`
+}
+
+// loadTargets holds the blocks, accounts and transactions of the replayed span the synthetic
+// load queries, collected from the server before the load starts
+type loadTargets struct {
+	blocks   []uint64
+	accounts []common.Address
+	txs      []common.Hash
+}
+
+type loadBlock struct {
+	Miner        common.Address `json:"miner"`
+	Transactions []struct {
+		Hash common.Hash     `json:"hash"`
+		From common.Address  `json:"from"`
+		To   *common.Address `json:"to"`
+	} `json:"transactions"`
+}
+
+// maxLoadTargetBlocks bounds the number of blocks the load targets are collected from
+const maxLoadTargetBlocks = 64
+
+func collectLoadTargets(ctx context.Context, client *rpc.Client, first, last uint64) (*loadTargets, error) {
+	targets := &loadTargets{}
+	step := (last - first + 1) / maxLoadTargetBlocks
+	if step == 0 {
+		step = 1
+	}
+	for number := first; number <= last && number >= first; number += step {
+		var block *loadBlock
+		if err := client.CallContext(ctx, &block, "eth_getBlockByNumber", hexutil.Uint64(number), true); err != nil {
+			return nil, fmt.Errorf("failed to get block %d: %w", number, err)
+		}
+		if block == nil {
+			return nil, fmt.Errorf("block %d not served", number)
+		}
+		targets.blocks = append(targets.blocks, number)
+		targets.accounts = append(targets.accounts, block.Miner)
+		for _, tx := range block.Transactions {
+			targets.txs = append(targets.txs, tx.Hash)
+			targets.accounts = append(targets.accounts, tx.From)
+			if tx.To != nil {
+				targets.accounts = append(targets.accounts, *tx.To)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// call issues a call to the method with random arguments picked from the targets
+func (t *loadTargets) call(ctx context.Context, client *rpc.Client, rng *rand.Rand, method string) error {
+	var (
+		result interface{}
+		block  = hexutil.Uint64(t.blocks[rng.Intn(len(t.blocks))])
+	)
+	switch method {
+	case "eth_blockNumber", "eth_chainId", "eth_gasPrice":
+		return client.CallContext(ctx, &result, method)
+	case "eth_getBlockByNumber":
+		return client.CallContext(ctx, &result, method, block, false)
+	case "eth_getBalance", "eth_getTransactionCount", "eth_getCode":
+		return client.CallContext(ctx, &result, method, t.accounts[rng.Intn(len(t.accounts))], block)
+	case "eth_getTransactionReceipt", "eth_getTransactionByHash":
+		if len(t.txs) == 0 {
+			return client.CallContext(ctx, &result, "eth_blockNumber")
+		}
+		return client.CallContext(ctx, &result, method, t.txs[rng.Intn(len(t.txs))])
+	case "eth_getLogs":
+		return client.CallContext(ctx, &result, method, map[string]interface{}{"fromBlock": block, "toBlock": block})
+	default:
+		return fmt.Errorf("unsupported load method %s", method)
+	}
+}
+
+// runRPCLoad calls the configured methods in round robin from concurrent clients, and reports
+// the latencies of each method
+func runRPCLoad(ctx context.Context, config *RPCLoadConfig, first, last uint64) ([]MethodLatencies, error) {
+	client, err := rpc.DialContext(ctx, config.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	targets, err := collectLoadTargets(ctx, client, first, last)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets.blocks) == 0 || len(config.Methods) == 0 {
+		return nil, nil
+	}
+	// reject unsupported methods before generating any load
+	for _, method := range config.Methods {
+		if err := targets.call(ctx, client, rand.New(rand.NewSource(0)), method); err != nil {
+			if _, ok := err.(rpc.Error); !ok {
+				return nil, err
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.Duration)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		latencies = make(map[string][]time.Duration)
+		failures  = make(map[string]int)
+		wg        sync.WaitGroup
+	)
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for call := 0; ctx.Err() == nil; call++ {
+				method := config.Methods[call%len(config.Methods)]
+				start := time.Now()
+				err := targets.call(ctx, client, rng, method)
+				elapsed := time.Since(start)
+				if ctx.Err() != nil {
+					return // calls cut short by the end of the load aren't representative
+				}
+				mu.Lock()
+				if err != nil {
+					failures[method]++
+				} else {
+					latencies[method] = append(latencies[method], elapsed)
+				}
+				mu.Unlock()
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	report := make([]MethodLatencies, 0, len(config.Methods))
+	for _, method := range config.Methods {
+		report = append(report, summarizeLatencies(method, latencies[method], failures[method]))
+	}
+	return report, nil
+}
+
+func summarizeLatencies(method string, latencies []time.Duration, failures int) MethodLatencies {
+	summary := MethodLatencies{Method: method, Calls: len(latencies) + failures, Errors: failures}
+	if len(latencies) == 0 {
+		return summary
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100]
+	}
+	summary.Mean = total / time.Duration(len(latencies))
+	summary.P50 = percentile(50)
+	summary.P90 = percentile(90)
+	summary.P99 = percentile(99)
+	summary.Max = latencies[len(latencies)-1]
+	return summary
+}
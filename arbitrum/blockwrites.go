@@ -0,0 +1,62 @@
+package arbitrum
+
+import (
+	"context"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+type BlockWrite struct {
+	Number      hexutil.Uint64 `json:"number"`
+	Hash        common.Hash    `json:"hash"`
+	ParentHash  common.Hash    `json:"parentHash"`
+	Status      string         `json:"status"`
+	Reorg       bool           `json:"reorg"`
+	ProcessTime hexutil.Uint64 `json:"processTime"` // in nanoseconds, zero if unknown
+	TrieFlush   string         `json:"trieFlush"`
+}
+
+func newBlockWrite(ev *core.BlockWriteEvent) *BlockWrite {
+	return &BlockWrite{
+		Number:      hexutil.Uint64(ev.Block.NumberU64()),
+		Hash:        ev.Block.Hash(),
+		ParentHash:  ev.Block.ParentHash(),
+		Status:      ev.Status.String(),
+		Reorg:       ev.Reorg,
+		ProcessTime: hexutil.Uint64(ev.ProcessTime),
+		TrieFlush:   ev.TrieFlush.String(),
+	}
+}
+
+// BlockWrites streams every block written by the node with its state, along with its write status (canonical, side or
+// none), whether it reorganised the chain, its processing time and the trie flushes decided on writing it
+func (api *ArbAPI) BlockWrites(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	rpcSub := notifier.CreateSubscription()
+	events := make(chan core.BlockWriteEvent, 128)
+	sub := api.b.BlockChain().SubscribeBlockWriteEvent(events)
+	go func() {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case ev := <-events:
+				if err := notifier.Notify(rpcSub.ID, newBlockWrite(&ev)); err != nil {
+					return
+				}
+			case <-sub.Err():
+				return
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
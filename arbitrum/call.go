@@ -0,0 +1,36 @@
+package arbitrum
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/internal/ethapi"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+type maxRecreateStateDepthKey struct{}
+
+// WithMaxRecreateStateDepth returns a context whose state lookups may recreate the state by replaying up to
+// maxDepthInL2Gas of l2 gas (-1=infinite, 0=no recreation), in place of the node's max-recreate-state-depth
+// and recreation limits. It's meant for trusted callers only.
+func WithMaxRecreateStateDepth(ctx context.Context, maxDepthInL2Gas int64) context.Context {
+	return context.WithValue(ctx, maxRecreateStateDepthKey{}, maxDepthInL2Gas)
+}
+
+func maxRecreateStateDepthFromContext(ctx context.Context) (int64, bool) {
+	depth, ok := ctx.Value(maxRecreateStateDepthKey{}).(int64)
+	return depth, ok
+}
+
+// Call executes eth_call with a recreation budget of maxRecreateGas l2 gas (-1=infinite) for the state of the
+// requested block, overriding the node default, which applies if omitted
+func (api *ArbDebugAPI) Call(ctx context.Context, args ethapi.TransactionArgs, blockNrOrHash rpc.BlockNumberOrHash, overrides *ethapi.StateOverride, blockOverrides *ethapi.BlockOverrides, maxRecreateGas *int64) (hexutil.Bytes, error) {
+	if maxRecreateGas != nil {
+		if *maxRecreateGas < InfiniteMaxRecreateStateDepth {
+			return nil, fmt.Errorf("invalid maxRecreateGas %d, must be -1 (infinite) or non-negative", *maxRecreateGas)
+		}
+		ctx = WithMaxRecreateStateDepth(ctx, *maxRecreateGas)
+	}
+	return ethapi.NewBlockChainAPI(api.b).Call(ctx, args, blockNrOrHash, overrides, blockOverrides)
+}
@@ -0,0 +1,46 @@
+package arbitrum
+
+import (
+	"time"
+
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/internal/ethapi"
+	flag "github.com/spf13/pflag"
+)
+
+type CallCacheConfig struct {
+	Enable bool          `koanf:"enable"`
+	Size   uint64        `koanf:"size"`
+	TTL    time.Duration `koanf:"ttl"`
+}
+
+var DefaultCallCacheConfig = CallCacheConfig{
+	Enable: false,
+	Size:   64 * 1024 * 1024,
+	TTL:    time.Minute,
+}
+
+func CallCacheConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultCallCacheConfig.Enable, "cache the results of eth_call and eth_estimateGas by block hash and arguments, serving repeated calls without executing them")
+	f.Uint64(prefix+".size", DefaultCallCacheConfig.Size, "max size in bytes of the cached call results")
+	f.Duration(prefix+".ttl", DefaultCallCacheConfig.TTL, "time a cached call result is served for, expired results are dropped as the head moves (0=until evicted)")
+}
+
+// pruneCallCache drops the expired call results on every new head until closed
+func pruneCallCache(cache *ethapi.CallCache, bc *core.BlockChain, chanClose chan struct{}) {
+	heads := make(chan core.ChainHeadEvent, 16)
+	sub := bc.SubscribeChainHeadEvent(heads)
+	go func() {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case <-heads:
+				cache.Prune()
+			case <-sub.Err():
+				return
+			case <-chanClose:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,170 @@
+package arbitrum
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/log"
+	flag "github.com/spf13/pflag"
+)
+
+type ChainGapCheckConfig struct {
+	Enable   bool          `koanf:"enable"`
+	Interval time.Duration `koanf:"interval"`
+	Depth    uint64        `koanf:"depth"`
+	Repair   bool          `koanf:"repair"`
+}
+
+var DefaultChainGapCheckConfig = ChainGapCheckConfig{
+	Enable:   false,
+	Interval: time.Hour,
+	Depth:    100_000,
+	Repair:   false,
+}
+
+func ChainGapCheckConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultChainGapCheckConfig.Enable, "scan the canonical chain for missing or mismatched data on startup and periodically")
+	f.Duration(prefix+".interval", DefaultChainGapCheckConfig.Interval, "interval between background canonical chain scans (0=startup only)")
+	f.Uint64(prefix+".depth", DefaultChainGapCheckConfig.Depth, "number of blocks below the head that are scanned (0=whole chain)")
+	f.Bool(prefix+".repair", DefaultChainGapCheckConfig.Repair, "attempt to repair detected gaps from local data")
+}
+
+type ChainGapReport struct {
+	From      hexutil.Uint64  `json:"from"`
+	To        hexutil.Uint64  `json:"to"`
+	CheckedAt time.Time       `json:"checkedAt"`
+	Gaps      []core.ChainGap `json:"gaps"`
+}
+
+type chainGapChecker struct {
+	config *ChainGapCheckConfig
+	bc     *core.BlockChain
+
+	mutex  sync.Mutex
+	report *ChainGapReport
+}
+
+func newChainGapChecker(config *ChainGapCheckConfig, bc *core.BlockChain) *chainGapChecker {
+	return &chainGapChecker{
+		config: config,
+		bc:     bc,
+	}
+}
+
+// check scans the given range, repairing gaps if configured to, and records the report
+func (c *chainGapChecker) check(ctx context.Context, from, to uint64) (*ChainGapReport, error) {
+	gaps := c.bc.FindChainGaps(ctx, from, to)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(gaps) > 0 {
+		log.Warn("Found gaps in canonical chain", "from", from, "to", to, "count", len(gaps))
+		if c.config.Repair {
+			var err error
+			gaps, err = c.bc.RepairChainGaps(ctx, gaps)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	report := &ChainGapReport{
+		From:      hexutil.Uint64(from),
+		To:        hexutil.Uint64(to),
+		CheckedAt: time.Now(),
+		Gaps:      gaps,
+	}
+	c.mutex.Lock()
+	c.report = report
+	c.mutex.Unlock()
+	return report, nil
+}
+
+func (c *chainGapChecker) checkHead(ctx context.Context) {
+	head := c.bc.CurrentBlock().Number.Uint64()
+	from := c.bc.Config().ArbitrumChainParams.GenesisBlockNum
+	if c.config.Depth > 0 && head > from+c.config.Depth {
+		from = head - c.config.Depth
+	}
+	if _, err := c.check(ctx, from, head); err != nil {
+		log.Error("Canonical chain gap check failed", "err", err)
+	}
+}
+
+func (c *chainGapChecker) lastReport() *ChainGapReport {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.report
+}
+
+func (c *chainGapChecker) start(chanClose chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-chanClose
+		cancel()
+	}()
+	go func() {
+		c.checkHead(ctx)
+		if c.config.Interval == 0 {
+			return
+		}
+		ticker := time.NewTicker(c.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-chanClose:
+				return
+			case <-ticker.C:
+				c.checkHead(ctx)
+			}
+		}
+	}()
+}
+
+// ChainGaps returns the report of the most recent canonical chain gap check
+func (api *ArbAPI) ChainGaps(ctx context.Context) (*ChainGapReport, error) {
+	checker := api.b.b.chainGapChecker
+	if checker == nil {
+		return nil, fmt.Errorf("chain gap check not enabled")
+	}
+	return checker.lastReport(), nil
+}
+
+// CheckChainGaps scans the canonical chain in the inclusive range [fromBlock, toBlock] for gaps, without repairing them
+func (api *ArbDebugAPI) CheckChainGaps(ctx context.Context, fromBlock, toBlock hexutil.Uint64) (*ChainGapReport, error) {
+	if err := api.checkChainGapRange(fromBlock, toBlock); err != nil {
+		return nil, err
+	}
+	gaps := api.b.b.arb.BlockChain().FindChainGaps(ctx, uint64(fromBlock), uint64(toBlock))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &ChainGapReport{From: fromBlock, To: toBlock, CheckedAt: time.Now(), Gaps: gaps}, nil
+}
+
+// RepairChainGaps scans the canonical chain in the inclusive range [fromBlock, toBlock] for gaps, and repairs them
+// from local data where possible
+func (api *ArbDebugAPI) RepairChainGaps(ctx context.Context, fromBlock, toBlock hexutil.Uint64) (*ChainGapReport, error) {
+	report, err := api.CheckChainGaps(ctx, fromBlock, toBlock)
+	if err != nil || len(report.Gaps) == 0 {
+		return report, err
+	}
+	log.Warn("Repairing gaps in canonical chain", "from", fromBlock, "to", toBlock, "count", len(report.Gaps))
+	if report.Gaps, err = api.b.b.arb.BlockChain().RepairChainGaps(ctx, report.Gaps); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (api *ArbDebugAPI) checkChainGapRange(fromBlock, toBlock hexutil.Uint64) error {
+	if fromBlock > toBlock {
+		return fmt.Errorf("invalid block range: from %d is after to %d", fromBlock, toBlock)
+	}
+	if bound := api.b.b.config.ArbDebug.BlockRangeBound; uint64(toBlock-fromBlock) >= bound {
+		return fmt.Errorf("block range of %d blocks exceeds the bound of %d", toBlock-fromBlock+1, bound)
+	}
+	return nil
+}
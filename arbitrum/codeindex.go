@@ -0,0 +1,114 @@
+package arbitrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rpc"
+	flag "github.com/spf13/pflag"
+)
+
+type CodeIndexConfig struct {
+	Enable        bool          `koanf:"enable"`
+	Backfill      bool          `koanf:"backfill"`
+	RetryInterval time.Duration `koanf:"retry-interval"`
+	MaxResults    uint64        `koanf:"max-results"`
+}
+
+var DefaultCodeIndexConfig = CodeIndexConfig{
+	Enable:        false,
+	Backfill:      true,
+	RetryInterval: time.Minute,
+	MaxResults:    1000,
+}
+
+func CodeIndexConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultCodeIndexConfig.Enable, "index the accounts deploying code by code hash as blocks are imported, serving arb_getContractsByCodeHash")
+	f.Bool(prefix+".backfill", DefaultCodeIndexConfig.Backfill, "add the accounts with code from before the index was enabled, in the background")
+	f.Duration(prefix+".retry-interval", DefaultCodeIndexConfig.RetryInterval, "time to wait before retrying a failed backfill")
+	f.Uint64(prefix+".max-results", DefaultCodeIndexConfig.MaxResults, "max number of contracts an arb_getContractsByCodeHash response returns (0=no limit)")
+}
+
+func startCodeIndexBackfill(config *CodeIndexConfig, bc *core.BlockChain, chanClose chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-chanClose
+		cancel()
+	}()
+	go func() {
+		for {
+			err := bc.BackfillCodeIndex(ctx)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			log.Warn("Code index backfill interrupted", "err", err)
+			select {
+			case <-chanClose:
+				return
+			case <-time.After(config.RetryInterval):
+			}
+		}
+	}()
+}
+
+type IndexedContract struct {
+	Address     *common.Address `json:"address"` // nil if the preimage of the address hash isn't known
+	AddressHash common.Hash     `json:"addressHash"`
+	BlockNumber hexutil.Uint64  `json:"blockNumber"` // block the account was seen with the code in
+}
+
+type ContractsByCodeHashResult struct {
+	Contracts []*IndexedContract `json:"contracts"`
+	// Next is the address hash to resume from, if there may be more contracts
+	Next *common.Hash `json:"next,omitempty"`
+}
+
+// GetContractsByCodeHash returns the contracts with the given code hash in the state of the block, ordered by address
+// hash from start onwards. Contracts deployed before the code index was enabled are only found once backfilled.
+func (api *ArbAPI) GetContractsByCodeHash(ctx context.Context, codeHash common.Hash, blockNrOrHash *rpc.BlockNumberOrHash, start *common.Hash, maxResults *hexutil.Uint64) (*ContractsByCodeHashResult, error) {
+	config := &api.b.b.config.CodeIndex
+	if !config.Enable {
+		return nil, errors.New("code index not enabled")
+	}
+	if blockNrOrHash == nil {
+		latest := rpc.BlockNumberOrHashWithNumber(rpc.LatestBlockNumber)
+		blockNrOrHash = &latest
+	}
+	header, err := api.b.HeaderByNumberOrHash(ctx, *blockNrOrHash)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, fmt.Errorf("block %v not found", blockNrOrHash.String())
+	}
+	max := config.MaxResults
+	if maxResults != nil && (max == 0 || uint64(*maxResults) < max) {
+		max = uint64(*maxResults)
+	}
+	var from common.Hash
+	if start != nil {
+		from = *start
+	}
+	entries, next, err := api.b.BlockChain().ContractsByCodeHash(header.Root, codeHash, from, int(max))
+	if err != nil {
+		return nil, err
+	}
+	result := &ContractsByCodeHashResult{
+		Contracts: make([]*IndexedContract, 0, len(entries)),
+		Next:      next,
+	}
+	for _, entry := range entries {
+		result.Contracts = append(result.Contracts, &IndexedContract{
+			Address:     entry.Address,
+			AddressHash: entry.AccountHash,
+			BlockNumber: hexutil.Uint64(entry.BlockNumber),
+		})
+	}
+	return result, nil
+}
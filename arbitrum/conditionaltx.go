@@ -3,6 +3,7 @@ package arbitrum
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/chainupcloud/arb-geth/arbitrum_types"
 	"github.com/chainupcloud/arb-geth/common"
@@ -40,15 +41,27 @@ func SubmitConditionalTransaction(ctx context.Context, b *APIBackend, tx *types.
 		// Ensure only eip155 signed transactions are submitted if EIP155Required is set.
 		return common.Hash{}, errors.New("only replay-protected (EIP-155) transactions allowed over RPC")
 	}
-	if err := b.SendConditionalTx(ctx, tx, options); err != nil {
-		return common.Hash{}, err
-	}
-	// Print a log with full tx details for manual investigations and interventions
 	signer := types.MakeSigner(b.ChainConfig(), b.CurrentBlock().Number, b.CurrentBlock().Time)
 	from, err := types.Sender(signer, tx)
 	if err != nil {
 		return common.Hash{}, err
 	}
+	// Signed conditions must have been signed by the sender for this very transaction, and the node may require them to be
+	if options != nil && options.Signature == nil && b.ConditionalSignatureRequired() {
+		return common.Hash{}, arbitrum_types.ErrConditionsNotSigned
+	}
+	if options != nil && options.Signature != nil {
+		if err := options.VerifySignature(b.ChainConfig().ChainID, tx.Hash(), from); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	if err := b.CheckConditionalOptions(ctx, options); err != nil {
+		return common.Hash{}, err
+	}
+	if err := b.SendConditionalTx(ctx, tx, options); err != nil {
+		return common.Hash{}, err
+	}
+	// Print a log with full tx details for manual investigations and interventions
 
 	if tx.To() == nil {
 		addr := crypto.CreateAddress(from, tx.Nonce())
@@ -59,6 +72,39 @@ func SubmitConditionalTransaction(ctx context.Context, b *APIBackend, tx *types.
 	return tx.Hash(), nil
 }
 
+// CheckConditionalOptions checks the options against the position the transaction would be sequenced at, so that
+// transactions whose conditions can't be met are rejected before being published. That's the pending block if the
+// sequencer is building one. Otherwise it's the block after the latest one, which can't be older than now nor than
+// the latest L1 block known to the node.
+func (a *APIBackend) CheckConditionalOptions(ctx context.Context, options *arbitrum_types.ConditionalOptions) error {
+	if options == nil {
+		return nil
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	statedb, header, err := a.pendingStateAndHeader(ctx)
+	if err != nil {
+		return err
+	}
+	if statedb != nil {
+		return options.Check(types.DeserializeHeaderExtraInformation(header).L1BlockNumber, header.Time, statedb)
+	}
+	statedb, header, err = a.StateAndHeaderByNumber(ctx, rpc.LatestBlockNumber)
+	if err != nil {
+		return err
+	}
+	l1BlockNumber := types.DeserializeHeaderExtraInformation(header).L1BlockNumber
+	if status, err := a.b.arb.SequencerQueueStatus(ctx); err == nil && status.L1BlockNumber > l1BlockNumber {
+		l1BlockNumber = status.L1BlockNumber
+	}
+	timestamp := header.Time
+	if now := uint64(time.Now().Unix()); now > timestamp {
+		timestamp = now
+	}
+	return options.Check(l1BlockNumber, timestamp, statedb)
+}
+
 func SendConditionalTransactionRPC(ctx context.Context, rpc *rpc.Client, tx *types.Transaction, options *arbitrum_types.ConditionalOptions) error {
 	data, err := tx.MarshalBinary()
 	if err != nil {
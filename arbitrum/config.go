@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/chainupcloud/arb-geth/eth/ethconfig"
+	"github.com/chainupcloud/arb-geth/eth/tracers/plugin"
 	"github.com/chainupcloud/arb-geth/params"
 	flag "github.com/spf13/pflag"
 )
@@ -18,6 +19,9 @@ type Config struct {
 
 	TxAllowUnprotected bool `koanf:"tx-allow-unprotected"`
 
+	// TxConditionalRequireSignature rejects the conditional transactions whose conditions aren't signed by their sender
+	TxConditionalRequireSignature bool `koanf:"tx-conditional-require-signature"`
+
 	// RPCEVMTimeout is the global timeout for eth-call.
 	RPCEVMTimeout time.Duration `koanf:"evm-timeout"`
 
@@ -32,37 +36,153 @@ type Config struct {
 	// FeeHistoryMaxBlockCount limits the number of historical blocks a fee history request may cover
 	FeeHistoryMaxBlockCount uint64 `koanf:"feehistory-max-block-count"`
 
+	// GasBreakdownMaxBlockCount limits the number of blocks a gas breakdown request may cover
+	GasBreakdownMaxBlockCount uint64 `koanf:"gas-breakdown-max-block-count"`
+
+	// BlockReceiptsMaxBlockCount limits the number of blocks a block receipts range request may cover
+	BlockReceiptsMaxBlockCount uint64 `koanf:"block-receipts-max-block-count"`
+
+	// Limits of the raw transactions by block requests
+	RawTransactionsMaxBlockCount   uint64 `koanf:"raw-transactions-max-block-count"`
+	RawTransactionsMaxResponseSize uint64 `koanf:"raw-transactions-max-response-size"`
+
+	// Limits of the account and storage range proof requests
+	RangeProofMaxEntries      uint64 `koanf:"range-proof-max-entries"`
+	RangeProofMaxResponseSize uint64 `koanf:"range-proof-max-response-size"`
+
 	ArbDebug ArbDebugConfig `koanf:"arbdebug"`
 
 	ClassicRedirect        string        `koanf:"classic-redirect"`
 	ClassicRedirectTimeout time.Duration `koanf:"classic-redirect-timeout"`
 	MaxRecreateStateDepth  int64         `koanf:"max-recreate-state-depth"`
 
+	RecreationRecordPreimages bool                   `koanf:"recreation-record-preimages"`
+	RecreationLimits          RecreationLimitsConfig `koanf:"recreation-limits"`
+	RecreationPrefetchWorkers int                    `koanf:"recreation-prefetch-workers"`
+
+	RecreationSnapshotSlice RecreationSnapshotSliceConfig `koanf:"recreation-snapshot-slice"`
+	RecreationRollback      bool                          `koanf:"recreation-rollback"`
+
 	AllowMethod []string `koanf:"allow-method"`
+
+	TracerPlugins TracerPluginsConfig `koanf:"tracer-plugins"`
+
+	ChainGapCheck ChainGapCheckConfig `koanf:"chain-gap-check"`
+
+	SideChainPruning SideChainPruningConfig `koanf:"side-chain-pruning"`
+
+	TracedStatePinning TracedStatePinningConfig `koanf:"traced-state-pinning"`
+
+	StateMirror StateMirrorConfig `koanf:"state-mirror"`
+
+	SnapshotThrottle SnapshotThrottleConfig `koanf:"snapshot-throttle"`
+
+	LogIndex LogIndexConfig `koanf:"log-index"`
+
+	CodeIndex CodeIndexConfig `koanf:"code-index"`
+
+	CallCache CallCacheConfig `koanf:"call-cache"`
+
+	ReceiptFormat ReceiptFormatConfig `koanf:"receipt-format"`
+
+	Quota QuotaConfig `koanf:"quota"`
+
+	AccountWatch AccountWatchConfig `koanf:"account-watch"`
+
+	GRPCStream GRPCStreamConfig `koanf:"grpc-stream"`
+
+	ReplayDiff ReplayDiffConfig `koanf:"replay-diff"`
+
+	ParallelExecution ParallelExecutionConfig `koanf:"parallel-execution"`
+
+	RevertDecoding RevertDecodingConfig `koanf:"revert-decoding"`
+
+	TransferIndex TransferIndexConfig `koanf:"transfer-index"`
+
+	SlowQuery SlowQueryConfig `koanf:"slow-query"`
+
+	Health HealthConfig `koanf:"health"`
+
+	AncientsServer AncientsServerConfig `koanf:"ancients-server"`
+}
+
+type TracerPluginsConfig struct {
+	Paths         []string      `koanf:"paths"`
+	MaxSteps      uint64        `koanf:"max-steps"`
+	MaxResultSize int           `koanf:"max-result-size"`
+	Timeout       time.Duration `koanf:"timeout"`
+}
+
+func (c *TracerPluginsConfig) Limits() plugin.Limits {
+	return plugin.Limits{
+		MaxSteps:      c.MaxSteps,
+		MaxResultSize: c.MaxResultSize,
+		Timeout:       c.Timeout,
+	}
 }
 
 type ArbDebugConfig struct {
-	BlockRangeBound   uint64 `koanf:"block-range-bound"`
-	TimeoutQueueBound uint64 `koanf:"timeout-queue-bound"`
+	BlockRangeBound        uint64        `koanf:"block-range-bound"`
+	TimeoutQueueBound      uint64        `koanf:"timeout-queue-bound"`
+	PrepareShutdownTimeout time.Duration `koanf:"prepare-shutdown-timeout"`
+	StorageStatsSampleSize uint64        `koanf:"storage-stats-sample-size"`
 }
 
 func ConfigAddOptions(prefix string, f *flag.FlagSet) {
 	f.Uint64(prefix+".gas-cap", DefaultConfig.RPCGasCap, "cap on computation gas that can be used in eth_call/estimateGas (0=infinite)")
 	f.Float64(prefix+".tx-fee-cap", DefaultConfig.RPCTxFeeCap, "cap on transaction fee (in ether) that can be sent via the RPC APIs (0 = no cap)")
 	f.Bool(prefix+".tx-allow-unprotected", DefaultConfig.TxAllowUnprotected, "allow transactions that aren't EIP-155 replay protected to be submitted over the RPC")
+	f.Bool(prefix+".tx-conditional-require-signature", DefaultConfig.TxConditionalRequireSignature, "reject the conditional transactions whose conditions aren't signed by the sender of the transaction, so that they can't be altered in transit")
 	f.Duration(prefix+".evm-timeout", DefaultConfig.RPCEVMTimeout, "timeout used for eth_call (0=infinite)")
 	f.Uint64(prefix+".bloom-bits-blocks", DefaultConfig.BloomBitsBlocks, "number of blocks a single bloom bit section vector holds")
 	f.Uint64(prefix+".bloom-confirms", DefaultConfig.BloomConfirms, "number of confirmation blocks before a bloom section is considered final")
 	f.Uint64(prefix+".feehistory-max-block-count", DefaultConfig.FeeHistoryMaxBlockCount, "max number of blocks a fee history request may cover")
+	f.Uint64(prefix+".gas-breakdown-max-block-count", DefaultConfig.GasBreakdownMaxBlockCount, "max number of blocks a gas breakdown request may cover")
+	f.Uint64(prefix+".block-receipts-max-block-count", DefaultConfig.BlockReceiptsMaxBlockCount, "max number of blocks an eth_getBlockReceiptsRange request may cover (0=no limit)")
+	f.Uint64(prefix+".raw-transactions-max-block-count", DefaultConfig.RawTransactionsMaxBlockCount, "max number of blocks an arb_getRawTransactionsByBlock request may cover (0=no limit)")
+	f.Uint64(prefix+".raw-transactions-max-response-size", DefaultConfig.RawTransactionsMaxResponseSize, "max size in bytes of the transactions and receipts an arb_getRawTransactionsByBlock response returns, later blocks are left for a follow up request (0=no limit)")
+	f.Uint64(prefix+".range-proof-max-entries", DefaultConfig.RangeProofMaxEntries, "max number of trie entries an arb_getAccountRange or arb_getStorageRange response returns (0=no limit)")
+	f.Uint64(prefix+".range-proof-max-response-size", DefaultConfig.RangeProofMaxResponseSize, "max size in bytes of the keys and values an arb_getAccountRange or arb_getStorageRange response returns (0=no limit)")
 	f.String(prefix+".classic-redirect", DefaultConfig.ClassicRedirect, "url to redirect classic requests, use \"error:[CODE:]MESSAGE\" to return specified error instead of redirecting")
 	f.Duration(prefix+".classic-redirect-timeout", DefaultConfig.ClassicRedirectTimeout, "timeout for forwarded classic requests, where 0 = no timeout")
 	f.Int(prefix+".filter-log-cache-size", DefaultConfig.FilterLogCacheSize, "log filter system maximum number of cached blocks")
 	f.Duration(prefix+".filter-timeout", DefaultConfig.FilterTimeout, "log filter system maximum time filters stay active")
 	f.Int64(prefix+".max-recreate-state-depth", DefaultConfig.MaxRecreateStateDepth, "maximum depth for recreating state, measured in l2 gas (0=don't recreate state, -1=infinite, -2=use default value for archive or non-archive node (whichever is configured))")
+	f.Bool(prefix+".recreation-record-preimages", DefaultConfig.RecreationRecordPreimages, "persist the preimages of hashed account and storage keys touched while recreating state, so the state can later be exported by address")
+	RecreationLimitsConfigAddOptions(prefix+".recreation-limits", f)
+	f.Int(prefix+".recreation-prefetch-workers", DefaultConfig.RecreationPrefetchWorkers, "number of goroutines warming the state caches ahead of blocks replayed while recreating state (0=disable prefetching)")
+	RecreationSnapshotSliceConfigAddOptions(prefix+".recreation-snapshot-slice", f)
+	f.Bool(prefix+".recreation-rollback", DefaultConfig.RecreationRollback, "serve the missing states recoverable from the snapshot reverse diffs (see --snapshot.history) by rolling the tries of a later state back rather than replaying blocks, in memory for as long as they are used; the states whose tries can't be rebuilt are served from the snapshot only, and can't be proven (eth_getProof) nor hashed")
 	f.StringSlice(prefix+".allow-method", DefaultConfig.AllowMethod, "list of whitelisted rpc methods")
 	arbDebug := DefaultConfig.ArbDebug
 	f.Uint64(prefix+".arbdebug.block-range-bound", arbDebug.BlockRangeBound, "bounds the number of blocks arbdebug calls may return")
 	f.Uint64(prefix+".arbdebug.timeout-queue-bound", arbDebug.TimeoutQueueBound, "bounds the length of timeout queues arbdebug calls may return")
+	f.Duration(prefix+".arbdebug.prepare-shutdown-timeout", arbDebug.PrepareShutdownTimeout, "default time arbdebug_prepareShutdown waits for the state flush before reporting the node as not ready (0=no timeout)")
+	f.Uint64(prefix+".arbdebug.storage-stats-sample-size", arbDebug.StorageStatsSampleSize, "max number of storage slots arbdebug_storageTrieStats walks before extrapolating from the sample (0=no limit)")
+	ChainGapCheckConfigAddOptions(prefix+".chain-gap-check", f)
+	SideChainPruningConfigAddOptions(prefix+".side-chain-pruning", f)
+	TracedStatePinningConfigAddOptions(prefix+".traced-state-pinning", f)
+	StateMirrorConfigAddOptions(prefix+".state-mirror", f)
+	SnapshotThrottleConfigAddOptions(prefix+".snapshot-throttle", f)
+	LogIndexConfigAddOptions(prefix+".log-index", f)
+	CodeIndexConfigAddOptions(prefix+".code-index", f)
+	CallCacheConfigAddOptions(prefix+".call-cache", f)
+	ReceiptFormatConfigAddOptions(prefix+".receipt-format", f)
+	QuotaConfigAddOptions(prefix+".quota", f)
+	AccountWatchConfigAddOptions(prefix+".account-watch", f)
+	GRPCStreamConfigAddOptions(prefix+".grpc-stream", f)
+	ReplayDiffConfigAddOptions(prefix+".replay-diff", f)
+	ParallelExecutionConfigAddOptions(prefix+".parallel-execution", f)
+	RevertDecodingConfigAddOptions(prefix+".revert-decoding", f)
+	TransferIndexConfigAddOptions(prefix+".transfer-index", f)
+	SlowQueryConfigAddOptions(prefix+".slow-query", f)
+	HealthConfigAddOptions(prefix+".health", f)
+	AncientsServerConfigAddOptions(prefix+".ancients-server", f)
+	tracerPlugins := DefaultConfig.TracerPlugins
+	f.StringSlice(prefix+".tracer-plugins.paths", tracerPlugins.Paths, "list of go plugins providing additional native tracers")
+	f.Uint64(prefix+".tracer-plugins.max-steps", tracerPlugins.MaxSteps, "maximum number of opcode steps a plugin tracer may observe per trace (0=infinite)")
+	f.Int(prefix+".tracer-plugins.max-result-size", tracerPlugins.MaxResultSize, "maximum size in bytes of a plugin tracer result (0=infinite)")
+	f.Duration(prefix+".tracer-plugins.timeout", tracerPlugins.Timeout, "maximum time a plugin tracer may run per trace (0=infinite)")
 }
 
 const (
@@ -73,20 +193,56 @@ const (
 )
 
 var DefaultConfig = Config{
-	RPCGasCap:               ethconfig.Defaults.RPCGasCap,   // 50,000,000
-	RPCTxFeeCap:             ethconfig.Defaults.RPCTxFeeCap, // 1 ether
-	TxAllowUnprotected:      true,
-	RPCEVMTimeout:           ethconfig.Defaults.RPCEVMTimeout, // 5 seconds
-	BloomBitsBlocks:         params.BloomBitsBlocks * 4,       // we generally have smaller blocks
-	BloomConfirms:           params.BloomConfirms,
-	FilterLogCacheSize:      32,
-	FilterTimeout:           5 * time.Minute,
-	FeeHistoryMaxBlockCount: 1024,
-	ClassicRedirect:         "",
-	MaxRecreateStateDepth:   UninitializedMaxRecreateStateDepth, // default value should be set for depending on node type (archive / non-archive)
-	AllowMethod:             []string{},
+	RPCGasCap:                      ethconfig.Defaults.RPCGasCap,   // 50,000,000
+	RPCTxFeeCap:                    ethconfig.Defaults.RPCTxFeeCap, // 1 ether
+	TxAllowUnprotected:             true,
+	RPCEVMTimeout:                  ethconfig.Defaults.RPCEVMTimeout, // 5 seconds
+	BloomBitsBlocks:                params.BloomBitsBlocks * 4,       // we generally have smaller blocks
+	BloomConfirms:                  params.BloomConfirms,
+	FilterLogCacheSize:             32,
+	FilterTimeout:                  5 * time.Minute,
+	FeeHistoryMaxBlockCount:        1024,
+	GasBreakdownMaxBlockCount:      1024,
+	BlockReceiptsMaxBlockCount:     128,
+	RawTransactionsMaxBlockCount:   1024,
+	RawTransactionsMaxResponseSize: 32 * 1024 * 1024,
+	RangeProofMaxEntries:           4096,
+	RangeProofMaxResponseSize:      4 * 1024 * 1024,
+	ClassicRedirect:                "",
+	MaxRecreateStateDepth:          UninitializedMaxRecreateStateDepth, // default value should be set for depending on node type (archive / non-archive)
+	RecreationPrefetchWorkers:      4,
+	RecreationSnapshotSlice:        DefaultRecreationSnapshotSliceConfig,
+	AllowMethod:                    []string{},
 	ArbDebug: ArbDebugConfig{
-		BlockRangeBound:   256,
-		TimeoutQueueBound: 512,
+		BlockRangeBound:        256,
+		TimeoutQueueBound:      512,
+		PrepareShutdownTimeout: time.Minute,
+		StorageStatsSampleSize: 1_000_000,
+	},
+	TracerPlugins: TracerPluginsConfig{
+		Paths:         []string{},
+		MaxSteps:      plugin.DefaultLimits.MaxSteps,
+		MaxResultSize: plugin.DefaultLimits.MaxResultSize,
+		Timeout:       plugin.DefaultLimits.Timeout,
 	},
+	RecreationLimits:   DefaultRecreationLimitsConfig,
+	ChainGapCheck:      DefaultChainGapCheckConfig,
+	SideChainPruning:   DefaultSideChainPruningConfig,
+	TracedStatePinning: DefaultTracedStatePinningConfig,
+	StateMirror:        DefaultStateMirrorConfig,
+	SnapshotThrottle:   DefaultSnapshotThrottleConfig,
+	LogIndex:           DefaultLogIndexConfig,
+	CodeIndex:          DefaultCodeIndexConfig,
+	CallCache:          DefaultCallCacheConfig,
+	ReceiptFormat:      DefaultReceiptFormatConfig,
+	Quota:              DefaultQuotaConfig,
+	AccountWatch:       DefaultAccountWatchConfig,
+	GRPCStream:         DefaultGRPCStreamConfig,
+	ReplayDiff:         DefaultReplayDiffConfig,
+	ParallelExecution:  DefaultParallelExecutionConfig,
+	RevertDecoding:     DefaultRevertDecodingConfig,
+	TransferIndex:      DefaultTransferIndexConfig,
+	SlowQuery:          DefaultSlowQueryConfig,
+	Health:             DefaultHealthConfig,
+	AncientsServer:     DefaultAncientsServerConfig,
 }
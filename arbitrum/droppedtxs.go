@@ -0,0 +1,256 @@
+package arbitrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/txpool"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/event"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+// reasons a published transaction got dropped
+const (
+	DropReasonConditionFailed   = "conditionFailed"   // the conditional options weren't met
+	DropReasonNonceTooLow       = "nonceTooLow"       // the nonce was already used, e.g. by a replacement
+	DropReasonNonceGap          = "nonceGap"          // transactions with lower nonces are missing
+	DropReasonFeeTooLow         = "feeTooLow"         // the fee cap is below the base fee or the price floor
+	DropReasonInsufficientFunds = "insufficientFunds" // the sender can't pay for the gas and value
+	DropReasonReplaced          = "replaced"          // another transaction with the same sender and nonce was sequenced instead
+	DropReasonTimeout           = "timeout"           // the sequencer didn't sequence it in time
+	DropReasonRejected          = "rejected"          // the sequencer rejected it for another reason
+)
+
+// DroppedTxEvent is posted when a transaction published through the node is dropped instead of sequenced
+type DroppedTxEvent struct {
+	Tx     *types.Transaction
+	Reason string // one of the DropReason constants
+	Err    error
+}
+
+// conditional options failures are rejected errors, whose error code survives the forwarding to the sequencer
+const rejectedErrorCode = -32003
+
+// dropReason classifies the error publishing a transaction failed with. Errors the sequencer returned through the
+// forwarder lose their identity, only a rejected error code survives, so the others are reported as rejected.
+func dropReason(err error) string {
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == rejectedErrorCode {
+		return DropReasonConditionFailed
+	}
+	for _, reason := range []struct {
+		err    error
+		reason string
+	}{
+		{core.ErrNonceTooLow, DropReasonNonceTooLow},
+		{core.ErrNonceTooHigh, DropReasonNonceGap},
+		{core.ErrFeeCapTooLow, DropReasonFeeTooLow},
+		{txpool.ErrUnderpriced, DropReasonFeeTooLow},
+		{txpool.ErrReplaceUnderpriced, DropReasonFeeTooLow},
+		{core.ErrInsufficientFunds, DropReasonInsufficientFunds},
+		{txpool.ErrOverdraft, DropReasonInsufficientFunds},
+		{context.DeadlineExceeded, DropReasonTimeout},
+	} {
+		if errors.Is(err, reason.err) {
+			return reason.reason
+		}
+	}
+	return DropReasonRejected
+}
+
+const (
+	// publishedTxLifetime is how long a transaction the sequencer accepted is waited for before it's given up on and
+	// reported dropped
+	publishedTxLifetime = 10 * time.Minute
+
+	// maxPublishedTxs bounds the number of accepted transactions tracked until they're sequenced
+	maxPublishedTxs = 4096
+)
+
+var (
+	errTxReplaced     = errors.New("replaced by another transaction")
+	errTxNotSequenced = errors.New("not sequenced in time")
+)
+
+type publishedTxKey struct {
+	from  common.Address
+	nonce uint64
+}
+
+type publishedTx struct {
+	tx       *types.Transaction
+	accepted time.Time
+}
+
+// publishedTxs tracks the transactions published through the node which the sequencer accepted, until they're
+// sequenced, replaced by another transaction with the same sender and nonce, or evicted after publishedTxLifetime
+type publishedTxs struct {
+	lock sync.Mutex
+	txs  map[publishedTxKey]*publishedTx
+}
+
+func newPublishedTxs() *publishedTxs {
+	return &publishedTxs{txs: make(map[publishedTxKey]*publishedTx)}
+}
+
+// add starts tracking an accepted transaction, unless too many are tracked already
+func (p *publishedTxs) add(tx *types.Transaction, now time.Time) {
+	from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+	if err != nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.txs) >= maxPublishedTxs {
+		return
+	}
+	p.txs[publishedTxKey{from, tx.Nonce()}] = &publishedTx{tx: tx, accepted: now}
+}
+
+// sequenced stops tracking the transactions whose sender and nonce were used by the block, returning the drop events
+// of the ones another transaction replaced
+func (p *publishedTxs) sequenced(signer types.Signer, block *types.Block) []*DroppedTxEvent {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.txs) == 0 {
+		return nil
+	}
+	var dropped []*DroppedTxEvent
+	for _, tx := range block.Transactions() {
+		from, err := types.Sender(signer, tx)
+		if err != nil {
+			continue
+		}
+		key := publishedTxKey{from, tx.Nonce()}
+		published, ok := p.txs[key]
+		if !ok {
+			continue
+		}
+		delete(p.txs, key)
+		if published.tx.Hash() != tx.Hash() {
+			dropped = append(dropped, &DroppedTxEvent{
+				Tx:     published.tx,
+				Reason: DropReasonReplaced,
+				Err:    fmt.Errorf("%w %v in block %d", errTxReplaced, tx.Hash(), block.NumberU64()),
+			})
+		}
+	}
+	return dropped
+}
+
+// expire evicts the transactions accepted before the deadline and still not sequenced, returning their drop events
+func (p *publishedTxs) expire(deadline time.Time) []*DroppedTxEvent {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var dropped []*DroppedTxEvent
+	for key, published := range p.txs {
+		if published.accepted.Before(deadline) {
+			delete(p.txs, key)
+			dropped = append(dropped, &DroppedTxEvent{Tx: published.tx, Reason: DropReasonTimeout, Err: errTxNotSequenced})
+		}
+	}
+	return dropped
+}
+
+// trackPublishedTxs reports the accepted transactions which get replaced or evicted instead of sequenced
+func (b *Backend) trackPublishedTxs(chanClose chan struct{}) {
+	bc := b.arb.BlockChain()
+	events := make(chan core.ChainEvent, 128)
+	sub := bc.SubscribeChainEvent(events)
+	go func() {
+		defer sub.Unsubscribe()
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case ev := <-events:
+				signer := types.MakeSigner(bc.Config(), ev.Block.Number(), ev.Block.Time())
+				for _, dropped := range b.publishedTxs.sequenced(signer, ev.Block) {
+					b.droppedTxFeed.Send(*dropped)
+				}
+			case now := <-ticker.C:
+				for _, dropped := range b.publishedTxs.expire(now.Add(-publishedTxLifetime)) {
+					b.droppedTxFeed.Send(*dropped)
+				}
+			case <-sub.Err():
+				return
+			case <-chanClose:
+				return
+			}
+		}
+	}()
+}
+
+// ReportDroppedTransaction notifies the subscribers that a published transaction was dropped. It's called on failures
+// to publish, for the accepted transactions replaced or evicted before being sequenced, and may be called by the
+// ArbInterface for the transactions it drops after accepting them.
+func (b *Backend) ReportDroppedTransaction(tx *types.Transaction, reason string, err error) {
+	b.droppedTxFeed.Send(DroppedTxEvent{Tx: tx, Reason: reason, Err: err})
+}
+
+func (b *Backend) SubscribeDroppedTxEvent(ch chan<- DroppedTxEvent) event.Subscription {
+	return b.scope.Track(b.droppedTxFeed.Subscribe(ch))
+}
+
+type DroppedTransaction struct {
+	Hash   common.Hash     `json:"hash"`
+	From   *common.Address `json:"from,omitempty"`
+	Nonce  hexutil.Uint64  `json:"nonce"`
+	Reason string          `json:"reason"`
+	Error  string          `json:"error,omitempty"`
+}
+
+func newDroppedTransaction(ev *DroppedTxEvent) *DroppedTransaction {
+	dropped := &DroppedTransaction{
+		Hash:   ev.Tx.Hash(),
+		Nonce:  hexutil.Uint64(ev.Tx.Nonce()),
+		Reason: ev.Reason,
+	}
+	if from, err := types.Sender(types.LatestSignerForChainID(ev.Tx.ChainId()), ev.Tx); err == nil {
+		dropped.From = &from
+	}
+	if ev.Err != nil {
+		dropped.Error = ev.Err.Error()
+	}
+	return dropped
+}
+
+// DroppedTransactions streams the transactions published through this node which got dropped instead of sequenced,
+// along with the reason, served as eth_subscribe("droppedTransactions")
+func (s *ArbTransactionAPI) DroppedTransactions(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	rpcSub := notifier.CreateSubscription()
+	events := make(chan DroppedTxEvent, 128)
+	sub := s.b.b.SubscribeDroppedTxEvent(events)
+	go func() {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case ev := <-events:
+				if err := notifier.Notify(rpcSub.ID, newDroppedTransaction(&ev)); err != nil {
+					return
+				}
+			case <-sub.Err():
+				return
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
@@ -0,0 +1,93 @@
+package arbitrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/arbitrum_types"
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/txpool"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+func TestDropReason(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{arbitrum_types.NewRejectedError("BlockNumberMin condition not met"), DropReasonConditionFailed},
+		{arbitrum_types.WrapOptionsCheckError(arbitrum_types.NewRejectedError("not met"), "sequencer"), DropReasonConditionFailed},
+		{fmt.Errorf("%w: address %v", core.ErrNonceTooLow, common.Address{}), DropReasonNonceTooLow},
+		{core.ErrNonceTooHigh, DropReasonNonceGap},
+		{core.ErrFeeCapTooLow, DropReasonFeeTooLow},
+		{txpool.ErrUnderpriced, DropReasonFeeTooLow},
+		{txpool.ErrReplaceUnderpriced, DropReasonFeeTooLow},
+		{fmt.Errorf("%w: have 0 want 1", core.ErrInsufficientFunds), DropReasonInsufficientFunds},
+		{txpool.ErrOverdraft, DropReasonInsufficientFunds},
+		{context.DeadlineExceeded, DropReasonTimeout},
+		// the sequencer's errors lose their identity through the forwarder
+		{errors.New(core.ErrNonceTooLow.Error()), DropReasonRejected},
+		{errors.New("sequencer unavailable"), DropReasonRejected},
+	}
+	for _, tt := range tests {
+		if reason := dropReason(tt.err); reason != tt.reason {
+			t.Errorf("%v: reason %s, want %s", tt.err, reason, tt.reason)
+		}
+	}
+}
+
+func TestPublishedTxs(t *testing.T) {
+	var (
+		key, _ = crypto.GenerateKey()
+		signer = types.LatestSigner(params.TestChainConfig)
+		now    = time.Now()
+	)
+	newTx := func(nonce uint64, price int64) *types.Transaction {
+		tx, _ := types.SignTx(types.NewTransaction(nonce, common.Address{0xaa}, big.NewInt(1), params.TxGas, big.NewInt(price), nil), signer, key)
+		return tx
+	}
+	var (
+		sequenced = newTx(0, 1)
+		replaced  = newTx(1, 1)
+		expired   = newTx(2, 1)
+		pending   = newTx(3, 1)
+	)
+	published := newPublishedTxs()
+	published.add(sequenced, now)
+	published.add(replaced, now)
+	published.add(expired, now.Add(-publishedTxLifetime-time.Second))
+	published.add(pending, now)
+
+	// A block sequencing the first transaction and replacing the second one
+	replacement := newTx(1, 2)
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(10)}).WithBody(types.Transactions{sequenced, replacement}, nil)
+	dropped := published.sequenced(signer, block)
+	if len(dropped) != 1 || dropped[0].Tx.Hash() != replaced.Hash() || dropped[0].Reason != DropReasonReplaced {
+		t.Fatalf("wrong drops on sequencing: %+v", dropped)
+	}
+	if !errors.Is(dropped[0].Err, errTxReplaced) {
+		t.Errorf("replaced error %v, want %v", dropped[0].Err, errTxReplaced)
+	}
+	// Only the transaction waiting for too long is evicted
+	dropped = published.expire(now.Add(-publishedTxLifetime))
+	if len(dropped) != 1 || dropped[0].Tx.Hash() != expired.Hash() || dropped[0].Reason != DropReasonTimeout {
+		t.Fatalf("wrong drops on expiry: %+v", dropped)
+	}
+	if len(published.txs) != 1 {
+		t.Fatalf("%d transactions still tracked, want 1", len(published.txs))
+	}
+	// The tracked transactions are bounded
+	for i := uint64(0); i < 2*maxPublishedTxs; i++ {
+		published.add(newTx(100+i, 1), now)
+	}
+	if len(published.txs) != maxPublishedTxs {
+		t.Errorf("%d transactions tracked, want %d", len(published.txs), maxPublishedTxs)
+	}
+}
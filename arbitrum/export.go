@@ -5,16 +5,53 @@ import (
 
 	"github.com/chainupcloud/arb-geth/common/hexutil"
 	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/eth/tracers"
 	"github.com/chainupcloud/arb-geth/internal/ethapi"
 	"github.com/chainupcloud/arb-geth/rpc"
 )
 
 type TransactionArgs = ethapi.TransactionArgs
+type StateOverride = ethapi.StateOverride
+type TraceConfig = tracers.TraceConfig
+type EstimateGasOptions = ethapi.EstimateGasOptions
+type EstimateGasResult = ethapi.EstimateGasResult
+
+const (
+	EstimateBinary     = ethapi.EstimateBinary
+	EstimateOptimistic = ethapi.EstimateOptimistic
+	EstimateHybrid     = ethapi.EstimateHybrid
+)
 
 func EstimateGas(ctx context.Context, b ethapi.Backend, args TransactionArgs, blockNrOrHash rpc.BlockNumberOrHash, gasCap uint64) (hexutil.Uint64, error) {
-	return ethapi.DoEstimateGas(ctx, b, args, blockNrOrHash, gasCap)
+	gas, err := ethapi.DoEstimateGas(ctx, b, args, blockNrOrHash, gasCap)
+	if err != nil {
+		return gas, decodeRevertError(err)
+	}
+	return gas, nil
+}
+
+// EstimateGasWithOptions estimates the gas of the call with the algorithm and error tolerance of the options, a binary
+// search if nil, returning the execution result at the estimate along with it if requested to save a follow-up call
+func EstimateGasWithOptions(ctx context.Context, b ethapi.Backend, args TransactionArgs, blockNrOrHash rpc.BlockNumberOrHash, gasCap uint64, opts *EstimateGasOptions) (*EstimateGasResult, error) {
+	res, err := ethapi.DoEstimateGasWithOptions(ctx, b, args, blockNrOrHash, gasCap, opts)
+	if err != nil {
+		return nil, decodeRevertError(err)
+	}
+	return res, nil
 }
 
+// NewRevertReason returns the json-rpc error of the reverted execution, decoding solidity errors and panics, stylus
+// revert payloads and the custom errors registered with RegisterRevertErrors
 func NewRevertReason(result *core.ExecutionResult) error {
-	return ethapi.NewRevertError(result)
+	return defaultRevertDecoder.Error(result.Revert())
+}
+
+// TraceCall traces the call on top of the state of the given block, with the given overrides applied to it.
+// The tracer is selected by traceConfig, nil means the struct logger with default settings
+func TraceCall(ctx context.Context, b tracers.Backend, args TransactionArgs, blockNrOrHash rpc.BlockNumberOrHash, traceConfig *TraceConfig, stateOverrides *StateOverride) (interface{}, error) {
+	config := &tracers.TraceCallConfig{StateOverrides: stateOverrides}
+	if traceConfig != nil {
+		config.TraceConfig = *traceConfig
+	}
+	return tracers.NewAPI(b).TraceCall(ctx, args, blockNrOrHash, config)
 }
@@ -0,0 +1,88 @@
+package arbitrum
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/common/math"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+type ArbFeeHistoryResult struct {
+	OldestBlock  *hexutil.Big     `json:"oldestBlock"`
+	Reward       [][]*hexutil.Big `json:"reward,omitempty"`
+	BaseFee      []*hexutil.Big   `json:"baseFeePerGas,omitempty"`
+	GasUsedRatio []float64        `json:"gasUsedRatio"`
+	// the L1 component of each block in the range
+	GasUsedForL1 []hexutil.Uint64 `json:"gasUsedForL1"`
+	GasUsedForL2 []hexutil.Uint64 `json:"gasUsedForL2"`
+	L1FeesPaid   []*hexutil.Big   `json:"l1FeesPaid"`
+	// EffectivePerGasSurplus is what the transactions of each block paid per unit of L2 gas on top of the base fee,
+	// which is mostly the L1 data fee spread over the L2 gas, and zero for blocks without L2 gas
+	EffectivePerGasSurplus []*hexutil.Big `json:"effectivePerGasSurplus"`
+}
+
+// FeeHistory extends eth_feeHistory with the L1 data fee component of each block in the range, computed from the
+// stored headers and receipts
+func (api *ArbAPI) FeeHistory(ctx context.Context, blockCount math.HexOrDecimal64, lastBlock rpc.BlockNumber, rewardPercentiles []float64) (*ArbFeeHistoryResult, error) {
+	oldest, reward, baseFee, gasUsedRatio, err := api.b.FeeHistory(ctx, uint64(blockCount), lastBlock, rewardPercentiles)
+	if err != nil {
+		return nil, err
+	}
+	result := &ArbFeeHistoryResult{
+		OldestBlock:            (*hexutil.Big)(oldest),
+		GasUsedRatio:           gasUsedRatio,
+		GasUsedForL1:           make([]hexutil.Uint64, len(gasUsedRatio)),
+		GasUsedForL2:           make([]hexutil.Uint64, len(gasUsedRatio)),
+		L1FeesPaid:             make([]*hexutil.Big, len(gasUsedRatio)),
+		EffectivePerGasSurplus: make([]*hexutil.Big, len(gasUsedRatio)),
+	}
+	if reward != nil {
+		result.Reward = make([][]*hexutil.Big, len(reward))
+		for i, w := range reward {
+			result.Reward[i] = make([]*hexutil.Big, len(w))
+			for j, v := range w {
+				result.Reward[i][j] = (*hexutil.Big)(v)
+			}
+		}
+	}
+	if baseFee != nil {
+		result.BaseFee = make([]*hexutil.Big, len(baseFee))
+		for i, v := range baseFee {
+			result.BaseFee[i] = (*hexutil.Big)(v)
+		}
+	}
+	bc := api.b.BlockChain()
+	for i := range gasUsedRatio {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		number := oldest.Uint64() + uint64(i)
+		header := bc.GetHeaderByNumber(number)
+		if header == nil {
+			return nil, fmt.Errorf("header not found for block %d", number)
+		}
+		receipts := bc.GetReceiptsByHash(header.Hash())
+		if receipts == nil {
+			return nil, fmt.Errorf("failed to get receipts for block %d hash %v", number, header.Hash())
+		}
+		fees := sumBlockFees(receipts)
+		surplus := new(big.Int)
+		if fees.gasUsedForL2 > 0 {
+			surplus.Div(fees.feesPaid, new(big.Int).SetUint64(fees.gasUsedForL2))
+			if header.BaseFee != nil {
+				surplus.Sub(surplus, header.BaseFee)
+			}
+			if surplus.Sign() < 0 {
+				surplus.SetUint64(0)
+			}
+		}
+		result.GasUsedForL1[i] = hexutil.Uint64(fees.gasUsedForL1)
+		result.GasUsedForL2[i] = hexutil.Uint64(fees.gasUsedForL2)
+		result.L1FeesPaid[i] = (*hexutil.Big)(fees.l1FeesPaid)
+		result.EffectivePerGasSurplus[i] = (*hexutil.Big)(surplus)
+	}
+	return result, nil
+}
@@ -0,0 +1,146 @@
+package arbitrum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/eth/tracers"
+	"github.com/chainupcloud/arb-geth/event"
+	"github.com/chainupcloud/arb-geth/node/grpcstream"
+	flag "github.com/spf13/pflag"
+)
+
+type GRPCStreamConfig struct {
+	Enable     bool   `koanf:"enable"`
+	Addr       string `koanf:"addr"`
+	Port       int    `koanf:"port"`
+	MaxStreams int    `koanf:"max-streams"`
+}
+
+var DefaultGRPCStreamConfig = GRPCStreamConfig{
+	Enable:     false,
+	Addr:       "localhost",
+	Port:       8549,
+	MaxStreams: 64,
+}
+
+func GRPCStreamConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultGRPCStreamConfig.Enable, "serve streams of new heads, receipts, traces and state diffs over gRPC")
+	f.String(prefix+".addr", DefaultGRPCStreamConfig.Addr, "gRPC stream server listening interface")
+	f.Int(prefix+".port", DefaultGRPCStreamConfig.Port, "gRPC stream server listening port")
+	f.Int(prefix+".max-streams", DefaultGRPCStreamConfig.MaxStreams, "number of concurrent gRPC streams served (0=unlimited)")
+}
+
+func newGRPCStreamServer(config *GRPCStreamConfig, backend *APIBackend) *grpcstream.Server {
+	return grpcstream.New(grpcstream.Config{
+		Addr:       net.JoinHostPort(config.Addr, strconv.Itoa(config.Port)),
+		MaxStreams: config.MaxStreams,
+	}, &grpcStreamBackend{backend})
+}
+
+// grpcStreamBackend serves the chain data streamed over gRPC
+type grpcStreamBackend struct {
+	b *APIBackend
+}
+
+func (s *grpcStreamBackend) CurrentHeader() *types.Header {
+	return s.b.BlockChain().CurrentHeader()
+}
+
+func (s *grpcStreamBackend) HeaderByNumber(number uint64) *types.Header {
+	return s.b.BlockChain().GetHeaderByNumber(number)
+}
+
+func (s *grpcStreamBackend) SubscribeNewHeads(ch chan<- *types.Header) event.Subscription {
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		events := make(chan core.ChainHeadEvent, 16)
+		sub := s.b.SubscribeChainHeadEvent(events)
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case ev := <-events:
+				select {
+				case ch <- ev.Block.Header():
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	})
+}
+
+func (s *grpcStreamBackend) Receipts(ctx context.Context, header *types.Header) (types.Receipts, error) {
+	return s.b.GetReceipts(ctx, header.Hash())
+}
+
+func (s *grpcStreamBackend) TraceBlock(ctx context.Context, header *types.Header, tracer string, config json.RawMessage) ([]byte, error) {
+	traceConfig := &tracers.TraceConfig{TracerConfig: config}
+	if tracer != "" {
+		traceConfig.Tracer = &tracer
+	}
+	result, err := tracers.NewAPI(s.b).TraceBlockByHash(ctx, header.Hash(), traceConfig)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+// StateDiff reads the state written by a block from its snapshot diff layer
+func (s *grpcStreamBackend) StateDiff(header *types.Header) (*grpcstream.StateDiff, error) {
+	bc := s.b.BlockChain()
+	snaps := bc.Snapshots()
+	if snaps == nil {
+		return nil, errors.New("snapshots disabled")
+	}
+	parent := bc.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+	if parent == nil {
+		return nil, fmt.Errorf("parent of block %d missing", header.Number)
+	}
+	diff := new(grpcstream.StateDiff)
+	if parent.Root == header.Root {
+		return diff, nil
+	}
+	changes, err := snaps.Changes(header.Root)
+	if err != nil {
+		return nil, err
+	}
+	// the bottom diff layer accumulates the writes of several blocks
+	if changes.Parent != parent.Root {
+		return nil, fmt.Errorf("snapshot of block %d merged with earlier blocks", header.Number)
+	}
+	snap := snaps.Snapshot(header.Root)
+	if snap == nil {
+		return nil, fmt.Errorf("snapshot of block %d missing", header.Number)
+	}
+	for hash := range changes.Destructs {
+		diff.Destructs = append(diff.Destructs, hash)
+	}
+	diff.Accounts = make(map[common.Hash][]byte, len(changes.Accounts))
+	for hash := range changes.Accounts {
+		if diff.Accounts[hash], err = snap.AccountRLP(hash); err != nil {
+			return nil, err
+		}
+	}
+	diff.Storage = make(map[common.Hash]map[common.Hash][]byte, len(changes.Storage))
+	for hash, slots := range changes.Storage {
+		values := make(map[common.Hash][]byte, len(slots))
+		for slot := range slots {
+			if values[slot], err = snap.Storage(hash, slot); err != nil {
+				return nil, err
+			}
+		}
+		diff.Storage[hash] = values
+	}
+	return diff, nil
+}
@@ -0,0 +1,211 @@
+package arbitrum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core/state/snapshot"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/metrics"
+	flag "github.com/spf13/pflag"
+)
+
+// compactionStallMeterSuffix ends the names of the meters of the time the databases stall writes while compacting
+const compactionStallMeterSuffix = "compact/writedelay/duration"
+
+type HealthConfig struct {
+	Enable               bool          `koanf:"enable"`
+	Path                 string        `koanf:"path"`
+	MaxBlocksBehind      uint64        `koanf:"max-blocks-behind"`
+	MaxFeedLag           time.Duration `koanf:"max-feed-lag"`
+	MaxHeadAge           time.Duration `koanf:"max-head-age"`
+	RequireSnapshot      bool          `koanf:"require-snapshot"`
+	AllowHealing         bool          `koanf:"allow-healing"`
+	MaxRecreationBacklog uint64        `koanf:"max-recreation-backlog"`
+	MaxCompactionStall   float64       `koanf:"max-compaction-stall"`
+}
+
+var DefaultHealthConfig = HealthConfig{
+	Enable:               false,
+	Path:                 "/health",
+	MaxBlocksBehind:      32,
+	MaxFeedLag:           time.Minute,
+	MaxHeadAge:           0,
+	RequireSnapshot:      false,
+	AllowHealing:         false,
+	MaxRecreationBacklog: 0,
+	MaxCompactionStall:   0.5,
+}
+
+func HealthConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultHealthConfig.Enable, "serve the readiness of the node for load balancers over http, answering 200 when ready and 503 otherwise (also served by admin_health)")
+	f.String(prefix+".path", DefaultHealthConfig.Path, "path of the http health endpoint")
+	f.Uint64(prefix+".max-blocks-behind", DefaultHealthConfig.MaxBlocksBehind, "number of blocks behind the sequencer above which the node isn't ready (0=ignore)")
+	f.Duration(prefix+".max-feed-lag", DefaultHealthConfig.MaxFeedLag, "lag of the sequencer feed above which the node isn't ready (0=ignore)")
+	f.Duration(prefix+".max-head-age", DefaultHealthConfig.MaxHeadAge, "age of the head block above which the node isn't ready (0=ignore)")
+	f.Bool(prefix+".require-snapshot", DefaultHealthConfig.RequireSnapshot, "the node isn't ready while the state snapshot is generated")
+	f.Bool(prefix+".allow-healing", DefaultHealthConfig.AllowHealing, "the node is ready while it heals its state")
+	f.Uint64(prefix+".max-recreation-backlog", DefaultHealthConfig.MaxRecreationBacklog, "number of blocks the state recreations in progress have left to replay above which the node isn't ready (0=ignore)")
+	f.Float64(prefix+".max-compaction-stall", DefaultHealthConfig.MaxCompactionStall, "fraction of the last minute a database stalled writes for compaction above which the node isn't ready, requires metrics (0=ignore)")
+}
+
+func (c *HealthConfig) Validate() error {
+	if c.Enable && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("invalid health endpoint path %q, must start with /", c.Path)
+	}
+	if c.MaxCompactionStall < 0 || c.MaxCompactionStall > 1 {
+		return errors.New("health max-compaction-stall must be between 0 and 1")
+	}
+	return nil
+}
+
+// HealthHead describes the head block of the node
+type HealthHead struct {
+	Number     hexutil.Uint64 `json:"number"`
+	Hash       common.Hash    `json:"hash"`
+	AgeSeconds float64        `json:"ageSeconds"`
+}
+
+// CompactionStall tells how much a database stalled writes while compacting
+type CompactionStall struct {
+	Database   string  `json:"database"`
+	StallRatio float64 `json:"stallRatio"` // fraction of the last minute writes were stalled
+}
+
+// HealthStatus is the readiness of the node, with the figures it's decided on
+type HealthStatus struct {
+	Ready                 bool                         `json:"ready"`
+	Reasons               []string                     `json:"reasons"` // why the node isn't ready
+	Head                  HealthHead                   `json:"head"`
+	BlocksBehindSequencer *hexutil.Uint64              `json:"blocksBehindSequencer,omitempty"`
+	FeedLag               *float64                     `json:"feedLagSeconds,omitempty"`
+	SnapshotGeneration    *snapshot.GenerationProgress `json:"snapshotGeneration,omitempty"`
+	HealBacklog           *hexutil.Uint64              `json:"healBacklog,omitempty"` // trie nodes and codes pending healing
+	RecreationBacklog     RecreationBacklog            `json:"recreationBacklog"`
+	Compaction            []*CompactionStall           `json:"compaction,omitempty"`
+	ShuttingDown          bool                         `json:"shuttingDown"`
+}
+
+// health gathers the readiness of the node, checked against the configured thresholds
+func (a *APIBackend) health() *HealthStatus {
+	config := &a.b.config.Health
+	stages := a.syncStages()
+	head := a.BlockChain().CurrentBlock()
+	status := &HealthStatus{
+		Reasons: []string{},
+		Head: HealthHead{
+			Number:     hexutil.Uint64(head.Number.Uint64()),
+			Hash:       head.Hash(),
+			AgeSeconds: time.Since(time.Unix(int64(head.Time), 0)).Seconds(),
+		},
+		BlocksBehindSequencer: stages.BlocksBehindSequencer,
+		FeedLag:               stages.FeedLag,
+		SnapshotGeneration:    stages.SnapshotGeneration,
+		RecreationBacklog:     stages.RecreationBacklog,
+		Compaction:            compactionStalls(),
+		ShuttingDown:          a.b.preparingShutdown.Load(),
+	}
+	if heal := stages.StateHeal; heal != nil {
+		backlog := hexutil.Uint64(heal.Scheduler.PendingNodes + heal.Scheduler.PendingCodes + heal.Scheduler.Queued)
+		status.HealBacklog = &backlog
+	}
+	fail := func(format string, args ...interface{}) {
+		status.Reasons = append(status.Reasons, fmt.Sprintf(format, args...))
+	}
+	if status.ShuttingDown {
+		fail("preparing to shut down")
+	}
+	if behind := status.BlocksBehindSequencer; config.MaxBlocksBehind > 0 && behind != nil && uint64(*behind) > config.MaxBlocksBehind {
+		fail("%d blocks behind the sequencer", *behind)
+	}
+	if lag := status.FeedLag; config.MaxFeedLag > 0 && lag != nil && *lag > config.MaxFeedLag.Seconds() {
+		fail("sequencer feed lagging %.1fs", *lag)
+	}
+	if config.MaxHeadAge > 0 && status.Head.AgeSeconds > config.MaxHeadAge.Seconds() {
+		fail("head block %d is %.0fs old", head.Number, status.Head.AgeSeconds)
+	}
+	if gen := status.SnapshotGeneration; config.RequireSnapshot && gen != nil && gen.Generating {
+		fail("snapshot generation at %.1f%%", gen.Progress*100)
+	}
+	if backlog := status.HealBacklog; !config.AllowHealing && backlog != nil && *backlog > 0 {
+		fail("%d trie nodes and codes pending healing", *backlog)
+	}
+	if blocks := uint64(status.RecreationBacklog.Blocks); config.MaxRecreationBacklog > 0 && blocks > config.MaxRecreationBacklog {
+		fail("%d blocks pending state recreation", blocks)
+	}
+	for _, stall := range status.Compaction {
+		if config.MaxCompactionStall > 0 && stall.StallRatio > config.MaxCompactionStall {
+			fail("database %s stalled %.0f%% of the last minute compacting", stall.Database, stall.StallRatio*100)
+		}
+	}
+	status.Ready = len(status.Reasons) == 0
+	return status
+}
+
+// compactionStalls reads the write stalls of the databases from their metrics, nil if metrics are disabled
+func compactionStalls() []*CompactionStall {
+	if !metrics.Enabled {
+		return nil
+	}
+	var stalls []*CompactionStall
+	metrics.DefaultRegistry.Each(func(name string, metric interface{}) {
+		meter, ok := metric.(metrics.Meter)
+		if !ok || !strings.HasSuffix(name, compactionStallMeterSuffix) {
+			return
+		}
+		stalls = append(stalls, &CompactionStall{
+			Database:   strings.TrimSuffix(strings.TrimSuffix(name, compactionStallMeterSuffix), "/"),
+			StallRatio: meter.Snapshot().Rate1() / float64(time.Second),
+		})
+	})
+	sort.Slice(stalls, func(i, j int) bool { return stalls[i].Database < stalls[j].Database })
+	return stalls
+}
+
+// healthHandler serves the readiness of the node over http
+type healthHandler struct {
+	b *APIBackend
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := h.b.health()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Debug("Failed to write health status", "err", err)
+	}
+}
+
+// HealthAPI serves the readiness of the node in the admin namespace
+type HealthAPI struct {
+	b *APIBackend
+}
+
+func NewHealthAPI(b *APIBackend) *HealthAPI {
+	return &HealthAPI{b}
+}
+
+// Health returns the readiness of the node, as served by the http health endpoint
+func (api *HealthAPI) Health(ctx context.Context) (*HealthStatus, error) {
+	return api.b.health(), nil
+}
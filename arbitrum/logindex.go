@@ -0,0 +1,45 @@
+package arbitrum
+
+import (
+	"context"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/logindex"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	flag "github.com/spf13/pflag"
+)
+
+type LogIndexConfig struct {
+	Enable    bool   `koanf:"enable"`
+	BatchSize uint64 `koanf:"batch-size"`
+}
+
+var DefaultLogIndexConfig = LogIndexConfig{
+	Enable:    false,
+	BatchSize: 1024,
+}
+
+func LogIndexConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultLogIndexConfig.Enable, "maintain a bitmap index of the blocks with logs of each address and topic, serving eth_getLogs ahead of the bloom bits")
+	f.Uint64(prefix+".batch-size", DefaultLogIndexConfig.BatchSize, "maximum number of blocks indexed or unwound per database write")
+}
+
+// the whole post-nitro chain is indexed, in the background on first start
+func newLogIndexer(config *LogIndexConfig, chainDb ethdb.Database, bc *core.BlockChain) *logindex.Indexer {
+	var tail uint64
+	if bc.Config().IsArbitrum() {
+		tail = bc.Config().ArbitrumChainParams.GenesisBlockNum
+	}
+	return logindex.NewIndexer(chainDb, bc, logindex.Config{
+		Tail:      tail,
+		BatchSize: config.BatchSize,
+	})
+}
+
+func (a *APIBackend) LogIndexMatches(ctx context.Context, begin, end uint64, addresses []common.Address, topics [][]common.Hash) ([]uint64, uint64, bool, error) {
+	if a.b.logIndexer == nil {
+		return nil, 0, false, nil
+	}
+	return a.b.logIndexer.Matches(ctx, begin, end, addresses, topics)
+}
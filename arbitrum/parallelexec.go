@@ -0,0 +1,33 @@
+package arbitrum
+
+import (
+	"runtime"
+
+	flag "github.com/spf13/pflag"
+)
+
+type ParallelExecutionConfig struct {
+	Enable  bool `koanf:"enable"`
+	Workers int  `koanf:"workers"`
+}
+
+var DefaultParallelExecutionConfig = ParallelExecutionConfig{
+	Enable:  false,
+	Workers: 0,
+}
+
+func ParallelExecutionConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultParallelExecutionConfig.Enable, "experimental: execute the transactions of imported and replayed blocks optimistically in parallel, executing them again serially when they clash")
+	f.Int(prefix+".workers", DefaultParallelExecutionConfig.Workers, "number of transactions executed concurrently (0=number of CPUs)")
+}
+
+// workers returns the number of transactions executed concurrently, 0 if disabled
+func (c *ParallelExecutionConfig) workers() int {
+	if !c.Enable {
+		return 0
+	}
+	if c.Workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return c.Workers
+}
@@ -0,0 +1,71 @@
+package arbitrum
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/internal/quota"
+	flag "github.com/spf13/pflag"
+)
+
+type QuotaConfig struct {
+	Enable             bool          `koanf:"enable"`
+	Window             time.Duration `koanf:"window"`
+	StateRecreationGas uint64        `koanf:"state-recreation-gas"`
+	TraceTime          time.Duration `koanf:"trace-time"`
+	LogBlocks          uint64        `koanf:"log-blocks"`
+	APIKeys            []string      `koanf:"api-keys"`
+	TrustForwardedFor  bool          `koanf:"trust-forwarded-for"`
+	MaxClients         int           `koanf:"max-clients"`
+}
+
+var DefaultQuotaConfig = QuotaConfig{
+	Enable:             false,
+	Window:             time.Minute,
+	StateRecreationGas: 10_000_000_000,
+	TraceTime:          time.Minute,
+	LogBlocks:          1_000_000,
+	APIKeys:            []string{},
+	TrustForwardedFor:  false,
+	MaxClients:         65536,
+}
+
+func QuotaConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultQuotaConfig.Enable, "meter the expensive RPC calls of each client, rejecting the calls above its budget with error code 429")
+	f.Duration(prefix+".window", DefaultQuotaConfig.Window, "time over which a client at rest recovers its whole budget")
+	f.Uint64(prefix+".state-recreation-gas", DefaultQuotaConfig.StateRecreationGas, "L2 gas a client may have replayed to recreate historical states per window (0=unlimited)")
+	f.Duration(prefix+".trace-time", DefaultQuotaConfig.TraceTime, "time a client may spend tracing per window (0=unlimited)")
+	f.Uint64(prefix+".log-blocks", DefaultQuotaConfig.LogBlocks, "blocks a client may query logs over per window (0=unlimited)")
+	f.StringSlice(prefix+".api-keys", DefaultQuotaConfig.APIKeys, "API keys identifying clients by the X-Api-Key header instead of their IP, as key=multiplier of the budgets (a bare key meaning 1, 0 meaning unlimited)")
+	f.Bool(prefix+".trust-forwarded-for", DefaultQuotaConfig.TrustForwardedFor, "identify clients by the X-Forwarded-For header, for nodes behind a proxy")
+	f.Int(prefix+".max-clients", DefaultQuotaConfig.MaxClients, "number of clients tracked, the least recently seen being forgotten")
+}
+
+func (c *QuotaConfig) engine() (*quota.Engine, error) {
+	keys := make(map[string]float64, len(c.APIKeys))
+	for _, entry := range c.APIKeys {
+		key, multiplier, scaled := strings.Cut(entry, "=")
+		if key == "" {
+			return nil, fmt.Errorf("empty API key in %q", entry)
+		}
+		keys[key] = 1
+		if scaled {
+			scale, err := strconv.ParseFloat(multiplier, 64)
+			if err != nil || scale < 0 {
+				return nil, fmt.Errorf("invalid multiplier of API key %q: %q", key, multiplier)
+			}
+			keys[key] = scale
+		}
+	}
+	return quota.New(quota.Config{
+		Window:             c.Window,
+		StateRecreationGas: c.StateRecreationGas,
+		TraceTime:          c.TraceTime,
+		LogBlocks:          c.LogBlocks,
+		Keys:               keys,
+		TrustForwardedFor:  c.TrustForwardedFor,
+		MaxClients:         c.MaxClients,
+	}), nil
+}
@@ -0,0 +1,117 @@
+package arbitrum
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/rpc"
+	"github.com/chainupcloud/arb-geth/trie"
+)
+
+type RangeProofResult struct {
+	Root   common.Hash     `json:"root"`
+	Origin hexutil.Bytes   `json:"origin"`
+	Keys   []hexutil.Bytes `json:"keys"`
+	Values []hexutil.Bytes `json:"values"`
+	// Proof holds the trie nodes proving the range boundaries, it's omitted if the range is the whole trie
+	Proof []hexutil.Bytes `json:"proof,omitempty"`
+	// More reports whether the trie holds entries past the returned ones
+	More bool `json:"more"`
+}
+
+func newRangeProofResult(root common.Hash, proof *trie.RangeProof, more bool) *RangeProofResult {
+	result := &RangeProofResult{
+		Root:   root,
+		Origin: proof.Origin,
+		Keys:   make([]hexutil.Bytes, len(proof.Keys)),
+		Values: make([]hexutil.Bytes, len(proof.Values)),
+		More:   more,
+	}
+	for i := range proof.Keys {
+		result.Keys[i], result.Values[i] = proof.Keys[i], proof.Values[i]
+	}
+	for _, node := range proof.Proof {
+		result.Proof = append(result.Proof, node)
+	}
+	return result
+}
+
+// rangeProofLimits returns the number of entries and bytes a range proof response may hold
+func (api *ArbAPI) rangeProofLimits(maxResults *hexutil.Uint64) (int, int) {
+	config := api.b.b.config
+	entries := config.RangeProofMaxEntries
+	if maxResults != nil && (entries == 0 || uint64(*maxResults) < entries) {
+		entries = uint64(*maxResults)
+	}
+	return int(entries), int(config.RangeProofMaxResponseSize)
+}
+
+// rangeProofState returns the state of the block, with its trie hashed so that it matches the block state root
+func (api *ArbAPI) rangeProofState(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash) (*state.StateDB, common.Hash, error) {
+	statedb, header, err := api.b.StateAndHeaderByNumberOrHash(ctx, blockNrOrHash)
+	if err != nil {
+		return nil, common.Hash{}, err
+	}
+	if root := statedb.IntermediateRoot(true); root != header.Root {
+		return nil, common.Hash{}, fmt.Errorf("state root mismatch for block %d: have %v, want %v", header.Number.Uint64(), root, header.Root)
+	}
+	return statedb, header.Root, nil
+}
+
+// GetAccountRange returns the accounts of the block state, keyed by address hash, from start up to limit (inclusive,
+// with the first account past it) or up to the response limits, along with the proofs of the range boundaries, so
+// that the range can be checked against the state root alone. A follow up request resumes past the last key.
+func (api *ArbAPI) GetAccountRange(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash, start hexutil.Bytes, limit *hexutil.Bytes, maxResults *hexutil.Uint64) (*RangeProofResult, error) {
+	statedb, root, err := api.rangeProofState(ctx, blockNrOrHash)
+	if err != nil {
+		return nil, err
+	}
+	maxEntries, maxBytes := api.rangeProofLimits(maxResults)
+	var end []byte
+	if limit != nil {
+		end = *limit
+	}
+	proof, err := statedb.AccountRangeProof(start, end, maxEntries, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	more, err := proof.Verify(root)
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid account range proof: %w", err)
+	}
+	return newRangeProofResult(root, proof, more), nil
+}
+
+// GetStorageRange returns the storage slots of the account in the block state, keyed by slot hash, like
+// GetAccountRange does for accounts. The proofs are against the storage root of the account.
+func (api *ArbAPI) GetStorageRange(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash, address common.Address, start hexutil.Bytes, limit *hexutil.Bytes, maxResults *hexutil.Uint64) (*RangeProofResult, error) {
+	statedb, _, err := api.rangeProofState(ctx, blockNrOrHash)
+	if err != nil {
+		return nil, err
+	}
+	maxEntries, maxBytes := api.rangeProofLimits(maxResults)
+	var end []byte
+	if limit != nil {
+		end = *limit
+	}
+	storage, err := statedb.StorageTrie(address)
+	if err != nil {
+		return nil, err
+	}
+	if storage == nil {
+		return nil, fmt.Errorf("account %v does not exist", address)
+	}
+	root := storage.Hash()
+	proof, err := trie.ProveRange(storage, start, end, maxEntries, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	more, err := proof.Verify(root)
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid storage range proof: %w", err)
+	}
+	return newRangeProofResult(root, proof, more), nil
+}
@@ -0,0 +1,194 @@
+package arbitrum
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+	flag "github.com/spf13/pflag"
+)
+
+type ReceiptFormatConfig struct {
+	Version        int           `koanf:"version"`
+	DictionarySize int           `koanf:"dictionary-size"`
+	TrainingBlocks uint64        `koanf:"training-blocks"`
+	Migrate        bool          `koanf:"migrate"`
+	BatchSize      int           `koanf:"batch-size"`
+	RetryInterval  time.Duration `koanf:"retry-interval"`
+}
+
+var DefaultReceiptFormatConfig = ReceiptFormatConfig{
+	Version:        rawdb.ReceiptFormatV1,
+	DictionarySize: 64 * 1024,
+	TrainingBlocks: 1024,
+	Migrate:        true,
+	BatchSize:      4 * 1024 * 1024,
+	RetryInterval:  time.Minute,
+}
+
+func ReceiptFormatConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Int(prefix+".version", DefaultReceiptFormatConfig.Version, "format new receipts are stored in: 1 for RLP, 2 for columns with deduplicated topics compressed with zstd")
+	f.Int(prefix+".dictionary-size", DefaultReceiptFormatConfig.DictionarySize, "maximum size in bytes of the zstd dictionary trained on the receipts of the chain when switching to format 2 (0 = no dictionary)")
+	f.Uint64(prefix+".training-blocks", DefaultReceiptFormatConfig.TrainingBlocks, "number of recent blocks whose receipts the zstd dictionary is trained on")
+	f.Bool(prefix+".migrate", DefaultReceiptFormatConfig.Migrate, "convert the receipts already stored outside of the ancient store to the format in the background")
+	f.Int(prefix+".batch-size", DefaultReceiptFormatConfig.BatchSize, "size in bytes of the converted receipts written per database batch, along with the migration progress")
+	f.Duration(prefix+".retry-interval", DefaultReceiptFormatConfig.RetryInterval, "time to wait before retrying a failed migration")
+}
+
+func (c *ReceiptFormatConfig) Validate() error {
+	if c.Version != rawdb.ReceiptFormatV1 && c.Version != rawdb.ReceiptFormatV2 {
+		return fmt.Errorf("unknown receipt format %d", c.Version)
+	}
+	return nil
+}
+
+type ReceiptFormatStatus struct {
+	Version    hexutil.Uint64          `json:"version"`
+	Dictionary hexutil.Uint64          `json:"dictionary"`
+	Migration  *ReceiptMigrationStatus `json:"migration,omitempty"`
+}
+
+type ReceiptMigrationStatus struct {
+	Version   hexutil.Uint64 `json:"version"`
+	Next      hexutil.Bytes  `json:"next,omitempty"`
+	Done      bool           `json:"done"`
+	Converted hexutil.Uint64 `json:"converted"`
+	Before    hexutil.Uint64 `json:"sizeBefore"`
+	After     hexutil.Uint64 `json:"sizeAfter"`
+}
+
+type receiptFormat struct {
+	config  *ReceiptFormatConfig
+	chainDb ethdb.Database
+	format  *rawdb.ReceiptFormat
+}
+
+// setupReceiptFormat switches the receipts written from now on to the configured
+// format, training the dictionary of the chain when first switching to format 2
+func setupReceiptFormat(config *ReceiptFormatConfig, chainDb ethdb.Database, bc *core.BlockChain) (*receiptFormat, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	stored := rawdb.ReadReceiptFormat(chainDb)
+	format := &rawdb.ReceiptFormat{Version: uint64(config.Version)}
+	if stored != nil && stored.Version == format.Version {
+		format = stored
+	} else if format.Version == rawdb.ReceiptFormatV2 && config.DictionarySize > 0 {
+		if dict := trainReceiptDictionary(chainDb, bc, config); dict != nil {
+			format.Dictionary = rawdb.WriteReceiptDictionary(chainDb, dict)
+			log.Info("Trained receipt dictionary", "id", format.Dictionary, "size", len(dict))
+		}
+	}
+	if err := rawdb.SetReceiptFormat(chainDb, format); err != nil {
+		return nil, err
+	}
+	if stored == nil || *stored != *format {
+		rawdb.WriteReceiptFormat(chainDb, format)
+	}
+	return &receiptFormat{config: config, chainDb: chainDb, format: format}, nil
+}
+
+func trainReceiptDictionary(chainDb ethdb.Database, bc *core.BlockChain, config *ReceiptFormatConfig) []byte {
+	var (
+		head    = bc.CurrentBlock().Number.Uint64()
+		samples []rlp.RawValue
+	)
+	for number := head; number+config.TrainingBlocks > head; number-- {
+		if hash := rawdb.ReadCanonicalHash(chainDb, number); hash != (common.Hash{}) {
+			if blob := rawdb.ReadReceiptsRLP(chainDb, hash, number); len(blob) > 0 {
+				samples = append(samples, blob)
+			}
+		}
+		if number == 0 {
+			break
+		}
+	}
+	return rawdb.TrainReceiptDictionary(samples, config.DictionarySize)
+}
+
+// migrationNeeded tells whether receipts may be stored in another format than
+// the one written, which is always the case once format 2 was used
+func (r *receiptFormat) migrationNeeded() bool {
+	progress := rawdb.ReadReceiptMigration(r.chainDb)
+	if progress != nil {
+		return progress.Version != r.format.Version || !progress.Done
+	}
+	return r.format.Version != rawdb.ReceiptFormatV1
+}
+
+func (r *receiptFormat) migrate(ctx context.Context) error {
+	progress := rawdb.ReadReceiptMigration(r.chainDb)
+	if progress == nil || progress.Version != r.format.Version {
+		progress = &rawdb.ReceiptMigration{Version: r.format.Version}
+	}
+	logged := time.Now()
+	for !progress.Done {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := rawdb.ConvertReceipts(r.chainDb, progress, r.config.BatchSize); err != nil {
+			return err
+		}
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Converting receipts", "format", progress.Version, "converted", progress.Converted, "before", progress.Before, "after", progress.After)
+			logged = time.Now()
+		}
+	}
+	log.Info("Converted receipts", "format", progress.Version, "converted", progress.Converted, "before", progress.Before, "after", progress.After)
+	return nil
+}
+
+func (r *receiptFormat) start(chanClose chan struct{}) {
+	if !r.config.Migrate || !r.migrationNeeded() {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-chanClose
+		cancel()
+	}()
+	go func() {
+		for {
+			err := r.migrate(ctx)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			log.Error("Receipt migration failed", "err", err)
+			select {
+			case <-chanClose:
+				return
+			case <-time.After(r.config.RetryInterval):
+			}
+		}
+	}()
+}
+
+// ReceiptFormat returns the format receipts are written in and the progress of the conversion of the stored ones
+func (api *ArbDebugAPI) ReceiptFormat() (*ReceiptFormatStatus, error) {
+	format := api.b.b.receiptFormat
+	if format == nil {
+		return nil, fmt.Errorf("receipt format not set up")
+	}
+	status := &ReceiptFormatStatus{
+		Version:    hexutil.Uint64(format.format.Version),
+		Dictionary: hexutil.Uint64(format.format.Dictionary),
+	}
+	if progress := rawdb.ReadReceiptMigration(format.chainDb); progress != nil {
+		status.Migration = &ReceiptMigrationStatus{
+			Version:   hexutil.Uint64(progress.Version),
+			Next:      progress.Next,
+			Done:      progress.Done,
+			Converted: hexutil.Uint64(progress.Converted),
+			Before:    hexutil.Uint64(progress.Before),
+			After:     hexutil.Uint64(progress.After),
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,44 @@
+package arbitrum
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/internal/ethapi"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+// GetBlockReceiptsRange returns the receipts of the transactions of each block in the inclusive range [fromBlock, toBlock],
+// as eth_getBlockReceipts does for a single block
+func (s *ArbTransactionAPI) GetBlockReceiptsRange(ctx context.Context, fromBlock, toBlock rpc.BlockNumber) ([][]map[string]interface{}, error) {
+	from, err := s.b.blockNumberToUint(ctx, fromBlock)
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.b.blockNumberToUint(ctx, toBlock)
+	if err != nil {
+		return nil, err
+	}
+	if from > to {
+		return nil, fmt.Errorf("invalid block range: from %d is after to %d", from, to)
+	}
+	if limit := s.b.b.config.BlockReceiptsMaxBlockCount; limit > 0 && to-from+1 > limit {
+		return nil, fmt.Errorf("block range too large: %d blocks requested, limit is %d", to-from+1, limit)
+	}
+	results := make([][]map[string]interface{}, 0, to-from+1)
+	for number := from; number <= to; number++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		block := s.b.BlockChain().GetBlockByNumber(number)
+		if block == nil {
+			return nil, fmt.Errorf("block %d not found", number)
+		}
+		receipts, err := ethapi.BlockReceipts(ctx, s.b, block)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, receipts)
+	}
+	return results, nil
+}
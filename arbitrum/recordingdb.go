@@ -318,29 +318,41 @@ func (r *RecordingDatabase) GetOrRecreateState(ctx context.Context, header *type
 	blockToRecreate := currentHeader.Number.Uint64() + 1
 	prevHash := currentHeader.Hash()
 	returnedBlockNumber := header.Number.Uint64()
+	progress := newRecreationProgressReporter(ctx, returnedBlockNumber)
+	opts := progress.replayOptions(nil)
+	fail := func(err error) error {
+		progress.done(blockToRecreate, err)
+		return err
+	}
 	for ctx.Err() == nil {
-		state, block, err := AdvanceStateByBlock(ctx, r.bc, state, header, blockToRecreate, prevHash, logFunc)
+		state, block, err := AdvanceStateByBlock(ctx, r.bc, state, header, blockToRecreate, prevHash, logFunc, opts)
 		if err != nil {
-			return nil, err
+			return nil, fail(err)
 		}
 		prevHash = block.Hash()
 		err = r.addStateVerify(state, block.Root())
 		if err != nil {
-			return nil, fmt.Errorf("failed committing state for block %d : %w", blockToRecreate, err)
+			return nil, fail(fmt.Errorf("failed committing state for block %d : %w", blockToRecreate, err))
+		}
+		if r.bc.RetainsState(blockToRecreate, block.Root()) {
+			if err := r.db.TrieDB().Commit(block.Root(), false); err != nil {
+				return nil, fail(fmt.Errorf("failed persisting state for block %d : %w", blockToRecreate, err))
+			}
 		}
 		r.dereferenceRoot(lastRoot)
 		lastRoot = block.Root()
 		if blockToRecreate >= returnedBlockNumber {
 			if block.Hash() != header.Hash() {
-				return nil, fmt.Errorf("blockHash doesn't match when recreating number: %d expected: %v got: %v", blockToRecreate, header.Hash(), block.Hash())
+				return nil, fail(newRecreationError(ErrReorgDetected, blockToRecreate, nil, "blockHash doesn't match when recreating number: %d expected: %v got: %v", blockToRecreate, header.Hash(), block.Hash()))
 			}
 			// don't dereference this one
 			lastRoot = common.Hash{}
+			progress.done(blockToRecreate, nil)
 			return state, nil
 		}
 		blockToRecreate++
 	}
-	return nil, ctx.Err()
+	return nil, fail(ctx.Err())
 }
 
 func (r *RecordingDatabase) ReferenceCount() int64 {
@@ -3,27 +3,163 @@ package arbitrum
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/chainupcloud/arb-geth/common"
 	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
 	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/core/state/snapshot"
 	"github.com/chainupcloud/arb-geth/core/types"
 	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
 	"github.com/pkg/errors"
 )
 
 var (
 	ErrDepthLimitExceeded = errors.New("state recreation l2 gas depth limit exceeded")
+	ErrBlockNotFound      = errors.New("block not found")
+	ErrReorgDetected      = errors.New("reorg detected")
+	ErrBeyondGenesis      = errors.New("moved beyond genesis")
+	ErrNoReceipts         = errors.New("receipts not found")
 )
 
+// recreationErrorKinds maps the kinds of RecreationError to their distinct rpc error code, the reason
+// reported to clients, and whether retrying the request may succeed. The codes are picked from -32010 on,
+// so that they don't clash with the ones of EIP-1474 nor the ones the rpc package reports itself
+var recreationErrorKinds = map[error]struct {
+	code      int
+	reason    string
+	retryable bool
+}{
+	ErrBeyondGenesis:      {-32010, "beyond-genesis", false},
+	ErrNoReceipts:         {-32011, "no-receipts", false},
+	ErrDepthLimitExceeded: {-32012, "depth-limit-exceeded", false},
+	ErrBlockNotFound:      {-32013, "block-not-found", true}, // the chain may be in the middle of a reorg
+	ErrReorgDetected:      {-32014, "reorg-detected", true},
+}
+
+// stateNotAvailableErrorCode follows the codes of recreationErrorKinds
+const stateNotAvailableErrorCode = -32015
+
+// RecreationError is returned when recreating state fails, Kind is one of ErrBlockNotFound,
+// ErrReorgDetected, ErrBeyondGenesis, ErrNoReceipts or ErrDepthLimitExceeded, errors.Is matches both
+// the kind and the cause
+type RecreationError struct {
+	Kind  error
+	Block uint64
+	msg   string
+	cause error
+}
+
+func newRecreationError(kind error, block uint64, cause error, format string, args ...interface{}) *RecreationError {
+	return &RecreationError{Kind: kind, Block: block, msg: fmt.Sprintf(format, args...), cause: cause}
+}
+
+func (e *RecreationError) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%v: %s: %v", e.Kind, e.msg, e.cause)
+	}
+	return fmt.Sprintf("%v: %s", e.Kind, e.msg)
+}
+
+func (e *RecreationError) Is(target error) bool { return target == e.Kind }
+
+func (e *RecreationError) Unwrap() error { return e.cause }
+
+// Retryable tells whether the same request may succeed later, once the chain settles
+func (e *RecreationError) Retryable() bool { return recreationErrorKinds[e.Kind].retryable }
+
+func (e *RecreationError) ErrorCode() int {
+	if kind, ok := recreationErrorKinds[e.Kind]; ok {
+		return kind.code
+	}
+	return -32000
+}
+
+type RecreationErrorData struct {
+	Reason    string `json:"reason"`
+	Block     uint64 `json:"block"`
+	Retryable bool   `json:"retryable"`
+}
+
+func (e *RecreationError) ErrorData() interface{} {
+	kind := recreationErrorKinds[e.Kind]
+	return &RecreationErrorData{Reason: kind.reason, Block: e.Block, Retryable: kind.retryable}
+}
+
+// StateNotAvailableError is returned when the state of a block isn't available on disk
+// and recreating it isn't allowed by the max-recreate-state-depth setting
+type StateNotAvailableError struct {
+	Block    uint64 `json:"block"`
+	MaxDepth int64  `json:"maxRecreateStateDepth"`
+	err      error
+}
+
+func (e *StateNotAvailableError) Error() string {
+	if e.MaxDepth == 0 {
+		return fmt.Sprintf("state for block %d is not available and state recreation is disabled: %v", e.Block, e.err)
+	}
+	return fmt.Sprintf("state for block %d is not available within max-recreate-state-depth of %d l2 gas: %v", e.Block, e.MaxDepth, e.err)
+}
+
+func (e *StateNotAvailableError) Unwrap() error { return e.err }
+
+func (e *StateNotAvailableError) ErrorCode() int { return stateNotAvailableErrorCode }
+
+func (e *StateNotAvailableError) ErrorData() interface{} { return e }
+
+// StateBuildingLogFunction is called for each block searched through and replayed while recreating state, see
+// WithRecreationProgress for structured progress events
 type StateBuildingLogFunction func(targetHeader, header *types.Header, hasState bool)
 type StateForHeaderFunction func(header *types.Header) (*state.StateDB, error)
 
+// AdvanceStateOptions tunes how blocks are replayed when recreating state, nil means defaults
+type AdvanceStateOptions struct {
+	// if set, the preimages of all hashed account and storage keys touched during replay
+	// are persisted to PreimageDB, so that the recreated state can later be iterated by address
+	PreimageDB ethdb.KeyValueWriter
+	// if set, called after each replayed block with the l2 gas it used and the time its replay took
+	BlockReplayed func(block *types.Block, l2GasUsed uint64, elapsed time.Duration)
+	// if set, called after each replayed block with the receipts its replay produced
+	ReceiptsReplayed func(block *types.Block, receipts types.Receipts)
+	// number of goroutines warming the trie nodes of the next block to replay (0=no prefetching),
+	// only used by AdvanceStateUpToBlock
+	PrefetchWorkers int
+	// if set, the replayed states the blockchain's retention policy requires are persisted to disk
+	PersistRetained bool
+	// if set, called with the accounts and storage slots each replayed transaction read and wrote,
+	// in transaction order, before the block is reported as replayed
+	TxAccessList func(block *types.Block, list *state.TxAccessList)
+	// if set, called with the result of each replayed transaction as soon as it's executed, returning
+	// an error aborts the recreation with it. the replay is serial when set
+	TxReplayed func(block *types.Block, result *core.TxResult) error
+	// if set, a flat snapshot of these accounts and their storage is generated at the last available
+	// state before replaying, so that their reads skip the tries, only used by AdvanceStateUpToBlock
+	SnapshotSliceAccounts []common.Address
+	// max number of storage slots of an account whose storage is included in the snapshot slice (0=no limit)
+	SnapshotSliceMaxSlots uint64
+}
+
 // finds last available state and header checking it first for targetHeader then looking backwards
 // if maxDepthInL2Gas is positive, it constitutes a limit for cumulative l2 gas used of the traversed blocks
 // else if maxDepthInL2Gas is -1, the traversal depth is not limited
 // otherwise only targetHeader state is checked and no search is performed
 func FindLastAvailableState(ctx context.Context, bc *core.BlockChain, stateFor StateForHeaderFunction, targetHeader *types.Header, logFunc StateBuildingLogFunction, maxDepthInL2Gas int64) (*state.StateDB, *types.Header, error) {
+	progress := newRecreationProgressReporter(ctx, targetHeader.Number.Uint64())
+	state, header, err := findLastAvailableState(ctx, bc, stateFor, targetHeader, logFunc, maxDepthInL2Gas, progress)
+	if err != nil {
+		var block uint64
+		if header != nil {
+			block = header.Number.Uint64()
+		}
+		progress.report(RecreationFailed, block, 0, 0, err)
+	}
+	return state, header, err
+}
+
+func findLastAvailableState(ctx context.Context, bc *core.BlockChain, stateFor StateForHeaderFunction, targetHeader *types.Header, logFunc StateBuildingLogFunction, maxDepthInL2Gas int64, progress *recreationProgressReporter) (*state.StateDB, *types.Header, error) {
 	genesis := bc.Config().ArbitrumChainParams.GenesisBlockNum
 	currentHeader := targetHeader
 	var state *state.StateDB
@@ -35,16 +171,18 @@ func FindLastAvailableState(ctx context.Context, bc *core.BlockChain, stateFor S
 		if err == nil {
 			break
 		}
+		var blockL2Gas uint64
 		if maxDepthInL2Gas > 0 {
 			receipts := bc.GetReceiptsByHash(currentHeader.Hash())
 			if receipts == nil {
-				return nil, lastHeader, fmt.Errorf("failed to get receipts for hash %v", currentHeader.Hash())
+				return nil, lastHeader, newRecreationError(ErrNoReceipts, currentHeader.Number.Uint64(), nil, "hash %v", currentHeader.Hash())
 			}
 			for _, receipt := range receipts {
-				l2GasUsed += receipt.GasUsed - receipt.GasUsedForL1
+				blockL2Gas += receipt.GasUsed - receipt.GasUsedForL1
 			}
+			l2GasUsed += blockL2Gas
 			if l2GasUsed > uint64(maxDepthInL2Gas) {
-				return nil, lastHeader, ErrDepthLimitExceeded
+				return nil, lastHeader, newRecreationError(ErrDepthLimitExceeded, currentHeader.Number.Uint64(), nil, "%d l2 gas used, limit %d", l2GasUsed, maxDepthInL2Gas)
 			}
 		} else if maxDepthInL2Gas != InfiniteMaxRecreateStateDepth {
 			return nil, lastHeader, err
@@ -52,52 +190,189 @@ func FindLastAvailableState(ctx context.Context, bc *core.BlockChain, stateFor S
 		if logFunc != nil {
 			logFunc(targetHeader, currentHeader, false)
 		}
+		progress.report(RecreationSearching, currentHeader.Number.Uint64(), 0, blockL2Gas, nil)
 		if currentHeader.Number.Uint64() <= genesis {
-			return nil, lastHeader, errors.Wrap(err, fmt.Sprintf("moved beyond genesis looking for state %d, genesis %d", targetHeader.Number.Uint64(), genesis))
+			return nil, lastHeader, newRecreationError(ErrBeyondGenesis, targetHeader.Number.Uint64(), err, "looking for state %d, genesis %d", targetHeader.Number.Uint64(), genesis)
 		}
 		currentHeader = bc.GetHeader(currentHeader.ParentHash, currentHeader.Number.Uint64()-1)
 		if currentHeader == nil {
-			return nil, lastHeader, fmt.Errorf("chain doesn't contain parent of block %d hash %v", lastHeader.Number, lastHeader.Hash())
+			return nil, lastHeader, newRecreationError(ErrBlockNotFound, lastHeader.Number.Uint64()-1, nil, "parent of block %d hash %v", lastHeader.Number, lastHeader.Hash())
 		}
 	}
+	if ctx.Err() == nil && currentHeader != targetHeader {
+		log.FromContext(ctx).Debug("Found last available state", "target", targetHeader.Number, "found", currentHeader.Number, "l2gas", l2GasUsed)
+	}
 	return state, currentHeader, ctx.Err()
 }
 
-func AdvanceStateByBlock(ctx context.Context, bc *core.BlockChain, state *state.StateDB, targetHeader *types.Header, blockToRecreate uint64, prevBlockHash common.Hash, logFunc StateBuildingLogFunction) (*state.StateDB, *types.Block, error) {
+// findLastAvailableStateWithinStride is FindLastAvailableState for sparse archive nodes, which persist the state of
+// every stride-th block: the search stops at the last stride block, the replay depth being bounded by the stride
+// in place of maxDepthInL2Gas. if the stride state is missing too (e.g. the block predates the sparse archive mode),
+// the search goes on from there within maxDepthInL2Gas
+func findLastAvailableStateWithinStride(ctx context.Context, bc *core.BlockChain, stateFor StateForHeaderFunction, targetHeader *types.Header, stride uint64, maxDepthInL2Gas int64) (*state.StateDB, *types.Header, error) {
+	if stride == 0 || maxDepthInL2Gas == 0 {
+		return FindLastAvailableState(ctx, bc, stateFor, targetHeader, nil, maxDepthInL2Gas)
+	}
+	base := targetHeader.Number.Uint64() - targetHeader.Number.Uint64()%stride
+	if genesis := bc.Config().ArbitrumChainParams.GenesisBlockNum; base < genesis {
+		base = genesis
+	}
+	currentHeader := targetHeader
+	for currentHeader.Number.Uint64() > base {
+		if ctx.Err() != nil {
+			return nil, currentHeader, ctx.Err()
+		}
+		// recent states may still be held in memory
+		if state, err := stateFor(currentHeader); err == nil {
+			return state, currentHeader, nil
+		}
+		lastHeader := currentHeader
+		currentHeader = bc.GetHeader(currentHeader.ParentHash, currentHeader.Number.Uint64()-1)
+		if currentHeader == nil {
+			return nil, lastHeader, newRecreationError(ErrBlockNotFound, lastHeader.Number.Uint64()-1, nil, "parent of block %d hash %v", lastHeader.Number, lastHeader.Hash())
+		}
+	}
+	return FindLastAvailableState(ctx, bc, stateFor, currentHeader, nil, maxDepthInL2Gas)
+}
+
+func AdvanceStateByBlock(ctx context.Context, bc *core.BlockChain, state *state.StateDB, targetHeader *types.Header, blockToRecreate uint64, prevBlockHash common.Hash, logFunc StateBuildingLogFunction, opts *AdvanceStateOptions) (*state.StateDB, *types.Block, error) {
 	block := bc.GetBlockByNumber(blockToRecreate)
 	if block == nil {
-		return nil, nil, fmt.Errorf("block not found while recreating: %d", blockToRecreate)
+		return nil, nil, newRecreationError(ErrBlockNotFound, blockToRecreate, nil, "number %d while recreating", blockToRecreate)
 	}
 	if block.ParentHash() != prevBlockHash {
-		return nil, nil, fmt.Errorf("reorg detected: number %d expectedPrev: %v foundPrev: %v", blockToRecreate, prevBlockHash, block.ParentHash())
+		return nil, nil, newRecreationError(ErrReorgDetected, blockToRecreate, nil, "number %d expectedPrev: %v foundPrev: %v", blockToRecreate, prevBlockHash, block.ParentHash())
 	}
 	if logFunc != nil {
 		logFunc(targetHeader, block.Header(), true)
 	}
-	_, _, _, err := bc.Processor().Process(block, state, vm.Config{})
+	recordPreimages := opts != nil && opts.PreimageDB != nil
+	if recordPreimages {
+		state.StartKeyPreimageRecording()
+	}
+	if opts != nil && opts.TxAccessList != nil {
+		startTxAccessRecording(state, block, opts.TxAccessList)
+	}
+	state.SetContext(ctx)
+	var stream *core.TxStream
+	if opts != nil && opts.TxReplayed != nil {
+		stream = &core.TxStream{OnTx: func(result *core.TxResult) error {
+			return opts.TxReplayed(block, result)
+		}}
+	}
+	start := time.Now()
+	receipts, _, _, err := bc.Processor().ProcessStream(core.WithBlockReplay(ctx), block, state, vm.Config{}, stream)
+	state.StopAccessRecording()
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed recreating state for block %d : %w", blockToRecreate, err)
 	}
+	if opts != nil && opts.ReceiptsReplayed != nil {
+		opts.ReceiptsReplayed(block, receipts)
+	}
+	if opts != nil && opts.BlockReplayed != nil {
+		var l2GasUsed uint64
+		for _, receipt := range receipts {
+			l2GasUsed += receipt.GasUsed - receipt.GasUsedForL1
+		}
+		opts.BlockReplayed(block, l2GasUsed, time.Since(start))
+	}
+	if recordPreimages {
+		rawdb.WritePreimages(opts.PreimageDB, state.KeyPreimages())
+		rawdb.WritePreimages(opts.PreimageDB, state.Preimages())
+	}
+	if opts != nil && opts.PersistRetained && bc.RetainsState(block.NumberU64(), block.Root()) {
+		state, err = persistRecreatedState(bc, state, block)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	return state, block, nil
 }
 
-func AdvanceStateUpToBlock(ctx context.Context, bc *core.BlockChain, state *state.StateDB, targetHeader *types.Header, lastAvailableHeader *types.Header, logFunc StateBuildingLogFunction) (*state.StateDB, error) {
+// startTxAccessRecording streams the access lists of the transactions of the block replayed on the statedb to the callback
+func startTxAccessRecording(statedb *state.StateDB, block *types.Block, callback func(*types.Block, *state.TxAccessList)) {
+	statedb.StartAccessRecording(func(list *state.TxAccessList) {
+		callback(block, list)
+	})
+}
+
+// persistRecreatedState writes the state recreated for the block to disk, and returns a fresh
+// statedb on top of it, as a committed statedb can't be used anymore
+func persistRecreatedState(bc *core.BlockChain, statedb *state.StateDB, block *types.Block) (*state.StateDB, error) {
+	root, err := statedb.Commit(bc.Config().IsEIP158(block.Number()))
+	if err != nil {
+		return nil, fmt.Errorf("failed committing recreated state for block %d: %w", block.NumberU64(), err)
+	}
+	if root != block.Root() {
+		return nil, fmt.Errorf("bad root hash recreating block %d expected: %v got: %v", block.NumberU64(), block.Root(), root)
+	}
+	if err := statedb.Database().TrieDB().Commit(root, false); err != nil {
+		return nil, fmt.Errorf("failed persisting recreated state for block %d: %w", block.NumberU64(), err)
+	}
+	return state.New(root, statedb.Database(), nil)
+}
+
+func AdvanceStateUpToBlock(ctx context.Context, bc *core.BlockChain, state *state.StateDB, targetHeader *types.Header, lastAvailableHeader *types.Header, logFunc StateBuildingLogFunction, opts *AdvanceStateOptions) (*state.StateDB, error) {
 	returnedBlockNumber := targetHeader.Number.Uint64()
 	blockToRecreate := lastAvailableHeader.Number.Uint64() + 1
 	prevHash := lastAvailableHeader.Hash()
+	logger := log.FromContext(ctx)
+	logger.Debug("Replaying blocks to recreate state", "from", blockToRecreate, "target", returnedBlockNumber)
+	start := time.Now()
+	progress := newRecreationProgressReporter(ctx, returnedBlockNumber)
+	opts = progress.replayOptions(opts)
+	var prefetcher *recreationPrefetcher
+	stopPrefetch := func() {}
+	defer func() { stopPrefetch() }()
+	if opts != nil && opts.PrefetchWorkers > 0 {
+		// warm the first block while it's being replayed, and then each following block one step ahead
+		prefetcher = newRecreationPrefetcher(bc, state.Database(), lastAvailableHeader.Root, opts.PrefetchWorkers)
+		if first := bc.GetBlockByNumber(blockToRecreate); first != nil {
+			stopPrefetch = prefetcher.prefetch(ctx, first)
+		}
+	}
+	if opts != nil && len(opts.SnapshotSliceAccounts) > 0 {
+		useSnapshotSlice(ctx, state, lastAvailableHeader.Root, opts.SnapshotSliceAccounts, opts.SnapshotSliceMaxSlots)
+	}
 	for ctx.Err() == nil {
-		state, block, err := AdvanceStateByBlock(ctx, bc, state, targetHeader, blockToRecreate, prevHash, logFunc)
+		stopCurrentPrefetch := stopPrefetch
+		stopPrefetch = func() {}
+		if prefetcher != nil && blockToRecreate < returnedBlockNumber {
+			if next := bc.GetBlockByNumber(blockToRecreate + 1); next != nil {
+				stopPrefetch = prefetcher.prefetch(ctx, next)
+			}
+		}
+		state, block, err := AdvanceStateByBlock(ctx, bc, state, targetHeader, blockToRecreate, prevHash, logFunc, opts)
+		stopCurrentPrefetch()
 		if err != nil {
+			logger.Debug("Failed recreating state", "block", blockToRecreate, "elapsed", time.Since(start), "err", err)
+			progress.done(blockToRecreate, err)
 			return nil, err
 		}
 		prevHash = block.Hash()
 		if blockToRecreate >= returnedBlockNumber {
 			if block.Hash() != targetHeader.Hash() {
-				return nil, fmt.Errorf("blockHash doesn't match when recreating number: %d expected: %v got: %v", blockToRecreate, targetHeader.Hash(), block.Hash())
+				err := newRecreationError(ErrReorgDetected, blockToRecreate, nil, "blockHash doesn't match when recreating number: %d expected: %v got: %v", blockToRecreate, targetHeader.Hash(), block.Hash())
+				progress.done(blockToRecreate, err)
+				return nil, err
 			}
+			logger.Debug("Recreated state", "block", blockToRecreate, "replayed", returnedBlockNumber-lastAvailableHeader.Number.Uint64(), "elapsed", time.Since(start))
+			progress.done(blockToRecreate, nil)
 			return state, nil
 		}
 		blockToRecreate++
 	}
+	progress.done(blockToRecreate, ctx.Err())
 	return nil, ctx.Err()
 }
+
+// useSnapshotSlice backs the reads of the accounts by a snapshot slice generated at root, unless the state is
+// backed by the snapshot tree already. failing to generate the slice only slows the replay down
+func useSnapshotSlice(ctx context.Context, statedb *state.StateDB, root common.Hash, accounts []common.Address, maxSlots uint64) {
+	slice, err := snapshot.GenerateSlice(ctx, statedb.Database().TrieDB(), root, accounts, maxSlots)
+	if err != nil {
+		log.FromContext(ctx).Debug("Failed generating snapshot slice for recreation", "root", root, "err", err)
+		return
+	}
+	statedb.SetSnapshotSlice(slice)
+}
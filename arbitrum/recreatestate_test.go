@@ -0,0 +1,57 @@
+package arbitrum
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+func TestRecreationErrorKinds(t *testing.T) {
+	cause := errors.New("cause")
+	tests := []struct {
+		kind      error
+		code      int
+		reason    string
+		retryable bool
+	}{
+		{ErrBeyondGenesis, -32010, "beyond-genesis", false},
+		{ErrNoReceipts, -32011, "no-receipts", false},
+		{ErrDepthLimitExceeded, -32012, "depth-limit-exceeded", false},
+		{ErrBlockNotFound, -32013, "block-not-found", true},
+		{ErrReorgDetected, -32014, "reorg-detected", true},
+	}
+	if len(tests) != len(recreationErrorKinds) {
+		t.Fatalf("%d error kinds tested, %d defined", len(tests), len(recreationErrorKinds))
+	}
+	codes := make(map[int]error)
+	for _, tt := range tests {
+		err := newRecreationError(tt.kind, 42, cause, "test")
+		var rpcErr rpc.Error = err
+		if code := rpcErr.ErrorCode(); code != tt.code {
+			t.Errorf("%v: code %d, want %d", tt.kind, code, tt.code)
+		}
+		if other, ok := codes[tt.code]; ok {
+			t.Errorf("%v: code %d already used by %v", tt.kind, tt.code, other)
+		}
+		codes[tt.code] = tt.kind
+
+		data := err.ErrorData().(*RecreationErrorData)
+		if data.Reason != tt.reason || data.Block != 42 || data.Retryable != tt.retryable {
+			t.Errorf("%v: data %+v, want reason %s, block 42, retryable %v", tt.kind, data, tt.reason, tt.retryable)
+		}
+		if err.Retryable() != tt.retryable {
+			t.Errorf("%v: retryable %v, want %v", tt.kind, err.Retryable(), tt.retryable)
+		}
+		if !errors.Is(err, tt.kind) || !errors.Is(err, cause) {
+			t.Errorf("%v: error doesn't match its kind and cause", tt.kind)
+		}
+	}
+	var rpcErr rpc.Error = &StateNotAvailableError{Block: 42, err: cause}
+	if code := rpcErr.ErrorCode(); code != -32015 {
+		t.Errorf("state not available: code %d, want %d", code, -32015)
+	}
+	if other, ok := codes[rpcErr.ErrorCode()]; ok {
+		t.Errorf("state not available: code %d already used by %v", rpcErr.ErrorCode(), other)
+	}
+}
@@ -0,0 +1,294 @@
+package arbitrum
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/rpc"
+	flag "github.com/spf13/pflag"
+)
+
+type RecreationLimitsConfig struct {
+	MaxBlocks            uint64        `koanf:"max-blocks"`
+	MaxDuration          time.Duration `koanf:"max-duration"`
+	FallbackGasPerSecond uint64        `koanf:"fallback-gas-per-second"`
+	NearestSearchBlocks  uint64        `koanf:"nearest-search-blocks"`
+}
+
+var DefaultRecreationLimitsConfig = RecreationLimitsConfig{
+	MaxBlocks:            0,
+	MaxDuration:          0,
+	FallbackGasPerSecond: 10_000_000,
+	NearestSearchBlocks:  65536,
+}
+
+func RecreationLimitsConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Uint64(prefix+".max-blocks", DefaultRecreationLimitsConfig.MaxBlocks, "reject state recreations that would replay more than this many blocks (0=unlimited)")
+	f.Duration(prefix+".max-duration", DefaultRecreationLimitsConfig.MaxDuration, "reject state recreations expected to take longer than this (0=unlimited)")
+	f.Uint64(prefix+".fallback-gas-per-second", DefaultRecreationLimitsConfig.FallbackGasPerSecond, "l2 gas replayed per second assumed when estimating recreation time before any throughput was measured")
+	f.Uint64(prefix+".nearest-search-blocks", DefaultRecreationLimitsConfig.NearestSearchBlocks, "number of blocks searched back for a state when reporting the nearest block whose tracing is within the limits, and when estimating a recreation nothing else bounds")
+}
+
+func (c *RecreationLimitsConfig) enabled() bool {
+	return c.MaxBlocks > 0 || c.MaxDuration > 0
+}
+
+// StateRecreationEstimate describes the work needed to recreate the state of a block
+type StateRecreationEstimate struct {
+	TargetBlock      hexutil.Uint64  `json:"targetBlock"`
+	BaseBlock        *hexutil.Uint64 `json:"baseBlock,omitempty"` // nil if no state was found within the search limit
+	Blocks           hexutil.Uint64  `json:"blocks"`
+	L2Gas            hexutil.Uint64  `json:"l2Gas"`
+	GasPerSecond     hexutil.Uint64  `json:"gasPerSecond"`
+	ExpectedDuration float64         `json:"expectedDuration"` // in seconds
+	Allowed          bool            `json:"allowed"`
+	Reason           string          `json:"reason,omitempty"`
+}
+
+func (e *StateRecreationEstimate) duration() time.Duration {
+	return time.Duration(e.ExpectedDuration * float64(time.Second))
+}
+
+// StateRecreationTooExpensiveError is returned instead of recreating a state whose estimated cost exceeds the configured limits
+type StateRecreationTooExpensiveError struct {
+	Estimate *StateRecreationEstimate
+	nearest  func(ctx context.Context) (uint64, bool, error)
+}
+
+func (e *StateRecreationTooExpensiveError) Error() string {
+	return fmt.Sprintf("state recreation for block %d too expensive: %s", e.Estimate.TargetBlock, e.Estimate.Reason)
+}
+
+func (e *StateRecreationTooExpensiveError) ErrorCode() int { return -32005 }
+
+func (e *StateRecreationTooExpensiveError) ErrorData() interface{} { return e.Estimate }
+
+// NearestAffordableState looks for the highest block below the target whose state recreation is within the limits
+func (e *StateRecreationTooExpensiveError) NearestAffordableState(ctx context.Context) (uint64, bool, error) {
+	if e.nearest == nil {
+		return 0, false, nil
+	}
+	return e.nearest(ctx)
+}
+
+// EstimateStateRecreation walks back from targetHeader to the closest block with available state,
+// accumulating the l2 gas of the blocks that would need to be replayed.
+// If maxBlocks is positive, the search stops after that many blocks and BaseBlock is left unset. The search also
+// stops once the l2 gas exceeds maxL2Gas, which is a recreate state depth (0=don't recreate state, -1=infinite), then
+// leaving BaseBlock unset with the reason set.
+func EstimateStateRecreation(ctx context.Context, bc *core.BlockChain, targetHeader *types.Header, maxBlocks uint64, maxL2Gas int64, gasPerSecond uint64) (*StateRecreationEstimate, error) {
+	genesis := bc.Config().ArbitrumChainParams.GenesisBlockNum
+	estimate := &StateRecreationEstimate{
+		TargetBlock:  hexutil.Uint64(targetHeader.Number.Uint64()),
+		GasPerSecond: hexutil.Uint64(gasPerSecond),
+	}
+	var l2Gas uint64
+	currentHeader := targetHeader
+	for !bc.HasState(currentHeader.Root) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if maxBlocks > 0 && uint64(estimate.Blocks) >= maxBlocks {
+			break
+		}
+		if maxL2Gas != InfiniteMaxRecreateStateDepth && maxL2Gas <= 0 {
+			estimate.Reason = "state recreation disabled"
+			break
+		}
+		receipts := bc.GetReceiptsByHash(currentHeader.Hash())
+		if receipts == nil {
+			return nil, fmt.Errorf("failed to get receipts for hash %v", currentHeader.Hash())
+		}
+		l2Gas += receiptsL2Gas(receipts)
+		estimate.Blocks++
+		if maxL2Gas > 0 && l2Gas > uint64(maxL2Gas) {
+			estimate.Reason = fmt.Sprintf("more than %d l2 gas to replay, the max recreate state depth", maxL2Gas)
+			break
+		}
+		if currentHeader.Number.Uint64() <= genesis {
+			return nil, fmt.Errorf("moved beyond genesis looking for state %d, genesis %d", targetHeader.Number.Uint64(), genesis)
+		}
+		lastHeader := currentHeader
+		currentHeader = bc.GetHeader(currentHeader.ParentHash, currentHeader.Number.Uint64()-1)
+		if currentHeader == nil {
+			return nil, fmt.Errorf("chain doesn't contain parent of block %d hash %v", lastHeader.Number, lastHeader.Hash())
+		}
+	}
+	if bc.HasState(currentHeader.Root) {
+		base := hexutil.Uint64(currentHeader.Number.Uint64())
+		estimate.BaseBlock = &base
+	}
+	estimate.L2Gas = hexutil.Uint64(l2Gas)
+	if gasPerSecond > 0 {
+		estimate.ExpectedDuration = float64(l2Gas) / float64(gasPerSecond)
+	}
+	estimate.Allowed = true
+	return estimate, nil
+}
+
+// receiptsL2Gas returns the l2 gas used by the receipts, ignoring the receipts reporting more l1 gas than gas used
+func receiptsL2Gas(receipts types.Receipts) uint64 {
+	var l2Gas uint64
+	for _, receipt := range receipts {
+		if receipt.GasUsed > receipt.GasUsedForL1 {
+			l2Gas += receipt.GasUsed - receipt.GasUsedForL1
+		}
+	}
+	return l2Gas
+}
+
+// applyLimits marks the estimate as not allowed if it exceeds the limits or replays more than reexec blocks (0=unlimited)
+func (c *RecreationLimitsConfig) applyLimits(estimate *StateRecreationEstimate, reexec uint64) {
+	switch {
+	case estimate.BaseBlock == nil && estimate.Reason != "":
+	case estimate.BaseBlock == nil:
+		estimate.Reason = fmt.Sprintf("no state available within %d blocks", estimate.Blocks)
+	case c.MaxBlocks > 0 && uint64(estimate.Blocks) > c.MaxBlocks:
+		estimate.Reason = fmt.Sprintf("%d blocks to replay, limit is %d", estimate.Blocks, c.MaxBlocks)
+	case reexec > 0 && uint64(estimate.Blocks) > reexec:
+		estimate.Reason = fmt.Sprintf("%d blocks to replay, reexec is %d", estimate.Blocks, reexec)
+	case c.MaxDuration > 0 && estimate.duration() > c.MaxDuration:
+		estimate.Reason = fmt.Sprintf("expected to take %v, limit is %v", estimate.duration().Round(time.Second), c.MaxDuration)
+	default:
+		return
+	}
+	estimate.Allowed = false
+}
+
+// FindNearestAffordableState looks for the highest block at or below targetHeader whose state is recreated replaying
+// at most maxBlocks blocks (0=unlimited) expected to take at most maxDuration (0=unlimited) at gasPerSecond, from the
+// closest state available below it. The closest state is searched for up to searchBlocks back, false is returned
+// if none is found
+func FindNearestAffordableState(ctx context.Context, bc *core.BlockChain, targetHeader *types.Header, maxBlocks uint64, maxDuration time.Duration, gasPerSecond uint64, searchBlocks uint64) (uint64, bool, error) {
+	genesis := bc.Config().ArbitrumChainParams.GenesisBlockNum
+	// blocks without state, from the target down
+	var path []common.Hash
+	header := targetHeader
+	for !bc.HasState(header.Root) {
+		if err := ctx.Err(); err != nil {
+			return 0, false, err
+		}
+		if uint64(len(path)) >= searchBlocks || header.Number.Uint64() <= genesis {
+			return 0, false, nil
+		}
+		path = append(path, header.Hash())
+		header = bc.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+		if header == nil {
+			return 0, false, nil
+		}
+	}
+	// replay forward from the state for as long as the limits allow
+	var blocks, l2Gas uint64
+	for ; blocks < uint64(len(path)); blocks++ {
+		if maxBlocks > 0 && blocks >= maxBlocks {
+			break
+		}
+		receipts := bc.GetReceiptsByHash(path[uint64(len(path))-1-blocks])
+		if receipts == nil {
+			break
+		}
+		l2Gas += receiptsL2Gas(receipts)
+		if maxDuration > 0 && gasPerSecond > 0 && time.Duration(float64(l2Gas)/float64(gasPerSecond)*float64(time.Second)) > maxDuration {
+			break
+		}
+	}
+	return header.Number.Uint64() + blocks, true, nil
+}
+
+// recreationThroughput keeps a moving average of the l2 gas replayed per second during state recreation
+type recreationThroughput struct {
+	mutex        sync.Mutex
+	gasPerSecond float64
+}
+
+func (t *recreationThroughput) update(l2Gas uint64, elapsed time.Duration) {
+	if l2Gas == 0 || elapsed <= 0 {
+		return
+	}
+	rate := float64(l2Gas) / elapsed.Seconds()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.gasPerSecond == 0 {
+		t.gasPerSecond = rate
+	} else {
+		t.gasPerSecond = 0.8*t.gasPerSecond + 0.2*rate
+	}
+}
+
+func (t *recreationThroughput) rate(fallback uint64) uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.gasPerSecond == 0 {
+		return fallback
+	}
+	return uint64(t.gasPerSecond)
+}
+
+// estimateRecreation estimates the cost of recreating the state for the header, checking it against the configured
+// limits and reexec (0=unlimited)
+func (a *APIBackend) estimateRecreation(ctx context.Context, header *types.Header, reexec uint64) (*StateRecreationEstimate, error) {
+	limits := &a.b.config.RecreationLimits
+	maxBlocks := reexec
+	if limits.MaxBlocks > 0 && (maxBlocks == 0 || limits.MaxBlocks+1 < maxBlocks) {
+		// no need to look further than one block beyond the limit
+		maxBlocks = limits.MaxBlocks + 1
+	}
+	// states looked up without reexec are recreated within the max recreate state depth, and the walk is bounded
+	// by the search limit if nothing else bounds it
+	maxL2Gas := int64(InfiniteMaxRecreateStateDepth)
+	if reexec == 0 {
+		maxL2Gas = a.b.config.MaxRecreateStateDepth
+	}
+	if maxBlocks == 0 && maxL2Gas == InfiniteMaxRecreateStateDepth {
+		maxBlocks = limits.NearestSearchBlocks
+	}
+	estimate, err := EstimateStateRecreation(ctx, a.BlockChain(), header, maxBlocks, maxL2Gas, a.b.recreationThroughput.rate(limits.FallbackGasPerSecond))
+	if err != nil {
+		return nil, err
+	}
+	limits.applyLimits(estimate, reexec)
+	return estimate, nil
+}
+
+// checkRecreationCost returns a StateRecreationTooExpensiveError if recreating the state for the header exceeds the
+// recreation limits or replays more than reexec blocks (0=unlimited)
+func (a *APIBackend) checkRecreationCost(ctx context.Context, header *types.Header, reexec uint64) (*StateRecreationEstimate, error) {
+	limits := &a.b.config.RecreationLimits
+	if !limits.enabled() && (reexec == 0 || a.BlockChain().HasState(header.Root)) {
+		return nil, nil
+	}
+	estimate, err := a.estimateRecreation(ctx, header, reexec)
+	if err != nil {
+		return nil, err
+	}
+	if !estimate.Allowed {
+		nearest := func(ctx context.Context) (uint64, bool, error) {
+			maxBlocks := reexec
+			if limits.MaxBlocks > 0 && (maxBlocks == 0 || limits.MaxBlocks < maxBlocks) {
+				maxBlocks = limits.MaxBlocks
+			}
+			gasPerSecond := a.b.recreationThroughput.rate(limits.FallbackGasPerSecond)
+			return FindNearestAffordableState(ctx, a.BlockChain(), header, maxBlocks, limits.MaxDuration, gasPerSecond, limits.NearestSearchBlocks)
+		}
+		return estimate, &StateRecreationTooExpensiveError{Estimate: estimate, nearest: nearest}
+	}
+	return estimate, nil
+}
+
+// DryRunStateAt estimates the cost of recreating the state of a block without recreating it
+func (api *ArbDebugAPI) DryRunStateAt(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash) (*StateRecreationEstimate, error) {
+	header, err := api.b.HeaderByNumberOrHash(ctx, blockNrOrHash)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, fmt.Errorf("header not found")
+	}
+	return api.b.estimateRecreation(ctx, header, 0)
+}
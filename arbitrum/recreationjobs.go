@@ -0,0 +1,149 @@
+package arbitrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+var errRecreationCancelled = errors.New("state recreation cancelled by the operator")
+
+type RecreationJob struct {
+	ID          hexutil.Uint64  `json:"id"`
+	Method      string          `json:"method,omitempty"` // RPC method that requested the state, if any
+	TargetBlock hexutil.Uint64  `json:"targetBlock"`
+	StartBlock  hexutil.Uint64  `json:"startBlock"`             // block whose state the replay started from
+	Block       *hexutil.Uint64 `json:"currentBlock,omitempty"` // last block replayed, if tracked
+	L2GasUsed   *hexutil.Uint64 `json:"l2GasUsed,omitempty"`    // l2 gas replayed so far, if tracked
+	Started     time.Time       `json:"started"`
+	Elapsed     string          `json:"elapsed"`
+	Cancelled   bool            `json:"cancelled,omitempty"`
+}
+
+// recreationJob is a state recreation in progress, whose progress is tracked if it replays block by block
+type recreationJob struct {
+	id      uint64
+	method  string
+	target  uint64
+	start   uint64
+	started time.Time
+	tracked bool
+
+	block     atomic.Uint64
+	l2GasUsed atomic.Uint64
+	cancelled atomic.Bool
+	cancel    context.CancelFunc
+}
+
+// replayed records the replay of a block by the job
+func (j *recreationJob) replayed(number uint64, l2GasUsed uint64) {
+	j.block.Store(number)
+	j.l2GasUsed.Add(l2GasUsed)
+}
+
+// err replaces the context error of a job cancelled by the operator
+func (j *recreationJob) err(err error) error {
+	if err != nil && j.cancelled.Load() {
+		return errRecreationCancelled
+	}
+	return err
+}
+
+func (j *recreationJob) report(now time.Time) *RecreationJob {
+	job := &RecreationJob{
+		ID:          hexutil.Uint64(j.id),
+		Method:      j.method,
+		TargetBlock: hexutil.Uint64(j.target),
+		StartBlock:  hexutil.Uint64(j.start),
+		Started:     j.started,
+		Elapsed:     now.Sub(j.started).Round(time.Millisecond).String(),
+		Cancelled:   j.cancelled.Load(),
+	}
+	if j.tracked {
+		block, l2GasUsed := hexutil.Uint64(j.block.Load()), hexutil.Uint64(j.l2GasUsed.Load())
+		job.Block, job.L2GasUsed = &block, &l2GasUsed
+	}
+	return job
+}
+
+// recreationJobs registers the state recreations in progress, for operators to follow and cancel them
+type recreationJobs struct {
+	lock sync.Mutex
+	next uint64
+	jobs map[uint64]*recreationJob
+}
+
+func newRecreationJobs() *recreationJobs {
+	return &recreationJobs{jobs: make(map[uint64]*recreationJob)}
+}
+
+// start registers a recreation replaying the blocks after start up to target, returning the context to run it with
+// and a function unregistering it. tracked tells whether the progress is reported through replayed
+func (r *recreationJobs) start(ctx context.Context, start, target uint64, tracked bool) (context.Context, *recreationJob, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.next++
+	job := &recreationJob{
+		id:      r.next,
+		method:  rpc.MethodFromContext(ctx),
+		target:  target,
+		start:   start,
+		started: time.Now(),
+		tracked: tracked,
+		cancel:  cancel,
+	}
+	job.block.Store(start)
+	r.jobs[job.id] = job
+	return ctx, job, func() {
+		cancel()
+		r.lock.Lock()
+		delete(r.jobs, job.id)
+		r.lock.Unlock()
+	}
+}
+
+func (r *recreationJobs) list() []*RecreationJob {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	jobs := make([]*RecreationJob, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		jobs = append(jobs, job.report(now))
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+func (r *recreationJobs) cancel(id uint64) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return fmt.Errorf("no state recreation %d in progress", id)
+	}
+	job.cancelled.Store(true)
+	job.cancel()
+	return nil
+}
+
+// RecreateStateStatus lists the state recreations in progress, with the block they target, their progress when
+// known, how long they have been running and the RPC method they serve
+func (api *ArbAPI) RecreateStateStatus() []*RecreationJob {
+	return api.b.b.recreationJobs.list()
+}
+
+// CancelStateRecreation aborts a state recreation in progress, the request it serves failing
+func (api *ArbDebugAPI) CancelStateRecreation(id hexutil.Uint64) error {
+	return api.b.b.recreationJobs.cancel(uint64(id))
+}
@@ -0,0 +1,132 @@
+package arbitrum
+
+import (
+	"context"
+	"sync"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/log"
+)
+
+// recreationPrefetcher warms the trie nodes and contract code a block replay is expected to read,
+// so that the serial replay mostly hits the caches of the state database.
+// The accounts and slots to warm are taken from the block's transactions and access lists,
+// and from the logs and created contracts in the block's stored receipts.
+type recreationPrefetcher struct {
+	bc      *core.BlockChain
+	db      state.Database
+	root    common.Hash // root of a state available in db, that the replayed states derive from
+	workers int
+}
+
+func newRecreationPrefetcher(bc *core.BlockChain, db state.Database, root common.Hash, workers int) *recreationPrefetcher {
+	return &recreationPrefetcher{
+		bc:      bc,
+		db:      db,
+		root:    root,
+		workers: workers,
+	}
+}
+
+// targets returns the accounts, and their storage slots, that replaying the block is expected to touch
+func (p *recreationPrefetcher) targets(block *types.Block) map[common.Address]map[common.Hash]struct{} {
+	targets := make(map[common.Address]map[common.Hash]struct{})
+	touch := func(addr common.Address) map[common.Hash]struct{} {
+		slots, ok := targets[addr]
+		if !ok {
+			slots = make(map[common.Hash]struct{})
+			targets[addr] = slots
+		}
+		return slots
+	}
+	touch(block.Coinbase())
+	touch(types.ArbosAddress)
+	signer := types.MakeSigner(p.bc.Config(), block.Number(), block.Time())
+	for _, tx := range block.Transactions() {
+		// recovering the sender also caches it in the transaction for the replay
+		if from, err := types.Sender(signer, tx); err == nil {
+			touch(from)
+		}
+		if to := tx.To(); to != nil {
+			touch(*to)
+		}
+		for _, tuple := range tx.AccessList() {
+			slots := touch(tuple.Address)
+			for _, key := range tuple.StorageKeys {
+				slots[key] = struct{}{}
+			}
+		}
+	}
+	for _, receipt := range p.bc.GetReceiptsByHash(block.Hash()) {
+		if receipt.ContractAddress != (common.Address{}) {
+			touch(receipt.ContractAddress)
+		}
+		for _, entry := range receipt.Logs {
+			touch(entry.Address)
+		}
+	}
+	return targets
+}
+
+// prefetch starts warming the caches for the block in the background, the returned function stops it
+func (p *recreationPrefetcher) prefetch(ctx context.Context, block *types.Block) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	targets := p.targets(block)
+	addrs := make(chan common.Address, len(targets))
+	for addr := range targets {
+		addrs <- addr
+	}
+	close(addrs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers && i < len(targets); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// tries aren't safe for concurrent use, each worker opens its own
+			tr, err := p.db.OpenTrie(p.root)
+			if err != nil {
+				log.Debug("Recreation prefetcher failed to open trie", "root", p.root, "err", err)
+				return
+			}
+			for addr := range addrs {
+				if ctx.Err() != nil {
+					return
+				}
+				p.prefetchAccount(ctx, tr, addr, targets[addr])
+			}
+		}()
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+func (p *recreationPrefetcher) prefetchAccount(ctx context.Context, tr state.Trie, addr common.Address, slots map[common.Hash]struct{}) {
+	account, err := tr.GetAccount(addr)
+	if err != nil || account == nil {
+		return
+	}
+	addrHash := crypto.Keccak256Hash(addr[:])
+	if codeHash := common.BytesToHash(account.CodeHash); codeHash != types.EmptyCodeHash {
+		_, _ = p.db.ContractCode(addrHash, codeHash)
+	}
+	if len(slots) == 0 || account.Root == types.EmptyRootHash {
+		return
+	}
+	storage, err := p.db.OpenStorageTrie(p.root, addrHash, account.Root)
+	if err != nil {
+		return
+	}
+	for slot := range slots {
+		if ctx.Err() != nil {
+			return
+		}
+		_, _ = storage.GetStorage(addr, slot[:])
+	}
+}
@@ -0,0 +1,119 @@
+package arbitrum
+
+import (
+	"context"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/core/types"
+)
+
+// RecreationPhase is the stage a state recreation is in
+type RecreationPhase string
+
+const (
+	// RecreationSearching is reported for each block whose state is missing, looking back for the last available state
+	RecreationSearching RecreationPhase = "searching"
+	// RecreationReplaying is reported for each block replayed on top of the last available state
+	RecreationReplaying RecreationPhase = "replaying"
+	// RecreationDone is reported once the state of the target block is recreated
+	RecreationDone RecreationPhase = "done"
+	// RecreationFailed is reported when the recreation fails, with the error
+	RecreationFailed RecreationPhase = "failed"
+)
+
+// RecreationProgress is an event of the progress of a state recreation
+type RecreationProgress struct {
+	Phase  RecreationPhase
+	Target uint64 // number of the block whose state is recreated
+	Block  uint64 // number of the block searched through or replayed
+	// number of blocks left to replay, only known once replaying
+	BlocksRemaining uint64
+	// l2 gas of the blocks searched through while searching, of the blocks replayed since then
+	L2GasProcessed uint64
+	Elapsed        time.Duration // time since the phase started
+	Err            error         // why the recreation failed
+}
+
+type recreationProgressKey struct{}
+
+// WithRecreationProgress returns a context whose state recreations report their progress to ch, in place of or along
+// with the StateBuildingLogFunction. The search for the last available state reports the blocks it goes through and
+// its failure, the replay reports each block it replays and ends with a done or failed event. Nothing is reported
+// when the state is available. Events are dropped rather than slowing the recreation down when ch is full, the
+// receiver should keep up or size ch for the expected number of blocks
+func WithRecreationProgress(ctx context.Context, ch chan<- RecreationProgress) context.Context {
+	return context.WithValue(ctx, recreationProgressKey{}, ch)
+}
+
+// recreationProgressReporter sends the progress events of a recreation to the channel of its context, if any
+type recreationProgressReporter struct {
+	ch     chan<- RecreationProgress
+	target uint64
+	phase  RecreationPhase
+	start  time.Time
+	l2Gas  uint64
+}
+
+func newRecreationProgressReporter(ctx context.Context, target uint64) *recreationProgressReporter {
+	ch, _ := ctx.Value(recreationProgressKey{}).(chan<- RecreationProgress)
+	return &recreationProgressReporter{ch: ch, target: target, start: time.Now()}
+}
+
+// report sends an event of the phase for the block, accumulating the l2 gas processed within the phase
+func (r *recreationProgressReporter) report(phase RecreationPhase, block, remaining, l2Gas uint64, err error) {
+	if r.ch == nil {
+		return
+	}
+	if phase != r.phase && phase != RecreationDone && phase != RecreationFailed {
+		r.phase, r.start, r.l2Gas = phase, time.Now(), 0
+	}
+	r.l2Gas += l2Gas
+	select {
+	case r.ch <- RecreationProgress{
+		Phase:           phase,
+		Target:          r.target,
+		Block:           block,
+		BlocksRemaining: remaining,
+		L2GasProcessed:  r.l2Gas,
+		Elapsed:         time.Since(r.start),
+		Err:             err,
+	}:
+	default:
+	}
+}
+
+// replayOptions returns the options reporting each block replayed with them, opts itself if there's nobody to report to
+func (r *recreationProgressReporter) replayOptions(opts *AdvanceStateOptions) *AdvanceStateOptions {
+	if r.ch == nil {
+		return opts
+	}
+	var reporting AdvanceStateOptions
+	if opts != nil {
+		reporting = *opts
+	}
+	blockReplayed := reporting.BlockReplayed
+	reporting.BlockReplayed = func(block *types.Block, l2GasUsed uint64, elapsed time.Duration) {
+		if blockReplayed != nil {
+			blockReplayed(block, l2GasUsed, elapsed)
+		}
+		var remaining uint64
+		if number := block.NumberU64(); number < r.target {
+			remaining = r.target - number
+		}
+		r.report(RecreationReplaying, block.NumberU64(), remaining, l2GasUsed, nil)
+	}
+	return &reporting
+}
+
+// done reports the end of the recreation, failed if err is set
+func (r *recreationProgressReporter) done(block uint64, err error) {
+	if err != nil {
+		var remaining uint64
+		if block <= r.target {
+			remaining = r.target - block + 1
+		}
+		r.report(RecreationFailed, block, remaining, 0, err)
+		return
+	}
+	r.report(RecreationDone, block, 0, 0, nil)
+}
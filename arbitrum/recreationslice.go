@@ -0,0 +1,40 @@
+package arbitrum
+
+import (
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	flag "github.com/spf13/pflag"
+)
+
+type RecreationSnapshotSliceConfig struct {
+	Accounts []string `koanf:"accounts"`
+	MaxSlots uint64   `koanf:"max-slots"`
+}
+
+var DefaultRecreationSnapshotSliceConfig = RecreationSnapshotSliceConfig{
+	Accounts: []string{},
+	MaxSlots: 65536,
+}
+
+func RecreationSnapshotSliceConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.StringSlice(prefix+".accounts", DefaultRecreationSnapshotSliceConfig.Accounts, "accounts whose state and storage are loaded into a flat snapshot before replaying blocks to recreate state, speeding up their repeated reads")
+	f.Uint64(prefix+".max-slots", DefaultRecreationSnapshotSliceConfig.MaxSlots, "max number of storage slots of an account whose storage is loaded into the recreation snapshot (0=no limit)")
+}
+
+func (c *RecreationSnapshotSliceConfig) Validate() error {
+	for _, account := range c.Accounts {
+		if !common.IsHexAddress(account) {
+			return fmt.Errorf("invalid recreation snapshot slice account %q", account)
+		}
+	}
+	return nil
+}
+
+func (c *RecreationSnapshotSliceConfig) accounts() []common.Address {
+	accounts := make([]common.Address, 0, len(c.Accounts))
+	for _, account := range c.Accounts {
+		accounts = append(accounts, common.HexToAddress(account))
+	}
+	return accounts
+}
@@ -0,0 +1,204 @@
+package arbitrum
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/rpc"
+	"github.com/chainupcloud/arb-geth/trie"
+	flag "github.com/spf13/pflag"
+)
+
+// maxReplayMismatches bounds the mismatches reported by a single replay diff
+const maxReplayMismatches = 1000
+
+type ReplayDiffConfig struct {
+	MaxBlocks uint64 `koanf:"max-blocks"`
+}
+
+var DefaultReplayDiffConfig = ReplayDiffConfig{
+	MaxBlocks: 10_000,
+}
+
+func ReplayDiffConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Uint64(prefix+".max-blocks", DefaultReplayDiffConfig.MaxBlocks, "number of blocks a single arbdebug_replayDiff call may replay (0=unlimited)")
+}
+
+type ReplayMismatch struct {
+	Number   hexutil.Uint64  `json:"number"`
+	Hash     common.Hash     `json:"hash"`
+	Kind     string          `json:"kind"` // stateRoot, receiptRoot, gasUsed, bloom, receiptCount, receipt or log
+	TxIndex  *hexutil.Uint64 `json:"txIndex,omitempty"`
+	Field    string          `json:"field,omitempty"`
+	Stored   string          `json:"stored"`
+	Replayed string          `json:"replayed"`
+}
+
+type ReplayDiffResult struct {
+	From       hexutil.Uint64    `json:"from"`
+	To         hexutil.Uint64    `json:"to"` // last block replayed
+	Mismatches []*ReplayMismatch `json:"mismatches"`
+	Truncated  bool              `json:"truncated,omitempty"` // more mismatches than reported
+	Stopped    string            `json:"stopped,omitempty"`   // why the replay stopped before the end of the range
+}
+
+func (r *ReplayDiffResult) report(block *types.Block, kind string, txIndex *uint64, field string, stored, replayed interface{}) {
+	if len(r.Mismatches) >= maxReplayMismatches {
+		r.Truncated = true
+		return
+	}
+	mismatch := &ReplayMismatch{
+		Number:   hexutil.Uint64(block.NumberU64()),
+		Hash:     block.Hash(),
+		Kind:     kind,
+		Field:    field,
+		Stored:   fmt.Sprint(stored),
+		Replayed: fmt.Sprint(replayed),
+	}
+	if txIndex != nil {
+		mismatch.TxIndex = (*hexutil.Uint64)(txIndex)
+	}
+	r.Mismatches = append(r.Mismatches, mismatch)
+}
+
+// ReplayDiff replays the blocks of the range on top of the state of the block before it, the way states are
+// recreated, and checks the resulting receipts, logs and state roots against the stored ones, reporting every
+// mismatch. The replay stops at the first state root mismatch, the following blocks running on a diverged state.
+// maxRecreateGas (-1=infinite) overrides the node default budget to recreate the starting state, if set
+func (api *ArbDebugAPI) ReplayDiff(ctx context.Context, from, to rpc.BlockNumber, maxRecreateGas *int64) (*ReplayDiffResult, error) {
+	bc := api.b.BlockChain()
+	head := bc.CurrentBlock().Number.Uint64()
+	resolve := func(number rpc.BlockNumber) uint64 {
+		if number < 0 {
+			return head
+		}
+		return uint64(number)
+	}
+	first, last := resolve(from), resolve(to)
+	if genesis := bc.Config().ArbitrumChainParams.GenesisBlockNum; first <= genesis {
+		return nil, fmt.Errorf("can't replay block %d, the first block after genesis is %d", first, genesis+1)
+	}
+	if last < first || last > head {
+		return nil, fmt.Errorf("invalid range %d-%d, the head is %d", first, last, head)
+	}
+	if limit := api.b.b.config.ReplayDiff.MaxBlocks; limit > 0 && last-first+1 > limit {
+		return nil, fmt.Errorf("range of %d blocks exceeds the limit of %d", last-first+1, limit)
+	}
+	if maxRecreateGas != nil {
+		if *maxRecreateGas < InfiniteMaxRecreateStateDepth {
+			return nil, fmt.Errorf("invalid maxRecreateGas %d, must be -1 (infinite) or non-negative", *maxRecreateGas)
+		}
+		ctx = WithMaxRecreateStateDepth(ctx, *maxRecreateGas)
+	}
+	statedb, parent, err := api.b.StateAndHeaderByNumber(ctx, rpc.BlockNumber(first-1))
+	if err != nil {
+		return nil, err
+	}
+	if statedb.Flat() {
+		return nil, errRolledBackState
+	}
+	target := bc.GetHeaderByNumber(last)
+	if target == nil {
+		return nil, fmt.Errorf("block %d not found", last)
+	}
+	var replayed types.Receipts
+	opts := &AdvanceStateOptions{
+		ReceiptsReplayed: func(_ *types.Block, receipts types.Receipts) { replayed = receipts },
+	}
+	res := &ReplayDiffResult{From: hexutil.Uint64(first), Mismatches: []*ReplayMismatch{}}
+	prevHash := parent.Hash()
+	for number := first; number <= last; number++ {
+		if err := ctx.Err(); err != nil {
+			res.Stopped = err.Error()
+			break
+		}
+		var block *types.Block
+		statedb, block, err = AdvanceStateByBlock(ctx, bc, statedb, target, number, prevHash, nil, opts)
+		if err != nil {
+			res.Stopped = err.Error()
+			break
+		}
+		res.To = hexutil.Uint64(number)
+		prevHash = block.Hash()
+
+		stored, err := api.b.GetReceipts(ctx, block.Hash())
+		if err != nil {
+			return nil, err
+		}
+		diffReplayedReceipts(res, block, stored, replayed)
+		root := statedb.IntermediateRoot(bc.Config().IsEIP158(block.Number()))
+		if root != block.Root() {
+			res.report(block, "stateRoot", nil, "", block.Root(), root)
+			res.Stopped = fmt.Sprintf("state diverged at block %d", number)
+			break
+		}
+	}
+	return res, nil
+}
+
+// diffReplayedReceipts checks the receipts replayed for a block against its header and stored receipts
+func diffReplayedReceipts(res *ReplayDiffResult, block *types.Block, stored, replayed types.Receipts) {
+	header := block.Header()
+	if hash := types.DeriveSha(replayed, trie.NewStackTrie(nil)); hash != header.ReceiptHash {
+		res.report(block, "receiptRoot", nil, "", header.ReceiptHash, hash)
+	}
+	var gasUsed uint64
+	if len(replayed) > 0 {
+		gasUsed = replayed[len(replayed)-1].CumulativeGasUsed
+	}
+	if gasUsed != header.GasUsed {
+		res.report(block, "gasUsed", nil, "", header.GasUsed, gasUsed)
+	}
+	if bloom := types.CreateBloom(replayed); bloom != header.Bloom {
+		res.report(block, "bloom", nil, "", hexutil.Bytes(header.Bloom[:]), hexutil.Bytes(bloom[:]))
+	}
+	if len(stored) != len(replayed) {
+		res.report(block, "receiptCount", nil, "", len(stored), len(replayed))
+		return
+	}
+	for i := range stored {
+		index := uint64(i)
+		want, have := stored[i], replayed[i]
+		if want.Status != have.Status {
+			res.report(block, "receipt", &index, "status", want.Status, have.Status)
+		}
+		if want.CumulativeGasUsed != have.CumulativeGasUsed {
+			res.report(block, "receipt", &index, "cumulativeGasUsed", want.CumulativeGasUsed, have.CumulativeGasUsed)
+		}
+		if want.GasUsedForL1 != have.GasUsedForL1 {
+			res.report(block, "receipt", &index, "gasUsedForL1", want.GasUsedForL1, have.GasUsedForL1)
+		}
+		if len(want.Logs) != len(have.Logs) {
+			res.report(block, "receipt", &index, "logs", len(want.Logs), len(have.Logs))
+			continue
+		}
+		for j := range want.Logs {
+			if field, stored, replayed := diffLog(want.Logs[j], have.Logs[j]); field != "" {
+				res.report(block, "log", &index, fmt.Sprintf("logs[%d].%s", j, field), stored, replayed)
+			}
+		}
+	}
+}
+
+// diffLog returns the first consensus field differing between the logs with its values, if any
+func diffLog(a, b *types.Log) (string, interface{}, interface{}) {
+	if a.Address != b.Address {
+		return "address", a.Address, b.Address
+	}
+	if len(a.Topics) != len(b.Topics) {
+		return "topics", a.Topics, b.Topics
+	}
+	for i := range a.Topics {
+		if a.Topics[i] != b.Topics[i] {
+			return "topics", a.Topics, b.Topics
+		}
+	}
+	if !bytes.Equal(a.Data, b.Data) {
+		return "data", hexutil.Bytes(a.Data), hexutil.Bytes(b.Data)
+	}
+	return "", nil, nil
+}
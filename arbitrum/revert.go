@@ -0,0 +1,260 @@
+package arbitrum
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/chainupcloud/arb-geth/accounts/abi"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/rpc"
+	flag "github.com/spf13/pflag"
+)
+
+type RevertDecodingConfig struct {
+	ErrorABIs []string `koanf:"error-abis"`
+}
+
+var DefaultRevertDecodingConfig = RevertDecodingConfig{
+	ErrorABIs: nil,
+}
+
+func RevertDecodingConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.StringSlice(prefix+".error-abis", DefaultRevertDecodingConfig.ErrorABIs, "paths of json abi files whose custom errors are decoded in the reverts reported by gas estimation and calls")
+}
+
+// the kinds of revert payloads
+const (
+	RevertKindError  = "error"  // solidity Error(string)
+	RevertKindPanic  = "panic"  // solidity Panic(uint256)
+	RevertKindCustom = "custom" // custom error, abi encoded after its selector, as solidity and the stylus sdk revert with
+	RevertKindUTF8   = "utf8"   // raw text, as stylus programs may revert with
+	RevertKindRaw    = "raw"    // anything else
+)
+
+var (
+	errorSelector = crypto.Keccak256([]byte("Error(string)"))[:4]
+	panicSelector = crypto.Keccak256([]byte("Panic(uint256)"))[:4]
+)
+
+// panicReasons describes the solidity panic codes
+var panicReasons = map[uint64]string{
+	0x00: "generic panic",
+	0x01: "assert(false)",
+	0x11: "arithmetic underflow or overflow",
+	0x12: "division or modulo by zero",
+	0x21: "enum overflow",
+	0x22: "invalid encoded storage byte array accessed",
+	0x31: "out-of-bounds array access; popping on an empty array",
+	0x32: "out-of-bounds access of an array or bytesN",
+	0x41: "out of memory",
+	0x51: "uninitialized function",
+}
+
+// RevertData is the structured revert reason returned as the data of the json-rpc error
+type RevertData struct {
+	Data      hexutil.Bytes   `json:"data"`
+	Kind      string          `json:"kind"`
+	Reason    string          `json:"reason,omitempty"`
+	PanicCode *hexutil.Uint64 `json:"panicCode,omitempty"`
+	Selector  hexutil.Bytes   `json:"selector,omitempty"`
+	Error     string          `json:"error,omitempty"` // signature of the custom error, if known
+	Args      []interface{}   `json:"args,omitempty"`
+}
+
+// RevertError is the json-rpc error of a reverted execution, with the revert reason decoded
+type RevertError struct {
+	msg  string
+	data *RevertData
+}
+
+func (e *RevertError) Error() string { return e.msg }
+
+func (e *RevertError) ErrorCode() int { return 3 }
+
+func (e *RevertError) ErrorData() interface{} { return e.data }
+
+// Revert returns the decoded revert reason
+func (e *RevertError) Revert() *RevertData { return e.data }
+
+// RevertDecoder decodes revert payloads, including the custom errors of the abis registered to it
+type RevertDecoder struct {
+	mutex  sync.RWMutex
+	errors map[[4]byte]abi.Error
+}
+
+func NewRevertDecoder() *RevertDecoder {
+	return &RevertDecoder{errors: make(map[[4]byte]abi.Error)}
+}
+
+// defaultRevertDecoder decodes the reverts reported by EstimateGas and NewRevertReason
+var defaultRevertDecoder = NewRevertDecoder()
+
+// RegisterRevertErrors registers the custom errors of the abi for decoding the reverts reported by EstimateGas
+// and NewRevertReason
+func RegisterRevertErrors(parsed *abi.ABI) {
+	defaultRevertDecoder.Register(parsed)
+}
+
+// Register adds the custom errors of the abi to those decoded
+func (d *RevertDecoder) Register(parsed *abi.ABI) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, abiErr := range parsed.Errors {
+		var selector [4]byte
+		copy(selector[:], abiErr.ID[:4])
+		d.errors[selector] = abiErr
+	}
+}
+
+// RegisterFile adds the custom errors of the json abi file to those decoded
+func (d *RevertDecoder) RegisterFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	parsed, err := abi.JSON(file)
+	if err != nil {
+		return fmt.Errorf("failed parsing abi %v: %w", path, err)
+	}
+	d.Register(&parsed)
+	return nil
+}
+
+func (d *RevertDecoder) lookup(selector []byte) (abi.Error, bool) {
+	var key [4]byte
+	copy(key[:], selector)
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	abiErr, ok := d.errors[key]
+	return abiErr, ok
+}
+
+// Decode decodes the revert payload, falling back to less specific kinds when it doesn't unpack
+func (d *RevertDecoder) Decode(revert []byte) *RevertData {
+	data := &RevertData{Data: revert, Kind: RevertKindRaw}
+	if len(revert) >= 4 {
+		selector := revert[:4]
+		switch {
+		case bytes.Equal(selector, errorSelector):
+			if reason, err := abi.UnpackRevert(revert); err == nil {
+				data.Kind, data.Reason = RevertKindError, reason
+				return data
+			}
+		case bytes.Equal(selector, panicSelector):
+			if len(revert) == 4+32 {
+				code := new(big.Int).SetBytes(revert[4:])
+				data.Kind, data.Reason = RevertKindPanic, "unknown panic code"
+				if code.IsUint64() {
+					panicCode := hexutil.Uint64(code.Uint64())
+					data.PanicCode = &panicCode
+					if reason, ok := panicReasons[code.Uint64()]; ok {
+						data.Reason = reason
+					}
+				}
+				return data
+			}
+		}
+		if abiErr, ok := d.lookup(selector); ok {
+			if args, err := abiErr.Inputs.Unpack(revert[4:]); err == nil {
+				data.Kind, data.Selector, data.Error = RevertKindCustom, selector, abiErr.Sig
+				data.Args = make([]interface{}, len(args))
+				for i, arg := range args {
+					data.Args[i] = revertArg(arg)
+				}
+				return data
+			}
+		}
+		if (len(revert)-4)%32 == 0 && !isRevertText(revert) {
+			// abi encoded arguments are made of whole words
+			data.Kind, data.Selector = RevertKindCustom, selector
+			return data
+		}
+	}
+	if isRevertText(revert) {
+		data.Kind, data.Reason = RevertKindUTF8, string(revert)
+	}
+	return data
+}
+
+// revertArg makes an unpacked abi value marshal as the json-rpc apis do
+func revertArg(arg interface{}) interface{} {
+	switch arg := arg.(type) {
+	case *big.Int:
+		return (*hexutil.Big)(arg)
+	case []byte:
+		return hexutil.Bytes(arg)
+	}
+	return arg
+}
+
+func isRevertText(revert []byte) bool {
+	if len(revert) == 0 || !utf8.Valid(revert) {
+		return false
+	}
+	for _, r := range string(revert) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Error returns the json-rpc error of the execution reverted with the payload
+func (d *RevertDecoder) Error(revert []byte) *RevertError {
+	data := d.Decode(revert)
+	msg := "execution reverted"
+	switch data.Kind {
+	case RevertKindError, RevertKindUTF8:
+		msg = fmt.Sprintf("%v: %v", msg, data.Reason)
+	case RevertKindPanic:
+		msg = fmt.Sprintf("%v: panic: %v", msg, data.Reason)
+		if data.PanicCode != nil {
+			msg = fmt.Sprintf("%v (%v)", msg, data.PanicCode)
+		}
+	case RevertKindCustom:
+		if data.Error != "" {
+			args := make([]string, len(data.Args))
+			for i, arg := range data.Args {
+				args[i] = fmt.Sprint(arg)
+			}
+			msg = fmt.Sprintf("%v: %v(%v)", msg, data.Error[:strings.IndexByte(data.Error, '(')], strings.Join(args, ", "))
+		} else if core.RenderRPCError != nil {
+			// errors of the arbos precompiles
+			if arbErr := core.RenderRPCError(revert); arbErr != nil {
+				msg = fmt.Sprintf("%v: %v", msg, arbErr)
+			}
+		}
+	}
+	return &RevertError{msg: msg, data: data}
+}
+
+// decodeRevertError replaces a revert error of the eth apis, whose data is the hex encoded payload, with one
+// carrying the decoded revert reason
+func decodeRevertError(err error) error {
+	var dataErr rpc.DataError
+	if !errors.As(err, &dataErr) {
+		return err
+	}
+	if coded, ok := dataErr.(rpc.Error); !ok || coded.ErrorCode() != 3 {
+		return err
+	}
+	hexData, ok := dataErr.ErrorData().(string)
+	if !ok {
+		return err
+	}
+	revert, decodeErr := hexutil.Decode(hexData)
+	if decodeErr != nil {
+		return err
+	}
+	return defaultRevertDecoder.Error(revert)
+}
@@ -0,0 +1,106 @@
+package arbitrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/log"
+)
+
+// ShutdownPreparer is optionally implemented by the ArbInterface to persist the transactions
+// it has queued but not yet sequenced ahead of a planned shutdown
+type ShutdownPreparer interface {
+	PrepareShutdown(ctx context.Context) error
+}
+
+// ShutdownReadiness reports what was persisted ahead of a planned shutdown
+type ShutdownReadiness struct {
+	Ready        bool           `json:"ready"`
+	BlockNumber  hexutil.Uint64 `json:"blockNumber"`
+	BlockHash    common.Hash    `json:"blockHash"`
+	StateRoot    common.Hash    `json:"stateRoot"`
+	SnapshotRoot *common.Hash   `json:"snapshotRoot,omitempty"`
+	TxQueue      string         `json:"txQueue"` // "checkpointed", "unsupported" or "failed"
+	Elapsed      float64        `json:"elapsedSeconds"`
+	Error        string         `json:"error,omitempty"`
+}
+
+type ArbDebugAPI struct {
+	b *APIBackend
+}
+
+func NewArbDebugAPI(b *APIBackend) *ArbDebugAPI {
+	return &ArbDebugAPI{b}
+}
+
+// PrepareShutdown flushes the in-memory state to disk and checkpoints the transaction queue,
+// so that a restart doesn't have to replay blocks even if the shutdown isn't clean.
+// The node keeps running afterwards, blocks imported after the call are not covered.
+func (api *ArbDebugAPI) PrepareShutdown(ctx context.Context, timeout *string) (*ShutdownReadiness, error) {
+	wait := api.b.b.config.ArbDebug.PrepareShutdownTimeout
+	if timeout != nil {
+		var err error
+		if wait, err = time.ParseDuration(*timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+	if !api.b.b.preparingShutdown.CompareAndSwap(false, true) {
+		return nil, errors.New("shutdown preparation already in progress")
+	}
+	if wait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wait)
+		defer cancel()
+	}
+	start := time.Now()
+	readiness := &ShutdownReadiness{}
+	defer func() {
+		readiness.Elapsed = time.Since(start).Seconds()
+	}()
+
+	type flushResult struct {
+		flush *core.StateFlush
+		err   error
+	}
+	// the flush can't be interrupted, on timeout it completes in the background
+	flushed := make(chan flushResult, 1)
+	go func() {
+		defer api.b.b.preparingShutdown.Store(false)
+		flush, err := api.b.BlockChain().FlushState()
+		flushed <- flushResult{flush, err}
+	}()
+	select {
+	case res := <-flushed:
+		if res.err != nil {
+			readiness.Error = res.err.Error()
+			return readiness, nil
+		}
+		readiness.BlockNumber = hexutil.Uint64(res.flush.Block.Number.Uint64())
+		readiness.BlockHash = res.flush.Block.Hash()
+		readiness.StateRoot = res.flush.Block.Root
+		if res.flush.SnapshotRoot != (common.Hash{}) {
+			readiness.SnapshotRoot = &res.flush.SnapshotRoot
+		}
+	case <-ctx.Done():
+		readiness.Error = fmt.Sprintf("state flush still in progress: %v", ctx.Err())
+		return readiness, nil
+	}
+
+	readiness.TxQueue = "unsupported"
+	if preparer, ok := api.b.b.arb.(ShutdownPreparer); ok {
+		if err := preparer.PrepareShutdown(ctx); err != nil {
+			readiness.TxQueue = "failed"
+			readiness.Error = err.Error()
+			return readiness, nil
+		}
+		readiness.TxQueue = "checkpointed"
+	}
+	readiness.Ready = true
+	log.Info("Prepared for shutdown", "block", readiness.BlockNumber, "root", readiness.StateRoot, "elapsed", time.Since(start))
+	return readiness, nil
+}
@@ -0,0 +1,189 @@
+package arbitrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/log"
+	flag "github.com/spf13/pflag"
+)
+
+type SideChainPruningConfig struct {
+	Enable            bool          `koanf:"enable"`
+	Interval          time.Duration `koanf:"interval"`
+	ConfirmationDepth uint64        `koanf:"confirmation-depth"`
+	MaxBlocks         uint64        `koanf:"max-blocks"`
+	DryRun            bool          `koanf:"dry-run"`
+}
+
+var DefaultSideChainPruningConfig = SideChainPruningConfig{
+	Enable:            false,
+	Interval:          time.Hour,
+	ConfirmationDepth: 10_000,
+	MaxBlocks:         1_000_000,
+	DryRun:            false,
+}
+
+func SideChainPruningConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultSideChainPruningConfig.Enable, "delete the non-canonical blocks, receipts and tx lookups left behind by reorgs on startup and periodically")
+	f.Duration(prefix+".interval", DefaultSideChainPruningConfig.Interval, "interval between background side chain pruning runs (0=startup only)")
+	f.Uint64(prefix+".confirmation-depth", DefaultSideChainPruningConfig.ConfirmationDepth, "number of blocks below the head under which non-canonical blocks are pruned")
+	f.Uint64(prefix+".max-blocks", DefaultSideChainPruningConfig.MaxBlocks, "max number of heights scanned by a background run, the next run carries on from there (0=no limit)")
+	f.Bool(prefix+".dry-run", DefaultSideChainPruningConfig.DryRun, "only report the non-canonical blocks that would be pruned")
+}
+
+func (c *SideChainPruningConfig) Validate() error {
+	if c.ConfirmationDepth == 0 {
+		return errors.New("side chain pruning confirmation-depth must be positive")
+	}
+	return nil
+}
+
+type SideChainPruneReport struct {
+	From      hexutil.Uint64        `json:"from"`
+	To        hexutil.Uint64        `json:"to"`
+	DryRun    bool                  `json:"dryRun"`
+	PrunedAt  time.Time             `json:"prunedAt"`
+	Blocks    []core.SideChainBlock `json:"blocks"`
+	Lookups   int                   `json:"lookups"`
+	ElapsedMs int64                 `json:"elapsedMs"`
+}
+
+type sideChainPruner struct {
+	config *SideChainPruningConfig
+	bc     *core.BlockChain
+
+	mutex  sync.Mutex
+	next   uint64 // first height the next background run scans
+	report *SideChainPruneReport
+}
+
+func newSideChainPruner(config *SideChainPruningConfig, bc *core.BlockChain) *sideChainPruner {
+	next := bc.Config().ArbitrumChainParams.GenesisBlockNum
+	if tail := bc.SideChainPruneTail(); tail != nil && *tail > next {
+		next = *tail
+	}
+	return &sideChainPruner{
+		config: config,
+		bc:     bc,
+		next:   next,
+	}
+}
+
+// confirmed returns the highest block whose side chains may be pruned, false if there's none yet
+func (p *sideChainPruner) confirmed() (uint64, bool) {
+	head := p.bc.CurrentBlock().Number.Uint64()
+	if head < p.config.ConfirmationDepth {
+		return 0, false
+	}
+	return head - p.config.ConfirmationDepth, true
+}
+
+// prune prunes the side chains in the given range, or reports them in a dry run, and records the report
+func (p *sideChainPruner) prune(ctx context.Context, from, to uint64, dryRun bool) (*SideChainPruneReport, error) {
+	if confirmed, ok := p.confirmed(); !ok || to > confirmed {
+		return nil, fmt.Errorf("block %d isn't %d blocks below the head", to, p.config.ConfirmationDepth)
+	}
+	pruned, err := p.bc.PruneSideChains(ctx, from, to, dryRun)
+	if pruned == nil {
+		return nil, err
+	}
+	report := &SideChainPruneReport{
+		From:      hexutil.Uint64(pruned.From),
+		To:        hexutil.Uint64(pruned.To),
+		DryRun:    pruned.DryRun,
+		PrunedAt:  time.Now(),
+		Blocks:    pruned.Blocks,
+		Lookups:   pruned.Lookups,
+		ElapsedMs: pruned.Elapsed.Milliseconds(),
+	}
+	if dryRun && len(report.Blocks) > 0 {
+		log.Info("Found side chains to prune", "from", from, "to", to, "blocks", len(report.Blocks), "lookups", report.Lookups)
+	}
+	p.mutex.Lock()
+	p.report = report
+	p.mutex.Unlock()
+	return report, err
+}
+
+// pruneNext carries on pruning from where the previous background run stopped, up to the confirmation depth
+func (p *sideChainPruner) pruneNext(ctx context.Context) {
+	to, ok := p.confirmed()
+	p.mutex.Lock()
+	from := p.next
+	p.mutex.Unlock()
+	if !ok || from > to {
+		return
+	}
+	if p.config.MaxBlocks > 0 && to-from >= p.config.MaxBlocks {
+		to = from + p.config.MaxBlocks - 1
+	}
+	if _, err := p.prune(ctx, from, to, p.config.DryRun); err != nil {
+		log.Error("Side chain pruning failed", "from", from, "to", to, "err", err)
+		return
+	}
+	p.mutex.Lock()
+	p.next = to + 1
+	p.mutex.Unlock()
+}
+
+func (p *sideChainPruner) lastReport() *SideChainPruneReport {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.report
+}
+
+func (p *sideChainPruner) start(chanClose chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-chanClose
+		cancel()
+	}()
+	go func() {
+		p.pruneNext(ctx)
+		if p.config.Interval == 0 {
+			return
+		}
+		ticker := time.NewTicker(p.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-chanClose:
+				return
+			case <-ticker.C:
+				p.pruneNext(ctx)
+			}
+		}
+	}()
+}
+
+// SideChains returns the report of the most recent side chain pruning run
+func (api *ArbDebugAPI) SideChains(ctx context.Context) (*SideChainPruneReport, error) {
+	pruner := api.b.b.sideChainPruner
+	if pruner == nil {
+		return nil, errors.New("side chain pruning not enabled")
+	}
+	return pruner.lastReport(), nil
+}
+
+// PruneSideChains deletes the non-canonical blocks in the inclusive range [fromBlock, toBlock], which must be the
+// confirmation depth below the head. Defaults to the configured dry-run mode, in which they're only reported
+func (api *ArbDebugAPI) PruneSideChains(ctx context.Context, fromBlock, toBlock hexutil.Uint64, dryRun *bool) (*SideChainPruneReport, error) {
+	pruner := api.b.b.sideChainPruner
+	if pruner == nil {
+		return nil, errors.New("side chain pruning not enabled")
+	}
+	if fromBlock > toBlock {
+		return nil, fmt.Errorf("invalid block range: from %d is after to %d", fromBlock, toBlock)
+	}
+	dry := pruner.config.DryRun
+	if dryRun != nil {
+		dry = *dryRun
+	}
+	return pruner.prune(ctx, uint64(fromBlock), uint64(toBlock), dry)
+}
@@ -0,0 +1,274 @@
+package arbitrum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/metrics"
+	"github.com/chainupcloud/arb-geth/rpc"
+	flag "github.com/spf13/pflag"
+)
+
+var slowQueryMeter = metrics.NewRegisteredMeter("arb/rpc/slowqueries", nil)
+
+type SlowQueryConfig struct {
+	Enable         bool   `koanf:"enable"`
+	ColdReads      uint64 `koanf:"cold-reads"`
+	Recreation     bool   `koanf:"recreation"`
+	MaxEntries     int    `koanf:"max-entries"`
+	MaxParamsBytes int    `koanf:"max-params-bytes"`
+}
+
+var DefaultSlowQueryConfig = SlowQueryConfig{
+	Enable:         false,
+	ColdReads:      10_000,
+	Recreation:     true,
+	MaxEntries:     1024,
+	MaxParamsBytes: 512,
+}
+
+func SlowQueryConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultSlowQueryConfig.Enable, "record the rpc calls that read a lot of state from the tries or recreated state, for arbdebug_slowQueries")
+	f.Uint64(prefix+".cold-reads", DefaultSlowQueryConfig.ColdReads, "number of accounts and storage slots read from the tries at or above which a call is recorded (0=ignore)")
+	f.Bool(prefix+".recreation", DefaultSlowQueryConfig.Recreation, "record the calls that recreated state")
+	f.Int(prefix+".max-entries", DefaultSlowQueryConfig.MaxEntries, "number of most recent slow calls kept")
+	f.Int(prefix+".max-params-bytes", DefaultSlowQueryConfig.MaxParamsBytes, "number of bytes of the params of a slow call kept (0=none)")
+}
+
+func (c *SlowQueryConfig) Validate() error {
+	if c.MaxEntries <= 0 {
+		return errors.New("slow query log max-entries must be positive")
+	}
+	if c.MaxParamsBytes < 0 {
+		return errors.New("slow query log max-params-bytes can't be negative")
+	}
+	return nil
+}
+
+// SlowQuery is an rpc call recorded for the state it read from the tries or recreated
+type SlowQuery struct {
+	Time             time.Time      `json:"time"`
+	Method           string         `json:"method"`
+	Fingerprint      string         `json:"fingerprint"` // hash of the method and params, telling identical calls apart
+	Params           string         `json:"params,omitempty"`
+	Client           string         `json:"client"`
+	Elapsed          string         `json:"elapsed"`
+	ColdAccountReads hexutil.Uint64 `json:"coldAccountReads"`
+	ColdStorageReads hexutil.Uint64 `json:"coldStorageReads"`
+	RecreatedBlocks  hexutil.Uint64 `json:"recreatedBlocks"`
+	RecreationL2Gas  hexutil.Uint64 `json:"recreationL2Gas"`
+	Error            string         `json:"error,omitempty"`
+}
+
+// SlowQueryClient sums up the slow calls of a client
+type SlowQueryClient struct {
+	Client          string         `json:"client"`
+	Calls           hexutil.Uint64 `json:"calls"`
+	ColdReads       hexutil.Uint64 `json:"coldReads"`
+	RecreatedBlocks hexutil.Uint64 `json:"recreatedBlocks"`
+	RecreationL2Gas hexutil.Uint64 `json:"recreationL2Gas"`
+}
+
+// callCost accumulates the cost of an rpc call while it's served
+type callCost struct {
+	reads           state.ReadMeter
+	recreatedBlocks atomic.Uint64
+	recreationL2Gas atomic.Uint64
+}
+
+type callCostKey struct{}
+
+func callCostFromContext(ctx context.Context) *callCost {
+	cost, _ := ctx.Value(callCostKey{}).(*callCost)
+	return cost
+}
+
+// meterStateReads attaches the read meter of the call served with ctx to the state, if the calls are metered
+func meterStateReads(ctx context.Context, statedb *state.StateDB) {
+	if cost := callCostFromContext(ctx); cost != nil && statedb != nil {
+		statedb.SetReadMeter(&cost.reads)
+	}
+}
+
+// recordRecreation charges the blocks replayed to recreate state to the call served with ctx, if the calls are metered
+func recordRecreation(ctx context.Context, blocks uint64, l2Gas uint64) {
+	if cost := callCostFromContext(ctx); cost != nil {
+		cost.recreatedBlocks.Add(blocks)
+		cost.recreationL2Gas.Add(l2Gas)
+	}
+}
+
+// slowQueryLog observes the rpc calls, keeping a ring of the most recent ones above the thresholds
+type slowQueryLog struct {
+	config *SlowQueryConfig
+
+	lock    sync.Mutex
+	entries []*SlowQuery
+	next    int
+}
+
+func newSlowQueryLog(config *SlowQueryConfig) *slowQueryLog {
+	return &slowQueryLog{
+		config:  config,
+		entries: make([]*SlowQuery, 0, config.MaxEntries),
+	}
+}
+
+// observe is the rpc.CallObserver metering the calls
+func (l *slowQueryLog) observe(ctx context.Context, method string, params json.RawMessage) (context.Context, func(error)) {
+	cost := new(callCost)
+	start := time.Now()
+	return context.WithValue(ctx, callCostKey{}, cost), func(err error) {
+		l.done(ctx, method, params, cost, start, err)
+	}
+}
+
+func (l *slowQueryLog) done(ctx context.Context, method string, params json.RawMessage, cost *callCost, start time.Time, err error) {
+	accounts, storage := cost.reads.Accounts(), cost.reads.Storage()
+	blocks := cost.recreatedBlocks.Load()
+	slow := (l.config.ColdReads > 0 && accounts+storage >= l.config.ColdReads) || (l.config.Recreation && blocks > 0)
+	if !slow {
+		return
+	}
+	query := &SlowQuery{
+		Time:             start,
+		Method:           method,
+		Fingerprint:      crypto.Keccak256Hash([]byte(method), params).Hex()[:18],
+		Client:           slowQueryClient(rpc.PeerInfoFromContext(ctx)),
+		Elapsed:          time.Since(start).Round(time.Millisecond).String(),
+		ColdAccountReads: hexutil.Uint64(accounts),
+		ColdStorageReads: hexutil.Uint64(storage),
+		RecreatedBlocks:  hexutil.Uint64(blocks),
+		RecreationL2Gas:  hexutil.Uint64(cost.recreationL2Gas.Load()),
+	}
+	if len(params) > l.config.MaxParamsBytes {
+		params = params[:l.config.MaxParamsBytes]
+	}
+	query.Params = string(params)
+	if err != nil {
+		query.Error = err.Error()
+	}
+	slowQueryMeter.Mark(1)
+	log.Debug("Slow rpc call", "method", method, "fingerprint", query.Fingerprint, "client", query.Client, "coldReads", accounts+storage, "recreatedBlocks", blocks, "elapsed", query.Elapsed)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.entries) < l.config.MaxEntries {
+		l.entries = append(l.entries, query)
+		return
+	}
+	l.entries[l.next] = query
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+// list returns the recorded calls from the most recent one, at most count of them (0=all)
+func (l *slowQueryLog) list(count int) []*SlowQuery {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if count <= 0 || count > len(l.entries) {
+		count = len(l.entries)
+	}
+	queries := make([]*SlowQuery, 0, count)
+	for i := 0; i < count; i++ {
+		queries = append(queries, l.entries[(l.next+len(l.entries)-1-i)%len(l.entries)])
+	}
+	return queries
+}
+
+// clients sums up the recorded calls by client, the most expensive first
+func (l *slowQueryLog) clients() []*SlowQueryClient {
+	byClient := make(map[string]*SlowQueryClient)
+	for _, query := range l.list(0) {
+		client := byClient[query.Client]
+		if client == nil {
+			client = &SlowQueryClient{Client: query.Client}
+			byClient[query.Client] = client
+		}
+		client.Calls++
+		client.ColdReads += query.ColdAccountReads + query.ColdStorageReads
+		client.RecreatedBlocks += query.RecreatedBlocks
+		client.RecreationL2Gas += query.RecreationL2Gas
+	}
+	clients := make([]*SlowQueryClient, 0, len(byClient))
+	for _, client := range byClient {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].RecreationL2Gas != clients[j].RecreationL2Gas {
+			return clients[i].RecreationL2Gas > clients[j].RecreationL2Gas
+		}
+		if clients[i].ColdReads != clients[j].ColdReads {
+			return clients[i].ColdReads > clients[j].ColdReads
+		}
+		return clients[i].Client < clients[j].Client
+	})
+	return clients
+}
+
+func (l *slowQueryLog) clear() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = l.entries[:0]
+	l.next = 0
+}
+
+// slowQueryClient identifies the client of a call by its API key, else by the address it's forwarded for, else by its
+// remote address
+func slowQueryClient(info rpc.PeerInfo) string {
+	switch {
+	case info.HTTP.APIKey != "":
+		return "key:" + info.HTTP.APIKey
+	case info.HTTP.ForwardedFor != "":
+		return "forwarded:" + info.HTTP.ForwardedFor
+	case info.RemoteAddr != "":
+		return info.RemoteAddr
+	default:
+		return info.Transport
+	}
+}
+
+var errSlowQueriesDisabled = errors.New("slow query log not enabled")
+
+// SlowQueries lists the most recent rpc calls that read at least the configured number of accounts and storage slots
+// from the tries or recreated state, from the most recent one, at most count of them if given
+func (api *ArbDebugAPI) SlowQueries(count *hexutil.Uint64) ([]*SlowQuery, error) {
+	slowQueries := api.b.b.slowQueries
+	if slowQueries == nil {
+		return nil, errSlowQueriesDisabled
+	}
+	var limit int
+	if count != nil {
+		limit = int(*count)
+	}
+	return slowQueries.list(limit), nil
+}
+
+// SlowQueryClients sums up the recorded slow calls by client, the clients causing the most recreation and trie reads
+// first
+func (api *ArbDebugAPI) SlowQueryClients() ([]*SlowQueryClient, error) {
+	slowQueries := api.b.b.slowQueries
+	if slowQueries == nil {
+		return nil, errSlowQueriesDisabled
+	}
+	return slowQueries.clients(), nil
+}
+
+// ClearSlowQueries forgets the recorded slow calls
+func (api *ArbDebugAPI) ClearSlowQueries() error {
+	slowQueries := api.b.b.slowQueries
+	if slowQueries == nil {
+		return errSlowQueriesDisabled
+	}
+	slowQueries.clear()
+	return nil
+}
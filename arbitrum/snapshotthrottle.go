@@ -0,0 +1,92 @@
+package arbitrum
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/metrics"
+	"github.com/chainupcloud/arb-geth/rpc"
+	flag "github.com/spf13/pflag"
+)
+
+var snapshotThrottleRateGauge = metrics.NewRegisteredGauge("arb/snapshot/generation/rate", nil)
+
+type SnapshotThrottleConfig struct {
+	Enable        bool          `koanf:"enable"`
+	MinRate       uint64        `koanf:"min-rate"`
+	MaxRate       uint64        `koanf:"max-rate"`
+	MaxInFlight   int64         `koanf:"max-in-flight"`
+	TargetLatency time.Duration `koanf:"target-latency"`
+}
+
+var DefaultSnapshotThrottleConfig = SnapshotThrottleConfig{
+	Enable:        false,
+	MinRate:       1024 * 1024,
+	MaxRate:       64 * 1024 * 1024,
+	MaxInFlight:   64,
+	TargetLatency: 500 * time.Millisecond,
+}
+
+func SnapshotThrottleConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultSnapshotThrottleConfig.Enable, "slow down the background snapshot generation while the rpc servers are under load")
+	f.Uint64(prefix+".min-rate", DefaultSnapshotThrottleConfig.MinRate, "rate in bytes per second of generated snapshot data the generation is slowed down to at most")
+	f.Uint64(prefix+".max-rate", DefaultSnapshotThrottleConfig.MaxRate, "rate in bytes per second of generated snapshot data the generation is sped up to at most while the rpc servers aren't under load")
+	f.Int64(prefix+".max-in-flight", DefaultSnapshotThrottleConfig.MaxInFlight, "number of rpc calls being served above which the rpc servers are considered under load (0=ignore)")
+	f.Duration(prefix+".target-latency", DefaultSnapshotThrottleConfig.TargetLatency, "99th percentile of the recent rpc calls serving time above which the rpc servers are considered under load (0=ignore)")
+}
+
+func (c *SnapshotThrottleConfig) Validate() error {
+	if c.MinRate == 0 || c.MaxRate < c.MinRate {
+		return errors.New("snapshot throttle rates must satisfy 0 < min-rate <= max-rate")
+	}
+	return nil
+}
+
+// snapshotThrottle paces the snapshot generation, halving its rate whenever the rpc servers are
+// under load, and growing it back progressively when they aren't
+type snapshotThrottle struct {
+	config *SnapshotThrottleConfig
+	load   func() rpc.LoadStats
+
+	mutex      sync.Mutex
+	rate       float64 // bytes per second
+	overloaded bool
+}
+
+func newSnapshotThrottle(config *SnapshotThrottleConfig, load func() rpc.LoadStats) *snapshotThrottle {
+	return &snapshotThrottle{
+		config: config,
+		load:   load,
+		rate:   float64(config.MaxRate),
+	}
+}
+
+// Delay implements snapshot.GenerationThrottle
+func (t *snapshotThrottle) Delay(size int) time.Duration {
+	load := t.load()
+	overloaded := (t.config.MaxInFlight > 0 && load.InFlight > t.config.MaxInFlight) ||
+		(t.config.TargetLatency > 0 && load.LatencyP99 > t.config.TargetLatency)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if overloaded {
+		t.rate /= 2
+		if min := float64(t.config.MinRate); t.rate < min {
+			t.rate = min
+		}
+	} else {
+		t.rate *= 1.25
+		if max := float64(t.config.MaxRate); t.rate > max {
+			t.rate = max
+		}
+	}
+	if overloaded != t.overloaded {
+		t.overloaded = overloaded
+		log.Info("Snapshot generation throttle updated", "rpcLoaded", overloaded, "inFlight", load.InFlight, "latencyP99", load.LatencyP99)
+	}
+	snapshotThrottleRateGauge.Update(int64(t.rate))
+	return time.Duration(float64(size) / t.rate * float64(time.Second))
+}
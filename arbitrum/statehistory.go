@@ -0,0 +1,129 @@
+package arbitrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/metrics"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+var stateRollbackMeter = metrics.NewRegisteredMeter("arb/recreation/rollback", nil)
+
+// errRolledBackState is returned when a state rolled back from the snapshot is used where its tries are needed
+var errRolledBackState = errors.New("state rolled back from the snapshot reverse diffs has no tries, disable recreation-rollback or raise maxRecreateGas")
+
+// StateHistoryResult describes the states recoverable from the snapshot reverse diffs
+type StateHistoryResult struct {
+	Limit      hexutil.Uint64 `json:"limit"`
+	DiffLayers hexutil.Uint64 `json:"diffLayers"`
+	Rollback   bool           `json:"rollback"`
+	Oldest     *BlockRef      `json:"oldest,omitempty"`
+	Disk       *BlockRef      `json:"disk,omitempty"`
+	Roots      []common.Hash  `json:"roots"`
+}
+
+// BlockRef identifies the block a state root belongs to
+type BlockRef struct {
+	Number hexutil.Uint64 `json:"number"`
+	Hash   common.Hash    `json:"hash"`
+	Root   common.Hash    `json:"root"`
+}
+
+// StateRecoverableResult tells how the state of a block can be obtained
+type StateRecoverableResult struct {
+	Block       hexutil.Uint64 `json:"block"`
+	Root        common.Hash    `json:"root"`
+	Available   bool           `json:"available"`   // the trie of the state is in the database
+	Recoverable bool           `json:"recoverable"` // the state can be read from the snapshot
+	Depth       hexutil.Uint64 `json:"depth"`       // number of reverse diffs overlaid to recover the state
+}
+
+// rolledBackState serves the missing state of the header from the snapshot reverse diffs if enabled, nil if it can't
+// be. The tries of the state are rebuilt from the closest later state if possible, else the state is served flat.
+func (a *APIBackend) rolledBackState(ctx context.Context, header *types.Header) *state.StateDB {
+	bc := a.BlockChain()
+	if !a.b.config.RecreationRollback || bc.HasState(header.Root) {
+		return nil
+	}
+	depth, ok := bc.StateRecoverable(header.Root)
+	if !ok {
+		return nil
+	}
+	statedb, err := bc.StateAtBlockByRollback(header)
+	if err != nil {
+		log.Debug("Failed to roll the tries back, serving flat state", "block", header.Number, "root", header.Root, "err", err)
+		if statedb, err = bc.StateAtFromSnapshot(header.Root); err != nil {
+			log.Debug("Failed to roll the snapshot back, recreating state", "block", header.Number, "root", header.Root, "err", err)
+			return nil
+		}
+	}
+	stateRollbackMeter.Mark(1)
+	log.Trace("Rolled state back from the snapshot", "block", header.Number, "root", header.Root, "depth", depth, "flat", statedb.Flat())
+	meterStateReads(ctx, statedb)
+	return statedb
+}
+
+// blockRefByRoot looks the block of the root up, walking back from the head at most limit blocks
+func blockRefByRoot(api *ArbDebugAPI, root common.Hash, limit int) *BlockRef {
+	bc := api.b.BlockChain()
+	header := bc.CurrentBlock()
+	for i := 0; header != nil && i <= limit; i++ {
+		if header.Root == root {
+			return &BlockRef{Number: hexutil.Uint64(header.Number.Uint64()), Hash: header.Hash(), Root: root}
+		}
+		if header.Number.Sign() == 0 {
+			break
+		}
+		header = bc.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+	}
+	return nil
+}
+
+// StateHistory returns the states recoverable from the snapshot reverse diffs, kept for --snapshot.history blocks
+// below the snapshot disk layer
+func (api *ArbDebugAPI) StateHistory() (*StateHistoryResult, error) {
+	history := api.b.BlockChain().StateHistory()
+	if history == nil {
+		return nil, errors.New("snapshot not enabled")
+	}
+	res := &StateHistoryResult{
+		Limit:      hexutil.Uint64(history.Limit),
+		DiffLayers: hexutil.Uint64(history.Layers),
+		Rollback:   api.b.b.config.RecreationRollback,
+		Roots:      history.Roots,
+	}
+	if len(history.Roots) > 0 {
+		depth := history.Limit + history.Layers + 1
+		res.Oldest = blockRefByRoot(api, history.Roots[0], depth)
+		res.Disk = blockRefByRoot(api, history.Roots[len(history.Roots)-1], depth)
+	}
+	return res, nil
+}
+
+// StateRecoverable tells whether the state of the block is available, or recoverable from the snapshot without
+// replaying blocks
+func (api *ArbDebugAPI) StateRecoverable(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash) (*StateRecoverableResult, error) {
+	header, err := api.b.HeaderByNumberOrHash(ctx, blockNrOrHash)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, fmt.Errorf("block %v not found", blockNrOrHash.String())
+	}
+	bc := api.b.BlockChain()
+	depth, recoverable := bc.StateRecoverable(header.Root)
+	return &StateRecoverableResult{
+		Block:       hexutil.Uint64(header.Number.Uint64()),
+		Root:        header.Root,
+		Available:   bc.HasState(header.Root),
+		Recoverable: recoverable,
+		Depth:       hexutil.Uint64(depth),
+	}, nil
+}
@@ -0,0 +1,445 @@
+package arbitrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+	"github.com/chainupcloud/arb-geth/rpc"
+	"github.com/chainupcloud/arb-geth/trie"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+	flag "github.com/spf13/pflag"
+)
+
+type StateMirrorConfig struct {
+	Serve             bool          `koanf:"serve"`
+	Source            string        `koanf:"source"`
+	Buffer            int           `koanf:"buffer"`
+	ReconnectInterval time.Duration `koanf:"reconnect-interval"`
+}
+
+var DefaultStateMirrorConfig = StateMirrorConfig{
+	Serve:             false,
+	Source:            "",
+	Buffer:            128,
+	ReconnectInterval: 5 * time.Second,
+}
+
+func StateMirrorConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".serve", DefaultStateMirrorConfig.Serve, "stream the blocks written by this node, along with the trie nodes of their state, to mirroring nodes over the statemirror rpc namespace")
+	f.String(prefix+".source", DefaultStateMirrorConfig.Source, "websocket or ipc endpoint of a node serving its state updates, to mirror its chain without executing the blocks (requires snapshots to be disabled, and the node not to produce blocks itself)")
+	f.Int(prefix+".buffer", DefaultStateMirrorConfig.Buffer, "number of recent state updates kept for mirrors reconnecting, and queued for each mirror before it's dropped as too slow")
+	f.Duration(prefix+".reconnect-interval", DefaultStateMirrorConfig.ReconnectInterval, "delay before reconnecting to the mirrored node after the stream is interrupted")
+}
+
+// StateMirrorMessage is an entry of the state update stream, either a block written with its state, or a head update
+type StateMirrorMessage struct {
+	Number hexutil.Uint64 `json:"number"`
+	Head   *common.Hash   `json:"head,omitempty"`
+	Update hexutil.Bytes  `json:"update,omitempty"` // RLP encoded stateMirrorUpdate
+}
+
+type stateMirrorUpdate struct {
+	Block    *types.Block
+	Receipts []*types.ReceiptForStorage
+	Sets     []stateMirrorNodeSet
+}
+
+type stateMirrorNodeSet struct {
+	Owner  common.Hash
+	Nodes  []stateMirrorNode
+	Leaves []stateMirrorLeaf
+}
+
+type stateMirrorNode struct {
+	Path []byte
+	Hash common.Hash
+	Blob []byte
+}
+
+type stateMirrorLeaf struct {
+	Parent common.Hash
+	Blob   []byte
+}
+
+func encodeStateMirrorSets(nodes *trienode.MergedNodeSet) []stateMirrorNodeSet {
+	if nodes == nil {
+		return nil
+	}
+	sets := make([]stateMirrorNodeSet, 0, len(nodes.Sets))
+	for owner, set := range nodes.Sets {
+		enc := stateMirrorNodeSet{Owner: owner}
+		for path, node := range set.Nodes {
+			enc.Nodes = append(enc.Nodes, stateMirrorNode{Path: []byte(path), Hash: node.Hash, Blob: node.Blob})
+		}
+		for _, leaf := range set.Leaves {
+			enc.Leaves = append(enc.Leaves, stateMirrorLeaf{Parent: leaf.Parent, Blob: leaf.Blob})
+		}
+		sets = append(sets, enc)
+	}
+	return sets
+}
+
+func decodeStateMirrorSets(sets []stateMirrorNodeSet) (*trienode.MergedNodeSet, error) {
+	if len(sets) == 0 {
+		return nil, nil
+	}
+	nodes := trienode.NewMergedNodeSet()
+	for _, enc := range sets {
+		set := trienode.NewNodeSet(enc.Owner)
+		for _, node := range enc.Nodes {
+			set.AddNode(node.Path, trienode.NewWithPrev(node.Hash, node.Blob, nil))
+		}
+		for _, leaf := range enc.Leaves {
+			set.AddLeaf(leaf.Parent, leaf.Blob)
+		}
+		if err := nodes.Merge(set); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+// maxStateMirrorPending bounds the number of committed states waiting for their block to be written,
+// the states recreated for rpc calls are committed without any block following
+const maxStateMirrorPending = 1024
+
+// stateMirrorSource pairs the blocks written by the node with the trie nodes their state commit produced,
+// and streams them to the subscribed mirrors
+type stateMirrorSource struct {
+	bc     *core.BlockChain
+	config *StateMirrorConfig
+
+	mutex  sync.Mutex
+	recent []*StateMirrorMessage
+	subs   map[chan *StateMirrorMessage]struct{}
+}
+
+func newStateMirrorSource(config *StateMirrorConfig, bc *core.BlockChain) *stateMirrorSource {
+	return &stateMirrorSource{
+		bc:     bc,
+		config: config,
+		subs:   make(map[chan *StateMirrorMessage]struct{}),
+	}
+}
+
+func (s *stateMirrorSource) start(closed <-chan struct{}) {
+	var (
+		updates   = make(chan trie.UpdateEvent, 64)
+		events    = make(chan core.FirehoseEvent, 64)
+		updateSub = s.bc.SubscribeStateUpdates(updates)
+		eventSub  = s.bc.SubscribeFirehose(s.bc.CurrentBlock().Number.Uint64()+1, events)
+	)
+	go func() {
+		defer updateSub.Unsubscribe()
+		defer eventSub.Unsubscribe()
+
+		var (
+			pending = make(map[common.Hash]*trienode.MergedNodeSet)
+			order   []common.Hash
+		)
+		addPending := func(update trie.UpdateEvent) {
+			if _, ok := pending[update.Root]; !ok {
+				order = append(order, update.Root)
+			}
+			pending[update.Root] = update.Nodes
+			for len(order) > maxStateMirrorPending {
+				delete(pending, order[0])
+				order = order[1:]
+			}
+		}
+		for {
+			select {
+			case update := <-updates:
+				addPending(update)
+			case event := <-events:
+				// the state of a block is committed before the block is posted, collect it first
+				for drained := false; !drained; {
+					select {
+					case update := <-updates:
+						addPending(update)
+					default:
+						drained = true
+					}
+				}
+				switch event.Type {
+				case core.FirehoseBlock, core.FirehoseSide:
+					root := event.Block.Root()
+					msg, err := s.encodeBlock(event.Block, pending[root])
+					if err != nil {
+						log.Error("Failed to encode mirrored state update", "block", event.Block.NumberU64(), "err", err)
+						continue
+					}
+					delete(pending, root)
+					s.publish(msg)
+				case core.FirehoseHead:
+					head := event.Block.Hash()
+					s.publish(&StateMirrorMessage{Number: hexutil.Uint64(event.Block.NumberU64()), Head: &head})
+				}
+			case err := <-updateSub.Err():
+				log.Error("State mirror lost trie updates", "err", err)
+				return
+			case err := <-eventSub.Err():
+				log.Error("State mirror lost chain events", "err", err)
+				return
+			case <-closed:
+				return
+			}
+		}
+	}()
+}
+
+func (s *stateMirrorSource) encodeBlock(block *types.Block, nodes *trienode.MergedNodeSet) (*StateMirrorMessage, error) {
+	receipts := s.bc.GetReceiptsByHash(block.Hash())
+	update := stateMirrorUpdate{
+		Block:    block,
+		Receipts: make([]*types.ReceiptForStorage, len(receipts)),
+		Sets:     encodeStateMirrorSets(nodes),
+	}
+	for i, receipt := range receipts {
+		update.Receipts[i] = (*types.ReceiptForStorage)(receipt)
+	}
+	enc, err := rlp.EncodeToBytes(&update)
+	if err != nil {
+		return nil, err
+	}
+	return &StateMirrorMessage{Number: hexutil.Uint64(block.NumberU64()), Update: enc}, nil
+}
+
+// publish sends the message to the subscribed mirrors, dropping the ones not keeping up
+func (s *stateMirrorSource) publish(msg *StateMirrorMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.recent = append(s.recent, msg)
+	if len(s.recent) > s.config.Buffer {
+		s.recent = s.recent[len(s.recent)-s.config.Buffer:]
+	}
+	for ch := range s.subs {
+		select {
+		case ch <- msg:
+		default:
+			log.Warn("Dropping state mirror not keeping up")
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel receiving the recent messages past the given block number, followed by the new ones.
+// The channel is closed if the subscriber doesn't keep up.
+func (s *stateMirrorSource) subscribe(from uint64) (chan *StateMirrorMessage, func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ch := make(chan *StateMirrorMessage, 2*s.config.Buffer)
+	replay := false
+	for _, msg := range s.recent {
+		if replay = replay || uint64(msg.Number) > from; replay {
+			ch <- msg
+		}
+	}
+	s.subs[ch] = struct{}{}
+	return ch, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if _, ok := s.subs[ch]; ok {
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+type StateMirrorAPI struct {
+	b *APIBackend
+}
+
+func NewStateMirrorAPI(b *APIBackend) *StateMirrorAPI {
+	return &StateMirrorAPI{b}
+}
+
+// Updates streams the blocks written by the node along with the trie nodes of their state, and the head updates,
+// starting with the recent ones past the given block number
+func (api *StateMirrorAPI) Updates(ctx context.Context, from hexutil.Uint64) (*rpc.Subscription, error) {
+	source := api.b.b.stateMirrorSource
+	if source == nil {
+		return nil, errors.New("state mirror serving not enabled")
+	}
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	rpcSub := notifier.CreateSubscription()
+	messages, unsubscribe := source.subscribe(uint64(from))
+	go func() {
+		defer unsubscribe()
+		for {
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					return // too slow, the mirror will resubscribe
+				}
+				if err := notifier.Notify(rpcSub.ID, msg); err != nil {
+					return
+				}
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
+
+// RawBlock returns the RLP encoded canonical block with the given number, mirrors re-execute the blocks they missed
+func (api *StateMirrorAPI) RawBlock(ctx context.Context, number hexutil.Uint64) (hexutil.Bytes, error) {
+	block := api.b.BlockChain().GetBlockByNumber(uint64(number))
+	if block == nil {
+		return nil, fmt.Errorf("block %d not found", number)
+	}
+	return rlp.EncodeToBytes(block)
+}
+
+// stateMirrorFollower applies the state updates streamed by another node
+type stateMirrorFollower struct {
+	bc     *core.BlockChain
+	config *StateMirrorConfig
+}
+
+func newStateMirrorFollower(config *StateMirrorConfig, bc *core.BlockChain) (*stateMirrorFollower, error) {
+	if bc.Snapshots() != nil {
+		return nil, errors.New("state mirroring requires snapshots to be disabled")
+	}
+	return &stateMirrorFollower{bc: bc, config: config}, nil
+}
+
+func (f *stateMirrorFollower) start(closed <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-closed
+		cancel()
+	}()
+	go func() {
+		for {
+			err := f.follow(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warn("State mirror stream interrupted", "source", f.config.Source, "err", err)
+			select {
+			case <-time.After(f.config.ReconnectInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (f *stateMirrorFollower) follow(ctx context.Context) error {
+	client, err := rpc.DialContext(ctx, f.config.Source)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	messages := make(chan *StateMirrorMessage, 2*f.config.Buffer)
+	sub, err := client.Subscribe(ctx, "statemirror", messages, "updates", hexutil.Uint64(f.bc.CurrentBlock().Number.Uint64()))
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	log.Info("Mirroring state updates", "source", f.config.Source, "head", f.bc.CurrentBlock().Number)
+
+	for {
+		select {
+		case msg := <-messages:
+			if err := f.apply(ctx, client, msg); err != nil {
+				return err
+			}
+		case err := <-sub.Err():
+			if err == nil {
+				err = errors.New("subscription closed")
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (f *stateMirrorFollower) apply(ctx context.Context, client *rpc.Client, msg *StateMirrorMessage) error {
+	if msg.Head != nil {
+		// heads moving forward follow the written blocks, only rewinds need to be applied
+		current := f.bc.CurrentBlock()
+		block := f.bc.GetBlockByHash(*msg.Head)
+		if block == nil || block.NumberU64() >= current.Number.Uint64() || !f.bc.HasState(block.Root()) {
+			return nil
+		}
+		log.Info("Rewinding mirrored chain", "from", current.Number, "to", block.NumberU64())
+		return f.bc.ReorgToOldBlock(block)
+	}
+	var update stateMirrorUpdate
+	if err := rlp.DecodeBytes(msg.Update, &update); err != nil {
+		return fmt.Errorf("invalid state update: %w", err)
+	}
+	block := update.Block
+	if f.bc.HasBlockAndState(block.Hash(), block.NumberU64()) {
+		return nil
+	}
+	parent := f.bc.GetHeader(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil || !f.bc.HasState(parent.Root) {
+		if err := f.catchUp(ctx, client, block.NumberU64()); err != nil {
+			return err
+		}
+		if parent = f.bc.GetHeader(block.ParentHash(), block.NumberU64()-1); parent == nil {
+			return fmt.Errorf("parent of mirrored block %d unknown", block.NumberU64())
+		}
+	}
+	nodes, err := decodeStateMirrorSets(update.Sets)
+	if err != nil {
+		return fmt.Errorf("invalid state update: %w", err)
+	}
+	receipts := make(types.Receipts, len(update.Receipts))
+	for i, receipt := range update.Receipts {
+		receipts[i] = (*types.Receipt)(receipt)
+	}
+	if err := receipts.DeriveFields(f.bc.Config(), block.Hash(), block.NumberU64(), block.Time(), block.BaseFee(), block.Transactions()); err != nil {
+		return fmt.Errorf("invalid receipts of mirrored block %d: %w", block.NumberU64(), err)
+	}
+	// the time covered by the block stands for its processing time, so that the state gets flushed periodically
+	processTime := time.Duration(block.Time()-parent.Time) * time.Second
+	_, err = f.bc.WriteMirroredBlock(block, receipts, nodes, processTime)
+	return err
+}
+
+// catchUp executes the canonical blocks of the mirrored node missed before the given one
+func (f *stateMirrorFollower) catchUp(ctx context.Context, client *rpc.Client, number uint64) error {
+	head := f.bc.CurrentBlock().Number.Uint64()
+	if head+1 >= number {
+		return nil
+	}
+	log.Info("Executing blocks missed by the state mirror", "from", head+1, "to", number-1)
+	for next := head + 1; next < number; next++ {
+		var raw hexutil.Bytes
+		if err := client.CallContext(ctx, &raw, "statemirror_rawBlock", hexutil.Uint64(next)); err != nil {
+			return err
+		}
+		block := new(types.Block)
+		if err := rlp.DecodeBytes(raw, block); err != nil {
+			return fmt.Errorf("invalid block %d: %w", next, err)
+		}
+		if _, err := f.bc.InsertChain(types.Blocks{block}); err != nil {
+			return fmt.Errorf("failed to execute missed block %d: %w", next, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package arbitrum
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/eth/tracers"
+	"github.com/chainupcloud/arb-geth/log"
+	flag "github.com/spf13/pflag"
+)
+
+type TracedStatePinningConfig struct {
+	Enable       bool          `koanf:"enable"`
+	Window       time.Duration `koanf:"window"`
+	MinTraces    int           `koanf:"min-traces"`
+	MemoryBudget uint64        `koanf:"memory-budget"`
+	MaxTracked   int           `koanf:"max-tracked"`
+}
+
+var DefaultTracedStatePinningConfig = TracedStatePinningConfig{
+	Enable:       false,
+	Window:       10 * time.Minute,
+	MinTraces:    3,
+	MemoryBudget: 512 * 1024 * 1024,
+	MaxTracked:   4096,
+}
+
+func TracedStatePinningConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultTracedStatePinningConfig.Enable, "keep recreated states of frequently traced blocks in memory")
+	f.Duration(prefix+".window", DefaultTracedStatePinningConfig.Window, "rolling window over which block traces are counted")
+	f.Int(prefix+".min-traces", DefaultTracedStatePinningConfig.MinTraces, "number of traces within the window after which a block's recreated state is pinned")
+	f.Uint64(prefix+".memory-budget", DefaultTracedStatePinningConfig.MemoryBudget, "maximum estimated memory in bytes used by pinned states")
+	f.Int(prefix+".max-tracked", DefaultTracedStatePinningConfig.MaxTracked, "maximum number of blocks whose trace frequency is tracked")
+}
+
+type pinnedState struct {
+	statedb *state.StateDB
+	release tracers.StateReleaseFunc
+	size    uint64
+	number  uint64
+	pinned  time.Time
+	users   int  // number of outstanding copies handed out
+	evicted bool // release the state once the last user is done
+}
+
+// tracedStatePinner tracks which blocks' states are requested for tracing and
+// keeps the recreated states of the most popular ones, so that repeated traces
+// of the same blocks don't pay for a full recreation every time
+type tracedStatePinner struct {
+	config *TracedStatePinningConfig
+
+	mutex  sync.Mutex
+	hits   map[common.Hash][]time.Time
+	pinned map[common.Hash]*pinnedState
+	size   uint64
+}
+
+func newTracedStatePinner(config *TracedStatePinningConfig) *tracedStatePinner {
+	return &tracedStatePinner{
+		config: config,
+		hits:   make(map[common.Hash][]time.Time),
+		pinned: make(map[common.Hash]*pinnedState),
+	}
+}
+
+// trimHits drops hits that fell out of the window, must be called with the mutex held
+func (p *tracedStatePinner) trimHits(hash common.Hash, now time.Time) int {
+	hits := p.hits[hash]
+	cutoff := now.Add(-p.config.Window)
+	i := 0
+	for i < len(hits) && hits[i].Before(cutoff) {
+		i++
+	}
+	hits = hits[i:]
+	if len(hits) == 0 {
+		delete(p.hits, hash)
+	} else {
+		p.hits[hash] = hits
+	}
+	return len(hits)
+}
+
+// record registers a trace request for the block and reports whether its state should be pinned
+func (p *tracedStatePinner) record(hash common.Hash) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	if _, tracked := p.hits[hash]; !tracked && len(p.hits) >= p.config.MaxTracked {
+		for other := range p.hits {
+			p.trimHits(other, now)
+		}
+		if len(p.hits) >= p.config.MaxTracked {
+			return false
+		}
+	}
+	p.hits[hash] = append(p.hits[hash], now)
+	return p.trimHits(hash, now) >= p.config.MinTraces
+}
+
+// get returns a copy of the pinned state of the block, if any, along with a
+// function releasing it. The pinned state is kept alive until then, even if
+// it gets evicted in the meantime.
+func (p *tracedStatePinner) get(hash common.Hash) (*state.StateDB, tracers.StateReleaseFunc) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pin, ok := p.pinned[hash]
+	if !ok {
+		return nil, nil
+	}
+	pin.users++
+	var once sync.Once
+	return pin.statedb.Copy(), func() {
+		once.Do(func() {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			pin.users--
+			if pin.evicted && pin.users == 0 && pin.release != nil {
+				pin.release()
+			}
+		})
+	}
+}
+
+// pin takes ownership of the state and its release function, evicting the
+// least traced pins if needed to stay within the memory budget. It reports
+// whether the state was pinned, if not the caller keeps ownership.
+func (p *tracedStatePinner) pin(hash common.Hash, number uint64, statedb *state.StateDB, release tracers.StateReleaseFunc) bool {
+	nodes, preimages := statedb.Database().TrieDB().Size()
+	size := uint64(nodes + preimages)
+	if size > p.config.MemoryBudget {
+		return false
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.pinned[hash]; ok {
+		return false
+	}
+	if p.size+size > p.config.MemoryBudget {
+		now := time.Now()
+		candidates := make([]common.Hash, 0, len(p.pinned))
+		for other := range p.pinned {
+			candidates = append(candidates, other)
+		}
+		popularity := make(map[common.Hash]int, len(candidates))
+		for _, other := range candidates {
+			popularity[other] = p.trimHits(other, now)
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return popularity[candidates[i]] < popularity[candidates[j]]
+		})
+		for _, other := range candidates {
+			if p.size+size <= p.config.MemoryBudget {
+				break
+			}
+			if popularity[other] > len(p.hits[hash]) {
+				// everything left is more popular than the new candidate
+				return false
+			}
+			p.unpin(other)
+		}
+		if p.size+size > p.config.MemoryBudget {
+			return false
+		}
+	}
+	p.pinned[hash] = &pinnedState{
+		statedb: statedb.Copy(),
+		release: release,
+		size:    size,
+		number:  number,
+		pinned:  time.Now(),
+	}
+	p.size += size
+	log.Info("Pinned state of frequently traced block", "number", number, "hash", hash, "size", common.StorageSize(size))
+	return true
+}
+
+// unpin releases a pinned state, must be called with the mutex held
+func (p *tracedStatePinner) unpin(hash common.Hash) {
+	pin, ok := p.pinned[hash]
+	if !ok {
+		return
+	}
+	delete(p.pinned, hash)
+	p.size -= pin.size
+	pin.evicted = true
+	if pin.users == 0 && pin.release != nil {
+		pin.release()
+	}
+	log.Debug("Unpinned state of traced block", "number", pin.number, "hash", hash)
+}
+
+// close releases all the pinned states
+func (p *tracedStatePinner) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for hash := range p.pinned {
+		p.unpin(hash)
+	}
+}
+
+type PinnedTracedState struct {
+	Number hexutil.Uint64 `json:"number"`
+	Hash   common.Hash    `json:"hash"`
+	Size   hexutil.Uint64 `json:"size"`
+	Traces int            `json:"traces"`
+	Pinned time.Time      `json:"pinned"`
+}
+
+func (p *tracedStatePinner) list() []PinnedTracedState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	res := make([]PinnedTracedState, 0, len(p.pinned))
+	for hash, pin := range p.pinned {
+		res = append(res, PinnedTracedState{
+			Number: hexutil.Uint64(pin.number),
+			Hash:   hash,
+			Size:   hexutil.Uint64(pin.size),
+			Traces: p.trimHits(hash, now),
+			Pinned: pin.pinned,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Number < res[j].Number })
+	return res
+}
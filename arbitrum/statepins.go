@@ -0,0 +1,95 @@
+package arbitrum
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+// maxStatePinLabelLength bounds the labels of pinned states, which are part of their database keys
+const maxStatePinLabelLength = 128
+
+type PinnedState struct {
+	Label       string         `json:"label"`
+	BlockNumber hexutil.Uint64 `json:"blockNumber"`
+	BlockHash   common.Hash    `json:"blockHash"`
+	StateRoot   common.Hash    `json:"stateRoot"`
+	Pinned      time.Time      `json:"pinned"`
+}
+
+func newPinnedState(pin *rawdb.StatePin) *PinnedState {
+	return &PinnedState{
+		Label:       pin.Label,
+		BlockNumber: hexutil.Uint64(pin.BlockNumber),
+		BlockHash:   pin.BlockHash,
+		StateRoot:   pin.Root,
+		Pinned:      time.Unix(int64(pin.Created), 0).UTC(),
+	}
+}
+
+// PinState recreates the state of the block if needed, with a recreation budget of maxRecreateGas l2 gas
+// (-1=infinite) overriding the node default, then commits it to disk and keeps it out of pruning under the label
+func (api *ArbDebugAPI) PinState(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash, label string, maxRecreateGas *int64) (*PinnedState, error) {
+	if label == "" || len(label) > maxStatePinLabelLength {
+		return nil, fmt.Errorf("invalid label, must be 1 to %d bytes long", maxStatePinLabelLength)
+	}
+	if maxRecreateGas != nil {
+		if *maxRecreateGas < InfiniteMaxRecreateStateDepth {
+			return nil, fmt.Errorf("invalid maxRecreateGas %d, must be -1 (infinite) or non-negative", *maxRecreateGas)
+		}
+		ctx = WithMaxRecreateStateDepth(ctx, *maxRecreateGas)
+	}
+	bc := api.b.BlockChain()
+	statedb, header, err := api.b.StateAndHeaderByNumberOrHash(ctx, blockNrOrHash)
+	if err != nil {
+		return nil, err
+	}
+	if statedb.Flat() {
+		return nil, errRolledBackState
+	}
+	if !bc.HasState(header.Root) {
+		// the recreated state only lives in the statedb, commit it so that it can be persisted
+		block := bc.GetBlock(header.Hash(), header.Number.Uint64())
+		if block == nil {
+			return nil, fmt.Errorf("block %d not found", header.Number.Uint64())
+		}
+		if _, err := persistRecreatedState(bc, statedb, block); err != nil {
+			return nil, err
+		}
+	}
+	pin, err := bc.PinState(label, header)
+	if err != nil {
+		return nil, err
+	}
+	return newPinnedState(pin), nil
+}
+
+// UnpinState releases the state pinned under the label, letting the next pruning drop it
+func (api *ArbDebugAPI) UnpinState(label string) error {
+	return api.b.BlockChain().UnpinState(label)
+}
+
+// PinnedState returns the state pinned under the label
+func (api *ArbDebugAPI) PinnedState(label string) (*PinnedState, error) {
+	pin := api.b.BlockChain().StatePin(label)
+	if pin == nil {
+		return nil, fmt.Errorf("%w: %q", core.ErrStatePinNotFound, label)
+	}
+	return newPinnedState(pin), nil
+}
+
+// PinnedStates lists all the pinned states, ordered by label
+func (api *ArbDebugAPI) PinnedStates() []*PinnedState {
+	pins := api.b.BlockChain().StatePins()
+	res := make([]*PinnedState, 0, len(pins))
+	for _, pin := range pins {
+		res = append(res, newPinnedState(pin))
+	}
+	return res
+}
@@ -0,0 +1,148 @@
+package arbitrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/rlp"
+	"github.com/chainupcloud/arb-geth/rpc"
+	"github.com/chainupcloud/arb-geth/trie"
+)
+
+const (
+	defaultStorageRangeLimit = 1024
+	maxStorageRangeLimit     = 16384
+)
+
+var errStorageRangeUnavailable = errors.New("storage not available in the snapshot")
+
+type StorageRangeEntry struct {
+	Hash  common.Hash  `json:"hash"`          // hash of the slot, the order of the iteration
+	Key   *common.Hash `json:"key,omitempty"` // slot, if its preimage is known
+	Value common.Hash  `json:"value"`
+}
+
+type StorageRange struct {
+	Entries []*StorageRangeEntry `json:"entries"`
+	Next    *common.Hash         `json:"next,omitempty"` // hash to resume the enumeration from, nil at the end of the storage
+	Source  string               `json:"source"`         // snapshot or trie
+}
+
+// StorageRange enumerates up to limit storage slots of the contract at the block, in the order of their hashes from
+// start on, iterating the flat snapshot if it holds the block and the storage trie otherwise. Both iterate in the
+// same order, so the next hash returned resumes the enumeration whichever serves the following page
+func (api *ArbDebugAPI) StorageRange(ctx context.Context, address common.Address, blockNrOrHash rpc.BlockNumberOrHash, start *common.Hash, limit *hexutil.Uint64) (*StorageRange, error) {
+	max := defaultStorageRangeLimit
+	if limit != nil {
+		if *limit == 0 || *limit > maxStorageRangeLimit {
+			return nil, fmt.Errorf("invalid limit %d, must be 1 to %d", *limit, maxStorageRangeLimit)
+		}
+		max = int(*limit)
+	}
+	var seek common.Hash
+	if start != nil {
+		seek = *start
+	}
+	header, err := api.b.HeaderByNumberOrHash(ctx, blockNrOrHash)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, fmt.Errorf("block %v not found", blockNrOrHash.String())
+	}
+	res, err := api.storageRangeFromSnapshot(header, address, seek, max)
+	if err == nil {
+		return res, nil
+	}
+	statedb, _, err := api.b.StateAndHeaderByNumberOrHash(ctx, rpc.BlockNumberOrHashWithHash(header.Hash(), false))
+	if err != nil {
+		return nil, err
+	}
+	st, err := statedb.StorageTrie(address)
+	if err != nil {
+		return nil, err
+	}
+	if st == nil {
+		return nil, fmt.Errorf("account %x doesn't exist", address)
+	}
+	res = &StorageRange{Entries: []*StorageRangeEntry{}, Source: "trie"}
+	it := trie.NewIterator(st.NodeIterator(seek[:]))
+	for it.Next() {
+		hash := common.BytesToHash(it.Key)
+		if len(res.Entries) == max {
+			res.Next = &hash
+			break
+		}
+		entry, err := api.storageRangeEntry(hash, it.Value)
+		if err != nil {
+			return nil, err
+		}
+		res.Entries = append(res.Entries, entry)
+	}
+	if it.Err != nil {
+		return nil, it.Err
+	}
+	return res, nil
+}
+
+// storageRangeFromSnapshot enumerates the storage from the flat snapshot, failing if it doesn't hold the block or
+// was flattened during the iteration
+func (api *ArbDebugAPI) storageRangeFromSnapshot(header *types.Header, address common.Address, seek common.Hash, max int) (*StorageRange, error) {
+	snaps := api.b.BlockChain().Snapshots()
+	if snaps == nil {
+		return nil, errStorageRangeUnavailable
+	}
+	snap := snaps.Snapshot(header.Root)
+	if snap == nil {
+		return nil, errStorageRangeUnavailable
+	}
+	accountHash := crypto.Keccak256Hash(address.Bytes())
+	account, err := snap.Account(accountHash)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, fmt.Errorf("account %x doesn't exist", address)
+	}
+	it, err := snaps.StorageIterator(header.Root, accountHash, seek)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Release()
+
+	res := &StorageRange{Entries: []*StorageRangeEntry{}, Source: "snapshot"}
+	for it.Next() {
+		hash := it.Hash()
+		if len(res.Entries) == max {
+			res.Next = &hash
+			break
+		}
+		entry, err := api.storageRangeEntry(hash, it.Slot())
+		if err != nil {
+			return nil, err
+		}
+		res.Entries = append(res.Entries, entry)
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (api *ArbDebugAPI) storageRangeEntry(hash common.Hash, value []byte) (*StorageRangeEntry, error) {
+	_, content, _, err := rlp.Split(value)
+	if err != nil {
+		return nil, err
+	}
+	entry := &StorageRangeEntry{Hash: hash, Value: common.BytesToHash(content)}
+	if preimage := api.b.BlockChain().TrieDB().Preimage(hash); preimage != nil {
+		key := common.BytesToHash(preimage)
+		entry.Key = &key
+	}
+	return entry, nil
+}
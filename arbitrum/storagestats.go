@@ -0,0 +1,124 @@
+package arbitrum
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core/state/snapshot"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/rpc"
+	"github.com/chainupcloud/arb-geth/trie"
+)
+
+type StorageTrieStats struct {
+	Address     common.Address `json:"address"`
+	BlockNumber hexutil.Uint64 `json:"blockNumber"`
+	StorageRoot common.Hash    `json:"storageRoot"`
+	// Slots and ValueSize are exact if counted from the snapshot or a full trie walk, and estimated if sampled
+	Slots      hexutil.Uint64 `json:"slots"`
+	ValueSize  hexutil.Uint64 `json:"valueSize"`
+	SlotsExact bool           `json:"slotsExact"`
+	// TrieNodes and TrieSize are estimated if sampled
+	TrieNodes hexutil.Uint64 `json:"trieNodes"`
+	TrieSize  hexutil.Uint64 `json:"trieSize"`
+	// Depths counts the walked slots by the number of trie nodes on their path
+	Depths       []hexutil.Uint64 `json:"depths"`
+	SampledSlots hexutil.Uint64   `json:"sampledSlots"`
+	Coverage     float64          `json:"coverage"`
+}
+
+// storageSnapshotStats counts the storage slots of the account and their size from the snapshot, if it covers the state
+func storageSnapshotStats(ctx context.Context, snaps *snapshot.Tree, root common.Hash, address common.Address) (uint64, uint64, bool, error) {
+	if snaps == nil || snaps.Snapshot(root) == nil {
+		return 0, 0, false, nil
+	}
+	it, err := snaps.StorageIterator(root, crypto.Keccak256Hash(address.Bytes()), common.Hash{})
+	if err != nil {
+		return 0, 0, false, nil // the snapshot is still being generated
+	}
+	defer it.Release()
+
+	var slots, size uint64
+	for it.Next() {
+		slots++
+		size += uint64(len(it.Slot()))
+		if slots%10000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return 0, 0, false, err
+			}
+		}
+	}
+	if err := it.Error(); err != nil {
+		return 0, 0, false, err
+	}
+	return slots, size, true, nil
+}
+
+// StorageTrieStats walks the storage trie of the contract in the stored state of the block and reports its slot count,
+// sizes and depth distribution. The walk stops after sampleSize slots (bounded by the configured sample size), and the
+// totals are then extrapolated from the share of the keyspace walked. The slot count and value size are taken from the
+// snapshot when it covers the state, which is exact and much faster than walking the trie.
+func (api *ArbDebugAPI) StorageTrieStats(ctx context.Context, address common.Address, blockNrOrHash rpc.BlockNumberOrHash, sampleSize *hexutil.Uint64) (*StorageTrieStats, error) {
+	header, err := api.b.HeaderByNumberOrHash(ctx, blockNrOrHash)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, fmt.Errorf("block %v not found", blockNrOrHash.String())
+	}
+	bc := api.b.BlockChain()
+	statedb, err := bc.StateAt(header.Root)
+	if err != nil {
+		return nil, fmt.Errorf("state of block %d not stored: %w", header.Number.Uint64(), err)
+	}
+	storage, err := statedb.StorageTrie(address)
+	if err != nil {
+		return nil, err
+	}
+	if storage == nil {
+		return nil, fmt.Errorf("account %v does not exist", address)
+	}
+	maxSlots := api.b.b.config.ArbDebug.StorageStatsSampleSize
+	if sampleSize != nil && (maxSlots == 0 || uint64(*sampleSize) < maxSlots) {
+		maxSlots = uint64(*sampleSize)
+	}
+	walked, err := trie.CollectStats(ctx, storage, maxSlots)
+	if err != nil {
+		return nil, err
+	}
+	sampled := walked.Coverage < 1
+	estimate := func(n uint64) hexutil.Uint64 {
+		if !sampled || walked.Coverage == 0 {
+			return hexutil.Uint64(n)
+		}
+		return hexutil.Uint64(float64(n) / walked.Coverage)
+	}
+	stats := &StorageTrieStats{
+		Address:      address,
+		BlockNumber:  hexutil.Uint64(header.Number.Uint64()),
+		StorageRoot:  storage.Hash(),
+		Slots:        estimate(walked.Leaves),
+		ValueSize:    estimate(walked.ValueBytes),
+		SlotsExact:   !sampled,
+		TrieNodes:    estimate(walked.Nodes),
+		TrieSize:     estimate(walked.NodeBytes),
+		Depths:       make([]hexutil.Uint64, len(walked.Depths)),
+		SampledSlots: hexutil.Uint64(walked.Leaves),
+		Coverage:     walked.Coverage,
+	}
+	for depth, count := range walked.Depths {
+		stats.Depths[depth] = hexutil.Uint64(count)
+	}
+	if sampled {
+		slots, size, ok, err := storageSnapshotStats(ctx, bc.Snapshots(), header.Root, address)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			stats.Slots, stats.ValueSize, stats.SlotsExact = hexutil.Uint64(slots), hexutil.Uint64(size), true
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,135 @@
+package arbitrum
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core/state/snapshot"
+	"github.com/chainupcloud/arb-geth/eth/protocols/snap"
+	"github.com/chainupcloud/arb-geth/log"
+)
+
+// SyncStagesBackend is optionally implemented by the SyncProgressBackend to report how far the node is behind the sequencer
+type SyncStagesBackend interface {
+	// FeedLag returns how far behind the latest sequencer feed message is
+	FeedLag() (time.Duration, error)
+	// SequencerBlockNumber returns the number of the latest block known to be produced by the sequencer
+	SequencerBlockNumber() (uint64, error)
+}
+
+// StateHealProgressBackend is optionally implemented by the SyncProgressBackend when the node heals its state
+type StateHealProgressBackend interface {
+	HealProgress() *snap.HealProgress
+}
+
+type RecreationBacklog struct {
+	Active hexutil.Uint64 `json:"active"` // number of state recreations in progress
+	Blocks hexutil.Uint64 `json:"blocks"` // number of blocks those still have to replay, if known
+}
+
+// SyncStages reports the Arbitrum specific stages a node goes through before it's fully ready to serve requests
+type SyncStages struct {
+	FeedLag               *float64                     `json:"feedLagSeconds,omitempty"`
+	BlocksBehindSequencer *hexutil.Uint64              `json:"blocksBehindSequencer,omitempty"`
+	StateHeal             *snap.HealProgress           `json:"stateHeal,omitempty"`
+	SnapshotGeneration    *snapshot.GenerationProgress `json:"snapshotGeneration,omitempty"`
+	RecreationBacklog     RecreationBacklog            `json:"recreationBacklog"`
+	Stage                 SyncStage                    `json:"stage"`
+	StageStatus           *SyncStatus                  `json:"stageStatus,omitempty"` // as reported by the SyncStatusProvider, if any
+}
+
+// recreationBacklog counts the state recreations in progress and the blocks they have left to replay
+type recreationBacklog struct {
+	active atomic.Int64
+	blocks atomic.Int64
+}
+
+// start registers a recreation of the given number of blocks, the returned functions
+// mark a block as replayed and the recreation as done
+func (b *recreationBacklog) start(blocks uint64) (replayed func(), done func()) {
+	b.active.Add(1)
+	b.blocks.Add(int64(blocks))
+	var remaining atomic.Int64
+	remaining.Store(int64(blocks))
+	replayed = func() {
+		if remaining.Add(-1) >= 0 {
+			b.blocks.Add(-1)
+		}
+	}
+	done = func() {
+		if left := remaining.Swap(0); left > 0 {
+			b.blocks.Add(-left)
+		}
+		b.active.Add(-1)
+	}
+	return replayed, done
+}
+
+func (b *recreationBacklog) report() RecreationBacklog {
+	return RecreationBacklog{
+		Active: hexutil.Uint64(b.active.Load()),
+		Blocks: hexutil.Uint64(b.blocks.Load()),
+	}
+}
+
+func (a *APIBackend) syncStages() *SyncStages {
+	stages := &SyncStages{
+		RecreationBacklog: a.b.recreationBacklog.report(),
+	}
+	if backend, ok := a.sync.(SyncStagesBackend); ok {
+		if lag, err := backend.FeedLag(); err == nil {
+			seconds := lag.Seconds()
+			stages.FeedLag = &seconds
+		}
+		if sequencerBlock, err := backend.SequencerBlockNumber(); err == nil {
+			var behind hexutil.Uint64
+			if head := a.BlockChain().CurrentBlock().Number.Uint64(); sequencerBlock > head {
+				behind = hexutil.Uint64(sequencerBlock - head)
+			}
+			stages.BlocksBehindSequencer = &behind
+		}
+	}
+	if backend, ok := a.sync.(StateHealProgressBackend); ok {
+		stages.StateHeal = backend.HealProgress()
+	}
+	if snaps := a.BlockChain().Snapshots(); snaps != nil {
+		if progress, err := snaps.GenerationProgress(); err == nil {
+			stages.SnapshotGeneration = progress
+		}
+	}
+	if provider := a.syncStatusProvider(); provider != nil {
+		status := provider.SyncStatus()
+		stages.Stage, stages.StageStatus = status.Stage, &status
+	} else {
+		_, tracksFeed := a.sync.(SyncStagesBackend)
+		stages.Stage = deriveSyncStage(stages, tracksFeed)
+	}
+	return stages
+}
+
+// addSyncStages merges the sync stages into the sync progress map
+func (a *APIBackend) addSyncStages(progress map[string]interface{}) {
+	encoded, err := json.Marshal(a.syncStages())
+	if err != nil {
+		log.Warn("Failed to encode sync stages", "err", err)
+		return
+	}
+	var stages map[string]interface{}
+	if err := json.Unmarshal(encoded, &stages); err != nil {
+		log.Warn("Failed to decode sync stages", "err", err)
+		return
+	}
+	for key, value := range stages {
+		if _, ok := progress[key]; !ok {
+			progress[key] = value
+		}
+	}
+}
+
+// SyncStages returns the Arbitrum specific sync stages, also when the node is considered synced
+func (api *ArbAPI) SyncStages(ctx context.Context) (*SyncStages, error) {
+	return api.b.syncStages(), nil
+}
@@ -0,0 +1,120 @@
+package arbitrum
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+)
+
+// SyncStage is the phase a node is in on its way to being synced
+type SyncStage string
+
+const (
+	// SyncStageWaitingForFeed is reported while the node has no recent sequencer feed messages to process
+	SyncStageWaitingForFeed SyncStage = "waiting-for-feed"
+	// SyncStageReplayingMessages is reported while the node executes the messages it's behind on
+	SyncStageReplayingMessages SyncStage = "replaying-messages"
+	// SyncStageHealingState is reported while the node heals the state it synced
+	SyncStageHealingState SyncStage = "healing-state"
+	// SyncStageGeneratingSnapshot is reported while the state snapshot is generated
+	SyncStageGeneratingSnapshot SyncStage = "generating-snapshot"
+	// SyncStageSynced is reported once the node caught up
+	SyncStageSynced SyncStage = "synced"
+)
+
+// SyncStatus is the stage a node is in, with the progress of the messages it replays
+type SyncStatus struct {
+	Stage SyncStage `json:"stage"`
+	Since time.Time `json:"since"`
+	// number of messages processed and of messages known to the node, set while replaying messages
+	MessagesProcessed *hexutil.Uint64 `json:"messagesProcessed,omitempty"`
+	MessagesTotal     *hexutil.Uint64 `json:"messagesTotal,omitempty"`
+	Detail            string          `json:"detail,omitempty"`
+}
+
+// SyncStatusProvider tells the stage the node is in, it's set with APIBackend.SetSyncStatusProvider or implemented by
+// the SyncProgressBackend. Without one, the stage is derived from the sync stages the node knows of itself
+type SyncStatusProvider interface {
+	SyncStatus() SyncStatus
+}
+
+// SyncStatusTracker is a SyncStatusProvider updated by the node as it goes through the stages
+type SyncStatusTracker struct {
+	mutex  sync.Mutex
+	status SyncStatus
+}
+
+func NewSyncStatusTracker() *SyncStatusTracker {
+	return &SyncStatusTracker{status: SyncStatus{Stage: SyncStageWaitingForFeed, Since: time.Now()}}
+}
+
+// SetStage moves the node into the stage, the time it entered it is kept if it's already in it
+func (t *SyncStatusTracker) SetStage(stage SyncStage, detail string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.status.Stage != stage {
+		t.status = SyncStatus{Stage: stage, Since: time.Now()}
+	}
+	t.status.Detail = detail
+}
+
+// SetMessages updates the number of messages processed and known to the node, moving it into the replaying stage
+// while it's behind and to the synced stage once it caught up
+func (t *SyncStatusTracker) SetMessages(processed, total uint64) {
+	stage := SyncStageReplayingMessages
+	if processed >= total {
+		stage = SyncStageSynced
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.status.Stage != stage {
+		t.status = SyncStatus{Stage: stage, Since: time.Now()}
+	}
+	processedHex, totalHex := hexutil.Uint64(processed), hexutil.Uint64(total)
+	t.status.MessagesProcessed, t.status.MessagesTotal = &processedHex, &totalHex
+}
+
+func (t *SyncStatusTracker) SyncStatus() SyncStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.status
+}
+
+// SetSyncStatusProvider sets what tells the stage the node is in
+func (a *APIBackend) SetSyncStatusProvider(provider SyncStatusProvider) error {
+	if !a.syncStatus.CompareAndSwap(nil, &provider) {
+		return errors.New("sync status provider already set")
+	}
+	return nil
+}
+
+// syncStatusProvider returns the provider set, the SyncProgressBackend if it's one, or nil
+func (a *APIBackend) syncStatusProvider() SyncStatusProvider {
+	if provider := a.syncStatus.Load(); provider != nil {
+		return *provider
+	}
+	if provider, ok := a.sync.(SyncStatusProvider); ok {
+		return provider
+	}
+	return nil
+}
+
+// deriveSyncStage tells the stage the node is in from its sync stages, when nothing provides it. Healing and
+// generating the snapshot keep the node from serving more than being behind the sequencer does, and are reported
+// first. Whether the node waits for the feed is only known if the SyncProgressBackend reports it, as tracksFeed tells
+func deriveSyncStage(stages *SyncStages, tracksFeed bool) SyncStage {
+	switch {
+	case stages.StateHeal != nil && stages.StateHeal.Scheduler.PendingNodes+stages.StateHeal.Scheduler.PendingCodes+stages.StateHeal.Scheduler.Queued > 0:
+		return SyncStageHealingState
+	case stages.SnapshotGeneration != nil && stages.SnapshotGeneration.Generating:
+		return SyncStageGeneratingSnapshot
+	case stages.BlocksBehindSequencer != nil && *stages.BlocksBehindSequencer > 0:
+		return SyncStageReplayingMessages
+	case tracksFeed && stages.FeedLag == nil:
+		return SyncStageWaitingForFeed
+	default:
+		return SyncStageSynced
+	}
+}
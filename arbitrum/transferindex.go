@@ -0,0 +1,111 @@
+package arbitrum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/rpc"
+	flag "github.com/spf13/pflag"
+)
+
+type TransferIndexConfig struct {
+	Enable     bool   `koanf:"enable"`
+	Retention  uint64 `koanf:"retention"`
+	MaxResults uint64 `koanf:"max-results"`
+}
+
+var DefaultTransferIndexConfig = TransferIndexConfig{
+	Enable:     false,
+	Retention:  0,
+	MaxResults: 10000,
+}
+
+func TransferIndexConfigAddOptions(prefix string, f *flag.FlagSet) {
+	f.Bool(prefix+".enable", DefaultTransferIndexConfig.Enable, "index the ERC-20, ERC-721 and ERC-1155 transfers by holder and token as blocks are imported, serving arb_getTokenTransfers")
+	f.Uint64(prefix+".retention", DefaultTransferIndexConfig.Retention, "number of recent blocks whose token transfers are kept in the index (0=all)")
+	f.Uint64(prefix+".max-results", DefaultTransferIndexConfig.MaxResults, "max number of transfers an arb_getTokenTransfers response returns (0=no limit)")
+}
+
+type TokenTransfersArgs struct {
+	Token     *common.Address  `json:"token"` // nil for the transfers of all tokens
+	FromBlock *rpc.BlockNumber `json:"fromBlock"`
+	ToBlock   *rpc.BlockNumber `json:"toBlock"`
+}
+
+type TokenTransfer struct {
+	Token           common.Address `json:"token"`
+	Standard        string         `json:"standard"`
+	From            common.Address `json:"from"`
+	To              common.Address `json:"to"`
+	TokenID         *hexutil.Big   `json:"tokenId,omitempty"`
+	Value           *hexutil.Big   `json:"value,omitempty"`
+	BlockNumber     hexutil.Uint64 `json:"blockNumber"`
+	BlockHash       common.Hash    `json:"blockHash"`
+	TransactionHash common.Hash    `json:"transactionHash"`
+	LogIndex        hexutil.Uint   `json:"logIndex"`
+}
+
+type TokenTransfersResult struct {
+	Transfers []*TokenTransfer `json:"transfers"`
+	// Next is the first block whose transfers were left out because of the response size limit, if any
+	Next *hexutil.Uint64 `json:"next,omitempty"`
+}
+
+// GetTokenTransfers returns the ERC-20, ERC-721 and ERC-1155 transfers from or to the holder in the inclusive block
+// range, defaulting to the latest block, ordered by block and log. Once the response size limit is reached the
+// transfers of the remaining blocks are left out, and the first of them is reported so that the caller can resume
+// from there.
+func (api *ArbAPI) GetTokenTransfers(ctx context.Context, holder common.Address, args TokenTransfersArgs) (*TokenTransfersResult, error) {
+	config := &api.b.b.config.TransferIndex
+	if !config.Enable {
+		return nil, errors.New("transfer index not enabled")
+	}
+	blockNumber := func(number *rpc.BlockNumber) (uint64, error) {
+		if number == nil {
+			return api.b.blockNumberToUint(ctx, rpc.LatestBlockNumber)
+		}
+		return api.b.blockNumberToUint(ctx, *number)
+	}
+	from, err := blockNumber(args.FromBlock)
+	if err != nil {
+		return nil, err
+	}
+	to, err := blockNumber(args.ToBlock)
+	if err != nil {
+		return nil, err
+	}
+	if from > to {
+		return nil, fmt.Errorf("invalid block range: from %d is after to %d", from, to)
+	}
+	transfers, err := api.b.BlockChain().TokenTransfers(holder, args.Token, from, to)
+	if err != nil {
+		return nil, err
+	}
+	result := &TokenTransfersResult{
+		Transfers: make([]*TokenTransfer, 0, len(transfers)),
+	}
+	for i, transfer := range transfers {
+		// Blocks are not split, the transfers of the last block may exceed the limit
+		if max := config.MaxResults; max > 0 && uint64(i) >= max && transfer.BlockNumber != transfers[i-1].BlockNumber {
+			next := hexutil.Uint64(transfer.BlockNumber)
+			result.Next = &next
+			break
+		}
+		result.Transfers = append(result.Transfers, &TokenTransfer{
+			Token:           transfer.Token,
+			Standard:        fmt.Sprintf("ERC-%d", transfer.Standard),
+			From:            transfer.From,
+			To:              transfer.To,
+			TokenID:         (*hexutil.Big)(transfer.TokenID),
+			Value:           (*hexutil.Big)(transfer.Value),
+			BlockNumber:     hexutil.Uint64(transfer.BlockNumber),
+			BlockHash:       transfer.BlockHash,
+			TransactionHash: transfer.TxHash,
+			LogIndex:        hexutil.Uint(transfer.LogIndex),
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,83 @@
+package arbitrum
+
+import (
+	"context"
+
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+type TxIndexRange struct {
+	From hexutil.Uint64 `json:"from"`
+	To   hexutil.Uint64 `json:"to"` // exclusive
+}
+
+type TxIndexBackfill struct {
+	From hexutil.Uint64 `json:"from"`
+	To   hexutil.Uint64 `json:"to"`   // exclusive
+	Next hexutil.Uint64 `json:"next"` // block below the lowest one indexed so far, the range is indexed downwards
+}
+
+type TxIndexCoverage struct {
+	Running   bool               `json:"running"` // whether the indexer keeping the lookup limit is running
+	Limit     hexutil.Uint64     `json:"limit"`   // number of recent blocks kept indexed (0=all)
+	Head      hexutil.Uint64     `json:"head"`
+	Tail      *hexutil.Uint64    `json:"tail"` // oldest block of the range indexed up to the head, nil if none
+	Ranges    []TxIndexRange     `json:"ranges"`
+	Backfills []*TxIndexBackfill `json:"backfills"`
+}
+
+func newTxIndexBackfill(backfill *core.TxIndexBackfill) *TxIndexBackfill {
+	return &TxIndexBackfill{
+		From: hexutil.Uint64(backfill.From),
+		To:   hexutil.Uint64(backfill.To),
+		Next: hexutil.Uint64(backfill.Next()),
+	}
+}
+
+// TxIndex reports the blocks whose transactions are indexed: the recent blocks kept by the lookup limit, and the
+// older ranges backfilled below them
+func (api *ArbDebugAPI) TxIndex() *TxIndexCoverage {
+	coverage := api.b.BlockChain().TxIndexCoverage()
+	result := &TxIndexCoverage{
+		Running:   coverage.Running,
+		Limit:     hexutil.Uint64(coverage.Limit),
+		Head:      hexutil.Uint64(coverage.Head),
+		Tail:      (*hexutil.Uint64)(coverage.Tail),
+		Ranges:    make([]TxIndexRange, 0, len(coverage.Ranges)),
+		Backfills: make([]*TxIndexBackfill, 0, len(coverage.Backfills)),
+	}
+	for _, r := range coverage.Ranges {
+		result.Ranges = append(result.Ranges, TxIndexRange{From: hexutil.Uint64(r.From), To: hexutil.Uint64(r.To)})
+	}
+	for _, backfill := range coverage.Backfills {
+		result.Backfills = append(result.Backfills, newTxIndexBackfill(backfill))
+	}
+	return result
+}
+
+// SetTxLookupLimit changes the number of recent blocks whose transactions are kept indexed (0=all) until the next
+// restart, indexing or unindexing the blocks in the background right away
+func (api *ArbDebugAPI) SetTxLookupLimit(limit hexutil.Uint64) *TxIndexCoverage {
+	api.b.BlockChain().SetTxLookupLimit(uint64(limit))
+	return api.TxIndex()
+}
+
+// BackfillTxIndex starts indexing the transactions of the inclusive block range in the background, leaving out the
+// blocks kept indexed by the lookup limit. the range stays indexed until the lookup limit is raised over it and lowered again
+func (api *ArbDebugAPI) BackfillTxIndex(ctx context.Context, from, to rpc.BlockNumber) (*TxIndexBackfill, error) {
+	start, err := api.b.blockNumberToUint(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := api.b.blockNumberToUint(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	backfill, err := api.b.BlockChain().BackfillTxIndex(start, end+1)
+	if err != nil {
+		return nil, err
+	}
+	return newTxIndexBackfill(backfill), nil
+}
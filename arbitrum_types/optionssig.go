@@ -0,0 +1,143 @@
+package arbitrum_types
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/math"
+	"github.com/chainupcloud/arb-geth/crypto"
+)
+
+// the EIP-712 domain and types the sender signs the conditions of a transaction with, absent bounds are signed as
+// the widest ones, absent storage roots as zero, and the known accounts and slots are sorted
+const (
+	conditionsDomainName    = "ArbitrumConditionalOptions"
+	conditionsDomainVersion = "1"
+
+	conditionsDomainType = "EIP712Domain(string name,string version,uint256 chainId)"
+	knownSlotType        = "KnownSlot(bytes32 slot,bytes32 value)"
+	knownAccountType     = "KnownAccount(address account,bytes32 storageRoot,KnownSlot[] slots)" + knownSlotType
+	conditionsType       = "ConditionalOptions(bytes32 txHash,KnownAccount[] knownAccounts,uint64 blockNumberMin,uint64 blockNumberMax,uint64 timestampMin,uint64 timestampMax)" + knownAccountType
+)
+
+var (
+	conditionsDomainTypeHash = crypto.Keccak256Hash([]byte(conditionsDomainType))
+	knownSlotTypeHash        = crypto.Keccak256Hash([]byte(knownSlotType))
+	knownAccountTypeHash     = crypto.Keccak256Hash([]byte(knownAccountType))
+	conditionsTypeHash       = crypto.Keccak256Hash([]byte(conditionsType))
+)
+
+var (
+	ErrConditionsNotSigned       = errors.New("conditional options not signed")
+	ErrInvalidConditionSignature = errors.New("invalid conditional options signature")
+)
+
+// SigningHash returns the EIP-712 hash binding the conditions to the transaction, which its sender signs
+func (o *ConditionalOptions) SigningHash(chainID *big.Int, txHash common.Hash) common.Hash {
+	domain := crypto.Keccak256(
+		conditionsDomainTypeHash[:],
+		crypto.Keccak256([]byte(conditionsDomainName)),
+		crypto.Keccak256([]byte(conditionsDomainVersion)),
+		math.U256Bytes(new(big.Int).Set(chainID)),
+	)
+	return crypto.Keccak256Hash([]byte("\x19\x01"), domain, o.structHash(txHash))
+}
+
+func (o *ConditionalOptions) structHash(txHash common.Hash) []byte {
+	addresses := make([]common.Address, 0, len(o.KnownAccounts))
+	for address := range o.KnownAccounts {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return bytes.Compare(addresses[i][:], addresses[j][:]) < 0 })
+
+	var accounts []byte
+	for _, address := range addresses {
+		known := o.KnownAccounts[address]
+		var root common.Hash
+		if known.RootHash != nil {
+			root = *known.RootHash
+		}
+		slots := make([]common.Hash, 0, len(known.SlotValue))
+		for slot := range known.SlotValue {
+			slots = append(slots, slot)
+		}
+		sort.Slice(slots, func(i, j int) bool { return bytes.Compare(slots[i][:], slots[j][:]) < 0 })
+		var slotHashes []byte
+		for _, slot := range slots {
+			value := known.SlotValue[slot]
+			slotHashes = append(slotHashes, crypto.Keccak256(knownSlotTypeHash[:], slot[:], value[:])...)
+		}
+		accounts = append(accounts, crypto.Keccak256(
+			knownAccountTypeHash[:],
+			common.LeftPadBytes(address[:], 32),
+			root[:],
+			crypto.Keccak256(slotHashes),
+		)...)
+	}
+	return crypto.Keccak256(
+		conditionsTypeHash[:],
+		txHash[:],
+		crypto.Keccak256(accounts),
+		encodeBound(o.BlockNumberMin, 0),
+		encodeBound(o.BlockNumberMax, ^uint64(0)),
+		encodeBound(o.TimestampMin, 0),
+		encodeBound(o.TimestampMax, ^uint64(0)),
+	)
+}
+
+func encodeBound(bound *math.HexOrDecimal64, absent uint64) []byte {
+	value := absent
+	if bound != nil {
+		value = uint64(*bound)
+	}
+	return math.U256Bytes(new(big.Int).SetUint64(value))
+}
+
+// Sign signs the conditions as bound to the transaction with the key of its sender
+func (o *ConditionalOptions) Sign(chainID *big.Int, txHash common.Hash, key *ecdsa.PrivateKey) error {
+	hash := o.SigningHash(chainID, txHash)
+	sig, err := crypto.Sign(hash[:], key)
+	if err != nil {
+		return err
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	o.Signature = sig
+	return nil
+}
+
+// Signer recovers the address that signed the conditions as bound to the transaction
+func (o *ConditionalOptions) Signer(chainID *big.Int, txHash common.Hash) (common.Address, error) {
+	if o.Signature == nil {
+		return common.Address{}, ErrConditionsNotSigned
+	}
+	if len(o.Signature) != crypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("%w: length %d", ErrInvalidConditionSignature, len(o.Signature))
+	}
+	sig := common.CopyBytes(o.Signature)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	hash := o.SigningHash(chainID, txHash)
+	pubkey, err := crypto.SigToPub(hash[:], sig)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("%w: %v", ErrInvalidConditionSignature, err)
+	}
+	return crypto.PubkeyToAddress(*pubkey), nil
+}
+
+// VerifySignature checks that the sender of the transaction signed the conditions as bound to it
+func (o *ConditionalOptions) VerifySignature(chainID *big.Int, txHash common.Hash, sender common.Address) error {
+	signer, err := o.Signer(chainID, txHash)
+	if err != nil {
+		return err
+	}
+	if signer != sender {
+		return fmt.Errorf("%w: signed by %v, transaction sent by %v", ErrInvalidConditionSignature, signer, sender)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package arbitrum_types
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/math"
+	"github.com/chainupcloud/arb-geth/crypto"
+)
+
+func testConditions() *ConditionalOptions {
+	root := common.Hash{0x01}
+	minBlock, maxTimestamp := math.HexOrDecimal64(10), math.HexOrDecimal64(2000)
+	return &ConditionalOptions{
+		KnownAccounts: map[common.Address]RootHashOrSlots{
+			{0x0a}: {RootHash: &root},
+			{0x0b}: {SlotValue: map[common.Hash]common.Hash{{0x02}: {0x03}, {0x04}: {0x05}}},
+		},
+		BlockNumberMin: &minBlock,
+		TimestampMax:   &maxTimestamp,
+	}
+}
+
+func TestConditionsSignature(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	var (
+		sender  = crypto.PubkeyToAddress(key.PublicKey)
+		chainID = big.NewInt(42161)
+		txHash  = common.Hash{0xaa}
+	)
+	signed := testConditions()
+	if err := signed.VerifySignature(chainID, txHash, sender); !errors.Is(err, ErrConditionsNotSigned) {
+		t.Fatalf("unsigned conditions: have %v, want %v", err, ErrConditionsNotSigned)
+	}
+	if err := signed.Sign(chainID, txHash, key); err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	if err := signed.VerifySignature(chainID, txHash, sender); err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	// The signature survives the JSON encoding the conditions are submitted in
+	data, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	decoded := new(ConditionalOptions)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if err := decoded.VerifySignature(chainID, txHash, sender); err != nil {
+		t.Fatalf("failed to verify decoded conditions: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(o *ConditionalOptions)
+		chainID *big.Int
+		txHash  common.Hash
+		sender  common.Address
+	}{
+		{"block bound", func(o *ConditionalOptions) { maxBlock := math.HexOrDecimal64(20); o.BlockNumberMax = &maxBlock }, chainID, txHash, sender},
+		{"removed bound", func(o *ConditionalOptions) { o.TimestampMax = nil }, chainID, txHash, sender},
+		{"storage root", func(o *ConditionalOptions) {
+			root := common.Hash{0x09}
+			o.KnownAccounts[common.Address{0x0a}] = RootHashOrSlots{RootHash: &root}
+		}, chainID, txHash, sender},
+		{"slot value", func(o *ConditionalOptions) {
+			o.KnownAccounts[common.Address{0x0b}].SlotValue[common.Hash{0x02}] = common.Hash{0x09}
+		}, chainID, txHash, sender},
+		{"removed account", func(o *ConditionalOptions) { delete(o.KnownAccounts, common.Address{0x0a}) }, chainID, txHash, sender},
+		{"wrong chain id", nil, big.NewInt(1), txHash, sender},
+		{"other transaction", nil, chainID, common.Hash{0xbb}, sender},
+		{"wrong sender", nil, chainID, txHash, crypto.PubkeyToAddress(other.PublicKey)},
+	}
+	for _, tt := range tests {
+		options := testConditions()
+		if err := options.Sign(chainID, txHash, key); err != nil {
+			t.Fatalf("%s: failed to sign: %v", tt.name, err)
+		}
+		if tt.modify != nil {
+			tt.modify(options)
+		}
+		if err := options.VerifySignature(tt.chainID, tt.txHash, tt.sender); !errors.Is(err, ErrInvalidConditionSignature) {
+			t.Errorf("%s: have %v, want %v", tt.name, err, ErrInvalidConditionSignature)
+		}
+	}
+	// Malformed signatures are rejected
+	for _, sig := range [][]byte{signed.Signature[:64], append(common.CopyBytes(signed.Signature), 0)} {
+		options := testConditions()
+		options.Signature = sig
+		if err := options.VerifySignature(chainID, txHash, sender); !errors.Is(err, ErrInvalidConditionSignature) {
+			t.Errorf("malformed signature of %d bytes: have %v, want %v", len(sig), err, ErrInvalidConditionSignature)
+		}
+	}
+}
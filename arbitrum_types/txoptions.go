@@ -3,17 +3,22 @@ package arbitrum_types
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
 	"github.com/chainupcloud/arb-geth/common/math"
 	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/core/types"
 	"github.com/chainupcloud/arb-geth/rpc"
 	"github.com/pkg/errors"
 )
 
 type rejectedError struct {
-	msg string
+	msg     string
+	failure *ConditionFailure
 }
 
 func NewRejectedError(msg string) *rejectedError {
@@ -22,6 +27,46 @@ func NewRejectedError(msg string) *rejectedError {
 func (e rejectedError) Error() string { return e.msg }
 func (rejectedError) ErrorCode() int  { return -32003 }
 
+// ErrorData returns the details of the condition that wasn't met, if any
+func (e rejectedError) ErrorData() interface{} {
+	if e.failure == nil {
+		return nil
+	}
+	return e.failure
+}
+
+func newConditionError(msg string, failure *ConditionFailure) *rejectedError {
+	return &rejectedError{msg: msg, failure: failure}
+}
+
+// ConditionFailure describes which condition of ConditionalOptions wasn't met
+type ConditionFailure struct {
+	Condition string          `json:"condition"`
+	Account   *common.Address `json:"account,omitempty"`
+	Slot      *common.Hash    `json:"slot,omitempty"`
+	Expected  string          `json:"expected,omitempty"`
+	Actual    string          `json:"actual,omitempty"`
+}
+
+const (
+	ConditionBlockNumberMin     = "blockNumberMin"
+	ConditionBlockNumberMax     = "blockNumberMax"
+	ConditionTimestampMin       = "timestampMin"
+	ConditionTimestampMax       = "timestampMax"
+	ConditionKnownAccountRoot   = "knownAccountRoot"
+	ConditionKnownAccountExists = "knownAccountExists"
+	ConditionKnownAccountSlot   = "knownAccountSlot"
+)
+
+// ConditionFailureOf returns the details of the failed condition carried by err, if any
+func ConditionFailureOf(err error) *ConditionFailure {
+	var rejected *rejectedError
+	if errors.As(err, &rejected) {
+		return rejected.failure
+	}
+	return nil
+}
+
 type limitExceededError struct {
 	msg string
 }
@@ -38,14 +83,24 @@ func WrapOptionsCheckError(err error, msg string) error {
 	}
 	switch e := err.(type) {
 	case *rejectedError:
-		return NewRejectedError(wrappedMsg(e, msg))
+		return newConditionError(wrappedMsg(e, msg), e.failure)
 	case *limitExceededError:
 		return NewLimitExceededError(wrappedMsg(e, msg))
+	case *invalidOptionsError:
+		return &invalidOptionsError{wrappedMsg(e, msg)}
 	default:
 		return errors.Wrap(err, msg)
 	}
 }
 
+// invalidOptionsError is returned for inconsistent options, which no block can meet
+type invalidOptionsError struct {
+	msg string
+}
+
+func (e invalidOptionsError) Error() string { return e.msg }
+func (invalidOptionsError) ErrorCode() int  { return -32602 }
+
 type RootHashOrSlots struct {
 	RootHash  *common.Hash
 	SlotValue map[common.Hash]common.Hash
@@ -74,41 +129,113 @@ type ConditionalOptions struct {
 	BlockNumberMax *math.HexOrDecimal64               `json:"blockNumberMax,omitempty"`
 	TimestampMin   *math.HexOrDecimal64               `json:"timestampMin,omitempty"`
 	TimestampMax   *math.HexOrDecimal64               `json:"timestampMax,omitempty"`
+	// EIP-712 signature of the sender binding the conditions to the transaction, optional
+	Signature hexutil.Bytes `json:"signature,omitempty"`
 }
 
-func (o *ConditionalOptions) Check(l1BlockNumber uint64, l2Timestamp uint64, statedb *state.StateDB) error {
+// Validate checks that the options are consistent, i.e. that they don't have empty ranges
+func (o *ConditionalOptions) Validate() error {
+	if o.BlockNumberMin != nil && o.BlockNumberMax != nil && *o.BlockNumberMin > *o.BlockNumberMax {
+		return &invalidOptionsError{fmt.Sprintf("invalid conditional options: blockNumberMin %d is greater than blockNumberMax %d", *o.BlockNumberMin, *o.BlockNumberMax)}
+	}
+	if o.TimestampMin != nil && o.TimestampMax != nil && *o.TimestampMin > *o.TimestampMax {
+		return &invalidOptionsError{fmt.Sprintf("invalid conditional options: timestampMin %d is greater than timestampMax %d", *o.TimestampMin, *o.TimestampMax)}
+	}
+	return nil
+}
+
+// CheckBlockNumber checks the l1 block number against the block number range
+func (o *ConditionalOptions) CheckBlockNumber(l1BlockNumber uint64) error {
 	if o.BlockNumberMin != nil && l1BlockNumber < uint64(*o.BlockNumberMin) {
-		return NewRejectedError("BlockNumberMin condition not met")
+		return newConditionError("BlockNumberMin condition not met", boundFailure(ConditionBlockNumberMin, uint64(*o.BlockNumberMin), l1BlockNumber))
 	}
 	if o.BlockNumberMax != nil && l1BlockNumber > uint64(*o.BlockNumberMax) {
-		return NewRejectedError("BlockNumberMax condition not met")
+		return newConditionError("BlockNumberMax condition not met", boundFailure(ConditionBlockNumberMax, uint64(*o.BlockNumberMax), l1BlockNumber))
 	}
+	return nil
+}
+
+// CheckTimestamp checks the l2 timestamp against the timestamp range
+func (o *ConditionalOptions) CheckTimestamp(l2Timestamp uint64) error {
 	if o.TimestampMin != nil && l2Timestamp < uint64(*o.TimestampMin) {
-		return NewRejectedError("TimestampMin condition not met")
+		return newConditionError("TimestampMin condition not met", boundFailure(ConditionTimestampMin, uint64(*o.TimestampMin), l2Timestamp))
 	}
 	if o.TimestampMax != nil && l2Timestamp > uint64(*o.TimestampMax) {
-		return NewRejectedError("TimestampMax condition not met")
+		return newConditionError("TimestampMax condition not met", boundFailure(ConditionTimestampMax, uint64(*o.TimestampMax), l2Timestamp))
 	}
+	return nil
+}
+
+// CheckKnownAccounts checks the storage roots and slot values of the known accounts against the state
+func (o *ConditionalOptions) CheckKnownAccounts(statedb *state.StateDB) error {
 	for address, rootHashOrSlots := range o.KnownAccounts {
+		address := address
 		if rootHashOrSlots.RootHash != nil {
 			trie, err := statedb.StorageTrie(address)
 			if err != nil {
 				return err
 			}
 			if trie == nil {
-				return NewRejectedError("Storage trie not found for address key in knownAccounts option")
+				return newConditionError("Storage trie not found for address key in knownAccounts option", &ConditionFailure{
+					Condition: ConditionKnownAccountExists,
+					Account:   &address,
+				})
 			}
-			if trie.Hash() != *rootHashOrSlots.RootHash {
-				return NewRejectedError("Storage root hash condition not met")
+			if root := trie.Hash(); root != *rootHashOrSlots.RootHash {
+				return newConditionError("Storage root hash condition not met", &ConditionFailure{
+					Condition: ConditionKnownAccountRoot,
+					Account:   &address,
+					Expected:  rootHashOrSlots.RootHash.Hex(),
+					Actual:    root.Hex(),
+				})
 			}
 		} else if len(rootHashOrSlots.SlotValue) > 0 {
 			for slot, value := range rootHashOrSlots.SlotValue {
+				slot := slot
 				stored := statedb.GetState(address, slot)
 				if !bytes.Equal(stored.Bytes(), value.Bytes()) {
-					return NewRejectedError("Storage slot value condition not met")
+					return newConditionError("Storage slot value condition not met", &ConditionFailure{
+						Condition: ConditionKnownAccountSlot,
+						Account:   &address,
+						Slot:      &slot,
+						Expected:  value.Hex(),
+						Actual:    stored.Hex(),
+					})
 				}
 			}
 		} // else rootHashOrSlots.SlotValue is empty - ignore it and check the rest of conditions
 	}
 	return nil
 }
+
+func (o *ConditionalOptions) Check(l1BlockNumber uint64, l2Timestamp uint64, statedb *state.StateDB) error {
+	if err := o.CheckBlockNumber(l1BlockNumber); err != nil {
+		return err
+	}
+	if err := o.CheckTimestamp(l2Timestamp); err != nil {
+		return err
+	}
+	return o.CheckKnownAccounts(statedb)
+}
+
+// CheckConditions validates the options and checks them against the state and header of a block,
+// taking the l1 block number from the header's extra information and the l2 timestamp from its time.
+// Nil options are always met.
+func CheckConditions(statedb *state.StateDB, header *types.Header, options *ConditionalOptions) error {
+	if options == nil {
+		return nil
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	l1BlockNumber := types.DeserializeHeaderExtraInformation(header).L1BlockNumber
+	return options.Check(l1BlockNumber, header.Time, statedb)
+}
+
+func boundFailure(condition string, bound uint64, actual uint64) *ConditionFailure {
+	return &ConditionFailure{
+		Condition: condition,
+		Expected:  strconv.FormatUint(bound, 10),
+		Actual:    strconv.FormatUint(actual, 10),
+	}
+}
@@ -0,0 +1,106 @@
+package arbitrum_types
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/math"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+func bound(n uint64) *math.HexOrDecimal64 {
+	b := math.HexOrDecimal64(n)
+	return &b
+}
+
+func TestConditionsCheck(t *testing.T) {
+	var (
+		contract = common.Address{0x0a}
+		missing  = common.Address{0x0b}
+		slot     = common.Hash{0x01}
+		value    = common.Hash{0x02}
+	)
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.SetState(contract, slot, value)
+	root, _ := statedb.Commit(false)
+	statedb, _ = state.New(root, statedb.Database(), nil)
+	tr, err := statedb.StorageTrie(contract)
+	if err != nil {
+		t.Fatalf("failed to open storage trie: %v", err)
+	}
+	storageRoot, wrongRoot := tr.Hash(), common.Hash{0xff}
+
+	tests := []struct {
+		name      string
+		options   ConditionalOptions
+		condition string // Condition failing, none if empty
+	}{
+		{"block number in range", ConditionalOptions{BlockNumberMin: bound(100), BlockNumberMax: bound(100)}, ""},
+		{"block number too low", ConditionalOptions{BlockNumberMin: bound(101)}, ConditionBlockNumberMin},
+		{"block number too high", ConditionalOptions{BlockNumberMax: bound(99)}, ConditionBlockNumberMax},
+		{"timestamp in range", ConditionalOptions{TimestampMin: bound(1000), TimestampMax: bound(1000)}, ""},
+		{"timestamp too low", ConditionalOptions{TimestampMin: bound(1001)}, ConditionTimestampMin},
+		{"timestamp too high", ConditionalOptions{TimestampMax: bound(999)}, ConditionTimestampMax},
+		{"storage root met", ConditionalOptions{KnownAccounts: map[common.Address]RootHashOrSlots{contract: {RootHash: &storageRoot}}}, ""},
+		{"storage root not met", ConditionalOptions{KnownAccounts: map[common.Address]RootHashOrSlots{contract: {RootHash: &wrongRoot}}}, ConditionKnownAccountRoot},
+		{"account missing", ConditionalOptions{KnownAccounts: map[common.Address]RootHashOrSlots{missing: {RootHash: &storageRoot}}}, ConditionKnownAccountExists},
+		{"storage slot met", ConditionalOptions{KnownAccounts: map[common.Address]RootHashOrSlots{contract: {SlotValue: map[common.Hash]common.Hash{slot: value}}}}, ""},
+		{"storage slot not met", ConditionalOptions{KnownAccounts: map[common.Address]RootHashOrSlots{contract: {SlotValue: map[common.Hash]common.Hash{slot: {}}}}}, ConditionKnownAccountSlot},
+		{"empty slots ignored", ConditionalOptions{KnownAccounts: map[common.Address]RootHashOrSlots{missing: {}}}, ""},
+	}
+	for _, tt := range tests {
+		err := tt.options.Check(100, 1000, statedb)
+		if tt.condition == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		var rpcErr rpc.Error
+		if !errors.As(err, &rpcErr) || rpcErr.ErrorCode() != -32003 {
+			t.Errorf("%s: have error %v, want a rejection", tt.name, err)
+			continue
+		}
+		if failure := ConditionFailureOf(err); failure == nil || failure.Condition != tt.condition {
+			t.Errorf("%s: have failure %+v, want condition %s", tt.name, failure, tt.condition)
+		}
+		// The wrapping of the sequencer keeps the code and the details
+		wrapped := WrapOptionsCheckError(err, "sequencer")
+		if !errors.As(wrapped, &rpcErr) || rpcErr.ErrorCode() != -32003 || ConditionFailureOf(wrapped) == nil {
+			t.Errorf("%s: wrapped error %v lost its code or details", tt.name, wrapped)
+		}
+	}
+}
+
+func TestConditionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ConditionalOptions
+		valid   bool
+	}{
+		{"empty", ConditionalOptions{}, true},
+		{"single block", ConditionalOptions{BlockNumberMin: bound(5), BlockNumberMax: bound(5)}, true},
+		{"empty block range", ConditionalOptions{BlockNumberMin: bound(6), BlockNumberMax: bound(5)}, false},
+		{"empty timestamp range", ConditionalOptions{TimestampMin: bound(6), TimestampMax: bound(5)}, false},
+	}
+	for _, tt := range tests {
+		err := tt.options.Validate()
+		if tt.valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		var rpcErr rpc.Error
+		if !errors.As(err, &rpcErr) || rpcErr.ErrorCode() != -32602 {
+			t.Errorf("%s: have error %v, want invalid params", tt.name, err)
+		}
+		if !errors.As(WrapOptionsCheckError(err, "sequencer"), &rpcErr) || rpcErr.ErrorCode() != -32602 {
+			t.Errorf("%s: wrapped error lost its code", tt.name)
+		}
+	}
+}
@@ -17,10 +17,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"sync/atomic"
@@ -35,6 +37,7 @@ import (
 	"github.com/chainupcloud/arb-geth/core/types"
 	"github.com/chainupcloud/arb-geth/crypto"
 	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/internal/era"
 	"github.com/chainupcloud/arb-geth/internal/flags"
 	"github.com/chainupcloud/arb-geth/log"
 	"github.com/chainupcloud/arb-geth/metrics"
@@ -117,6 +120,36 @@ Optional second and third arguments control the first and
 last block to write. In this mode, the file will be appended
 if already existing. If the file ends with .gz, the output will
 be gzipped.`,
+	}
+	importHistoryCommand = &cli.Command{
+		Action:    importHistory,
+		Name:      "import-history",
+		Usage:     "Import chain history from era files",
+		ArgsUsage: "<dir> [<checksums file>]",
+		Flags: flags.Merge([]cli.Flag{
+			utils.CacheFlag,
+			utils.SyncModeFlag,
+			utils.TxLookupLimitFlag,
+		}, utils.DatabasePathFlags),
+		Description: `
+The import-history command imports blocks and receipts from the era files in the
+given directory. Every file is checked to be internally consistent. Files whose
+accumulator is listed in the optional checksums file are trusted and imported
+without executing their blocks, other files are imported with full verification.`,
+	}
+	exportHistoryCommand = &cli.Command{
+		Action:    exportHistory,
+		Name:      "export-history",
+		Usage:     "Export chain history into era files",
+		ArgsUsage: "<dir> <blockNumFirst> <blockNumLast>",
+		Flags: flags.Merge([]cli.Flag{
+			utils.CacheFlag,
+			utils.SyncModeFlag,
+		}, utils.DatabasePathFlags),
+		Description: `
+The export-history command writes the blocks, receipts and total difficulties of
+the given range into era files of up to 8192 blocks each, along with a
+checksums.txt file listing the accumulator root of every file.`,
 	}
 	importPreimagesCommand = &cli.Command{
 		Action:    importPreimages,
@@ -162,6 +195,28 @@ It's deprecated, please use "geth db export" instead.
 		}, utils.DatabasePathFlags),
 		Description: `
 This command dumps out the state for a given block (or latest, if none provided).
+`,
+	}
+	dumpTablesCommand = &cli.Command{
+		Action:    dumpTables,
+		Name:      "dumptables",
+		Usage:     "Dump the state of a specific block into SQLite or CSV tables",
+		ArgsUsage: "[? <blockHash> | <blockNum>]",
+		Flags: flags.Merge([]cli.Flag{
+			utils.CacheFlag,
+			utils.ExcludeCodeFlag,
+			utils.ExcludeStorageFlag,
+			utils.DumpDirFlag,
+			utils.DumpFormatFlag,
+			utils.DumpWorkersFlag,
+		}, utils.DatabasePathFlags),
+		Description: `
+This command dumps the state for a given block (or latest, if none provided) into
+tables of the accounts, storage slots and contract codes, traversing ranges of the
+state in parallel. The tables are written in the given directory, either into a
+state.sqlite database (the default), or into CSV files along with a schema.sql
+file describing them. The progress is saved regularly, running the command again
+on the same directory resumes an interrupted dump.
 `,
 	}
 )
@@ -362,6 +417,61 @@ func exportChain(ctx *cli.Context) error {
 	return nil
 }
 
+// historyNetwork returns the network name of the era files of the chain.
+func historyNetwork(chain *core.BlockChain) string {
+	return fmt.Sprintf("chain%d", chain.Config().ChainID)
+}
+
+func exportHistory(ctx *cli.Context) error {
+	if ctx.Args().Len() != 3 {
+		utils.Fatalf("Arguments required: <dir> <blockNumFirst> <blockNumLast>")
+	}
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	chain, _ := utils.MakeChain(ctx, stack, true)
+	start := time.Now()
+
+	first, ferr := strconv.ParseUint(ctx.Args().Get(1), 10, 64)
+	last, lerr := strconv.ParseUint(ctx.Args().Get(2), 10, 64)
+	if ferr != nil || lerr != nil {
+		utils.Fatalf("Export error in parsing parameters: block number not an integer\n")
+	}
+	if first > last {
+		utils.Fatalf("Export error: first block %d larger than last block %d\n", first, last)
+	}
+	if err := era.Export(chain, ctx.Args().First(), historyNetwork(chain), first, last, era.MaxSize); err != nil {
+		utils.Fatalf("Export error: %v\n", err)
+	}
+	fmt.Printf("Export done in %v\n", time.Since(start))
+	return nil
+}
+
+func importHistory(ctx *cli.Context) error {
+	if ctx.Args().Len() < 1 {
+		utils.Fatalf("This command requires an argument.")
+	}
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	chain, _ := utils.MakeChain(ctx, stack, false)
+	defer chain.Stop()
+	start := time.Now()
+
+	var trusted []common.Hash
+	if ctx.Args().Len() > 1 {
+		var err error
+		if trusted, err = era.ReadChecksums(ctx.Args().Get(1)); err != nil {
+			utils.Fatalf("Failed to read checksums: %v", err)
+		}
+	}
+	if err := era.Import(chain, ctx.Args().First(), historyNetwork(chain), trusted); err != nil {
+		utils.Fatalf("Import error: %v\n", err)
+	}
+	fmt.Printf("Import done in %v\n", time.Since(start))
+	return nil
+}
+
 // importPreimages imports preimage data from the specified file.
 func importPreimages(ctx *cli.Context) error {
 	if ctx.Args().Len() < 1 {
@@ -485,6 +595,61 @@ func dump(ctx *cli.Context) error {
 	return nil
 }
 
+func dumpTables(ctx *cli.Context) error {
+	dir := ctx.String(utils.DumpDirFlag.Name)
+	if dir == "" {
+		return errors.New("missing output directory, use --" + utils.DumpDirFlag.Name)
+	}
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	conf, db, root, err := parseDumpConfig(ctx, stack)
+	if err != nil {
+		return err
+	}
+	config := &trie.Config{
+		Preimages: true, // always enable preimage lookup
+	}
+	statedb, err := state.New(root, state.NewDatabaseWithConfig(db, config), nil)
+	if err != nil {
+		return err
+	}
+	var sink interface {
+		state.DumpSink
+		Progress() (*state.DumpProgress, error)
+	}
+	switch format := ctx.String(utils.DumpFormatFlag.Name); format {
+	case "sqlite":
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		db, err := state.NewSQLiteDumpSink(filepath.Join(dir, "state.sqlite"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		sink = db
+	case "csv":
+		if sink, err = state.NewCSVDumpSink(dir); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown dump format %q", format)
+	}
+	progress, err := sink.Progress()
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		log.Info("Resuming state dump", "dir", dir, "root", progress.Root)
+	}
+	return statedb.ParallelDump(context.Background(), sink, &state.ParallelDumpConfig{
+		Workers:     ctx.Int(utils.DumpWorkersFlag.Name),
+		SkipStorage: conf.SkipStorage,
+		SkipCode:    conf.SkipCode,
+	}, progress)
+}
+
 // hashish returns true for strings that look like hashes.
 func hashish(x string) bool {
 	_, err := strconv.Atoi(x)
@@ -105,6 +105,14 @@ var (
 		utils.CacheSnapshotFlag,
 		utils.CacheNoPrefetchFlag,
 		utils.CachePreimagesFlag,
+		utils.CachePreimagesSnapSyncFlag,
+		utils.CacheTrieDedupFlag,
+		utils.SnapshotHistoryFlag,
+		utils.CacheCodeFlag,
+		utils.CacheCodeMaxSizeFlag,
+		utils.CacheCodeNoAdmissionFlag,
+		utils.CacheSnapHealFlag,
+		utils.SnapHealAdaptiveFlag,
 		utils.CacheLogSizeFlag,
 		utils.FDLimitFlag,
 		utils.CryptoKZGFlag,
@@ -199,10 +207,13 @@ func init() {
 		initCommand,
 		importCommand,
 		exportCommand,
+		importHistoryCommand,
+		exportHistoryCommand,
 		importPreimagesCommand,
 		exportPreimagesCommand,
 		removedbCommand,
 		dumpCommand,
+		dumpTablesCommand,
 		dumpGenesisCommand,
 		// See accountcmd.go:
 		accountCommand,
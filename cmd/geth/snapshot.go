@@ -52,6 +52,8 @@ var (
 				Flags: flags.Merge([]cli.Flag{
 					utils.CacheTrieJournalFlag,
 					utils.BloomFilterSizeFlag,
+					utils.PruneDisputeFromFlag,
+					utils.PruneDisputeStrideFlag,
 				}, utils.NetworkFlags, utils.DatabasePathFlags),
 				Description: `
 geth snapshot prune-state <state-root>
@@ -60,7 +62,9 @@ All trie nodes and contract codes that do not belong to the specified
 version state will be deleted from the database. After pruning, only
 two version states are available: genesis and the specific one.
 
-The default pruning target is the HEAD-127 state.
+The default pruning target is the HEAD-127 state. With --prune.dispute-from, the
+states persisted for the blocks of the dispute window, from the given block up to
+the head, are kept as well.
 
 WARNING: It's necessary to delete the trie clean cache after the pruning.
 If you specify another directory for the trie clean cache via "--cache.trie.journal"
@@ -171,6 +175,11 @@ func pruneState(ctx *cli.Context) error {
 		Cachedir:  stack.ResolvePath(config.Eth.TrieCleanCacheJournal),
 		BloomSize: ctx.Uint64(utils.BloomFilterSizeFlag.Name),
 	}
+	if ctx.IsSet(utils.PruneDisputeFromFlag.Name) {
+		first := ctx.Uint64(utils.PruneDisputeFromFlag.Name)
+		prunerconfig.DisputeWindow = func() (uint64, error) { return first, nil }
+		prunerconfig.DisputeStride = ctx.Uint64(utils.PruneDisputeStrideFlag.Name)
+	}
 	pruner, err := pruner.NewPruner(chaindb, prunerconfig)
 	if err != nil {
 		log.Error("Failed to open snapshot tree", "err", err)
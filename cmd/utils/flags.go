@@ -29,6 +29,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	godebug "runtime/debug"
 	"strconv"
 	"strings"
@@ -110,6 +111,28 @@ var (
 		Usage:    "Root directory for ancient data (default = inside chaindata)",
 		Category: flags.EthCategory,
 	}
+	RemoteAncientsFlag = &cli.StringFlag{
+		Name:     "datadir.ancient.remote",
+		Usage:    "URL of a remote source of the ancient chain data missing locally, read through on demand",
+		Category: flags.EthCategory,
+	}
+	RemoteAncientsBackfillFlag = &cli.BoolFlag{
+		Name:     "datadir.ancient.remote.backfill",
+		Usage:    "Copy the ancient chain data missing locally from the remote source in the background",
+		Value:    node.DefaultConfig.RemoteAncients.Backfill,
+		Category: flags.EthCategory,
+	}
+	RemoteAncientsAllowHTTPFlag = &cli.BoolFlag{
+		Name:     "datadir.ancient.remote.allowhttp",
+		Usage:    "Accept a plain http URL for the remote source of the ancient chain data",
+		Category: flags.EthCategory,
+	}
+	RemoteAncientsReadTimeoutFlag = &cli.DurationFlag{
+		Name:     "datadir.ancient.remote.readtimeout",
+		Usage:    "Timeout of the remote fetches blocking a database read",
+		Value:    node.DefaultConfig.RemoteAncients.ReadTimeout,
+		Category: flags.EthCategory,
+	}
 	MinFreeDiskSpaceFlag = &flags.DirectoryFlag{
 		Name:     "datadir.minfreedisk",
 		Usage:    "Minimum free disk space in MB, once reached triggers auto shut down (default = --cache.gc converted to MB, 0 = disabled)",
@@ -221,6 +244,20 @@ var (
 		Usage: "Max number of elements (0 = no limit)",
 		Value: 0,
 	}
+	DumpDirFlag = &cli.StringFlag{
+		Name:  "dir",
+		Usage: "Directory to write the state tables and their progress into, an interrupted dump in it is resumed",
+	}
+	DumpFormatFlag = &cli.StringFlag{
+		Name:  "format",
+		Usage: "Format of the state tables (\"sqlite\" into a state.sqlite database, \"csv\" into one file per table and range)",
+		Value: "sqlite",
+	}
+	DumpWorkersFlag = &cli.IntFlag{
+		Name:  "workers",
+		Usage: "Number of state ranges dumped concurrently",
+		Value: runtime.NumCPU(),
+	}
 
 	defaultSyncMode = ethconfig.Defaults.SyncMode
 	SyncModeFlag    = &flags.TextMarshalerFlag{
@@ -268,6 +305,17 @@ var (
 		Value:    2048,
 		Category: flags.EthCategory,
 	}
+	PruneDisputeFromFlag = &cli.Uint64Flag{
+		Name:     "prune.dispute-from",
+		Usage:    "Number of the oldest block whose state the rollup may still need for fraud proofs, the persisted states from there on survive the pruning",
+		Category: flags.EthCategory,
+	}
+	PruneDisputeStrideFlag = &cli.Uint64Flag{
+		Name:     "prune.dispute-stride",
+		Usage:    "Keep the state of every n-th block of the dispute window (1 = every block, 0 = none)",
+		Value:    1,
+		Category: flags.EthCategory,
+	}
 	OverrideCancun = &cli.Uint64Flag{
 		Name:     "override.cancun",
 		Usage:    "Manually specify the Cancun fork timestamp, overriding the bundled setting",
@@ -444,6 +492,46 @@ var (
 		Usage:    "Enable recording the SHA3/keccak preimages of trie keys",
 		Category: flags.PerfCategory,
 	}
+	CachePreimagesSnapSyncFlag = &cli.BoolFlag{
+		Name:     "cache.preimages.snapsync",
+		Usage:    "Record the preimages of the account and storage keys seen in the blocks imported by snap sync (requires --cache.preimages)",
+		Category: flags.PerfCategory,
+	}
+	CacheTrieDedupFlag = &cli.BoolFlag{
+		Name:     "cache.trie.dedup",
+		Usage:    "Skip writing the storage trie nodes already persisted, sharing the identical subtries of cloned contracts",
+		Category: flags.PerfCategory,
+	}
+	SnapshotHistoryFlag = &cli.IntFlag{
+		Name:     "snapshot.history",
+		Usage:    "Number of blocks below the snapshot disk layer whose state is kept recoverable from reverse diffs (0 = disabled)",
+		Category: flags.PerfCategory,
+	}
+	CacheCodeFlag = &cli.IntFlag{
+		Name:     "cache.code",
+		Usage:    "Megabytes of memory allocated to caching contract code (0 = 64)",
+		Category: flags.PerfCategory,
+	}
+	CacheCodeMaxSizeFlag = &cli.IntFlag{
+		Name:     "cache.code.maxsize",
+		Usage:    "Size in bytes of the largest contract code cached (0 = no limit)",
+		Category: flags.PerfCategory,
+	}
+	CacheCodeNoAdmissionFlag = &cli.BoolFlag{
+		Name:     "cache.code.noadmission",
+		Usage:    "Cache every contract code read, rather than only those read more often than the codes they'd evict",
+		Category: flags.PerfCategory,
+	}
+	CacheSnapHealFlag = &cli.IntFlag{
+		Name:     "cache.snapheal",
+		Usage:    "Megabytes of memory allocated to the state healed by snap sync before it's committed, spilled to disk beyond (0 = unbounded)",
+		Category: flags.PerfCategory,
+	}
+	SnapHealAdaptiveFlag = &cli.BoolFlag{
+		Name:     "snapshot.adaptiveheal",
+		Usage:    "Size the trie node requests of snap sync healing after the measured throughput and latency of every peer",
+		Category: flags.EthCategory,
+	}
 	CacheLogSizeFlag = &cli.IntFlag{
 		Name:     "cache.blocklogs",
 		Usage:    "Size (in number of blocks) of the log cache for filtering",
@@ -942,6 +1030,10 @@ var (
 	DatabasePathFlags = []cli.Flag{
 		DataDirFlag,
 		AncientFlag,
+		RemoteAncientsFlag,
+		RemoteAncientsBackfillFlag,
+		RemoteAncientsAllowHTTPFlag,
+		RemoteAncientsReadTimeoutFlag,
 		RemoteDBFlag,
 		HttpHeaderFlag,
 	}
@@ -1436,6 +1528,18 @@ func SetNodeConfig(ctx *cli.Context, cfg *node.Config) {
 		log.Info(fmt.Sprintf("Using %s as db engine", dbEngine))
 		cfg.DBEngine = dbEngine
 	}
+	if ctx.IsSet(RemoteAncientsFlag.Name) {
+		cfg.RemoteAncients.URL = ctx.String(RemoteAncientsFlag.Name)
+	}
+	if ctx.IsSet(RemoteAncientsBackfillFlag.Name) {
+		cfg.RemoteAncients.Backfill = ctx.Bool(RemoteAncientsBackfillFlag.Name)
+	}
+	if ctx.IsSet(RemoteAncientsAllowHTTPFlag.Name) {
+		cfg.RemoteAncients.AllowHTTP = ctx.Bool(RemoteAncientsAllowHTTPFlag.Name)
+	}
+	if ctx.IsSet(RemoteAncientsReadTimeoutFlag.Name) {
+		cfg.RemoteAncients.ReadTimeout = ctx.Duration(RemoteAncientsReadTimeoutFlag.Name)
+	}
 }
 
 func setSmartCard(ctx *cli.Context, cfg *node.Config) {
@@ -1692,6 +1796,30 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *ethconfig.Config) {
 		cfg.Preimages = true
 		log.Info("Enabling recording of key preimages since archive mode is used")
 	}
+	if ctx.IsSet(CachePreimagesSnapSyncFlag.Name) {
+		cfg.SnapSyncPreimages = ctx.Bool(CachePreimagesSnapSyncFlag.Name)
+	}
+	if ctx.IsSet(CacheTrieDedupFlag.Name) {
+		cfg.TrieDedup = ctx.Bool(CacheTrieDedupFlag.Name)
+	}
+	if ctx.IsSet(SnapshotHistoryFlag.Name) {
+		cfg.SnapshotHistory = ctx.Int(SnapshotHistoryFlag.Name)
+	}
+	if ctx.IsSet(CacheCodeFlag.Name) {
+		cfg.CodeCache = ctx.Int(CacheCodeFlag.Name)
+	}
+	if ctx.IsSet(CacheCodeMaxSizeFlag.Name) {
+		cfg.CodeCacheMaxCodeSize = ctx.Int(CacheCodeMaxSizeFlag.Name)
+	}
+	if ctx.IsSet(CacheCodeNoAdmissionFlag.Name) {
+		cfg.CodeCacheNoAdmission = ctx.Bool(CacheCodeNoAdmissionFlag.Name)
+	}
+	if ctx.IsSet(CacheSnapHealFlag.Name) {
+		cfg.SnapHealMemory = ctx.Int(CacheSnapHealFlag.Name)
+	}
+	if ctx.IsSet(SnapHealAdaptiveFlag.Name) {
+		cfg.SnapHealAdaptive = ctx.Bool(SnapHealAdaptiveFlag.Name)
+	}
 	if ctx.IsSet(TxLookupLimitFlag.Name) {
 		cfg.TxLookupLimit = ctx.Uint64(TxLookupLimitFlag.Name)
 	}
@@ -18,6 +18,7 @@ package core
 
 import (
 	"context"
+	"math/big"
 
 	"github.com/chainupcloud/arb-geth/common"
 	"github.com/chainupcloud/arb-geth/core/state"
@@ -45,9 +46,15 @@ var InterceptRPCMessage = func(
 // Gets ArbOS's maximum intended gas per second
 var GetArbOSSpeedLimitPerSecond func(statedb *state.StateDB) (uint64, error)
 
+// Gets ArbOS's current estimate of the L1 base fee, in wei per L1 gas unit
+var GetArbOSL1PricePerUnit func(statedb *state.StateDB) (*big.Int, error)
+
 // Allows ArbOS to update the gas cap so that it ignores the message's specific L1 poster costs.
 var InterceptRPCGasCap = func(gascap *uint64, msg *Message, header *types.Header, statedb *state.StateDB) {}
 
+// Overrides the ArbOS version stored in the state of an RPC call, so the call follows that version's rules
+var OverrideArbOSVersion func(statedb *state.StateDB, version uint64) error
+
 // Renders a solidity error in human-readable form
 var RenderRPCError func(data []byte) error
 
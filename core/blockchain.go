@@ -18,6 +18,7 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -128,21 +129,37 @@ const (
 // CacheConfig contains the configuration values for the trie database
 // that's resident in a blockchain.
 type CacheConfig struct {
-	TrieCleanLimit      int           // Memory allowance (MB) to use for caching trie nodes in memory
-	TrieCleanJournal    string        // Disk journal for saving clean cache entries.
-	TrieCleanRejournal  time.Duration // Time interval to dump clean cache to disk periodically
-	TrieCleanNoPrefetch bool          // Whether to disable heuristic state prefetching for followup blocks
-	TrieDirtyLimit      int           // Memory limit (MB) at which to start flushing dirty trie nodes to disk
-	TrieDirtyDisabled   bool          // Whether to disable trie write caching and GC altogether (archive node)
-	TrieTimeLimit       time.Duration // Time limit after which to flush the current in-memory trie to disk
-	SnapshotLimit       int           // Memory allowance (MB) to use for caching snapshot entries in memory
-	Preimages           bool          // Whether to store preimage of trie key to the disk
+	TrieCleanLimit      int                  // Memory allowance (MB) to use for caching trie nodes in memory
+	TrieCleanJournal    string               // Disk journal for saving clean cache entries.
+	TrieCleanRejournal  time.Duration        // Time interval to dump clean cache to disk periodically
+	TrieCleanNoPrefetch bool                 // Whether to disable heuristic state prefetching for followup blocks
+	TrieDirtyLimit      int                  // Memory limit (MB) at which to start flushing dirty trie nodes to disk
+	TrieDirtyDisabled   bool                 // Whether to disable trie write caching and GC altogether (archive node)
+	TrieTimeLimit       time.Duration        // Time limit after which to flush the current in-memory trie to disk
+	SnapshotLimit       int                  // Memory allowance (MB) to use for caching snapshot entries in memory
+	Preimages           bool                 // Whether to store preimage of trie key to the disk
+	PreimageBackend     trie.PreimageBackend // Store the preimages are written to instead of the chain database, if set
+	TrieDedup           bool                 // Whether to skip writing the storage trie nodes already persisted
+	TrieCommitWorkers   int                  // Number of goroutines committing storage tries in parallel with the rest of the commit (0 or 1 = sequential commit)
+
+	CodeCacheLimit       int  // Memory allowance (MB) to use for caching contract code (0 = 64)
+	CodeCacheMaxCodeSize int  // Largest contract code (bytes) cached (0 = no limit)
+	CodeCacheNoAdmission bool // Whether to cache every code read rather than only those read more often than the ones they'd evict
 
 	SnapshotRestoreMaxGas uint64 // Rollback up to this much gas to restore snapshot (otherwise snapshot recalculated from nothing)
 
+	// Arbitrum: reorgs can go deeper than the default 128 snapshot diff layers
+	SnapshotDiffLayers  int // Number of snapshot diff layers kept in memory (0 = 128)
+	SnapshotSpillLayers int // Number of snapshot layers flattened onto disk kept revertible, one per block, which is the state history length (0 = disabled)
+
 	// Arbitrum: configure GC window
-	TriesInMemory uint64        // Height difference before which a trie may not be garbage-collected
-	TrieRetention time.Duration // Time limit before which a trie may not be garbage-collected
+	TriesInMemory  uint64          // Height difference before which a trie may not be garbage-collected
+	TrieRetention  time.Duration   // Time limit before which a trie may not be garbage-collected
+	StateRetention RetentionPolicy // States surviving the garbage collection, adjustable at runtime
+
+	// Sparse archive: persist the state of every N-th block as soon as it's
+	// written, bounding the depth of the state recreation (0 = disabled)
+	SparseArchiveStride uint64
 
 	MaxNumberOfBlocksToSkipStateSaving uint32
 	MaxAmountOfGasToSkipStateSaving    uint64
@@ -151,6 +168,19 @@ type CacheConfig struct {
 	SnapshotWait    bool // Wait for snapshot construction on startup. TODO(karalabe): This is a dirty hack for testing, nuke it
 }
 
+// codeCacheConfig returns the configuration of the contract code cache.
+func (c *CacheConfig) codeCacheConfig() state.CodeCacheConfig {
+	config := state.DefaultCodeCacheConfig
+	if c.CodeCacheLimit > 0 {
+		config.Size = uint64(c.CodeCacheLimit) * 1024 * 1024
+	}
+	if c.CodeCacheMaxCodeSize > 0 {
+		config.MaxCodeSize = uint64(c.CodeCacheMaxCodeSize)
+	}
+	config.NoAdmission = c.CodeCacheNoAdmission
+	return config
+}
+
 // defaultCacheConfig are the default caching values if none are specified by the
 // user (also used during testing).
 var defaultCacheConfig = &CacheConfig{
@@ -189,6 +219,8 @@ type BlockChain struct {
 	db            ethdb.Database                   // Low level persistent database to store final content in
 	snaps         *snapshot.Tree                   // Snapshot tree for fast trie leaf access
 	triegc        *prque.Prque[int64, trieGcEntry] // Priority queue mapping block numbers to tries to gc
+	retention     retentionState                   // States to keep beyond the garbage collection window
+	retentionLock sync.RWMutex                     // Protects the retention state
 	gcproc        time.Duration                    // Accumulates canonical block processing for trie dumping
 	lastWrite     uint64                           // Last block when the state was flushed
 	flushInterval atomic.Int64                     // Time interval (processing time) after which to flush a state
@@ -200,7 +232,11 @@ type BlockChain struct {
 	//  * 0:   means no limit and regenerate any missing indexes
 	//  * N:   means N block limit [HEAD-N+1, HEAD] and delete extra indexes
 	//  * nil: disable tx reindexer/deleter, but still index new blocks
-	txLookupLimit uint64
+	txLookupLimit atomic.Uint64
+
+	txIndexKick      chan struct{}                 // Notifies the tx indexer of a changed lookup limit, nil if not running
+	txIndexLock      sync.Mutex                    // Protects the tx index ranges and backfills
+	txIndexBackfills map[*TxIndexBackfill]struct{} // Backfills of tx index ranges in progress
 
 	hc            *HeaderChain
 	rmLogsFeed    event.Feed
@@ -209,9 +245,16 @@ type BlockChain struct {
 	chainHeadFeed event.Feed
 	logsFeed      event.Feed
 	blockProcFeed event.Feed
+	firehoseFeed  event.Feed
+	paramsFeed    event.Feed
+	writeFeed     event.Feed
+	rootListeners stateRootListeners
+	pressureFeed  event.Feed
 	scope         event.SubscriptionScope
 	genesisBlock  *types.Block
 
+	paramsSchedule atomic.Pointer[chainParamsSchedule] // Chain configs following the runtime chain parameter updates
+
 	// This mutex synchronizes chain write operations.
 	// Readers don't need to take it, they can just read the database.
 	chainmu *syncx.ClosableMutex
@@ -221,6 +264,18 @@ type BlockChain struct {
 	currentFinalBlock atomic.Pointer[types.Header] // Latest (consensus) finalized block
 	currentSafeBlock  atomic.Pointer[types.Header] // Latest (consensus) safe block
 
+	flushPressure atomic.Pointer[FlushPressure] // Flush pressure as of the last block written
+
+	l1FinalizedHead atomic.Pointer[rawdb.L1ConfirmedHead] // L1 confirmation of the finalized block, if set by it
+	l1SafeHead      atomic.Pointer[rawdb.L1ConfirmedHead] // L1 confirmation of the safe block, if set by it
+
+	statePinLock sync.Mutex // Lock serializing the updates of the pinned states
+
+	codeIndexing atomic.Bool // Whether the accounts deploying code are indexed by code hash
+
+	transferIndexing  atomic.Bool   // Whether the token transfers are indexed by holder and token
+	transferRetention atomic.Uint64 // Number of recent blocks whose token transfers are kept (0 = all)
+
 	bodyCache     *lru.Cache[common.Hash, *types.Body]
 	bodyRLPCache  *lru.Cache[common.Hash, rlp.RawValue]
 	receiptsCache *lru.Cache[common.Hash, []*types.Receipt]
@@ -260,9 +315,11 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 	}
 	// Open trie database with provided config
 	triedb := trie.NewDatabaseWithConfig(db, &trie.Config{
-		Cache:     cacheConfig.TrieCleanLimit,
-		Journal:   cacheConfig.TrieCleanJournal,
-		Preimages: cacheConfig.Preimages,
+		Cache:           cacheConfig.TrieCleanLimit,
+		Journal:         cacheConfig.TrieCleanJournal,
+		Preimages:       cacheConfig.Preimages,
+		PreimageBackend: cacheConfig.PreimageBackend,
+		DedupNodes:      cacheConfig.TrieDedup,
 	})
 
 	var genesisHash common.Hash
@@ -296,6 +353,7 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 		db:            db,
 		triedb:        triedb,
 		triegc:        prque.New[int64, trieGcEntry](nil),
+		retention:     retentionState{policy: cacheConfig.StateRetention},
 		quit:          make(chan struct{}),
 		chainmu:       syncx.NewClosableMutex(),
 		bodyCache:     lru.NewCache[common.Hash, *types.Body](bodyCacheLimit),
@@ -309,7 +367,7 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 	}
 	bc.flushInterval.Store(int64(cacheConfig.TrieTimeLimit))
 	bc.forker = NewForkChoice(bc, shouldPreserve)
-	bc.stateCache = state.NewDatabaseWithNodeDB(bc.db, bc.triedb)
+	bc.stateCache = state.NewDatabaseWithCodeCache(bc.db, bc.triedb, cacheConfig.codeCacheConfig())
 	bc.validator = NewBlockValidator(chainConfig, bc, engine)
 	bc.prefetcher = newStatePrefetcher(chainConfig, bc, engine)
 	bc.processor = NewStateProcessor(chainConfig, bc, engine)
@@ -327,6 +385,7 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 	if bc.genesisBlock == nil {
 		return nil, ErrNoGenesis
 	}
+	bc.paramsSchedule.Store(newChainParamsSchedule(chainConfig, rawdb.ReadChainParamsUpdates(db, bc.genesisBlock.Hash())))
 
 	bc.currentBlock.Store(nil)
 	bc.currentSnapBlock.Store(nil)
@@ -444,6 +503,9 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 			Recovery:   recover,
 			NoBuild:    bc.cacheConfig.SnapshotNoBuild,
 			AsyncBuild: !bc.cacheConfig.SnapshotWait,
+
+			DiffLayers:  bc.cacheConfig.SnapshotDiffLayers,
+			SpillLayers: bc.cacheConfig.SnapshotSpillLayers,
 		}
 		bc.snaps, _ = snapshot.New(snapconfig, bc.db, bc.triedb, head.Root)
 	}
@@ -476,7 +538,8 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 	}
 	// Start tx indexer/unindexer if required.
 	if txLookupLimit != nil {
-		bc.txLookupLimit = *txLookupLimit
+		bc.txLookupLimit.Store(*txLookupLimit)
+		bc.txIndexKick = make(chan struct{}, 1)
 
 		bc.wg.Add(1)
 		go bc.maintainTxIndex()
@@ -550,6 +613,7 @@ func (bc *BlockChain) loadLastState() error {
 			headSafeBlockGauge.Update(int64(block.NumberU64()))
 		}
 	}
+	bc.loadL1ConfirmedHeads()
 	// Issue a status log for the user
 	var (
 		currentSnapBlock  = bc.CurrentSnapBlock()
@@ -665,6 +729,8 @@ func (bc *BlockChain) setHeadBeyondRoot(head uint64, time uint64, root common.Ha
 	var blockNumber uint64 // (no root == always 0)
 	var rootFound bool
 
+	oldHead := bc.CurrentBlock()
+
 	// Retrieve the last pivot block to short circuit rollbacks beyond it and the
 	// current freezer limit to start nuking id underflown
 	pivot := rawdb.ReadLastPivotNumber(bc.db)
@@ -853,7 +919,11 @@ func (bc *BlockChain) setHeadBeyondRoot(head uint64, time uint64, root common.Ha
 		bc.SetFinalized(nil)
 	}
 
-	return blockNumber, rootFound, bc.loadLastState()
+	if err := bc.loadLastState(); err != nil {
+		return blockNumber, rootFound, err
+	}
+	bc.fireRewind(oldHead)
+	return blockNumber, rootFound, nil
 }
 
 // SnapSyncCommitHead sets the current head block to the one defined by the hash
@@ -1064,7 +1134,9 @@ func (bc *BlockChain) Stop() {
 			}
 		}
 		for !bc.triegc.Empty() {
-			triedb.Dereference(bc.triegc.PopItem().Root)
+			entry, number := bc.triegc.Pop()
+			bc.persistRetained(uint64(-number), entry.Root)
+			triedb.Dereference(entry.Root)
 		}
 		if size, _ := triedb.Size(); size != 0 {
 			log.Error("Dangling trie nodes after full cleanup")
@@ -1121,6 +1193,45 @@ const (
 	SideStatTy
 )
 
+func (s WriteStatus) String() string {
+	switch s {
+	case NonStatTy:
+		return "none"
+	case CanonStatTy:
+		return "canonical"
+	case SideStatTy:
+		return "side"
+	}
+	return fmt.Sprintf("WriteStatus(%d)", byte(s))
+}
+
+// TrieFlush is the set of decisions taken on flushing the trie database to disk
+// after writing the state of a block.
+type TrieFlush byte
+
+const (
+	TrieFlushCommit   TrieFlush = 1 << iota // The state of the block was committed to disk (archive)
+	TrieFlushSkip                           // Committing the state of the block was skipped (archive)
+	TrieFlushCap                            // Dirty trie nodes were flushed to stay within the memory limit
+	TrieFlushInterval                       // The state of an older block was flushed as the flush interval elapsed
+)
+
+func (f TrieFlush) String() string {
+	var decisions []string
+	for _, d := range []struct {
+		flag TrieFlush
+		name string
+	}{{TrieFlushCommit, "commit"}, {TrieFlushSkip, "skip"}, {TrieFlushCap, "cap"}, {TrieFlushInterval, "interval"}} {
+		if f&d.flag != 0 {
+			decisions = append(decisions, d.name)
+		}
+	}
+	if len(decisions) == 0 {
+		return "none"
+	}
+	return strings.Join(decisions, ",")
+}
+
 // InsertReceiptChain attempts to complete an already existing header chain with
 // transaction and receipt data.
 func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain []types.Receipts, ancientLimit uint64) (int, error) {
@@ -1231,7 +1342,7 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 		// generated.
 		var batch = bc.db.NewBatch()
 		for i, block := range blockChain {
-			if bc.txLookupLimit == 0 || ancientLimit <= bc.txLookupLimit || block.NumberU64() >= ancientLimit-bc.txLookupLimit {
+			if txLookupLimit := bc.txLookupLimit.Load(); txLookupLimit == 0 || ancientLimit <= txLookupLimit || block.NumberU64() >= ancientLimit-txLookupLimit {
 				rawdb.WriteTxLookupEntriesByBlock(batch, block)
 			} else if rawdb.ReadTxIndexTail(bc.db) != nil {
 				rawdb.WriteTxLookupEntriesByBlock(batch, block)
@@ -1359,10 +1470,10 @@ func (bc *BlockChain) InsertReceiptChain(blockChain types.Blocks, receiptChain [
 		// * 0: all ancient blocks have been indexed
 		// * ancient-limit: the indices of blocks before ancient-limit are ignored
 		if tail := rawdb.ReadTxIndexTail(bc.db); tail == nil {
-			if bc.txLookupLimit == 0 || ancientLimit <= bc.txLookupLimit {
+			if txLookupLimit := bc.txLookupLimit.Load(); txLookupLimit == 0 || ancientLimit <= txLookupLimit {
 				rawdb.WriteTxIndexTail(bc.db, 0)
 			} else {
-				rawdb.WriteTxIndexTail(bc.db, ancientLimit-bc.txLookupLimit)
+				rawdb.WriteTxIndexTail(bc.db, ancientLimit-txLookupLimit)
 			}
 		}
 	}
@@ -1421,7 +1532,28 @@ func (bc *BlockChain) writeKnownBlock(block *types.Block) error {
 
 // writeBlockWithState writes block, metadata and corresponding state data to the
 // database.
-func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.Receipt, state *state.StateDB) error {
+func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.Receipt, state *state.StateDB) (TrieFlush, error) {
+	if err := bc.writeBlockData(block, receipts, state.Preimages()); err != nil {
+		return 0, err
+	}
+	if bc.codeIndexing.Load() {
+		bc.indexCode(block, state)
+	}
+	if bc.transferIndexing.Load() {
+		bc.indexTransfers(block, receipts)
+	}
+	// Commit all cached state changes into underlying memory database.
+	state.SetCommitPipeline(bc.cacheConfig.TrieCommitWorkers)
+	root, err := state.Commit(bc.chainConfig.IsEIP158(block.Number()))
+	if err != nil {
+		return 0, err
+	}
+	defer bc.updateFlushPressure()
+	return bc.retainBlockState(block, root)
+}
+
+// writeBlockData writes the block and its metadata to the database.
+func (bc *BlockChain) writeBlockData(block *types.Block, receipts []*types.Receipt, preimages map[common.Hash][]byte) error {
 	// Calculate the total difficulty of the block
 	ptd := bc.GetTd(block.ParentHash(), block.NumberU64()-1)
 	if ptd == nil {
@@ -1438,19 +1570,28 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 	rawdb.WriteTd(blockBatch, block.Hash(), block.NumberU64(), externTd)
 	rawdb.WriteBlock(blockBatch, block)
 	rawdb.WriteReceipts(blockBatch, block.Hash(), block.NumberU64(), receipts)
-	rawdb.WritePreimages(blockBatch, state.Preimages())
+	if backend := bc.cacheConfig.PreimageBackend; backend == nil {
+		rawdb.WritePreimages(blockBatch, preimages)
+	} else if len(preimages) > 0 {
+		if err := backend.WritePreimages(preimages); err != nil {
+			log.Error("Failed to write preimages", "number", block.Number(), "err", err)
+		}
+	}
 	if err := blockBatch.Write(); err != nil {
 		log.Crit("Failed to write block into disk", "err", err)
 	}
-	// Commit all cached state changes into underlying memory database.
-	root, err := state.Commit(bc.chainConfig.IsEIP158(block.Number()))
-	if err != nil {
-		return err
-	}
+	return nil
+}
+
+// retainBlockState references the state of the block committed to the trie
+// database, flushing it to disk or garbage collecting older states as needed,
+// and reports the flushes it decided on.
+func (bc *BlockChain) retainBlockState(block *types.Block, root common.Hash) (TrieFlush, error) {
 	// If we're running an archive node, flush
 	// If MaxNumberOfBlocksToSkipStateSaving or MaxAmountOfGasToSkipStateSaving is not zero, then flushing of some blocks will be skipped:
 	// * at most MaxNumberOfBlocksToSkipStateSaving block state commits will be skipped
 	// * sum of gas used in skipped blocks will be at most MaxAmountOfGasToSkipStateSaving
+	var flush TrieFlush
 	archiveNode := bc.cacheConfig.TrieDirtyDisabled
 	if archiveNode {
 		var maySkipCommiting, blockLimitReached, gasLimitReached bool
@@ -1473,16 +1614,26 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 		if !maySkipCommiting || blockLimitReached || gasLimitReached {
 			bc.numberOfBlocksToSkipStateSaving = bc.cacheConfig.MaxNumberOfBlocksToSkipStateSaving
 			bc.amountOfGasInBlocksToSkipStateSaving = bc.cacheConfig.MaxAmountOfGasToSkipStateSaving
-			return bc.triedb.Commit(root, false)
+			return TrieFlushCommit, bc.triedb.Commit(root, false)
 		}
 		// we are skipping saving the trie to diskdb, so we need to keep the trie in memory and garbage collect it later
+		flush |= TrieFlushSkip
+	}
+
+	// Sparse archive: persist the stride states right away rather than when they're
+	// garbage collected, so that they also survive crashes and restarts
+	if stride := bc.cacheConfig.SparseArchiveStride; stride != 0 && !archiveNode && block.NumberU64()%stride == 0 {
+		if err := bc.triedb.Commit(root, false); err != nil {
+			return flush, err
+		}
+		flush |= TrieFlushCommit
 	}
 
 	// Full node or archive node that's not keeping all states, do proper garbage collection
 	bc.triedb.Reference(root, common.Hash{}) // metadata reference to keep trie alive
 	bc.triegc.Push(trieGcEntry{root, block.Header().Time}, -int64(block.NumberU64()))
 
-	blockLimit := int64(block.NumberU64()) - int64(bc.cacheConfig.TriesInMemory)   // only cleared if below that
+	blockLimit := int64(block.NumberU64()) - int64(bc.triesInMemory())             // only cleared if below that
 	timeLimit := time.Now().Unix() - int64(bc.cacheConfig.TrieRetention.Seconds()) // only cleared if less than that
 
 	if blockLimit > 0 && timeLimit > 0 {
@@ -1491,8 +1642,9 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 			nodes, imgs = bc.triedb.Size()
 			limit       = common.StorageSize(bc.cacheConfig.TrieDirtyLimit) * 1024 * 1024
 		)
-		if nodes > limit || imgs > 4*1024*1024 {
+		if nodes > limit || imgs > maxDirtyPreimages {
 			bc.triedb.Cap(limit - ethdb.IdealBatchSize)
+			flush |= TrieFlushCap
 		}
 		var prevEntry *trieGcEntry
 		var prevNum uint64
@@ -1503,6 +1655,7 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 				bc.triegc.Push(triegcEntry, number)
 				break
 			}
+			bc.persistRetained(uint64(-number), triegcEntry.Root)
 			if prevEntry != nil {
 				bc.triedb.Dereference(prevEntry.Root)
 			}
@@ -1528,13 +1681,14 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 				bc.triedb.Commit(header.Root, true)
 				bc.lastWrite = prevNum
 				bc.gcproc = 0
+				flush |= TrieFlushInterval
 			}
 		}
 		if prevEntry != nil {
 			bc.triedb.Dereference(prevEntry.Root)
 		}
 	}
-	return nil
+	return flush, nil
 }
 
 // WriteBlockAndSetHead writes the given block and all associated state to the database,
@@ -1545,15 +1699,31 @@ func (bc *BlockChain) WriteBlockAndSetHead(block *types.Block, receipts []*types
 	}
 	defer bc.chainmu.Unlock()
 
-	return bc.writeBlockAndSetHead(block, receipts, logs, state, emitHeadEvent)
+	return bc.writeBlockAndSetHead(block, receipts, logs, state, emitHeadEvent, 0)
 }
 
 // writeBlockAndSetHead is the internal implementation of WriteBlockAndSetHead.
-// This function expects the chain mutex to be held.
-func (bc *BlockChain) writeBlockAndSetHead(block *types.Block, receipts []*types.Receipt, logs []*types.Log, state *state.StateDB, emitHeadEvent bool) (status WriteStatus, err error) {
-	if err := bc.writeBlockWithState(block, receipts, state); err != nil {
+// The time spent processing the block, if known, is reported to the subscribers
+// of the block write events. This function expects the chain mutex to be held.
+func (bc *BlockChain) writeBlockAndSetHead(block *types.Block, receipts []*types.Receipt, logs []*types.Log, state *state.StateDB, emitHeadEvent bool, processTime time.Duration) (status WriteStatus, err error) {
+	bc.announceStateRoot(block, true)
+	flush, err := bc.writeBlockWithState(block, receipts, state)
+	if err != nil {
 		return NonStatTy, err
 	}
+	return bc.updateHeadWithBlock(block, logs, emitHeadEvent, processTime, flush)
+}
+
+// updateHeadWithBlock applies a block written along with its state as the new
+// chain head if it makes the chain heavier, reorganising the chain if needed.
+// This function expects the chain mutex to be held.
+func (bc *BlockChain) updateHeadWithBlock(block *types.Block, logs []*types.Log, emitHeadEvent bool, processTime time.Duration, flush TrieFlush) (status WriteStatus, err error) {
+	event := BlockWriteEvent{Block: block, ProcessTime: processTime, TrieFlush: flush}
+	defer func() {
+		event.Status = status
+		bc.writeFeed.Send(event)
+	}()
+
 	currentBlock := bc.CurrentBlock()
 	reorg, err := bc.forker.ReorgNeeded(currentBlock, block.Header())
 	if err != nil {
@@ -1565,6 +1735,7 @@ func (bc *BlockChain) writeBlockAndSetHead(block *types.Block, receipts []*types
 			if err := bc.reorg(currentBlock, block); err != nil {
 				return NonStatTy, err
 			}
+			event.Reorg = true
 		}
 		status = CanonStatTy
 	} else {
@@ -1581,6 +1752,7 @@ func (bc *BlockChain) writeBlockAndSetHead(block *types.Block, receipts []*types
 		if len(logs) > 0 {
 			bc.logsFeed.Send(logs)
 		}
+		bc.fireBlock(block, logs)
 		// In theory, we should fire a ChainHeadEvent when we inject
 		// a canonical block, but sometimes we can insert a batch of
 		// canonical blocks. Avoid firing too many ChainHeadEvents,
@@ -1588,9 +1760,11 @@ func (bc *BlockChain) writeBlockAndSetHead(block *types.Block, receipts []*types
 		// event here.
 		if emitHeadEvent {
 			bc.chainHeadFeed.Send(ChainHeadEvent{Block: block})
+			bc.fireHead(block)
 		}
 	} else {
 		bc.chainSideFeed.Send(ChainSideEvent{Block: block})
+		bc.fireSide(block, nil)
 	}
 	return status, nil
 }
@@ -1627,6 +1801,19 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 	defer bc.blockProcFeed.Send(false)
 
 	// Do a sanity check that the provided chain is actually ordered and linked.
+	if err := checkContiguous(chain); err != nil {
+		return 0, err
+	}
+	// Pre-checks passed, start the full block imports
+	if !bc.chainmu.TryLock() {
+		return 0, errChainStopped
+	}
+	defer bc.chainmu.Unlock()
+	return bc.insertChain(chain, true)
+}
+
+// checkContiguous checks that the blocks are ordered and linked.
+func checkContiguous(chain types.Blocks) error {
 	for i := 1; i < len(chain); i++ {
 		block, prev := chain[i], chain[i-1]
 		if block.NumberU64() != prev.NumberU64()+1 || block.ParentHash() != prev.Hash() {
@@ -1637,16 +1824,11 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 				"prevnumber", prev.Number(),
 				"prevhash", prev.Hash(),
 			)
-			return 0, fmt.Errorf("non contiguous insert: item %d is #%d [%x..], item %d is #%d [%x..] (parent [%x..])", i-1, prev.NumberU64(),
+			return fmt.Errorf("non contiguous insert: item %d is #%d [%x..], item %d is #%d [%x..] (parent [%x..])", i-1, prev.NumberU64(),
 				prev.Hash().Bytes()[:4], i, block.NumberU64(), block.Hash().Bytes()[:4], block.ParentHash().Bytes()[:4])
 		}
 	}
-	// Pre-checks passed, start the full block imports
-	if !bc.chainmu.TryLock() {
-		return 0, errChainStopped
-	}
-	defer bc.chainmu.Unlock()
-	return bc.insertChain(chain, true)
+	return nil
 }
 
 // insertChain is the internal implementation of InsertChain, which assumes that
@@ -1674,6 +1856,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 	defer func() {
 		if lastCanon != nil && bc.CurrentBlock().Hash() == lastCanon.Hash() {
 			bc.chainHeadFeed.Send(ChainHeadEvent{lastCanon})
+			bc.fireHead(lastCanon)
 		}
 	}()
 	// Start the parallel header verifier
@@ -1844,6 +2027,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 		if parent == nil {
 			parent = bc.GetHeader(block.ParentHash(), block.NumberU64()-1)
 		}
+		bc.revertSnapshot(parent.Root)
 		statedb, err := state.New(parent.Root, bc.stateCache, bc.snaps)
 		if err != nil {
 			return it.index, err
@@ -1873,7 +2057,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 
 		// Process block using the parent state as reference point
 		pstart := time.Now()
-		receipts, logs, usedGas, err := bc.processor.Process(block, statedb, bc.vmConfig)
+		receipts, logs, usedGas, err := bc.processor.Process(context.Background(), block, statedb, bc.vmConfig)
 		if err != nil {
 			bc.reportBlock(block, receipts, err)
 			followupInterrupt.Store(true)
@@ -1913,9 +2097,10 @@ func (bc *BlockChain) insertChain(chain types.Blocks, setHead bool) (int, error)
 		)
 		if !setHead {
 			// Don't set the head, only insert the block
-			err = bc.writeBlockWithState(block, receipts, statedb)
+			bc.announceStateRoot(block, false)
+			_, err = bc.writeBlockWithState(block, receipts, statedb)
 		} else {
-			status, err = bc.writeBlockAndSetHead(block, receipts, logs, statedb, false)
+			status, err = bc.writeBlockAndSetHead(block, receipts, logs, statedb, false, proctime)
 		}
 		followupInterrupt.Store(true)
 		if err != nil {
@@ -2185,34 +2370,21 @@ func (bc *BlockChain) collectLogs(b *types.Block, removed bool) []*types.Log {
 	return logs
 }
 
-// reorg takes two blocks, an old chain and a new chain and will reconstruct the
-// blocks and inserts them to be part of the new canonical chain and accumulates
-// potential missing transactions and post an event about them.
-// Note the new head block won't be processed here, callers need to handle it
-// externally.
-func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
-	var (
-		newChain    types.Blocks
-		oldChain    types.Blocks
-		commonBlock *types.Block
-
-		deletedTxs []common.Hash
-		addedTxs   []common.Hash
-	)
+// reorgChains walks back from the old head and the new head to their common
+// ancestor, returning the blocks dropped from the canonical chain and those made
+// canonical, both from the head towards the ancestor.
+func (bc *BlockChain) reorgChains(oldHead *types.Header, newHead *types.Block) (oldChain types.Blocks, newChain types.Blocks, commonBlock *types.Block, err error) {
 	oldBlock := bc.GetBlock(oldHead.Hash(), oldHead.Number.Uint64())
 	if oldBlock == nil {
-		return errors.New("current head block missing")
+		return nil, nil, nil, errors.New("current head block missing")
 	}
 	newBlock := newHead
 
 	// Reduce the longer chain to the same number as the shorter one
 	if oldBlock.NumberU64() > newBlock.NumberU64() {
-		// Old chain is longer, gather all transactions and logs as deleted ones
+		// Old chain is longer, gather all its blocks as deleted ones
 		for ; oldBlock != nil && oldBlock.NumberU64() != newBlock.NumberU64(); oldBlock = bc.GetBlock(oldBlock.ParentHash(), oldBlock.NumberU64()-1) {
 			oldChain = append(oldChain, oldBlock)
-			for _, tx := range oldBlock.Transactions() {
-				deletedTxs = append(deletedTxs, tx.Hash())
-			}
 		}
 	} else {
 		// New chain is longer, stash all blocks away for subsequent insertion
@@ -2221,34 +2393,51 @@ func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
 		}
 	}
 	if oldBlock == nil {
-		return errors.New("invalid old chain")
+		return nil, nil, nil, errors.New("invalid old chain")
 	}
 	if newBlock == nil {
-		return errors.New("invalid new chain")
+		return nil, nil, nil, errors.New("invalid new chain")
 	}
 	// Both sides of the reorg are at the same number, reduce both until the common
 	// ancestor is found
 	for {
 		// If the common ancestor was found, bail out
 		if oldBlock.Hash() == newBlock.Hash() {
-			commonBlock = oldBlock
-			break
+			return oldChain, newChain, oldBlock, nil
 		}
 		// Remove an old block as well as stash away a new block
 		oldChain = append(oldChain, oldBlock)
-		for _, tx := range oldBlock.Transactions() {
-			deletedTxs = append(deletedTxs, tx.Hash())
-		}
 		newChain = append(newChain, newBlock)
 
 		// Step back with both chains
 		oldBlock = bc.GetBlock(oldBlock.ParentHash(), oldBlock.NumberU64()-1)
 		if oldBlock == nil {
-			return fmt.Errorf("invalid old chain")
+			return nil, nil, nil, fmt.Errorf("invalid old chain")
 		}
 		newBlock = bc.GetBlock(newBlock.ParentHash(), newBlock.NumberU64()-1)
 		if newBlock == nil {
-			return fmt.Errorf("invalid new chain")
+			return nil, nil, nil, fmt.Errorf("invalid new chain")
+		}
+	}
+}
+
+// reorg takes two blocks, an old chain and a new chain and will reconstruct the
+// blocks and inserts them to be part of the new canonical chain and accumulates
+// potential missing transactions and post an event about them.
+// Note the new head block won't be processed here, callers need to handle it
+// externally.
+func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
+	oldChain, newChain, commonBlock, err := bc.reorgChains(oldHead, newHead)
+	if err != nil {
+		return err
+	}
+	var (
+		deletedTxs []common.Hash
+		addedTxs   []common.Hash
+	)
+	for _, block := range oldChain {
+		for _, tx := range block.Transactions() {
+			deletedTxs = append(deletedTxs, tx.Hash())
 		}
 	}
 
@@ -2277,7 +2466,7 @@ func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
 	} else {
 		// len(newChain) == 0 && len(oldChain) > 0
 		// rewind the canonical chain to a lower point.
-		log.Error("Impossible reorg, please file an issue", "oldnum", oldBlock.Number(), "oldhash", oldBlock.Hash(), "oldblocks", len(oldChain), "newnum", newBlock.Number(), "newhash", newBlock.Hash(), "newblocks", len(newChain))
+		log.Error("Impossible reorg, please file an issue", "oldnum", commonBlock.Number(), "oldhash", commonBlock.Hash(), "oldblocks", len(oldChain), "newnum", commonBlock.Number(), "newhash", commonBlock.Hash(), "newblocks", len(newChain))
 	}
 	// Insert the new chain(except the head block(reverse order)),
 	// taking care of the proper incremental order.
@@ -2321,15 +2510,20 @@ func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
 	// high, so the events are sent in batches of size around 512.
 
 	// Deleted logs + blocks:
+	if len(oldChain) > 0 {
+		bc.fireReorg(commonBlock.Header(), oldHead, newHead.Header())
+	}
 	var deletedLogs []*types.Log
 	for i := len(oldChain) - 1; i >= 0; i-- {
 		// Also send event for blocks removed from the canon chain.
 		bc.chainSideFeed.Send(ChainSideEvent{Block: oldChain[i]})
 
 		// Collect deleted logs for notification
-		if logs := bc.collectLogs(oldChain[i], true); len(logs) > 0 {
+		logs := bc.collectLogs(oldChain[i], true)
+		if len(logs) > 0 {
 			deletedLogs = append(deletedLogs, logs...)
 		}
+		bc.fireSide(oldChain[i], logs)
 		if len(deletedLogs) > 512 {
 			bc.rmLogsFeed.Send(RemovedLogsEvent{deletedLogs})
 			deletedLogs = nil
@@ -2342,9 +2536,11 @@ func (bc *BlockChain) reorg(oldHead *types.Header, newHead *types.Block) error {
 	// New logs:
 	var rebirthLogs []*types.Log
 	for i := len(newChain) - 1; i >= 1; i-- {
-		if logs := bc.collectLogs(newChain[i], false); len(logs) > 0 {
+		logs := bc.collectLogs(newChain[i], false)
+		if len(logs) > 0 {
 			rebirthLogs = append(rebirthLogs, logs...)
 		}
+		bc.fireBlock(newChain[i], logs)
 		if len(rebirthLogs) > 512 {
 			bc.logsFeed.Send(rebirthLogs)
 			rebirthLogs = nil
@@ -2403,6 +2599,8 @@ func (bc *BlockChain) SetCanonical(head *types.Block) (common.Hash, error) {
 		bc.logsFeed.Send(logs)
 	}
 	bc.chainHeadFeed.Send(ChainHeadEvent{Block: head})
+	bc.fireBlock(head, logs)
+	bc.fireHead(head)
 
 	context := []interface{}{
 		"number", head.Number(),
@@ -2475,19 +2673,23 @@ func (bc *BlockChain) skipBlock(err error, it *insertIterator) bool {
 // indexBlocks reindexes or unindexes transactions depending on user configuration
 func (bc *BlockChain) indexBlocks(tail *uint64, head uint64, done chan struct{}) {
 	defer func() { close(done) }()
+	// The backfilled ranges the tail was moved back over are part of the tail now
+	defer bc.pruneTxIndexRanges()
+
+	txLookupLimit := bc.txLookupLimit.Load()
 
 	// The tail flag is not existent, it means the node is just initialized
 	// and all blocks(may from ancient store) are not indexed yet.
 	if tail == nil {
 		from := uint64(0)
-		if bc.txLookupLimit != 0 && head >= bc.txLookupLimit {
-			from = head - bc.txLookupLimit + 1
+		if txLookupLimit != 0 && head >= txLookupLimit {
+			from = head - txLookupLimit + 1
 		}
 		rawdb.IndexTransactions(bc.db, from, head+1, bc.quit)
 		return
 	}
 	// The tail flag is existent, but the whole chain is required to be indexed.
-	if bc.txLookupLimit == 0 || head < bc.txLookupLimit {
+	if txLookupLimit == 0 || head < txLookupLimit {
 		if *tail > 0 {
 			// It can happen when chain is rewound to a historical point which
 			// is even lower than the indexes tail, recap the indexing target
@@ -2501,12 +2703,12 @@ func (bc *BlockChain) indexBlocks(tail *uint64, head uint64, done chan struct{})
 		return
 	}
 	// Update the transaction index to the new chain state
-	if head-bc.txLookupLimit+1 < *tail {
+	if head-txLookupLimit+1 < *tail {
 		// Reindex a part of missing indices and rewind index tail to HEAD-limit
-		rawdb.IndexTransactions(bc.db, head-bc.txLookupLimit+1, *tail, bc.quit)
+		rawdb.IndexTransactions(bc.db, head-txLookupLimit+1, *tail, bc.quit)
 	} else {
 		// Unindex a part of stale indices and forward index tail to HEAD-limit
-		rawdb.UnindexTransactions(bc.db, *tail, head-bc.txLookupLimit+1, bc.quit)
+		rawdb.UnindexTransactions(bc.db, *tail, head-txLookupLimit+1, bc.quit)
 	}
 }
 
@@ -2526,6 +2728,7 @@ func (bc *BlockChain) maintainTxIndex() {
 	// Listening to chain events and manipulate the transaction indexes.
 	var (
 		done   chan struct{}                  // Non-nil if background unindexing or reindexing routine is active.
+		kicked bool                           // Whether the lookup limit changed while the routine was active
 		headCh = make(chan ChainHeadEvent, 1) // Buffered to avoid locking up the event feed
 	)
 	sub := bc.SubscribeChainHeadEvent(headCh)
@@ -2541,8 +2744,20 @@ func (bc *BlockChain) maintainTxIndex() {
 				done = make(chan struct{})
 				go bc.indexBlocks(rawdb.ReadTxIndexTail(bc.db), head.Block.NumberU64(), done)
 			}
+		case <-bc.txIndexKick:
+			if done != nil {
+				kicked = true
+				continue
+			}
+			done = make(chan struct{})
+			go bc.indexBlocks(rawdb.ReadTxIndexTail(bc.db), bc.CurrentBlock().Number.Uint64(), done)
 		case <-done:
 			done = nil
+			if kicked {
+				kicked = false
+				done = make(chan struct{})
+				go bc.indexBlocks(rawdb.ReadTxIndexTail(bc.db), bc.CurrentBlock().Number.Uint64(), done)
+			}
 		case <-bc.quit:
 			if done != nil {
 				log.Info("Waiting background transaction indexer to exit")
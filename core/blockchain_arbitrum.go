@@ -19,14 +19,295 @@ package core
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 	"time"
 
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
 	"github.com/chainupcloud/arb-geth/core/state"
 	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/event"
 	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/params"
 	"github.com/chainupcloud/arb-geth/rpc"
 )
 
+// ChainParamsUpdateEvent is posted when ApplyChainParamsUpdate schedules an
+// update of the Arbitrum chain parameters.
+type ChainParamsUpdateEvent struct {
+	Activation uint64
+	Old        params.ArbitrumChainParams
+	New        params.ArbitrumChainParams
+}
+
+// ErrChainParamsActivation is returned when a chain parameter update would take
+// effect before a block that's yet to be processed, or before an update already
+// scheduled.
+var ErrChainParamsActivation = errors.New("invalid chain parameter update activation")
+
+// chainParamsSchedule holds the chain configs in effect from the activation of
+// each update of the chain parameters on. It's replaced as a whole when an update
+// is scheduled, and none of its configs is ever modified, so that they can be
+// used without locking.
+type chainParamsSchedule struct {
+	updates []rawdb.ChainParamsUpdate // Ordered by activation block
+	configs []*params.ChainConfig     // Base config, followed by the one of each update
+}
+
+func newChainParamsSchedule(base *params.ChainConfig, updates []rawdb.ChainParamsUpdate) *chainParamsSchedule {
+	schedule := &chainParamsSchedule{
+		updates: updates,
+		configs: []*params.ChainConfig{base},
+	}
+	for _, update := range updates {
+		config := *base
+		config.ArbitrumChainParams = update.Params
+		schedule.configs = append(schedule.configs, &config)
+	}
+	return schedule
+}
+
+// at returns the config in effect for the block with the given number.
+func (s *chainParamsSchedule) at(number uint64) *params.ChainConfig {
+	return s.configs[sort.Search(len(s.updates), func(i int) bool { return s.updates[i].Activation > number })]
+}
+
+// ApplyChainParamsUpdate schedules an update of the Arbitrum chain parameters of
+// the running chain, without restarting the node. The update is validated first,
+// the fields fixed by the genesis can't change. It takes effect from the given
+// activation block on, which must be after the current head and any update
+// already scheduled, so that every node processing the chain applies it at the
+// same block. The update is persisted and posted to the subscribers of the
+// parameter updates.
+//
+// The chain config in use is never modified: Config and ConfigAt return a new
+// one once the update is scheduled, and the components holding on to the
+// previous config keep using it.
+func (bc *BlockChain) ApplyChainParamsUpdate(update params.ArbitrumChainParams, activation uint64) error {
+	if !bc.chainmu.TryLock() {
+		return errChainStopped
+	}
+	defer bc.chainmu.Unlock()
+
+	schedule := bc.paramsSchedule.Load()
+	if head := bc.CurrentBlock().Number.Uint64(); activation <= head {
+		return fmt.Errorf("%w: block %d is not after the head %d", ErrChainParamsActivation, activation, head)
+	}
+	if n := len(schedule.updates); n > 0 && activation <= schedule.updates[n-1].Activation {
+		return fmt.Errorf("%w: block %d is not after the last scheduled update at %d", ErrChainParamsActivation, activation, schedule.updates[n-1].Activation)
+	}
+	old := schedule.at(activation).ArbitrumChainParams
+	if err := old.CheckUpdate(&update); err != nil {
+		return err
+	}
+	if old == update {
+		return nil
+	}
+	updates := append(append([]rawdb.ChainParamsUpdate{}, schedule.updates...), rawdb.ChainParamsUpdate{Activation: activation, Params: update})
+	rawdb.WriteChainParamsUpdates(bc.db, bc.genesisBlock.Hash(), updates)
+	bc.paramsSchedule.Store(newChainParamsSchedule(bc.chainConfig, updates))
+	log.Info("Scheduled chain parameters update", "activation", activation, "old", fmt.Sprintf("%+v", old), "new", fmt.Sprintf("%+v", update))
+
+	bc.paramsFeed.Send(ChainParamsUpdateEvent{Activation: activation, Old: old, New: update})
+	return nil
+}
+
+// SubscribeChainParamsUpdateEvent registers a subscription of ChainParamsUpdateEvent.
+func (bc *BlockChain) SubscribeChainParamsUpdateEvent(ch chan<- ChainParamsUpdateEvent) event.Subscription {
+	return bc.scope.Track(bc.paramsFeed.Subscribe(ch))
+}
+
+var (
+	// ErrL1HeadNotCanonical is returned when L1 confirms a block which isn't
+	// part of the local canonical chain.
+	ErrL1HeadNotCanonical = errors.New("L1 confirmed block is not canonical")
+
+	// ErrL1FinalityRegression is returned when the finalized block would move
+	// backwards, or be confirmed by an older L1 block than the current one.
+	ErrL1FinalityRegression = errors.New("L1 finality regression")
+)
+
+// SetFinalizedByL1 marks the block with the given hash as finalized, following
+// the finalization of the L1 block which confirmed its batch. The finalized block
+// only moves forward, and the safe block is advanced along with it if behind.
+func (bc *BlockChain) SetFinalizedByL1(hash common.Hash, l1BlockNumber uint64) error {
+	if !bc.chainmu.TryLock() {
+		return errChainStopped
+	}
+	defer bc.chainmu.Unlock()
+
+	header, err := bc.l1ConfirmedHeader(hash)
+	if err != nil {
+		return err
+	}
+	if final := bc.CurrentFinalBlock(); final != nil && header.Number.Cmp(final.Number) < 0 {
+		return fmt.Errorf("%w: block #%d is behind finalized #%d", ErrL1FinalityRegression, header.Number, final.Number)
+	}
+	if prev, ok := bc.FinalizedL1BlockNumber(); ok && l1BlockNumber < prev {
+		return fmt.Errorf("%w: L1 block %d is behind %d", ErrL1FinalityRegression, l1BlockNumber, prev)
+	}
+	head := &rawdb.L1ConfirmedHead{Hash: hash, L1BlockNumber: l1BlockNumber}
+	bc.SetFinalized(header)
+	rawdb.WriteL1FinalizedHead(bc.db, head)
+	bc.l1FinalizedHead.Store(head)
+
+	if safe := bc.CurrentSafeBlock(); safe == nil || safe.Number.Cmp(header.Number) < 0 {
+		bc.setSafeByL1(header, head)
+	}
+	return nil
+}
+
+// SetSafeByL1 marks the block with the given hash as safe, following the
+// inclusion of its batch in the given L1 block. The safe block may move back
+// on L1 reorgs, but never behind the finalized block.
+func (bc *BlockChain) SetSafeByL1(hash common.Hash, l1BlockNumber uint64) error {
+	if !bc.chainmu.TryLock() {
+		return errChainStopped
+	}
+	defer bc.chainmu.Unlock()
+
+	header, err := bc.l1ConfirmedHeader(hash)
+	if err != nil {
+		return err
+	}
+	if final := bc.CurrentFinalBlock(); final != nil && header.Number.Cmp(final.Number) < 0 {
+		return fmt.Errorf("%w: safe block #%d is behind finalized #%d", ErrL1FinalityRegression, header.Number, final.Number)
+	}
+	bc.setSafeByL1(header, &rawdb.L1ConfirmedHead{Hash: hash, L1BlockNumber: l1BlockNumber})
+	return nil
+}
+
+func (bc *BlockChain) setSafeByL1(header *types.Header, head *rawdb.L1ConfirmedHead) {
+	bc.SetSafe(header)
+	rawdb.WriteL1SafeHead(bc.db, head)
+	bc.l1SafeHead.Store(head)
+}
+
+// l1ConfirmedHeader returns the header of a canonical block confirmed by L1.
+func (bc *BlockChain) l1ConfirmedHeader(hash common.Hash) (*types.Header, error) {
+	header := bc.GetHeaderByHash(hash)
+	if header == nil {
+		return nil, fmt.Errorf("%w: unknown block %x", ErrL1HeadNotCanonical, hash)
+	}
+	number := header.Number.Uint64()
+	if number > bc.CurrentBlock().Number.Uint64() || bc.GetCanonicalHash(number) != hash {
+		return nil, fmt.Errorf("%w: block #%d [%x]", ErrL1HeadNotCanonical, number, hash)
+	}
+	return header, nil
+}
+
+// FinalizedL1BlockNumber returns the number of the L1 block which confirmed the
+// current finalized block, if it was set through SetFinalizedByL1.
+func (bc *BlockChain) FinalizedL1BlockNumber() (uint64, bool) {
+	return l1ConfirmationOf(bc.l1FinalizedHead.Load(), bc.CurrentFinalBlock())
+}
+
+// SafeL1BlockNumber returns the number of the L1 block which confirmed the
+// current safe block, if it was set through SetSafeByL1 or SetFinalizedByL1.
+func (bc *BlockChain) SafeL1BlockNumber() (uint64, bool) {
+	return l1ConfirmationOf(bc.l1SafeHead.Load(), bc.CurrentSafeBlock())
+}
+
+// l1ConfirmationOf returns the L1 block number of a confirmation, as long as
+// the head it confirms wasn't replaced since, e.g. by a rewind of the chain.
+func l1ConfirmationOf(head *rawdb.L1ConfirmedHead, header *types.Header) (uint64, bool) {
+	if head == nil || header == nil || header.Hash() != head.Hash {
+		return 0, false
+	}
+	return head.L1BlockNumber, true
+}
+
+// loadL1ConfirmedHeads restores the L1 confirmations of the finalized and safe
+// blocks. Unlike a safe block set through SetSafe, one confirmed by L1 is kept
+// across restarts.
+func (bc *BlockChain) loadL1ConfirmedHeads() {
+	final := bc.CurrentFinalBlock()
+	if head := rawdb.ReadL1FinalizedHead(bc.db); head != nil && final != nil && final.Hash() == head.Hash {
+		bc.l1FinalizedHead.Store(head)
+	}
+	head := rawdb.ReadL1SafeHead(bc.db)
+	if head == nil {
+		return
+	}
+	header, err := bc.l1ConfirmedHeader(head.Hash)
+	if err != nil || (final != nil && header.Number.Cmp(final.Number) < 0) {
+		return
+	}
+	bc.currentSafeBlock.Store(header)
+	headSafeBlockGauge.Update(int64(header.Number.Uint64()))
+	bc.l1SafeHead.Store(head)
+}
+
+var (
+	// ErrStatePinNotFound is returned when no state is pinned with a label.
+	ErrStatePinNotFound = errors.New("state pin not found")
+
+	// ErrStatePinExists is returned when pinning a state with a label already
+	// used by the state of another block.
+	ErrStatePinExists = errors.New("state pin label already in use")
+)
+
+// PinState commits the state of the given block to disk and records it under
+// the label, keeping it out of pruning until unpinned. The state must be
+// available, e.g. right after its recreation. Pinning a block with the label
+// it's already pinned with is a no-op.
+func (bc *BlockChain) PinState(label string, header *types.Header) (*rawdb.StatePin, error) {
+	if label == "" {
+		return nil, errors.New("empty state pin label")
+	}
+	bc.statePinLock.Lock()
+	defer bc.statePinLock.Unlock()
+
+	if pin := rawdb.ReadStatePin(bc.db, label); pin != nil {
+		if pin.BlockHash != header.Hash() {
+			return nil, fmt.Errorf("%w: %q pins block #%d [%x]", ErrStatePinExists, label, pin.BlockNumber, pin.BlockHash)
+		}
+		return pin, nil
+	}
+	if !bc.HasState(header.Root) {
+		return nil, fmt.Errorf("state of block #%d [%x] not available", header.Number, header.Hash())
+	}
+	if err := bc.stateCache.TrieDB().Commit(header.Root, false); err != nil {
+		return nil, fmt.Errorf("failed to commit state of block #%d: %w", header.Number, err)
+	}
+	pin := &rawdb.StatePin{
+		Label:       label,
+		Root:        header.Root,
+		BlockHash:   header.Hash(),
+		BlockNumber: header.Number.Uint64(),
+		Created:     uint64(time.Now().Unix()),
+	}
+	rawdb.WriteStatePin(bc.db, pin)
+	log.Info("Pinned state", "label", label, "number", header.Number, "hash", header.Hash(), "root", header.Root)
+	return pin, nil
+}
+
+// UnpinState removes the pinned state with the given label. Its state is left
+// on disk, until dropped by the next pruning.
+func (bc *BlockChain) UnpinState(label string) error {
+	bc.statePinLock.Lock()
+	defer bc.statePinLock.Unlock()
+
+	pin := rawdb.ReadStatePin(bc.db, label)
+	if pin == nil {
+		return fmt.Errorf("%w: %q", ErrStatePinNotFound, label)
+	}
+	rawdb.DeleteStatePin(bc.db, label)
+	log.Info("Unpinned state", "label", label, "number", pin.BlockNumber, "hash", pin.BlockHash)
+	return nil
+}
+
+// StatePin returns the pinned state with the given label, or nil if none.
+func (bc *BlockChain) StatePin(label string) *rawdb.StatePin {
+	return rawdb.ReadStatePin(bc.db, label)
+}
+
+// StatePins returns all the pinned states, ordered by label.
+func (bc *BlockChain) StatePins() []*rawdb.StatePin {
+	return rawdb.ReadAllStatePins(bc.db)
+}
+
 // WriteBlockAndSetHeadWithTime also counts processTime, which will cause intermittent TrieDirty cache writes
 func (bc *BlockChain) WriteBlockAndSetHeadWithTime(block *types.Block, receipts []*types.Receipt, logs []*types.Log, state *state.StateDB, emitHeadEvent bool, processTime time.Duration) (status WriteStatus, err error) {
 	if !bc.chainmu.TryLock() {
@@ -34,7 +315,7 @@ func (bc *BlockChain) WriteBlockAndSetHeadWithTime(block *types.Block, receipts
 	}
 	defer bc.chainmu.Unlock()
 	bc.gcproc += processTime
-	return bc.writeBlockAndSetHead(block, receipts, logs, state, emitHeadEvent)
+	return bc.writeBlockAndSetHead(block, receipts, logs, state, emitHeadEvent, processTime)
 }
 
 func (bc *BlockChain) ReorgToOldBlock(newHead *types.Block) error {
@@ -49,15 +330,34 @@ func (bc *BlockChain) ReorgToOldBlock(newHead *types.Block) error {
 	if oldHead.Hash() == newHead.Hash() {
 		return nil
 	}
+	logger := log.New(log.TraceKey, log.NewTraceID(), log.OpKey, "reorg-to-old-block")
+	logger.Info("Reorging to old block", "oldnumber", oldHead.Number, "oldhash", oldHead.Hash(), "number", newHead.Number(), "hash", newHead.Hash())
+	start := time.Now()
 	bc.writeHeadBlock(newHead)
 	err := bc.reorg(oldHead, newHead)
 	if err != nil {
+		logger.Error("Failed reorging to old block", "elapsed", time.Since(start), "err", err)
 		return err
 	}
+	bc.revertSnapshot(newHead.Root())
+	logger.Info("Reorged to old block", "number", newHead.Number(), "elapsed", time.Since(start))
 	bc.chainHeadFeed.Send(ChainHeadEvent{Block: newHead})
+	bc.fireHead(newHead)
 	return nil
 }
 
+// revertSnapshot rewinds the snapshot to the state a reorg deeper than its diff
+// layers returns to, if the layer of the state was spilled to disk, so that the
+// snapshot keeps being maintained instead of needing a rebuild.
+func (bc *BlockChain) revertSnapshot(root common.Hash) {
+	if bc.snaps == nil || bc.cacheConfig.SnapshotSpillLayers == 0 || bc.snaps.Snapshot(root) != nil {
+		return
+	}
+	if err := bc.snaps.Revert(root); err != nil {
+		log.Debug("Failed to revert state snapshot", "root", root, "err", err)
+	}
+}
+
 func (bc *BlockChain) ClipToPostNitroGenesis(blockNum rpc.BlockNumber) (rpc.BlockNumber, rpc.BlockNumber) {
 	currentBlock := rpc.BlockNumber(bc.CurrentBlock().Number.Uint64())
 	nitroGenesis := rpc.BlockNumber(bc.Config().ArbitrumChainParams.GenesisBlockNum)
@@ -81,3 +381,50 @@ func (bc *BlockChain) RecoverState(block *types.Block) error {
 	_, err := bc.recoverAncestors(block)
 	return err
 }
+
+// StateFlush describes the state written to disk by FlushState.
+type StateFlush struct {
+	Block        *types.Header // Block whose state was committed
+	SnapshotRoot common.Hash   // Root of the snapshot disk layer, also committed, if snapshots are enabled
+}
+
+// FlushState writes the state held in memory for the current head to disk,
+// flattens the snapshot onto disk and journals it, so that a restart following
+// it doesn't have to replay more than the blocks imported since, even if the
+// shutdown itself isn't clean. Unlike Stop, the chain keeps running: block
+// insertion is only paused while flushing.
+func (bc *BlockChain) FlushState() (*StateFlush, error) {
+	if !bc.chainmu.TryLock() {
+		return nil, errChainStopped
+	}
+	defer bc.chainmu.Unlock()
+
+	head := bc.CurrentBlock()
+	flush := &StateFlush{Block: head}
+	if bc.snaps != nil {
+		// Flatten the diff layers onto disk, otherwise a crash would rewind the
+		// chain to the old disk layer regardless of the journal
+		if err := bc.snaps.Cap(head.Root, 0); err != nil {
+			return nil, fmt.Errorf("failed to flatten state snapshot: %w", err)
+		}
+		base, err := bc.snaps.Checkpoint(head.Root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to journal state snapshot: %w", err)
+		}
+		flush.SnapshotRoot = base
+	}
+	log.Info("Writing cached state to disk", "block", head.Number, "hash", head.Hash(), "root", head.Root)
+	if err := bc.triedb.Commit(head.Root, true); err != nil {
+		return nil, fmt.Errorf("failed to commit head state trie: %w", err)
+	}
+	if flush.SnapshotRoot != (common.Hash{}) && flush.SnapshotRoot != head.Root {
+		log.Info("Writing snapshot state to disk", "root", flush.SnapshotRoot)
+		if err := bc.triedb.Commit(flush.SnapshotRoot, true); err != nil {
+			return nil, fmt.Errorf("failed to commit snapshot state trie: %w", err)
+		}
+	}
+	if bc.cacheConfig.TrieCleanJournal != "" {
+		bc.triedb.SaveCache(bc.cacheConfig.TrieCleanJournal)
+	}
+	return flush, nil
+}
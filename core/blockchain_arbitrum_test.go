@@ -0,0 +1,473 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that the chain parameters can be updated at runtime from an activation
+// block on, within the limits of the validation, with the updates persisted and
+// posted to the subscribers, and the configs in use left untouched.
+func TestApplyChainParamsUpdate(t *testing.T) {
+	config := *params.TestChainConfig
+	var (
+		db    = rawdb.NewMemoryDatabase()
+		gspec = &Genesis{Config: &config}
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4, nil)
+	chain, err := NewBlockChain(db, nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	if _, err := chain.InsertChain(blocks[:2]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	events := make(chan ChainParamsUpdateEvent, 1)
+	sub := chain.SubscribeChainParamsUpdateEvent(events)
+	defer sub.Unsubscribe()
+
+	base := chain.Config()
+	update := config.ArbitrumChainParams
+	update.MaxCodeSize = 48 * 1024
+	update.AllowDebugPrecompiles = true
+	if err := chain.ApplyChainParamsUpdate(update, 2); !errors.Is(err, ErrChainParamsActivation) {
+		t.Errorf("activation at the head: have %v, want %v", err, ErrChainParamsActivation)
+	}
+	if err := chain.ApplyChainParamsUpdate(update, 4); err != nil {
+		t.Fatalf("failed to apply update: %v", err)
+	}
+	if base.ArbitrumChainParams != config.ArbitrumChainParams {
+		t.Errorf("config in use modified: have %+v", base.ArbitrumChainParams)
+	}
+	if have := chain.ConfigAt(3).ArbitrumChainParams; have != config.ArbitrumChainParams {
+		t.Errorf("params changed before activation: have %+v", have)
+	}
+	if have := chain.ConfigAt(4); have.ArbitrumChainParams != update || have.MaxCodeSize() != 48*1024 {
+		t.Errorf("params not updated at activation: have %+v", have.ArbitrumChainParams)
+	}
+	if have := chain.Config().ArbitrumChainParams; have != config.ArbitrumChainParams {
+		t.Errorf("params of the next block changed before activation: have %+v", have)
+	}
+	select {
+	case event := <-events:
+		if event.Activation != 4 || event.New != update || event.Old.MaxCodeSize != 0 {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	default:
+		t.Error("update not posted")
+	}
+	// Invalid updates are rejected without side effects
+	immutable := update
+	immutable.GenesisBlockNum++
+	if err := chain.ApplyChainParamsUpdate(immutable, 5); !errors.Is(err, params.ErrImmutableChainParam) {
+		t.Errorf("immutable param update: have %v, want %v", err, params.ErrImmutableChainParam)
+	}
+	inconsistent := update
+	inconsistent.MaxInitCodeSize = update.MaxCodeSize - 1
+	if err := chain.ApplyChainParamsUpdate(inconsistent, 5); err == nil {
+		t.Error("inconsistent code size limits accepted")
+	}
+	if err := chain.ApplyChainParamsUpdate(config.ArbitrumChainParams, 3); !errors.Is(err, ErrChainParamsActivation) {
+		t.Errorf("activation before a scheduled update: have %v, want %v", err, ErrChainParamsActivation)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("rejected update posted: %+v", event)
+	default:
+	}
+	// The update takes effect once the head reaches the block before activation
+	if _, err := chain.InsertChain(blocks[2:3]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if have := chain.Config().ArbitrumChainParams; have != update {
+		t.Errorf("params of the next block not updated: have %+v", have)
+	}
+	chain.Stop()
+
+	// The schedule survives a restart
+	chain, err = NewBlockChain(db, nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to reopen chain: %v", err)
+	}
+	defer chain.Stop()
+	if have := chain.ConfigAt(4).ArbitrumChainParams; have != update {
+		t.Errorf("update not persisted: have %+v", have)
+	}
+	if stored := rawdb.ReadChainConfig(db, chain.Genesis().Hash()); stored == nil || stored.ArbitrumChainParams != config.ArbitrumChainParams {
+		t.Errorf("base config overwritten: have %+v", stored)
+	}
+}
+
+// Tests that the safe and finalized blocks confirmed by L1 are validated, kept
+// across restarts, and dropped once the chain is rewound below them.
+func TestL1ConfirmedHeads(t *testing.T) {
+	var (
+		db    = rawdb.NewMemoryDatabase()
+		gspec = &Genesis{Config: params.TestChainConfig}
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 10, nil)
+	chain, err := NewBlockChain(db, nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if err := chain.SetSafeByL1(blocks[5].Hash(), 100); err != nil {
+		t.Fatalf("failed to set safe block: %v", err)
+	}
+	if err := chain.SetFinalizedByL1(blocks[2].Hash(), 90); err != nil {
+		t.Fatalf("failed to set finalized block: %v", err)
+	}
+	if err := chain.SetFinalizedByL1(common.Hash{1}, 95); !errors.Is(err, ErrL1HeadNotCanonical) {
+		t.Errorf("unknown block: have %v, want %v", err, ErrL1HeadNotCanonical)
+	}
+	if err := chain.SetFinalizedByL1(blocks[1].Hash(), 95); !errors.Is(err, ErrL1FinalityRegression) {
+		t.Errorf("finalized block regression: have %v, want %v", err, ErrL1FinalityRegression)
+	}
+	if err := chain.SetFinalizedByL1(blocks[3].Hash(), 80); !errors.Is(err, ErrL1FinalityRegression) {
+		t.Errorf("finalized L1 block regression: have %v, want %v", err, ErrL1FinalityRegression)
+	}
+	if err := chain.SetSafeByL1(blocks[1].Hash(), 95); !errors.Is(err, ErrL1FinalityRegression) {
+		t.Errorf("safe block behind finalized: have %v, want %v", err, ErrL1FinalityRegression)
+	}
+	check := func(chain *BlockChain, safe, final int, safeL1, finalL1 uint64) {
+		t.Helper()
+		if have := chain.CurrentSafeBlock(); have == nil || have.Hash() != blocks[safe].Hash() {
+			t.Errorf("safe block: have %v, want #%d", have, blocks[safe].Number())
+		}
+		if have := chain.CurrentFinalBlock(); have == nil || have.Hash() != blocks[final].Hash() {
+			t.Errorf("finalized block: have %v, want #%d", have, blocks[final].Number())
+		}
+		if have, ok := chain.SafeL1BlockNumber(); !ok || have != safeL1 {
+			t.Errorf("safe L1 block: have %d (%v), want %d", have, ok, safeL1)
+		}
+		if have, ok := chain.FinalizedL1BlockNumber(); !ok || have != finalL1 {
+			t.Errorf("finalized L1 block: have %d (%v), want %d", have, ok, finalL1)
+		}
+	}
+	check(chain, 5, 2, 100, 90)
+
+	// Finalizing past the safe block drags it along
+	if err := chain.SetFinalizedByL1(blocks[7].Hash(), 110); err != nil {
+		t.Fatalf("failed to set finalized block: %v", err)
+	}
+	check(chain, 7, 7, 110, 110)
+
+	// The safe block may move back on L1 reorgs, down to the finalized block
+	if err := chain.SetSafeByL1(blocks[9].Hash(), 120); err != nil {
+		t.Fatalf("failed to set safe block: %v", err)
+	}
+	if err := chain.SetSafeByL1(blocks[8].Hash(), 115); err != nil {
+		t.Fatalf("failed to move safe block back: %v", err)
+	}
+	check(chain, 8, 7, 115, 110)
+	chain.Stop()
+
+	// Both heads survive a restart
+	chain, err = NewBlockChain(db, nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to reopen chain: %v", err)
+	}
+	defer chain.Stop()
+	check(chain, 8, 7, 115, 110)
+
+	// Rewinding below the heads drops them along with their confirmations
+	if err := chain.SetHead(4); err != nil {
+		t.Fatalf("failed to rewind chain: %v", err)
+	}
+	if chain.CurrentSafeBlock() != nil || chain.CurrentFinalBlock() != nil {
+		t.Errorf("heads kept after rewind: safe %v, finalized %v", chain.CurrentSafeBlock(), chain.CurrentFinalBlock())
+	}
+	if _, ok := chain.SafeL1BlockNumber(); ok {
+		t.Error("safe L1 block kept after rewind")
+	}
+	if _, ok := chain.FinalizedL1BlockNumber(); ok {
+		t.Error("finalized L1 block kept after rewind")
+	}
+}
+
+// Tests that pinned states are committed to disk, and kept under their labels
+// until unpinned.
+func TestStatePins(t *testing.T) {
+	var (
+		db    = rawdb.NewMemoryDatabase()
+		gspec = &Genesis{Config: params.TestChainConfig}
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4, func(i int, gen *BlockGen) {
+		gen.SetCoinbase(common.Address{byte(i + 1)})
+	})
+	chain, err := NewBlockChain(db, nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	header := blocks[2].Header()
+	if rawdb.HasLegacyTrieNode(db, header.Root) {
+		t.Fatal("state already on disk")
+	}
+	pin, err := chain.PinState("dispute-12345", header)
+	if err != nil {
+		t.Fatalf("failed to pin state: %v", err)
+	}
+	if pin.Root != header.Root || pin.BlockHash != header.Hash() || pin.BlockNumber != 3 {
+		t.Errorf("unexpected pin: %+v", pin)
+	}
+	if !rawdb.HasLegacyTrieNode(db, header.Root) {
+		t.Error("pinned state not committed to disk")
+	}
+	// Pinning again is a no-op, reusing the label for another block fails
+	if again, err := chain.PinState("dispute-12345", header); err != nil || *again != *pin {
+		t.Errorf("repinning: have %+v (%v), want %+v", again, err, pin)
+	}
+	if _, err := chain.PinState("dispute-12345", blocks[3].Header()); !errors.Is(err, ErrStatePinExists) {
+		t.Errorf("reusing label: have %v, want %v", err, ErrStatePinExists)
+	}
+	if _, err := chain.PinState("dispute-1", blocks[3].Header()); err != nil {
+		t.Fatalf("failed to pin state: %v", err)
+	}
+	if have := chain.StatePin("dispute-12345"); have == nil || *have != *pin {
+		t.Errorf("pin lookup: have %+v, want %+v", have, pin)
+	}
+	pins := chain.StatePins()
+	if len(pins) != 2 || pins[0].Label != "dispute-1" || pins[1].Label != "dispute-12345" {
+		t.Errorf("unexpected pins: %+v", pins)
+	}
+	if err := chain.UnpinState("dispute-12345"); err != nil {
+		t.Fatalf("failed to unpin state: %v", err)
+	}
+	if err := chain.UnpinState("dispute-12345"); !errors.Is(err, ErrStatePinNotFound) {
+		t.Errorf("unpinning twice: have %v, want %v", err, ErrStatePinNotFound)
+	}
+	if pins := chain.StatePins(); len(pins) != 1 || chain.StatePin("dispute-12345") != nil {
+		t.Errorf("pin kept after unpinning: %+v", pins)
+	}
+}
+
+// Tests that every block written with its state is posted along with its write
+// status, whether it reorganised the chain, and the trie flush decisions.
+func TestBlockWriteEvents(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig}
+	cacheConfig := *defaultCacheConfig
+	cacheConfig.TrieDirtyDisabled = true // archive, committing every state
+
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), &cacheConfig, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	events := make(chan BlockWriteEvent, 16)
+	sub := chain.SubscribeBlockWriteEvent(events)
+	defer sub.Unsubscribe()
+
+	_, original, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, gen *BlockGen) {})
+	if _, err := chain.InsertChain(original); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// The replacement chain only gets heavier from its third block
+	_, replacement, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4, func(i int, gen *BlockGen) {
+		gen.SetExtra([]byte{1})
+		if i == 2 {
+			gen.OffsetTime(-9)
+		}
+	})
+	if _, err := chain.InsertChain(replacement); err != nil {
+		t.Fatalf("failed to insert replacement chain: %v", err)
+	}
+	want := []struct {
+		block  common.Hash
+		status WriteStatus
+		reorg  bool
+	}{
+		{original[0].Hash(), CanonStatTy, false},
+		{original[1].Hash(), CanonStatTy, false},
+		{original[2].Hash(), CanonStatTy, false},
+		{replacement[0].Hash(), SideStatTy, false},
+		{replacement[1].Hash(), SideStatTy, false},
+		{replacement[2].Hash(), CanonStatTy, true},
+		{replacement[3].Hash(), CanonStatTy, false},
+	}
+	for i, w := range want {
+		select {
+		case ev := <-events:
+			if ev.Block.Hash() != w.block || ev.Status != w.status || ev.Reorg != w.reorg {
+				t.Fatalf("event %d: have block %x %v (reorg %v), want %x %v (reorg %v)", i, ev.Block.Hash(), ev.Status, ev.Reorg, w.block, w.status, w.reorg)
+			}
+			if ev.TrieFlush != TrieFlushCommit {
+				t.Errorf("event %d: have trie flush %v, want %v", i, ev.TrieFlush, TrieFlushCommit)
+			}
+			if ev.ProcessTime == 0 {
+				t.Errorf("event %d: process time not reported", i)
+			}
+		default:
+			t.Fatalf("event %d missing", i)
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event for block %x", ev.Block.Hash())
+	default:
+	}
+}
+
+// Tests that an atomic insert either makes the whole batch canonical, or rolls
+// back to the previous head, deleting the blocks of the batch and their indexes.
+func TestInsertChainAtomic(t *testing.T) {
+	var (
+		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr   = crypto.PubkeyToAddress(key.PublicKey)
+		gspec  = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{addr: {Balance: big.NewInt(10000000000000000)}},
+		}
+		signer = types.LatestSigner(gspec.Config)
+		db     = rawdb.NewMemoryDatabase()
+	)
+	chain, err := NewBlockChain(db, nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 6, func(i int, gen *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(gen.TxNonce(addr), common.Address{1}, big.NewInt(1), 21000, gen.header.BaseFee, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		gen.AddTx(tx)
+	})
+	if _, err := chain.InsertChainAtomic(blocks[:2]); err != nil {
+		t.Fatalf("failed to insert valid batch: %v", err)
+	}
+	if head := chain.CurrentBlock(); head.Hash() != blocks[1].Hash() {
+		t.Fatalf("head not advanced: have #%d, want #%d", head.Number, blocks[1].Number())
+	}
+	// Corrupt the state root of the last block of the next batch
+	header := blocks[4].Header()
+	header.Root = common.Hash{1}
+	bad := append(types.Blocks{}, blocks[2:4]...)
+	bad = append(bad, types.NewBlockWithHeader(header).WithBody(blocks[4].Transactions(), nil))
+
+	if _, err := chain.InsertChainAtomic(bad); err == nil {
+		t.Fatal("invalid batch inserted")
+	}
+	if head := chain.CurrentBlock(); head.Hash() != blocks[1].Hash() {
+		t.Fatalf("head not rolled back: have #%d, want #%d", head.Number, blocks[1].Number())
+	}
+	for _, block := range bad {
+		if chain.HasBlock(block.Hash(), block.NumberU64()) {
+			t.Errorf("block #%d of rolled back batch still stored", block.NumberU64())
+		}
+		if hash := rawdb.ReadCanonicalHash(db, block.NumberU64()); hash != (common.Hash{}) {
+			t.Errorf("canonical hash of rolled back block #%d still stored", block.NumberU64())
+		}
+		if rawdb.ReadReceipts(db, block.Hash(), block.NumberU64(), block.Time(), gspec.Config) != nil {
+			t.Errorf("receipts of rolled back block #%d still stored", block.NumberU64())
+		}
+		for _, tx := range block.Transactions() {
+			if chain.GetTransactionLookup(tx.Hash()) != nil {
+				t.Errorf("lookup of transaction %x of rolled back block #%d still stored", tx.Hash(), block.NumberU64())
+			}
+		}
+	}
+	// The valid blocks can be imported again afterwards
+	if _, err := chain.InsertChainAtomic(blocks[2:]); err != nil {
+		t.Fatalf("failed to insert valid batch after rollback: %v", err)
+	}
+	if head := chain.CurrentBlock(); head.Hash() != blocks[5].Hash() {
+		t.Fatalf("head not advanced: have #%d, want #%d", head.Number, blocks[5].Number())
+	}
+}
+
+// Tests that rolling back an atomic insert longer than the tries kept in memory
+// and the snapshot diff layers restores a head whose state is still available.
+func TestInsertChainAtomicDeepRollback(t *testing.T) {
+	var (
+		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr   = crypto.PubkeyToAddress(key.PublicKey)
+		gspec  = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{addr: {Balance: big.NewInt(10000000000000000)}},
+		}
+		signer = types.LatestSigner(gspec.Config)
+		db     = rawdb.NewMemoryDatabase()
+	)
+	cacheConfig := *defaultCacheConfig
+	cacheConfig.TriesInMemory = 4
+	cacheConfig.TrieRetention = 0
+	cacheConfig.SnapshotDiffLayers = 2
+	cacheConfig.SnapshotWait = true
+
+	chain, err := NewBlockChain(db, &cacheConfig, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 12, func(i int, gen *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(gen.TxNonce(addr), common.Address{1}, big.NewInt(1), 21000, gen.header.BaseFee, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		gen.AddTx(tx)
+	})
+	if _, err := chain.InsertChainAtomic(blocks[:2]); err != nil {
+		t.Fatalf("failed to insert valid batch: %v", err)
+	}
+	previous := chain.CurrentBlock()
+
+	// Corrupt the state root of the last block of a batch longer than the tries in memory
+	header := blocks[11].Header()
+	header.Root = common.Hash{1}
+	bad := append(types.Blocks{}, blocks[2:11]...)
+	bad = append(bad, types.NewBlockWithHeader(header).WithBody(blocks[11].Transactions(), nil))
+
+	if _, err := chain.InsertChainAtomic(bad); err == nil {
+		t.Fatal("invalid batch inserted")
+	}
+	if head := chain.CurrentBlock(); head.Hash() != previous.Hash() {
+		t.Fatalf("head not rolled back: have #%d, want #%d", head.Number, previous.Number)
+	}
+	if !chain.HasState(previous.Root) {
+		t.Fatal("state of the rolled back head missing")
+	}
+	if chain.snaps.Snapshot(previous.Root) == nil {
+		t.Fatal("snapshot not following the rolled back head")
+	}
+	// The valid blocks can be imported on top of the rolled back head
+	if _, err := chain.InsertChainAtomic(blocks[2:]); err != nil {
+		t.Fatalf("failed to insert valid batch after rollback: %v", err)
+	}
+	if head := chain.CurrentBlock(); head.Hash() != blocks[11].Hash() {
+		t.Fatalf("head not advanced: have #%d, want #%d", head.Number, blocks[11].Number())
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/log"
+)
+
+// errAtomicInsertNotHead is returned if a batch imported by InsertChainAtomic
+// was valid but its last block didn't become the chain head.
+var errAtomicInsertNotHead = errors.New("batch didn't become the chain head")
+
+// InsertChainAtomic imports a batch of blocks like InsertChain, but either
+// advances the head to the last block of the batch or leaves the chain at its
+// head from before the batch. If any block fails, or the batch doesn't become
+// the canonical chain, the blocks imported so far are rolled back: the previous
+// head is restored along with its canonical chain and transaction indexes, and
+// the blocks the batch added are deleted with their receipts. Subscribers see
+// the rollback as a reorg back to the previous head.
+func (bc *BlockChain) InsertChainAtomic(chain types.Blocks) (int, error) {
+	if len(chain) == 0 {
+		return 0, nil
+	}
+	bc.blockProcFeed.Send(true)
+	defer bc.blockProcFeed.Send(false)
+
+	if err := checkContiguous(chain); err != nil {
+		return 0, err
+	}
+	if !bc.chainmu.TryLock() {
+		return 0, errChainStopped
+	}
+	defer bc.chainmu.Unlock()
+
+	// Keep the state of the previous head alive for the whole batch, as the
+	// garbage collection drops it once the batch is longer than the tries kept
+	// in memory, and a rollback needs it.
+	previous := bc.CurrentBlock()
+	bc.triedb.Reference(previous.Root, common.Hash{})
+
+	known := make([]bool, len(chain))
+	for i, block := range chain {
+		known[i] = bc.HasBlock(block.Hash(), block.NumberU64())
+	}
+	n, err := bc.insertChain(chain, true)
+	if err == nil && bc.CurrentBlock().Hash() != chain[len(chain)-1].Hash() {
+		err = errAtomicInsertNotHead
+	}
+	if err == nil {
+		bc.triedb.Dereference(previous.Root)
+		return n, nil
+	}
+	// The state is the head one again, hand the reference over to the garbage
+	// collection so it's released once the chain moves far enough past it
+	bc.triegc.Push(trieGcEntry{previous.Root, previous.Time}, -int64(previous.Number.Uint64()))
+
+	if rollbackErr := bc.rollbackInsert(previous, chain, known); rollbackErr != nil {
+		return n, fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+	}
+	return n, err
+}
+
+// rollbackInsert restores the head from before importing the batch, and deletes
+// the blocks of the batch that weren't stored before it. This function expects
+// the chain mutex to be held.
+func (bc *BlockChain) rollbackInsert(previous *types.Header, chain types.Blocks, known []bool) error {
+	if current := bc.CurrentBlock(); current.Hash() != previous.Hash() {
+		head := bc.GetBlock(previous.Hash(), previous.Number.Uint64())
+		if head == nil {
+			return errors.New("previous head block missing")
+		}
+		bc.writeHeadBlock(head)
+		if err := bc.reorg(current, head); err != nil {
+			return err
+		}
+		bc.restoreSnapshot(previous.Root)
+		bc.chainHeadFeed.Send(ChainHeadEvent{Block: head})
+		bc.fireHead(head)
+	}
+	batch := bc.db.NewBatch()
+	for i, block := range chain {
+		if known[i] {
+			continue
+		}
+		hash, number := block.Hash(), block.NumberU64()
+		rawdb.DeleteBlock(batch, hash, number)
+
+		bc.bodyCache.Remove(hash)
+		bc.bodyRLPCache.Remove(hash)
+		bc.receiptsCache.Remove(hash)
+		bc.blockCache.Remove(hash)
+		bc.futureBlocks.Remove(hash)
+		bc.hc.headerCache.Remove(hash)
+		bc.hc.tdCache.Remove(hash)
+		bc.hc.numberCache.Remove(hash)
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	bc.txLookupCache.Purge()
+
+	log.Warn("Rolled back atomic chain insert", "head", previous.Number, "hash", previous.Hash(), "batch", len(chain))
+	return nil
+}
+
+// restoreSnapshot makes the snapshot follow the state the head was rolled back
+// to. If the batch was deeper than the snapshot diff layers, the layer of the
+// state was flattened into the disk layer: it's reverted if it was spilled,
+// otherwise the snapshot is regenerated from the state.
+func (bc *BlockChain) restoreSnapshot(root common.Hash) {
+	if bc.snaps == nil || bc.snaps.Snapshot(root) != nil {
+		return
+	}
+	bc.revertSnapshot(root)
+	if bc.snaps.Snapshot(root) == nil {
+		log.Warn("Rolled back past the state snapshot, regenerating", "root", root)
+		bc.snaps.Rebuild(root)
+	}
+}
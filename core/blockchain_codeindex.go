@@ -0,0 +1,172 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+	"github.com/chainupcloud/arb-geth/trie"
+)
+
+// SetCodeIndexing enables or disables indexing the accounts of the imported
+// blocks by code hash, as they deploy code. The accounts existing from before
+// are added by BackfillCodeIndex.
+func (bc *BlockChain) SetCodeIndexing(enabled bool) {
+	bc.codeIndexing.Store(enabled)
+}
+
+// indexCode records the accounts whose code is set by the block in the code
+// hash index.
+func (bc *BlockChain) indexCode(block *types.Block, statedb *state.StateDB) {
+	dirty := statedb.DirtyCode()
+	if len(dirty) == 0 {
+		return
+	}
+	batch := bc.db.NewBatch()
+	for addr, codeHash := range dirty {
+		addr := addr
+		rawdb.WriteCodeIndexEntry(batch, codeHash, &rawdb.CodeIndexEntry{
+			AccountHash: crypto.Keccak256Hash(addr.Bytes()),
+			Address:     &addr,
+			BlockNumber: block.NumberU64(),
+		})
+	}
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to write code index", "err", err)
+	}
+}
+
+// BackfillCodeIndex adds the accounts with code in the head state to the code
+// hash index, resuming where it left off. The address of an account is known
+// only if its preimage is stored. Code indexing must be enabled beforehand, so
+// that no deployment is missed while the head moves on: the walk goes on from
+// where it stopped in whatever the head state is when resuming.
+func (bc *BlockChain) BackfillCodeIndex(ctx context.Context) error {
+	progress := rawdb.ReadCodeIndexProgress(bc.db)
+	if progress == nil {
+		progress = new(rawdb.CodeIndexProgress)
+	}
+	if progress.Done {
+		return nil
+	}
+	head := bc.CurrentBlock()
+	tr, err := trie.New(trie.StateTrieID(head.Root), bc.triedb)
+	if err != nil {
+		return err
+	}
+	var (
+		batch = bc.db.NewBatch()
+		it    = trie.NewIterator(tr.NodeIterator(progress.Next))
+	)
+	for it.Next() {
+		var account types.StateAccount
+		if err := rlp.DecodeBytes(it.Value, &account); err != nil {
+			return err
+		}
+		if codeHash := common.BytesToHash(account.CodeHash); codeHash != types.EmptyCodeHash {
+			entry := &rawdb.CodeIndexEntry{
+				AccountHash: common.BytesToHash(it.Key),
+				BlockNumber: head.Number.Uint64(),
+			}
+			if preimage := bc.triedb.Preimage(entry.AccountHash); len(preimage) == common.AddressLength {
+				addr := common.BytesToAddress(preimage)
+				entry.Address = &addr
+			}
+			rawdb.WriteCodeIndexEntry(batch, codeHash, entry)
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			progress.Next = common.CopyBytes(it.Key)
+			rawdb.WriteCodeIndexProgress(batch, progress)
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	}
+	if it.Err != nil {
+		return it.Err
+	}
+	progress.Next, progress.Done = nil, true
+	rawdb.WriteCodeIndexProgress(batch, progress)
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	log.Info("Backfilled code hash index", "number", head.Number)
+	return nil
+}
+
+// ContractsByCodeHash returns up to max of the accounts with the given code hash
+// in the state, ordered by account hash from start onwards, along with the hash
+// to resume from if there may be more. The candidates are taken from the code
+// hash index and checked against the state, which must be available.
+func (bc *BlockChain) ContractsByCodeHash(root common.Hash, codeHash common.Hash, start common.Hash, max int) ([]*rawdb.CodeIndexEntry, *common.Hash, error) {
+	tr, err := trie.NewStateTrie(trie.StateTrieID(root), bc.triedb)
+	if err != nil {
+		return nil, nil, err
+	}
+	page := max
+	if page == 0 {
+		page = 1024
+	}
+	var matches []*rawdb.CodeIndexEntry
+	for {
+		candidates := rawdb.ReadCodeIndexEntries(bc.db, codeHash, start, page)
+		for _, entry := range candidates {
+			if max > 0 && len(matches) == max {
+				next := entry.AccountHash
+				return matches, &next, nil
+			}
+			account, err := tr.GetAccountByHash(entry.AccountHash)
+			if err != nil {
+				return nil, nil, err
+			}
+			if account != nil && common.BytesToHash(account.CodeHash) == codeHash {
+				matches = append(matches, entry)
+			}
+		}
+		if len(candidates) < page {
+			return matches, nil, nil
+		}
+		next, ok := incHash(candidates[len(candidates)-1].AccountHash)
+		if !ok {
+			return matches, nil, nil
+		}
+		start = next
+	}
+}
+
+// incHash returns the hash right after the given one, if there is one.
+func incHash(h common.Hash) (common.Hash, bool) {
+	for i := len(h) - 1; i >= 0; i-- {
+		h[i]++
+		if h[i] != 0 {
+			return h, true
+		}
+	}
+	return h, false
+}
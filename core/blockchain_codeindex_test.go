@@ -0,0 +1,133 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that the contracts deployed by imported blocks and those backfilled from
+// the state are found by code hash, checked against the state.
+func TestCodeIndex(t *testing.T) {
+	var (
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr     = crypto.PubkeyToAddress(key.PublicKey)
+		runtime  = []byte{byte(vm.INVALID)}
+		codeHash = crypto.Keccak256Hash(runtime)
+		existing = common.Address{0xc0}
+		gspec    = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: GenesisAlloc{
+				addr:     {Balance: big.NewInt(10000000000000000)},
+				existing: {Balance: big.NewInt(1), Code: runtime},
+			},
+		}
+		signer = types.LatestSigner(gspec.Config)
+		db     = rawdb.NewMemoryDatabase()
+	)
+	chain, err := NewBlockChain(db, nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	chain.SetCodeIndexing(true)
+
+	// Deploy the same runtime code twice: MSTORE8 it at 0 and return 1 byte
+	initcode := []byte{
+		byte(vm.PUSH1), runtime[0], byte(vm.PUSH1), 0, byte(vm.MSTORE8),
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.RETURN),
+	}
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 2, func(i int, gen *BlockGen) {
+		if i > 0 {
+			return
+		}
+		for j := 0; j < 2; j++ {
+			tx, err := types.SignTx(types.NewContractCreation(gen.TxNonce(addr), new(big.Int), 100000, gen.header.BaseFee, initcode), signer, key)
+			if err != nil {
+				t.Fatalf("failed to sign tx: %v", err)
+			}
+			gen.AddTx(tx)
+		}
+	})
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	deployed := map[common.Hash]common.Address{}
+	for nonce := uint64(0); nonce < 2; nonce++ {
+		contract := crypto.CreateAddress(addr, nonce)
+		deployed[crypto.Keccak256Hash(contract.Bytes())] = contract
+	}
+	// A stale entry of an account without the code is filtered out
+	rawdb.WriteCodeIndexEntry(db, codeHash, &rawdb.CodeIndexEntry{AccountHash: crypto.Keccak256Hash(addr.Bytes())})
+
+	root := chain.CurrentBlock().Root
+	matches, next, err := chain.ContractsByCodeHash(root, codeHash, common.Hash{}, 0)
+	if err != nil {
+		t.Fatalf("failed to enumerate contracts: %v", err)
+	}
+	if len(matches) != len(deployed) || next != nil {
+		t.Fatalf("have %d contracts (next %v), want %d", len(matches), next, len(deployed))
+	}
+	for _, entry := range matches {
+		if want, ok := deployed[entry.AccountHash]; !ok || entry.Address == nil || *entry.Address != want || entry.BlockNumber != 1 {
+			t.Fatalf("unexpected contract %+v", entry)
+		}
+	}
+	// Backfilling adds the contract from the genesis state
+	if err := chain.BackfillCodeIndex(context.Background()); err != nil {
+		t.Fatalf("failed to backfill code index: %v", err)
+	}
+	if progress := rawdb.ReadCodeIndexProgress(db); progress == nil || !progress.Done {
+		t.Fatalf("backfill not done: %+v", progress)
+	}
+	deployed[crypto.Keccak256Hash(existing.Bytes())] = existing
+
+	var all []*rawdb.CodeIndexEntry
+	start := common.Hash{}
+	for page := 0; ; page++ {
+		matches, next, err := chain.ContractsByCodeHash(root, codeHash, start, 2)
+		if err != nil {
+			t.Fatalf("failed to enumerate contracts: %v", err)
+		}
+		all = append(all, matches...)
+		if next == nil {
+			break
+		}
+		if page > len(deployed) {
+			t.Fatal("pagination not converging")
+		}
+		start = *next
+	}
+	if len(all) != len(deployed) {
+		t.Fatalf("have %d contracts after backfill, want %d", len(all), len(deployed))
+	}
+	for _, entry := range all {
+		if _, ok := deployed[entry.AccountHash]; !ok {
+			t.Fatalf("unexpected contract %x", entry.AccountHash)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/consensus"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/event"
+	"github.com/chainupcloud/arb-geth/trie"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+)
+
+// errMirrorSnapshots is returned when mirroring blocks into a chain maintaining
+// state snapshots, which mirroring doesn't update.
+var errMirrorSnapshots = errors.New("state mirroring requires snapshots to be disabled")
+
+// SubscribeStateUpdates registers a subscription of the state transitions
+// committed into the trie database, which WriteMirroredBlock applies on
+// another node.
+func (bc *BlockChain) SubscribeStateUpdates(ch chan<- trie.UpdateEvent) event.Subscription {
+	return bc.scope.Track(bc.triedb.SubscribeUpdates(ch))
+}
+
+// WriteMirroredBlock writes a block executed by another node, along with the
+// trie nodes its state commit produced there, and applies it as the new chain
+// head if it makes the chain heavier, without executing it. The state of the
+// parent block must be available. The receipts must have their derived fields
+// set, as the logs are posted to the subscribers. The processing time feeds
+// the periodic flush of the in-memory state, and the state root is announced to
+// the state root listeners, as for executed blocks.
+func (bc *BlockChain) WriteMirroredBlock(block *types.Block, receipts types.Receipts, nodes *trienode.MergedNodeSet, processTime time.Duration) (WriteStatus, error) {
+	if bc.snaps != nil {
+		return NonStatTy, errMirrorSnapshots
+	}
+	if !bc.chainmu.TryLock() {
+		return NonStatTy, errChainStopped
+	}
+	defer bc.chainmu.Unlock()
+
+	parent := bc.GetHeader(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return NonStatTy, consensus.ErrUnknownAncestor
+	}
+	if !bc.HasState(parent.Root) {
+		return NonStatTy, consensus.ErrPrunedAncestor
+	}
+	if nodes != nil && block.Root() != parent.Root {
+		if err := bc.triedb.Update(block.Root(), parent.Root, nodes); err != nil {
+			return NonStatTy, err
+		}
+	}
+	if !bc.HasState(block.Root()) {
+		return NonStatTy, fmt.Errorf("state %x of mirrored block %d not provided", block.Root(), block.NumberU64())
+	}
+	bc.announceStateRoot(block, true)
+	if err := bc.writeBlockData(block, receipts, nil); err != nil {
+		return NonStatTy, err
+	}
+	bc.gcproc += processTime
+	flush, err := bc.retainBlockState(block, block.Root())
+	if err != nil {
+		return NonStatTy, err
+	}
+	var logs []*types.Log
+	for _, receipt := range receipts {
+		logs = append(logs, receipt.Logs...)
+	}
+	return bc.updateHeadWithBlock(block, logs, true, processTime, flush)
+}
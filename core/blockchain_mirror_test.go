@@ -0,0 +1,134 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+	"github.com/chainupcloud/arb-geth/trie"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+)
+
+// Tests that a chain mirroring the state updates of another one tracks its head
+// and state without executing the blocks.
+func TestWriteMirroredBlock(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{address: {Balance: big.NewInt(params.Ether)}},
+		}
+		engine = ethash.NewFaker()
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, engine, 8, func(i int, gen *BlockGen) {
+		for j := 0; j < 3; j++ {
+			to := common.BigToAddress(big.NewInt(int64(0x1000 + i*3 + j)))
+			tx, _ := types.SignTx(types.NewTransaction(gen.TxNonce(address), to, big.NewInt(1000), params.TxGas, gen.header.BaseFee, nil), signer, key)
+			gen.AddTx(tx)
+		}
+	})
+	primary, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create primary chain: %v", err)
+	}
+	defer primary.Stop()
+
+	updatesCh := make(chan trie.UpdateEvent, len(blocks))
+	sub := primary.SubscribeStateUpdates(updatesCh)
+	defer sub.Unsubscribe()
+
+	if _, err := primary.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	updates := make(map[common.Hash]*trienode.MergedNodeSet)
+	for len(updatesCh) > 0 {
+		update := <-updatesCh
+		updates[update.Root] = update.Nodes
+	}
+	config := &CacheConfig{
+		TrieCleanLimit: 256,
+		TrieDirtyLimit: 256,
+		TrieTimeLimit:  5 * time.Minute,
+		TriesInMemory:  128,
+	}
+	mirror, err := NewBlockChain(rawdb.NewMemoryDatabase(), config, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create mirror chain: %v", err)
+	}
+	defer mirror.Stop()
+
+	var announced []*StateRootAnnouncement
+	mirror.AddStateRootListener(func(a *StateRootAnnouncement) {
+		if mirror.HasBlock(a.Hash, a.Number) {
+			t.Errorf("block %d written before its root is announced", a.Number)
+		}
+		announced = append(announced, a)
+	})
+	// Blocks can't be mirrored ahead of their parent
+	if _, err := mirror.WriteMirroredBlock(blocks[1], primary.GetReceiptsByHash(blocks[1].Hash()), updates[blocks[1].Root()], 0); !errors.Is(err, consensus.ErrUnknownAncestor) {
+		t.Fatalf("mirrored block ahead of parent: have %v, want %v", err, consensus.ErrUnknownAncestor)
+	}
+	// Nor without the state they commit
+	if _, err := mirror.WriteMirroredBlock(blocks[0], primary.GetReceiptsByHash(blocks[0].Hash()), nil, 0); err == nil {
+		t.Fatal("mirrored block without state")
+	}
+	for _, block := range blocks {
+		status, err := mirror.WriteMirroredBlock(block, primary.GetReceiptsByHash(block.Hash()), updates[block.Root()], 0)
+		if err != nil {
+			t.Fatalf("block %d: failed to mirror: %v", block.NumberU64(), err)
+		}
+		if status != CanonStatTy {
+			t.Fatalf("block %d: wrong status: have %v, want %v", block.NumberU64(), status, CanonStatTy)
+		}
+	}
+	if len(announced) != len(blocks) {
+		t.Fatalf("have %d announcements, want %d", len(announced), len(blocks))
+	}
+	for i, a := range announced {
+		if a.Number != blocks[i].NumberU64() || a.Hash != blocks[i].Hash() || a.Root != blocks[i].Root() || !a.SetHead {
+			t.Errorf("announcement %d mismatch: %+v", i, a)
+		}
+	}
+	if head := mirror.CurrentBlock(); head.Hash() != primary.CurrentBlock().Hash() {
+		t.Fatalf("head mismatch: have %d, want %d", head.Number, primary.CurrentBlock().Number)
+	}
+	statedb, err := mirror.State()
+	if err != nil {
+		t.Fatalf("mirrored head state unavailable: %v", err)
+	}
+	for i := 0; i < len(blocks)*3; i++ {
+		if balance := statedb.GetBalance(common.BigToAddress(big.NewInt(int64(0x1000 + i)))); balance.Cmp(big.NewInt(1000)) != 0 {
+			t.Errorf("account %d: wrong balance: have %v, want 1000", i, balance)
+		}
+	}
+	if receipts := mirror.GetReceiptsByHash(blocks[2].Hash()); len(receipts) != 3 {
+		t.Errorf("mirrored receipts missing: have %d, want 3", len(receipts))
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/event"
+)
+
+// flushImminentRatio is the share of the dirty cache limit or flush interval
+// from which a flush is reported imminent.
+const flushImminentRatio = 0.9
+
+// maxDirtyPreimages is the size of the preimages held in memory from which the
+// dirty trie nodes are flushed along with them.
+const maxDirtyPreimages = 4 * 1024 * 1024
+
+// FlushPressureLevel tells how close the chain is to stall a block import
+// flushing the dirty state to disk.
+type FlushPressureLevel byte
+
+const (
+	FlushPressureNone     FlushPressureLevel = iota // No flush is due soon
+	FlushPressureImminent                           // A flush is due within a few blocks
+	FlushPressurePause                              // The next import flushes, pausing to call FlushDirtyState is recommended
+)
+
+func (l FlushPressureLevel) String() string {
+	switch l {
+	case FlushPressureNone:
+		return "none"
+	case FlushPressureImminent:
+		return "imminent"
+	case FlushPressurePause:
+		return "pause"
+	}
+	return "unknown"
+}
+
+// FlushPressure is the state of the dirty trie cache after the last block
+// write, against the limits triggering a flush on import.
+type FlushPressure struct {
+	Level         FlushPressureLevel
+	Dirty         common.StorageSize // Size of the dirty trie nodes held in memory
+	DirtyLimit    common.StorageSize // Size of the dirty nodes above which some are flushed
+	Preimages     common.StorageSize // Size of the preimages held in memory
+	ProcTime      time.Duration      // Processing time of the blocks since the last state commit
+	FlushInterval time.Duration      // Processing time after which a state is committed
+}
+
+// FlushPressureEvent is posted when the flush pressure level changes.
+type FlushPressureEvent struct {
+	Pressure *FlushPressure
+}
+
+// FlushPressure returns how close the chain is to stall a block import to flush
+// the dirty state, as of the last block written, so that the imports can be
+// scheduled around the flushes.
+func (bc *BlockChain) FlushPressure() *FlushPressure {
+	if p := bc.flushPressure.Load(); p != nil {
+		return p
+	}
+	nodes, imgs := bc.triedb.Size()
+	return &FlushPressure{
+		Dirty:         nodes,
+		DirtyLimit:    common.StorageSize(bc.cacheConfig.TrieDirtyLimit) * 1024 * 1024,
+		Preimages:     imgs,
+		FlushInterval: time.Duration(bc.flushInterval.Load()),
+	}
+}
+
+// SubscribeFlushPressureEvent registers a subscription of FlushPressureEvent.
+func (bc *BlockChain) SubscribeFlushPressureEvent(ch chan<- FlushPressureEvent) event.Subscription {
+	return bc.scope.Track(bc.pressureFeed.Subscribe(ch))
+}
+
+// updateFlushPressure recomputes the flush pressure, announcing the changes of
+// level. This function expects the chain mutex to be held.
+func (bc *BlockChain) updateFlushPressure() {
+	nodes, imgs := bc.triedb.Size()
+	p := &FlushPressure{
+		Dirty:         nodes,
+		DirtyLimit:    common.StorageSize(bc.cacheConfig.TrieDirtyLimit) * 1024 * 1024,
+		Preimages:     imgs,
+		ProcTime:      bc.gcproc,
+		FlushInterval: time.Duration(bc.flushInterval.Load()),
+	}
+	switch {
+	case p.Dirty > p.DirtyLimit || p.Preimages > maxDirtyPreimages || p.ProcTime > p.FlushInterval:
+		p.Level = FlushPressurePause
+	case float64(p.Dirty) > float64(p.DirtyLimit)*flushImminentRatio || float64(p.ProcTime) > float64(p.FlushInterval)*flushImminentRatio:
+		p.Level = FlushPressureImminent
+	}
+	if prev := bc.flushPressure.Swap(p); prev == nil || prev.Level != p.Level {
+		bc.pressureFeed.Send(FlushPressureEvent{Pressure: p})
+	}
+}
+
+// FlushDirtyState flushes the dirty state the next block import would, at a
+// time of the caller's choosing: the dirty nodes above the memory limit, or the
+// head state if the flush interval elapsed. If force is set, the head state is
+// committed regardless, restarting the flush interval.
+func (bc *BlockChain) FlushDirtyState(force bool) (TrieFlush, error) {
+	if !bc.chainmu.TryLock() {
+		return 0, errChainStopped
+	}
+	defer bc.chainmu.Unlock()
+	defer bc.updateFlushPressure()
+
+	var (
+		flush       TrieFlush
+		nodes, imgs = bc.triedb.Size()
+		limit       = common.StorageSize(bc.cacheConfig.TrieDirtyLimit) * 1024 * 1024
+	)
+	if force || bc.gcproc > time.Duration(bc.flushInterval.Load()) {
+		head := bc.CurrentBlock()
+		if err := bc.triedb.Commit(head.Root, false); err != nil {
+			return flush, err
+		}
+		bc.lastWrite = head.Number.Uint64()
+		bc.gcproc = 0
+		return flush | TrieFlushInterval, nil
+	}
+	if nodes > limit || imgs > maxDirtyPreimages {
+		if err := bc.triedb.Cap(limit - ethdb.IdealBatchSize); err != nil {
+			return flush, err
+		}
+		flush |= TrieFlushCap
+	}
+	return flush, nil
+}
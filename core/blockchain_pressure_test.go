@@ -0,0 +1,98 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that the flush pressure tracks the dirty state, announces its level
+// changes and is relieved by an explicit flush.
+func TestFlushPressure(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr    = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{Config: params.TestChainConfig, Alloc: GenesisAlloc{addr: {Balance: big.NewInt(params.Ether)}}}
+		signer  = types.LatestSigner(gspec.Config)
+		to      = common.Address{0x01}
+		_, b, _ = GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, gen *BlockGen) {
+			tx, _ := types.SignTx(types.NewTransaction(gen.TxNonce(addr), to, big.NewInt(1000), params.TxGas, gen.header.BaseFee, nil), signer, key)
+			gen.AddTx(tx)
+		})
+	)
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(b); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	p := chain.FlushPressure()
+	if p.Level != FlushPressureNone || p.Dirty == 0 || p.ProcTime == 0 {
+		t.Fatalf("unexpected pressure after import: %+v", p)
+	}
+	events := make(chan FlushPressureEvent, 1)
+	sub := chain.SubscribeFlushPressureEvent(events)
+	defer sub.Unsubscribe()
+
+	// Shorten the flush interval below the processing time since the last commit
+	chain.SetTrieFlushInterval(time.Nanosecond)
+	chain.chainmu.MustLock()
+	chain.updateFlushPressure()
+	chain.chainmu.Unlock()
+
+	select {
+	case ev := <-events:
+		if ev.Pressure.Level != FlushPressurePause {
+			t.Fatalf("have level %v, want %v", ev.Pressure.Level, FlushPressurePause)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no pressure event")
+	}
+	chain.SetTrieFlushInterval(time.Hour)
+	dirty := chain.FlushPressure().Dirty
+	flush, err := chain.FlushDirtyState(true)
+	if err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if flush&TrieFlushInterval == 0 {
+		t.Fatalf("head state not committed: %v", flush)
+	}
+	if p := chain.FlushPressure(); p.Level != FlushPressureNone || p.Dirty >= dirty || p.ProcTime != 0 {
+		t.Fatalf("unexpected pressure after flush: %+v", p)
+	}
+	select {
+	case ev := <-events:
+		if ev.Pressure.Level != FlushPressureNone {
+			t.Fatalf("have level %v, want %v", ev.Pressure.Level, FlushPressureNone)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no pressure event")
+	}
+}
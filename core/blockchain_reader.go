@@ -27,6 +27,7 @@ import (
 	"github.com/chainupcloud/arb-geth/core/types"
 	"github.com/chainupcloud/arb-geth/core/vm"
 	"github.com/chainupcloud/arb-geth/event"
+	"github.com/chainupcloud/arb-geth/log"
 	"github.com/chainupcloud/arb-geth/params"
 	"github.com/chainupcloud/arb-geth/rlp"
 	"github.com/chainupcloud/arb-geth/trie"
@@ -229,6 +230,34 @@ func (bc *BlockChain) GetReceiptsByHash(hash common.Hash) types.Receipts {
 	return receipts
 }
 
+// GetHeadersByRange retrieves the canonical headers of the blocks [from,
+// from+count), in ascending order, stopping before the first missing one. The
+// frozen headers are read in a single sequential freezer scan instead of one
+// access per block, which suits range queries such as the log filters'.
+func (bc *BlockChain) GetHeadersByRange(from, count uint64) []*types.Header {
+	return rawdb.ReadHeadersRange(bc.db, from, count)
+}
+
+// GetReceiptsByRange retrieves the receipts of the canonical blocks [from,
+// from+count), in ascending order, with their metadata fields derived. It stops
+// before the first block whose receipts are missing. Like GetHeadersByRange,
+// the frozen data is read with sequential freezer scans.
+func (bc *BlockChain) GetReceiptsByRange(from, count uint64) []types.Receipts {
+	var (
+		headers  = rawdb.ReadHeadersRange(bc.db, from, count)
+		bodies   = rawdb.ReadBodiesRange(bc.db, from, uint64(len(headers)))
+		receipts = rawdb.ReadRawReceiptsRange(bc.db, from, uint64(len(bodies)))
+	)
+	for i, blockReceipts := range receipts {
+		header := headers[i]
+		if err := blockReceipts.DeriveFields(bc.chainConfig, header.Hash(), header.Number.Uint64(), header.Time, header.BaseFee, bodies[i].Transactions); err != nil {
+			log.Error("Failed to derive block receipts fields", "hash", header.Hash(), "number", header.Number, "err", err)
+			return receipts[:i]
+		}
+	}
+	return receipts
+}
+
 // GetUnclesInChain retrieves all the uncles from a given block backwards until
 // a specific distance is reached.
 func (bc *BlockChain) GetUnclesInChain(block *types.Block, length int) []*types.Header {
@@ -321,8 +350,28 @@ func (bc *BlockChain) StateAt(root common.Hash) (*state.StateDB, error) {
 	return state.New(root, bc.stateCache, bc.snaps)
 }
 
-// Config retrieves the chain's fork configuration.
-func (bc *BlockChain) Config() *params.ChainConfig { return bc.chainConfig }
+// Config retrieves the chain's fork configuration, in effect for the block
+// following the current head.
+func (bc *BlockChain) Config() *params.ChainConfig {
+	schedule := bc.paramsSchedule.Load()
+	if schedule == nil || len(schedule.updates) == 0 {
+		return bc.chainConfig
+	}
+	if head := bc.CurrentBlock(); head != nil {
+		return schedule.at(head.Number.Uint64() + 1)
+	}
+	return bc.chainConfig
+}
+
+// ConfigAt retrieves the chain's fork configuration in effect for the block
+// with the given number.
+func (bc *BlockChain) ConfigAt(number uint64) *params.ChainConfig {
+	schedule := bc.paramsSchedule.Load()
+	if schedule == nil {
+		return bc.chainConfig
+	}
+	return schedule.at(number)
+}
 
 // Engine retrieves the blockchain's consensus engine.
 func (bc *BlockChain) Engine() consensus.Engine { return bc.engine }
@@ -365,13 +414,21 @@ func (bc *BlockChain) GetVMConfig() *vm.Config {
 // SetTxLookupLimit is responsible for updating the txlookup limit to the
 // original one stored in db if the new mismatches with the old one.
 func (bc *BlockChain) SetTxLookupLimit(limit uint64) {
-	bc.txLookupLimit = limit
+	bc.txLookupLimit.Store(limit)
+
+	// Apply the new limit right away instead of waiting for the next head
+	if bc.txIndexKick != nil {
+		select {
+		case bc.txIndexKick <- struct{}{}:
+		default:
+		}
+	}
 }
 
 // TxLookupLimit retrieves the txlookup limit used by blockchain to prune
 // stale transaction indices.
 func (bc *BlockChain) TxLookupLimit() uint64 {
-	return bc.txLookupLimit
+	return bc.txLookupLimit.Load()
 }
 
 // TrieDB retrieves the low level trie database used for data storage.
@@ -394,6 +451,12 @@ func (bc *BlockChain) SubscribeChainHeadEvent(ch chan<- ChainHeadEvent) event.Su
 	return bc.scope.Track(bc.chainHeadFeed.Subscribe(ch))
 }
 
+// SubscribeBlockWriteEvent registers a subscription of BlockWriteEvent, posted
+// for every block written with its state, canonical or not.
+func (bc *BlockChain) SubscribeBlockWriteEvent(ch chan<- BlockWriteEvent) event.Subscription {
+	return bc.scope.Track(bc.writeFeed.Subscribe(ch))
+}
+
 // SubscribeChainSideEvent registers a subscription of ChainSideEvent.
 func (bc *BlockChain) SubscribeChainSideEvent(ch chan<- ChainSideEvent) event.Subscription {
 	return bc.scope.Track(bc.chainSideFeed.Subscribe(ch))
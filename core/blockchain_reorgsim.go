@@ -0,0 +1,79 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+)
+
+// ReorgSimulation describes what a reorg of the chain to a new head would
+// change, as computed by SimulateReorg.
+type ReorgSimulation struct {
+	OldHead *types.Header // Current head the reorg would replace
+	NewHead *types.Header // Head the reorg would set
+	Common  *types.Header // Common ancestor of the old and new heads
+
+	Unwound     []*types.Header    // Blocks dropped from the canonical chain, from the old head down
+	Applied     []*types.Header    // Blocks made canonical, up to the new head
+	DroppedTxs  types.Transactions // Transactions of the unwound blocks not in the applied ones, returning to the pool
+	RemovedLogs []*types.Log       // Logs of the unwound blocks, marked removed
+
+	HasState bool // Whether the state of the new head is available
+}
+
+// SimulateReorg computes which blocks a reorg to the given head, such as one
+// by ReorgToOldBlock, would unwind and apply, which transactions it would drop
+// back to the pool and which logs it would remove, without changing anything.
+func (bc *BlockChain) SimulateReorg(newHead *types.Block) (*ReorgSimulation, error) {
+	oldHead := bc.CurrentBlock()
+	sim := &ReorgSimulation{
+		OldHead:  oldHead,
+		NewHead:  newHead.Header(),
+		Common:   newHead.Header(),
+		HasState: bc.HasState(newHead.Root()),
+	}
+	if oldHead.Hash() == newHead.Hash() {
+		return sim, nil
+	}
+	oldChain, newChain, commonBlock, err := bc.reorgChains(oldHead, newHead)
+	if err != nil {
+		return nil, err
+	}
+	sim.Common = commonBlock.Header()
+
+	added := make(map[common.Hash]struct{})
+	for i := len(newChain) - 1; i >= 0; i-- {
+		sim.Applied = append(sim.Applied, newChain[i].Header())
+		for _, tx := range newChain[i].Transactions() {
+			added[tx.Hash()] = struct{}{}
+		}
+	}
+	for _, block := range oldChain {
+		sim.Unwound = append(sim.Unwound, block.Header())
+		for _, tx := range block.Transactions() {
+			if _, ok := added[tx.Hash()]; !ok {
+				sim.DroppedTxs = append(sim.DroppedTxs, tx)
+			}
+		}
+	}
+	// Logs are removed from the oldest block up, as the reorg notifies them
+	for i := len(oldChain) - 1; i >= 0; i-- {
+		sim.RemovedLogs = append(sim.RemovedLogs, bc.collectLogs(oldChain[i], true)...)
+	}
+	return sim, nil
+}
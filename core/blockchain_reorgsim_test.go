@@ -0,0 +1,96 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that simulating a reorg to an old block reports what the reorg then
+// does, without changing the chain.
+func TestSimulateReorg(t *testing.T) {
+	var (
+		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr   = crypto.PubkeyToAddress(key.PublicKey)
+		gspec  = &Genesis{Config: params.TestChainConfig, Alloc: GenesisAlloc{addr: {Balance: big.NewInt(params.Ether)}}}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 5, func(i int, gen *BlockGen) {
+		tx, err := types.SignTx(types.NewContractCreation(gen.TxNonce(addr), new(big.Int), 1000000, gen.header.BaseFee, logCode), signer, key)
+		if err != nil {
+			t.Fatalf("failed to create tx: %v", err)
+		}
+		gen.AddTx(tx)
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	head := chain.CurrentBlock()
+
+	sim, err := chain.SimulateReorg(blocks[1])
+	if err != nil {
+		t.Fatalf("failed to simulate reorg: %v", err)
+	}
+	if chain.CurrentBlock().Hash() != head.Hash() {
+		t.Fatalf("simulation changed the head")
+	}
+	if sim.OldHead.Hash() != head.Hash() || sim.Common.Hash() != blocks[1].Hash() || !sim.HasState {
+		t.Fatalf("unexpected simulation: %+v", sim)
+	}
+	if len(sim.Unwound) != 3 || len(sim.Applied) != 0 {
+		t.Fatalf("have %d unwound and %d applied blocks, want 3 and 0", len(sim.Unwound), len(sim.Applied))
+	}
+	for i, header := range sim.Unwound {
+		if header.Hash() != blocks[4-i].Hash() {
+			t.Errorf("unwound block %d mismatch", i)
+		}
+	}
+	if len(sim.DroppedTxs) != 3 || len(sim.RemovedLogs) != 3 {
+		t.Fatalf("have %d dropped txs and %d removed logs, want 3 and 3", len(sim.DroppedTxs), len(sim.RemovedLogs))
+	}
+	for i, log := range sim.RemovedLogs {
+		if !log.Removed || log.BlockNumber != uint64(i+3) {
+			t.Errorf("removed log %d mismatch: %+v", i, log)
+		}
+	}
+	// The reorg itself must drop what was simulated
+	rmLogsCh := make(chan RemovedLogsEvent, 1)
+	sub := chain.SubscribeRemovedLogsEvent(rmLogsCh)
+	defer sub.Unsubscribe()
+	if err := chain.ReorgToOldBlock(blocks[1]); err != nil {
+		t.Fatalf("failed to reorg: %v", err)
+	}
+	if ev := <-rmLogsCh; len(ev.Logs) != len(sim.RemovedLogs) {
+		t.Fatalf("have %d removed logs, simulated %d", len(ev.Logs), len(sim.RemovedLogs))
+	}
+	if sim, err := chain.SimulateReorg(blocks[4]); err != nil || len(sim.Applied) != 3 || len(sim.Unwound) != 0 {
+		t.Fatalf("unexpected simulation of the reorg back: %+v, %v", sim, err)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/log"
+)
+
+// RetentionPolicy selects the block states that survive the garbage collection
+// of the dirty trie cache. States of recent blocks are kept in memory (flushed
+// to disk only under memory pressure), while the states of interval blocks and
+// of tagged roots are persisted to disk when they're garbage collected. So are
+// the states of the dispute window blocks, see SetDisputeWindow.
+type RetentionPolicy struct {
+	Recent        uint64 // Number of latest blocks whose state is kept in memory, TriesInMemory if lower
+	Interval      uint64 // Persist the state of every Interval-th block, 0 to disable
+	DisputeStride uint64 // Persist the state of every DisputeStride-th block of the dispute window (1 = every block, 0 = disabled)
+}
+
+// disputeWindowRefresh is how long the start of the dispute window is cached
+// before being asked for again.
+const disputeWindowRefresh = 30 * time.Second
+
+// DisputeWindowFunc returns the number of the oldest block whose state the
+// rollup may still need, e.g. to prove fraud against an assertion that isn't
+// confirmed on L1 yet. It fails if the window isn't known.
+type DisputeWindowFunc func() (uint64, error)
+
+// retentionState holds the retention policy and the tagged state roots.
+type retentionState struct {
+	policy        RetentionPolicy
+	tags          map[common.Hash]string
+	disputeWindow DisputeWindowFunc
+	windowID      uint64 // Incremented on every window change, to drop stale fetches
+
+	windowStart      uint64    // Cached start of the dispute window
+	windowKnown      bool      // Whether the window start was ever fetched successfully
+	windowUpdated    time.Time // Time of the last window fetch, successful or not
+	windowRefreshing bool      // Whether a window fetch is in flight
+}
+
+// RetentionPolicy returns the current state retention policy.
+func (bc *BlockChain) RetentionPolicy() RetentionPolicy {
+	bc.retentionLock.RLock()
+	defer bc.retentionLock.RUnlock()
+
+	return bc.retention.policy
+}
+
+// SetRetentionPolicy updates the state retention policy. It only applies to the
+// states still held in memory, the ones already garbage collected are lost.
+func (bc *BlockChain) SetRetentionPolicy(policy RetentionPolicy) {
+	bc.retentionLock.Lock()
+	defer bc.retentionLock.Unlock()
+
+	bc.retention.policy = policy
+}
+
+// TagState marks the state with the given root to be persisted when it would
+// otherwise be garbage collected, e.g. because it's relevant to a dispute. The
+// root may also belong to a block not processed yet. If the state was already
+// garbage collected, it's persisted the next time it gets recreated.
+func (bc *BlockChain) TagState(root common.Hash, tag string) {
+	bc.retentionLock.Lock()
+	defer bc.retentionLock.Unlock()
+
+	if bc.retention.tags == nil {
+		bc.retention.tags = make(map[common.Hash]string)
+	}
+	bc.retention.tags[root] = tag
+}
+
+// UntagState removes the tag of the state with the given root. A state already
+// persisted to disk stays there.
+func (bc *BlockChain) UntagState(root common.Hash) {
+	bc.retentionLock.Lock()
+	defer bc.retentionLock.Unlock()
+
+	delete(bc.retention.tags, root)
+}
+
+// TaggedStates returns the tagged state roots along with their tags.
+func (bc *BlockChain) TaggedStates() map[common.Hash]string {
+	bc.retentionLock.RLock()
+	defer bc.retentionLock.RUnlock()
+
+	tags := make(map[common.Hash]string, len(bc.retention.tags))
+	for root, tag := range bc.retention.tags {
+		tags[root] = tag
+	}
+	return tags
+}
+
+// SetDisputeWindow sets the callback telling where the dispute window starts.
+// The states of the window's first block and of every DisputeStride-th block
+// counting from it are persisted when they're garbage collected, the ones the
+// offline pruner keeps for the same window. While the window isn't known, the
+// states of all blocks are, lest a state the rollup still needs is lost.
+//
+// The window start is cached and refreshed in the background, so the callback
+// is never waited for while blocks are being processed. As the window only
+// moves forward, a stale start merely persists a few states more.
+func (bc *BlockChain) SetDisputeWindow(window DisputeWindowFunc) {
+	bc.retentionLock.Lock()
+	defer bc.retentionLock.Unlock()
+
+	bc.retention.disputeWindow = window
+	bc.retention.windowID++
+	bc.retention.windowStart, bc.retention.windowKnown = 0, false
+	bc.retention.windowUpdated = time.Time{}
+}
+
+// DisputeWindowStart returns the number of the first block of the dispute
+// window, failing if no window is set or it isn't known. The window is asked
+// for directly, refreshing the cached start.
+func (bc *BlockChain) DisputeWindowStart() (uint64, error) {
+	bc.retentionLock.RLock()
+	window, id := bc.retention.disputeWindow, bc.retention.windowID
+	bc.retentionLock.RUnlock()
+
+	if window == nil {
+		return 0, errors.New("no dispute window set")
+	}
+	first, err := window()
+	bc.updateDisputeWindow(id, first, err)
+	return first, err
+}
+
+// updateDisputeWindow caches the result of fetching the dispute window start,
+// unless the window was replaced in the meantime.
+func (bc *BlockChain) updateDisputeWindow(id uint64, first uint64, err error) {
+	bc.retentionLock.Lock()
+	defer bc.retentionLock.Unlock()
+
+	if id != bc.retention.windowID {
+		return
+	}
+	if err == nil {
+		bc.retention.windowStart, bc.retention.windowKnown = first, true
+	} else {
+		log.Debug("Dispute window unknown", "err", err)
+	}
+	bc.retention.windowUpdated = time.Now()
+}
+
+// refreshDisputeWindow fetches the dispute window start in the background if
+// the cached one is stale and no fetch is in flight already.
+func (bc *BlockChain) refreshDisputeWindow() {
+	bc.retentionLock.Lock()
+	window, id := bc.retention.disputeWindow, bc.retention.windowID
+	if window == nil || bc.retention.windowRefreshing || time.Since(bc.retention.windowUpdated) < disputeWindowRefresh {
+		bc.retentionLock.Unlock()
+		return
+	}
+	bc.retention.windowRefreshing = true
+	bc.retentionLock.Unlock()
+
+	go func() {
+		first, err := window()
+		bc.updateDisputeWindow(id, first, err)
+
+		bc.retentionLock.Lock()
+		bc.retention.windowRefreshing = false
+		bc.retentionLock.Unlock()
+	}()
+}
+
+// SparseArchiveStride returns the stride of the blocks whose state is persisted
+// as soon as it's written, 0 if the sparse archive mode is disabled. The state of
+// a block is then recreated from at most stride blocks back.
+func (bc *BlockChain) SparseArchiveStride() uint64 {
+	return bc.cacheConfig.SparseArchiveStride
+}
+
+// RetainsState reports whether the retention policy requires the state of the
+// given block to be persisted, either because it's an interval or sparse archive
+// stride block, because its root is tagged or because the rollup may still need
+// it within the dispute window.
+func (bc *BlockChain) RetainsState(number uint64, root common.Hash) bool {
+	if stride := bc.cacheConfig.SparseArchiveStride; stride != 0 && number%stride == 0 {
+		return true
+	}
+	bc.retentionLock.RLock()
+	var (
+		policy    = bc.retention.policy
+		_, tagged = bc.retention.tags[root]
+		window    = bc.retention.disputeWindow
+		first     = bc.retention.windowStart
+		known     = bc.retention.windowKnown
+	)
+	bc.retentionLock.RUnlock()
+
+	if interval := policy.Interval; interval != 0 && number%interval == 0 {
+		return true
+	}
+	if tagged {
+		return true
+	}
+	stride := policy.DisputeStride
+	if stride == 0 || window == nil {
+		return false
+	}
+	// Use the cached window, the rollup may take its time to answer
+	bc.refreshDisputeWindow()
+	if !known {
+		return true
+	}
+	return number >= first && (number-first)%stride == 0
+}
+
+// triesInMemory returns the number of recent block states the garbage
+// collection keeps in memory.
+func (bc *BlockChain) triesInMemory() uint64 {
+	bc.retentionLock.RLock()
+	defer bc.retentionLock.RUnlock()
+
+	if recent := bc.retention.policy.Recent; recent > bc.cacheConfig.TriesInMemory {
+		return recent
+	}
+	return bc.cacheConfig.TriesInMemory
+}
+
+// persistRetained commits the state of the block to disk if the retention
+// policy requires it, ahead of the state getting dereferenced.
+func (bc *BlockChain) persistRetained(number uint64, root common.Hash) {
+	if !bc.RetainsState(number, root) {
+		return
+	}
+	if err := bc.triedb.Commit(root, false); err != nil {
+		log.Error("Failed to persist retained state", "number", number, "root", root, "err", err)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that the states selected by the retention policy survive the garbage
+// collection of the dirty trie cache, while the others are dropped.
+func TestStateRetention(t *testing.T) {
+	var (
+		gspec  = &Genesis{Config: params.TestChainConfig}
+		engine = ethash.NewFaker()
+		config = &CacheConfig{
+			TrieCleanLimit: 256,
+			TrieDirtyLimit: 256,
+			TrieTimeLimit:  5 * time.Minute,
+			TriesInMemory:  4,
+			StateRetention: RetentionPolicy{Interval: 3},
+		}
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, engine, 24, func(i int, gen *BlockGen) {})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), config, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	defer chain.Stop()
+
+	tagged := blocks[4] // block 5
+	chain.TagState(tagged.Root(), "dispute")
+	if _, err := chain.InsertChain(blocks[:16]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// Keep more recent states from now on
+	chain.SetRetentionPolicy(RetentionPolicy{Recent: 6, Interval: 3})
+	if _, err := chain.InsertChain(blocks[16:]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	head := uint64(len(blocks))
+	for _, block := range blocks {
+		number := block.NumberU64()
+		want := number%3 == 0 || block.Hash() == tagged.Hash() || number > head-6
+		if have := chain.HasState(block.Root()); have != want {
+			t.Errorf("block %d: state available %v, want %v", number, have, want)
+		}
+	}
+	if tags := chain.TaggedStates(); len(tags) != 1 || tags[tagged.Root()] != "dispute" {
+		t.Errorf("unexpected tagged states: %v", tags)
+	}
+}
+
+// Tests that the sparse archive mode persists the stride states to disk as soon
+// as they're written, and drops the others once garbage collected.
+func TestSparseArchive(t *testing.T) {
+	var (
+		gspec  = &Genesis{Config: params.TestChainConfig}
+		engine = ethash.NewFaker()
+		db     = rawdb.NewMemoryDatabase()
+		config = &CacheConfig{
+			TrieCleanLimit:      256,
+			TrieDirtyLimit:      256,
+			TrieTimeLimit:       5 * time.Minute,
+			TriesInMemory:       4,
+			SparseArchiveStride: 5,
+		}
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, engine, 22, func(i int, gen *BlockGen) {
+		gen.SetCoinbase(common.Address{byte(i)})
+	})
+	chain, err := NewBlockChain(db, config, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	head := uint64(len(blocks))
+	for _, block := range blocks {
+		number := block.NumberU64()
+		if have, want := rawdb.HasLegacyTrieNode(db, block.Root()), number%5 == 0; have != want {
+			t.Errorf("block %d: state persisted %v, want %v", number, have, want)
+		}
+		if have, want := chain.HasState(block.Root()), number%5 == 0 || number > head-4; have != want {
+			t.Errorf("block %d: state available %v, want %v", number, have, want)
+		}
+		if !chain.RetainsState(number, block.Root()) && number%5 == 0 {
+			t.Errorf("block %d: stride state not retained", number)
+		}
+	}
+}
+
+// Tests that the states of the dispute window blocks survive the garbage
+// collection, counting the stride from the window start, and that all states
+// do while the window is unknown.
+func TestDisputeWindowRetention(t *testing.T) {
+	var (
+		gspec  = &Genesis{Config: params.TestChainConfig}
+		engine = ethash.NewFaker()
+		config = &CacheConfig{
+			TrieCleanLimit: 256,
+			TrieDirtyLimit: 256,
+			TrieTimeLimit:  5 * time.Minute,
+			TriesInMemory:  4,
+			StateRetention: RetentionPolicy{DisputeStride: 4},
+		}
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, engine, 32, func(i int, gen *BlockGen) {
+		gen.SetCoinbase(common.Address{byte(i)})
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), config, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.DisputeWindowStart(); err == nil {
+		t.Fatal("dispute window known before being set")
+	}
+	// The window is unknown up to block 8, then starts at block 10
+	var known atomic.Bool
+	chain.SetDisputeWindow(func() (uint64, error) {
+		if !known.Load() {
+			return 0, errors.New("not synced with L1 yet")
+		}
+		return 10, nil
+	})
+	if _, err := chain.InsertChain(blocks[:8]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// The cached window start is only refreshed in the background every now
+	// and then, asking for the window refreshes it right away
+	known.Store(true)
+	if first, err := chain.DisputeWindowStart(); err != nil || first != 10 {
+		t.Fatalf("wrong dispute window start: have %d (%v), want 10", first, err)
+	}
+	if !chain.RetainsState(10, common.Hash{}) {
+		t.Error("refreshed window start not retained")
+	}
+	if _, err := chain.InsertChain(blocks[8:]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if first, err := chain.DisputeWindowStart(); err != nil || first != 10 {
+		t.Fatalf("wrong dispute window start: have %d (%v), want 10", first, err)
+	}
+	head := uint64(len(blocks))
+	for _, block := range blocks {
+		number := block.NumberU64()
+		var want bool
+		switch {
+		case number <= 4: // Garbage collected while the window was unknown
+			want = true
+		case number <= head-4:
+			want = number >= 10 && (number-10)%4 == 0
+		default:
+			want = true
+		}
+		if have := chain.HasState(block.Root()); have != want {
+			t.Errorf("block %d: state available %v, want %v", number, have, want)
+		}
+	}
+}
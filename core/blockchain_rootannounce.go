@@ -0,0 +1,103 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"sync"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+)
+
+// StateRootAnnouncement is the state root of a block, announced as soon as the
+// block is executed, before it's written and made the chain head.
+type StateRootAnnouncement struct {
+	Number     uint64
+	Hash       common.Hash
+	ParentHash common.Hash
+	Root       common.Hash // State root the execution of the block results in
+	SendRoot   common.Hash // Merkle root of the outgoing messages after the block
+	SendCount  uint64      // Number of outgoing messages after the block
+	SetHead    bool        // Whether the block is to be made the head, if it makes the chain heavier
+}
+
+// StateRootListener is called with the state root of every block executed by
+// the chain or handed over to it with its state. It's called synchronously, on
+// the path of the block import, holding the chain mutex: it must be quick, and
+// must not call the methods of the chain writing blocks or moving the head.
+type StateRootListener func(announcement *StateRootAnnouncement)
+
+// stateRootListeners holds the listeners registered on a chain.
+type stateRootListeners struct {
+	listeners map[uint64]StateRootListener
+	nextID    uint64
+	lock      sync.RWMutex
+}
+
+// AddStateRootListener registers a listener called with the state root of every
+// block once executed, before it's written to the database and made the head,
+// so that validators get the root as early as possible. The returned function
+// unregisters the listener, also from within it. An announcement in flight may
+// still reach a listener being unregistered.
+func (bc *BlockChain) AddStateRootListener(fn StateRootListener) func() {
+	l := &bc.rootListeners
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.listeners == nil {
+		l.listeners = make(map[uint64]StateRootListener)
+	}
+	id := l.nextID
+	l.nextID++
+	l.listeners[id] = fn
+
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		delete(l.listeners, id)
+	}
+}
+
+// announceStateRoot calls the state root listeners with the root of the block,
+// which is known to be the one of its state.
+func (bc *BlockChain) announceStateRoot(block *types.Block, setHead bool) {
+	// Call the listeners without the lock held, so that they may unregister
+	l := &bc.rootListeners
+	l.lock.RLock()
+	listeners := make([]StateRootListener, 0, len(l.listeners))
+	for _, fn := range l.listeners {
+		listeners = append(listeners, fn)
+	}
+	l.lock.RUnlock()
+
+	if len(listeners) == 0 {
+		return
+	}
+	info := types.DeserializeHeaderExtraInformation(block.Header())
+	announcement := &StateRootAnnouncement{
+		Number:     block.NumberU64(),
+		Hash:       block.Hash(),
+		ParentHash: block.ParentHash(),
+		Root:       block.Root(),
+		SendRoot:   info.SendRoot,
+		SendCount:  info.SendCount,
+		SetHead:    setHead,
+	}
+	for _, fn := range listeners {
+		fn(announcement)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that the state roots are announced before the blocks are written and
+// made the head, until the listener is unregistered.
+func TestStateRootListener(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig}
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, gen *BlockGen) {})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	var announced []*StateRootAnnouncement
+	remove := chain.AddStateRootListener(func(a *StateRootAnnouncement) {
+		if chain.HasBlock(a.Hash, a.Number) || chain.CurrentBlock().Number.Uint64() >= a.Number {
+			t.Errorf("block %d written before its root is announced", a.Number)
+		}
+		announced = append(announced, a)
+	})
+	if _, err := chain.InsertChain(blocks[:2]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if len(announced) != 2 {
+		t.Fatalf("have %d announcements, want 2", len(announced))
+	}
+	for i, a := range announced {
+		if a.Number != blocks[i].NumberU64() || a.Hash != blocks[i].Hash() || a.Root != blocks[i].Root() || !a.SetHead {
+			t.Errorf("announcement %d mismatch: %+v", i, a)
+		}
+	}
+	remove()
+	if _, err := chain.InsertChain(blocks[2:]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if len(announced) != 2 {
+		t.Fatalf("unregistered listener called")
+	}
+}
+
+// Tests that a listener can unregister itself without blocking the import.
+func TestStateRootListenerUnregisterItself(t *testing.T) {
+	gspec := &Genesis{Config: params.TestChainConfig}
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, gen *BlockGen) {})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	var (
+		announced int
+		remove    func()
+	)
+	remove = chain.AddStateRootListener(func(a *StateRootAnnouncement) {
+		announced++
+		remove()
+	})
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if announced != 1 {
+		t.Fatalf("have %d announcements, want 1", announced)
+	}
+}
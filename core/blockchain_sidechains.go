@@ -0,0 +1,195 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/log"
+)
+
+// sideChainPruneBatch is the number of heights pruned under a single hold of
+// the chain mutex, so that block imports aren't held up for long.
+const sideChainPruneBatch = 1024
+
+// SideChainBlock is a non-canonical block found while pruning side chains.
+type SideChainBlock struct {
+	Number  uint64      `json:"number"`
+	Hash    common.Hash `json:"hash"`
+	Txs     int         `json:"txs"`
+	Lookups int         `json:"lookups"` // Tx lookup entries pointing at the block rather than the canonical chain
+}
+
+// SideChainPruneReport lists the non-canonical blocks pruned, or that would
+// have been pruned in a dry run, in the inclusive range [From, To].
+type SideChainPruneReport struct {
+	From    uint64           `json:"from"`
+	To      uint64           `json:"to"`
+	DryRun  bool             `json:"dryRun"`
+	Blocks  []SideChainBlock `json:"blocks"`
+	Lookups int              `json:"lookups"`
+	Elapsed time.Duration    `json:"elapsed"`
+}
+
+// SideChainPruneTail returns the number of the block below which all the
+// non-canonical blocks have been pruned, or nil if they never were. Nothing
+// below the genesis block needs pruning.
+func (bc *BlockChain) SideChainPruneTail() *uint64 {
+	return rawdb.ReadSideChainPruneTail(bc.db)
+}
+
+// PruneSideChains deletes the headers, bodies, receipts and total difficulties
+// of the non-canonical blocks in the inclusive range [from, to], along with the
+// tx lookup entries of their transactions that aren't also in the canonical
+// block at the same height. The range must be below the current head, callers
+// are expected to keep it a confirmation depth below so that no side chain that
+// might still become canonical is deleted. In a dry run nothing is deleted, the
+// report lists what would have been.
+//
+// The side chains of the ancient blocks were already wiped by the freezer, only
+// the key-value store is scanned. Once a range covering the prune tail (the
+// genesis block if nothing was pruned yet) is pruned, the tail is moved past
+// it. If the context is cancelled the blocks pruned so far are reported along
+// with the error.
+func (bc *BlockChain) PruneSideChains(ctx context.Context, from, to uint64, dryRun bool) (*SideChainPruneReport, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid block range: from %d is after to %d", from, to)
+	}
+	if head := bc.CurrentBlock().Number.Uint64(); to >= head {
+		return nil, fmt.Errorf("block %d isn't below the head %d", to, head)
+	}
+	var (
+		start  = time.Now()
+		report = &SideChainPruneReport{From: from, To: to, DryRun: dryRun, Blocks: []SideChainBlock{}}
+	)
+	for first := from; first <= to; first += sideChainPruneBatch {
+		last := first + sideChainPruneBatch - 1
+		if last > to || last < first {
+			last = to
+		}
+		if err := ctx.Err(); err != nil {
+			report.Elapsed = time.Since(start)
+			return report, err
+		}
+		if err := bc.pruneSideChainRange(first, last, dryRun, report); err != nil {
+			report.Elapsed = time.Since(start)
+			return report, err
+		}
+		if last == to {
+			break
+		}
+	}
+	if !dryRun {
+		tail := bc.genesisBlock.NumberU64()
+		if stored := rawdb.ReadSideChainPruneTail(bc.db); stored != nil {
+			tail = *stored
+		}
+		if from <= tail && tail <= to {
+			rawdb.WriteSideChainPruneTail(bc.db, to+1)
+		}
+	}
+	report.Elapsed = time.Since(start)
+	if len(report.Blocks) > 0 {
+		log.Info("Pruned side chains", "from", from, "to", to, "dryrun", dryRun, "blocks", len(report.Blocks), "lookups", report.Lookups, "elapsed", common.PrettyDuration(report.Elapsed))
+	}
+	return report, nil
+}
+
+// pruneSideChainRange prunes the non-canonical blocks in the inclusive range
+// [first, last], adding them to the report.
+func (bc *BlockChain) pruneSideChainRange(first, last uint64, dryRun bool, report *SideChainPruneReport) error {
+	if !dryRun {
+		if !bc.chainmu.TryLock() {
+			return errChainStopped
+		}
+		defer bc.chainmu.Unlock()
+	}
+	var (
+		batch     = bc.db.NewBatch()
+		canonical = make(map[uint64]map[common.Hash]struct{})
+		deleted   []common.Hash
+		lookups   []common.Hash
+	)
+	// canonicalTxs returns the transactions of the canonical block at number
+	canonicalTxs := func(number uint64) map[common.Hash]struct{} {
+		if txs, ok := canonical[number]; ok {
+			return txs
+		}
+		txs := make(map[common.Hash]struct{})
+		if hash := rawdb.ReadCanonicalHash(bc.db, number); hash != (common.Hash{}) {
+			if body := rawdb.ReadBody(bc.db, hash, number); body != nil {
+				for _, tx := range body.Transactions {
+					txs[tx.Hash()] = struct{}{}
+				}
+			}
+		}
+		canonical[number] = txs
+		return txs
+	}
+	for _, nh := range rawdb.ReadAllHashesInRange(bc.db, first, last) {
+		if nh.Hash == rawdb.ReadCanonicalHash(bc.db, nh.Number) {
+			continue
+		}
+		block := SideChainBlock{Number: nh.Number, Hash: nh.Hash}
+		if body := rawdb.ReadBody(bc.db, nh.Hash, nh.Number); body != nil {
+			block.Txs = len(body.Transactions)
+			for _, tx := range body.Transactions {
+				hash := tx.Hash()
+				if entry := rawdb.ReadTxLookupEntry(bc.db, hash); entry == nil || *entry != nh.Number {
+					continue
+				}
+				if _, ok := canonicalTxs(nh.Number)[hash]; ok {
+					continue
+				}
+				block.Lookups++
+				lookups = append(lookups, hash)
+			}
+		}
+		report.Blocks = append(report.Blocks, block)
+		report.Lookups += block.Lookups
+		deleted = append(deleted, nh.Hash)
+		if !dryRun {
+			rawdb.DeleteBlock(batch, nh.Hash, nh.Number)
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	for _, hash := range lookups {
+		rawdb.DeleteTxLookupEntry(batch, hash)
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	for _, hash := range deleted {
+		bc.hc.headerCache.Remove(hash)
+		bc.hc.tdCache.Remove(hash)
+		bc.hc.numberCache.Remove(hash)
+		bc.bodyCache.Remove(hash)
+		bc.bodyRLPCache.Remove(hash)
+		bc.receiptsCache.Remove(hash)
+		bc.blockCache.Remove(hash)
+	}
+	for _, hash := range lookups {
+		bc.txLookupCache.Remove(hash)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that the blocks left behind by a reorg are reported in a dry run and
+// deleted along with their dangling tx lookups otherwise.
+func TestPruneSideChains(t *testing.T) {
+	var (
+		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr   = crypto.PubkeyToAddress(key.PublicKey)
+		gspec  = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{addr: {Balance: big.NewInt(10000000000000000)}},
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	chain, _ := NewBlockChain(rawdb.NewMemoryDatabase(), nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	defer chain.Stop()
+
+	_, side, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, gen *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(gen.TxNonce(addr), common.Address{0x01}, big.NewInt(1), params.TxGas, gen.header.BaseFee, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to create tx: %v", err)
+		}
+		gen.AddTx(tx)
+	})
+	if _, err := chain.InsertChain(side); err != nil {
+		t.Fatalf("failed to insert side chain: %v", err)
+	}
+	_, canon, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 6, func(i int, gen *BlockGen) {
+		gen.SetCoinbase(common.Address{0x02})
+	})
+	if _, err := chain.InsertChain(canon); err != nil {
+		t.Fatalf("failed to insert canonical chain: %v", err)
+	}
+	if head := chain.CurrentBlock().Hash(); head != canon[len(canon)-1].Hash() {
+		t.Fatalf("chain didn't reorg: head %x", head)
+	}
+	// Leave a lookup behind as an interrupted reorg would
+	dangling := side[1].Transactions()[0].Hash()
+	rawdb.WriteTxLookupEntries(chain.db, 2, []common.Hash{dangling})
+
+	if _, err := chain.PruneSideChains(context.Background(), 0, 6, false); err == nil {
+		t.Fatal("pruned up to the head")
+	}
+	report, err := chain.PruneSideChains(context.Background(), 0, 5, true)
+	if err != nil {
+		t.Fatalf("failed to dry run: %v", err)
+	}
+	if len(report.Blocks) != len(side) || report.Lookups != 1 {
+		t.Fatalf("wrong dry run report: have %d blocks %d lookups, want %d blocks 1 lookup", len(report.Blocks), report.Lookups, len(side))
+	}
+	for i, block := range report.Blocks {
+		if block.Hash != side[i].Hash() || block.Txs != 1 {
+			t.Errorf("block %d: have %x with %d txs, want %x with 1 tx", i, block.Hash, block.Txs, side[i].Hash())
+		}
+		if !rawdb.HasHeader(chain.db, block.Hash, block.Number) {
+			t.Errorf("block %d deleted by a dry run", i)
+		}
+	}
+	if tail := chain.SideChainPruneTail(); tail != nil {
+		t.Fatalf("dry run moved the prune tail to %d", *tail)
+	}
+	// Prune in two steps, the tail following along
+	for _, r := range [][2]uint64{{0, 2}, {3, 5}} {
+		if _, err := chain.PruneSideChains(context.Background(), r[0], r[1], false); err != nil {
+			t.Fatalf("failed to prune [%d, %d]: %v", r[0], r[1], err)
+		}
+		if tail := chain.SideChainPruneTail(); tail == nil || *tail != r[1]+1 {
+			t.Fatalf("wrong prune tail after [%d, %d]: have %v, want %d", r[0], r[1], tail, r[1]+1)
+		}
+	}
+	for i, block := range side {
+		if rawdb.HasHeader(chain.db, block.Hash(), block.NumberU64()) || rawdb.HasBody(chain.db, block.Hash(), block.NumberU64()) {
+			t.Errorf("side block %d not pruned", i)
+		}
+		if chain.GetBlockByHash(block.Hash()) != nil {
+			t.Errorf("side block %d still served", i)
+		}
+	}
+	if rawdb.ReadTxLookupEntry(chain.db, dangling) != nil {
+		t.Error("dangling tx lookup not pruned")
+	}
+	for i, block := range canon {
+		if chain.GetBlockByNumber(block.NumberU64()) == nil || !rawdb.HasReceipts(chain.db, block.Hash(), block.NumberU64()) {
+			t.Errorf("canonical block %d pruned", i)
+		}
+	}
+	if report, err := chain.PruneSideChains(context.Background(), 0, 5, true); err != nil || len(report.Blocks) != 0 {
+		t.Fatalf("side chains left after pruning: %v, %v", report, err)
+	}
+}
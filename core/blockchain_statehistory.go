@@ -0,0 +1,276 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/core/state/snapshot"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/rlp"
+	"github.com/chainupcloud/arb-geth/trie"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+)
+
+// errNoSnapshot is returned if the state history is queried while the snapshot
+// is disabled.
+var errNoSnapshot = errors.New("snapshot disabled")
+
+// StateHistory describes the states recoverable from the snapshot without the
+// tries: the ones of its layers, and the older ones recoverable from the reverse
+// diffs of the layers spilled to disk.
+type StateHistory struct {
+	Limit  int           // Number of blocks below the disk layer kept recoverable, 0 if disabled
+	Layers int           // Number of diff layers kept in memory above the disk layer
+	Roots  []common.Hash // Roots recoverable from the reverse diffs, the oldest first, ending with the disk layer
+}
+
+// StateHistory reports the states recoverable from the snapshot, nil if the
+// snapshot is disabled.
+func (bc *BlockChain) StateHistory() *StateHistory {
+	if bc.snaps == nil {
+		return nil
+	}
+	return &StateHistory{
+		Limit:  bc.snaps.SpillLayers(),
+		Layers: bc.snaps.DiffLayers(),
+		Roots:  bc.snaps.History(),
+	}
+}
+
+// StateRecoverable reports whether the state of the root can be read from the
+// snapshot without its trie, depth being the number of reverse diffs overlaid
+// onto the snapshot disk layer to do so (0 if the root has a snapshot layer).
+func (bc *BlockChain) StateRecoverable(root common.Hash) (int, bool) {
+	if bc.snaps == nil {
+		return 0, false
+	}
+	return bc.snaps.Recoverable(root)
+}
+
+// StateAtFromSnapshot returns the state of the root backed by the flat snapshot
+// data only, recovering the states older than the snapshot disk layer from the
+// reverse diffs without modifying the snapshot. The state can't be hashed,
+// committed nor proven, see state.NewFlat.
+func (bc *BlockChain) StateAtFromSnapshot(root common.Hash) (*state.StateDB, error) {
+	if bc.snaps == nil {
+		return nil, errNoSnapshot
+	}
+	snap, err := bc.snaps.Historical(root)
+	if err != nil {
+		return nil, err
+	}
+	return state.NewFlat(root, bc.stateCache, snap), nil
+}
+
+// StateAtBlockByRollback derives the state of the block from the closest state
+// above it whose tries are available, by applying the reverse diffs of the
+// snapshot to those tries rather than replaying blocks up from an older state.
+// The rebuilt trie nodes are kept in a trie database of their own, reading the
+// other nodes through the one of the chain, so that the state lives as long as
+// the returned StateDB without touching the chain's trie database, as is done
+// without holding the chain lock. It fails if the state isn't recoverable from
+// the snapshot, or if the storage of an account destructed since the block
+// can't be rebuilt.
+func (bc *BlockChain) StateAtBlockByRollback(header *types.Header) (*state.StateDB, error) {
+	if bc.snaps == nil {
+		return nil, errNoSnapshot
+	}
+	if bc.HasState(header.Root) {
+		return bc.StateAt(header.Root)
+	}
+	depth, ok := bc.snaps.Recoverable(header.Root)
+	if !ok {
+		return nil, fmt.Errorf("state %x of block %d not recoverable from the snapshot", header.Root, header.Number)
+	}
+	// Look the closest available state up, at most as far as the snapshot reaches
+	var (
+		base   *types.Header
+		number = header.Number.Uint64()
+		limit  = number + uint64(depth+bc.snaps.DiffLayers()) + 1
+	)
+	for n := number + 1; n <= limit; n++ {
+		next := bc.GetHeaderByNumber(n)
+		if next == nil {
+			break
+		}
+		if bc.HasState(next.Root) {
+			base = next
+			break
+		}
+	}
+	if base == nil {
+		return nil, fmt.Errorf("no state available above block %d to roll back from", number)
+	}
+	changes, err := bc.snaps.ChangesBetween(header.Root, base.Root)
+	if err != nil {
+		return nil, err
+	}
+	view, err := bc.snaps.Historical(header.Root)
+	if err != nil {
+		return nil, err
+	}
+	triedb := trie.NewDatabase(&trieNodeFallback{Database: bc.db, triedb: bc.triedb})
+	root, nodes, err := rollbackTries(triedb, base.Root, header.Root, view, changes)
+	if err != nil {
+		return nil, fmt.Errorf("failed rolling block %d back to block %d: %w", base.Number, number, err)
+	}
+	if root != header.Root {
+		return nil, fmt.Errorf("rolled back state root mismatch for block %d: have %x, want %x", number, root, header.Root)
+	}
+	if err := triedb.Update(root, base.Root, nodes); err != nil {
+		return nil, err
+	}
+	return state.New(root, state.NewDatabaseWithNodeDB(bc.db, triedb), nil)
+}
+
+// trieNodeFallback is the disk database of an ephemeral trie database, reading
+// the trie nodes it doesn't hold through the trie database of the chain, which
+// has the nodes not flushed to disk yet.
+type trieNodeFallback struct {
+	ethdb.Database
+	triedb *trie.Database
+}
+
+func (db *trieNodeFallback) Get(key []byte) ([]byte, error) {
+	if len(key) == common.HashLength {
+		if blob, err := db.triedb.Node(common.BytesToHash(key)); err == nil {
+			return blob, nil
+		}
+	}
+	return db.Database.Get(key)
+}
+
+func (db *trieNodeFallback) Has(key []byte) (bool, error) {
+	if len(key) == common.HashLength {
+		if _, err := db.triedb.Node(common.BytesToHash(key)); err == nil {
+			return true, nil
+		}
+	}
+	return db.Database.Has(key)
+}
+
+// rollbackTries applies the values of the changed entries at the target state,
+// read from the snapshot view, to the tries of the base state, returning the
+// resulting root and trie nodes.
+func rollbackTries(triedb *trie.Database, baseRoot, targetRoot common.Hash, view snapshot.Snapshot, changes *snapshot.Changes) (common.Hash, *trienode.MergedNodeSet, error) {
+	accTrie, err := trie.New(trie.StateTrieID(baseRoot), triedb)
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+	accounts := make(map[common.Hash]struct{}, len(changes.Accounts)+len(changes.Destructs)+len(changes.Storage))
+	for _, set := range []map[common.Hash]struct{}{changes.Accounts, changes.Destructs} {
+		for hash := range set {
+			accounts[hash] = struct{}{}
+		}
+	}
+	for hash := range changes.Storage {
+		accounts[hash] = struct{}{}
+	}
+	nodes := trienode.NewMergedNodeSet()
+	for hash := range accounts {
+		slim, err := view.AccountRLP(hash)
+		if err != nil {
+			return common.Hash{}, nil, err
+		}
+		if len(slim) == 0 {
+			if err := accTrie.Delete(hash[:]); err != nil {
+				return common.Hash{}, nil, err
+			}
+			continue
+		}
+		account, err := snapshot.FullAccount(slim)
+		if err != nil {
+			return common.Hash{}, nil, err
+		}
+		// Reuse the storage trie of the target if still around, rebuild it otherwise
+		storageRoot := common.BytesToHash(account.Root)
+		if _, err := trie.New(trie.StorageTrieID(targetRoot, hash, storageRoot), triedb); err != nil {
+			if _, destructed := changes.Destructs[hash]; destructed {
+				return common.Hash{}, nil, fmt.Errorf("storage of destructed account %x missing", hash)
+			}
+			set, err := rollbackStorage(triedb, accTrie, baseRoot, hash, storageRoot, view, changes.Storage[hash])
+			if err != nil {
+				return common.Hash{}, nil, err
+			}
+			if set != nil {
+				if err := nodes.Merge(set); err != nil {
+					return common.Hash{}, nil, err
+				}
+			}
+		}
+		blob, err := rlp.EncodeToBytes(account)
+		if err != nil {
+			return common.Hash{}, nil, err
+		}
+		if err := accTrie.Update(hash[:], blob); err != nil {
+			return common.Hash{}, nil, err
+		}
+	}
+	root, set := accTrie.Commit(true)
+	if set != nil {
+		if err := nodes.Merge(set); err != nil {
+			return common.Hash{}, nil, err
+		}
+	}
+	return root, nodes, nil
+}
+
+// rollbackStorage applies the values of the changed slots of the account at the
+// target state to its storage trie at the base state, which must then hash to
+// the storage root of the account at the target state.
+func rollbackStorage(triedb *trie.Database, accTrie *trie.Trie, baseRoot, accountHash, storageRoot common.Hash, view snapshot.Snapshot, slots map[common.Hash]struct{}) (*trienode.NodeSet, error) {
+	baseStorageRoot := types.EmptyRootHash
+	blob, err := accTrie.Get(accountHash[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) > 0 {
+		var account types.StateAccount
+		if err := rlp.DecodeBytes(blob, &account); err != nil {
+			return nil, err
+		}
+		baseStorageRoot = account.Root
+	}
+	st, err := trie.New(trie.StorageTrieID(baseRoot, accountHash, baseStorageRoot), triedb)
+	if err != nil {
+		return nil, err
+	}
+	for storageHash := range slots {
+		value, err := view.Storage(accountHash, storageHash)
+		if err != nil {
+			return nil, err
+		}
+		if len(value) == 0 {
+			err = st.Delete(storageHash[:])
+		} else {
+			err = st.Update(storageHash[:], value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	root, set := st.Commit(false)
+	if root != storageRoot {
+		return nil, fmt.Errorf("rolled back storage root mismatch for account %x: have %x, want %x", accountHash, root, storageRoot)
+	}
+	return set, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that the states of the blocks below the snapshot disk layer are served
+// from the reverse diffs, matching the states of their tries.
+func TestStateAtFromSnapshot(t *testing.T) {
+	var (
+		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		sender = crypto.PubkeyToAddress(key.PublicKey)
+		gspec  = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{sender: {Balance: big.NewInt(params.Ether)}},
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	// Every block pays a new recipient, and the first one again
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 8, func(i int, gen *BlockGen) {
+		price := new(big.Int).Add(gen.header.BaseFee, big.NewInt(1))
+		for _, to := range []common.Address{{0x1}, {byte(i + 2)}} {
+			tx, err := types.SignTx(types.NewTransaction(gen.TxNonce(sender), to, big.NewInt(int64(i+1)), params.TxGas, price, nil), signer, key)
+			if err != nil {
+				t.Fatalf("failed to sign tx: %v", err)
+			}
+			gen.AddTx(tx)
+		}
+	})
+	cacheConfig := *defaultCacheConfig
+	cacheConfig.TrieDirtyDisabled = true
+	cacheConfig.SnapshotWait = true
+	cacheConfig.SnapshotDiffLayers = 2
+	cacheConfig.SnapshotSpillLayers = 4
+
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), &cacheConfig, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// The disk layer is 2 blocks below the head, with the 4 blocks below it recoverable
+	history := chain.StateHistory()
+	if history == nil || history.Limit != 4 || len(history.Roots) != 5 || history.Roots[4] != blocks[5].Root() {
+		t.Fatalf("unexpected state history %+v", history)
+	}
+	if _, ok := chain.StateRecoverable(blocks[0].Root()); ok {
+		t.Fatal("state beyond the history reported recoverable")
+	}
+	for i := 1; i < len(blocks); i++ {
+		depth, ok := chain.StateRecoverable(blocks[i].Root())
+		if !ok {
+			t.Fatalf("block %d: state not recoverable", i+1)
+		}
+		if want := 5 - i; i < 5 && depth != want {
+			t.Errorf("block %d: have depth %d, want %d", i+1, depth, want)
+		}
+		flat, err := chain.StateAtFromSnapshot(blocks[i].Root())
+		if err != nil {
+			t.Fatalf("block %d: failed to recover state: %v", i+1, err)
+		}
+		full, _ := chain.StateAt(blocks[i].Root())
+		for _, addr := range []common.Address{sender, {0x1}, {byte(i + 2)}, {byte(i + 3)}} {
+			if have, want := flat.GetBalance(addr), full.GetBalance(addr); have.Cmp(want) != 0 {
+				t.Errorf("block %d: balance of %x mismatch: have %v, want %v", i+1, addr, have, want)
+			}
+			if have, want := flat.GetNonce(addr), full.GetNonce(addr); have != want {
+				t.Errorf("block %d: nonce of %x mismatch: have %v, want %v", i+1, addr, have, want)
+			}
+		}
+		if !flat.Flat() {
+			t.Errorf("block %d: recovered state not flat", i+1)
+		}
+		if _, err := flat.Commit(true); err == nil {
+			t.Errorf("block %d: flat state committed", i+1)
+		}
+	}
+}
+
+// Tests that the states of the blocks whose tries were garbage collected are
+// rebuilt by rolling the tries of a later state back with the snapshot, without
+// writing them to the chain's trie database.
+func TestStateAtBlockByRollback(t *testing.T) {
+	var (
+		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		sender = crypto.PubkeyToAddress(key.PublicKey)
+		// Stores the call value in the slot of the block number and in slot 0
+		contract = common.Address{0xcc}
+		gspec    = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: GenesisAlloc{
+				sender:   {Balance: big.NewInt(params.Ether)},
+				contract: {Balance: common.Big0, Code: []byte{0x34, 0x43, 0x55, 0x34, 0x60, 0x00, 0x55, 0x00}},
+			},
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 10, func(i int, gen *BlockGen) {
+		price := new(big.Int).Add(gen.header.BaseFee, big.NewInt(1))
+		tx, err := types.SignTx(types.NewTransaction(gen.TxNonce(sender), contract, big.NewInt(int64(i+1)), 100_000, price, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		gen.AddTx(tx)
+	})
+	cacheConfig := *defaultCacheConfig
+	cacheConfig.TriesInMemory = 2
+	cacheConfig.TrieRetention = 0
+	cacheConfig.SnapshotWait = true
+	cacheConfig.SnapshotDiffLayers = 2
+	cacheConfig.SnapshotSpillLayers = 6
+
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), &cacheConfig, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if _, err := chain.StateAtBlockByRollback(blocks[0].Header()); err == nil {
+		t.Fatal("state beyond the history rolled back")
+	}
+	for i := 6; i >= 1; i-- {
+		header := blocks[i].Header()
+		if chain.HasState(header.Root) {
+			t.Fatalf("block %d: state not garbage collected", i+1)
+		}
+		statedb, err := chain.StateAtBlockByRollback(header)
+		if err != nil {
+			t.Fatalf("block %d: failed to roll back: %v", i+1, err)
+		}
+		if chain.HasState(header.Root) {
+			t.Errorf("block %d: rolled back state written to the chain's trie database", i+1)
+		}
+		if have, want := statedb.GetState(contract, common.Hash{}), common.BigToHash(big.NewInt(int64(i+1))); have != want {
+			t.Errorf("block %d: slot 0 mismatch: have %x, want %x", i+1, have, want)
+		}
+		if have := statedb.GetState(contract, common.BigToHash(big.NewInt(int64(i+2)))); have != (common.Hash{}) {
+			t.Errorf("block %d: slot of the next block set: %x", i+1, have)
+		}
+		if have, want := statedb.GetBalance(contract), big.NewInt(int64((i+1)*(i+2)/2)); have.Cmp(want) != 0 {
+			t.Errorf("block %d: contract balance mismatch: have %v, want %v", i+1, have, want)
+		}
+	}
+}
@@ -17,6 +17,7 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math/big"
@@ -162,7 +163,7 @@ func testBlockChainImport(chain types.Blocks, blockchain *BlockChain) error {
 		if err != nil {
 			return err
 		}
-		receipts, _, usedGas, err := blockchain.processor.Process(block, statedb, vm.Config{})
+		receipts, _, usedGas, err := blockchain.processor.Process(context.Background(), block, statedb, vm.Config{})
 		if err != nil {
 			blockchain.reportBlock(block, receipts, err)
 			return err
@@ -1706,6 +1707,59 @@ func TestTrieForkGC(t *testing.T) {
 	}
 }
 
+// Tests that flushing the state of a running chain persists the head state and
+// the snapshot journal, so that the head survives a subsequent crash.
+func TestFlushState(t *testing.T) {
+	engine := ethash.NewFaker()
+	genesis := &Genesis{
+		Config:  params.TestChainConfig,
+		BaseFee: big.NewInt(params.InitialBaseFee),
+	}
+	_, blocks, _ := GenerateChainWithGenesis(genesis, engine, 9, func(i int, b *BlockGen) { b.SetCoinbase(common.Address{1}) })
+
+	db := rawdb.NewMemoryDatabase()
+	chain, err := NewBlockChain(db, nil, nil, genesis, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	if _, err := chain.InsertChain(blocks[:8]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	head := blocks[7]
+	if rawdb.HasLegacyTrieNode(db, head.Root()) {
+		t.Fatalf("head state unexpectedly on disk before flush")
+	}
+	flush, err := chain.FlushState()
+	if err != nil {
+		t.Fatalf("failed to flush state: %v", err)
+	}
+	if flush.Block.Hash() != head.Hash() {
+		t.Fatalf("flushed wrong block: have %x, want %x", flush.Block.Hash(), head.Hash())
+	}
+	if !rawdb.HasLegacyTrieNode(db, head.Root()) {
+		t.Fatalf("head state missing from disk after flush")
+	}
+	if rawdb.ReadSnapshotJournal(db) == nil {
+		t.Fatalf("snapshot journal missing after flush")
+	}
+	// The chain keeps running after a flush
+	if _, err := chain.InsertChain(blocks[8:]); err != nil {
+		t.Fatalf("failed to insert block after flush: %v", err)
+	}
+	// Simulate a crash and check the flushed head is kept
+	chain.stopWithoutSaving()
+
+	restarted, err := NewBlockChain(db, nil, nil, genesis, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to recreate chain: %v", err)
+	}
+	defer restarted.Stop()
+
+	if number := restarted.CurrentBlock().Number.Uint64(); number < head.NumberU64() {
+		t.Fatalf("head rewound after crash: have %d, want at least %d", number, head.NumberU64())
+	}
+}
+
 // Tests that doing large reorgs works even if the state associated with the
 // forking point is not available any more.
 func TestLargeReorgTrieGC(t *testing.T) {
@@ -0,0 +1,220 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/log"
+)
+
+// transferPruneBatch is the maximum number of blocks whose token transfers are
+// pruned per imported block, spreading out the pruning after the retention is
+// lowered.
+const transferPruneBatch = 64
+
+var (
+	// Transfer(address indexed from, address indexed to, uint256 value), the
+	// token ID being indexed instead of the value being logged for ERC-721
+	transferEventTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+
+	// TransferSingle(address indexed operator, address indexed from, address indexed to, uint256 id, uint256 value)
+	transferSingleEventTopic = crypto.Keccak256Hash([]byte("TransferSingle(address,address,address,uint256,uint256)"))
+
+	// TransferBatch(address indexed operator, address indexed from, address indexed to, uint256[] ids, uint256[] values)
+	transferBatchEventTopic = crypto.Keccak256Hash([]byte("TransferBatch(address,address,address,uint256[],uint256[])"))
+)
+
+// SetTransferIndexing enables or disables indexing the ERC-20, ERC-721 and
+// ERC-1155 transfers of the imported blocks by holder and token. If retention
+// is non-zero, only the transfers of that many recent blocks are kept.
+func (bc *BlockChain) SetTransferIndexing(enabled bool, retention uint64) {
+	bc.transferRetention.Store(retention)
+	bc.transferIndexing.Store(enabled)
+}
+
+// indexTransfers records the token transfers logged by the block in the token
+// transfer index, for both the sender and the recipient, and prunes the blocks
+// past the retention.
+func (bc *BlockChain) indexTransfers(block *types.Block, receipts []*types.Receipt) {
+	var transfers []*rawdb.TokenTransfer
+	for _, receipt := range receipts {
+		for _, log := range receipt.Logs {
+			for _, transfer := range parseTokenTransfers(log) {
+				for _, holder := range []common.Address{transfer.From, transfer.To} {
+					if holder == (common.Address{}) || (holder == transfer.To && transfer.To == transfer.From) {
+						continue
+					}
+					indexed := *transfer
+					indexed.Holder = holder
+					transfers = append(transfers, &indexed)
+				}
+			}
+		}
+	}
+	number := block.NumberU64()
+	batch := bc.db.NewBatch()
+	if len(transfers) > 0 {
+		rawdb.WriteTokenTransfers(batch, number, block.Hash(), transfers)
+	}
+	tail := rawdb.ReadTransferIndexTail(bc.db)
+	if tail == nil {
+		rawdb.WriteTransferIndexTail(batch, number)
+	}
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to write token transfer index", "err", err)
+	}
+	if retention := bc.transferRetention.Load(); tail != nil && retention > 0 && number >= retention {
+		var (
+			limit = number - retention + 1
+			next  = *tail
+		)
+		for ; next < limit && next < *tail+transferPruneBatch; next++ {
+			rawdb.DeleteTokenTransfers(bc.db, next)
+		}
+		if next != *tail {
+			rawdb.WriteTransferIndexTail(bc.db, next)
+		}
+	}
+}
+
+// parseTokenTransfers returns the token transfers in a log, leaving the holder
+// unset, or nil if the log isn't a token transfer.
+func parseTokenTransfers(log *types.Log) []*rawdb.TokenTransfer {
+	if len(log.Topics) == 0 {
+		return nil
+	}
+	transfer := func(standard uint16, from, to common.Hash, id, value *big.Int) *rawdb.TokenTransfer {
+		return &rawdb.TokenTransfer{
+			Token:    log.Address,
+			LogIndex: uint32(log.Index),
+			Standard: standard,
+			TxHash:   log.TxHash,
+			From:     common.BytesToAddress(from.Bytes()),
+			To:       common.BytesToAddress(to.Bytes()),
+			TokenID:  id,
+			Value:    value,
+		}
+	}
+	switch log.Topics[0] {
+	case transferEventTopic:
+		switch {
+		case len(log.Topics) == 3 && len(log.Data) == 32:
+			return []*rawdb.TokenTransfer{transfer(rawdb.TokenERC20, log.Topics[1], log.Topics[2], nil, new(big.Int).SetBytes(log.Data))}
+		case len(log.Topics) == 4 && len(log.Data) == 0:
+			return []*rawdb.TokenTransfer{transfer(rawdb.TokenERC721, log.Topics[1], log.Topics[2], log.Topics[3].Big(), nil)}
+		}
+	case transferSingleEventTopic:
+		if len(log.Topics) == 4 && len(log.Data) == 64 {
+			id, value := new(big.Int).SetBytes(log.Data[:32]), new(big.Int).SetBytes(log.Data[32:])
+			return []*rawdb.TokenTransfer{transfer(rawdb.TokenERC1155, log.Topics[2], log.Topics[3], id, value)}
+		}
+	case transferBatchEventTopic:
+		if len(log.Topics) != 4 {
+			return nil
+		}
+		ids, ok := abiUint256Array(log.Data, 0)
+		if !ok {
+			return nil
+		}
+		values, ok := abiUint256Array(log.Data, 32)
+		if !ok || len(values) != len(ids) {
+			return nil
+		}
+		transfers := make([]*rawdb.TokenTransfer, len(ids))
+		for i := range ids {
+			transfers[i] = transfer(rawdb.TokenERC1155, log.Topics[2], log.Topics[3], ids[i], values[i])
+			transfers[i].Item = uint32(i)
+		}
+		return transfers
+	}
+	return nil
+}
+
+// abiUint256Array decodes the ABI encoded uint256[] whose offset is stored in
+// the word at pos of data.
+func abiUint256Array(data []byte, pos int) ([]*big.Int, bool) {
+	word := func(pos uint64) (*big.Int, bool) {
+		if pos+32 > uint64(len(data)) {
+			return nil, false
+		}
+		return new(big.Int).SetBytes(data[pos : pos+32]), true
+	}
+	offset, ok := word(uint64(pos))
+	if !ok || !offset.IsUint64() {
+		return nil, false
+	}
+	length, ok := word(offset.Uint64())
+	if !ok || !length.IsUint64() || length.Uint64() > uint64(len(data))/32 {
+		return nil, false
+	}
+	items := make([]*big.Int, length.Uint64())
+	for i := range items {
+		if items[i], ok = word(offset.Uint64() + 32*uint64(i+1)); !ok {
+			return nil, false
+		}
+	}
+	return items, true
+}
+
+// TokenTransfers returns the canonical token transfers from or to the holder in
+// the blocks [from, to], of the given token or all of them if nil, ordered by
+// block and log. It fails if the transfers of some of the blocks aren't indexed
+// because they were pruned or imported before indexing was enabled.
+func (bc *BlockChain) TokenTransfers(holder common.Address, token *common.Address, from, to uint64) ([]*rawdb.TokenTransfer, error) {
+	tail := rawdb.ReadTransferIndexTail(bc.db)
+	if tail == nil {
+		return nil, fmt.Errorf("no token transfers indexed")
+	}
+	if from < *tail {
+		return nil, fmt.Errorf("token transfers before block %d are not indexed", *tail)
+	}
+	var (
+		transfers []*rawdb.TokenTransfer
+		canonical = make(map[uint64]common.Hash)
+	)
+	rawdb.IterateTokenTransfers(bc.db, holder, token, from, to, func(transfer *rawdb.TokenTransfer) bool {
+		hash, ok := canonical[transfer.BlockNumber]
+		if !ok {
+			hash = bc.GetCanonicalHash(transfer.BlockNumber)
+			canonical[transfer.BlockNumber] = hash
+		}
+		if transfer.BlockHash == hash {
+			transfers = append(transfers, transfer)
+		}
+		return true
+	})
+	if token == nil {
+		sort.SliceStable(transfers, func(i, j int) bool {
+			a, b := transfers[i], transfers[j]
+			if a.BlockNumber != b.BlockNumber {
+				return a.BlockNumber < b.BlockNumber
+			}
+			if a.LogIndex != b.LogIndex {
+				return a.LogIndex < b.LogIndex
+			}
+			return a.Item < b.Item
+		})
+	}
+	return transfers, nil
+}
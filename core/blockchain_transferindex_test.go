@@ -0,0 +1,152 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// logCall returns code emitting a log with the given topics and data words.
+func logCall(topics []common.Hash, words ...common.Hash) []byte {
+	var code []byte
+	for i, word := range words {
+		code = append(code, byte(vm.PUSH32))
+		code = append(code, word.Bytes()...)
+		code = append(code, byte(vm.PUSH2), byte(32*i>>8), byte(32*i), byte(vm.MSTORE))
+	}
+	for i := len(topics) - 1; i >= 0; i-- {
+		code = append(code, byte(vm.PUSH32))
+		code = append(code, topics[i].Bytes()...)
+	}
+	code = append(code, byte(vm.PUSH2), byte(32*len(words)>>8), byte(32*len(words)), byte(vm.PUSH1), 0)
+	return append(code, byte(vm.LOG0)+byte(len(topics)))
+}
+
+// Tests that the token transfers of the imported blocks are found by holder and
+// token, restricted to the canonical chain and the retained blocks.
+func TestTransferIndex(t *testing.T) {
+	var (
+		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr   = crypto.PubkeyToAddress(key.PublicKey)
+		alice  = common.Address{0xaa}
+		bob    = common.Address{0xbb}
+		token  = common.Address{0xc0}
+		word   = func(n int64) common.Hash { return common.BigToHash(big.NewInt(n)) }
+	)
+	// The token logs an ERC-20 transfer from alice to bob, an ERC-721 mint to
+	// alice and an ERC-1155 batch transfer from bob to alice
+	var code []byte
+	code = append(code, logCall([]common.Hash{transferEventTopic, alice.Hash(), bob.Hash()}, word(5))...)
+	code = append(code, logCall([]common.Hash{transferEventTopic, {}, alice.Hash(), word(7)})...)
+	code = append(code, logCall([]common.Hash{transferBatchEventTopic, addr.Hash(), bob.Hash(), alice.Hash()},
+		word(64), word(160), word(2), word(1), word(2), word(2), word(3), word(4))...)
+
+	var (
+		gspec = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: GenesisAlloc{
+				addr:  {Balance: big.NewInt(10000000000000000)},
+				token: {Balance: big.NewInt(1), Code: code},
+			},
+		}
+		signer = types.LatestSigner(gspec.Config)
+		call   = func(gen *BlockGen) {
+			tx, err := types.SignTx(types.NewTransaction(gen.TxNonce(addr), token, new(big.Int), 200000, gen.header.BaseFee, nil), signer, key)
+			if err != nil {
+				t.Fatalf("failed to sign tx: %v", err)
+			}
+			gen.AddTx(tx)
+		}
+	)
+	genDb, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4, func(i int, gen *BlockGen) { call(gen) })
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	chain.SetTransferIndexing(true, 0)
+
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	transfers, err := chain.TokenTransfers(alice, nil, 1, 4)
+	if err != nil {
+		t.Fatalf("failed to query transfers: %v", err)
+	}
+	if len(transfers) != 16 {
+		for _, tr := range transfers {
+			t.Logf("%+v", tr)
+		}
+		t.Fatalf("have %d transfers of alice, want 16", len(transfers))
+	}
+	for i, transfer := range transfers[:4] {
+		if transfer.BlockNumber != 1 || transfer.BlockHash != blocks[0].Hash() || transfer.Token != token || transfer.Holder != alice {
+			t.Fatalf("transfer %d: unexpected position %+v", i, transfer)
+		}
+	}
+	if tr := transfers[0]; tr.Standard != rawdb.TokenERC20 || tr.From != alice || tr.To != bob || tr.Value.Int64() != 5 || tr.TokenID != nil {
+		t.Fatalf("unexpected ERC-20 transfer %+v", tr)
+	}
+	if tr := transfers[1]; tr.Standard != rawdb.TokenERC721 || tr.From != (common.Address{}) || tr.To != alice || tr.TokenID.Int64() != 7 || tr.Value != nil {
+		t.Fatalf("unexpected ERC-721 transfer %+v", tr)
+	}
+	for i, tr := range transfers[2:4] {
+		if tr.Standard != rawdb.TokenERC1155 || tr.From != bob || tr.To != alice || tr.Item != uint32(i) || tr.TokenID.Int64() != int64(i+1) || tr.Value.Int64() != int64(i+3) {
+			t.Fatalf("unexpected ERC-1155 transfer %+v", tr)
+		}
+	}
+	if transfers, err := chain.TokenTransfers(bob, &token, 2, 3); err != nil || len(transfers) != 6 {
+		t.Fatalf("have %d transfers of bob (err %v), want 6", len(transfers), err)
+	}
+	if transfers, err := chain.TokenTransfers(bob, &common.Address{0xc1}, 1, 4); err != nil || len(transfers) != 0 {
+		t.Fatalf("have %d transfers of another token (err %v), want 0", len(transfers), err)
+	}
+	// The transfers of the blocks reorged out are dropped
+	forks, _ := GenerateChain(gspec.Config, blocks[1], ethash.NewFaker(), genDb, 3, func(i int, gen *BlockGen) {
+		gen.SetCoinbase(common.Address{0x1})
+	})
+	if _, err := chain.InsertChain(forks); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	if transfers, err := chain.TokenTransfers(alice, nil, 1, 5); err != nil || len(transfers) != 8 {
+		t.Fatalf("have %d transfers of alice after reorg (err %v), want 8", len(transfers), err)
+	}
+	// Only the retained blocks are queryable
+	chain.SetTransferIndexing(true, 2)
+	more, _ := GenerateChain(gspec.Config, forks[len(forks)-1], ethash.NewFaker(), genDb, 2, func(i int, gen *BlockGen) { call(gen) })
+	if _, err := chain.InsertChain(more); err != nil {
+		t.Fatalf("failed to extend chain: %v", err)
+	}
+	if _, err := chain.TokenTransfers(alice, nil, 1, 7); err == nil {
+		t.Fatal("pruned transfers queried")
+	}
+	if transfers, err := chain.TokenTransfers(alice, &token, 6, 7); err != nil || len(transfers) != 8 {
+		t.Fatalf("have %d retained transfers of alice (err %v), want 8", len(transfers), err)
+	}
+	if transfers := rawdb.ReadTransferIndexTail(chain.db); transfers == nil || *transfers != 6 {
+		t.Fatalf("unexpected transfer index tail %v", transfers)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/log"
+)
+
+// errTxIndexerNotRunning is returned if the tx index is managed while the
+// blockchain was created without a tx lookup limit, so the indexer isn't
+// running.
+var errTxIndexerNotRunning = errors.New("transaction indexer not running")
+
+// TxIndexBackfill is the backfill of the tx index of a range of blocks
+// [From, To) below the tx index tail, indexed from the highest block down.
+type TxIndexBackfill struct {
+	From uint64
+	To   uint64
+	next atomic.Uint64 // Block below the lowest indexed one
+}
+
+// Next returns the number of the block below the lowest one indexed so far.
+func (b *TxIndexBackfill) Next() uint64 {
+	return b.next.Load()
+}
+
+// TxIndexCoverage describes the blocks whose transactions are indexed.
+type TxIndexCoverage struct {
+	Running   bool                 // Whether the indexer keeping the limit is running
+	Limit     uint64               // Number of recent blocks kept indexed, 0 for all of them
+	Head      uint64               // Head block
+	Tail      *uint64              // Oldest block of the indexed range up to the head, nil if none
+	Ranges    []rawdb.TxIndexRange // Ranges of blocks indexed below the tail
+	Backfills []*TxIndexBackfill   // Backfills of ranges below the tail in progress
+}
+
+// TxIndexCoverage reports which blocks have their transactions indexed.
+func (bc *BlockChain) TxIndexCoverage() *TxIndexCoverage {
+	bc.txIndexLock.Lock()
+	defer bc.txIndexLock.Unlock()
+
+	coverage := &TxIndexCoverage{
+		Running: bc.txIndexKick != nil,
+		Limit:   bc.txLookupLimit.Load(),
+		Head:    bc.CurrentBlock().Number.Uint64(),
+		Tail:    rawdb.ReadTxIndexTail(bc.db),
+	}
+	if coverage.Tail != nil {
+		coverage.Ranges = clipTxIndexRanges(rawdb.ReadTxIndexRanges(bc.db), *coverage.Tail)
+	}
+	for backfill := range bc.txIndexBackfills {
+		coverage.Backfills = append(coverage.Backfills, backfill)
+	}
+	sort.Slice(coverage.Backfills, func(i, j int) bool {
+		return coverage.Backfills[i].From < coverage.Backfills[j].From
+	})
+	return coverage
+}
+
+// BackfillTxIndex starts indexing the transactions of the blocks [from, to) in
+// the background, leaving out the blocks at or above the tx index tail which
+// are already indexed. The range stays indexed until the tail is moved back
+// over it and forward again.
+func (bc *BlockChain) BackfillTxIndex(from, to uint64) (*TxIndexBackfill, error) {
+	if bc.txIndexKick == nil {
+		return nil, errTxIndexerNotRunning
+	}
+	if bc.stopping.Load() {
+		return nil, errChainStopped
+	}
+	tail := rawdb.ReadTxIndexTail(bc.db)
+	if tail == nil {
+		return nil, errors.New("transaction index not initialized")
+	}
+	if to > *tail {
+		to = *tail
+	}
+	if from >= to {
+		return nil, fmt.Errorf("blocks [%d, %d) already indexed", from, to)
+	}
+	backfill := &TxIndexBackfill{From: from, To: to}
+	backfill.next.Store(to)
+
+	bc.txIndexLock.Lock()
+	if bc.txIndexBackfills == nil {
+		bc.txIndexBackfills = make(map[*TxIndexBackfill]struct{})
+	}
+	for running := range bc.txIndexBackfills {
+		if running.From < to && from < running.To {
+			bc.txIndexLock.Unlock()
+			return nil, fmt.Errorf("blocks [%d, %d) already being backfilled", running.From, running.To)
+		}
+	}
+	bc.txIndexBackfills[backfill] = struct{}{}
+	bc.txIndexLock.Unlock()
+
+	bc.wg.Add(1)
+	go func() {
+		defer bc.wg.Done()
+
+		rawdb.IndexTransactionsRange(bc.db, from, to, bc.quit, func(number uint64) bool {
+			backfill.next.Store(number)
+			return true
+		})
+		bc.txIndexLock.Lock()
+		defer bc.txIndexLock.Unlock()
+
+		delete(bc.txIndexBackfills, backfill)
+		// Only the top of the range is indexed if the backfill was interrupted
+		if next := backfill.next.Load(); next < to {
+			bc.addTxIndexRange(rawdb.TxIndexRange{From: next, To: to})
+		}
+		log.Info("Backfilled transaction index", "from", backfill.next.Load(), "to", to)
+	}()
+	return backfill, nil
+}
+
+// addTxIndexRange records a range indexed below the tail, merging it with the
+// overlapping and adjacent ones. The caller must hold txIndexLock.
+func (bc *BlockChain) addTxIndexRange(added rawdb.TxIndexRange) {
+	ranges := append(rawdb.ReadTxIndexRanges(bc.db), added)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].From < ranges[j].From })
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		if last := &merged[len(merged)-1]; r.From <= last.To {
+			if r.To > last.To {
+				last.To = r.To
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	if tail := rawdb.ReadTxIndexTail(bc.db); tail != nil {
+		merged = clipTxIndexRanges(merged, *tail)
+	}
+	rawdb.WriteTxIndexRanges(bc.db, merged)
+}
+
+// pruneTxIndexRanges drops the recorded ranges indexed below the tail that the
+// tail was moved back over, as the indexer unindexes them when moving the tail
+// forward again.
+func (bc *BlockChain) pruneTxIndexRanges() {
+	bc.txIndexLock.Lock()
+	defer bc.txIndexLock.Unlock()
+
+	tail := rawdb.ReadTxIndexTail(bc.db)
+	if tail == nil {
+		return
+	}
+	ranges := rawdb.ReadTxIndexRanges(bc.db)
+	clipped := clipTxIndexRanges(ranges, *tail)
+
+	// Only the trailing ranges can be clipped
+	if len(clipped) == len(ranges) && (len(ranges) == 0 || clipped[len(clipped)-1] == ranges[len(ranges)-1]) {
+		return
+	}
+	rawdb.WriteTxIndexRanges(bc.db, clipped)
+}
+
+// clipTxIndexRanges returns the parts of the sorted ranges below the tail.
+func clipTxIndexRanges(ranges []rawdb.TxIndexRange, tail uint64) []rawdb.TxIndexRange {
+	clipped := make([]rawdb.TxIndexRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.From >= tail {
+			break
+		}
+		if r.To > tail {
+			r.To = tail
+		}
+		clipped = append(clipped, r)
+	}
+	return clipped
+}
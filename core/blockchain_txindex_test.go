@@ -0,0 +1,123 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that ranges below the tx index tail are backfilled in the background,
+// and that the lookup limit is applied at runtime.
+func TestTxIndexBackfill(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   GenesisAlloc{address: {Balance: big.NewInt(100000000000000000)}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 128, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x00}, big.NewInt(1000), params.TxGas, block.header.BaseFee, nil), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
+	})
+	db := rawdb.NewMemoryDatabase()
+	limit := uint64(32)
+	chain, err := NewBlockChain(db, nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, &limit)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// The blocks are indexed as they're imported, and then unindexed down to the limit
+	rawdb.WriteTxIndexTail(db, 0)
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	indexed := func(number uint64) bool {
+		return rawdb.ReadTxLookupEntry(db, blocks[number-1].Transactions()[0].Hash()) != nil
+	}
+	wait := func(done func(*TxIndexCoverage) bool) *TxIndexCoverage {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if coverage := chain.TxIndexCoverage(); done(coverage) {
+				return coverage
+			}
+		}
+		t.Fatalf("tx index not updated: %+v", chain.TxIndexCoverage())
+		return nil
+	}
+	backfilled := func(coverage *TxIndexCoverage) bool { return len(coverage.Backfills) == 0 }
+	wait(func(coverage *TxIndexCoverage) bool { return *coverage.Tail == 97 })
+
+	if _, err := chain.BackfillTxIndex(10, 20); err != nil {
+		t.Fatalf("failed to backfill: %v", err)
+	}
+	coverage := wait(backfilled)
+	if want := []rawdb.TxIndexRange{{From: 10, To: 20}}; !reflect.DeepEqual(coverage.Ranges, want) {
+		t.Fatalf("backfilled ranges mismatch: have %v, want %v", coverage.Ranges, want)
+	}
+	for number := uint64(1); number < 97; number++ {
+		if have, want := indexed(number), number >= 10 && number < 20; have != want {
+			t.Fatalf("block %d: indexed %v, want %v", number, have, want)
+		}
+	}
+	// Backfills are clipped to the tail and merged with the recorded ranges
+	backfill, err := chain.BackfillTxIndex(15, 200)
+	if err != nil {
+		t.Fatalf("failed to backfill: %v", err)
+	}
+	if backfill.From != 15 || backfill.To != 97 {
+		t.Fatalf("backfill range mismatch: have [%d, %d), want [15, 97)", backfill.From, backfill.To)
+	}
+	coverage = wait(backfilled)
+	if want := []rawdb.TxIndexRange{{From: 10, To: 97}}; !reflect.DeepEqual(coverage.Ranges, want) {
+		t.Fatalf("merged ranges mismatch: have %v, want %v", coverage.Ranges, want)
+	}
+	if _, err := chain.BackfillTxIndex(100, 120); err == nil {
+		t.Fatal("indexed range backfilled")
+	}
+	// Moving the tail back over the ranges drops them, moving it forward again
+	// unindexes them
+	chain.SetTxLookupLimit(0)
+	coverage = wait(func(coverage *TxIndexCoverage) bool { return *coverage.Tail == 0 })
+	if len(coverage.Ranges) != 0 {
+		t.Fatalf("ranges above the tail kept: %v", coverage.Ranges)
+	}
+	chain.SetTxLookupLimit(32)
+	wait(func(coverage *TxIndexCoverage) bool { return *coverage.Tail == 97 })
+	for number := uint64(1); number <= 128; number++ {
+		if have, want := indexed(number), number >= 97; have != want {
+			t.Fatalf("block %d: indexed %v, want %v", number, have, want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/trie"
+)
+
+// ChainGapKind describes what is missing or inconsistent at a canonical height.
+type ChainGapKind string
+
+const (
+	GapCanonicalHash     ChainGapKind = "canonical-hash"     // No number->hash mapping
+	GapCanonicalMismatch ChainGapKind = "canonical-mismatch" // Mapping doesn't link to the child's parent hash
+	GapHeader            ChainGapKind = "header"             // Canonical header missing
+	GapBody              ChainGapKind = "body"               // Canonical block body missing
+	GapReceipts          ChainGapKind = "receipts"           // Canonical receipts missing
+)
+
+// ChainGap is a single inconsistency found in the canonical chain data.
+type ChainGap struct {
+	Number   uint64       `json:"number"`
+	Hash     common.Hash  `json:"hash"` // Hash the canonical chain is expected to contain, if known
+	Kind     ChainGapKind `json:"kind"`
+	Repaired bool         `json:"repaired"`
+}
+
+// FindChainGaps scans the canonical chain in the inclusive range [from, to],
+// walking backwards from to, and reports missing or mismatched number->hash
+// mappings, headers, bodies and receipts. Such gaps may be left behind by
+// imports that were interrupted half way through. The scan stops early if the
+// context is cancelled, returning the gaps found so far.
+func (bc *BlockChain) FindChainGaps(ctx context.Context, from, to uint64) []ChainGap {
+	var (
+		gaps     []ChainGap
+		expected common.Hash // Hash the next canonical block points to as its parent
+	)
+	for number := to + 1; number > from && ctx.Err() == nil; number-- {
+		n := number - 1
+		hash := rawdb.ReadCanonicalHash(bc.db, n)
+		switch {
+		case hash == (common.Hash{}):
+			gaps = append(gaps, ChainGap{Number: n, Hash: expected, Kind: GapCanonicalHash})
+			if expected == (common.Hash{}) {
+				continue
+			}
+			hash = expected
+		case expected != (common.Hash{}) && hash != expected:
+			gaps = append(gaps, ChainGap{Number: n, Hash: expected, Kind: GapCanonicalMismatch})
+			hash = expected
+		}
+		header := rawdb.ReadHeader(bc.db, hash, n)
+		if header == nil {
+			gaps = append(gaps, ChainGap{Number: n, Hash: hash, Kind: GapHeader})
+			expected = common.Hash{}
+			continue
+		}
+		if !rawdb.HasBody(bc.db, hash, n) {
+			gaps = append(gaps, ChainGap{Number: n, Hash: hash, Kind: GapBody})
+		}
+		if !rawdb.HasReceipts(bc.db, hash, n) {
+			gaps = append(gaps, ChainGap{Number: n, Hash: hash, Kind: GapReceipts})
+		}
+		expected = header.ParentHash
+	}
+	return gaps
+}
+
+// RepairChainGaps attempts to fix the given gaps from data available locally.
+// Canonical mappings are restored from the header chain linkage, and missing
+// receipts are re-derived by re-executing the block on top of its parent state
+// (only if that state is available). Missing headers and bodies can't be
+// recreated locally and are left for the caller to refetch. The returned gaps
+// have their Repaired flag updated.
+func (bc *BlockChain) RepairChainGaps(ctx context.Context, gaps []ChainGap) ([]ChainGap, error) {
+	if !bc.chainmu.TryLock() {
+		return gaps, errChainStopped
+	}
+	defer bc.chainmu.Unlock()
+
+	repaired := make([]ChainGap, len(gaps))
+	copy(repaired, gaps)
+	for i, gap := range repaired {
+		if err := ctx.Err(); err != nil {
+			return repaired, err
+		}
+		if gap.Hash == (common.Hash{}) {
+			continue
+		}
+		var err error
+		switch gap.Kind {
+		case GapCanonicalHash, GapCanonicalMismatch:
+			if !rawdb.HasHeader(bc.db, gap.Hash, gap.Number) {
+				err = errors.New("header not available")
+				break
+			}
+			rawdb.WriteCanonicalHash(bc.db, gap.Hash, gap.Number)
+		case GapReceipts:
+			err = bc.rederiveReceipts(ctx, gap.Hash, gap.Number)
+		default:
+			err = errors.New("can't be repaired from local data")
+		}
+		if err != nil {
+			log.Warn("Failed to repair chain gap", "number", gap.Number, "hash", gap.Hash, "kind", gap.Kind, "err", err)
+			continue
+		}
+		log.Info("Repaired chain gap", "number", gap.Number, "hash", gap.Hash, "kind", gap.Kind)
+		repaired[i].Repaired = true
+	}
+	return repaired, nil
+}
+
+// rederiveReceipts re-executes a block on top of its parent state and stores
+// the resulting receipts, after checking them against the header.
+func (bc *BlockChain) rederiveReceipts(ctx context.Context, hash common.Hash, number uint64) error {
+	block := rawdb.ReadBlock(bc.db, hash, number)
+	if block == nil {
+		return errors.New("block not available")
+	}
+	parent := bc.GetHeader(block.ParentHash(), number-1)
+	if parent == nil {
+		return errors.New("parent header not available")
+	}
+	statedb, err := bc.StateAt(parent.Root)
+	if err != nil {
+		return fmt.Errorf("parent state not available: %w", err)
+	}
+	statedb.SetContext(ctx)
+	receipts, _, _, err := bc.Processor().Process(WithBlockReplay(ctx), block, statedb, bc.vmConfig)
+	if err != nil {
+		return err
+	}
+	if root := types.DeriveSha(receipts, trie.NewStackTrie(nil)); root != block.ReceiptHash() {
+		return fmt.Errorf("re-derived receipt root mismatch: have %x, want %x", root, block.ReceiptHash())
+	}
+	rawdb.WriteReceipts(bc.db, hash, number, receipts)
+	bc.receiptsCache.Remove(hash)
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+)
+
+// Tests that gaps in the canonical chain are detected and repaired from local data.
+func TestChainGaps(t *testing.T) {
+	_, _, chain, err := newCanonical(ethash.NewFaker(), 16, true)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	head := chain.CurrentBlock().Number.Uint64()
+	if gaps := chain.FindChainGaps(context.Background(), 0, head); len(gaps) != 0 {
+		t.Fatalf("unexpected gaps in healthy chain: %v", gaps)
+	}
+	// Punch a hole in the canonical mappings and the receipts
+	hash5 := chain.GetCanonicalHash(5)
+	hash9 := chain.GetCanonicalHash(9)
+	rawdb.DeleteCanonicalHash(chain.db, 5)
+	rawdb.DeleteReceipts(chain.db, hash9, 9)
+
+	gaps := chain.FindChainGaps(context.Background(), 0, head)
+	if len(gaps) != 2 {
+		t.Fatalf("wrong number of gaps: have %d, want 2: %v", len(gaps), gaps)
+	}
+	if gaps[0].Number != 9 || gaps[0].Kind != GapReceipts || gaps[0].Hash != hash9 {
+		t.Errorf("unexpected first gap: %+v", gaps[0])
+	}
+	if gaps[1].Number != 5 || gaps[1].Kind != GapCanonicalHash || gaps[1].Hash != hash5 {
+		t.Errorf("unexpected second gap: %+v", gaps[1])
+	}
+	repaired, err := chain.RepairChainGaps(context.Background(), gaps)
+	if err != nil {
+		t.Fatalf("failed to repair gaps: %v", err)
+	}
+	for _, gap := range repaired {
+		if !gap.Repaired {
+			t.Errorf("gap not repaired: %+v", gap)
+		}
+	}
+	if gaps := chain.FindChainGaps(context.Background(), 0, head); len(gaps) != 0 {
+		t.Fatalf("unexpected gaps after repair: %v", gaps)
+	}
+}
@@ -439,6 +439,11 @@ func (c *ChainIndexer) Sections() (uint64, uint64, common.Hash) {
 	return c.storedSections, c.storedSections*c.sectionSize - 1, c.SectionHead(c.storedSections - 1)
 }
 
+// SectionSize returns the number of blocks in a single section of the indexer.
+func (c *ChainIndexer) SectionSize() uint64 {
+	return c.sectionSize
+}
+
 // AddChildIndexer adds a child ChainIndexer that can use the output of this one
 func (c *ChainIndexer) AddChildIndexer(indexer *ChainIndexer) {
 	if indexer == c {
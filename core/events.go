@@ -17,6 +17,8 @@
 package core
 
 import (
+	"time"
+
 	"github.com/chainupcloud/arb-geth/common"
 	"github.com/chainupcloud/arb-geth/core/types"
 )
@@ -41,3 +43,13 @@ type ChainSideEvent struct {
 }
 
 type ChainHeadEvent struct{ Block *types.Block }
+
+// BlockWriteEvent is posted for every block written along with its state and
+// then considered for the chain head, whatever the outcome.
+type BlockWriteEvent struct {
+	Block       *types.Block
+	Status      WriteStatus   // CanonStatTy, SideStatTy, or NonStatTy if updating the head failed
+	Reorg       bool          // Whether the block became the head by reorganising the chain
+	ProcessTime time.Duration // Time spent processing the block, zero if unknown
+	TrieFlush   TrieFlush     // Flushes of the trie database decided on writing the state
+}
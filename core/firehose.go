@@ -0,0 +1,284 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/event"
+)
+
+// FirehoseEventType identifies the kind of an event in the firehose.
+type FirehoseEventType uint8
+
+const (
+	// FirehoseBlock is posted when a block becomes part of the canonical chain.
+	// Canonical blocks are always posted in ascending order.
+	FirehoseBlock FirehoseEventType = iota
+
+	// FirehoseLogs carries the logs of the preceding FirehoseBlock, it's only
+	// posted if the block has any.
+	FirehoseLogs
+
+	// FirehoseHead is posted when the head of the chain is updated, the same
+	// way as ChainHeadEvent.
+	FirehoseHead
+
+	// FirehoseSide is posted when a block is imported on a side chain, or gets
+	// dropped from the canonical chain by a reorg, the same way as ChainSideEvent.
+	FirehoseSide
+
+	// FirehoseRemovedLogs carries the logs of the preceding FirehoseSide block
+	// dropped from the canonical chain, it's only posted if the block has any.
+	FirehoseRemovedLogs
+
+	// FirehoseReorg marks the start of a reorg. The dropped blocks follow from
+	// the highest to the lowest, then the new canonical blocks in ascending order.
+	FirehoseReorg
+)
+
+func (t FirehoseEventType) String() string {
+	switch t {
+	case FirehoseBlock:
+		return "block"
+	case FirehoseLogs:
+		return "logs"
+	case FirehoseHead:
+		return "head"
+	case FirehoseSide:
+		return "side"
+	case FirehoseRemovedLogs:
+		return "removedLogs"
+	case FirehoseReorg:
+		return "reorg"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+// FirehoseReorgBoundary describes a reorg of the canonical chain.
+type FirehoseReorgBoundary struct {
+	CommonAncestor *types.Header // Last block shared by the old and new canonical chains
+	OldHead        *types.Header // Head of the canonical chain before the reorg, nil if it was deleted
+	NewHead        *types.Header // Head of the canonical chain after the reorg
+}
+
+// FirehoseEvent is an entry of the ordered stream of chain events.
+type FirehoseEvent struct {
+	Type     FirehoseEventType
+	Block    *types.Block           // Block the event refers to, nil for FirehoseReorg
+	Logs     []*types.Log           // Logs of FirehoseLogs and FirehoseRemovedLogs events
+	Reorg    *FirehoseReorgBoundary // Boundary of FirehoseReorg events
+	Replayed bool                   // Whether the event was served from the database
+}
+
+// fireBlock posts a block that became canonical, followed by its logs.
+func (bc *BlockChain) fireBlock(block *types.Block, logs []*types.Log) {
+	bc.firehoseFeed.Send(FirehoseEvent{Type: FirehoseBlock, Block: block})
+	if len(logs) > 0 {
+		bc.firehoseFeed.Send(FirehoseEvent{Type: FirehoseLogs, Block: block, Logs: logs})
+	}
+}
+
+// fireSide posts a block that isn't part of the canonical chain, followed by
+// the logs it had if it was dropped from it.
+func (bc *BlockChain) fireSide(block *types.Block, removedLogs []*types.Log) {
+	bc.firehoseFeed.Send(FirehoseEvent{Type: FirehoseSide, Block: block})
+	if len(removedLogs) > 0 {
+		bc.firehoseFeed.Send(FirehoseEvent{Type: FirehoseRemovedLogs, Block: block, Logs: removedLogs})
+	}
+}
+
+// fireHead posts an update of the chain head.
+func (bc *BlockChain) fireHead(block *types.Block) {
+	bc.firehoseFeed.Send(FirehoseEvent{Type: FirehoseHead, Block: block})
+}
+
+// fireReorg posts the start of a reorg.
+func (bc *BlockChain) fireReorg(ancestor, oldHead, newHead *types.Header) {
+	bc.firehoseFeed.Send(FirehoseEvent{Type: FirehoseReorg, Reorg: &FirehoseReorgBoundary{
+		CommonAncestor: ancestor,
+		OldHead:        oldHead,
+		NewHead:        newHead,
+	}})
+}
+
+// fireRewind posts the rewind of the chain from the given old head to the
+// current one. The dropped blocks are deleted by the rewind, so they aren't
+// posted individually.
+func (bc *BlockChain) fireRewind(oldHead *types.Header) {
+	head := bc.CurrentBlock()
+	if oldHead == nil || oldHead.Hash() == head.Hash() {
+		return
+	}
+	block := bc.GetBlock(head.Hash(), head.Number.Uint64())
+	if block == nil {
+		return
+	}
+	bc.fireReorg(head, oldHead, head)
+	bc.fireHead(block)
+}
+
+// SubscribeFirehose registers a subscription to the ordered stream of chain
+// events, starting with the canonical blocks from the given number onwards.
+// The blocks already in the chain are replayed from the database first, as
+// FirehoseBlock and FirehoseLogs events, then the subscription switches to the
+// live events without gaps or duplicates. If the canonical chain is reorged
+// during the replay, the replayed blocks that got dropped are reported as with
+// a live reorg.
+//
+// Like with the other chain event subscriptions, the events are sent
+// synchronously once live, so the channel must be drained promptly to not
+// stall the chain.
+func (bc *BlockChain) SubscribeFirehose(from uint64, ch chan<- FirehoseEvent) event.Subscription {
+	return bc.scope.Track(event.NewSubscription(func(quit <-chan struct{}) error {
+		replay := &firehoseReplay{bc: bc, ch: ch, quit: quit, next: from}
+		sub, err := replay.run()
+		if err != nil || sub == nil {
+			return err
+		}
+		defer sub.Unsubscribe()
+
+		select {
+		case err := <-sub.Err():
+			return err
+		case <-quit:
+			return nil
+		}
+	}))
+}
+
+// firehoseReplay serves the past canonical blocks of a firehose subscription.
+type firehoseReplay struct {
+	bc   *BlockChain
+	ch   chan<- FirehoseEvent
+	quit <-chan struct{}
+
+	next uint64      // Number of the next block to replay
+	tip  common.Hash // Hash of the last replayed block, zero if none yet
+}
+
+// run replays the canonical blocks until it reaches the head of the chain, and
+// subscribes the channel to the live events. It returns a nil subscription if
+// the replay was interrupted.
+func (r *firehoseReplay) run() (event.Subscription, error) {
+	for {
+		head := r.bc.CurrentBlock().Number.Uint64()
+		for ; r.next <= head; r.next++ {
+			block := r.bc.GetBlockByNumber(r.next)
+			if block == nil {
+				if r.next <= r.bc.CurrentBlock().Number.Uint64() {
+					return nil, fmt.Errorf("block %d not available", r.next)
+				}
+				break // The chain was rewound below the block
+			}
+			if r.tip != (common.Hash{}) && block.ParentHash() != r.tip {
+				// The chain was reorged since the last replayed block
+				break
+			}
+			if !r.send(FirehoseEvent{Type: FirehoseBlock, Block: block, Replayed: true}) {
+				return nil, nil
+			}
+			if logs := r.bc.collectLogs(block, false); len(logs) > 0 {
+				if !r.send(FirehoseEvent{Type: FirehoseLogs, Block: block, Logs: logs, Replayed: true}) {
+					return nil, nil
+				}
+			}
+			r.tip = block.Hash()
+		}
+		if !r.reconcile() {
+			return nil, nil
+		}
+		// Switch to the live events if the replay caught up with the chain.
+		// Chain events are only posted with the chain mutex held, so none can
+		// be missed or posted twice while it's held.
+		if !r.bc.chainmu.TryLock() {
+			return nil, errChainStopped
+		}
+		head = r.bc.CurrentBlock().Number.Uint64()
+		if r.next > head && (r.tip == (common.Hash{}) || r.bc.GetCanonicalHash(r.next-1) == r.tip) {
+			sub := r.bc.firehoseFeed.Subscribe(r.ch)
+			r.bc.chainmu.Unlock()
+			return sub, nil
+		}
+		r.bc.chainmu.Unlock()
+	}
+}
+
+// reconcile reports the replayed blocks that are no longer part of the
+// canonical chain as dropped by a reorg, and rewinds the replay to the common
+// ancestor. It returns false if the replay was interrupted.
+func (r *firehoseReplay) reconcile() bool {
+	if r.tip == (common.Hash{}) || r.bc.GetCanonicalHash(r.next-1) == r.tip {
+		return true
+	}
+	var (
+		head    = r.bc.CurrentBlock()
+		oldHead = r.bc.GetHeaderByHash(r.tip)
+		dropped []*types.Block
+	)
+	if oldHead == nil {
+		// The replayed blocks were deleted by a rewind, so the current head is
+		// the best approximation of the common ancestor
+		r.next, r.tip = head.Number.Uint64()+1, head.Hash()
+		return r.send(FirehoseEvent{Type: FirehoseReorg, Replayed: true, Reorg: &FirehoseReorgBoundary{
+			CommonAncestor: head,
+			NewHead:        head,
+		}})
+	}
+	ancestor := oldHead
+	for ancestor.Number.Sign() > 0 && r.bc.GetCanonicalHash(ancestor.Number.Uint64()) != ancestor.Hash() {
+		block := r.bc.GetBlock(ancestor.Hash(), ancestor.Number.Uint64())
+		parent := r.bc.GetHeader(ancestor.ParentHash, ancestor.Number.Uint64()-1)
+		if block == nil || parent == nil {
+			break
+		}
+		dropped = append(dropped, block)
+		ancestor = parent
+	}
+	if !r.send(FirehoseEvent{Type: FirehoseReorg, Replayed: true, Reorg: &FirehoseReorgBoundary{
+		CommonAncestor: ancestor,
+		OldHead:        oldHead,
+		NewHead:        head,
+	}}) {
+		return false
+	}
+	for _, block := range dropped {
+		if !r.send(FirehoseEvent{Type: FirehoseSide, Block: block, Replayed: true}) {
+			return false
+		}
+		if logs := r.bc.collectLogs(block, true); len(logs) > 0 {
+			if !r.send(FirehoseEvent{Type: FirehoseRemovedLogs, Block: block, Logs: logs, Replayed: true}) {
+				return false
+			}
+		}
+	}
+	r.next, r.tip = ancestor.Number.Uint64()+1, ancestor.Hash()
+	return true
+}
+
+// send delivers a replayed event, returning false if the subscription ended.
+func (r *firehoseReplay) send(ev FirehoseEvent) bool {
+	select {
+	case r.ch <- ev:
+		return true
+	case <-r.quit:
+		return false
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that the firehose replays the past canonical blocks and follows up with
+// the live events, so that a consumer can track the canonical chain through it,
+// across the reorgs too.
+func TestFirehose(t *testing.T) {
+	var (
+		gspec  = &Genesis{Config: params.TestChainConfig}
+		engine = ethash.NewFaker()
+	)
+	genDb, chain, _ := GenerateChainWithGenesis(gspec, engine, 6, func(i int, gen *BlockGen) {})
+	fork, _ := GenerateChain(gspec.Config, chain[1], engine, genDb, 6, func(i int, gen *BlockGen) {
+		gen.SetCoinbase(common.Address{0x01})
+	})
+	blockchain, _ := NewBlockChain(rawdb.NewMemoryDatabase(), nil, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	defer blockchain.Stop()
+
+	if _, err := blockchain.InsertChain(chain[:4]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	events := make(chan FirehoseEvent, 256)
+	sub := blockchain.SubscribeFirehose(2, events)
+	defer sub.Unsubscribe()
+
+	// Extend the chain, then reorg it to the longer fork
+	if _, err := blockchain.InsertChain(chain[4:]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if _, err := blockchain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to insert fork: %v", err)
+	}
+	head := blockchain.CurrentBlock()
+	if head.Hash() != fork[len(fork)-1].Hash() {
+		t.Fatalf("chain not reorged to the fork")
+	}
+	// Track the canonical chain through the events
+	var (
+		canonical = make(map[uint64]common.Hash)
+		timeout   = time.After(10 * time.Second)
+	)
+	for canonical[head.Number.Uint64()] != head.Hash() {
+		select {
+		case ev := <-events:
+			switch ev.Type {
+			case FirehoseBlock:
+				number := ev.Block.NumberU64()
+				if len(canonical) == 0 {
+					if number != 2 {
+						t.Fatalf("first block %d, want 2", number)
+					}
+				} else if parent, ok := canonical[number-1]; !ok || parent != ev.Block.ParentHash() {
+					t.Fatalf("block %d doesn't extend the tracked chain", number)
+				}
+				if _, ok := canonical[number]; ok {
+					t.Fatalf("block %d replaced without a reorg", number)
+				}
+				canonical[number] = ev.Block.Hash()
+
+			case FirehoseReorg:
+				ancestor := ev.Reorg.CommonAncestor.Number.Uint64()
+				if canonical[ancestor] != ev.Reorg.CommonAncestor.Hash() {
+					t.Fatalf("reorg ancestor %d not in the tracked chain", ancestor)
+				}
+				for number := range canonical {
+					if number > ancestor {
+						delete(canonical, number)
+					}
+				}
+
+			case FirehoseSide:
+				if number := ev.Block.NumberU64(); canonical[number] == ev.Block.Hash() {
+					t.Fatalf("canonical block %d reported as side block", number)
+				}
+			}
+		case err := <-sub.Err():
+			t.Fatalf("subscription failed: %v", err)
+		case <-timeout:
+			t.Fatalf("timeout, tracked %d blocks", len(canonical))
+		}
+	}
+	for number := uint64(2); number <= head.Number.Uint64(); number++ {
+		if canonical[number] != blockchain.GetCanonicalHash(number) {
+			t.Errorf("block %d: tracked %x, canonical %x", number, canonical[number], blockchain.GetCanonicalHash(number))
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package logindex
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// ChunkBits is the number of low bits of a block number addressed within a
+	// single bitmap, every bitmap covers 2^ChunkBits consecutive blocks.
+	ChunkBits = 16
+
+	// arrayMaxSize is the number of values beyond which a bitmap switches from a
+	// sorted array to a bitset, the point where the array gets larger.
+	arrayMaxSize = 4096
+
+	// bitsetWords is the number of 64 bit words of a bitset covering a chunk.
+	bitsetWords = 1 << ChunkBits / 64
+
+	bitmapArray  = 0 // encoding tag of the sorted array representation
+	bitmapBitset = 1 // encoding tag of the bitset representation
+)
+
+var errInvalidBitmap = errors.New("invalid log index bitmap")
+
+// bitmap is a set of the block offsets within a chunk, stored like the containers
+// of a roaring bitmap: as a sorted array while sparse, and as a bitset once dense.
+type bitmap struct {
+	array  []uint16 // sorted offsets, if sparse
+	bitset []uint64 // one bit per offset, if dense
+	count  int      // number of offsets in the bitset
+}
+
+// add inserts the given offset into the bitmap.
+func (b *bitmap) add(v uint16) {
+	if b.bitset != nil {
+		if b.bitset[v/64]&(1<<(v%64)) == 0 {
+			b.bitset[v/64] |= 1 << (v % 64)
+			b.count++
+		}
+		return
+	}
+	i := sort.Search(len(b.array), func(i int) bool { return b.array[i] >= v })
+	if i < len(b.array) && b.array[i] == v {
+		return
+	}
+	b.array = append(b.array, 0)
+	copy(b.array[i+1:], b.array[i:])
+	b.array[i] = v
+
+	if len(b.array) > arrayMaxSize {
+		b.toBitset()
+	}
+}
+
+// remove deletes the given offset from the bitmap.
+func (b *bitmap) remove(v uint16) {
+	if b.bitset != nil {
+		if b.bitset[v/64]&(1<<(v%64)) != 0 {
+			b.bitset[v/64] &^= 1 << (v % 64)
+			b.count--
+		}
+		if b.count <= arrayMaxSize {
+			b.toArray()
+		}
+		return
+	}
+	i := sort.Search(len(b.array), func(i int) bool { return b.array[i] >= v })
+	if i < len(b.array) && b.array[i] == v {
+		b.array = append(b.array[:i], b.array[i+1:]...)
+	}
+}
+
+// contains reports whether the given offset is in the bitmap.
+func (b *bitmap) contains(v uint16) bool {
+	if b.bitset != nil {
+		return b.bitset[v/64]&(1<<(v%64)) != 0
+	}
+	i := sort.Search(len(b.array), func(i int) bool { return b.array[i] >= v })
+	return i < len(b.array) && b.array[i] == v
+}
+
+// empty reports whether the bitmap has no offsets.
+func (b *bitmap) empty() bool {
+	if b.bitset != nil {
+		return b.count == 0
+	}
+	return len(b.array) == 0
+}
+
+// or adds all the offsets of the other bitmap into this one.
+func (b *bitmap) or(o *bitmap) {
+	if o.bitset != nil {
+		if b.bitset == nil {
+			b.toBitset()
+		}
+		b.count = 0
+		for i, word := range o.bitset {
+			b.bitset[i] |= word
+			b.count += bits.OnesCount64(b.bitset[i])
+		}
+		return
+	}
+	for _, v := range o.array {
+		b.add(v)
+	}
+}
+
+// and returns the offsets contained in both bitmaps.
+func (b *bitmap) and(o *bitmap) *bitmap {
+	if b.bitset != nil && o.bitset != nil {
+		res := &bitmap{bitset: make([]uint64, bitsetWords)}
+		for i := range b.bitset {
+			res.bitset[i] = b.bitset[i] & o.bitset[i]
+			res.count += bits.OnesCount64(res.bitset[i])
+		}
+		if res.count <= arrayMaxSize {
+			res.toArray()
+		}
+		return res
+	}
+	if b.bitset != nil {
+		b, o = o, b
+	}
+	res := new(bitmap)
+	for _, v := range b.array {
+		if o.contains(v) {
+			res.array = append(res.array, v)
+		}
+	}
+	return res
+}
+
+// values returns the offsets in the bitmap in ascending order.
+func (b *bitmap) values() []uint16 {
+	if b.bitset == nil {
+		return b.array
+	}
+	values := make([]uint16, 0, b.count)
+	for i, word := range b.bitset {
+		for word != 0 {
+			bit := bits.TrailingZeros64(word)
+			values = append(values, uint16(i*64+bit))
+			word &= word - 1
+		}
+	}
+	return values
+}
+
+func (b *bitmap) toBitset() {
+	b.bitset = make([]uint64, bitsetWords)
+	for _, v := range b.array {
+		b.bitset[v/64] |= 1 << (v % 64)
+	}
+	b.count, b.array = len(b.array), nil
+}
+
+func (b *bitmap) toArray() {
+	b.array, b.bitset, b.count = b.values(), nil, 0
+}
+
+// encode serializes the bitmap, tagged with its representation.
+func (b *bitmap) encode() []byte {
+	if b.bitset != nil {
+		enc := make([]byte, 1+8*bitsetWords)
+		enc[0] = bitmapBitset
+		for i, word := range b.bitset {
+			binary.BigEndian.PutUint64(enc[1+8*i:], word)
+		}
+		return enc
+	}
+	enc := make([]byte, 1+2*len(b.array))
+	enc[0] = bitmapArray
+	for i, v := range b.array {
+		binary.BigEndian.PutUint16(enc[1+2*i:], v)
+	}
+	return enc
+}
+
+// decodeBitmap deserializes a bitmap encoded by encode.
+func decodeBitmap(enc []byte) (*bitmap, error) {
+	if len(enc) == 0 {
+		return nil, errInvalidBitmap
+	}
+	switch enc[0] {
+	case bitmapArray:
+		if (len(enc)-1)%2 != 0 || (len(enc)-1)/2 > arrayMaxSize {
+			return nil, errInvalidBitmap
+		}
+		b := &bitmap{array: make([]uint16, (len(enc)-1)/2)}
+		for i := range b.array {
+			b.array[i] = binary.BigEndian.Uint16(enc[1+2*i:])
+			if i > 0 && b.array[i] <= b.array[i-1] {
+				return nil, errInvalidBitmap
+			}
+		}
+		return b, nil
+
+	case bitmapBitset:
+		if len(enc) != 1+8*bitsetWords {
+			return nil, errInvalidBitmap
+		}
+		b := &bitmap{bitset: make([]uint64, bitsetWords)}
+		for i := range b.bitset {
+			b.bitset[i] = binary.BigEndian.Uint64(enc[1+8*i:])
+			b.count += bits.OnesCount64(b.bitset[i])
+		}
+		return b, nil
+	}
+	return nil, errInvalidBitmap
+}
@@ -0,0 +1,450 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package logindex implements an index of the blocks containing logs of each
+// address and topic, serving wide range log queries without scanning the blooms.
+package logindex
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/event"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+const (
+	addressField = 0 // field of the log addresses, topics use 1 + their position
+	maxTopics    = 4 // number of topic positions indexed
+)
+
+// Config are the configuration parameters of the log indexer.
+type Config struct {
+	Tail      uint64 // First block to index
+	BatchSize uint64 // Maximum number of blocks indexed or unwound per database write
+}
+
+// Chain is the part of the blockchain followed by the log indexer.
+type Chain interface {
+	Config() *params.ChainConfig
+	CurrentBlock() *types.Header
+	SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription
+}
+
+// Indexer maintains the log index of the canonical chain. It follows the chain
+// head, indexing the new blocks and unwinding the ones dropped by reorgs.
+type Indexer struct {
+	db     ethdb.Database
+	chain  Chain
+	config Config
+
+	lock     sync.RWMutex            // Lock held while the index is updated, to keep queries consistent
+	progress *rawdb.LogIndexProgress // Range of blocks currently indexed, nil if none
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewIndexer creates a log indexer over the given database, resuming from the
+// progress stored in it. Call Start to begin following the chain.
+func NewIndexer(db ethdb.Database, chain Chain, config Config) *Indexer {
+	if config.BatchSize == 0 {
+		config.BatchSize = 1
+	}
+	return &Indexer{
+		db:       db,
+		chain:    chain,
+		config:   config,
+		progress: rawdb.ReadLogIndexProgress(db),
+		quit:     make(chan struct{}),
+	}
+}
+
+// Start begins following the chain in the background.
+func (idx *Indexer) Start() {
+	idx.wg.Add(1)
+	go idx.loop()
+}
+
+// Stop terminates the indexer, waiting for any pending database write.
+func (idx *Indexer) Stop() {
+	close(idx.quit)
+	idx.wg.Wait()
+}
+
+func (idx *Indexer) loop() {
+	defer idx.wg.Done()
+
+	heads := make(chan core.ChainHeadEvent, 10)
+	sub := idx.chain.SubscribeChainHeadEvent(heads)
+	defer sub.Unsubscribe()
+
+	if progress := idx.progress; progress != nil && progress.Tail != idx.config.Tail {
+		log.Warn("Log index tail changed, reindexing", "old", progress.Tail, "new", idx.config.Tail)
+		idx.reset()
+	}
+	logged := time.Now()
+	for {
+		done, err := idx.step()
+		if err != nil {
+			log.Error("Failed to update log index", "err", err)
+			done = true
+		}
+		if !done {
+			if time.Since(logged) > 8*time.Second {
+				if progress := idx.progress; progress != nil {
+					log.Info("Indexing logs", "tail", progress.Tail, "head", progress.Head)
+				}
+				logged = time.Now()
+			}
+			select {
+			case <-idx.quit:
+				return
+			default:
+				continue
+			}
+		}
+		select {
+		case <-heads:
+		case <-sub.Err():
+			return
+		case <-idx.quit:
+			return
+		}
+	}
+}
+
+// step brings the index one batch closer to the chain head, unwinding the blocks
+// no longer canonical first. It reports whether the index was up to date.
+func (idx *Indexer) step() (bool, error) {
+	head := idx.chain.CurrentBlock().Number.Uint64()
+	if progress := idx.progress; progress != nil {
+		if progress.Head > head || rawdb.ReadCanonicalHash(idx.db, progress.Head) != progress.HeadHash {
+			return false, idx.unwind(head)
+		}
+	}
+	from := idx.config.Tail
+	if idx.progress != nil {
+		from = idx.progress.Head + 1
+	}
+	if from > head {
+		return true, nil
+	}
+	to := head
+	if to-from >= idx.config.BatchSize {
+		to = from + idx.config.BatchSize - 1
+	}
+	indexed, err := idx.extend(from, to)
+	return indexed == 0, err
+}
+
+// extend indexes the canonical blocks in [from, to], stopping early if they no
+// longer link up with the indexed ones because of a reorg under way.
+func (idx *Indexer) extend(from, to uint64) (int, error) {
+	var (
+		w        = newWriter(idx.db)
+		progress = idx.progress
+		indexed  int
+	)
+	for number := from; number <= to; number++ {
+		hash := rawdb.ReadCanonicalHash(idx.db, number)
+		header := rawdb.ReadHeader(idx.db, hash, number)
+		if header == nil {
+			break
+		}
+		if progress != nil && header.ParentHash != progress.HeadHash {
+			break
+		}
+		if err := w.update(number, rawdb.ReadLogs(idx.db, hash, number, idx.chain.Config()), true); err != nil {
+			return 0, err
+		}
+		progress = &rawdb.LogIndexProgress{Tail: idx.config.Tail, Head: number, HeadHash: hash}
+		indexed++
+	}
+	if indexed == 0 {
+		return 0, nil
+	}
+	return indexed, idx.commit(w, progress)
+}
+
+// unwind removes the indexed blocks which are no longer canonical, newest first.
+// Blocks whose logs can't be retrieved anymore are left in the bitmaps, which
+// only yields false positives, weeded out when the matching blocks are read.
+func (idx *Indexer) unwind(head uint64) error {
+	var (
+		w        = newWriter(idx.db)
+		progress = *idx.progress
+	)
+	for i := uint64(0); i < idx.config.BatchSize; i++ {
+		if progress.Head <= head && rawdb.ReadCanonicalHash(idx.db, progress.Head) == progress.HeadHash {
+			break
+		}
+		header := rawdb.ReadHeader(idx.db, progress.HeadHash, progress.Head)
+		if header == nil {
+			log.Warn("Log index head missing, reindexing", "number", progress.Head, "hash", progress.HeadHash)
+			idx.reset()
+			return nil
+		}
+		if err := w.update(progress.Head, rawdb.ReadLogs(idx.db, progress.HeadHash, progress.Head, idx.chain.Config()), false); err != nil {
+			return err
+		}
+		if progress.Head == progress.Tail {
+			return idx.commit(w, nil)
+		}
+		progress.Head, progress.HeadHash = progress.Head-1, header.ParentHash
+	}
+	return idx.commit(w, &progress)
+}
+
+// commit writes the updated bitmaps along with the new progress of the index.
+func (idx *Indexer) commit(w *writer, progress *rawdb.LogIndexProgress) error {
+	batch := idx.db.NewBatch()
+	w.flush(batch)
+	if progress == nil {
+		rawdb.DeleteLogIndexProgress(batch)
+	} else {
+		rawdb.WriteLogIndexProgress(batch, progress)
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	idx.progress = progress
+	return nil
+}
+
+// reset deletes the whole index.
+func (idx *Indexer) reset() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	batch := idx.db.NewBatch()
+	it := idx.db.NewIterator(rawdb.LogIndexPrefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		batch.Delete(it.Key())
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				log.Error("Failed to delete log index", "err", err)
+				return
+			}
+			batch.Reset()
+		}
+	}
+	rawdb.DeleteLogIndexProgress(batch)
+	if err := batch.Write(); err != nil {
+		log.Error("Failed to delete log index", "err", err)
+		return
+	}
+	idx.progress = nil
+}
+
+// Matches returns the numbers of the blocks in [begin, end] which may contain
+// logs matching the filter criteria, along with the last block searched. The
+// search stops at the last indexed block still canonical. It reports false if
+// the index can't serve the query, lacking the start of the range or criteria
+// selective enough.
+func (idx *Indexer) Matches(ctx context.Context, begin, end uint64, addresses []common.Address, topics [][]common.Hash) ([]uint64, uint64, bool, error) {
+	if len(topics) > maxTopics {
+		return nil, 0, false, nil
+	}
+	var clauses [][]fieldValue
+	if len(addresses) > 0 {
+		clause := make([]fieldValue, len(addresses))
+		for i, address := range addresses {
+			clause[i] = fieldValue{addressField, address.Bytes()}
+		}
+		clauses = append(clauses, clause)
+	}
+	for i, sub := range topics {
+		if len(sub) == 0 {
+			continue
+		}
+		clause := make([]fieldValue, len(sub))
+		for j, topic := range sub {
+			clause[j] = fieldValue{byte(1 + i), topic.Bytes()}
+		}
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 0 {
+		return nil, 0, false, nil
+	}
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	last, ok := idx.canonicalHead()
+	if !ok || begin < idx.progress.Tail || begin > last {
+		return nil, 0, false, nil
+	}
+	if end < last {
+		last = end
+	}
+	var matches []uint64
+	for chunk := begin >> ChunkBits; chunk <= last>>ChunkBits; chunk++ {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, false, err
+		}
+		var result *bitmap
+		for _, clause := range clauses {
+			union := new(bitmap)
+			for _, fv := range clause {
+				enc := rawdb.ReadLogIndexBitmap(idx.db, fv.field, fv.value, chunk)
+				if len(enc) == 0 {
+					continue
+				}
+				b, err := decodeBitmap(enc)
+				if err != nil {
+					return nil, 0, false, err
+				}
+				union.or(b)
+			}
+			if result == nil {
+				result = union
+			} else {
+				result = result.and(union)
+			}
+			if result.empty() {
+				break
+			}
+		}
+		for _, offset := range result.values() {
+			if number := chunk<<ChunkBits | uint64(offset); number >= begin && number <= last {
+				matches = append(matches, number)
+			}
+		}
+	}
+	return matches, last, true, nil
+}
+
+// canonicalHead returns the last indexed block still part of the canonical chain,
+// which is below the index head while a reorg hasn't been unwound yet.
+func (idx *Indexer) canonicalHead() (uint64, bool) {
+	progress := idx.progress
+	if progress == nil {
+		return 0, false
+	}
+	number, hash := progress.Head, progress.HeadHash
+	for rawdb.ReadCanonicalHash(idx.db, number) != hash {
+		if number == progress.Tail {
+			return 0, false
+		}
+		header := rawdb.ReadHeader(idx.db, hash, number)
+		if header == nil {
+			return 0, false
+		}
+		number, hash = number-1, header.ParentHash
+	}
+	return number, true
+}
+
+// fieldValue is a value of a log field to look up in the index.
+type fieldValue struct {
+	field byte
+	value []byte
+}
+
+// writer accumulates the bitmap updates of a batch of blocks.
+type writer struct {
+	db      ethdb.KeyValueReader
+	bitmaps map[string]*pendingBitmap
+}
+
+type pendingBitmap struct {
+	fieldValue
+	chunk  uint64
+	bitmap *bitmap
+}
+
+func newWriter(db ethdb.KeyValueReader) *writer {
+	return &writer{db: db, bitmaps: make(map[string]*pendingBitmap)}
+}
+
+// update adds the block to, or removes it from, the bitmaps of the addresses and
+// topics of its logs.
+func (w *writer) update(number uint64, logs [][]*types.Log, add bool) error {
+	var (
+		chunk  = number >> ChunkBits
+		offset = uint16(number)
+	)
+	set := func(field byte, value []byte) error {
+		b, err := w.bitmap(field, value, chunk)
+		if err != nil {
+			return err
+		}
+		if add {
+			b.add(offset)
+		} else {
+			b.remove(offset)
+		}
+		return nil
+	}
+	for _, txLogs := range logs {
+		for _, l := range txLogs {
+			if err := set(addressField, l.Address.Bytes()); err != nil {
+				return err
+			}
+			for i, topic := range l.Topics {
+				if i == maxTopics {
+					break
+				}
+				if err := set(byte(1+i), topic.Bytes()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// bitmap returns the bitmap of the field value within the chunk, loading it
+// from the database on first access.
+func (w *writer) bitmap(field byte, value []byte, chunk uint64) (*bitmap, error) {
+	key := string(binary.BigEndian.AppendUint64(append([]byte{field}, value...), chunk))
+	if pending, ok := w.bitmaps[key]; ok {
+		return pending.bitmap, nil
+	}
+	b := new(bitmap)
+	if enc := rawdb.ReadLogIndexBitmap(w.db, field, value, chunk); len(enc) > 0 {
+		var err error
+		if b, err = decodeBitmap(enc); err != nil {
+			return nil, err
+		}
+	}
+	w.bitmaps[key] = &pendingBitmap{fieldValue{field, common.CopyBytes(value)}, chunk, b}
+	return b, nil
+}
+
+// flush writes the updated bitmaps, deleting the emptied ones.
+func (w *writer) flush(db ethdb.KeyValueWriter) {
+	for _, pending := range w.bitmaps {
+		if pending.bitmap.empty() {
+			rawdb.DeleteLogIndexBitmap(db, pending.field, pending.value, pending.chunk)
+		} else {
+			rawdb.WriteLogIndexBitmap(db, pending.field, pending.value, pending.chunk, pending.bitmap.encode())
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package logindex
+
+import (
+	"context"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/event"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that bitmaps behave as sets across the switches between their sparse
+// and dense representations, and survive an encoding round trip.
+func TestBitmap(t *testing.T) {
+	var (
+		b    = new(bitmap)
+		want = make(map[uint16]bool)
+	)
+	check := func(stage string) {
+		t.Helper()
+		values := b.values()
+		if len(values) != len(want) {
+			t.Fatalf("%s: have %d values, want %d", stage, len(values), len(want))
+		}
+		for i, v := range values {
+			if !want[v] || !b.contains(v) || (i > 0 && values[i-1] >= v) {
+				t.Fatalf("%s: unexpected value %d at %d", stage, v, i)
+			}
+		}
+		dec, err := decodeBitmap(b.encode())
+		if err != nil {
+			t.Fatalf("%s: failed to decode: %v", stage, err)
+		}
+		if !reflect.DeepEqual(dec.values(), values) {
+			t.Fatalf("%s: encoding round trip mismatch", stage)
+		}
+	}
+	for len(want) < 2*arrayMaxSize {
+		v := uint16(rand.Intn(1 << ChunkBits))
+		b.add(v)
+		want[v] = true
+	}
+	if b.bitset == nil {
+		t.Fatal("dense bitmap not converted to a bitset")
+	}
+	check("dense")
+
+	other := new(bitmap)
+	for v := 0; v < 1<<ChunkBits; v += 3 {
+		other.add(uint16(v))
+	}
+	and := b.and(other)
+	for _, v := range and.values() {
+		if !want[v] || v%3 != 0 {
+			t.Fatalf("intersection contains %d", v)
+		}
+	}
+	for v := range want {
+		if v%3 == 0 && !and.contains(v) {
+			t.Fatalf("intersection misses %d", v)
+		}
+	}
+	for v := range want {
+		if len(want) <= arrayMaxSize/2 {
+			break
+		}
+		b.remove(v)
+		delete(want, v)
+	}
+	if b.bitset != nil {
+		t.Fatal("sparse bitmap not converted back to an array")
+	}
+	check("sparse")
+
+	union := &bitmap{array: []uint16{1, 2}}
+	union.or(b)
+	want[1], want[2] = true, true
+	b = union
+	check("union")
+}
+
+// testChain is a chain written directly into the database.
+type testChain struct {
+	db     ethdb.Database
+	head   *types.Header
+	blocks map[uint64]*types.Header
+	feed   event.Feed
+}
+
+func (c *testChain) Config() *params.ChainConfig { return params.TestChainConfig }
+func (c *testChain) CurrentBlock() *types.Header { return c.head }
+func (c *testChain) SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription {
+	return c.feed.Subscribe(ch)
+}
+
+// extend writes the blocks in [from, to] on top of the canonical block before
+// them, with the logs of the given generator, and makes the last one the head.
+func (c *testChain) extend(from, to uint64, salt byte, logs func(uint64) []*types.Log) {
+	for number := from; number <= to; number++ {
+		header := &types.Header{Number: new(big.Int).SetUint64(number), Extra: []byte{salt}}
+		if parent := c.blocks[number-1]; parent != nil {
+			header.ParentHash = parent.Hash()
+		}
+		receipt := &types.Receipt{Logs: logs(number)}
+		rawdb.WriteHeader(c.db, header)
+		rawdb.WriteReceipts(c.db, header.Hash(), number, types.Receipts{receipt})
+		rawdb.WriteCanonicalHash(c.db, header.Hash(), number)
+		c.blocks[number] = header
+	}
+	for number := to + 1; c.blocks[number] != nil; number++ {
+		rawdb.DeleteCanonicalHash(c.db, number)
+		delete(c.blocks, number)
+	}
+	c.head = c.blocks[to]
+}
+
+// Tests that the log index follows the chain across chunk boundaries and reorgs,
+// never missing the blocks with matching logs.
+func TestIndexerReorg(t *testing.T) {
+	var (
+		addrA = common.Address{0xa}
+		addrB = common.Address{0xb}
+		topic = common.Hash{0x1}
+		tail  = uint64(1<<ChunkBits - 150)
+		chain = &testChain{db: rawdb.NewMemoryDatabase(), blocks: make(map[uint64]*types.Header)}
+	)
+	original := func(number uint64) []*types.Log {
+		var logs []*types.Log
+		if number%3 == 0 {
+			l := &types.Log{Address: addrA}
+			if number%5 == 0 {
+				l.Topics = []common.Hash{topic}
+			}
+			logs = append(logs, l)
+		}
+		if number%7 == 0 {
+			logs = append(logs, &types.Log{Address: addrB, Topics: []common.Hash{{}, topic}})
+		}
+		return logs
+	}
+	chain.extend(tail, tail+300, 0, original)
+
+	idx := NewIndexer(chain.db, chain, Config{Tail: tail, BatchSize: 64})
+	sync := func() {
+		t.Helper()
+		for i := 0; ; i++ {
+			done, err := idx.step()
+			if err != nil {
+				t.Fatalf("failed to update index: %v", err)
+			}
+			if done {
+				return
+			}
+			if i > 100 {
+				t.Fatal("index not converging")
+			}
+		}
+	}
+	query := func(begin, end uint64, addresses []common.Address, topics [][]common.Hash) ([]uint64, uint64) {
+		t.Helper()
+		matches, last, ok, err := idx.Matches(context.Background(), begin, end, addresses, topics)
+		if err != nil || !ok {
+			t.Fatalf("query [%d, %d] not served: %v", begin, end, err)
+		}
+		return matches, last
+	}
+	expect := func(begin, end uint64, pred func(uint64) bool) []uint64 {
+		var want []uint64
+		for number := begin; number <= end; number++ {
+			if pred(number) {
+				want = append(want, number)
+			}
+		}
+		return want
+	}
+	sync()
+
+	matches, last := query(tail, tail+300, []common.Address{addrA}, [][]common.Hash{{topic}})
+	if want := expect(tail, tail+300, func(n uint64) bool { return n%15 == 0 }); last != tail+300 || !reflect.DeepEqual(matches, want) {
+		t.Fatalf("address and topic query: have %v (last %d), want %v", matches, last, want)
+	}
+	// Topics are positional
+	matches, _ = query(tail, tail+300, nil, [][]common.Hash{nil, {topic}})
+	if want := expect(tail, tail+300, func(n uint64) bool { return n%7 == 0 }); !reflect.DeepEqual(matches, want) {
+		t.Fatalf("second topic query: have %v, want %v", matches, want)
+	}
+	// Queries without criteria or starting before the tail aren't served
+	if _, _, ok, _ := idx.Matches(context.Background(), tail, tail+300, nil, nil); ok {
+		t.Error("query without criteria served")
+	}
+	if _, _, ok, _ := idx.Matches(context.Background(), tail-1, tail+300, []common.Address{addrA}, nil); ok {
+		t.Error("query before the tail served")
+	}
+	// Reorg the chain, until unwound the index only serves the common blocks
+	fork := tail + 250
+	reorged := func(number uint64) []*types.Log {
+		if number < fork {
+			return original(number)
+		}
+		return []*types.Log{{Address: addrB}}
+	}
+	chain.extend(fork, tail+280, 1, reorged)
+	if _, last := query(tail, tail+300, []common.Address{addrB}, nil); last != fork-1 {
+		t.Errorf("query before unwinding: last %d, want %d", last, fork-1)
+	}
+	sync()
+
+	matches, last = query(tail, tail+300, []common.Address{addrB}, nil)
+	if want := expect(tail, tail+280, func(n uint64) bool { return n%7 == 0 || n >= fork }); last != tail+280 || !reflect.DeepEqual(matches, want) {
+		t.Fatalf("query after reorg: have %v (last %d), want %v", matches, last, want)
+	}
+	matches, _ = query(tail, tail+300, []common.Address{addrA}, nil)
+	if want := expect(tail, tail+280, func(n uint64) bool { return n%3 == 0 && n < fork }); !reflect.DeepEqual(matches, want) {
+		t.Fatalf("unwound address query: have %v, want %v", matches, want)
+	}
+	// The index resumes from the database
+	idx = NewIndexer(chain.db, chain, Config{Tail: tail, BatchSize: 64})
+	chain.extend(tail+281, tail+290, 1, reorged)
+	sync()
+	matches, _ = query(fork, tail+300, []common.Address{addrB}, nil)
+	if want := expect(fork, tail+290, func(uint64) bool { return true }); !reflect.DeepEqual(matches, want) {
+		t.Fatalf("query after restart: have %v, want %v", matches, want)
+	}
+}
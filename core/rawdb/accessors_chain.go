@@ -277,6 +277,58 @@ func WriteTxIndexTail(db ethdb.KeyValueWriter, number uint64) {
 	}
 }
 
+// ReadSideChainPruneTail retrieves the number of the block below which all the
+// non-canonical blocks have been pruned, or nil if they never were.
+func ReadSideChainPruneTail(db ethdb.KeyValueReader) *uint64 {
+	data, _ := db.Get(sideChainPruneTailKey)
+	if len(data) != 8 {
+		return nil
+	}
+	number := binary.BigEndian.Uint64(data)
+	return &number
+}
+
+// WriteSideChainPruneTail stores the number of the block below which all the
+// non-canonical blocks have been pruned.
+func WriteSideChainPruneTail(db ethdb.KeyValueWriter, number uint64) {
+	if err := db.Put(sideChainPruneTailKey, encodeBlockNumber(number)); err != nil {
+		log.Crit("Failed to store the side chain prune tail", "err", err)
+	}
+}
+
+// TxIndexRange is a range of blocks [From, To) whose transactions have been
+// indexed below the tx index tail.
+type TxIndexRange struct {
+	From uint64
+	To   uint64
+}
+
+// ReadTxIndexRanges retrieves the block ranges indexed below the tx index tail,
+// ordered by block number.
+func ReadTxIndexRanges(db ethdb.KeyValueReader) []TxIndexRange {
+	data, _ := db.Get(txIndexRangesKey)
+	if len(data) == 0 {
+		return nil
+	}
+	var ranges []TxIndexRange
+	if err := rlp.DecodeBytes(data, &ranges); err != nil {
+		log.Error("Invalid transaction index ranges", "err", err)
+		return nil
+	}
+	return ranges
+}
+
+// WriteTxIndexRanges stores the block ranges indexed below the tx index tail.
+func WriteTxIndexRanges(db ethdb.KeyValueWriter, ranges []TxIndexRange) {
+	data, err := rlp.EncodeToBytes(ranges)
+	if err != nil {
+		log.Crit("Failed to encode transaction index ranges", "err", err)
+	}
+	if err := db.Put(txIndexRangesKey, data); err != nil {
+		log.Crit("Failed to store the transaction index ranges", "err", err)
+	}
+}
+
 // ReadFastTxLookupLimit retrieves the tx lookup limit used in fast sync.
 func ReadFastTxLookupLimit(db ethdb.KeyValueReader) *uint64 {
 	data, _ := db.Get(fastTxLookupLimitKey)
@@ -582,6 +634,17 @@ func HasReceipts(db ethdb.Reader, hash common.Hash, number uint64) bool {
 
 // ReadReceiptsRLP retrieves all the transaction receipts belonging to a block in RLP encoding.
 func ReadReceiptsRLP(db ethdb.Reader, hash common.Hash, number uint64) rlp.RawValue {
+	data, err := decodeStoredReceipts(db, readStoredReceipts(db, hash, number))
+	if err != nil {
+		log.Error("Invalid stored receipts", "hash", hash, "number", number, "err", err)
+		return nil
+	}
+	return data
+}
+
+// readStoredReceipts retrieves the receipts belonging to a block in the format
+// they were stored in.
+func readStoredReceipts(db ethdb.Reader, hash common.Hash, number uint64) []byte {
 	var data []byte
 	db.ReadAncients(func(reader ethdb.AncientReaderOp) error {
 		// Check if the data is in ancients
@@ -662,7 +725,7 @@ func WriteReceipts(db ethdb.KeyValueWriter, hash common.Hash, number uint64, rec
 		log.Crit("Failed to encode block receipts", "err", err)
 	}
 	// Store the flattened receipt slice
-	if err := db.Put(blockReceiptsKey(number, hash), bytes); err != nil {
+	if err := db.Put(blockReceiptsKey(number, hash), encodeStoredReceipts(bytes)); err != nil {
 		log.Crit("Failed to store block receipts", "err", err)
 	}
 }
@@ -0,0 +1,98 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// CodeIndexEntry is an account seen referencing a code hash. The index only
+// grows, so the account may have changed code or been deleted since.
+type CodeIndexEntry struct {
+	AccountHash common.Hash     `rlp:"-"`
+	Address     *common.Address `rlp:"nil"` // Address of the account, nil if its preimage is unknown
+	BlockNumber uint64          // Number of the block the account was seen in
+}
+
+// CodeIndexProgress is the progress of the backfill of the code hash index
+// with the accounts existing from before it was enabled.
+type CodeIndexProgress struct {
+	Next []byte // Hashed key of the next account to backfill
+	Done bool
+}
+
+// WriteCodeIndexEntry records that the account references the code hash.
+func WriteCodeIndexEntry(db ethdb.KeyValueWriter, codeHash common.Hash, entry *CodeIndexEntry) {
+	data, err := rlp.EncodeToBytes(entry)
+	if err != nil {
+		log.Crit("Failed to encode code index entry", "err", err)
+	}
+	if err := db.Put(codeIndexKey(codeHash, entry.AccountHash), data); err != nil {
+		log.Crit("Failed to store code index entry", "err", err)
+	}
+}
+
+// ReadCodeIndexEntries retrieves up to max of the accounts seen referencing the
+// code hash, ordered by account hash from start onwards, zero meaning no bound.
+func ReadCodeIndexEntries(db ethdb.Iteratee, codeHash common.Hash, start common.Hash, max int) []*CodeIndexEntry {
+	it := db.NewIterator(append(append([]byte{}, CodeIndexPrefix...), codeHash.Bytes()...), start.Bytes())
+	defer it.Release()
+
+	var entries []*CodeIndexEntry
+	for it.Next() && (max == 0 || len(entries) < max) {
+		if len(it.Key()) != len(CodeIndexPrefix)+2*common.HashLength {
+			continue
+		}
+		entry := new(CodeIndexEntry)
+		if err := rlp.DecodeBytes(it.Value(), entry); err != nil {
+			log.Error("Invalid code index entry", "key", it.Key(), "err", err)
+			continue
+		}
+		entry.AccountHash = common.BytesToHash(it.Key()[len(CodeIndexPrefix)+common.HashLength:])
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// ReadCodeIndexProgress retrieves the progress of the code index backfill, or
+// nil if it wasn't started.
+func ReadCodeIndexProgress(db ethdb.KeyValueReader) *CodeIndexProgress {
+	data, _ := db.Get(codeIndexProgressKey)
+	if len(data) == 0 {
+		return nil
+	}
+	progress := new(CodeIndexProgress)
+	if err := rlp.DecodeBytes(data, progress); err != nil {
+		log.Error("Invalid code index progress", "err", err)
+		return nil
+	}
+	return progress
+}
+
+// WriteCodeIndexProgress stores the progress of the code index backfill.
+func WriteCodeIndexProgress(db ethdb.KeyValueWriter, progress *CodeIndexProgress) {
+	data, err := rlp.EncodeToBytes(progress)
+	if err != nil {
+		log.Crit("Failed to encode code index progress", "err", err)
+	}
+	if err := db.Put(codeIndexProgressKey, data); err != nil {
+		log.Crit("Failed to store code index progress", "err", err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// L1ConfirmedHead is a block of the chain along with the number of the L1 block
+// whose batch confirmation made it safe or finalized.
+type L1ConfirmedHead struct {
+	Hash          common.Hash
+	L1BlockNumber uint64
+}
+
+func readL1ConfirmedHead(db ethdb.KeyValueReader, key []byte) *L1ConfirmedHead {
+	data, _ := db.Get(key)
+	if len(data) == 0 {
+		return nil
+	}
+	head := new(L1ConfirmedHead)
+	if err := rlp.DecodeBytes(data, head); err != nil {
+		log.Error("Invalid L1 confirmed head in database", "key", string(key), "err", err)
+		return nil
+	}
+	return head
+}
+
+func writeL1ConfirmedHead(db ethdb.KeyValueWriter, key []byte, head *L1ConfirmedHead) {
+	data, err := rlp.EncodeToBytes(head)
+	if err != nil {
+		log.Crit("Failed to encode L1 confirmed head", "err", err)
+	}
+	if err := db.Put(key, data); err != nil {
+		log.Crit("Failed to store L1 confirmed head", "key", string(key), "err", err)
+	}
+}
+
+// ReadL1FinalizedHead retrieves the finalized block confirmed by L1, if any.
+func ReadL1FinalizedHead(db ethdb.KeyValueReader) *L1ConfirmedHead {
+	return readL1ConfirmedHead(db, l1FinalizedHeadKey)
+}
+
+// WriteL1FinalizedHead stores the finalized block confirmed by L1.
+func WriteL1FinalizedHead(db ethdb.KeyValueWriter, head *L1ConfirmedHead) {
+	writeL1ConfirmedHead(db, l1FinalizedHeadKey, head)
+}
+
+// ReadL1SafeHead retrieves the safe block confirmed by L1, if any.
+func ReadL1SafeHead(db ethdb.KeyValueReader) *L1ConfirmedHead {
+	return readL1ConfirmedHead(db, l1SafeHeadKey)
+}
+
+// WriteL1SafeHead stores the safe block confirmed by L1.
+func WriteL1SafeHead(db ethdb.KeyValueWriter, head *L1ConfirmedHead) {
+	writeL1ConfirmedHead(db, l1SafeHeadKey, head)
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// LogIndexProgress is the range of blocks [Tail, Head] covered by the log index,
+// along with the hash of the head block to detect reorgs.
+type LogIndexProgress struct {
+	Tail     uint64
+	Head     uint64
+	HeadHash common.Hash
+}
+
+// ReadLogIndexProgress retrieves the range of blocks covered by the log index,
+// or nil if nothing has been indexed.
+func ReadLogIndexProgress(db ethdb.KeyValueReader) *LogIndexProgress {
+	data, _ := db.Get(logIndexProgressKey)
+	if len(data) == 0 {
+		return nil
+	}
+	progress := new(LogIndexProgress)
+	if err := rlp.DecodeBytes(data, progress); err != nil {
+		log.Error("Invalid log index progress", "err", err)
+		return nil
+	}
+	return progress
+}
+
+// WriteLogIndexProgress stores the range of blocks covered by the log index.
+func WriteLogIndexProgress(db ethdb.KeyValueWriter, progress *LogIndexProgress) {
+	data, err := rlp.EncodeToBytes(progress)
+	if err != nil {
+		log.Crit("Failed to encode log index progress", "err", err)
+	}
+	if err := db.Put(logIndexProgressKey, data); err != nil {
+		log.Crit("Failed to store log index progress", "err", err)
+	}
+}
+
+// DeleteLogIndexProgress removes the log index progress marker.
+func DeleteLogIndexProgress(db ethdb.KeyValueWriter) {
+	if err := db.Delete(logIndexProgressKey); err != nil {
+		log.Crit("Failed to delete log index progress", "err", err)
+	}
+}
+
+// ReadLogIndexBitmap retrieves the bitmap of the blocks in the given chunk
+// having logs whose field (the address, or a topic position) has the given value.
+func ReadLogIndexBitmap(db ethdb.KeyValueReader, field byte, value []byte, chunk uint64) []byte {
+	data, _ := db.Get(logIndexKey(field, value, chunk))
+	return data
+}
+
+// WriteLogIndexBitmap stores the bitmap of the blocks in the given chunk having
+// logs whose field has the given value.
+func WriteLogIndexBitmap(db ethdb.KeyValueWriter, field byte, value []byte, chunk uint64, bitmap []byte) {
+	if err := db.Put(logIndexKey(field, value, chunk), bitmap); err != nil {
+		log.Crit("Failed to store log index bitmap", "err", err)
+	}
+}
+
+// DeleteLogIndexBitmap removes the bitmap of the blocks in the given chunk
+// having logs whose field has the given value.
+func DeleteLogIndexBitmap(db ethdb.KeyValueWriter, field byte, value []byte, chunk uint64) {
+	if err := db.Delete(logIndexKey(field, value, chunk)); err != nil {
+		log.Crit("Failed to delete log index bitmap", "err", err)
+	}
+}
@@ -67,6 +67,40 @@ func ReadChainConfig(db ethdb.KeyValueReader, hash common.Hash) *params.ChainCon
 	return &config
 }
 
+// ChainParamsUpdate is an update of the Arbitrum chain parameters, in effect
+// from its activation block on.
+type ChainParamsUpdate struct {
+	Activation uint64
+	Params     params.ArbitrumChainParams
+}
+
+// ReadChainParamsUpdates retrieves the updates of the Arbitrum chain parameters
+// scheduled on top of the chain config, ordered by activation block.
+func ReadChainParamsUpdates(db ethdb.KeyValueReader, hash common.Hash) []ChainParamsUpdate {
+	data, _ := db.Get(chainParamsUpdatesKey(hash))
+	if len(data) == 0 {
+		return nil
+	}
+	var updates []ChainParamsUpdate
+	if err := json.Unmarshal(data, &updates); err != nil {
+		log.Error("Invalid chain params updates JSON", "hash", hash, "err", err)
+		return nil
+	}
+	return updates
+}
+
+// WriteChainParamsUpdates stores the scheduled updates of the Arbitrum chain
+// parameters.
+func WriteChainParamsUpdates(db ethdb.KeyValueWriter, hash common.Hash, updates []ChainParamsUpdate) {
+	data, err := json.Marshal(updates)
+	if err != nil {
+		log.Crit("Failed to JSON encode chain params updates", "err", err)
+	}
+	if err := db.Put(chainParamsUpdatesKey(hash), data); err != nil {
+		log.Crit("Failed to store chain params updates", "err", err)
+	}
+}
+
 // WriteChainConfig writes the chain config settings to the database.
 func WriteChainConfig(db ethdb.KeyValueWriter, hash common.Hash, cfg *params.ChainConfig) {
 	if cfg == nil {
@@ -0,0 +1,133 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// rangeReadBytes is the size of the items a single freezer read of a range
+// retrieves at most.
+const rangeReadBytes = 4 * 1024 * 1024
+
+// readCanonicalRange retrieves the items of the canonical blocks [start,
+// start+count) in the given chain freezer table, the frozen ones being read
+// with sequential freezer scans instead of an access per block. The items of
+// the blocks not frozen yet are looked up by the key of the block. The range
+// stops before the first missing item.
+func readCanonicalRange(db ethdb.Reader, table string, start, count uint64, key func(uint64, common.Hash) []byte) []rlp.RawValue {
+	var (
+		items     []rlp.RawValue
+		end       = start + count
+		frozen, _ = db.Ancients()
+	)
+	for next := start; next < end && next < frozen; {
+		limit := end
+		if limit > frozen {
+			limit = frozen
+		}
+		data, err := db.AncientRange(table, next, limit-next, rangeReadBytes)
+		if err != nil || len(data) == 0 {
+			return items
+		}
+		for _, item := range data {
+			items = append(items, item)
+		}
+		next += uint64(len(data))
+	}
+	for next := start + uint64(len(items)); next < end; next++ {
+		hash := ReadCanonicalHash(db, next)
+		if hash == (common.Hash{}) {
+			break
+		}
+		data, _ := db.Get(key(next, hash))
+		if len(data) == 0 {
+			// The block may have been frozen in the meantime
+			if data, _ = db.Ancient(table, next); len(data) == 0 {
+				break
+			}
+		}
+		items = append(items, data)
+	}
+	return items
+}
+
+// ReadHeadersRange retrieves the canonical headers of the blocks [start,
+// start+count), in ascending order, stopping before the first missing one.
+// This method assumes that the caller already has placed a cap on count.
+func ReadHeadersRange(db ethdb.Reader, start, count uint64) []*types.Header {
+	data := readCanonicalRange(db, ChainFreezerHeaderTable, start, count, headerKey)
+	headers := make([]*types.Header, 0, len(data))
+	for i, blob := range data {
+		header := new(types.Header)
+		if err := rlp.DecodeBytes(blob, header); err != nil {
+			log.Error("Invalid block header RLP", "number", start+uint64(i), "err", err)
+			break
+		}
+		headers = append(headers, header)
+	}
+	return headers
+}
+
+// ReadBodiesRange retrieves the canonical block bodies of the blocks [start,
+// start+count), in ascending order, stopping before the first missing one.
+// This method assumes that the caller already has placed a cap on count.
+func ReadBodiesRange(db ethdb.Reader, start, count uint64) []*types.Body {
+	data := readCanonicalRange(db, ChainFreezerBodiesTable, start, count, blockBodyKey)
+	bodies := make([]*types.Body, 0, len(data))
+	for i, blob := range data {
+		body := new(types.Body)
+		if err := rlp.DecodeBytes(blob, body); err != nil {
+			log.Error("Invalid block body RLP", "number", start+uint64(i), "err", err)
+			break
+		}
+		bodies = append(bodies, body)
+	}
+	return bodies
+}
+
+// ReadRawReceiptsRange retrieves the receipts of the canonical blocks [start,
+// start+count), in ascending order, stopping before the first block whose
+// receipts are missing. Like with ReadRawReceipts, the receipt metadata fields
+// are not populated. This method assumes that the caller already has placed a
+// cap on count.
+func ReadRawReceiptsRange(db ethdb.Reader, start, count uint64) []types.Receipts {
+	data := readCanonicalRange(db, ChainFreezerReceiptTable, start, count, blockReceiptsKey)
+	receipts := make([]types.Receipts, 0, len(data))
+	for i, stored := range data {
+		blob, err := decodeStoredReceipts(db, stored)
+		if err != nil {
+			log.Error("Invalid stored receipts", "number", start+uint64(i), "err", err)
+			break
+		}
+		var storageReceipts []*types.ReceiptForStorage
+		if err := rlp.DecodeBytes(blob, &storageReceipts); err != nil {
+			log.Error("Invalid receipt array RLP", "number", start+uint64(i), "err", err)
+			break
+		}
+		block := make(types.Receipts, len(storageReceipts))
+		for j, storageReceipt := range storageReceipts {
+			block[j] = (*types.Receipt)(storageReceipt)
+		}
+		receipts = append(receipts, block)
+	}
+	return receipts
+}
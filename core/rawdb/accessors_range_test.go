@@ -0,0 +1,89 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+)
+
+// Tests that ranges of headers, bodies and receipts are read across the
+// freezer and the key-value store.
+func TestReadRanges(t *testing.T) {
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), t.TempDir(), "", false)
+	if err != nil {
+		t.Fatalf("failed to create database with ancient backend")
+	}
+	defer db.Close()
+
+	var (
+		chain    []*types.Block
+		receipts []types.Receipts
+		parent   common.Hash
+	)
+	for i := 0; i < 20; i++ {
+		tx := types.NewTransaction(uint64(i), common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil)
+		block := types.NewBlockWithHeader(&types.Header{
+			Number:     big.NewInt(int64(i)),
+			Extra:      []byte("test block"),
+			ParentHash: parent,
+		}).WithBody([]*types.Transaction{tx}, nil)
+		chain = append(chain, block)
+		receipts = append(receipts, types.Receipts{{
+			Status:            types.ReceiptStatusSuccessful,
+			CumulativeGasUsed: uint64(i),
+			Logs:              []*types.Log{{Address: common.Address{byte(i)}}},
+		}})
+		parent = block.Hash()
+	}
+	// Freeze the first half, keep the second one in the key-value store
+	WriteAncientBlocks(db, chain[:10], receipts[:10], big.NewInt(100))
+	for i := 10; i < 20; i++ {
+		WriteCanonicalHash(db, chain[i].Hash(), chain[i].NumberU64())
+		WriteBlock(db, chain[i])
+		WriteReceipts(db, chain[i].Hash(), chain[i].NumberU64(), receipts[i])
+	}
+	check := func(from, count, want int) {
+		headers := ReadHeadersRange(db, uint64(from), uint64(count))
+		bodies := ReadBodiesRange(db, uint64(from), uint64(count))
+		blockReceipts := ReadRawReceiptsRange(db, uint64(from), uint64(count))
+		if len(headers) != want || len(bodies) != want || len(blockReceipts) != want {
+			t.Fatalf("range %d+%d: have %d headers, %d bodies, %d receipts, want %d", from, count, len(headers), len(bodies), len(blockReceipts), want)
+		}
+		for i := 0; i < want; i++ {
+			block := chain[from+i]
+			if headers[i].Hash() != block.Hash() {
+				t.Fatalf("range %d+%d: header %d mismatch", from, count, from+i)
+			}
+			if len(bodies[i].Transactions) != 1 || bodies[i].Transactions[0].Hash() != block.Transactions()[0].Hash() {
+				t.Fatalf("range %d+%d: body %d mismatch", from, count, from+i)
+			}
+			if len(blockReceipts[i]) != 1 || blockReceipts[i][0].CumulativeGasUsed != uint64(from+i) || blockReceipts[i][0].Logs[0].Address != (common.Address{byte(from + i)}) {
+				t.Fatalf("range %d+%d: receipts %d mismatch", from, count, from+i)
+			}
+		}
+	}
+	check(0, 5, 5)   // Ancients only
+	check(5, 10, 10) // Across the freezer and the key-value store
+	check(12, 5, 5)  // Key-value store only
+	check(15, 10, 5) // Past the head
+	check(0, 20, 20) // Everything
+	check(25, 10, 0) // Unknown blocks
+}
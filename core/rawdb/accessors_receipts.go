@@ -0,0 +1,536 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// Formats the receipts of a block are stored in.
+const (
+	ReceiptFormatV1 = 1 // RLP list of the storage encoding of the receipts
+	ReceiptFormatV2 = 2 // Receipts and logs split in columns, compressed with zstd
+)
+
+// receiptsV2Marker prefixes the receipts stored in the v2 format. It can't start
+// an RLP list, so the formats are told apart without any lookup.
+const receiptsV2Marker = 0x02
+
+// maxReceiptColumnsSize bounds the size of the v2 receipt columns of a block,
+// guarding against corrupted sizes.
+const maxReceiptColumnsSize = 1 << 30
+
+// zstdDictMagic starts the zstd dictionaries that aren't raw content.
+var zstdDictMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+
+// ReceiptFormat is the format the node writes new receipts in.
+type ReceiptFormat struct {
+	Version    uint64
+	Dictionary uint32 // Identifier of the zstd dictionary, 0 if none
+}
+
+// ReceiptMigration is the progress of the conversion of the receipts stored in
+// the key-value store to another format. The ancient store isn't converted, it
+// holds the receipts in the format they were stored in when frozen.
+type ReceiptMigration struct {
+	Version   uint64 // Format the receipts are converted to
+	Next      []byte // Number and hash of the next receipts to convert
+	Done      bool
+	Converted uint64 // Number of receipt lists converted
+	Before    uint64 // Size of the converted receipts before the conversion
+	After     uint64 // Size of the converted receipts after the conversion
+}
+
+// receiptColumns is the v2 layout of the receipts of a block before compression.
+// Logs are stored field by field, with addresses and topics deduplicated.
+type receiptColumns struct {
+	Receipts    []rlp.RawValue   // Storage encoding of the receipts with their logs left out
+	LogCounts   []uint64         // Number of logs of each receipt
+	Addresses   []common.Address // Distinct log addresses, in order of appearance
+	Topics      []common.Hash    // Distinct log topics, in order of appearance
+	LogAddress  []uint64         // Index of the address of each log
+	TopicCounts []uint64         // Number of topics of each log
+	LogTopics   []uint64         // Indexes of the topics of the logs, concatenated
+	Data        [][]byte         // Data of each log
+}
+
+var (
+	// receiptEncoder is the compressor new receipts are written with, nil if
+	// they are written in the v1 format.
+	receiptEncoder atomic.Pointer[receiptCompressor]
+
+	// receiptCompressors caches the compressors by the content hash of their
+	// dictionary, as distinct databases may hold distinct dictionaries under
+	// the same short identifier.
+	receiptCompressors sync.Map
+)
+
+// SetReceiptFormat sets the format new receipts are written in by the process,
+// which must be the format of the database the chain is written to. Receipts
+// are read in whichever format they were stored, with the dictionaries of the
+// database they're read from.
+func SetReceiptFormat(db ethdb.KeyValueReader, format *ReceiptFormat) error {
+	if format == nil || format.Version == ReceiptFormatV1 {
+		receiptEncoder.Store(nil)
+		return nil
+	}
+	if format.Version != ReceiptFormatV2 {
+		return fmt.Errorf("unknown receipt format %d", format.Version)
+	}
+	c, err := loadReceiptCompressor(db, format.Dictionary)
+	if err != nil {
+		return err
+	}
+	receiptEncoder.Store(c)
+	return nil
+}
+
+// loadReceiptCompressor returns the compressor of the dictionary the database
+// holds under the identifier, loading the dictionary if no compressor of the
+// same content is cached yet.
+func loadReceiptCompressor(db ethdb.KeyValueReader, id uint32) (*receiptCompressor, error) {
+	var (
+		dict []byte
+		hash common.Hash
+	)
+	if id != 0 {
+		// Dictionaries stored without their hash are hashed on every load
+		if data, _ := db.Get(receiptDictionaryHashKey(id)); len(data) == common.HashLength {
+			hash = common.BytesToHash(data)
+		} else if dict = ReadReceiptDictionary(db, id); dict == nil {
+			return nil, fmt.Errorf("receipt dictionary %#x not found", id)
+		} else {
+			hash = crypto.Keccak256Hash(dict)
+		}
+	}
+	if c, ok := receiptCompressors.Load(hash); ok {
+		return c.(*receiptCompressor), nil
+	}
+	if id != 0 && dict == nil {
+		if dict = ReadReceiptDictionary(db, id); dict == nil {
+			return nil, fmt.Errorf("receipt dictionary %#x not found", id)
+		}
+		if crypto.Keccak256Hash(dict) != hash {
+			return nil, fmt.Errorf("receipt dictionary %#x doesn't match its hash", id)
+		}
+	}
+	c, err := newReceiptCompressor(id, dict)
+	if err != nil {
+		return nil, err
+	}
+	cached, _ := receiptCompressors.LoadOrStore(hash, c)
+	return cached.(*receiptCompressor), nil
+}
+
+// encodeStoredReceipts converts the RLP of the receipts of a block into the
+// format new receipts are written in. Lists gaining nothing from the v2 format,
+// such as the tiny ones, are kept in the v1 format.
+func encodeStoredReceipts(blob []byte) []byte {
+	c := receiptEncoder.Load()
+	if c == nil || len(blob) <= 1 {
+		return blob
+	}
+	enc, err := encodeReceiptsV2(blob, c)
+	if err != nil {
+		log.Error("Failed to encode receipts in v2 format", "err", err)
+		return blob
+	}
+	if len(enc) >= len(blob) {
+		return blob
+	}
+	return enc
+}
+
+// decodeStoredReceipts converts the stored receipts of a block back into RLP.
+func decodeStoredReceipts(db ethdb.KeyValueReader, data []byte) (rlp.RawValue, error) {
+	if len(data) == 0 || data[0] != receiptsV2Marker {
+		return data, nil
+	}
+	return decodeReceiptsV2(db, data)
+}
+
+// splitReceipt returns the fields of the storage encoding of a receipt, along
+// with the position of the logs, which are its only list field.
+func splitReceipt(receipt []byte) ([]rlp.RawValue, int, error) {
+	content, _, err := rlp.SplitList(receipt)
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		fields []rlp.RawValue
+		logs   = -1
+	)
+	for len(content) > 0 {
+		kind, _, rest, err := rlp.Split(content)
+		if err != nil {
+			return nil, 0, err
+		}
+		if kind == rlp.List {
+			if logs >= 0 {
+				return nil, 0, errors.New("receipt with several list fields")
+			}
+			logs = len(fields)
+		}
+		fields = append(fields, content[:len(content)-len(rest)])
+		content = rest
+	}
+	if logs < 0 {
+		return nil, 0, errors.New("receipt without logs")
+	}
+	return fields, logs, nil
+}
+
+// encodeReceiptsV2 converts the RLP of the receipts of a block into the v2
+// format: the marker, the dictionary identifier, the size of the columns and
+// the compressed columns.
+func encodeReceiptsV2(blob []byte, c *receiptCompressor) ([]byte, error) {
+	var receipts []rlp.RawValue
+	if err := rlp.DecodeBytes(blob, &receipts); err != nil {
+		return nil, err
+	}
+	var (
+		cols      = &receiptColumns{Receipts: make([]rlp.RawValue, len(receipts))}
+		addresses = make(map[common.Address]uint64)
+		topics    = make(map[common.Hash]uint64)
+	)
+	for i, receipt := range receipts {
+		fields, index, err := splitReceipt(receipt)
+		if err != nil {
+			return nil, err
+		}
+		var logs []*types.Log
+		if err := rlp.DecodeBytes(fields[index], &logs); err != nil {
+			return nil, err
+		}
+		fields[index] = rlp.EmptyList
+		if cols.Receipts[i], err = rlp.EncodeToBytes(fields); err != nil {
+			return nil, err
+		}
+		cols.LogCounts = append(cols.LogCounts, uint64(len(logs)))
+		for _, l := range logs {
+			id, ok := addresses[l.Address]
+			if !ok {
+				id = uint64(len(cols.Addresses))
+				addresses[l.Address] = id
+				cols.Addresses = append(cols.Addresses, l.Address)
+			}
+			cols.LogAddress = append(cols.LogAddress, id)
+			cols.TopicCounts = append(cols.TopicCounts, uint64(len(l.Topics)))
+			for _, topic := range l.Topics {
+				id, ok := topics[topic]
+				if !ok {
+					id = uint64(len(cols.Topics))
+					topics[topic] = id
+					cols.Topics = append(cols.Topics, topic)
+				}
+				cols.LogTopics = append(cols.LogTopics, id)
+			}
+			cols.Data = append(cols.Data, l.Data)
+		}
+	}
+	enc, err := rlp.EncodeToBytes(cols)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := c.compress(enc)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, 5+binary.MaxVarintLen64+len(compressed))
+	data = append(data, receiptsV2Marker)
+	data = binary.BigEndian.AppendUint32(data, c.id)
+	data = binary.AppendUvarint(data, uint64(len(enc)))
+	return append(data, compressed...), nil
+}
+
+// decodeReceiptsV2 converts receipts stored in the v2 format back into the RLP
+// they were encoded from.
+func decodeReceiptsV2(db ethdb.KeyValueReader, data []byte) (rlp.RawValue, error) {
+	if len(data) < 6 {
+		return nil, errors.New("truncated v2 receipts")
+	}
+	size, n := binary.Uvarint(data[5:])
+	if n <= 0 || size > maxReceiptColumnsSize {
+		return nil, errors.New("invalid v2 receipts size")
+	}
+	c, err := loadReceiptCompressor(db, binary.BigEndian.Uint32(data[1:5]))
+	if err != nil {
+		return nil, err
+	}
+	enc, err := c.decompress(data[5+n:], int(size))
+	if err != nil {
+		return nil, err
+	}
+	var cols receiptColumns
+	if err := rlp.DecodeBytes(enc, &cols); err != nil {
+		return nil, err
+	}
+	if len(cols.LogCounts) != len(cols.Receipts) || len(cols.LogAddress) != len(cols.Data) || len(cols.TopicCounts) != len(cols.Data) {
+		return nil, errors.New("inconsistent v2 receipt columns")
+	}
+	var (
+		receipts = make([]rlp.RawValue, len(cols.Receipts))
+		logIdx   uint64
+		topicIdx uint64
+	)
+	for i, stripped := range cols.Receipts {
+		fields, index, err := splitReceipt(stripped)
+		if err != nil {
+			return nil, err
+		}
+		if cols.LogCounts[i] > uint64(len(cols.Data))-logIdx {
+			return nil, errors.New("v2 receipt logs out of range")
+		}
+		logs := make([]*types.Log, cols.LogCounts[i])
+		for j := range logs {
+			if cols.LogAddress[logIdx] >= uint64(len(cols.Addresses)) || cols.TopicCounts[logIdx] > uint64(len(cols.LogTopics))-topicIdx {
+				return nil, errors.New("v2 receipt log fields out of range")
+			}
+			l := &types.Log{
+				Address: cols.Addresses[cols.LogAddress[logIdx]],
+				Topics:  make([]common.Hash, cols.TopicCounts[logIdx]),
+				Data:    cols.Data[logIdx],
+			}
+			for k := range l.Topics {
+				if cols.LogTopics[topicIdx] >= uint64(len(cols.Topics)) {
+					return nil, errors.New("v2 receipt topic out of range")
+				}
+				l.Topics[k] = cols.Topics[cols.LogTopics[topicIdx]]
+				topicIdx++
+			}
+			logs[j] = l
+			logIdx++
+		}
+		if fields[index], err = rlp.EncodeToBytes(logs); err != nil {
+			return nil, err
+		}
+		if receipts[i], err = rlp.EncodeToBytes(fields); err != nil {
+			return nil, err
+		}
+	}
+	return rlp.EncodeToBytes(receipts)
+}
+
+// TrainReceiptDictionary builds a zstd dictionary of at most size bytes out of
+// the RLP of the receipts of sample blocks. It's a raw content dictionary made
+// of the log addresses, topics and data words repeated the most across blocks,
+// the most valuable last as zstd finds them the cheapest to reference. It
+// returns nil if the samples share nothing worth a dictionary.
+func TrainReceiptDictionary(samples []rlp.RawValue, size int) []byte {
+	counts := make(map[string]int)
+	for _, blob := range samples {
+		var receipts []rlp.RawValue
+		if err := rlp.DecodeBytes(blob, &receipts); err != nil {
+			continue
+		}
+		for _, receipt := range receipts {
+			fields, index, err := splitReceipt(receipt)
+			if err != nil {
+				continue
+			}
+			var logs []*types.Log
+			if err := rlp.DecodeBytes(fields[index], &logs); err != nil {
+				continue
+			}
+			for _, l := range logs {
+				counts[string(l.Address[:])]++
+				for _, topic := range l.Topics {
+					counts[string(topic[:])]++
+				}
+				for i := 0; i+common.HashLength <= len(l.Data); i += common.HashLength {
+					counts[string(l.Data[i:i+common.HashLength])]++
+				}
+			}
+		}
+	}
+	type candidate struct {
+		data  string
+		score int
+	}
+	var candidates []candidate
+	for data, count := range counts {
+		if count > 1 {
+			candidates = append(candidates, candidate{data, (count - 1) * len(data)})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].data < candidates[j].data
+	})
+	var picked []string
+	for _, c := range candidates {
+		if size -= len(c.data); size < 0 {
+			break
+		}
+		picked = append(picked, c.data)
+	}
+	if len(picked) == 0 {
+		return nil
+	}
+	var dict []byte
+	for i := len(picked) - 1; i >= 0; i-- {
+		dict = append(dict, picked[i]...)
+	}
+	// Keep zstd from parsing the content as a structured dictionary
+	if bytes.HasPrefix(dict, zstdDictMagic) {
+		dict = append([]byte{0}, dict...)
+	}
+	return dict
+}
+
+// receiptDictionaryID derives the identifier of a dictionary from its content.
+func receiptDictionaryID(dict []byte) uint32 {
+	if id := binary.BigEndian.Uint32(crypto.Keccak256(dict)[:4]); id != 0 {
+		return id
+	}
+	return 1
+}
+
+// ReadReceiptDictionary retrieves the zstd dictionary of the given identifier.
+func ReadReceiptDictionary(db ethdb.KeyValueReader, id uint32) []byte {
+	data, _ := db.Get(receiptDictionaryKey(id))
+	return data
+}
+
+// WriteReceiptDictionary stores a zstd dictionary and returns its identifier.
+func WriteReceiptDictionary(db ethdb.KeyValueWriter, dict []byte) uint32 {
+	id := receiptDictionaryID(dict)
+	if err := db.Put(receiptDictionaryKey(id), dict); err != nil {
+		log.Crit("Failed to store receipt dictionary", "err", err)
+	}
+	if err := db.Put(receiptDictionaryHashKey(id), crypto.Keccak256(dict)); err != nil {
+		log.Crit("Failed to store receipt dictionary hash", "err", err)
+	}
+	return id
+}
+
+// ReadReceiptFormat retrieves the format the node writes receipts in, or nil
+// if it was never set, receipts then being written in the v1 format.
+func ReadReceiptFormat(db ethdb.KeyValueReader) *ReceiptFormat {
+	data, _ := db.Get(receiptFormatKey)
+	if len(data) == 0 {
+		return nil
+	}
+	format := new(ReceiptFormat)
+	if err := rlp.DecodeBytes(data, format); err != nil {
+		log.Error("Invalid receipt format", "err", err)
+		return nil
+	}
+	return format
+}
+
+// WriteReceiptFormat stores the format the node writes receipts in.
+func WriteReceiptFormat(db ethdb.KeyValueWriter, format *ReceiptFormat) {
+	data, err := rlp.EncodeToBytes(format)
+	if err != nil {
+		log.Crit("Failed to encode receipt format", "err", err)
+	}
+	if err := db.Put(receiptFormatKey, data); err != nil {
+		log.Crit("Failed to store receipt format", "err", err)
+	}
+}
+
+// ReadReceiptMigration retrieves the progress of the receipt format migration,
+// or nil if none was started.
+func ReadReceiptMigration(db ethdb.KeyValueReader) *ReceiptMigration {
+	data, _ := db.Get(receiptMigrationKey)
+	if len(data) == 0 {
+		return nil
+	}
+	progress := new(ReceiptMigration)
+	if err := rlp.DecodeBytes(data, progress); err != nil {
+		log.Error("Invalid receipt migration progress", "err", err)
+		return nil
+	}
+	return progress
+}
+
+// WriteReceiptMigration stores the progress of the receipt format migration.
+func WriteReceiptMigration(db ethdb.KeyValueWriter, progress *ReceiptMigration) {
+	data, err := rlp.EncodeToBytes(progress)
+	if err != nil {
+		log.Crit("Failed to encode receipt migration progress", "err", err)
+	}
+	if err := db.Put(receiptMigrationKey, data); err != nil {
+		log.Crit("Failed to store receipt migration progress", "err", err)
+	}
+}
+
+// ConvertReceipts rewrites a batch of the receipts stored in the key-value store
+// in the format new receipts are written in, from the progress onwards, and
+// stores the updated progress along with them. The receipts of the blocks about
+// to be moved to the ancient store are left alone.
+func ConvertReceipts(db ethdb.Database, progress *ReceiptMigration, batchSize int) error {
+	if progress.Done {
+		return nil
+	}
+	frozen, _ := db.Ancients()
+
+	it := db.NewIterator(blockReceiptsPrefix, progress.Next)
+	defer it.Release()
+
+	batch := db.NewBatch()
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(blockReceiptsPrefix)+8+common.HashLength {
+			continue
+		}
+		if batch.ValueSize() >= batchSize {
+			progress.Next = common.CopyBytes(key[len(blockReceiptsPrefix):])
+			WriteReceiptMigration(batch, progress)
+			return batch.Write()
+		}
+		if binary.BigEndian.Uint64(key[len(blockReceiptsPrefix):]) < frozen {
+			continue
+		}
+		blob, err := decodeStoredReceipts(db, it.Value())
+		if err != nil {
+			return fmt.Errorf("receipts %x: %w", key[len(blockReceiptsPrefix):], err)
+		}
+		data := encodeStoredReceipts(blob)
+		if bytes.Equal(data, it.Value()) {
+			continue
+		}
+		if err := batch.Put(key, data); err != nil {
+			return err
+		}
+		progress.Converted++
+		progress.Before += uint64(len(it.Value()))
+		progress.After += uint64(len(data))
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	progress.Next, progress.Done = nil, true
+	WriteReceiptMigration(batch, progress)
+	return batch.Write()
+}
@@ -0,0 +1,206 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// makeReceiptsV2Block creates the receipts of a block emitting the same kind of
+// logs as the other blocks, along with their RLP.
+func makeReceiptsV2Block(t *testing.T, number uint64) (types.Receipts, rlp.RawValue) {
+	var (
+		token    = common.HexToAddress("0xaf88d065e77c8cc2239327c5edb3a432268e5831")
+		transfer = common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+		receipts types.Receipts
+	)
+	for i := uint64(0); i < 20; i++ {
+		receipt := &types.Receipt{
+			Type:              types.DynamicFeeTxType,
+			Status:            types.ReceiptStatusSuccessful,
+			CumulativeGasUsed: 50000 * (i + 1),
+			GasUsedForL1:      i * 7,
+		}
+		for j := uint64(0); j < i%4; j++ {
+			from := common.BigToHash(new(big.Int).SetUint64(number*100 + i))
+			receipt.Logs = append(receipt.Logs, &types.Log{
+				Address: token,
+				Topics:  []common.Hash{transfer, from, common.BigToHash(big.NewInt(int64(j)))},
+				Data:    common.BigToHash(new(big.Int).SetUint64(number * j)).Bytes(),
+			})
+		}
+		receipts = append(receipts, receipt)
+	}
+	receipts = append(receipts, &types.Receipt{
+		Type:              types.ArbitrumLegacyTxType,
+		Status:            types.ReceiptStatusFailed,
+		CumulativeGasUsed: 2000000,
+		GasUsed:           1000,
+		ContractAddress:   common.Address{0x1},
+		Logs:              []*types.Log{{Address: token}},
+	}, &types.Receipt{
+		Type:              types.ArbitrumContractTxType,
+		Status:            types.ReceiptStatusSuccessful,
+		CumulativeGasUsed: 3000000,
+		ContractAddress:   common.Address{0x2},
+	})
+	storage := make([]*types.ReceiptForStorage, len(receipts))
+	for i, receipt := range receipts {
+		storage[i] = (*types.ReceiptForStorage)(receipt)
+	}
+	blob, err := rlp.EncodeToBytes(storage)
+	if err != nil {
+		t.Fatalf("failed to encode receipts: %v", err)
+	}
+	return receipts, blob
+}
+
+// Tests that receipts stored in the v2 format read back as the exact RLP they
+// were encoded from, with and without a dictionary, and that the migration
+// converts the stored receipts between the formats.
+func TestReceiptsV2(t *testing.T) {
+	t.Cleanup(func() { SetReceiptFormat(nil, nil) })
+
+	var (
+		db      = NewMemoryDatabase()
+		blocks  []types.Receipts
+		blobs   []rlp.RawValue
+		hash    = func(number uint64) common.Hash { return common.BigToHash(new(big.Int).SetUint64(number + 1)) }
+		version = func(number uint64) int {
+			data, _ := db.Get(blockReceiptsKey(number, hash(number)))
+			if data[0] == receiptsV2Marker {
+				return ReceiptFormatV2
+			}
+			return ReceiptFormatV1
+		}
+		check = func(stage string, number uint64) {
+			t.Helper()
+			if have := ReadReceiptsRLP(db, hash(number), number); !bytes.Equal(have, blobs[number]) {
+				t.Fatalf("%s: block %d: receipts RLP mismatch", stage, number)
+			}
+		}
+	)
+	for number := uint64(0); number < 10; number++ {
+		receipts, blob := makeReceiptsV2Block(t, number)
+		blocks, blobs = append(blocks, receipts), append(blobs, blob)
+		WriteReceipts(db, hash(number), number, receipts)
+	}
+	dict := TrainReceiptDictionary(blobs[:5], 4096)
+	if len(dict) == 0 || len(dict) > 4096 {
+		t.Fatalf("dictionary size %d out of bounds", len(dict))
+	}
+	format := &ReceiptFormat{Version: ReceiptFormatV2, Dictionary: WriteReceiptDictionary(db, dict)}
+	if err := SetReceiptFormat(db, &ReceiptFormat{Version: ReceiptFormatV2, Dictionary: format.Dictionary + 1}); err == nil {
+		t.Fatal("unknown dictionary accepted")
+	}
+	// New receipts are written in the v2 format, without and with a dictionary
+	var sizes []int
+	for _, dictionary := range []uint32{0, format.Dictionary} {
+		if err := SetReceiptFormat(db, &ReceiptFormat{Version: ReceiptFormatV2, Dictionary: dictionary}); err != nil {
+			t.Fatalf("failed to set format: %v", err)
+		}
+		WriteReceipts(db, hash(9), 9, blocks[9])
+		data, _ := db.Get(blockReceiptsKey(9, hash(9)))
+		if data[0] != receiptsV2Marker || len(data) >= len(blobs[9]) {
+			t.Fatalf("dictionary %#x: receipts not stored compacted: %d bytes, %d in v1", dictionary, len(data), len(blobs[9]))
+		}
+		check("written", 9)
+		if receipts := ReadRawReceipts(db, hash(9), 9); len(receipts) != len(blocks[9]) || len(receipts[3].Logs) != 3 {
+			t.Fatalf("dictionary %#x: unexpected receipts read", dictionary)
+		}
+		sizes = append(sizes, len(data))
+	}
+	if sizes[1] >= sizes[0] {
+		t.Errorf("dictionary not helping: %d bytes with, %d without", sizes[1], sizes[0])
+	}
+	// The migration converts the stored receipts back and forth
+	for _, target := range []int{ReceiptFormatV2, ReceiptFormatV1} {
+		if target == ReceiptFormatV2 {
+			SetReceiptFormat(db, format)
+		} else {
+			SetReceiptFormat(db, nil)
+		}
+		progress := &ReceiptMigration{Version: uint64(target)}
+		for i := 0; !progress.Done; i++ {
+			if err := ConvertReceipts(db, progress, 1); err != nil {
+				t.Fatalf("format %d: failed to convert receipts: %v", target, err)
+			}
+			if i > 20 {
+				t.Fatalf("format %d: migration not converging", target)
+			}
+		}
+		if stored := ReadReceiptMigration(db); stored == nil || !stored.Done {
+			t.Fatalf("format %d: migration progress not stored", target)
+		}
+		for number := range blobs {
+			if have := version(uint64(number)); have != target {
+				t.Fatalf("format %d: block %d stored in format %d", target, number, have)
+			}
+			check("migrated", uint64(number))
+		}
+	}
+}
+
+// Tests that databases holding distinct dictionaries under the same identifier
+// each read their receipts with their own dictionary.
+func TestReceiptsV2DictionaryCollision(t *testing.T) {
+	var (
+		blobs []rlp.RawValue
+		hash  = common.Hash{0x01}
+	)
+	for number := uint64(0); number < 10; number++ {
+		_, blob := makeReceiptsV2Block(t, number)
+		blobs = append(blobs, blob)
+	}
+	var (
+		dbs   = []ethdb.Database{NewMemoryDatabase(), NewMemoryDatabase()}
+		dict  = TrainReceiptDictionary(blobs[:5], 4096)
+		dicts = [][]byte{dict, make([]byte, len(dict))}
+		id    = WriteReceiptDictionary(dbs[0], dict)
+	)
+	for i := range dict {
+		dicts[1][i] = dict[len(dict)-1-i]
+	}
+	// Store the second dictionary under the identifier of the first
+	dbs[1].Put(receiptDictionaryKey(id), dicts[1])
+	dbs[1].Put(receiptDictionaryHashKey(id), crypto.Keccak256(dicts[1]))
+
+	for i, db := range dbs {
+		c, err := newReceiptCompressor(id, dicts[i])
+		if err != nil {
+			t.Fatalf("database %d: failed to create compressor: %v", i, err)
+		}
+		enc, err := encodeReceiptsV2(blobs[9], c)
+		if err != nil {
+			t.Fatalf("database %d: failed to encode receipts: %v", i, err)
+		}
+		db.Put(blockReceiptsKey(9, hash), enc)
+	}
+	for i, db := range dbs {
+		if have := ReadReceiptsRLP(db, hash, 9); !bytes.Equal(have, blobs[9]) {
+			t.Errorf("database %d: receipts RLP mismatch", i)
+		}
+	}
+}
@@ -208,3 +208,48 @@ func WriteSnapshotSyncStatus(db ethdb.KeyValueWriter, status []byte) {
 		log.Crit("Failed to store snapshot sync status", "err", err)
 	}
 }
+
+// ReadSnapshotSpill retrieves the serialized list of the diff layers spilled to
+// disk as reverse diffs.
+func ReadSnapshotSpill(db ethdb.KeyValueReader) []byte {
+	data, _ := db.Get(snapshotSpillKey)
+	return data
+}
+
+// WriteSnapshotSpill stores the serialized list of the diff layers spilled to
+// disk as reverse diffs.
+func WriteSnapshotSpill(db ethdb.KeyValueWriter, spill []byte) {
+	if err := db.Put(snapshotSpillKey, spill); err != nil {
+		log.Crit("Failed to store snapshot spill", "err", err)
+	}
+}
+
+// DeleteSnapshotSpill deletes the serialized list of the diff layers spilled to
+// disk as reverse diffs.
+func DeleteSnapshotSpill(db ethdb.KeyValueWriter) {
+	if err := db.Delete(snapshotSpillKey); err != nil {
+		log.Crit("Failed to remove snapshot spill", "err", err)
+	}
+}
+
+// ReadSnapshotReverseDiff retrieves the serialized reverse diff reverting the
+// snapshot disk layer from the given root to its parent.
+func ReadSnapshotReverseDiff(db ethdb.KeyValueReader, root common.Hash) []byte {
+	data, _ := db.Get(snapshotReverseDiffKey(root))
+	return data
+}
+
+// WriteSnapshotReverseDiff stores the serialized reverse diff reverting the
+// snapshot disk layer from the given root to its parent.
+func WriteSnapshotReverseDiff(db ethdb.KeyValueWriter, root common.Hash, diff []byte) {
+	if err := db.Put(snapshotReverseDiffKey(root), diff); err != nil {
+		log.Crit("Failed to store snapshot reverse diff", "err", err)
+	}
+}
+
+// DeleteSnapshotReverseDiff deletes the reverse diff of the given root.
+func DeleteSnapshotReverseDiff(db ethdb.KeyValueWriter, root common.Hash) {
+	if err := db.Delete(snapshotReverseDiffKey(root)); err != nil {
+		log.Crit("Failed to remove snapshot reverse diff", "err", err)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// StatePin is a state committed to disk and kept out of pruning under a label,
+// for reuse after an expensive recreation.
+type StatePin struct {
+	Label       string
+	Root        common.Hash
+	BlockHash   common.Hash
+	BlockNumber uint64
+	Created     uint64 // Unix time the state was pinned at
+}
+
+// ReadStatePin retrieves the pinned state with the given label, if any.
+func ReadStatePin(db ethdb.KeyValueReader, label string) *StatePin {
+	data, _ := db.Get(statePinKey(label))
+	if len(data) == 0 {
+		return nil
+	}
+	pin := new(StatePin)
+	if err := rlp.DecodeBytes(data, pin); err != nil {
+		log.Error("Invalid state pin", "label", label, "err", err)
+		return nil
+	}
+	return pin
+}
+
+// ReadAllStatePins retrieves all the pinned states, ordered by label.
+func ReadAllStatePins(db ethdb.Iteratee) []*StatePin {
+	it := db.NewIterator(statePinPrefix, nil)
+	defer it.Release()
+
+	var pins []*StatePin
+	for it.Next() {
+		pin := new(StatePin)
+		if err := rlp.DecodeBytes(it.Value(), pin); err != nil {
+			log.Error("Invalid state pin", "key", string(it.Key()), "err", err)
+			continue
+		}
+		pins = append(pins, pin)
+	}
+	return pins
+}
+
+// WriteStatePin stores the pinned state under its label.
+func WriteStatePin(db ethdb.KeyValueWriter, pin *StatePin) {
+	data, err := rlp.EncodeToBytes(pin)
+	if err != nil {
+		log.Crit("Failed to encode state pin", "err", err)
+	}
+	if err := db.Put(statePinKey(pin.Label), data); err != nil {
+		log.Crit("Failed to store state pin", "label", pin.Label, "err", err)
+	}
+}
+
+// DeleteStatePin removes the pinned state with the given label.
+func DeleteStatePin(db ethdb.KeyValueWriter, label string) {
+	if err := db.Delete(statePinKey(label)); err != nil {
+		log.Crit("Failed to delete state pin", "label", label, "err", err)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"encoding/binary"
+	"math/big"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// transferIndexKeyLength is the length of the keys of the token transfer index.
+const transferIndexKeyLength = 1 + 2*common.AddressLength + 8 + common.HashLength + 2*4
+
+// Token standards of the indexed transfers.
+const (
+	TokenERC20   = 20
+	TokenERC721  = 721
+	TokenERC1155 = 1155
+)
+
+// TokenTransfer is a token transfer from or to an account, as recorded in the
+// token transfer index. The entries of the blocks that were reorged out aren't
+// removed, the block hash tells whether a transfer is canonical.
+type TokenTransfer struct {
+	Holder      common.Address `rlp:"-"` // Account the transfer is indexed for, the sender or the recipient
+	Token       common.Address `rlp:"-"`
+	BlockNumber uint64         `rlp:"-"`
+	BlockHash   common.Hash    `rlp:"-"`
+	LogIndex    uint32         `rlp:"-"`
+	Item        uint32         `rlp:"-"` // Position of the transfer in an ERC-1155 batch
+
+	Standard uint16
+	TxHash   common.Hash
+	From     common.Address
+	To       common.Address
+	TokenID  *big.Int // Token of an ERC-721 or ERC-1155 transfer
+	Value    *big.Int // Amount of an ERC-20 or ERC-1155 transfer
+}
+
+// WriteTokenTransfers stores the token transfers of a block, along with the
+// list of their keys used to prune them.
+func WriteTokenTransfers(db ethdb.KeyValueWriter, number uint64, hash common.Hash, transfers []*TokenTransfer) {
+	keys := make([][]byte, 0, len(transfers))
+	for _, transfer := range transfers {
+		data, err := rlp.EncodeToBytes(transfer)
+		if err != nil {
+			log.Crit("Failed to encode token transfer", "err", err)
+		}
+		key := transferIndexKey(transfer.Holder, transfer.Token, number, hash, transfer.LogIndex, transfer.Item)
+		if err := db.Put(key, data); err != nil {
+			log.Crit("Failed to store token transfer", "err", err)
+		}
+		keys = append(keys, key)
+	}
+	data, err := rlp.EncodeToBytes(keys)
+	if err != nil {
+		log.Crit("Failed to encode token transfer keys", "err", err)
+	}
+	if err := db.Put(transferBlockKey(number, hash), data); err != nil {
+		log.Crit("Failed to store token transfer keys", "err", err)
+	}
+}
+
+// IterateTokenTransfers calls fn with the indexed transfers of the holder in
+// the blocks [from, to], of any block hash, until it returns false. If token is
+// nil the transfers of all tokens are iterated, ordered by token and block,
+// otherwise only the transfers of that token, ordered by block.
+func IterateTokenTransfers(db ethdb.Iteratee, holder common.Address, token *common.Address, from, to uint64, fn func(*TokenTransfer) bool) {
+	prefix := append(append([]byte{}, TransferIndexPrefix...), holder.Bytes()...)
+	var start []byte
+	if token != nil {
+		prefix = append(prefix, token.Bytes()...)
+		start = encodeBlockNumber(from)
+	}
+	it := db.NewIterator(prefix, start)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if len(key) != transferIndexKeyLength {
+			continue
+		}
+		pos := len(TransferIndexPrefix) + 2*common.AddressLength
+		number := binary.BigEndian.Uint64(key[pos:])
+		if number < from || number > to {
+			if token != nil {
+				return
+			}
+			continue
+		}
+		transfer := new(TokenTransfer)
+		if err := rlp.DecodeBytes(it.Value(), transfer); err != nil {
+			log.Error("Invalid token transfer", "key", key, "err", err)
+			continue
+		}
+		// The fields absent from the standard are decoded as zero
+		switch transfer.Standard {
+		case TokenERC20:
+			transfer.TokenID = nil
+		case TokenERC721:
+			transfer.Value = nil
+		}
+		transfer.Holder = holder
+		transfer.Token = common.BytesToAddress(key[len(TransferIndexPrefix)+common.AddressLength : pos])
+		transfer.BlockNumber = number
+		transfer.BlockHash = common.BytesToHash(key[pos+8 : pos+8+common.HashLength])
+		transfer.LogIndex = binary.BigEndian.Uint32(key[pos+8+common.HashLength:])
+		transfer.Item = binary.BigEndian.Uint32(key[pos+8+common.HashLength+4:])
+		if !fn(transfer) {
+			return
+		}
+	}
+}
+
+// DeleteTokenTransfers deletes the indexed token transfers of all the blocks
+// with the given number.
+func DeleteTokenTransfers(db ethdb.KeyValueStore, number uint64) {
+	prefix := append(append([]byte{}, transferBlockPrefix...), encodeBlockNumber(number)...)
+	it := db.NewIterator(prefix, nil)
+	defer it.Release()
+
+	batch := db.NewBatch()
+	for it.Next() {
+		if len(it.Key()) != len(prefix)+common.HashLength {
+			continue
+		}
+		var keys [][]byte
+		if err := rlp.DecodeBytes(it.Value(), &keys); err != nil {
+			log.Error("Invalid token transfer keys", "number", number, "err", err)
+		}
+		for _, key := range keys {
+			batch.Delete(key)
+		}
+		batch.Delete(it.Key())
+	}
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to delete token transfers", "err", err)
+	}
+}
+
+// ReadTransferIndexTail retrieves the number of the oldest block whose token
+// transfers are indexed, or nil if nothing was indexed yet.
+func ReadTransferIndexTail(db ethdb.KeyValueReader) *uint64 {
+	data, _ := db.Get(transferIndexTailKey)
+	if len(data) != 8 {
+		return nil
+	}
+	number := binary.BigEndian.Uint64(data)
+	return &number
+}
+
+// WriteTransferIndexTail stores the number of the oldest block whose token
+// transfers are indexed.
+func WriteTransferIndexTail(db ethdb.KeyValueWriter, number uint64) {
+	if err := db.Put(transferIndexTailKey, encodeBlockNumber(number)); err != nil {
+		log.Crit("Failed to store the token transfer index tail", "err", err)
+	}
+}
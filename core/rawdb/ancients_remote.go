@@ -0,0 +1,359 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/ethdb/remoteancient"
+	"github.com/chainupcloud/arb-geth/log"
+)
+
+const (
+	// remoteFreezerName is the folder name of the local copy of the remote
+	// ancients, within the root ancient directory.
+	remoteFreezerName = "remote"
+
+	remoteBackfillBatch = 256              // Number of items of each table backfilled at once
+	remoteBackfillRetry = 30 * time.Second // Time to wait before retrying a failed backfill
+)
+
+// remoteTables are the chain tables in the order their items are verified, the
+// body and receipts of a block being verified against its header.
+var remoteTables = []string{
+	ChainFreezerHashTable,
+	ChainFreezerHeaderTable,
+	ChainFreezerDifficultyTable,
+	ChainFreezerBodiesTable,
+	ChainFreezerReceiptTable,
+}
+
+// remoteAncients is an ancient store reading the items below the tail of the
+// local store through from a remote source, so that a node with a pruned or
+// partial freezer serves the full history. The remote items are verified
+// against the hash chain ending at the local tail before being returned, and
+// are optionally copied into a separate local freezer in the background,
+// serving them from there once copied.
+type remoteAncients struct {
+	ethdb.AncientStore // Local chain freezer
+
+	remote   *remoteancient.Client
+	verifier *remoteVerifier
+	backfill *Freezer // Local copy of the remote items, nil if not backfilling
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newRemoteAncients wraps the local chain freezer, reading the items it misses
+// from the configured source. The key-value store holds the local blocks not
+// frozen yet and the receipt compression dictionaries, and the hasher derives
+// the transaction and receipt roots the remote bodies and receipts are checked
+// against.
+func newRemoteAncients(local ethdb.AncientStore, kvdb ethdb.KeyValueReader, hasher func() types.TrieHasher, ancientRoot string, namespace string, config *remoteancient.Config) (*remoteAncients, error) {
+	remote, err := remoteancient.New(config)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := newRemoteVerifier(local, kvdb, remote, hasher, filepath.Join(ancientRoot, remoteVerifiedName), namespace+"remoteverified/")
+	if err != nil {
+		return nil, err
+	}
+	r := &remoteAncients{
+		AncientStore: local,
+		remote:       remote,
+		verifier:     verifier,
+		quit:         make(chan struct{}),
+	}
+	if config.Backfill {
+		r.backfill, err = NewFreezer(filepath.Join(ancientRoot, remoteFreezerName), namespace+"remote/", false, freezerTableSize, chainFreezerNoSnappy)
+		if err != nil {
+			verifier.close()
+			return nil, err
+		}
+	}
+	r.wg.Add(1)
+	go r.run()
+
+	log.Info("Reading missing ancients through", "url", config.URL, "backfill", r.backfill != nil)
+	return r, nil
+}
+
+// missing returns whether the local store lacks the item, as it's below its tail.
+func (r *remoteAncients) missing(local ethdb.AncientReaderOp, number uint64) bool {
+	tail, err := local.Tail()
+	return err == nil && number < tail
+}
+
+// fetch retrieves an item missing locally from the backfilled copy if there,
+// from the remote source otherwise, verifying it first. Only the blocks verified
+// by the background walk, or a short way below the local tail, are served.
+func (r *remoteAncients) fetch(kind string, number uint64) ([]byte, error) {
+	if r.backfill != nil {
+		if copied, _ := r.backfill.Ancients(); number < copied {
+			return r.backfill.Ancient(kind, number)
+		}
+	}
+	ctx, cancel := r.remote.ReadContext()
+	defer cancel()
+	return r.fetchRemote(ctx, kind, number)
+}
+
+// HasAncient returns whether the item exists, locally or remotely.
+func (r *remoteAncients) HasAncient(kind string, number uint64) (bool, error) {
+	return (&remoteReader{r.AncientStore, r}).HasAncient(kind, number)
+}
+
+// Ancient retrieves an item, locally or remotely.
+func (r *remoteAncients) Ancient(kind string, number uint64) ([]byte, error) {
+	return (&remoteReader{r.AncientStore, r}).Ancient(kind, number)
+}
+
+// AncientRange retrieves a sequence of items, locally or remotely.
+func (r *remoteAncients) AncientRange(kind string, start, count, maxBytes uint64) ([][]byte, error) {
+	return (&remoteReader{r.AncientStore, r}).AncientRange(kind, start, count, maxBytes)
+}
+
+// ReadAncients runs the read operation on the local store, reading the items
+// it misses through.
+func (r *remoteAncients) ReadAncients(fn func(ethdb.AncientReaderOp) error) error {
+	return r.AncientStore.ReadAncients(func(op ethdb.AncientReaderOp) error {
+		return fn(&remoteReader{op, r})
+	})
+}
+
+// Close stops the background work and closes the local stores.
+func (r *remoteAncients) Close() error {
+	close(r.quit)
+	r.wg.Wait()
+
+	var errs []error
+	if r.backfill != nil {
+		if err := r.backfill.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := r.verifier.close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := r.AncientStore.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// run verifies the hash chain below the local tail down to the genesis, then
+// backfills the missing items if enabled, retrying after failures.
+func (r *remoteAncients) run() {
+	defer r.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		err := r.verifier.extend(ctx, 0)
+		if err == nil {
+			if lowest, ok := r.verifier.verified(); ok {
+				log.Info("Verified the remote ancients", "lowest", lowest)
+			}
+			if r.backfill == nil {
+				return
+			}
+			if err = r.runBackfill(ctx); err == nil {
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warn("Failed to verify or backfill remote ancients", "err", err)
+		select {
+		case <-time.After(remoteBackfillRetry):
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// runBackfill copies the items below the tail of the local store into the
+// backfill freezer, in order, verifying each, until it catches up with the tail.
+func (r *remoteAncients) runBackfill(ctx context.Context) error {
+	logged := time.Now()
+	for {
+		tail, err := r.AncientStore.Tail()
+		if err != nil {
+			return err
+		}
+		next, err := r.backfill.Ancients()
+		if err != nil {
+			return err
+		}
+		if next >= tail {
+			log.Info("Backfilled the remote ancients", "items", next)
+			return nil
+		}
+		end := next + remoteBackfillBatch
+		if end > tail {
+			end = tail
+		}
+		_, err = r.backfill.ModifyAncients(func(op ethdb.AncientWriteOp) error {
+			for number := next; number < end; number++ {
+				for _, kind := range remoteTables {
+					fetchCtx, cancel := r.remote.FetchContext(ctx)
+					item, err := r.fetchRemote(fetchCtx, kind, number)
+					cancel()
+					if err != nil {
+						return err
+					}
+					if err := op.AppendRaw(kind, number, item); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Backfilling remote ancients", "items", end, "tail", tail)
+			logged = time.Now()
+		}
+		select {
+		case <-r.quit:
+			return nil
+		default:
+		}
+	}
+}
+
+// fetchRemote retrieves an item from the remote source, verifying it before
+// caching and returning it.
+func (r *remoteAncients) fetchRemote(ctx context.Context, kind string, number uint64) ([]byte, error) {
+	if item, ok := r.remote.Cached(kind, number); ok {
+		return item, nil
+	}
+	item, err := r.remote.Fetch(ctx, kind, number)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.verifier.verify(ctx, kind, number, item); err != nil {
+		return nil, err
+	}
+	r.remote.Cache(kind, number, item)
+	return item, nil
+}
+
+// remoteReader reads the items missing from a local reader through.
+type remoteReader struct {
+	ethdb.AncientReaderOp // Local reader
+	r                     *remoteAncients
+}
+
+func (rr *remoteReader) HasAncient(kind string, number uint64) (bool, error) {
+	if !rr.r.missing(rr.AncientReaderOp, number) {
+		return rr.AncientReaderOp.HasAncient(kind, number)
+	}
+	if _, err := rr.r.fetch(kind, number); err != nil {
+		if errors.Is(err, remoteancient.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (rr *remoteReader) Ancient(kind string, number uint64) ([]byte, error) {
+	if !rr.r.missing(rr.AncientReaderOp, number) {
+		return rr.AncientReaderOp.Ancient(kind, number)
+	}
+	return rr.r.fetch(kind, number)
+}
+
+func (rr *remoteReader) AncientRange(kind string, start, count, maxBytes uint64) ([][]byte, error) {
+	if !rr.r.missing(rr.AncientReaderOp, start) {
+		return rr.AncientReaderOp.AncientRange(kind, start, count, maxBytes)
+	}
+	// Read the missing items through one by one, then the local ones
+	var (
+		items [][]byte
+		size  uint64
+	)
+	for number := start; number < start+count; number++ {
+		if !rr.r.missing(rr.AncientReaderOp, number) {
+			rest, err := rr.AncientReaderOp.AncientRange(kind, number, start+count-number, maxBytes-size)
+			if err != nil && len(items) == 0 {
+				return nil, err
+			}
+			return append(items, rest...), nil
+		}
+		item, err := rr.r.fetch(kind, number)
+		if err != nil {
+			if len(items) == 0 {
+				return nil, err
+			}
+			break
+		}
+		// The first item is returned regardless of the size limit
+		if len(items) > 0 && size+uint64(len(item)) > maxBytes {
+			break
+		}
+		items = append(items, item)
+		if size += uint64(len(item)); size >= maxBytes {
+			break
+		}
+	}
+	return items, nil
+}
+
+// RemoteAncientsHandler serves the ancients of the database in the layout read
+// by the remote source, so that a node can be the remote source of others. The
+// receipts are served in their uncompressed encoding, as the dictionaries they
+// may be compressed with are local to the database.
+func RemoteAncientsHandler(db ethdb.Database) http.Handler {
+	return remoteancient.Handler(&remoteItemReader{db})
+}
+
+// remoteItemReader reads the items served to the remote readers.
+type remoteItemReader struct {
+	db ethdb.Database
+}
+
+func (r *remoteItemReader) Ancient(kind string, number uint64) ([]byte, error) {
+	item, err := r.db.Ancient(kind, number)
+	if err != nil || kind != ChainFreezerReceiptTable {
+		return item, err
+	}
+	return decodeStoredReceipts(r.db, item)
+}
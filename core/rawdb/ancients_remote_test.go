@@ -0,0 +1,276 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/ethdb/remoteancient"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+func remoteTestHasher() types.TrieHasher {
+	return newHasher()
+}
+
+// makeRemoteTestChain creates a chain of blocks with a transaction and receipt
+// each, linked by their parent hashes.
+func makeRemoteTestChain(n int) ([]*types.Block, []types.Receipts) {
+	var (
+		blocks   []*types.Block
+		receipts []types.Receipts
+		parent   common.Hash
+	)
+	for i := 0; i < n; i++ {
+		tx := types.NewTransaction(uint64(i), common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil)
+		receipt := &types.Receipt{
+			Status:            types.ReceiptStatusSuccessful,
+			CumulativeGasUsed: 21000,
+			Logs:              []*types.Log{{Address: common.Address{0x02}, Topics: []common.Hash{{byte(i)}}}},
+		}
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+		header := &types.Header{
+			ParentHash: parent,
+			Number:     big.NewInt(int64(i)),
+			Difficulty: big.NewInt(1),
+		}
+		block := types.NewBlock(header, []*types.Transaction{tx}, nil, []*types.Receipt{receipt}, newHasher())
+		blocks = append(blocks, block)
+		receipts = append(receipts, types.Receipts{receipt})
+		parent = block.Hash()
+	}
+	return blocks, receipts
+}
+
+// newRemoteTestFreezer creates a chain freezer holding the blocks.
+func newRemoteTestFreezer(t *testing.T, blocks []*types.Block, receipts []types.Receipts) *Freezer {
+	f, err := NewChainFreezer(t.TempDir(), "", false)
+	if err != nil {
+		t.Fatalf("failed to create freezer: %v", err)
+	}
+	if _, err := WriteAncientBlocks(f, blocks, receipts, big.NewInt(1)); err != nil {
+		t.Fatalf("failed to fill freezer: %v", err)
+	}
+	return f
+}
+
+// waitRemoteVerified waits for the background walk to verify the chain down to
+// the given block.
+func waitRemoteVerified(t *testing.T, store *remoteAncients, number uint64) {
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if lowest, ok := store.verifier.verified(); ok && lowest <= number {
+			return
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("verification didn't reach block %d", number)
+		}
+	}
+}
+
+// Tests that the ancients below the tail of the freezer are read through from
+// the remote source, then from the local copy once backfilled.
+func TestRemoteAncients(t *testing.T) {
+	blocks, receipts := makeRemoteTestChain(100)
+	source := newRemoteTestFreezer(t, blocks, receipts)
+	defer source.Close()
+	server := httptest.NewServer(remoteancient.Handler(source))
+	defer server.Close()
+
+	root := t.TempDir()
+	local := newRemoteTestFreezer(t, blocks, receipts)
+	if err := local.TruncateTail(60); err != nil {
+		t.Fatalf("failed to truncate tail: %v", err)
+	}
+	config := remoteancient.DefaultConfig
+	config.URL = server.URL
+	config.AllowHTTP = true
+	config.Backfill = false
+	store, err := newRemoteAncients(local, NewMemoryDatabase(), remoteTestHasher, root, "", &config)
+	if err != nil {
+		t.Fatalf("failed to create remote ancients: %v", err)
+	}
+	waitRemoteVerified(t, store, 0)
+	for _, number := range []uint64{0, 59, 60, 99} {
+		for _, kind := range remoteTables {
+			want, _ := source.Ancient(kind, number)
+			if item, err := store.Ancient(kind, number); err != nil || !bytes.Equal(item, want) {
+				t.Errorf("%s #%d: have %x (%v), want %x", kind, number, item, err, want)
+			}
+		}
+	}
+	if has, err := store.HasAncient(ChainFreezerBodiesTable, 100); has || err != nil {
+		t.Errorf("item past the head reported: %v %v", has, err)
+	}
+	// Ranges may span both stores
+	items, err := store.AncientRange(ChainFreezerHashTable, 55, 10, 1024)
+	if err != nil || len(items) != 10 {
+		t.Fatalf("failed to read range: %d items, %v", len(items), err)
+	}
+	for i, item := range items {
+		if want := blocks[55+i].Hash(); !bytes.Equal(item, want[:]) {
+			t.Errorf("range item %d: have %x, want %x", i, item, want)
+		}
+	}
+	err = store.ReadAncients(func(op ethdb.AncientReaderOp) error {
+		want, _ := source.Ancient(ChainFreezerReceiptTable, 10)
+		item, err := op.Ancient(ChainFreezerReceiptTable, 10)
+		if err == nil && !bytes.Equal(item, want) {
+			err = fmt.Errorf("have %x", item)
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("failed to read through in batch: %v", err)
+	}
+	store.Close()
+
+	// Backfill the missing items, which are then served without the source,
+	// resuming from the verified index
+	local = newRemoteTestFreezer(t, blocks, receipts)
+	local.TruncateTail(60)
+	config.Backfill = true
+	store, err = newRemoteAncients(local, NewMemoryDatabase(), remoteTestHasher, root, "", &config)
+	if err != nil {
+		t.Fatalf("failed to create remote ancients: %v", err)
+	}
+	defer store.Close()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if copied, _ := store.backfill.Ancients(); copied == 60 {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("backfill timed out")
+		}
+	}
+	server.Close()
+	want, _ := source.Ancient(ChainFreezerDifficultyTable, 30)
+	if item, err := store.Ancient(ChainFreezerDifficultyTable, 30); err != nil || !bytes.Equal(item, want) {
+		t.Errorf("backfilled item: have %x (%v), want %x", item, err, want)
+	}
+}
+
+// Tests that remote items not matching the hash chain ending at the local tail
+// are rejected, and that blocks below a forged header aren't verified.
+func TestRemoteAncientsTampered(t *testing.T) {
+	blocks, receipts := makeRemoteTestChain(100)
+	source := newRemoteTestFreezer(t, blocks, receipts)
+	defer source.Close()
+
+	// Serve a forged header for block 30
+	forged := types.CopyHeader(blocks[30].Header())
+	forged.Extra = []byte("forged")
+	forgedRLP, _ := rlp.EncodeToBytes(forged)
+	handler := remoteancient.Handler(source)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/headers/30" {
+			w.Write(forgedRLP)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	local := newRemoteTestFreezer(t, blocks, receipts)
+	local.TruncateTail(60)
+	config := remoteancient.DefaultConfig
+	config.URL = server.URL
+	config.AllowHTTP = true
+	config.Backfill = false
+	store, err := newRemoteAncients(local, NewMemoryDatabase(), remoteTestHasher, t.TempDir(), "", &config)
+	if err != nil {
+		t.Fatalf("failed to create remote ancients: %v", err)
+	}
+	defer store.Close()
+	waitRemoteVerified(t, store, 30)
+
+	if _, err := store.Ancient(ChainFreezerHeaderTable, 30); !errors.Is(err, errRemoteMismatch) {
+		t.Errorf("forged header returned: %v", err)
+	}
+	if _, err := store.Ancient(ChainFreezerHeaderTable, 20); !errors.Is(err, errRemoteUnverified) {
+		t.Errorf("header below the forged one returned: %v", err)
+	}
+	if lowest, _ := store.verifier.verified(); lowest != 30 {
+		t.Errorf("verification went past the forged header: lowest %d", lowest)
+	}
+	if item, err := store.Ancient(ChainFreezerBodiesTable, 31); err != nil || len(item) == 0 {
+		t.Errorf("valid body rejected: %v", err)
+	}
+}
+
+// Tests that remote bodies not matching their header are rejected.
+func TestRemoteAncientsTamperedBody(t *testing.T) {
+	blocks, receipts := makeRemoteTestChain(100)
+	source := newRemoteTestFreezer(t, blocks, receipts)
+	defer source.Close()
+
+	handler := remoteancient.Handler(source)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bodies/10" {
+			r.URL.Path = "/bodies/11"
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	local := newRemoteTestFreezer(t, blocks, receipts)
+	local.TruncateTail(60)
+	config := remoteancient.DefaultConfig
+	config.URL = server.URL
+	config.AllowHTTP = true
+	config.Backfill = false
+	store, err := newRemoteAncients(local, NewMemoryDatabase(), remoteTestHasher, t.TempDir(), "", &config)
+	if err != nil {
+		t.Fatalf("failed to create remote ancients: %v", err)
+	}
+	defer store.Close()
+	waitRemoteVerified(t, store, 0)
+
+	if _, err := store.Ancient(ChainFreezerBodiesTable, 10); !errors.Is(err, errRemoteMismatch) {
+		t.Errorf("tampered body returned: %v", err)
+	}
+	if _, err := store.Ancient(ChainFreezerReceiptTable, 10); !errors.Is(err, errRemoteMismatch) {
+		t.Errorf("receipts checked against a tampered body: %v", err)
+	}
+	if _, err := store.Ancient(ChainFreezerBodiesTable, 11); err != nil {
+		t.Errorf("valid body rejected: %v", err)
+	}
+}
+
+// Tests that a plain http source is only accepted if explicitly allowed.
+func TestRemoteAncientsRequireHTTPS(t *testing.T) {
+	local, err := NewChainFreezer(t.TempDir(), "", false)
+	if err != nil {
+		t.Fatalf("failed to create freezer: %v", err)
+	}
+	defer local.Close()
+
+	config := remoteancient.DefaultConfig
+	config.URL = "http://example.com/ancients"
+	if _, err := newRemoteAncients(local, NewMemoryDatabase(), remoteTestHasher, t.TempDir(), "", &config); err == nil {
+		t.Fatal("plain http source accepted")
+	}
+}
@@ -0,0 +1,440 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/ethdb/remoteancient"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+const (
+	// remoteVerifiedName is the folder name of the index of the verified remote
+	// blocks, within the root ancient directory.
+	remoteVerifiedName = "remote-verified"
+
+	// remoteVerifiedTable is the single table of the index.
+	remoteVerifiedTable = "blocks"
+
+	// remoteVerifyBatch is the number of blocks verified at once.
+	remoteVerifyBatch = 256
+
+	// remoteVerifyGapLimit bounds the number of headers walked in memory to verify
+	// a block between the local tail and the top of the index, left by the local
+	// tail moving up after the index was started.
+	remoteVerifyGapLimit = 1024
+)
+
+var (
+	// errRemoteUnverified is returned for the remote items of the blocks that
+	// aren't verified yet.
+	errRemoteUnverified = errors.New("remote ancient block not verified yet")
+
+	// errRemoteMismatch is returned for the remote items not matching the
+	// verified chain.
+	errRemoteMismatch = errors.New("remote ancient item doesn't match the verified chain")
+)
+
+// remoteVerifiedBlock is an entry of the index of the verified remote blocks.
+type remoteVerifiedBlock struct {
+	Number uint64
+	Hash   common.Hash
+	TD     *big.Int
+}
+
+// remoteVerifier checks the remote items against the canonical chain. Starting
+// from the parent hash of the block at the local tail, it walks the remote
+// headers down along their parent hashes, keeping the hash and total difficulty
+// of every block verified this way in an index, persisted in a freezer with the
+// highest block first. Headers, hashes and total difficulties are checked
+// against the index, and bodies and receipts against the roots of the verified
+// header of their block.
+type remoteVerifier struct {
+	local  ethdb.AncientStore
+	kvdb   ethdb.KeyValueReader
+	remote *remoteancient.Client
+	hasher func() types.TrieHasher // Hasher of the transaction and receipt roots, nil if unavailable
+
+	index  *Freezer
+	top    uint64        // Number of the first block of the index
+	count  atomic.Uint64 // Number of blocks in the index
+	lock   sync.Mutex    // Serializes the extensions of the index
+	lowest *remoteVerifiedBlock
+}
+
+func newRemoteVerifier(local ethdb.AncientStore, kvdb ethdb.KeyValueReader, remote *remoteancient.Client, hasher func() types.TrieHasher, dir string, namespace string) (*remoteVerifier, error) {
+	index, err := NewFreezer(dir, namespace, false, freezerTableSize, map[string]bool{remoteVerifiedTable: true})
+	if err != nil {
+		return nil, err
+	}
+	v := &remoteVerifier{
+		local:  local,
+		kvdb:   kvdb,
+		remote: remote,
+		hasher: hasher,
+		index:  index,
+	}
+	if err := v.open(); err != nil {
+		index.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// open loads the index, starting it anew from the local tail if there's none or
+// if it doesn't fit below the local tail.
+func (v *remoteVerifier) open() error {
+	tail, err := v.local.Tail()
+	if err != nil {
+		return err
+	}
+	count, err := v.index.Ancients()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		first, err := v.entry(0)
+		if err != nil {
+			return err
+		}
+		if first.Number < tail {
+			lowest, err := v.entry(count - 1)
+			if err != nil {
+				return err
+			}
+			v.top, v.lowest = first.Number, lowest
+			v.count.Store(count)
+			return nil
+		}
+		if err := v.index.TruncateHead(0); err != nil {
+			return err
+		}
+	}
+	if tail == 0 {
+		return nil // Nothing missing locally
+	}
+	anchor, err := v.anchor(tail)
+	if err != nil {
+		return fmt.Errorf("failed to anchor the remote ancients at the local tail %d: %w", tail, err)
+	}
+	if err := v.append([]*remoteVerifiedBlock{anchor}); err != nil {
+		return err
+	}
+	v.top = anchor.Number
+	return nil
+}
+
+// anchor returns the parent of the local block with the given number, read from
+// the ancient store, or the key-value store if not frozen.
+func (v *remoteVerifier) anchor(number uint64) (*remoteVerifiedBlock, error) {
+	var headerRLP, tdRLP []byte
+	if headerRLP, _ = v.local.Ancient(ChainFreezerHeaderTable, number); len(headerRLP) > 0 {
+		tdRLP, _ = v.local.Ancient(ChainFreezerDifficultyTable, number)
+	} else {
+		data, _ := v.kvdb.Get(headerHashKey(number))
+		hash := common.BytesToHash(data)
+		headerRLP, _ = v.kvdb.Get(headerKey(number, hash))
+		tdRLP, _ = v.kvdb.Get(headerTDKey(number, hash))
+	}
+	if len(headerRLP) == 0 || len(tdRLP) == 0 {
+		return nil, errors.New("local block missing")
+	}
+	header := new(types.Header)
+	if err := rlp.DecodeBytes(headerRLP, header); err != nil {
+		return nil, err
+	}
+	td := new(big.Int)
+	if err := rlp.DecodeBytes(tdRLP, td); err != nil {
+		return nil, err
+	}
+	return &remoteVerifiedBlock{
+		Number: number - 1,
+		Hash:   header.ParentHash,
+		TD:     td.Sub(td, header.Difficulty),
+	}, nil
+}
+
+func (v *remoteVerifier) entry(i uint64) (*remoteVerifiedBlock, error) {
+	data, err := v.index.Ancient(remoteVerifiedTable, i)
+	if err != nil {
+		return nil, err
+	}
+	block := new(remoteVerifiedBlock)
+	if err := rlp.DecodeBytes(data, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func (v *remoteVerifier) append(blocks []*remoteVerifiedBlock) error {
+	count := v.count.Load()
+	_, err := v.index.ModifyAncients(func(op ethdb.AncientWriteOp) error {
+		for i, block := range blocks {
+			if err := op.Append(remoteVerifiedTable, count+uint64(i), block); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	v.lowest = blocks[len(blocks)-1]
+	v.count.Store(count + uint64(len(blocks)))
+	return nil
+}
+
+// verified returns the lowest block number verified, false if none is.
+func (v *remoteVerifier) verified() (uint64, bool) {
+	count := v.count.Load()
+	if count == 0 {
+		return 0, false
+	}
+	return v.top - (count - 1), true
+}
+
+// block returns the verified hash and total difficulty of a block below the
+// local tail, or errRemoteUnverified if the index doesn't reach it yet.
+func (v *remoteVerifier) block(ctx context.Context, number uint64) (*remoteVerifiedBlock, error) {
+	if v.count.Load() > 0 && number > v.top {
+		return v.walk(ctx, number)
+	}
+	if lowest, ok := v.verified(); !ok || number < lowest {
+		return nil, fmt.Errorf("%w: #%d", errRemoteUnverified, number)
+	}
+	return v.entry(v.top - number)
+}
+
+// walk verifies a block above the top of the index by walking the headers down
+// from the local tail.
+func (v *remoteVerifier) walk(ctx context.Context, number uint64) (*remoteVerifiedBlock, error) {
+	tail, err := v.local.Tail()
+	if err != nil {
+		return nil, err
+	}
+	if number >= tail {
+		return nil, fmt.Errorf("block #%d isn't below the local tail %d", number, tail)
+	}
+	if tail-number > remoteVerifyGapLimit {
+		return nil, fmt.Errorf("%w: #%d is too far below the local tail %d", errRemoteUnverified, number, tail)
+	}
+	block, err := v.anchor(tail)
+	if err != nil {
+		return nil, err
+	}
+	for block.Number > number {
+		if block, err = v.parent(ctx, block); err != nil {
+			return nil, err
+		}
+	}
+	return block, nil
+}
+
+// header fetches the header of a verified block and checks its hash.
+func (v *remoteVerifier) header(ctx context.Context, block *remoteVerifiedBlock) (*types.Header, error) {
+	data, err := v.fetch(ctx, ChainFreezerHeaderTable, block.Number)
+	if err != nil {
+		return nil, err
+	}
+	if crypto.Keccak256Hash(data) != block.Hash {
+		return nil, fmt.Errorf("%w: header #%d", errRemoteMismatch, block.Number)
+	}
+	header := new(types.Header)
+	if err := rlp.DecodeBytes(data, header); err != nil {
+		return nil, err
+	}
+	v.remote.Cache(ChainFreezerHeaderTable, block.Number, data)
+	return header, nil
+}
+
+// parent verifies the parent of a verified block.
+func (v *remoteVerifier) parent(ctx context.Context, block *remoteVerifiedBlock) (*remoteVerifiedBlock, error) {
+	if block.Number == 0 {
+		return nil, errors.New("genesis has no parent")
+	}
+	header, err := v.header(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+	if header.Difficulty.Cmp(block.TD) > 0 {
+		return nil, fmt.Errorf("%w: difficulty of #%d above its total difficulty", errRemoteMismatch, block.Number)
+	}
+	return &remoteVerifiedBlock{
+		Number: block.Number - 1,
+		Hash:   header.ParentHash,
+		TD:     new(big.Int).Sub(block.TD, header.Difficulty),
+	}, nil
+}
+
+// fetch returns a remote item, cached or not. It's not verified.
+func (v *remoteVerifier) fetch(ctx context.Context, kind string, number uint64) ([]byte, error) {
+	if item, ok := v.remote.Cached(kind, number); ok {
+		return item, nil
+	}
+	return v.remote.Fetch(ctx, kind, number)
+}
+
+// extend verifies the blocks down to the given number, persisting them in the
+// index a batch at a time. The batches verified are kept if it fails midway.
+func (v *remoteVerifier) extend(ctx context.Context, number uint64) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for {
+		lowest, ok := v.verified()
+		if !ok || lowest <= number {
+			return nil
+		}
+		var (
+			batch []*remoteVerifiedBlock
+			block = v.lowest
+		)
+		for len(batch) < remoteVerifyBatch && block.Number > number {
+			fetchCtx, cancel := v.remote.FetchContext(ctx)
+			parent, err := v.parent(fetchCtx, block)
+			cancel()
+			if err != nil {
+				if len(batch) > 0 {
+					if err := v.append(batch); err != nil {
+						return err
+					}
+				}
+				return err
+			}
+			batch = append(batch, parent)
+			block = parent
+		}
+		if err := v.append(batch); err != nil {
+			return err
+		}
+	}
+}
+
+// verify checks a remote item of a block below the local tail.
+func (v *remoteVerifier) verify(ctx context.Context, kind string, number uint64, item []byte) error {
+	block, err := v.block(ctx, number)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case ChainFreezerHashTable:
+		if !bytes.Equal(item, block.Hash[:]) {
+			return fmt.Errorf("%w: hash #%d", errRemoteMismatch, number)
+		}
+	case ChainFreezerHeaderTable:
+		if crypto.Keccak256Hash(item) != block.Hash {
+			return fmt.Errorf("%w: header #%d", errRemoteMismatch, number)
+		}
+	case ChainFreezerDifficultyTable:
+		td := new(big.Int)
+		if err := rlp.DecodeBytes(item, td); err != nil || td.Cmp(block.TD) != 0 {
+			return fmt.Errorf("%w: total difficulty #%d", errRemoteMismatch, number)
+		}
+	case ChainFreezerBodiesTable:
+		header, err := v.header(ctx, block)
+		if err != nil {
+			return err
+		}
+		return v.verifyBody(header, item)
+	case ChainFreezerReceiptTable:
+		header, err := v.header(ctx, block)
+		if err != nil {
+			return err
+		}
+		bodyRLP, err := v.fetch(ctx, ChainFreezerBodiesTable, number)
+		if err != nil {
+			return err
+		}
+		if err := v.verifyBody(header, bodyRLP); err != nil {
+			return err
+		}
+		return v.verifyReceipts(header, bodyRLP, item)
+	default:
+		return fmt.Errorf("unknown ancient kind %q", kind)
+	}
+	return nil
+}
+
+// verifyBody checks a block body against the roots of its header.
+func (v *remoteVerifier) verifyBody(header *types.Header, item []byte) error {
+	if v.hasher == nil {
+		return errors.New("no hasher to verify remote bodies with")
+	}
+	body := new(types.Body)
+	if err := rlp.DecodeBytes(item, body); err != nil {
+		return err
+	}
+	if types.DeriveSha(types.Transactions(body.Transactions), v.hasher()) != header.TxHash {
+		return fmt.Errorf("%w: transactions #%d", errRemoteMismatch, header.Number)
+	}
+	if types.CalcUncleHash(body.Uncles) != header.UncleHash {
+		return fmt.Errorf("%w: uncles #%d", errRemoteMismatch, header.Number)
+	}
+	if header.WithdrawalsHash == nil {
+		if body.Withdrawals != nil {
+			return fmt.Errorf("%w: withdrawals #%d", errRemoteMismatch, header.Number)
+		}
+	} else if types.DeriveSha(types.Withdrawals(body.Withdrawals), v.hasher()) != *header.WithdrawalsHash {
+		return fmt.Errorf("%w: withdrawals #%d", errRemoteMismatch, header.Number)
+	}
+	return nil
+}
+
+// verifyReceipts checks the receipts of a block against the root of its header,
+// the body being verified already.
+func (v *remoteVerifier) verifyReceipts(header *types.Header, bodyRLP []byte, item []byte) error {
+	data, err := decodeStoredReceipts(v.kvdb, item)
+	if err != nil {
+		return err
+	}
+	var stored []*types.ReceiptForStorage
+	if err := rlp.DecodeBytes(data, &stored); err != nil {
+		return err
+	}
+	body := new(types.Body)
+	if err := rlp.DecodeBytes(bodyRLP, body); err != nil {
+		return err
+	}
+	if len(stored) != len(body.Transactions) {
+		return fmt.Errorf("%w: receipt count #%d", errRemoteMismatch, header.Number)
+	}
+	receipts := make(types.Receipts, len(stored))
+	for i, receipt := range stored {
+		receipts[i] = (*types.Receipt)(receipt)
+		receipts[i].Type = body.Transactions[i].Type()
+		receipts[i].Bloom = types.CreateBloom(types.Receipts{receipts[i]})
+	}
+	if types.DeriveSha(receipts, v.hasher()) != header.ReceiptHash {
+		return fmt.Errorf("%w: receipts #%d", errRemoteMismatch, header.Number)
+	}
+	return nil
+}
+
+func (v *remoteVerifier) close() error {
+	return v.index.Close()
+}
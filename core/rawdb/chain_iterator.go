@@ -178,7 +178,10 @@ func iterateTransactions(db ethdb.Database, from uint64, to uint64, reverse bool
 //
 // There is a passed channel, the whole procedure will be interrupted if any
 // signal received.
-func indexTransactions(db ethdb.Database, from uint64, to uint64, interrupt chan struct{}, hook func(uint64) bool) {
+//
+// If tail is false the tx index tail flag is left as is, for indexing ranges
+// below the tail.
+func indexTransactions(db ethdb.Database, from uint64, to uint64, interrupt chan struct{}, hook func(uint64) bool, tail bool) {
 	// short circuit for invalid range
 	if from >= to {
 		return
@@ -218,7 +221,9 @@ func indexTransactions(db ethdb.Database, from uint64, to uint64, interrupt chan
 			txs += len(delivery.hashes)
 			// If enough data was accumulated in memory or we're at the last block, dump to disk
 			if batch.ValueSize() > ethdb.IdealBatchSize {
-				WriteTxIndexTail(batch, lastNum) // Also write the tail here
+				if tail {
+					WriteTxIndexTail(batch, lastNum) // Also write the tail here
+				}
 				if err := batch.Write(); err != nil {
 					log.Crit("Failed writing batch to db", "error", err)
 					return
@@ -235,7 +240,9 @@ func indexTransactions(db ethdb.Database, from uint64, to uint64, interrupt chan
 	// Flush the new indexing tail and the last committed data. It can also happen
 	// that the last batch is empty because nothing to index, but the tail has to
 	// be flushed anyway.
-	WriteTxIndexTail(batch, lastNum)
+	if tail {
+		WriteTxIndexTail(batch, lastNum)
+	}
 	if err := batch.Write(); err != nil {
 		log.Crit("Failed writing batch to db", "error", err)
 		return
@@ -258,12 +265,21 @@ func indexTransactions(db ethdb.Database, from uint64, to uint64, interrupt chan
 // There is a passed channel, the whole procedure will be interrupted if any
 // signal received.
 func IndexTransactions(db ethdb.Database, from uint64, to uint64, interrupt chan struct{}) {
-	indexTransactions(db, from, to, interrupt, nil)
+	indexTransactions(db, from, to, interrupt, nil, true)
+}
+
+// IndexTransactionsRange creates txlookup indices of the specified block range
+// like IndexTransactions, without moving the tx index tail flag, for backfilling
+// ranges below the tail. The hook, if set, is called with the number of each
+// block before it's indexed, in reverse order, and stops the indexing if it
+// returns false.
+func IndexTransactionsRange(db ethdb.Database, from uint64, to uint64, interrupt chan struct{}, hook func(uint64) bool) {
+	indexTransactions(db, from, to, interrupt, hook, false)
 }
 
 // indexTransactionsForTesting is the internal debug version with an additional hook.
 func indexTransactionsForTesting(db ethdb.Database, from uint64, to uint64, interrupt chan struct{}, hook func(uint64) bool) {
-	indexTransactions(db, from, to, interrupt, hook)
+	indexTransactions(db, from, to, interrupt, hook, true)
 }
 
 // unindexTransactions removes txlookup indices of the specified block range.
@@ -27,9 +27,11 @@ import (
 	"time"
 
 	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
 	"github.com/chainupcloud/arb-geth/ethdb"
 	"github.com/chainupcloud/arb-geth/ethdb/leveldb"
 	"github.com/chainupcloud/arb-geth/ethdb/memorydb"
+	"github.com/chainupcloud/arb-geth/ethdb/remoteancient"
 	"github.com/chainupcloud/arb-geth/log"
 	"github.com/olekukonko/tablewriter"
 )
@@ -66,22 +68,32 @@ func (frdb *freezerdb) Close() error {
 // a freeze cycle completes, without having to sleep for a minute to trigger the
 // automatic background run.
 func (frdb *freezerdb) Freeze(threshold uint64) error {
-	if frdb.AncientStore.(*chainFreezer).readonly {
+	freezer := frdb.chainFreezer()
+	if freezer.readonly {
 		return errReadOnly
 	}
 	// Set the freezer threshold to a temporary value
 	defer func(old uint64) {
-		frdb.AncientStore.(*chainFreezer).threshold.Store(old)
-	}(frdb.AncientStore.(*chainFreezer).threshold.Load())
-	frdb.AncientStore.(*chainFreezer).threshold.Store(threshold)
+		freezer.threshold.Store(old)
+	}(freezer.threshold.Load())
+	freezer.threshold.Store(threshold)
 
 	// Trigger a freeze cycle and block until it's done
 	trigger := make(chan struct{}, 1)
-	frdb.AncientStore.(*chainFreezer).trigger <- trigger
+	freezer.trigger <- trigger
 	<-trigger
 	return nil
 }
 
+// chainFreezer returns the local chain freezer, which the missing ancients may
+// be read through around.
+func (frdb *freezerdb) chainFreezer() *chainFreezer {
+	if remote, ok := frdb.AncientStore.(*remoteAncients); ok {
+		return remote.AncientStore.(*chainFreezer)
+	}
+	return frdb.AncientStore.(*chainFreezer)
+}
+
 // nofreezedb is a database wrapper that disables freezer data retrievals.
 type nofreezedb struct {
 	ethdb.KeyValueStore
@@ -352,6 +364,13 @@ type OpenOptions struct {
 	Cache             int    // the capacity(in megabytes) of the data caching
 	Handles           int    // number of files to be open simultaneously
 	ReadOnly          bool
+
+	// Remote source the ancients missing below the tail of the freezer are
+	// read through from, disabled if its URL is empty or the database is opened
+	// read-only, and the hasher of the transaction and receipt roots the remote
+	// items are verified against
+	RemoteAncients remoteancient.Config
+	RemoteHasher   func() types.TrieHasher
 }
 
 // openKeyValueDatabase opens a disk-based key-value database, e.g. leveldb or pebble.
@@ -412,6 +431,15 @@ func Open(o OpenOptions) (ethdb.Database, error) {
 		kvdb.Close()
 		return nil, err
 	}
+	if o.RemoteAncients.URL != "" && !o.ReadOnly {
+		fdb := frdb.(*freezerdb)
+		remote, err := newRemoteAncients(fdb.AncientStore, fdb.KeyValueStore, o.RemoteHasher, o.AncientsDirectory, o.Namespace, &o.RemoteAncients)
+		if err != nil {
+			frdb.Close()
+			return nil, err
+		}
+		fdb.AncientStore = remote
+	}
 	return frdb, nil
 }
 
@@ -468,8 +496,10 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 		txLookups       stat
 		accountSnaps    stat
 		storageSnaps    stat
+		snapReverse     stat
 		preimages       stat
 		bloomBits       stat
+		logIndex        stat
 		beaconHeaders   stat
 		cliqueSnaps     stat
 
@@ -514,18 +544,30 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 			accountSnaps.Add(size)
 		case bytes.HasPrefix(key, SnapshotStoragePrefix) && len(key) == (len(SnapshotStoragePrefix)+2*common.HashLength):
 			storageSnaps.Add(size)
+		case bytes.HasPrefix(key, snapshotReverseDiffPrefix) && len(key) == (len(snapshotReverseDiffPrefix)+common.HashLength):
+			snapReverse.Add(size)
 		case bytes.HasPrefix(key, PreimagePrefix) && len(key) == (len(PreimagePrefix)+common.HashLength):
 			preimages.Add(size)
 		case bytes.HasPrefix(key, configPrefix) && len(key) == (len(configPrefix)+common.HashLength):
 			metadata.Add(size)
 		case bytes.HasPrefix(key, genesisPrefix) && len(key) == (len(genesisPrefix)+common.HashLength):
 			metadata.Add(size)
+		case bytes.HasPrefix(key, paramsPrefix) && len(key) == (len(paramsPrefix)+common.HashLength):
+			metadata.Add(size)
 		case bytes.HasPrefix(key, bloomBitsPrefix) && len(key) == (len(bloomBitsPrefix)+10+common.HashLength):
 			bloomBits.Add(size)
 		case bytes.HasPrefix(key, BloomBitsIndexPrefix):
 			bloomBits.Add(size)
+		case bytes.HasPrefix(key, LogIndexPrefix) && (len(key) == len(LogIndexPrefix)+1+common.AddressLength+8 || len(key) == len(LogIndexPrefix)+1+common.HashLength+8):
+			logIndex.Add(size)
 		case bytes.HasPrefix(key, skeletonHeaderPrefix) && len(key) == (len(skeletonHeaderPrefix)+8):
 			beaconHeaders.Add(size)
+		case bytes.HasPrefix(key, statePinPrefix):
+			metadata.Add(size)
+		case bytes.HasPrefix(key, receiptDictionaryPrefix), bytes.HasPrefix(key, receiptDictionaryHashPrefix):
+			metadata.Add(size)
+		case bytes.HasPrefix(key, SnapHealSpillTablePrefix):
+			metadata.Add(size)
 		case bytes.HasPrefix(key, CliqueSnapshotPrefix) && len(key) == 7+common.HashLength:
 			cliqueSnaps.Add(size)
 		case bytes.HasPrefix(key, ChtTablePrefix) ||
@@ -541,8 +583,9 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 			for _, meta := range [][]byte{
 				databaseVersionKey, headHeaderKey, headBlockKey, headFastBlockKey, headFinalizedBlockKey,
 				lastPivotKey, fastTrieProgressKey, snapshotDisabledKey, SnapshotRootKey, snapshotJournalKey,
-				snapshotGeneratorKey, snapshotRecoveryKey, txIndexTailKey, fastTxLookupLimitKey,
+				snapshotGeneratorKey, snapshotRecoveryKey, snapshotSpillKey, txIndexTailKey, txIndexRangesKey, fastTxLookupLimitKey, sideChainPruneTailKey,
 				uncleanShutdownKey, badBlockKey, transitionStatusKey, skeletonSyncStatusKey,
+				l1FinalizedHeadKey, l1SafeHeadKey, logIndexProgressKey, receiptFormatKey, receiptMigrationKey,
 			} {
 				if bytes.Equal(key, meta) {
 					metadata.Add(size)
@@ -570,11 +613,13 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 		{"Key-Value store", "Block hash->number", hashNumPairings.Size(), hashNumPairings.Count()},
 		{"Key-Value store", "Transaction index", txLookups.Size(), txLookups.Count()},
 		{"Key-Value store", "Bloombit index", bloomBits.Size(), bloomBits.Count()},
+		{"Key-Value store", "Log index", logIndex.Size(), logIndex.Count()},
 		{"Key-Value store", "Contract codes", codes.Size(), codes.Count()},
 		{"Key-Value store", "Trie nodes", tries.Size(), tries.Count()},
 		{"Key-Value store", "Trie preimages", preimages.Size(), preimages.Count()},
 		{"Key-Value store", "Account snapshot", accountSnaps.Size(), accountSnaps.Count()},
 		{"Key-Value store", "Storage snapshot", storageSnaps.Size(), storageSnaps.Count()},
+		{"Key-Value store", "Snapshot reverse diffs", snapReverse.Size(), snapReverse.Count()},
 		{"Key-Value store", "Beacon sync headers", beaconHeaders.Size(), beaconHeaders.Count()},
 		{"Key-Value store", "Clique snapshots", cliqueSnaps.Size(), cliqueSnaps.Count()},
 		{"Key-Value store", "Singleton metadata", metadata.Size(), metadata.Count()},
@@ -0,0 +1,74 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"errors"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// receiptCompressionLevel trades a slower compression for smaller receipts, as
+// they are written once but stored for good.
+const receiptCompressionLevel = 9
+
+// receiptCompressor compresses receipt columns with zstd, primed with the
+// dictionary trained for the chain if any. The implementation is pure Go, so
+// that the receipts can be read by any build of the node.
+type receiptCompressor struct {
+	id  uint32 // Identifier of the dictionary, 0 if none
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newReceiptCompressor(id uint32, dict []byte) (*receiptCompressor, error) {
+	var (
+		eopts = []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(receiptCompressionLevel))}
+		dopts = []zstd.DOption{zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxReceiptColumnsSize)}
+	)
+	// Raw content dictionaries leave no identifier in the frames
+	if len(dict) > 0 {
+		eopts = append(eopts, zstd.WithEncoderDictRaw(0, dict))
+		dopts = append(dopts, zstd.WithDecoderDictRaw(0, dict))
+	}
+	enc, err := zstd.NewWriter(nil, eopts...)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil, dopts...)
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+	return &receiptCompressor{id: id, enc: enc, dec: dec}, nil
+}
+
+func (c *receiptCompressor) compress(data []byte) ([]byte, error) {
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+// decompress inflates data back to its size, which is known beforehand.
+func (c *receiptCompressor) decompress(data []byte, size int) ([]byte, error) {
+	out, err := c.dec.DecodeAll(data, make([]byte, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != size {
+		return nil, errors.New("receipt columns size mismatch")
+	}
+	return out, nil
+}
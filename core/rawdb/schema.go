@@ -43,6 +43,26 @@ var (
 	// headFinalizedBlockKey tracks the latest known finalized block hash.
 	headFinalizedBlockKey = []byte("LastFinalized")
 
+	// l1FinalizedHeadKey and l1SafeHeadKey track the finalized and safe blocks
+	// along with the L1 block confirming them.
+	l1FinalizedHeadKey = []byte("LastL1Finalized")
+	l1SafeHeadKey      = []byte("LastL1Safe")
+
+	// logIndexProgressKey tracks the range of blocks covered by the log index.
+	logIndexProgressKey = []byte("LogIndexProgress")
+
+	// codeIndexProgressKey tracks the backfill of the code hash index.
+	codeIndexProgressKey = []byte("CodeIndexProgress")
+
+	// transferIndexTailKey tracks the oldest block whose token transfers are indexed.
+	transferIndexTailKey = []byte("TransferIndexTail")
+
+	// receiptFormatKey tracks the format new receipts are written in.
+	receiptFormatKey = []byte("ReceiptFormat")
+
+	// receiptMigrationKey tracks the conversion of the stored receipts to another format.
+	receiptMigrationKey = []byte("ReceiptMigration")
+
 	// lastPivotKey tracks the last pivot block used by fast sync (to reenable on sethead).
 	lastPivotKey = []byte("LastPivot")
 
@@ -67,12 +87,22 @@ var (
 	// snapshotSyncStatusKey tracks the snapshot sync status across restarts.
 	snapshotSyncStatusKey = []byte("SnapshotSyncStatus")
 
+	// snapshotSpillKey tracks the diff layers spilled to disk as reverse diffs.
+	snapshotSpillKey = []byte("SnapshotSpill")
+
 	// skeletonSyncStatusKey tracks the skeleton sync status across restarts.
 	skeletonSyncStatusKey = []byte("SkeletonSyncStatus")
 
 	// txIndexTailKey tracks the oldest block whose transactions have been indexed.
 	txIndexTailKey = []byte("TransactionIndexTail")
 
+	// txIndexRangesKey tracks the block ranges below the tail whose transactions
+	// have been indexed.
+	txIndexRangesKey = []byte("TransactionIndexRanges")
+
+	// sideChainPruneTailKey tracks the block below which non-canonical blocks have been pruned.
+	sideChainPruneTailKey = []byte("SideChainPruneTail")
+
 	// fastTxLookupLimitKey tracks the transaction lookup limit during fast sync.
 	fastTxLookupLimitKey = []byte("FastTransactionLookupLimit")
 
@@ -100,6 +130,10 @@ var (
 	SnapshotStoragePrefix = []byte("o") // SnapshotStoragePrefix + account hash + storage hash -> storage trie value
 	CodePrefix            = []byte("c") // CodePrefix + code hash -> account code
 	skeletonHeaderPrefix  = []byte("S") // skeletonHeaderPrefix + num (uint64 big endian) -> header
+	LogIndexPrefix        = []byte("X") // LogIndexPrefix + field + address/topic + chunk (uint64 big endian) -> block bitmap
+	CodeIndexPrefix       = []byte("K") // CodeIndexPrefix + code hash + account hash -> code index entry
+	TransferIndexPrefix   = []byte("W") // TransferIndexPrefix + holder + token + num (uint64 big endian) + hash + log index (uint32 big endian) + item (uint32 big endian) -> token transfer
+	transferBlockPrefix   = []byte("w") // transferBlockPrefix + num (uint64 big endian) + hash -> keys of the token transfers of the block
 
 	// Path-based storage scheme of merkle patricia trie.
 	trieNodeAccountPrefix = []byte("A") // trieNodeAccountPrefix + hexPath -> trie node
@@ -107,6 +141,7 @@ var (
 
 	PreimagePrefix = []byte("secure-key-")       // PreimagePrefix + hash -> preimage
 	configPrefix   = []byte("ethereum-config-")  // config prefix for the db
+	paramsPrefix   = []byte("arbitrum-params-")  // paramsPrefix + genesis hash -> scheduled chain parameter updates
 	genesisPrefix  = []byte("ethereum-genesis-") // genesis state prefix for the db
 
 	// BloomBitsIndexPrefix is the data table of a chain indexer to track its progress
@@ -120,8 +155,17 @@ var (
 	BloomTrieTablePrefix = []byte("blt-")
 	BloomTrieIndexPrefix = []byte("bltIndex-")
 
+	SnapHealSpillTablePrefix = []byte("snapHealSpill-") // Scratch table of the state healed by snap sync but not yet committed
+
 	CliqueSnapshotPrefix = []byte("clique-")
 
+	statePinPrefix = []byte("state-pin-") // statePinPrefix + label -> pinned state
+
+	snapshotReverseDiffPrefix = []byte("SnapshotReverseDiff-") // snapshotReverseDiffPrefix + state root -> snapshot reverse diff
+
+	receiptDictionaryPrefix     = []byte("ReceiptDictionary-")     // receiptDictionaryPrefix + id (uint32 big endian) -> zstd dictionary
+	receiptDictionaryHashPrefix = []byte("ReceiptDictionaryHash-") // receiptDictionaryHashPrefix + id (uint32 big endian) -> dictionary content hash
+
 	preimageCounter    = metrics.NewRegisteredCounter("db/preimage/total", nil)
 	preimageHitCounter = metrics.NewRegisteredCounter("db/preimage/hits", nil)
 )
@@ -176,6 +220,16 @@ func blockReceiptsKey(number uint64, hash common.Hash) []byte {
 	return append(append(blockReceiptsPrefix, encodeBlockNumber(number)...), hash.Bytes()...)
 }
 
+// receiptDictionaryKey = receiptDictionaryPrefix + id (uint32 big endian)
+func receiptDictionaryKey(id uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{}, receiptDictionaryPrefix...), id)
+}
+
+// receiptDictionaryHashKey = receiptDictionaryHashPrefix + id (uint32 big endian)
+func receiptDictionaryHashKey(id uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{}, receiptDictionaryHashPrefix...), id)
+}
+
 // txLookupKey = txLookupPrefix + hash
 func txLookupKey(hash common.Hash) []byte {
 	return append(txLookupPrefix, hash.Bytes()...)
@@ -191,6 +245,11 @@ func storageSnapshotKey(accountHash, storageHash common.Hash) []byte {
 	return append(append(SnapshotStoragePrefix, accountHash.Bytes()...), storageHash.Bytes()...)
 }
 
+// snapshotReverseDiffKey = snapshotReverseDiffPrefix + state root
+func snapshotReverseDiffKey(root common.Hash) []byte {
+	return append(snapshotReverseDiffPrefix, root.Bytes()...)
+}
+
 // storageSnapshotsKey = SnapshotStoragePrefix + account hash + storage hash
 func storageSnapshotsKey(accountHash common.Hash) []byte {
 	return append(SnapshotStoragePrefix, accountHash.Bytes()...)
@@ -206,6 +265,43 @@ func bloomBitsKey(bit uint, section uint64, hash common.Hash) []byte {
 	return key
 }
 
+// logIndexKey = LogIndexPrefix + field + address/topic + chunk (uint64 big endian)
+func logIndexKey(field byte, value []byte, chunk uint64) []byte {
+	key := make([]byte, 0, len(LogIndexPrefix)+1+len(value)+8)
+	key = append(append(append(key, LogIndexPrefix...), field), value...)
+	return append(key, encodeBlockNumber(chunk)...)
+}
+
+// codeIndexKey = CodeIndexPrefix + code hash + account hash
+func codeIndexKey(codeHash common.Hash, accountHash common.Hash) []byte {
+	key := make([]byte, 0, len(CodeIndexPrefix)+2*common.HashLength)
+	key = append(key, CodeIndexPrefix...)
+	key = append(key, codeHash.Bytes()...)
+	return append(key, accountHash.Bytes()...)
+}
+
+// transferIndexKey = TransferIndexPrefix + holder + token + num (uint64 big endian) + hash + log index (uint32 big endian) + item (uint32 big endian)
+func transferIndexKey(holder, token common.Address, number uint64, hash common.Hash, logIndex, item uint32) []byte {
+	key := make([]byte, 0, transferIndexKeyLength)
+	key = append(key, TransferIndexPrefix...)
+	key = append(key, holder.Bytes()...)
+	key = append(key, token.Bytes()...)
+	key = append(key, encodeBlockNumber(number)...)
+	key = append(key, hash.Bytes()...)
+	key = binary.BigEndian.AppendUint32(key, logIndex)
+	return binary.BigEndian.AppendUint32(key, item)
+}
+
+// transferBlockKey = transferBlockPrefix + num (uint64 big endian) + hash
+func transferBlockKey(number uint64, hash common.Hash) []byte {
+	return append(append(append([]byte{}, transferBlockPrefix...), encodeBlockNumber(number)...), hash.Bytes()...)
+}
+
+// statePinKey = statePinPrefix + label
+func statePinKey(label string) []byte {
+	return append(append([]byte{}, statePinPrefix...), label...)
+}
+
 // skeletonHeaderKey = skeletonHeaderPrefix + num (uint64 big endian)
 func skeletonHeaderKey(number uint64) []byte {
 	return append(skeletonHeaderPrefix, encodeBlockNumber(number)...)
@@ -235,6 +331,11 @@ func configKey(hash common.Hash) []byte {
 	return append(configPrefix, hash.Bytes()...)
 }
 
+// chainParamsUpdatesKey = paramsPrefix + hash
+func chainParamsUpdatesKey(hash common.Hash) []byte {
+	return append(paramsPrefix, hash.Bytes()...)
+}
+
 // genesisStateSpecKey = genesisPrefix + hash
 func genesisStateSpecKey(hash common.Hash) []byte {
 	return append(genesisPrefix, hash.Bytes()...)
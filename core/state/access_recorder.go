@@ -0,0 +1,240 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+)
+
+// TxAccessList is the state accessed by a single transaction, as recorded by
+// StartAccessRecording. The state written by a transaction is usually read by
+// it too, so that the writes mostly show up among the reads as well.
+type TxAccessList struct {
+	TxHash  common.Hash
+	TxIndex int
+	Reads   types.AccessList // Accounts and storage slots read, sorted
+	Writes  types.AccessList // Accounts and storage slots modified and not reverted, sorted
+
+	// Accounts among the reads only credited or debited, whose balance the
+	// transaction didn't depend on, sorted
+	BalanceDeltas []common.Address
+}
+
+// AccessRecordingCallback receives the access list of every transaction.
+type AccessRecordingCallback func(list *TxAccessList)
+
+// accessSet is a set of accounts with the storage slots accessed in each.
+type accessSet map[common.Address]map[common.Hash]struct{}
+
+func (set accessSet) addAccount(addr common.Address) map[common.Hash]struct{} {
+	slots, ok := set[addr]
+	if !ok {
+		slots = make(map[common.Hash]struct{})
+		set[addr] = slots
+	}
+	return slots
+}
+
+func (set accessSet) addSlot(addr common.Address, slot common.Hash) {
+	set.addAccount(addr)[slot] = struct{}{}
+}
+
+// accessList converts the set into an access list sorted by address and slot.
+func (set accessSet) accessList() types.AccessList {
+	list := make(types.AccessList, 0, len(set))
+	for addr, slots := range set {
+		tuple := types.AccessTuple{Address: addr, StorageKeys: make([]common.Hash, 0, len(slots))}
+		for slot := range slots {
+			tuple.StorageKeys = append(tuple.StorageKeys, slot)
+		}
+		sort.Slice(tuple.StorageKeys, func(i, j int) bool {
+			return bytes.Compare(tuple.StorageKeys[i][:], tuple.StorageKeys[j][:]) < 0
+		})
+		list = append(list, tuple)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return bytes.Compare(list[i].Address[:], list[j].Address[:]) < 0
+	})
+	return list
+}
+
+// accessRecorder accumulates the state accessed by the current transaction.
+type accessRecorder struct {
+	callback AccessRecordingCallback
+	started  bool // Whether anything was recorded for the current transaction
+	thash    common.Hash
+	txIndex  int
+	reads    accessSet
+	writes   accessSet
+
+	balanceChange bool                        // Whether a balance is being credited or debited
+	reverting     bool                        // Whether changes are being reverted, the accounts being already recorded
+	credited      map[common.Address]struct{} // Accounts read while crediting or debiting them
+	direct        map[common.Address]struct{} // Accounts read otherwise
+}
+
+func newAccessRecorder(callback AccessRecordingCallback) *accessRecorder {
+	return &accessRecorder{
+		callback: callback,
+		reads:    make(accessSet),
+		writes:   make(accessSet),
+		credited: make(map[common.Address]struct{}),
+		direct:   make(map[common.Address]struct{}),
+	}
+}
+
+// flush hands the accesses of the current transaction to the callback, if any.
+func (r *accessRecorder) flush() {
+	if !r.started {
+		return
+	}
+	deltas := make([]common.Address, 0, len(r.credited))
+	for addr := range r.credited {
+		if _, ok := r.direct[addr]; !ok {
+			deltas = append(deltas, addr)
+		}
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		return bytes.Compare(deltas[i][:], deltas[j][:]) < 0
+	})
+	r.callback(&TxAccessList{
+		TxHash:        r.thash,
+		TxIndex:       r.txIndex,
+		Reads:         r.reads.accessList(),
+		Writes:        r.writes.accessList(),
+		BalanceDeltas: deltas,
+	})
+	r.started = false
+	r.reads = make(accessSet)
+	r.writes = make(accessSet)
+	r.credited = make(map[common.Address]struct{})
+	r.direct = make(map[common.Address]struct{})
+}
+
+// StartAccessRecording makes the state record the accounts and storage slots
+// each transaction reads and writes, handing them to the callback once the
+// next transaction starts, or when recording stops. Writes are known once the
+// transaction is finalised, as reverted changes don't count.
+func (s *StateDB) StartAccessRecording(callback AccessRecordingCallback) {
+	s.StopAccessRecording()
+	s.accessRecorder = newAccessRecorder(callback)
+}
+
+// StopAccessRecording hands the accesses of the last transaction to the
+// callback, and stops recording.
+func (s *StateDB) StopAccessRecording() {
+	if s.accessRecorder == nil {
+		return
+	}
+	s.recordJournalWrites()
+	s.accessRecorder.flush()
+	s.accessRecorder = nil
+}
+
+// RecordingAccesses returns whether the state records the accesses of the
+// transactions.
+func (s *StateDB) RecordingAccesses() bool {
+	return s.accessRecorder != nil
+}
+
+// recorder returns the access recorder of the current transaction, or nil if
+// recording isn't enabled.
+func (s *StateDB) recorder() *accessRecorder {
+	r := s.accessRecorder
+	if r == nil {
+		return nil
+	}
+	if r.started && (r.thash != s.thash || r.txIndex != s.txIndex) {
+		r.flush()
+	}
+	if !r.started {
+		r.started, r.thash, r.txIndex = true, s.thash, s.txIndex
+	}
+	return r
+}
+
+// recordAccountRead records a read of the account if enabled.
+func (s *StateDB) recordAccountRead(addr common.Address) {
+	if r := s.recorder(); r != nil && !r.reverting {
+		r.reads.addAccount(addr)
+		if r.balanceChange {
+			r.credited[addr] = struct{}{}
+		} else {
+			r.direct[addr] = struct{}{}
+		}
+	}
+}
+
+// recordBalanceChange marks the accounts read until done is called as read
+// only to credit or debit them, if enabled.
+func (s *StateDB) recordBalanceChange() (done func()) {
+	r := s.accessRecorder
+	if r == nil {
+		return func() {}
+	}
+	r.balanceChange = true
+	return func() { r.balanceChange = false }
+}
+
+// recordRevert suspends recording the account reads until done is called, as
+// reverting changes reads the accounts changed, which were recorded already.
+func (s *StateDB) recordRevert() (done func()) {
+	r := s.accessRecorder
+	if r == nil {
+		return func() {}
+	}
+	r.reverting = true
+	return func() { r.reverting = false }
+}
+
+// recordSlotRead records a read of the storage slot if enabled.
+func (s *StateDB) recordSlotRead(addr common.Address, slot common.Hash) {
+	if r := s.recorder(); r != nil {
+		r.reads.addSlot(addr, slot)
+	}
+}
+
+// recordAccountWrite records a write of the account if enabled.
+func (s *StateDB) recordAccountWrite(addr common.Address) {
+	if r := s.recorder(); r != nil {
+		r.writes.addAccount(addr)
+	}
+}
+
+// recordJournalWrites records the state modified by the changes in the journal
+// if enabled, which only holds the changes of the current transaction that
+// weren't reverted.
+func (s *StateDB) recordJournalWrites() {
+	if s.accessRecorder == nil || len(s.journal.entries) == 0 {
+		return
+	}
+	r := s.recorder()
+	for _, entry := range s.journal.entries {
+		switch entry := entry.(type) {
+		case storageChange:
+			r.writes.addSlot(*entry.account, entry.key)
+		case resetObjectChange:
+			r.writes.addAccount(entry.prev.address)
+		case createObjectChange, suicideChange, balanceChange, nonceChange, codeChange:
+			r.writes.addAccount(*entry.dirtied())
+		}
+	}
+}
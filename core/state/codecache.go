@@ -0,0 +1,217 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/metrics"
+)
+
+var (
+	codeCacheHitMeter             = metrics.NewRegisteredMeter("state/codecache/hit", nil)
+	codeCacheMissMeter            = metrics.NewRegisteredMeter("state/codecache/miss", nil)
+	codeCacheEvictMeter           = metrics.NewRegisteredMeter("state/codecache/evict", nil)
+	codeCacheRejectSizeMeter      = metrics.NewRegisteredMeter("state/codecache/reject/size", nil)
+	codeCacheRejectFrequencyMeter = metrics.NewRegisteredMeter("state/codecache/reject/frequency", nil)
+)
+
+const (
+	// codeCacheAvgCodeSize is the code size the frequency sketch is sized with,
+	// one counter per expected code in each of its rows.
+	codeCacheAvgCodeSize = 4 * 1024
+
+	// codeCacheMaxFrequency is where the sketch counters saturate.
+	codeCacheMaxFrequency = 15
+)
+
+// CodeCacheConfig sizes the contract code cache and sets its admission policy.
+type CodeCacheConfig struct {
+	Size        uint64 // Bytes of code cached
+	MaxCodeSize uint64 // Largest code cached, in bytes (0 = no limit)
+	NoAdmission bool   // Admit every code read, evicting the least recently used ones
+}
+
+// DefaultCodeCacheConfig is the code cache used unless configured otherwise.
+var DefaultCodeCacheConfig = CodeCacheConfig{
+	Size: codeCacheSize,
+}
+
+// codeCacheEntry is a code held by the cache.
+type codeCacheEntry struct {
+	hash common.Hash
+	code []byte
+}
+
+// CodeCache is a contract code cache whose capacity is in bytes. Rather than
+// admitting every code read, evicting the least recently used codes to make
+// room, a code read while the cache is full is only admitted if it's looked up
+// more often than all the codes it'd evict together. How often codes are looked
+// up is estimated by a count-min sketch aging over time, so that a large code
+// read once doesn't flush many small hot ones, as happens with the long tail of
+// large contracts.
+type CodeCache struct {
+	config CodeCacheConfig
+
+	lock    sync.Mutex
+	size    uint64
+	entries map[common.Hash]*list.Element
+	recency *list.List // Most recently used in front
+	sketch  *frequencySketch
+}
+
+// NewCodeCache creates a code cache.
+func NewCodeCache(config CodeCacheConfig) *CodeCache {
+	return &CodeCache{
+		config:  config,
+		entries: make(map[common.Hash]*list.Element),
+		recency: list.New(),
+		sketch:  newFrequencySketch(int(config.Size / codeCacheAvgCodeSize)),
+	}
+}
+
+// Get looks up a code, counting the lookup towards its admission.
+func (c *CodeCache) Get(hash common.Hash) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.sketch.increment(hash)
+	elem, ok := c.entries[hash]
+	if !ok {
+		codeCacheMissMeter.Mark(1)
+		return nil, false
+	}
+	codeCacheHitMeter.Mark(1)
+	c.recency.MoveToFront(elem)
+	return elem.Value.(*codeCacheEntry).code, true
+}
+
+// Add caches a code unless it's too large or, with the cache full, not looked
+// up often enough to displace the codes it'd evict. Codes are expected to be
+// content-addressed and not modified afterwards. Returns whether it's cached.
+func (c *CodeCache) Add(hash common.Hash, code []byte) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[hash]; ok {
+		c.recency.MoveToFront(elem)
+		return true
+	}
+	size := uint64(len(code))
+	if size > c.config.Size || (c.config.MaxCodeSize > 0 && size > c.config.MaxCodeSize) {
+		codeCacheRejectSizeMeter.Mark(1)
+		return false
+	}
+	// Find the codes to evict for the new one, and weigh them against it
+	var (
+		victims   []*list.Element
+		freed     uint64
+		frequency int
+	)
+	for elem := c.recency.Back(); elem != nil && c.size-freed+size > c.config.Size; elem = elem.Prev() {
+		victim := elem.Value.(*codeCacheEntry)
+		victims = append(victims, elem)
+		freed += uint64(len(victim.code))
+		frequency += c.sketch.estimate(victim.hash)
+	}
+	if len(victims) > 0 && !c.config.NoAdmission && c.sketch.estimate(hash) <= frequency {
+		codeCacheRejectFrequencyMeter.Mark(1)
+		return false
+	}
+	for _, elem := range victims {
+		delete(c.entries, elem.Value.(*codeCacheEntry).hash)
+		c.recency.Remove(elem)
+	}
+	codeCacheEvictMeter.Mark(int64(len(victims)))
+	c.size = c.size - freed + size
+	c.entries[hash] = c.recency.PushFront(&codeCacheEntry{hash: hash, code: code})
+	return true
+}
+
+// Len returns the number of codes cached.
+func (c *CodeCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+// Size returns the number of bytes of code cached.
+func (c *CodeCache) Size() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.size
+}
+
+// frequencySketch is a count-min sketch estimating how often codes are looked
+// up. Its counters are halved once it counted ten times as many lookups as it
+// has counters in a row, so that codes popular long ago age out.
+type frequencySketch struct {
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newFrequencySketch(width int) *frequencySketch {
+	size := 1024
+	for size < width {
+		size <<= 1
+	}
+	sketch := &frequencySketch{
+		mask:    uint64(size - 1),
+		resetAt: 10 * size,
+	}
+	for i := range sketch.rows {
+		sketch.rows[i] = make([]uint8, size)
+	}
+	return sketch
+}
+
+// index returns the counter of the code hash in a row. Code hashes are uniformly
+// distributed already, each row uses a different part of the hash.
+func (s *frequencySketch) index(hash common.Hash, row int) uint64 {
+	return binary.BigEndian.Uint64(hash[row*8:]) & s.mask
+}
+
+func (s *frequencySketch) increment(hash common.Hash) {
+	for i := range s.rows {
+		if idx := s.index(hash, i); s.rows[i][idx] < codeCacheMaxFrequency {
+			s.rows[i][idx]++
+		}
+	}
+	if s.additions++; s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *frequencySketch) estimate(hash common.Hash) int {
+	frequency := codeCacheMaxFrequency
+	for i := range s.rows {
+		if count := int(s.rows[i][s.index(hash, i)]); count < frequency {
+			frequency = count
+		}
+	}
+	return frequency
+}
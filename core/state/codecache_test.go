@@ -0,0 +1,107 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/crypto"
+)
+
+// Tests that a code read once isn't admitted over the hot codes it'd evict,
+// while a code read often enough is, and that oversized codes are never cached.
+func TestCodeCacheAdmission(t *testing.T) {
+	cache := NewCodeCache(CodeCacheConfig{Size: 1000, MaxCodeSize: 600})
+
+	// Fill the cache with hot codes, read a few times each
+	var hot [][]byte
+	for i := 0; i < 10; i++ {
+		code := make([]byte, 100)
+		code[0] = byte(i)
+		hash := crypto.Keccak256Hash(code)
+		for j := 0; j < 3; j++ {
+			cache.Get(hash)
+		}
+		if !cache.Add(hash, code) {
+			t.Fatalf("code %d rejected while the cache had room", i)
+		}
+		hot = append(hot, code)
+	}
+	if cache.Size() != 1000 || cache.Len() != 10 {
+		t.Fatalf("wrong cache size: have %d bytes in %d codes, want 1000 in 10", cache.Size(), cache.Len())
+	}
+	// A large code read once would flush half of them, it's rejected
+	large := make([]byte, 500)
+	largeHash := crypto.Keccak256Hash(large)
+	if _, ok := cache.Get(largeHash); ok {
+		t.Fatal("large code cached before being added")
+	}
+	if cache.Add(largeHash, large) {
+		t.Fatal("code read once admitted over hot codes")
+	}
+	// A small code read more often than the code it evicts is admitted
+	small := make([]byte, 100)
+	small[1] = 1
+	smallHash := crypto.Keccak256Hash(small)
+	for j := 0; j < 5; j++ {
+		cache.Get(smallHash)
+	}
+	if !cache.Add(smallHash, small) {
+		t.Fatal("hot code rejected")
+	}
+	if _, ok := cache.Get(crypto.Keccak256Hash(hot[0])); ok {
+		t.Error("least recently used code not evicted")
+	}
+	if _, ok := cache.Get(crypto.Keccak256Hash(hot[1])); !ok {
+		t.Error("more codes evicted than needed")
+	}
+	// Codes above the size limit are never cached
+	huge := make([]byte, 700)
+	hugeHash := crypto.Keccak256Hash(huge)
+	for j := 0; j < 20; j++ {
+		cache.Get(hugeHash)
+	}
+	if cache.Add(hugeHash, huge) {
+		t.Fatal("code above the size limit admitted")
+	}
+	if cache.Size() != 1000 {
+		t.Fatalf("wrong cache size: have %d, want 1000", cache.Size())
+	}
+}
+
+// Tests that without admission the cache evicts the least recently used codes
+// for every new one.
+func TestCodeCacheNoAdmission(t *testing.T) {
+	cache := NewCodeCache(CodeCacheConfig{Size: 300, NoAdmission: true})
+
+	codes := make([][]byte, 4)
+	for i := range codes {
+		codes[i] = make([]byte, 100)
+		codes[i][0] = byte(i)
+		if !cache.Add(crypto.Keccak256Hash(codes[i]), codes[i]) {
+			t.Fatalf("code %d rejected", i)
+		}
+	}
+	if _, ok := cache.Get(crypto.Keccak256Hash(codes[0])); ok {
+		t.Error("least recently used code not evicted")
+	}
+	for i := 1; i < len(codes); i++ {
+		if _, ok := cache.Get(crypto.Keccak256Hash(codes[i])); !ok {
+			t.Errorf("code %d evicted", i)
+		}
+	}
+}
@@ -140,7 +140,7 @@ func NewDatabaseWithConfig(db ethdb.Database, config *trie.Config) Database {
 	cdb := &cachingDB{
 		disk:          db,
 		codeSizeCache: lru.NewCache[common.Hash, int](codeSizeCacheSize),
-		codeCache:     lru.NewSizeConstrainedCache[common.Hash, []byte](codeCacheSize),
+		codeCache:     NewCodeCache(DefaultCodeCacheConfig),
 		triedb:        trie.NewDatabaseWithConfig(db, config),
 	}
 	return cdb
@@ -148,10 +148,16 @@ func NewDatabaseWithConfig(db ethdb.Database, config *trie.Config) Database {
 
 // NewDatabaseWithNodeDB creates a state database with an already initialized node database.
 func NewDatabaseWithNodeDB(db ethdb.Database, triedb *trie.Database) Database {
+	return NewDatabaseWithCodeCache(db, triedb, DefaultCodeCacheConfig)
+}
+
+// NewDatabaseWithCodeCache creates a state database with an already initialized
+// node database, caching contract code as configured.
+func NewDatabaseWithCodeCache(db ethdb.Database, triedb *trie.Database, config CodeCacheConfig) Database {
 	cdb := &cachingDB{
 		disk:          db,
 		codeSizeCache: lru.NewCache[common.Hash, int](codeSizeCacheSize),
-		codeCache:     lru.NewSizeConstrainedCache[common.Hash, []byte](codeCacheSize),
+		codeCache:     NewCodeCache(config),
 		triedb:        triedb,
 	}
 	return cdb
@@ -160,7 +166,7 @@ func NewDatabaseWithNodeDB(db ethdb.Database, triedb *trie.Database) Database {
 type cachingDB struct {
 	disk          ethdb.KeyValueStore
 	codeSizeCache *lru.Cache[common.Hash, int]
-	codeCache     *lru.SizeConstrainedCache[common.Hash, []byte]
+	codeCache     *CodeCache
 	triedb        *trie.Database
 }
 
@@ -187,6 +193,8 @@ func (db *cachingDB) CopyTrie(t Trie) Trie {
 	switch t := t.(type) {
 	case *trie.StateTrie:
 		return t.Copy()
+	case *flatTrie:
+		return t
 	default:
 		panic(fmt.Errorf("unknown trie type %T", t))
 	}
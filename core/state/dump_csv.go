@@ -0,0 +1,209 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+)
+
+const (
+	dumpProgressFile = "progress.json"
+	dumpSchemaFile   = "schema.sql"
+)
+
+// dumpTables are the tables of a CSV dump, in the order of their checkpoints.
+var dumpTables = []string{"accounts", "storage", "code"}
+
+// dumpSchema describes the columns of the CSV tables, in a form SQLite can
+// create the tables from before importing them.
+const dumpSchema = `CREATE TABLE accounts (addr_hash TEXT, address TEXT, nonce INTEGER, balance TEXT, root TEXT, code_hash TEXT);
+CREATE TABLE storage (addr_hash TEXT, slot_hash TEXT, slot TEXT, value TEXT);
+CREATE TABLE code (code_hash TEXT, size INTEGER, code TEXT);
+`
+
+// CSVDumpSink writes a parallel state dump into a directory as CSV tables, in
+// one file per table and range, without headers. Their columns are described
+// by the schema.sql file, and they load as is into SQLite or any tool building
+// columnar formats such as Parquet. The progress of the dump is saved along, so
+// that an interrupted dump can be resumed.
+type CSVDumpSink struct {
+	dir string
+}
+
+// NewCSVDumpSink creates a sink writing into the given directory, which is
+// created if needed.
+func NewCSVDumpSink(dir string) (*CSVDumpSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, dumpSchemaFile), []byte(dumpSchema), 0644); err != nil {
+		return nil, err
+	}
+	return &CSVDumpSink{dir: dir}, nil
+}
+
+// Progress returns the progress saved in the directory, or nil if none.
+func (s *CSVDumpSink) Progress() (*DumpProgress, error) {
+	blob, err := os.ReadFile(filepath.Join(s.dir, dumpProgressFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	progress := new(DumpProgress)
+	if err := json.Unmarshal(blob, progress); err != nil {
+		return nil, fmt.Errorf("invalid dump progress: %w", err)
+	}
+	return progress, nil
+}
+
+// SaveProgress implements DumpSink, replacing the progress file atomically.
+func (s *CSVDumpSink) SaveProgress(progress *DumpProgress) error {
+	blob, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, dumpProgressFile+".tmp")
+	if err := os.WriteFile(tmp, blob, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, dumpProgressFile))
+}
+
+// OpenRange implements DumpSink. The checkpoints are the sizes of the files of
+// the range, which are truncated back to them to drop the rows written after.
+func (s *CSVDumpSink) OpenRange(index int, checkpoint []byte) (DumpRangeWriter, error) {
+	var sizes []int64
+	if checkpoint != nil {
+		if err := json.Unmarshal(checkpoint, &sizes); err != nil || len(sizes) != len(dumpTables) {
+			return nil, fmt.Errorf("invalid checkpoint of range %d", index)
+		}
+	} else {
+		sizes = make([]int64, len(dumpTables))
+	}
+	w := &csvDumpRange{}
+	for i, table := range dumpTables {
+		f, err := os.OpenFile(filepath.Join(s.dir, fmt.Sprintf("%s-%04d.csv", table, index)), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.files = append(w.files, f)
+		if err := f.Truncate(sizes[i]); err != nil {
+			w.Close()
+			return nil, err
+		}
+		if _, err := f.Seek(sizes[i], io.SeekStart); err != nil {
+			w.Close()
+			return nil, err
+		}
+		buf := bufio.NewWriter(f)
+		w.bufs = append(w.bufs, buf)
+		w.tables = append(w.tables, csv.NewWriter(buf))
+	}
+	return w, nil
+}
+
+// csvDumpRange writes the rows of a single range into its CSV files.
+type csvDumpRange struct {
+	files  []*os.File
+	bufs   []*bufio.Writer
+	tables []*csv.Writer
+}
+
+func (w *csvDumpRange) WriteAccount(row *DumpAccountRow) error {
+	var address string
+	if row.Address != nil {
+		address = row.Address.Hex()
+	}
+	return w.tables[0].Write([]string{
+		row.AddrHash.Hex(),
+		address,
+		strconv.FormatUint(row.Nonce, 10),
+		row.Balance.String(),
+		row.Root.Hex(),
+		row.CodeHash.Hex(),
+	})
+}
+
+func (w *csvDumpRange) WriteStorage(row *DumpStorageRow) error {
+	var slot string
+	if row.Slot != nil {
+		slot = row.Slot.Hex()
+	}
+	return w.tables[1].Write([]string{
+		row.AddrHash.Hex(),
+		row.SlotHash.Hex(),
+		slot,
+		hexutil.Encode(row.Value),
+	})
+}
+
+func (w *csvDumpRange) WriteCode(row *DumpCodeRow) error {
+	var code string
+	if row.Code != nil {
+		code = hexutil.Encode(row.Code)
+	}
+	return w.tables[2].Write([]string{
+		row.CodeHash.Hex(),
+		strconv.Itoa(row.Size),
+		code,
+	})
+}
+
+func (w *csvDumpRange) Flush() ([]byte, error) {
+	sizes := make([]int64, len(w.files))
+	for i, f := range w.files {
+		w.tables[i].Flush()
+		if err := w.tables[i].Error(); err != nil {
+			return nil, err
+		}
+		if err := w.bufs[i].Flush(); err != nil {
+			return nil, err
+		}
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+		size, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = size
+	}
+	return json.Marshal(sizes)
+}
+
+func (w *csvDumpRange) Close() error {
+	var err error
+	for _, f := range w.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
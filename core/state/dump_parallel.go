@@ -0,0 +1,393 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+	"github.com/chainupcloud/arb-geth/trie"
+)
+
+const (
+	// DefaultDumpRanges is the default number of account hash ranges a parallel
+	// dump splits the state into.
+	DefaultDumpRanges = 256
+
+	// DefaultDumpCheckpointAccounts is the default number of accounts a range is
+	// checkpointed after.
+	DefaultDumpCheckpointAccounts = 10000
+)
+
+// errDumpProgressMismatch is returned if resuming a dump of another state.
+var errDumpProgressMismatch = errors.New("dump progress belongs to another state or range split")
+
+// ParallelDumpConfig is a set of options to control a parallel state dump.
+type ParallelDumpConfig struct {
+	Workers            int  // Number of ranges dumped concurrently
+	Ranges             int  // Number of account hash ranges the state is split into
+	SkipStorage        bool // Whether to leave out the storage slots
+	SkipCode           bool // Whether to leave out the bytecodes, keeping their hashes and sizes
+	CheckpointAccounts int  // Number of accounts of a range between checkpoints
+}
+
+// DumpAccountRow is an account of a parallel state dump.
+type DumpAccountRow struct {
+	AddrHash common.Hash
+	Address  *common.Address // Nil if the preimage is missing
+	Nonce    uint64
+	Balance  *big.Int
+	Root     common.Hash
+	CodeHash common.Hash
+}
+
+// DumpStorageRow is a storage slot of a parallel state dump.
+type DumpStorageRow struct {
+	AddrHash common.Hash
+	SlotHash common.Hash
+	Slot     *common.Hash // Nil if the preimage is missing
+	Value    []byte       // Slot value without leading zeroes
+}
+
+// DumpCodeRow is a contract code of a parallel state dump, dumped in every range
+// it's used in, and possibly again if the range is resumed.
+type DumpCodeRow struct {
+	CodeHash common.Hash
+	Size     int
+	Code     []byte // Nil if the bytecodes are skipped
+}
+
+// DumpRangeWriter receives the rows of a single range of a parallel dump, it's
+// only used by one goroutine at a time.
+type DumpRangeWriter interface {
+	WriteAccount(row *DumpAccountRow) error
+	WriteStorage(row *DumpStorageRow) error
+	WriteCode(row *DumpCodeRow) error
+
+	// Flush makes the rows written so far durable, and returns a checkpoint of
+	// them to resume the range from.
+	Flush() ([]byte, error)
+
+	Close() error
+}
+
+// DumpSink receives the rows of a parallel state dump, split in ranges.
+type DumpSink interface {
+	// OpenRange returns the writer of a range, resuming right after the rows
+	// covered by the checkpoint, which is nil if the range starts afresh.
+	OpenRange(index int, checkpoint []byte) (DumpRangeWriter, error)
+
+	// SaveProgress persists the progress of the dump, it's called only after the
+	// rows it covers were flushed. Calls are serialized.
+	SaveProgress(progress *DumpProgress) error
+}
+
+// DumpRangeProgress is the progress of a single range of a parallel dump.
+type DumpRangeProgress struct {
+	Next       hexutil.Bytes `json:"next"`                 // Account hash to resume the range from
+	Done       bool          `json:"done"`                 // Whether the range is fully dumped
+	Checkpoint hexutil.Bytes `json:"checkpoint,omitempty"` // Checkpoint of the sink covering the rows before Next
+}
+
+// DumpProgress is the progress of a parallel dump, used to resume it.
+type DumpProgress struct {
+	Root   common.Hash          `json:"root"`
+	Ranges []*DumpRangeProgress `json:"ranges"`
+}
+
+// newDumpProgress splits the account hash space into the given number of
+// ranges of equal size.
+func newDumpProgress(root common.Hash, ranges int) *DumpProgress {
+	progress := &DumpProgress{Root: root, Ranges: make([]*DumpRangeProgress, ranges)}
+	for i := range progress.Ranges {
+		progress.Ranges[i] = &DumpRangeProgress{Next: dumpRangeStart(i, ranges).Bytes()}
+	}
+	return progress
+}
+
+// dumpRangeStart returns the first account hash of the given range.
+func dumpRangeStart(index, ranges int) common.Hash {
+	if index == 0 {
+		return common.Hash{}
+	}
+	step := new(big.Int).Div(new(big.Int).Lsh(common.Big1, 256), big.NewInt(int64(ranges)))
+	return common.BigToHash(step.Mul(step, big.NewInt(int64(index))))
+}
+
+// ParallelDump dumps the state into the sink by concurrently traversing ranges
+// of the account trie, checkpointing every range regularly. Passing the last
+// saved progress resumes an interrupted dump, nil starts afresh.
+func (s *StateDB) ParallelDump(ctx context.Context, sink DumpSink, conf *ParallelDumpConfig, progress *DumpProgress) error {
+	cfg := ParallelDumpConfig{}
+	if conf != nil {
+		cfg = *conf
+	}
+	if cfg.Ranges <= 0 {
+		cfg.Ranges = DefaultDumpRanges
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.CheckpointAccounts <= 0 {
+		cfg.CheckpointAccounts = DefaultDumpCheckpointAccounts
+	}
+	root := s.trie.Hash()
+	if progress == nil {
+		progress = newDumpProgress(root, cfg.Ranges)
+	} else if progress.Root != root || len(progress.Ranges) != cfg.Ranges {
+		return errDumpProgressMismatch
+	}
+	d := &parallelDump{
+		state:    s,
+		root:     root,
+		sink:     sink,
+		conf:     &cfg,
+		progress: progress,
+		start:    time.Now(),
+	}
+	log.Info("Parallel state dump started", "root", root, "ranges", cfg.Ranges, "workers", cfg.Workers)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		tasks = make(chan int, cfg.Ranges)
+		errs  = make(chan error, cfg.Workers)
+		wg    sync.WaitGroup
+	)
+	for i, r := range progress.Ranges {
+		if !r.Done {
+			tasks <- i
+		}
+	}
+	close(tasks)
+	for w := 0; w < cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range tasks {
+				if err := d.dumpRange(ctx, index); err != nil {
+					errs <- fmt.Errorf("range %d: %w", index, err)
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Info("Parallel state dump complete", "accounts", d.accounts, "slots", d.slots,
+		"elapsed", common.PrettyDuration(time.Since(d.start)))
+	return nil
+}
+
+// parallelDump is the state shared by the workers of a parallel dump.
+type parallelDump struct {
+	state *StateDB
+	root  common.Hash
+	sink  DumpSink
+	conf  *ParallelDumpConfig
+	start time.Time
+
+	lock     sync.Mutex // Protects the fields below
+	progress *DumpProgress
+	accounts uint64
+	slots    uint64
+	logged   time.Time
+}
+
+// dumpRange dumps the remaining accounts of a single range.
+func (d *parallelDump) dumpRange(ctx context.Context, index int) error {
+	d.lock.Lock()
+	r := *d.progress.Ranges[index]
+	d.lock.Unlock()
+
+	var end []byte
+	if index+1 < len(d.progress.Ranges) {
+		end = dumpRangeStart(index+1, len(d.progress.Ranges)).Bytes()
+	}
+	w, err := d.sink.OpenRange(index, r.Checkpoint)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	// Every worker traverses its own trie, tries aren't safe for concurrent use
+	tr, err := d.state.db.OpenTrie(d.root)
+	if err != nil {
+		return err
+	}
+	var (
+		it       = trie.NewIterator(tr.NodeIterator(r.Next))
+		codes    = make(map[common.Hash]struct{})
+		accounts int
+		slots    int
+	)
+	for it.Next() {
+		if end != nil && string(it.Key) >= string(end) {
+			break
+		}
+		if accounts > 0 && accounts%d.conf.CheckpointAccounts == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := d.checkpoint(index, w, it.Key, false, accounts, slots); err != nil {
+				return err
+			}
+			accounts, slots = 0, 0
+		}
+		var data types.StateAccount
+		if err := rlp.DecodeBytes(it.Value, &data); err != nil {
+			return fmt.Errorf("invalid account %x: %w", it.Key, err)
+		}
+		row := &DumpAccountRow{
+			AddrHash: common.BytesToHash(it.Key),
+			Nonce:    data.Nonce,
+			Balance:  data.Balance,
+			Root:     data.Root,
+			CodeHash: common.BytesToHash(data.CodeHash),
+		}
+		if preimage := tr.GetKey(it.Key); preimage != nil {
+			addr := common.BytesToAddress(preimage)
+			row.Address = &addr
+		}
+		if err := w.WriteAccount(row); err != nil {
+			return err
+		}
+		accounts++
+
+		if row.CodeHash != types.EmptyCodeHash {
+			if _, ok := codes[row.CodeHash]; !ok {
+				codes[row.CodeHash] = struct{}{}
+				if err := d.dumpCode(w, row); err != nil {
+					return err
+				}
+			}
+		}
+		if !d.conf.SkipStorage && data.Root != types.EmptyRootHash {
+			n, err := d.dumpStorage(ctx, w, tr, row)
+			if err != nil {
+				return err
+			}
+			slots += n
+		}
+	}
+	if it.Err != nil {
+		return it.Err
+	}
+	return d.checkpoint(index, w, nil, true, accounts, slots)
+}
+
+// dumpCode writes the code of the account.
+func (d *parallelDump) dumpCode(w DumpRangeWriter, account *DumpAccountRow) error {
+	row := &DumpCodeRow{CodeHash: account.CodeHash}
+	if d.conf.SkipCode {
+		size, err := d.state.db.ContractCodeSize(account.AddrHash, account.CodeHash)
+		if err != nil {
+			return fmt.Errorf("missing code %x: %w", account.CodeHash, err)
+		}
+		row.Size = size
+	} else {
+		code, err := d.state.db.ContractCode(account.AddrHash, account.CodeHash)
+		if err != nil {
+			return fmt.Errorf("missing code %x: %w", account.CodeHash, err)
+		}
+		row.Size, row.Code = len(code), code
+	}
+	return w.WriteCode(row)
+}
+
+// dumpStorage writes the storage slots of the account, returning their number.
+func (d *parallelDump) dumpStorage(ctx context.Context, w DumpRangeWriter, accountTrie Trie, account *DumpAccountRow) (int, error) {
+	tr, err := d.state.db.OpenStorageTrie(d.root, account.AddrHash, account.Root)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		it    = trie.NewIterator(tr.NodeIterator(nil))
+		slots int
+	)
+	for it.Next() {
+		// Giant storage tries may take a while, stay responsive
+		if slots%DefaultDumpCheckpointAccounts == 0 && ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		_, content, _, err := rlp.Split(it.Value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid storage slot %x of %x: %w", it.Key, account.AddrHash, err)
+		}
+		row := &DumpStorageRow{
+			AddrHash: account.AddrHash,
+			SlotHash: common.BytesToHash(it.Key),
+			Value:    content,
+		}
+		if preimage := accountTrie.GetKey(it.Key); preimage != nil {
+			slot := common.BytesToHash(preimage)
+			row.Slot = &slot
+		}
+		if err := w.WriteStorage(row); err != nil {
+			return 0, err
+		}
+		slots++
+	}
+	return slots, it.Err
+}
+
+// checkpoint flushes the rows of the range and saves the progress of the dump.
+func (d *parallelDump) checkpoint(index int, w DumpRangeWriter, next []byte, done bool, accounts, slots int) error {
+	checkpoint, err := w.Flush()
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.progress.Ranges[index] = &DumpRangeProgress{
+		Next:       common.CopyBytes(next),
+		Done:       done,
+		Checkpoint: checkpoint,
+	}
+	d.accounts += uint64(accounts)
+	d.slots += uint64(slots)
+	if time.Since(d.logged) > 8*time.Second {
+		var finished int
+		for _, r := range d.progress.Ranges {
+			if r.Done {
+				finished++
+			}
+		}
+		log.Info("Parallel state dump in progress", "ranges", fmt.Sprintf("%d/%d", finished, len(d.progress.Ranges)),
+			"accounts", d.accounts, "slots", d.slots, "elapsed", common.PrettyDuration(time.Since(d.start)))
+		d.logged = time.Now()
+	}
+	return d.sink.SaveProgress(d.progress)
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/trie"
+)
+
+var errDumpInterrupted = errors.New("interrupted")
+
+// resumableDumpSink is a sink saving the progress of the dump along its rows.
+type resumableDumpSink interface {
+	DumpSink
+	Progress() (*DumpProgress, error)
+}
+
+// failingDumpSink interrupts a dump after a number of accounts.
+type failingDumpSink struct {
+	DumpSink
+	accounts chan struct{}
+}
+
+func (s *failingDumpSink) OpenRange(index int, checkpoint []byte) (DumpRangeWriter, error) {
+	w, err := s.DumpSink.OpenRange(index, checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &failingDumpRange{w, s.accounts}, nil
+}
+
+type failingDumpRange struct {
+	DumpRangeWriter
+	accounts chan struct{}
+}
+
+func (w *failingDumpRange) WriteAccount(row *DumpAccountRow) error {
+	select {
+	case <-w.accounts:
+		return w.DumpRangeWriter.WriteAccount(row)
+	default:
+		return errDumpInterrupted
+	}
+}
+
+// readDumpTable returns the rows of a table across all the ranges of a dump.
+func readDumpTable(t *testing.T, dir, table string) [][]string {
+	files, _ := filepath.Glob(filepath.Join(dir, table+"-*.csv"))
+	var rows [][]string
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(f).ReadAll()
+		f.Close()
+		if err != nil {
+			t.Fatalf("invalid table %s: %v", file, err)
+		}
+		rows = append(rows, records...)
+	}
+	return rows
+}
+
+// makeDumpTestState creates a state of 100 accounts, a tenth of them being
+// contracts with two storage slots.
+func makeDumpTestState(t *testing.T) (*StateDB, common.Hash) {
+	sdb, _ := New(types.EmptyRootHash, NewDatabaseWithConfig(rawdb.NewMemoryDatabase(), &trie.Config{Preimages: true}), nil)
+	for i := 0; i < 100; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(i + 1)))
+		sdb.SetBalance(addr, big.NewInt(int64(i+1)))
+		if i%10 == 0 {
+			sdb.SetCode(addr, []byte{0x60, byte(i)})
+			sdb.SetState(addr, common.Hash{0x1}, common.Hash{byte(i + 1)})
+			sdb.SetState(addr, common.Hash{0x2}, common.Hash{0x2})
+		}
+	}
+	root, _ := sdb.Commit(false)
+	sdb, _ = New(root, sdb.db, nil)
+	return sdb, root
+}
+
+// testInterruptedDump interrupts a dump into the sink, then resumes it to the
+// end from the saved progress.
+func testInterruptedDump(t *testing.T, sdb *StateDB, root common.Hash, sink resumableDumpSink) {
+	conf := &ParallelDumpConfig{Workers: 3, Ranges: 8, CheckpointAccounts: 4}
+
+	accounts := make(chan struct{}, 30)
+	for i := 0; i < cap(accounts); i++ {
+		accounts <- struct{}{}
+	}
+	err := sdb.ParallelDump(context.Background(), &failingDumpSink{sink, accounts}, conf, nil)
+	if !errors.Is(err, errDumpInterrupted) {
+		t.Fatalf("interrupted dump: have error %v, want %v", err, errDumpInterrupted)
+	}
+	progress, err := sink.Progress()
+	if err != nil || progress == nil {
+		t.Fatalf("failed to load progress: %v", err)
+	}
+	if err := sdb.ParallelDump(context.Background(), sink, conf, progress); err != nil {
+		t.Fatalf("failed to resume dump: %v", err)
+	}
+	if progress, _ = sink.Progress(); progress.Root != root {
+		t.Fatalf("progress root %v, want %v", progress.Root, root)
+	}
+	for i, r := range progress.Ranges {
+		if !r.Done {
+			t.Errorf("range %d not done", i)
+		}
+	}
+	// Resuming the progress of another state fails
+	if err := sdb.ParallelDump(context.Background(), sink, &ParallelDumpConfig{Ranges: 4}, progress); err == nil {
+		t.Error("resumed the dump with another range split")
+	}
+}
+
+// Tests that a parallel dump exports the whole state into CSV tables, and that
+// an interrupted dump resumes without repeating or missing any row.
+func TestParallelDump(t *testing.T) {
+	sdb, root := makeDumpTestState(t)
+	sink, err := NewCSVDumpSink(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create sink: %v", err)
+	}
+	testInterruptedDump(t, sdb, root, sink)
+
+	// Every account is dumped exactly once, with its storage
+	seen := make(map[string]bool)
+	for _, row := range readDumpTable(t, sink.dir, "accounts") {
+		if seen[row[1]] {
+			t.Fatalf("account %s dumped twice", row[1])
+		}
+		seen[row[1]] = true
+	}
+	if len(seen) != 100 {
+		t.Fatalf("dumped %d accounts, want 100", len(seen))
+	}
+	if rows := readDumpTable(t, sink.dir, "storage"); len(rows) != 20 {
+		t.Errorf("dumped %d storage slots, want 20", len(rows))
+	}
+	if rows := readDumpTable(t, sink.dir, "code"); len(rows) != 10 {
+		t.Errorf("dumped %d codes, want 10", len(rows))
+	}
+}
+
+// Tests that a parallel dump exports the whole state into a SQLite database,
+// and that an interrupted dump resumes without repeating or missing any row.
+func TestParallelDumpSQLite(t *testing.T) {
+	sdb, root := makeDumpTestState(t)
+	sink, err := NewSQLiteDumpSink(filepath.Join(t.TempDir(), "state.sqlite"))
+	if err != nil {
+		t.Fatalf("failed to create sink: %v", err)
+	}
+	defer sink.Close()
+
+	testInterruptedDump(t, sdb, root, sink)
+
+	// Every account is dumped exactly once, with its storage
+	for _, check := range []struct {
+		query string
+		want  int
+	}{
+		{"SELECT COUNT(*) FROM accounts", 100},
+		{"SELECT COUNT(DISTINCT address) FROM accounts", 100},
+		{"SELECT COUNT(*) FROM storage", 20},
+		{"SELECT COUNT(*) FROM code", 10},
+		{"SELECT COUNT(*) FROM accounts WHERE balance = '42'", 1},
+	} {
+		var have int
+		if err := sink.db.QueryRow(check.query).Scan(&have); err != nil {
+			t.Fatalf("%s: %v", check.query, err)
+		}
+		if have != check.want {
+			t.Errorf("%s: have %d, want %d", check.query, have, check.want)
+		}
+	}
+}
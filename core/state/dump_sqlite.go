@@ -0,0 +1,227 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3" // Registers the sqlite3 driver, requires cgo
+)
+
+// sqliteDumpBatchRows is the number of rows a range buffers before writing them
+// into the database, between checkpoints.
+const sqliteDumpBatchRows = 10000
+
+// sqliteDumpSchema creates the tables of a SQLite dump. Every row carries the
+// range it belongs to and the sequence number of the checkpoint covering it, so
+// that the rows written after the last checkpoint of a range can be dropped when
+// resuming it.
+const sqliteDumpSchema = `
+CREATE TABLE IF NOT EXISTS accounts (addr_hash BLOB, address BLOB, nonce INTEGER, balance TEXT, root BLOB, code_hash BLOB, range_id INTEGER, seq INTEGER);
+CREATE TABLE IF NOT EXISTS storage (addr_hash BLOB, slot_hash BLOB, slot BLOB, value BLOB, range_id INTEGER, seq INTEGER);
+CREATE TABLE IF NOT EXISTS code (code_hash BLOB, size INTEGER, code BLOB, range_id INTEGER, seq INTEGER);
+CREATE INDEX IF NOT EXISTS accounts_range ON accounts (range_id, seq);
+CREATE INDEX IF NOT EXISTS storage_range ON storage (range_id, seq);
+CREATE INDEX IF NOT EXISTS code_range ON code (range_id, seq);
+CREATE TABLE IF NOT EXISTS progress (id INTEGER PRIMARY KEY CHECK (id = 0), progress TEXT);
+`
+
+// sqliteDumpInserts are the statements inserting a row into the dump tables, in
+// the order of dumpTables.
+var sqliteDumpInserts = []string{
+	"INSERT INTO accounts VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+	"INSERT INTO storage VALUES (?, ?, ?, ?, ?, ?)",
+	"INSERT INTO code VALUES (?, ?, ?, ?, ?)",
+}
+
+// SQLiteDumpSink writes a parallel state dump into a single SQLite database,
+// with a table of accounts, storage slots and contract codes. Hashes, addresses
+// and bytecodes are stored as blobs, balances as decimal text. The progress of
+// the dump is saved in the database too, so that an interrupted dump can be
+// resumed.
+type SQLiteDumpSink struct {
+	db *sql.DB
+}
+
+// NewSQLiteDumpSink opens the SQLite database at the given path, creating it and
+// its tables if needed.
+func NewSQLiteDumpSink(path string) (*SQLiteDumpSink, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=10000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, the ranges take turns on one connection
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteDumpSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create dump tables: %w", err)
+	}
+	return &SQLiteDumpSink{db: db}, nil
+}
+
+// Close closes the database.
+func (s *SQLiteDumpSink) Close() error {
+	return s.db.Close()
+}
+
+// Progress returns the progress saved in the database, or nil if none.
+func (s *SQLiteDumpSink) Progress() (*DumpProgress, error) {
+	var blob string
+	err := s.db.QueryRow("SELECT progress FROM progress WHERE id = 0").Scan(&blob)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	progress := new(DumpProgress)
+	if err := json.Unmarshal([]byte(blob), progress); err != nil {
+		return nil, fmt.Errorf("invalid dump progress: %w", err)
+	}
+	return progress, nil
+}
+
+// SaveProgress implements DumpSink.
+func (s *SQLiteDumpSink) SaveProgress(progress *DumpProgress) error {
+	blob, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT OR REPLACE INTO progress (id, progress) VALUES (0, ?)", string(blob))
+	return err
+}
+
+// OpenRange implements DumpSink. The checkpoints are the sequence numbers of
+// the last flush of the range, the rows written after it are deleted.
+func (s *SQLiteDumpSink) OpenRange(index int, checkpoint []byte) (DumpRangeWriter, error) {
+	var seq uint64
+	if checkpoint != nil {
+		if err := json.Unmarshal(checkpoint, &seq); err != nil {
+			return nil, fmt.Errorf("invalid checkpoint of range %d", index)
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range dumpTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE range_id = ? AND seq > ?", index, seq); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &sqliteDumpRange{db: s.db, index: index, seq: seq + 1}, nil
+}
+
+// sqliteDumpRange buffers the rows of a single range and writes them into the
+// database in batches.
+type sqliteDumpRange struct {
+	db    *sql.DB
+	index int
+	seq   uint64 // Sequence number of the rows until the next flush
+
+	rows  [][][]interface{} // Buffered rows of every table
+	count int               // Number of buffered rows
+}
+
+func (w *sqliteDumpRange) add(table int, row ...interface{}) error {
+	if w.rows == nil {
+		w.rows = make([][][]interface{}, len(dumpTables))
+	}
+	w.rows[table] = append(w.rows[table], append(row, w.index, int64(w.seq)))
+	if w.count++; w.count >= sqliteDumpBatchRows {
+		return w.write()
+	}
+	return nil
+}
+
+// write inserts the buffered rows into the database in a single transaction.
+func (w *sqliteDumpRange) write() error {
+	if w.count == 0 {
+		return nil
+	}
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i, rows := range w.rows {
+		if len(rows) == 0 {
+			continue
+		}
+		stmt, err := tx.Prepare(sqliteDumpInserts[i])
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, row := range rows {
+			if _, err := stmt.Exec(row...); err != nil {
+				stmt.Close()
+				tx.Rollback()
+				return err
+			}
+		}
+		stmt.Close()
+		w.rows[i] = rows[:0]
+	}
+	w.count = 0
+	return tx.Commit()
+}
+
+func (w *sqliteDumpRange) WriteAccount(row *DumpAccountRow) error {
+	var address []byte
+	if row.Address != nil {
+		address = row.Address.Bytes()
+	}
+	return w.add(0, row.AddrHash.Bytes(), address, int64(row.Nonce), row.Balance.String(), row.Root.Bytes(), row.CodeHash.Bytes())
+}
+
+func (w *sqliteDumpRange) WriteStorage(row *DumpStorageRow) error {
+	var slot []byte
+	if row.Slot != nil {
+		slot = row.Slot.Bytes()
+	}
+	return w.add(1, row.AddrHash.Bytes(), row.SlotHash.Bytes(), slot, row.Value)
+}
+
+func (w *sqliteDumpRange) WriteCode(row *DumpCodeRow) error {
+	return w.add(2, row.CodeHash.Bytes(), row.Size, row.Code)
+}
+
+func (w *sqliteDumpRange) Flush() ([]byte, error) {
+	if err := w.write(); err != nil {
+		return nil, err
+	}
+	checkpoint, err := json.Marshal(w.seq)
+	if err != nil {
+		return nil, err
+	}
+	w.seq++
+	return checkpoint, nil
+}
+
+// Close drops the rows buffered since the last flush, they are dumped again
+// when the range is resumed.
+func (w *sqliteDumpRange) Close() error {
+	w.rows, w.count = nil, 0
+	return nil
+}
@@ -27,4 +27,6 @@ var (
 	storageTriesUpdatedMeter = metrics.NewRegisteredMeter("state/update/storagenodes", nil)
 	accountTrieDeletedMeter  = metrics.NewRegisteredMeter("state/delete/accountnodes", nil)
 	storageTriesDeletedMeter = metrics.NewRegisteredMeter("state/delete/storagenodes", nil)
+	coldAccountReadMeter     = metrics.NewRegisteredMeter("state/read/cold/account", nil)
+	coldStorageReadMeter     = metrics.NewRegisteredMeter("state/read/cold/storage", nil)
 )
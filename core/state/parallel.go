@@ -0,0 +1,219 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+)
+
+// ErrUnmergeableWrites is returned by ExtractTxWrites if the transaction deleted
+// an account, which can't be replayed on another state.
+var ErrUnmergeableWrites = errors.New("transaction deleted an account")
+
+// accountWrites is the change of an account by a transaction.
+type accountWrites struct {
+	address      common.Address
+	balanceDelta *big.Int // Amount credited, for the accounts only credited or debited
+	balance      *big.Int // New balance if modified, for the other accounts
+	nonce        *uint64  // New nonce if modified
+	code         []byte   // New code if modified
+	storage      map[common.Hash]common.Hash
+}
+
+// changed returns whether the fields of the account were modified, besides
+// its storage.
+func (w *accountWrites) changed() bool {
+	return w.balanceDelta != nil || w.balance != nil || w.nonce != nil || w.code != nil
+}
+
+// TxWrites is the state modified by a transaction executed on a copy of a
+// state, to be merged into another state by ApplyTxWrites.
+type TxWrites struct {
+	accounts               []*accountWrites
+	logs                   []*types.Log
+	preimages              map[common.Hash][]byte
+	unexpectedBalanceDelta *big.Int
+}
+
+// ExtractTxWrites returns the state modified by the last transaction executed
+// on this state, a copy of base, and finalised. The list is the access list of
+// the transaction recorded on this state. The balances of the accounts only
+// credited or debited are extracted as the difference with base, others are
+// taken as is.
+func (s *StateDB) ExtractTxWrites(base *StateDB, list *TxAccessList) (*TxWrites, error) {
+	deltas := make(map[common.Address]struct{}, len(list.BalanceDeltas))
+	for _, addr := range list.BalanceDeltas {
+		deltas[addr] = struct{}{}
+	}
+	writes := &TxWrites{
+		accounts:               make([]*accountWrites, 0, len(list.Writes)),
+		logs:                   s.logs[s.thash],
+		preimages:              make(map[common.Hash][]byte),
+		unexpectedBalanceDelta: new(big.Int).Sub(s.unexpectedBalanceDelta, base.unexpectedBalanceDelta),
+	}
+	for _, tuple := range list.Writes {
+		addr := tuple.Address
+		if _, destructed := s.stateObjectsDestruct[addr]; destructed {
+			if _, ok := base.stateObjectsDestruct[addr]; !ok {
+				return nil, ErrUnmergeableWrites
+			}
+		}
+		obj := s.getStateObject(addr)
+		if obj == nil {
+			return nil, ErrUnmergeableWrites
+		}
+		var (
+			prev = base.getStateObject(addr)
+			acc  = &accountWrites{address: addr, storage: make(map[common.Hash]common.Hash, len(tuple.StorageKeys))}
+		)
+		if _, ok := deltas[addr]; ok {
+			acc.balanceDelta = new(big.Int).Set(obj.Balance())
+			if prev != nil {
+				acc.balanceDelta.Sub(acc.balanceDelta, prev.Balance())
+			}
+		} else {
+			if prev == nil || prev.Balance().Cmp(obj.Balance()) != 0 {
+				acc.balance = new(big.Int).Set(obj.Balance())
+			}
+			if prev == nil || prev.Nonce() != obj.Nonce() {
+				nonce := obj.Nonce()
+				acc.nonce = &nonce
+			}
+			if prev == nil || !bytes.Equal(prev.CodeHash(), obj.CodeHash()) {
+				if code := obj.Code(s.db); len(code) > 0 {
+					acc.code = common.CopyBytes(code)
+				}
+			}
+		}
+		for _, key := range tuple.StorageKeys {
+			acc.storage[key] = obj.GetState(s.db, key)
+		}
+		writes.accounts = append(writes.accounts, acc)
+	}
+	for hash, preimage := range s.preimages {
+		if _, ok := base.preimages[hash]; !ok {
+			writes.preimages[hash] = preimage
+		}
+	}
+	return writes, nil
+}
+
+// ApplyTxWrites merges the state modified by a transaction executed on another
+// state into the current transaction. The logs are added to the current
+// transaction too. The state must be finalised afterwards, like after executing
+// the transaction.
+func (s *StateDB) ApplyTxWrites(writes *TxWrites) {
+	unexpectedBalanceDelta := new(big.Int).Add(s.unexpectedBalanceDelta, writes.unexpectedBalanceDelta)
+	for _, acc := range writes.accounts {
+		switch {
+		case acc.balanceDelta != nil && acc.balanceDelta.Sign() < 0:
+			s.SubBalance(acc.address, new(big.Int).Neg(acc.balanceDelta))
+		case acc.balanceDelta != nil:
+			s.AddBalance(acc.address, acc.balanceDelta)
+		case acc.balance != nil:
+			s.SetBalance(acc.address, acc.balance)
+		}
+		if acc.nonce != nil {
+			s.SetNonce(acc.address, *acc.nonce)
+		}
+		if acc.code != nil {
+			s.SetCode(acc.address, acc.code)
+		}
+		for key, value := range acc.storage {
+			s.SetState(acc.address, key, value)
+		}
+	}
+	for _, log := range writes.logs {
+		s.AddLog(&types.Log{
+			Address: log.Address,
+			Topics:  log.Topics,
+			Data:    log.Data,
+		})
+	}
+	for hash, preimage := range writes.preimages {
+		s.AddPreimage(hash, preimage)
+	}
+	// The balance changes made above may differ from the transaction's own,
+	// which also counts the expected burns
+	s.unexpectedBalanceDelta = unexpectedBalanceDelta
+}
+
+// WriteSet accumulates the state modified by the transactions merged into a
+// state, to tell whether a transaction executed speculatively, without them,
+// read any of it.
+type WriteSet struct {
+	accounts map[common.Address]struct{}
+	slots    map[common.Address]map[common.Hash]struct{}
+}
+
+// NewWriteSet creates an empty write set.
+func NewWriteSet() *WriteSet {
+	return &WriteSet{
+		accounts: make(map[common.Address]struct{}),
+		slots:    make(map[common.Address]map[common.Hash]struct{}),
+	}
+}
+
+// Add adds the state modified by the transaction to the set.
+func (ws *WriteSet) Add(writes *TxWrites) {
+	for _, acc := range writes.accounts {
+		if acc.changed() {
+			ws.accounts[acc.address] = struct{}{}
+		}
+		if len(acc.storage) == 0 {
+			continue
+		}
+		slots, ok := ws.slots[acc.address]
+		if !ok {
+			slots = make(map[common.Hash]struct{}, len(acc.storage))
+			ws.slots[acc.address] = slots
+		}
+		for key := range acc.storage {
+			slots[key] = struct{}{}
+		}
+	}
+}
+
+// Conflicts returns whether the transaction with the given access list read
+// some of the state in the set. Crediting or debiting an account doesn't
+// depend on its balance, so that it doesn't count.
+func (ws *WriteSet) Conflicts(list *TxAccessList) bool {
+	deltas := make(map[common.Address]struct{}, len(list.BalanceDeltas))
+	for _, addr := range list.BalanceDeltas {
+		deltas[addr] = struct{}{}
+	}
+	for _, tuple := range list.Reads {
+		if _, ok := deltas[tuple.Address]; ok {
+			continue
+		}
+		if _, ok := ws.accounts[tuple.Address]; ok {
+			return true
+		}
+		slots := ws.slots[tuple.Address]
+		for _, key := range tuple.StorageKeys {
+			if _, ok := slots[key]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
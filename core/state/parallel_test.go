@@ -0,0 +1,112 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+)
+
+// Tests that the writes of transactions executed on copies of a state merge
+// into the same state as executing them in order, and that reading the state
+// they modified is told apart from crediting it.
+func TestTxWritesMerge(t *testing.T) {
+	var (
+		state, _ = New(types.EmptyRootHash, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		addrA    = common.Address{0xa}
+		addrB    = common.Address{0xb}
+		fees     = common.Address{0xf}
+		slot     = common.Hash{0x1}
+	)
+	state.SetBalance(addrA, big.NewInt(10))
+	state.SetBalance(addrB, big.NewInt(10))
+	state.SetBalance(fees, big.NewInt(10))
+	state.Finalise(true)
+
+	// execute runs a transaction on a copy of the state, returning its writes
+	execute := func(index int, fn func(s *StateDB)) (*TxAccessList, *TxWrites) {
+		var (
+			copy = state.Copy()
+			list *TxAccessList
+		)
+		copy.StartAccessRecording(func(l *TxAccessList) { list = l })
+		copy.SetTxContext(common.Hash{byte(index)}, index)
+		fn(copy)
+		copy.Finalise(true)
+		copy.StopAccessRecording()
+		writes, err := copy.ExtractTxWrites(state, list)
+		if err != nil {
+			t.Fatalf("failed to extract writes: %v", err)
+		}
+		return list, writes
+	}
+	listA, writesA := execute(0, func(s *StateDB) {
+		s.SubBalance(addrA, big.NewInt(2))
+		s.AddBalance(fees, big.NewInt(1))
+		s.SetState(addrA, slot, common.Hash{0x2})
+		s.SetNonce(addrA, 1)
+	})
+	listB, writesB := execute(1, func(s *StateDB) {
+		s.GetBalance(addrB)
+		s.SubBalance(addrB, big.NewInt(3))
+		s.AddBalance(fees, big.NewInt(2))
+		s.AddLog(&types.Log{Address: addrB})
+	})
+	listC, _ := execute(2, func(s *StateDB) {
+		s.GetState(addrA, slot)
+	})
+	if len(listA.BalanceDeltas) != 1 || listA.BalanceDeltas[0] != fees {
+		t.Fatalf("unexpected balance deltas: %v", listA.BalanceDeltas)
+	}
+	written := NewWriteSet()
+	if written.Conflicts(listA) {
+		t.Fatalf("first transaction conflicts")
+	}
+	state.SetTxContext(common.Hash{0}, 0)
+	state.ApplyTxWrites(writesA)
+	state.Finalise(true)
+	written.Add(writesA)
+
+	if written.Conflicts(listB) {
+		t.Fatalf("crediting the same account conflicts")
+	}
+	state.SetTxContext(common.Hash{1}, 1)
+	state.ApplyTxWrites(writesB)
+	state.Finalise(true)
+	written.Add(writesB)
+
+	if !written.Conflicts(listC) {
+		t.Fatalf("reading a modified slot doesn't conflict")
+	}
+	// Compare with the transactions executed in order
+	serial, _ := New(types.EmptyRootHash, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	serial.SetBalance(addrA, big.NewInt(8))
+	serial.SetBalance(addrB, big.NewInt(7))
+	serial.SetBalance(fees, big.NewInt(13))
+	serial.SetState(addrA, slot, common.Hash{0x2})
+	serial.SetNonce(addrA, 1)
+	if have, want := state.IntermediateRoot(true), serial.IntermediateRoot(true); have != want {
+		t.Errorf("merged state root mismatch: have %x, want %x", have, want)
+	}
+	if logs := state.GetLogs(common.Hash{1}, 0, common.Hash{}); len(logs) != 1 || logs[0].Address != addrB || logs[0].TxIndex != 1 {
+		t.Errorf("unexpected merged logs: %v", logs)
+	}
+}
@@ -59,6 +59,10 @@ type Config struct {
 	Datadir   string // The directory of the state database
 	Cachedir  string // The directory of state clean cache
 	BloomSize uint64 // The Megabytes of memory allocated to bloom-filter
+
+	// Arbitrum: the states the rollup may still need for fraud proofs survive
+	DisputeWindow func() (uint64, error) // Returns the oldest block whose state the rollup may still need, nil if there's none
+	DisputeStride uint64                 // Keep the state of every DisputeStride-th block of the dispute window (1 = every block, 0 = disabled)
 }
 
 // Pruner is an offline tool to prune the stale state with the
@@ -423,6 +427,88 @@ func dumpRawTrieDescendants(db ethdb.Database, root common.Hash, output *stateBl
 	return nil
 }
 
+// dumpRawTrieDifference commits the trie nodes and codes of the state root that
+// aren't shared with the state base into the given bloomfilter, the nodes of
+// base being committed already.
+func dumpRawTrieDifference(db ethdb.Database, base, root common.Hash, output *stateBloom) error {
+	triedb := trie.NewDatabase(db)
+	baseTr, err := trie.New(trie.StateTrieID(base), triedb)
+	if err != nil {
+		return err
+	}
+	// The base accounts are looked up in a trie of their own, as resolving them
+	// alters the trie iterated over
+	baseAccounts, err := trie.New(trie.StateTrieID(base), triedb)
+	if err != nil {
+		return err
+	}
+	tr, err := trie.New(trie.StateTrieID(root), triedb)
+	if err != nil {
+		return err
+	}
+	accountIt, _ := trie.NewDifferenceIterator(baseTr.NodeIterator(nil), tr.NodeIterator(nil))
+	for accountIt.Next(true) {
+		if hash := accountIt.Hash(); hash != (common.Hash{}) {
+			if err := output.Put(hash.Bytes(), nil); err != nil {
+				return err
+			}
+		}
+		if !accountIt.Leaf() {
+			continue
+		}
+		var data types.StateAccount
+		if err := rlp.DecodeBytes(accountIt.LeafBlob(), &data); err != nil {
+			return fmt.Errorf("failed to decode account data: %w", err)
+		}
+		if !bytes.Equal(data.CodeHash, types.EmptyCodeHash[:]) {
+			output.Put(data.CodeHash, nil)
+		}
+		if data.Root == (common.Hash{}) || data.Root == types.EmptyRootHash {
+			continue
+		}
+		// Only traverse the storage where it differs from the account's base storage
+		addrHash := common.BytesToHash(accountIt.LeafKey())
+		var baseRoot common.Hash
+		blob, err := baseAccounts.Get(accountIt.LeafKey())
+		if err != nil {
+			return err
+		}
+		if len(blob) > 0 {
+			var baseData types.StateAccount
+			if err := rlp.DecodeBytes(blob, &baseData); err != nil {
+				return fmt.Errorf("failed to decode account data: %w", err)
+			}
+			baseRoot = baseData.Root
+		}
+		if baseRoot == data.Root {
+			continue
+		}
+		storageTr, err := trie.New(trie.StorageTrieID(root, addrHash, data.Root), triedb)
+		if err != nil {
+			return err
+		}
+		storageIt := storageTr.NodeIterator(nil)
+		if baseRoot != (common.Hash{}) && baseRoot != types.EmptyRootHash {
+			baseStorageTr, err := trie.New(trie.StorageTrieID(base, addrHash, baseRoot), triedb)
+			if err != nil {
+				return err
+			}
+			storageIt, _ = trie.NewDifferenceIterator(baseStorageTr.NodeIterator(nil), storageIt)
+		}
+		for storageIt.Next(true) {
+			if hash := storageIt.Hash(); hash != (common.Hash{}) {
+				if err := output.Put(hash.Bytes(), nil); err != nil {
+					return err
+				}
+			}
+		}
+		if err := storageIt.Error(); err != nil {
+			return err
+		}
+	}
+	return accountIt.Error()
+}
+
 // Prune deletes all historical state nodes except the nodes belong to the
 // specified state version. If user doesn't specify the state version, use
 // the bottom-most snapshot diff layer as the target.
@@ -517,6 +603,19 @@ func (p *Pruner) Prune(inputRoots []common.Hash) error {
 	if err := extractGenesis(p.db, p.stateBloom); err != nil {
 		return err
 	}
+	// Traverse the pinned states and the states of the dispute window, so that
+	// they survive the pruning. Their roots are listed ahead of the targets, so
+	// that they aren't taken for false positives and the last root stays the
+	// snapshot target.
+	pinned, err := extractPinnedStates(p.db, p.stateBloom)
+	if err != nil {
+		return err
+	}
+	window, err := extractDisputeWindow(p.db, p.config, p.chainHeader, p.stateBloom)
+	if err != nil {
+		return err
+	}
+	roots = append(append(pinned, window...), roots...)
 
 	filterName := bloomFilterPath(p.config.Datadir)
 
@@ -596,6 +695,75 @@ func extractGenesis(db ethdb.Database, stateBloom *stateBloom) error {
 	return dumpRawTrieDescendants(db, genesis.Root(), stateBloom)
 }
 
+// extractPinnedStates commits all the state entries of the pinned states into
+// the given bloomfilter, returning their roots.
+func extractPinnedStates(db ethdb.Database, stateBloom *stateBloom) ([]common.Hash, error) {
+	var roots []common.Hash
+	for _, pin := range rawdb.ReadAllStatePins(db) {
+		if !rawdb.HasLegacyTrieNode(db, pin.Root) {
+			log.Warn("Pinned state missing", "label", pin.Label, "number", pin.BlockNumber, "root", pin.Root)
+			continue
+		}
+		log.Info("Retaining pinned state", "label", pin.Label, "number", pin.BlockNumber, "root", pin.Root)
+		if err := dumpRawTrieDescendants(db, pin.Root, stateBloom); err != nil {
+			return nil, err
+		}
+		roots = append(roots, pin.Root)
+	}
+	return roots, nil
+}
+
+// extractDisputeWindow commits the state entries of the persisted states of the
+// dispute window blocks, up to the head, into the given bloomfilter, returning
+// their roots. The first state is traversed in full, the following ones only
+// where they differ from the previous one. Pruning is refused if the window
+// isn't known, as the rollup may still need any of the states. The blocks are
+// the first one of the window and every stride-th block counting from it, like
+// for the core.RetentionPolicy of the running chain, and nothing is kept if the
+// stride is 0.
+func extractDisputeWindow(db ethdb.Database, config Config, head *types.Header, stateBloom *stateBloom) ([]common.Hash, error) {
+	stride := config.DisputeStride
+	if config.DisputeWindow == nil || stride == 0 {
+		return nil, nil
+	}
+	first, err := config.DisputeWindow()
+	if err != nil {
+		return nil, fmt.Errorf("dispute window unknown, refusing to prune: %w", err)
+	}
+	var (
+		roots   []common.Hash
+		missing int
+		start   = time.Now()
+	)
+	for number := first; number <= head.Number.Uint64(); number += stride {
+		header := rawdb.ReadHeader(db, rawdb.ReadCanonicalHash(db, number), number)
+		if header == nil {
+			return nil, fmt.Errorf("dispute window block %d missing, refusing to prune", number)
+		}
+		if !rawdb.HasLegacyTrieNode(db, header.Root) {
+			missing++
+			continue
+		}
+		if len(roots) > 0 && roots[len(roots)-1] == header.Root {
+			continue
+		}
+		if len(roots) == 0 {
+			err = dumpRawTrieDescendants(db, header.Root, stateBloom)
+		} else {
+			err = dumpRawTrieDifference(db, roots[len(roots)-1], header.Root, stateBloom)
+		}
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, header.Root)
+	}
+	if len(roots) == 0 && first <= head.Number.Uint64() {
+		log.Warn("No dispute window state persisted", "first", first, "head", head.Number)
+	}
+	log.Info("Retaining dispute window states", "first", first, "head", head.Number, "stride", stride, "states", len(roots), "missing", missing, "elapsed", common.PrettyDuration(time.Since(start)))
+	return roots, nil
+}
+
 func bloomFilterPath(datadir string) string {
 	return filepath.Join(datadir, stateBloomFileName)
 }
@@ -0,0 +1,95 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package pruner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that the pruner keeps the dispute window states the running chain
+// persisted, with a window start that isn't a multiple of the stride.
+func TestExtractDisputeWindow(t *testing.T) {
+	const (
+		first  = 10
+		stride = 4
+	)
+	var (
+		db     = rawdb.NewMemoryDatabase()
+		gspec  = &core.Genesis{Config: params.TestChainConfig}
+		engine = ethash.NewFaker()
+		config = &core.CacheConfig{
+			TrieCleanLimit: 256,
+			TrieDirtyLimit: 256,
+			TrieTimeLimit:  5 * time.Minute,
+			TriesInMemory:  4,
+			StateRetention: core.RetentionPolicy{DisputeStride: stride},
+		}
+	)
+	_, blocks, _ := core.GenerateChainWithGenesis(gspec, engine, 32, func(i int, gen *core.BlockGen) {
+		gen.SetCoinbase(common.Address{byte(i)})
+	})
+	chain, err := core.NewBlockChain(db, config, nil, gspec, nil, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	chain.SetDisputeWindow(func() (uint64, error) { return first, nil })
+	if _, err := chain.DisputeWindowStart(); err != nil {
+		t.Fatalf("dispute window unknown: %v", err)
+	}
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	chain.Stop()
+
+	bloom, err := newStateBloomWithSize(16)
+	if err != nil {
+		t.Fatalf("failed to create state bloom: %v", err)
+	}
+	head := blocks[len(blocks)-1].Header()
+	roots, err := extractDisputeWindow(db, Config{
+		DisputeWindow: func() (uint64, error) { return first, nil },
+		DisputeStride: stride,
+	}, head, bloom)
+	if err != nil {
+		t.Fatalf("failed to extract dispute window: %v", err)
+	}
+	// The states garbage collected by the chain must all be kept, the later
+	// ones depend on what the chain flushed when it was stopped
+	var want []common.Hash
+	for number := uint64(first); number <= head.Number.Uint64()-config.TriesInMemory; number += stride {
+		want = append(want, blocks[number-1].Root())
+	}
+	if len(roots) < len(want) {
+		t.Fatalf("have %d dispute window states, want at least %d", len(roots), len(want))
+	}
+	for i, root := range roots {
+		if i < len(want) && root != want[i] {
+			t.Errorf("state %d: have root %x, want %x", i, root, want[i])
+		}
+		if !bloom.Contain(root.Bytes()) {
+			t.Errorf("state %d: root %x not retained", i, root)
+		}
+	}
+}
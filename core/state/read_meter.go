@@ -0,0 +1,59 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import "sync/atomic"
+
+// ReadMeter counts the cold reads of the states it's attached to, that is the
+// account and storage reads served by the tries rather than by the live objects
+// or the snapshot. A meter may be shared by several states.
+type ReadMeter struct {
+	accounts atomic.Uint64
+	storage  atomic.Uint64
+}
+
+// Accounts returns the number of accounts read from the tries.
+func (m *ReadMeter) Accounts() uint64 {
+	return m.accounts.Load()
+}
+
+// Storage returns the number of storage slots read from the tries.
+func (m *ReadMeter) Storage() uint64 {
+	return m.storage.Load()
+}
+
+// SetReadMeter attaches a meter counting the cold reads of the state, nil to
+// detach it. The meter isn't carried over to the copies of the state.
+func (s *StateDB) SetReadMeter(meter *ReadMeter) {
+	s.readMeter = meter
+}
+
+// coldAccountRead records the read of an account from the trie.
+func (s *StateDB) coldAccountRead() {
+	coldAccountReadMeter.Mark(1)
+	if s.readMeter != nil {
+		s.readMeter.accounts.Add(1)
+	}
+}
+
+// coldStorageRead records the read of a storage slot from a trie.
+func (s *StateDB) coldStorageRead() {
+	coldStorageReadMeter.Mark(1)
+	if s.readMeter != nil {
+		s.readMeter.storage.Add(1)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+)
+
+// Changes is the set of accounts and storage slots touched by a diff layer
+// relative to its parent, keyed by hash.
+type Changes struct {
+	Parent    common.Hash                              // Root of the parent layer
+	Destructs map[common.Hash]struct{}                 // Accounts deleted (and potentially recreated)
+	Accounts  map[common.Hash]struct{}                 // Accounts modified or created
+	Storage   map[common.Hash]map[common.Hash]struct{} // Storage slots modified, one set per account
+}
+
+// Changes returns the accounts and storage slots touched by the diff layer of
+// the given root. The sets are copies, safe to use after the layer is flattened.
+//
+// Note, the bottom diff layer accumulates the writes of the layers flattened into
+// it, so the sets are a superset of the changes of a single block there, and the
+// values must be compared against the parent to tell the actual changes.
+func (t *Tree) Changes(root common.Hash) (*Changes, error) {
+	t.lock.RLock()
+	layer := t.layers[root]
+	t.lock.RUnlock()
+
+	if layer == nil {
+		return nil, fmt.Errorf("snapshot [%#x] missing", root)
+	}
+	diff, ok := layer.(*diffLayer)
+	if !ok {
+		return nil, fmt.Errorf("snapshot [%#x] is not a diff layer", root)
+	}
+	diff.lock.RLock()
+	defer diff.lock.RUnlock()
+
+	if diff.Stale() {
+		return nil, ErrSnapshotStale
+	}
+	changes := &Changes{
+		Parent:    diff.parent.Root(),
+		Destructs: make(map[common.Hash]struct{}, len(diff.destructSet)),
+		Accounts:  make(map[common.Hash]struct{}, len(diff.accountData)),
+		Storage:   make(map[common.Hash]map[common.Hash]struct{}, len(diff.storageData)),
+	}
+	for hash := range diff.destructSet {
+		changes.Destructs[hash] = struct{}{}
+	}
+	for hash := range diff.accountData {
+		changes.Accounts[hash] = struct{}{}
+	}
+	for hash, slots := range diff.storageData {
+		set := make(map[common.Hash]struct{}, len(slots))
+		for slot := range slots {
+			set[slot] = struct{}{}
+		}
+		changes.Storage[hash] = set
+	}
+	return changes, nil
+}
+
+// ChangesBetween returns the accounts and storage slots touched by the layers
+// above the root up to the head, which is either one of the layers or a state
+// recoverable from the reverse diffs, as is the root. The values of the entries
+// at the root are read from Historical.
+//
+// Note, the storage slots of the accounts destructed in the diff layers are not
+// listed, only the accounts are, the reverse diffs listing all of them.
+func (t *Tree) ChangesBetween(root, head common.Hash) (*Changes, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	changes := &Changes{
+		Parent:    root,
+		Destructs: make(map[common.Hash]struct{}),
+		Accounts:  make(map[common.Hash]struct{}),
+		Storage:   make(map[common.Hash]map[common.Hash]struct{}),
+	}
+	addStorage := func(accountHash, storageHash common.Hash) {
+		if changes.Storage[accountHash] == nil {
+			changes.Storage[accountHash] = make(map[common.Hash]struct{})
+		}
+		changes.Storage[accountHash][storageHash] = struct{}{}
+	}
+	if root == head {
+		return changes, nil
+	}
+	// Collect the changes of the diff layers down to the disk layer
+	current, collecting := head, t.layers[head] != nil
+	if collecting {
+		for current != root {
+			diff, ok := t.layers[current].(*diffLayer)
+			if !ok {
+				break
+			}
+			diff.lock.RLock()
+			for hash := range diff.destructSet {
+				changes.Destructs[hash] = struct{}{}
+			}
+			for hash := range diff.accountData {
+				changes.Accounts[hash] = struct{}{}
+			}
+			for accountHash, slots := range diff.storageData {
+				for storageHash := range slots {
+					addStorage(accountHash, storageHash)
+				}
+			}
+			current = diff.parent.Root()
+			diff.lock.RUnlock()
+		}
+		if current == root {
+			return changes, nil
+		}
+	}
+	// Continue with the reverse diffs below the disk layer, starting to collect
+	// them at the head if it's one of the recoverable states
+	roots, err := t.history()
+	if err != nil {
+		return nil, err
+	}
+	current = roots[len(roots)-1]
+	for depth := 0; current != root; depth++ {
+		if depth >= len(roots)-1 {
+			return nil, fmt.Errorf("%w: [%#x] not below [%#x]", errNotRecoverable, root, head)
+		}
+		if current == head {
+			collecting = true
+		}
+		diff, err := readReverseDiff(t.diskdb, current)
+		if err != nil {
+			return nil, err
+		}
+		if collecting {
+			for _, account := range diff.Accounts {
+				changes.Accounts[account.Hash] = struct{}{}
+			}
+			for _, slots := range diff.Storage {
+				for _, storageHash := range slots.Keys {
+					addStorage(slots.Hash, storageHash)
+				}
+			}
+		}
+		current = diff.Parent
+	}
+	if !collecting {
+		return nil, fmt.Errorf("%w: [%#x] not above [%#x]", errNotRecoverable, head, root)
+	}
+	return changes, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+)
+
+// Tests that the changes of a diff layer are reported relative to its parent,
+// and that disk layers have none.
+func TestChanges(t *testing.T) {
+	var (
+		db      = rawdb.NewMemoryDatabase()
+		a1, a2  = common.HexToHash("0xa1"), common.HexToHash("0xa2")
+		b1      = common.HexToHash("0xb1")
+		genesis = common.HexToHash("0x01")
+		root    = common.HexToHash("0x02")
+	)
+	base := &diskLayer{diskdb: db, root: genesis, cache: fastcache.New(1024 * 500)}
+	snaps := &Tree{
+		diskdb: db,
+		layers: map[common.Hash]snapshot{base.root: base},
+	}
+	if err := snaps.Update(root, genesis, map[common.Hash]struct{}{a2: {}},
+		map[common.Hash][]byte{a1: randomAccount()},
+		map[common.Hash]map[common.Hash][]byte{a1: {b1: {0x1}}}); err != nil {
+		t.Fatalf("failed to update snapshot: %v", err)
+	}
+	changes, err := snaps.Changes(root)
+	if err != nil {
+		t.Fatalf("failed to retrieve changes: %v", err)
+	}
+	if changes.Parent != genesis {
+		t.Errorf("parent mismatch: have %x, want %x", changes.Parent, genesis)
+	}
+	if _, ok := changes.Accounts[a1]; !ok || len(changes.Accounts) != 1 {
+		t.Errorf("account changes mismatch: %v", changes.Accounts)
+	}
+	if _, ok := changes.Destructs[a2]; !ok || len(changes.Destructs) != 1 {
+		t.Errorf("destruct changes mismatch: %v", changes.Destructs)
+	}
+	if _, ok := changes.Storage[a1][b1]; !ok || len(changes.Storage) != 1 {
+		t.Errorf("storage changes mismatch: %v", changes.Storage)
+	}
+	if _, err := snaps.Changes(genesis); err == nil {
+		t.Errorf("disk layer reported changes")
+	}
+	if _, err := snaps.Changes(common.HexToHash("0x03")); err == nil {
+		t.Errorf("missing layer reported changes")
+	}
+}
@@ -18,6 +18,7 @@ package snapshot
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/big"
@@ -56,7 +57,7 @@ var (
 // generateSnapshot regenerates a brand new snapshot based on an existing state
 // database and head block asynchronously. The snapshot is returned immediately
 // and generation is continued in the background until done.
-func generateSnapshot(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache int, root common.Hash) *diskLayer {
+func generateSnapshot(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache int, root common.Hash, throttle *throttleRef) *diskLayer {
 	// Create a new disk layer with an initialized state marker at zero
 	var (
 		stats     = &generatorStats{start: time.Now()}
@@ -76,12 +77,35 @@ func generateSnapshot(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache i
 		genMarker:  genMarker,
 		genPending: make(chan struct{}),
 		genAbort:   make(chan chan *generatorStats),
+		throttle:   throttle,
 	}
 	go base.generate(stats)
 	log.Debug("Start snapshot generation", "root", root)
 	return base
 }
 
+// resumeGeneration restarts the generation of a disk layer that was stopped
+// while still in progress, continuing from the progress persisted in the
+// database.
+func (dl *diskLayer) resumeGeneration() {
+	stats := &generatorStats{start: time.Now()}
+	if len(dl.genMarker) >= 8 {
+		stats.origin = binary.BigEndian.Uint64(dl.genMarker)
+	}
+	var generator journalGenerator
+	if blob := rawdb.ReadSnapshotGenerator(dl.diskdb); len(blob) > 0 {
+		if err := rlp.DecodeBytes(blob, &generator); err == nil {
+			stats.accounts = generator.Accounts
+			stats.slots = generator.Slots
+			stats.storage = common.StorageSize(generator.Storage)
+		}
+	}
+	dl.genAbort = make(chan chan *generatorStats)
+	go dl.generate(stats)
+
+	log.Debug("Resumed snapshot generation", "root", dl.root, "marker", dl.genMarker)
+}
+
 // journalProgress persists the generator stats into the database to resume later.
 func journalProgress(db ethdb.KeyValueWriter, marker []byte, stats *generatorStats) {
 	// Write out the generator marker. Note it's a standalone disk layer generator
@@ -483,6 +507,7 @@ func (dl *diskLayer) checkAndFlush(ctx *generatorContext, current []byte) error
 		// generation indeed makes progress.
 		journalProgress(ctx.batch, current, ctx.stats)
 
+		size := ctx.batch.ValueSize()
 		if err := ctx.batch.Write(); err != nil {
 			return err
 		}
@@ -492,6 +517,17 @@ func (dl *diskLayer) checkAndFlush(ctx *generatorContext, current []byte) error
 		dl.genMarker = current
 		dl.lock.Unlock()
 
+		// Pause if throttled, the progress is persisted so an interruption can be
+		// served right away
+		if delay := dl.throttle.delay(size); abort == nil && delay > 0 {
+			snapThrottleCounter.Inc(delay.Nanoseconds())
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case abort = <-dl.genAbort:
+				timer.Stop()
+			}
+		}
 		if abort != nil {
 			ctx.stats.Log("Aborting state snapshot generation", dl.root, current)
 			return newAbortErr(abort) // bubble up an error for interruption
@@ -113,6 +113,54 @@ func TestGenerateExistentState(t *testing.T) {
 	<-stop
 }
 
+// Tests that checkpointing a snapshot during generation lets the generation
+// complete, and that the snapshot can still be journalled afterwards.
+func TestGenerationCheckpoint(t *testing.T) {
+	var helper = newHelper()
+	stRoot := helper.makeStorageTrie(common.Hash{}, []string{"key-1", "key-2", "key-3"}, []string{"val-1", "val-2", "val-3"}, false)
+
+	helper.addTrieAccount("acc-1", &Account{Balance: big.NewInt(1), Root: stRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+	helper.addTrieAccount("acc-2", &Account{Balance: big.NewInt(2), Root: types.EmptyRootHash.Bytes(), CodeHash: types.EmptyCodeHash.Bytes()})
+	helper.addTrieAccount("acc-3", &Account{Balance: big.NewInt(3), Root: stRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+
+	helper.makeStorageTrie(hashData([]byte("acc-1")), []string{"key-1", "key-2", "key-3"}, []string{"val-1", "val-2", "val-3"}, true)
+	helper.makeStorageTrie(hashData([]byte("acc-3")), []string{"key-1", "key-2", "key-3"}, []string{"val-1", "val-2", "val-3"}, true)
+
+	root, snap := helper.CommitAndGenerate()
+	snaps := &Tree{
+		diskdb: helper.diskdb,
+		triedb: helper.triedb,
+		layers: map[common.Hash]snapshot{root: snap},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := snaps.Checkpoint(root); err != nil {
+			t.Fatalf("checkpoint %d failed: %v", i, err)
+		}
+	}
+	select {
+	case <-snap.genPending:
+		// Snapshot generation succeeded
+
+	case <-time.After(3 * time.Second):
+		t.Errorf("Snapshot generation failed")
+	}
+	checkSnapRoot(t, snap, root)
+
+	done := make(chan error)
+	go func() {
+		_, err := snaps.Journal(root)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to journal snapshot: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Snapshot journalling blocked")
+	}
+}
+
 func checkSnapRoot(t *testing.T, snap *diskLayer, trieRoot common.Hash) {
 	t.Helper()
 
@@ -211,7 +259,7 @@ func (t *testHelper) Commit() common.Hash {
 
 func (t *testHelper) CommitAndGenerate() (common.Hash, *diskLayer) {
 	root := t.Commit()
-	snap := generateSnapshot(t.diskdb, t.triedb, 16, root)
+	snap := generateSnapshot(t.diskdb, t.triedb, 16, root, nil)
 	return root, snap
 }
 
@@ -396,7 +444,7 @@ func TestGenerateCorruptAccountTrie(t *testing.T) {
 	helper.triedb.Commit(root, false)
 	helper.diskdb.Delete(common.HexToHash("0x65145f923027566669a1ae5ccac66f945b55ff6eaeb17d2ea8e048b7d381f2d7").Bytes())
 
-	snap := generateSnapshot(helper.diskdb, helper.triedb, 16, root)
+	snap := generateSnapshot(helper.diskdb, helper.triedb, 16, root, nil)
 	select {
 	case <-snap.genPending:
 		// Snapshot generation succeeded
@@ -431,7 +479,7 @@ func TestGenerateMissingStorageTrie(t *testing.T) {
 	// Delete a storage trie root and ensure the generator chokes
 	helper.diskdb.Delete(stRoot)
 
-	snap := generateSnapshot(helper.diskdb, helper.triedb, 16, root)
+	snap := generateSnapshot(helper.diskdb, helper.triedb, 16, root, nil)
 	select {
 	case <-snap.genPending:
 		// Snapshot generation succeeded
@@ -465,7 +513,7 @@ func TestGenerateCorruptStorageTrie(t *testing.T) {
 	// Delete a storage trie leaf and ensure the generator chokes
 	helper.diskdb.Delete(common.HexToHash("0x18a0f4d79cff4459642dd7604f303886ad9d77c30cf3d7d7cedb3a693ab6d371").Bytes())
 
-	snap := generateSnapshot(helper.diskdb, helper.triedb, 16, root)
+	snap := generateSnapshot(helper.diskdb, helper.triedb, 16, root, nil)
 	select {
 	case <-snap.genPending:
 		// Snapshot generation succeeded
@@ -524,7 +572,7 @@ func TestGenerateWithExtraAccounts(t *testing.T) {
 	if data := rawdb.ReadStorageSnapshot(helper.diskdb, hashData([]byte("acc-2")), hashData([]byte("b-key-1"))); data == nil {
 		t.Fatalf("expected snap storage to exist")
 	}
-	snap := generateSnapshot(helper.diskdb, helper.triedb, 16, root)
+	snap := generateSnapshot(helper.diskdb, helper.triedb, 16, root, nil)
 	select {
 	case <-snap.genPending:
 		// Snapshot generation succeeded
@@ -875,3 +923,55 @@ func TestGenerateBrokenSnapshotWithDanglingStorage(t *testing.T) {
 	snap.genAbort <- stop
 	<-stop
 }
+
+// testThrottle is a generation throttle reporting the flushed batch sizes, and
+// requesting a fixed delay after each.
+type testThrottle struct {
+	delay time.Duration
+	sizes chan int
+}
+
+func (t *testThrottle) Delay(size int) time.Duration {
+	select {
+	case t.sizes <- size:
+	default:
+	}
+	return t.delay
+}
+
+// Tests that the generator pauses as requested by the throttle after flushing a
+// batch, and that it can be aborted while paused.
+func TestGenerateThrottled(t *testing.T) {
+	helper := newHelper()
+	for i := 0; i < 4000; i++ {
+		helper.addTrieAccount(fmt.Sprintf("acc-%d", i), &Account{Balance: big.NewInt(int64(i)), Root: types.EmptyRootHash.Bytes(), CodeHash: types.EmptyCodeHash.Bytes()})
+	}
+	root := helper.Commit()
+
+	throttle := &testThrottle{delay: time.Hour, sizes: make(chan int, 1)}
+	snap := generateSnapshot(helper.diskdb, helper.triedb, 16, root, &throttleRef{throttle: throttle})
+	select {
+	case size := <-throttle.sizes:
+		if size <= ethdb.IdealBatchSize {
+			t.Errorf("throttled after a batch of %d bytes, want more than %d", size, ethdb.IdealBatchSize)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("throttle not consulted")
+	}
+	select {
+	case <-snap.genPending:
+		t.Fatal("snapshot generated despite the throttle")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The paused generator serves the abortion right away, with its progress saved
+	stop := make(chan *generatorStats)
+	select {
+	case snap.genAbort <- stop:
+		<-stop
+	case <-time.After(time.Second):
+		t.Fatal("paused generator not aborted")
+	}
+	if len(snap.genMarker) == 0 {
+		t.Error("generation progress not recorded")
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// errNotRecoverable is returned if the state of a root can't be read from the
+// snapshot, as it's neither one of its layers nor among the spilled layers.
+var errNotRecoverable = errors.New("state not recoverable from the snapshot")
+
+// SpillLayers returns the number of layers flattened onto disk kept revertible,
+// which is the number of blocks below the disk layer whose state is recoverable
+// from the reverse diffs.
+func (t *Tree) SpillLayers() int {
+	return t.config.SpillLayers
+}
+
+// History returns the roots of the states recoverable from the reverse diffs of
+// the layers spilled to disk, the oldest first, ending with the disk layer.
+func (t *Tree) History() []common.Hash {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	roots, err := t.history()
+	if err != nil {
+		return nil
+	}
+	return roots
+}
+
+// history returns the roots of the states recoverable from the reverse diffs,
+// the oldest first. The caller must hold the tree lock.
+func (t *Tree) history() ([]common.Hash, error) {
+	base := t.disklayer()
+	if base == nil {
+		return nil, fmt.Errorf("%w: snapshot missing", errNotRecoverable)
+	}
+	base.lock.RLock()
+	generating := base.genMarker != nil
+	base.lock.RUnlock()
+	if generating {
+		return nil, fmt.Errorf("%w: snapshot being generated", errNotRecoverable)
+	}
+	spilled := readSpill(t.diskdb)
+	if len(spilled) == 0 || spilled[len(spilled)-1] != base.root {
+		return []common.Hash{base.root}, nil
+	}
+	// The oldest reverse diff leads to the state below the spilled layers
+	diff, err := readReverseDiff(t.diskdb, spilled[0])
+	if err != nil {
+		return nil, err
+	}
+	return append([]common.Hash{diff.Parent}, spilled...), nil
+}
+
+// Recoverable reports whether the state of the root can be read from the snapshot,
+// either from one of its layers or by overlaying the reverse diffs of the layers
+// spilled to disk onto the disk layer, depth being the number of reverse diffs
+// needed (0 if the root has a layer).
+func (t *Tree) Recoverable(root common.Hash) (int, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.layers[root] != nil {
+		return 0, true
+	}
+	roots, err := t.history()
+	if err != nil {
+		return 0, false
+	}
+	for i, have := range roots {
+		if have == root {
+			return len(roots) - 1 - i, true
+		}
+	}
+	return 0, false
+}
+
+// Historical returns a read-only view of the state of the root, which is either
+// one of the layers or the state of an older block recoverable from the reverse
+// diffs. The disk layer is left untouched, the reverse diffs being overlaid onto
+// it in memory. The view follows the disk layer as new layers are flattened onto
+// it, for as long as the reverse diffs of the layers flattened since are retained.
+func (t *Tree) Historical(root common.Hash) (Snapshot, error) {
+	if snap := t.Snapshot(root); snap != nil {
+		return snap, nil
+	}
+	view := &historicalLayer{
+		tree:     t,
+		root:     root,
+		accounts: make(map[common.Hash][]byte),
+		storage:  make(map[common.Hash]map[common.Hash][]byte),
+	}
+	if err := view.rebase(); err != nil {
+		return nil, err
+	}
+	return view, nil
+}
+
+// readReverseDiff loads the reverse diff reverting the layer of the root to its
+// parent.
+func readReverseDiff(db ethdb.KeyValueReader, root common.Hash) (*reverseDiff, error) {
+	blob := rawdb.ReadSnapshotReverseDiff(db, root)
+	if len(blob) == 0 {
+		return nil, fmt.Errorf("%w: reverse diff of [%#x] missing", errNotRecoverable, root)
+	}
+	diff := new(reverseDiff)
+	if err := rlp.DecodeBytes(blob, diff); err != nil {
+		return nil, fmt.Errorf("failed to decode reverse diff of [%#x]: %v", root, err)
+	}
+	return diff, nil
+}
+
+// historicalLayer is the state of an older block, made of the reverse diffs of
+// the layers above it overlaid onto the disk layer.
+type historicalLayer struct {
+	tree *Tree
+	root common.Hash
+
+	lock     sync.RWMutex
+	base     *diskLayer                             // Disk layer the reverse diffs are overlaid onto
+	accounts map[common.Hash][]byte                 // Accounts changed above the root, empty if absent at the root
+	storage  map[common.Hash]map[common.Hash][]byte // Storage changed above the root, empty if absent at the root
+}
+
+// rebase overlays the reverse diffs from the current disk layer down to the one
+// the view was last based on, or to the root if the view is new. As the diffs
+// are walked from the newest down, the values of the older ones overwrite the
+// newer ones, while the values already in the view are older than all of them.
+func (hl *historicalLayer) rebase() error {
+	hl.tree.lock.RLock()
+	defer hl.tree.lock.RUnlock()
+
+	base := hl.tree.disklayer()
+	if base == nil {
+		return fmt.Errorf("%w: snapshot missing", errNotRecoverable)
+	}
+	base.lock.RLock()
+	generating := base.genMarker != nil
+	base.lock.RUnlock()
+	if generating {
+		return fmt.Errorf("%w: snapshot being generated", errNotRecoverable)
+	}
+	hl.lock.RLock()
+	target, rebased := hl.root, hl.base == base
+	if hl.base != nil {
+		target = hl.base.root
+	}
+	hl.lock.RUnlock()
+	if rebased {
+		return nil
+	}
+	var (
+		accounts = make(map[common.Hash][]byte)
+		storage  = make(map[common.Hash]map[common.Hash][]byte)
+		limit    = len(readSpill(hl.tree.diskdb))
+	)
+	for current, depth := base.root, 0; current != target; depth++ {
+		if depth >= limit {
+			return fmt.Errorf("%w: [%#x] not among the %d spilled layers below [%#x]", errNotRecoverable, target, limit, base.root)
+		}
+		diff, err := readReverseDiff(hl.tree.diskdb, current)
+		if err != nil {
+			return err
+		}
+		for _, account := range diff.Accounts {
+			accounts[account.Hash] = common.CopyBytes(account.Blob)
+		}
+		for _, slots := range diff.Storage {
+			if storage[slots.Hash] == nil {
+				storage[slots.Hash] = make(map[common.Hash][]byte)
+			}
+			for i, key := range slots.Keys {
+				storage[slots.Hash][key] = common.CopyBytes(slots.Vals[i])
+			}
+		}
+		current = diff.Parent
+	}
+	hl.lock.Lock()
+	defer hl.lock.Unlock()
+
+	for hash, blob := range accounts {
+		if _, ok := hl.accounts[hash]; !ok {
+			hl.accounts[hash] = blob
+		}
+	}
+	for accountHash, slots := range storage {
+		have := hl.storage[accountHash]
+		if have == nil {
+			have = make(map[common.Hash][]byte)
+			hl.storage[accountHash] = have
+		}
+		for storageHash, blob := range slots {
+			if _, ok := have[storageHash]; !ok {
+				have[storageHash] = blob
+			}
+		}
+	}
+	hl.base = base
+	return nil
+}
+
+// Root returns the root hash of the state the view was made for.
+func (hl *historicalLayer) Root() common.Hash {
+	return hl.root
+}
+
+// Account directly retrieves the account associated with a particular hash in
+// the snapshot slim data format.
+func (hl *historicalLayer) Account(hash common.Hash) (*Account, error) {
+	data, err := hl.AccountRLP(hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	account := new(Account)
+	if err := rlp.DecodeBytes(data, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// AccountRLP directly retrieves the account RLP associated with a particular
+// hash in the snapshot slim data format.
+func (hl *historicalLayer) AccountRLP(hash common.Hash) ([]byte, error) {
+	return hl.read(func() ([]byte, bool) {
+		blob, ok := hl.accounts[hash]
+		return blob, ok
+	}, func(base *diskLayer) ([]byte, error) {
+		return base.AccountRLP(hash)
+	})
+}
+
+// Storage directly retrieves the storage data associated with a particular hash,
+// within a particular account.
+func (hl *historicalLayer) Storage(accountHash, storageHash common.Hash) ([]byte, error) {
+	return hl.read(func() ([]byte, bool) {
+		blob, ok := hl.storage[accountHash][storageHash]
+		return blob, ok
+	}, func(base *diskLayer) ([]byte, error) {
+		return base.Storage(accountHash, storageHash)
+	})
+}
+
+// read looks an entry up in the overlaid reverse diffs, falling back to the disk
+// layer, and rebasing the view if the disk layer moved on meanwhile.
+func (hl *historicalLayer) read(overlay func() ([]byte, bool), disk func(*diskLayer) ([]byte, error)) ([]byte, error) {
+	for {
+		hl.lock.RLock()
+		blob, ok := overlay()
+		base := hl.base
+		hl.lock.RUnlock()
+		if ok {
+			if len(blob) == 0 {
+				return nil, nil
+			}
+			return blob, nil
+		}
+		blob, err := disk(base)
+		if !errors.Is(err, ErrSnapshotStale) {
+			return blob, err
+		}
+		if err := hl.rebase(); err != nil {
+			return nil, err
+		}
+	}
+}
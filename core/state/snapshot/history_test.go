@@ -0,0 +1,160 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+)
+
+// Tests that the states of the layers spilled to disk can be read by overlaying
+// their reverse diffs onto the disk layer, while the disk layer moves on.
+func TestHistorical(t *testing.T) {
+	var (
+		db      = rawdb.NewMemoryDatabase()
+		a1, a2  = common.HexToHash("0xa1"), common.HexToHash("0xa2")
+		a3      = common.HexToHash("0xa3")
+		b1, b2  = common.HexToHash("0xb1"), common.HexToHash("0xb2")
+		acc0    = randomAccount()
+		acc2    = randomAccount()
+		acc1    = randomAccount()
+		genesis = common.HexToHash("0x01")
+	)
+	rawdb.WriteAccountSnapshot(db, a1, acc0)
+	rawdb.WriteStorageSnapshot(db, a1, b1, []byte{0x1})
+	rawdb.WriteAccountSnapshot(db, a2, acc2)
+	rawdb.WriteStorageSnapshot(db, a2, b1, []byte{0x2})
+	rawdb.WriteStorageSnapshot(db, a2, b2, []byte{0x3})
+	rawdb.WriteSnapshotRoot(db, genesis)
+
+	base := &diskLayer{diskdb: db, root: genesis, cache: fastcache.New(1024 * 500)}
+	snaps := &Tree{
+		config: Config{DiffLayers: 2, SpillLayers: 4},
+		diskdb: db,
+		layers: map[common.Hash]snapshot{base.root: base},
+	}
+	update := func(root, parent common.Hash, destructs map[common.Hash]struct{}, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) {
+		t.Helper()
+		if err := snaps.Update(root, parent, destructs, accounts, storage); err != nil {
+			t.Fatalf("failed to update snapshot: %v", err)
+		}
+		if err := snaps.Cap(root, snaps.DiffLayers()); err != nil {
+			t.Fatalf("failed to cap snapshot: %v", err)
+		}
+	}
+	update(common.HexToHash("0x02"), genesis, nil,
+		map[common.Hash][]byte{a1: acc1, a3: randomAccount()},
+		map[common.Hash]map[common.Hash][]byte{a1: {b1: {0x4}}})
+	update(common.HexToHash("0x03"), common.HexToHash("0x02"), map[common.Hash]struct{}{a2: {}},
+		map[common.Hash][]byte{a1: randomAccount(), a2: randomAccount()},
+		map[common.Hash]map[common.Hash][]byte{a1: {b2: {0x5}}, a2: {b2: {0x6}}})
+	update(common.HexToHash("0x04"), common.HexToHash("0x03"), nil,
+		map[common.Hash][]byte{a1: randomAccount()}, nil)
+	update(common.HexToHash("0x05"), common.HexToHash("0x04"), nil,
+		map[common.Hash][]byte{a3: randomAccount()}, nil)
+
+	// The disk layer is at 0x03, with the layers of 0x02 and 0x03 spilled
+	history := snaps.History()
+	if len(history) != 3 || history[0] != genesis || history[2] != common.HexToHash("0x03") {
+		t.Fatalf("unexpected history %x", history)
+	}
+	for root, want := range map[common.Hash]int{genesis: 2, common.HexToHash("0x02"): 1, common.HexToHash("0x05"): 0} {
+		if depth, ok := snaps.Recoverable(root); !ok || depth != want {
+			t.Errorf("root %x: have depth %d (recoverable %v), want %d", root, depth, ok, want)
+		}
+	}
+	if _, ok := snaps.Recoverable(common.HexToHash("0x09")); ok {
+		t.Error("unknown root reported recoverable")
+	}
+	if _, err := snaps.Historical(common.HexToHash("0x09")); !errors.Is(err, errNotRecoverable) {
+		t.Fatalf("view of an unknown root: %v", err)
+	}
+	genesisView, err := snaps.Historical(genesis)
+	if err != nil {
+		t.Fatalf("failed to make view of the genesis: %v", err)
+	}
+	parentView, err := snaps.Historical(common.HexToHash("0x02"))
+	if err != nil {
+		t.Fatalf("failed to make view of block 2: %v", err)
+	}
+	check := func() {
+		t.Helper()
+		accounts := []struct {
+			view Snapshot
+			hash common.Hash
+			want []byte
+		}{
+			{genesisView, a1, acc0}, {genesisView, a2, acc2}, {genesisView, a3, nil}, {parentView, a1, acc1}, {parentView, a2, acc2},
+		}
+		for _, account := range accounts {
+			if have, err := account.view.AccountRLP(account.hash); err != nil || !bytes.Equal(have, account.want) {
+				t.Errorf("view %x account %x mismatch: have %x, want %x (err %v)", account.view.Root(), account.hash, have, account.want, err)
+			}
+		}
+		slots := []struct {
+			view          Snapshot
+			account, slot common.Hash
+			want          []byte
+		}{
+			{genesisView, a1, b1, []byte{0x1}}, {genesisView, a1, b2, nil}, {genesisView, a2, b1, []byte{0x2}}, {genesisView, a2, b2, []byte{0x3}},
+			{parentView, a1, b1, []byte{0x4}}, {parentView, a2, b1, []byte{0x2}},
+		}
+		for _, slot := range slots {
+			if have, err := slot.view.Storage(slot.account, slot.slot); err != nil || !bytes.Equal(have, slot.want) {
+				t.Errorf("view %x slot %x/%x mismatch: have %x, want %x (err %v)", slot.view.Root(), slot.account, slot.slot, have, slot.want, err)
+			}
+		}
+	}
+	check()
+
+	// The changes span the diff layers and the reverse diffs
+	changes, err := snaps.ChangesBetween(common.HexToHash("0x02"), common.HexToHash("0x04"))
+	if err != nil {
+		t.Fatalf("failed to collect changes: %v", err)
+	}
+	if len(changes.Accounts) != 2 || len(changes.Destructs) != 0 || len(changes.Storage[a1]) != 1 || len(changes.Storage[a2]) != 2 {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+	if _, err := snaps.ChangesBetween(common.HexToHash("0x04"), common.HexToHash("0x02")); !errors.Is(err, errNotRecoverable) {
+		t.Errorf("changes of a root above the head: %v", err)
+	}
+
+	// The views follow the disk layer as it moves on
+	update(common.HexToHash("0x06"), common.HexToHash("0x05"), nil,
+		map[common.Hash][]byte{a2: randomAccount()},
+		map[common.Hash]map[common.Hash][]byte{a2: {b1: {0x7}}})
+	update(common.HexToHash("0x07"), common.HexToHash("0x06"), nil, nil, nil)
+	if root := rawdb.ReadSnapshotRoot(db); root != common.HexToHash("0x05") {
+		t.Fatalf("disk layer root mismatch: have %x, want %x", root, common.HexToHash("0x05"))
+	}
+	check()
+
+	// The views outlive the reverse diffs they're made of, but new ones can't be made
+	update(common.HexToHash("0x08"), common.HexToHash("0x07"), nil, nil, nil)
+	if _, ok := snaps.Recoverable(genesis); ok {
+		t.Fatal("genesis recoverable beyond the spilled layers")
+	}
+	if _, err := snaps.Historical(genesis); !errors.Is(err, errNotRecoverable) {
+		t.Fatalf("view of a dropped root: %v", err)
+	}
+	check()
+}
@@ -50,4 +50,6 @@ var (
 	snapStorageWriteCounter = metrics.NewRegisteredCounter("state/snapshot/generation/duration/storage/write", nil)
 	// snapStorageCleanCounter measures time spent on deleting storages
 	snapStorageCleanCounter = metrics.NewRegisteredCounter("state/snapshot/generation/duration/storage/clean", nil)
+	// snapThrottleCounter measures time spent paused by the generation throttle
+	snapThrottleCounter = metrics.NewRegisteredCounter("state/snapshot/generation/duration/throttle", nil)
 )
@@ -0,0 +1,171 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"context"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+	"github.com/chainupcloud/arb-geth/trie"
+)
+
+// Slice is a flat snapshot of a few accounts, and of their storage, at a given
+// state root, generated from the tries on demand without touching the snapshot
+// tree. The accounts outside of the slice, and the storage of the accounts whose
+// storage was too large to be included, are reported as not covered, so that the
+// callers fall back to the tries.
+type Slice struct {
+	root     common.Hash
+	accounts map[common.Hash][]byte                 // Slim RLP of the covered accounts, nil if the account doesn't exist
+	storage  map[common.Hash]map[common.Hash][]byte // Storage of the covered accounts whose storage is complete
+	size     common.StorageSize
+}
+
+// GenerateSlice generates the flat snapshot of the accounts at the state root,
+// including the storage of those whose storage has at most maxSlots slots (0 =
+// no limit), from the tries of triedb.
+func GenerateSlice(ctx context.Context, triedb *trie.Database, root common.Hash, accounts []common.Address, maxSlots uint64) (*Slice, error) {
+	start := time.Now()
+	tr, err := trie.NewStateTrie(trie.StateTrieID(root), triedb)
+	if err != nil {
+		return nil, err
+	}
+	slice := &Slice{
+		root:     root,
+		accounts: make(map[common.Hash][]byte, len(accounts)),
+		storage:  make(map[common.Hash]map[common.Hash][]byte, len(accounts)),
+	}
+	for _, addr := range accounts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		hash := crypto.Keccak256Hash(addr.Bytes())
+		if _, ok := slice.accounts[hash]; ok {
+			continue
+		}
+		account, err := tr.GetAccount(addr)
+		if err != nil {
+			return nil, err
+		}
+		if account == nil {
+			slice.accounts[hash] = nil
+			slice.storage[hash] = make(map[common.Hash][]byte)
+			continue
+		}
+		data := SlimAccountRLP(account.Nonce, account.Balance, account.Root, account.CodeHash)
+		slice.accounts[hash] = data
+		slice.size += common.StorageSize(common.HashLength + len(data))
+
+		storage, err := generateSliceStorage(ctx, triedb, root, hash, account.Root, maxSlots)
+		if err != nil {
+			return nil, err
+		}
+		if storage == nil {
+			log.Debug("Left out storage of snapshot slice", "root", root, "account", addr, "limit", maxSlots)
+			continue
+		}
+		slice.storage[hash] = storage
+		for _, value := range storage {
+			slice.size += common.StorageSize(2*common.HashLength + len(value))
+		}
+	}
+	log.Debug("Generated snapshot slice", "root", root, "accounts", len(slice.accounts), "size", slice.size, "elapsed", common.PrettyDuration(time.Since(start)))
+	return slice, nil
+}
+
+// generateSliceStorage returns the storage of an account, or nil if it has more
+// than maxSlots slots.
+func generateSliceStorage(ctx context.Context, triedb *trie.Database, stateRoot, accountHash, storageRoot common.Hash, maxSlots uint64) (map[common.Hash][]byte, error) {
+	storage := make(map[common.Hash][]byte)
+	if storageRoot == types.EmptyRootHash {
+		return storage, nil
+	}
+	tr, err := trie.New(trie.StorageTrieID(stateRoot, accountHash, storageRoot), triedb)
+	if err != nil {
+		return nil, err
+	}
+	it := trie.NewIterator(tr.NodeIterator(nil))
+	for it.Next() {
+		if maxSlots > 0 && uint64(len(storage)) >= maxSlots {
+			return nil, nil
+		}
+		if len(storage)%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		storage[common.BytesToHash(it.Key)] = common.CopyBytes(it.Value)
+	}
+	if it.Err != nil {
+		return nil, it.Err
+	}
+	return storage, nil
+}
+
+// Root returns the root hash for which this slice was made.
+func (s *Slice) Root() common.Hash {
+	return s.root
+}
+
+// Size returns the memory used by the accounts and storage of the slice.
+func (s *Slice) Size() common.StorageSize {
+	return s.size
+}
+
+// Account directly retrieves the account associated with a particular hash in
+// the snapshot slim data format.
+func (s *Slice) Account(hash common.Hash) (*Account, error) {
+	data, err := s.AccountRLP(hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	account := new(Account)
+	if err := rlp.DecodeBytes(data, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// AccountRLP directly retrieves the account RLP associated with a particular
+// hash in the snapshot slim data format, or ErrNotCoveredYet if the account is
+// outside of the slice.
+func (s *Slice) AccountRLP(hash common.Hash) ([]byte, error) {
+	data, ok := s.accounts[hash]
+	if !ok {
+		return nil, ErrNotCoveredYet
+	}
+	return data, nil
+}
+
+// Storage directly retrieves the storage data associated with a particular hash,
+// within a particular account, or ErrNotCoveredYet if the storage of the account
+// is outside of the slice.
+func (s *Slice) Storage(accountHash, storageHash common.Hash) ([]byte, error) {
+	storage, ok := s.storage[accountHash]
+	if !ok {
+		return nil, ErrNotCoveredYet
+	}
+	return storage[storageHash], nil
+}
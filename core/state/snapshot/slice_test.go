@@ -0,0 +1,80 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+)
+
+// Tests that a snapshot slice serves the accounts and storage it was generated
+// for, and reports the rest as not covered.
+func TestGenerateSlice(t *testing.T) {
+	var (
+		helper = newHelper()
+		small  = common.Address{0x01}
+		large  = common.Address{0x02}
+		empty  = common.Address{0x03}
+		other  = common.Address{0x04}
+		absent = common.Address{0x05}
+	)
+	smallRoot := helper.makeStorageTrie(hashData(small[:]), []string{"key-1"}, []string{"val-1"}, true)
+	largeRoot := helper.makeStorageTrie(hashData(large[:]), []string{"key-1", "key-2", "key-3"}, []string{"val-1", "val-2", "val-3"}, true)
+
+	helper.addTrieAccount(string(small[:]), &Account{Balance: big.NewInt(1), Root: smallRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+	helper.addTrieAccount(string(large[:]), &Account{Balance: big.NewInt(2), Root: largeRoot, CodeHash: types.EmptyCodeHash.Bytes()})
+	helper.addTrieAccount(string(empty[:]), &Account{Balance: big.NewInt(3), Root: types.EmptyRootHash.Bytes(), CodeHash: types.EmptyCodeHash.Bytes()})
+	helper.addTrieAccount(string(other[:]), &Account{Balance: big.NewInt(4), Root: types.EmptyRootHash.Bytes(), CodeHash: types.EmptyCodeHash.Bytes()})
+	root := helper.Commit()
+
+	slice, err := GenerateSlice(context.Background(), helper.triedb, root, []common.Address{small, large, empty, absent}, 2)
+	if err != nil {
+		t.Fatalf("failed to generate slice: %v", err)
+	}
+	if slice.Root() != root {
+		t.Fatalf("root mismatch: have %x, want %x", slice.Root(), root)
+	}
+	for addr, balance := range map[common.Address]int64{small: 1, large: 2, empty: 3} {
+		account, err := slice.Account(hashData(addr[:]))
+		if err != nil || account == nil || account.Balance.Int64() != balance {
+			t.Fatalf("account %x: have %+v (err %v), want balance %d", addr, account, err, balance)
+		}
+	}
+	if account, err := slice.Account(hashData(absent[:])); err != nil || account != nil {
+		t.Fatalf("absent account: have %+v (err %v), want nil", account, err)
+	}
+	if _, err := slice.Account(hashData(other[:])); err != ErrNotCoveredYet {
+		t.Fatalf("account outside of the slice: have err %v, want %v", err, ErrNotCoveredYet)
+	}
+	if value, err := slice.Storage(hashData(small[:]), hashData([]byte("key-1"))); err != nil || !bytes.Equal(value, []byte("val-1")) {
+		t.Fatalf("storage: have %q (err %v), want %q", value, err, "val-1")
+	}
+	if value, err := slice.Storage(hashData(small[:]), hashData([]byte("key-2"))); err != nil || value != nil {
+		t.Fatalf("missing storage: have %q (err %v), want nil", value, err)
+	}
+	if value, err := slice.Storage(hashData(empty[:]), hashData([]byte("key-1"))); err != nil || value != nil {
+		t.Fatalf("empty storage: have %q (err %v), want nil", value, err)
+	}
+	if _, err := slice.Storage(hashData(large[:]), hashData([]byte("key-1"))); err != ErrNotCoveredYet {
+		t.Fatalf("storage over the limit: have err %v, want %v", err, ErrNotCoveredYet)
+	}
+}
@@ -19,11 +19,13 @@ package snapshot
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"sync"
 
 	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
 	"github.com/chainupcloud/arb-geth/core/rawdb"
 	"github.com/chainupcloud/arb-geth/ethdb"
 	"github.com/chainupcloud/arb-geth/log"
@@ -153,6 +155,11 @@ type Config struct {
 	Recovery   bool // Indicator that the snapshots is in the recovery mode
 	NoBuild    bool // Indicator that the snapshots generation is disallowed
 	AsyncBuild bool // The snapshot generation is allowed to be constructed asynchronously
+
+	DiffLayers  int // Number of diff layers kept in memory above the disk layer (0 = 128)
+	SpillLayers int // Number of layers flattened onto disk kept revertible, persisting every layer separately (0 = disabled)
+
+	Throttle GenerationThrottle // Optional pacing of the background generation
 }
 
 // Tree is an Ethereum state snapshot tree. It consists of one persistent base
@@ -171,6 +178,8 @@ type Tree struct {
 	layers map[common.Hash]snapshot // Collection of all known layers
 	lock   sync.RWMutex
 
+	throttle *throttleRef // Generation throttle shared by the disk layers
+
 	// Test hooks
 	onFlatten func() // Hook invoked when the bottom most diff layers are flattened
 }
@@ -198,9 +207,11 @@ func New(config Config, diskdb ethdb.KeyValueStore, triedb *trie.Database, root
 		diskdb: diskdb,
 		triedb: triedb,
 		layers: make(map[common.Hash]snapshot),
+
+		throttle: &throttleRef{throttle: config.Throttle},
 	}
 	// Attempt to load a previously persisted snapshot and rebuild one if failed
-	head, disabled, err := loadSnapshot(diskdb, triedb, root, config.CacheSize, config.Recovery, config.NoBuild)
+	head, disabled, err := loadSnapshot(diskdb, triedb, root, config.CacheSize, config.Recovery, config.NoBuild, snap.throttle)
 	if disabled {
 		log.Warn("Snapshot maintenance disabled (syncing)")
 		return snap, nil
@@ -406,7 +417,7 @@ func (t *Tree) Cap(root common.Hash, layers int) error {
 	if layers == 0 {
 		// If full commit was requested, flatten the diffs and merge onto disk
 		diff.lock.RLock()
-		base := diffToDisk(diff.flatten().(*diffLayer))
+		base := diffToDisk(diff.flatten().(*diffLayer), t.config.SpillLayers)
 		diff.lock.RUnlock()
 
 		// Replace the entire snapshot tree with the flat base
@@ -497,7 +508,7 @@ func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
 			t.onFlatten()
 		}
 		diff.parent = flattened
-		if flattened.memory < aggregatorMemoryLimit {
+		if flattened.memory < aggregatorMemoryLimit && t.config.SpillLayers == 0 {
 			// Accumulator layer is smaller than the limit, so we can abort, unless
 			// there's a snapshot being generated currently. In that case, the trie
 			// will move from underneath the generator so we **must** merge all the
@@ -513,7 +524,7 @@ func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
 	bottom := diff.parent.(*diffLayer)
 
 	bottom.lock.RLock()
-	base := diffToDisk(bottom)
+	base := diffToDisk(bottom, t.config.SpillLayers)
 	bottom.lock.RUnlock()
 
 	t.layers[base.root] = base
@@ -522,16 +533,23 @@ func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
 }
 
 // diffToDisk merges a bottom-most diff into the persistent disk layer underneath
-// it. The method will panic if called onto a non-bottom-most diff layer.
+// it. The method will panic if called onto a non-bottom-most diff layer. If spill
+// is set, the overwritten entries are recorded to revert the merge, keeping the
+// reverse diffs of the last spill merges.
 //
 // The disk layer persistence should be operated in an atomic way. All updates should
 // be discarded if the whole transition if not finished.
-func diffToDisk(bottom *diffLayer) *diskLayer {
+func diffToDisk(bottom *diffLayer, spill int) *diskLayer {
 	var (
-		base  = bottom.parent.(*diskLayer)
-		batch = base.diskdb.NewBatch()
-		stats *generatorStats
+		base    = bottom.parent.(*diskLayer)
+		batch   = base.diskdb.NewBatch()
+		stats   *generatorStats
+		reverse *reverseRecorder
 	)
+	// Partially generated snapshots can't be reverted, their entries being unknown
+	if spill > 0 && base.genMarker == nil {
+		reverse = newReverseRecorder(base.diskdb)
+	}
 	// If the disk layer is running a snapshot generator, abort it
 	if base.genAbort != nil {
 		abort := make(chan *generatorStats)
@@ -556,12 +574,18 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 			continue
 		}
 		// Remove all storage slots
+		if reverse != nil {
+			reverse.account(hash)
+		}
 		rawdb.DeleteAccountSnapshot(batch, hash)
 		base.cache.Set(hash[:], nil)
 
 		it := rawdb.IterateStorageSnapshots(base.diskdb, hash)
 		for it.Next() {
 			key := it.Key()
+			if reverse != nil {
+				reverse.slot(hash, common.BytesToHash(key[len(rawdb.SnapshotStoragePrefix)+common.HashLength:]), it.Value(), true)
+			}
 			batch.Delete(key)
 			base.cache.Del(key[1:])
 			snapshotFlushStorageItemMeter.Mark(1)
@@ -585,6 +609,9 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 			continue
 		}
 		// Push the account to disk
+		if reverse != nil {
+			reverse.account(hash)
+		}
 		rawdb.WriteAccountSnapshot(batch, hash, data)
 		base.cache.Set(hash[:], data)
 		snapshotCleanAccountWriteMeter.Mark(int64(len(data)))
@@ -616,6 +643,9 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 			if midAccount && bytes.Compare(storageHash[:], base.genMarker[common.HashLength:]) > 0 {
 				continue
 			}
+			if reverse != nil {
+				reverse.slot(accountHash, storageHash, nil, false)
+			}
 			if len(data) > 0 {
 				rawdb.WriteStorageSnapshot(batch, accountHash, storageHash, data)
 				base.cache.Set(append(accountHash[:], storageHash[:]...), data)
@@ -630,6 +660,9 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 	}
 	// Update the snapshot block marker and write any remainder data
 	rawdb.WriteSnapshotRoot(batch, bottom.root)
+	if spill > 0 {
+		spillLayer(batch, base.diskdb, bottom.root, base.root, reverse, spill)
+	}
 
 	// Write out the generator progress marker and report
 	journalProgress(batch, base.genMarker, stats)
@@ -647,6 +680,7 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 		triedb:     base.triedb,
 		genMarker:  base.genMarker,
 		genPending: base.genPending,
+		throttle:   base.throttle,
 	}
 	// If snapshot generation hasn't finished yet, port over all the starts and
 	// continue where the previous round left off.
@@ -677,6 +711,37 @@ func (t *Tree) Journal(root common.Hash) (common.Hash, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
+	return t.journal(snap)
+}
+
+// Checkpoint journals the diff hierarchy to disk like Journal, but leaves the
+// tree usable afterwards: snapshot generation, if still running, is resumed
+// from the journalled progress. It is meant to be used ahead of a planned
+// shutdown, so that an unclean exit doesn't lose the in-memory layers.
+func (t *Tree) Checkpoint(root common.Hash) (common.Hash, error) {
+	snap := t.Snapshot(root)
+	if snap == nil {
+		return common.Hash{}, fmt.Errorf("snapshot [%#x] missing", root)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var generating bool
+	if dl := t.disklayer(); dl != nil {
+		generating = dl.genAbort != nil && dl.genMarker != nil
+	}
+	base, err := t.journal(snap)
+
+	// Restart the generator if journalling stopped it
+	if dl := t.disklayer(); generating && dl != nil && dl.genAbort == nil && !dl.stale {
+		dl.resumeGeneration()
+	}
+	return base, err
+}
+
+// journal writes the diff hierarchy ending in snap to disk, the caller must
+// hold the tree lock.
+func (t *Tree) journal(snap Snapshot) (common.Hash, error) {
 	// Firstly write out the metadata of journal
 	journal := new(bytes.Buffer)
 	if err := rlp.Encode(journal, journalVersion); err != nil {
@@ -742,7 +807,7 @@ func (t *Tree) Rebuild(root common.Hash) {
 	// generator will run a wiper first if there's not one running right now.
 	log.Info("Rebuilding state snapshot")
 	t.layers = map[common.Hash]snapshot{
-		root: generateSnapshot(t.diskdb, t.triedb, t.config.CacheSize, root),
+		root: generateSnapshot(t.diskdb, t.triedb, t.config.CacheSize, root, t.throttle),
 	}
 }
 
@@ -850,6 +915,40 @@ func (t *Tree) generating() (bool, error) {
 	return layer.genMarker != nil, nil
 }
 
+// GenerationProgress describes how far the generation of the disk layer got.
+type GenerationProgress struct {
+	Generating bool          `json:"generating"`
+	Marker     hexutil.Bytes `json:"marker,omitempty"` // Position of the generator in the account (and storage) space
+	Progress   float64       `json:"progress"`         // Estimated fraction of the accounts already generated
+}
+
+// GenerationProgress is an external helper function reporting whether the
+// snapshot is still under construction, and approximately how far along.
+func (t *Tree) GenerationProgress() (*GenerationProgress, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	layer := t.disklayer()
+	if layer == nil {
+		return nil, errors.New("disk layer is missing")
+	}
+	layer.lock.RLock()
+	defer layer.lock.RUnlock()
+
+	if layer.genMarker == nil {
+		return &GenerationProgress{Progress: 1}, nil
+	}
+	// Account hashes are uniformly distributed, so the position of the marker
+	// in the hash space approximates the fraction of accounts done
+	var prefix [8]byte
+	copy(prefix[:], layer.genMarker)
+	return &GenerationProgress{
+		Generating: true,
+		Marker:     common.CopyBytes(layer.genMarker),
+		Progress:   float64(binary.BigEndian.Uint64(prefix[:])) / (1 << 64),
+	}, nil
+}
+
 // DiskRoot is a external helper function to return the disk layer root.
 func (t *Tree) DiskRoot() common.Hash {
 	t.lock.Lock()
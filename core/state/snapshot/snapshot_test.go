@@ -491,3 +491,29 @@ func TestReadStateDuringFlattening(t *testing.T) {
 		t.Fatal("Unexpected blocker")
 	}
 }
+
+// Tests that the generation progress is derived from the generator marker.
+func TestGenerationProgress(t *testing.T) {
+	base := &diskLayer{
+		diskdb:    rawdb.NewMemoryDatabase(),
+		root:      common.HexToHash("0x01"),
+		cache:     fastcache.New(1024 * 500),
+		genMarker: []byte{0x40},
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	progress, err := snaps.GenerationProgress()
+	if err != nil {
+		t.Fatalf("failed to retrieve progress: %v", err)
+	}
+	if !progress.Generating || progress.Progress != 0.25 {
+		t.Fatalf("wrong progress while generating: %+v", progress)
+	}
+	base.genMarker = nil
+	if progress, _ = snaps.GenerationProgress(); progress.Generating || progress.Progress != 1 {
+		t.Fatalf("wrong progress after generation: %+v", progress)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// defaultDiffLayers is the number of diff layers kept in memory above the disk
+// layer unless configured otherwise.
+const defaultDiffLayers = 128
+
+// errNotRevertible is returned if the disk layer can't be reverted to a root, as
+// it's not among the spilled layers.
+var errNotRevertible = errors.New("snapshot not revertible")
+
+// DiffLayers returns the number of diff layers kept in memory above the disk
+// layer, which is the depth of the reorgs the snapshot survives without spilling.
+func (t *Tree) DiffLayers() int {
+	if t.config.DiffLayers > 0 {
+		return t.config.DiffLayers
+	}
+	return defaultDiffLayers
+}
+
+// reverseDiff holds the disk layer values overwritten by flattening a diff layer
+// onto it, an empty blob standing for an absent entry. The reverse diffs of the
+// layers spilled to disk let the disk layer be reverted on deep reorgs.
+type reverseDiff struct {
+	Parent   common.Hash // Root of the disk layer the diff was flattened onto
+	Accounts []journalAccount
+	Storage  []journalStorage
+}
+
+// reverseRecorder collects the original values of the disk layer entries as a
+// diff layer is flattened onto it.
+type reverseRecorder struct {
+	diskdb   ethdb.KeyValueReader
+	accounts map[common.Hash][]byte
+	storage  map[common.Hash]map[common.Hash][]byte
+}
+
+func newReverseRecorder(diskdb ethdb.KeyValueReader) *reverseRecorder {
+	return &reverseRecorder{
+		diskdb:   diskdb,
+		accounts: make(map[common.Hash][]byte),
+		storage:  make(map[common.Hash]map[common.Hash][]byte),
+	}
+}
+
+// account records the value of an account before it's first overwritten.
+func (r *reverseRecorder) account(hash common.Hash) {
+	if _, ok := r.accounts[hash]; !ok {
+		r.accounts[hash] = rawdb.ReadAccountSnapshot(r.diskdb, hash)
+	}
+}
+
+// slot records the value of a storage slot before it's first overwritten. The
+// value is read from disk unless already known.
+func (r *reverseRecorder) slot(accountHash, storageHash common.Hash, known []byte, isKnown bool) {
+	storage := r.storage[accountHash]
+	if storage == nil {
+		storage = make(map[common.Hash][]byte)
+		r.storage[accountHash] = storage
+	}
+	if _, ok := storage[storageHash]; ok {
+		return
+	}
+	if !isKnown {
+		known = rawdb.ReadStorageSnapshot(r.diskdb, accountHash, storageHash)
+	}
+	storage[storageHash] = common.CopyBytes(known)
+}
+
+// encode serializes the recorded values into the reverse diff leading to parent.
+func (r *reverseRecorder) encode(parent common.Hash) []byte {
+	diff := &reverseDiff{Parent: parent}
+	for hash, blob := range r.accounts {
+		diff.Accounts = append(diff.Accounts, journalAccount{Hash: hash, Blob: blob})
+	}
+	for accountHash, slots := range r.storage {
+		storage := journalStorage{Hash: accountHash}
+		for storageHash, blob := range slots {
+			storage.Keys = append(storage.Keys, storageHash)
+			storage.Vals = append(storage.Vals, blob)
+		}
+		diff.Storage = append(diff.Storage, storage)
+	}
+	blob, err := rlp.EncodeToBytes(diff)
+	if err != nil {
+		panic(err) // can't happen, the reverse diff is made of byte slices
+	}
+	return blob
+}
+
+// readSpill returns the roots of the spilled layers, the oldest first.
+func readSpill(db ethdb.KeyValueReader) []common.Hash {
+	var roots []common.Hash
+	if blob := rawdb.ReadSnapshotSpill(db); len(blob) > 0 {
+		if err := rlp.DecodeBytes(blob, &roots); err != nil {
+			log.Warn("Failed to decode snapshot spill", "err", err)
+			return nil
+		}
+	}
+	return roots
+}
+
+func writeSpill(db ethdb.KeyValueWriter, roots []common.Hash) {
+	blob, err := rlp.EncodeToBytes(roots)
+	if err != nil {
+		panic(err) // can't happen, the roots are hashes
+	}
+	rawdb.WriteSnapshotSpill(db, blob)
+}
+
+// spillLayer persists the reverse diff of the layer flattened onto the disk layer,
+// dropping the oldest ones beyond the limit. A nil recorder, as the layer couldn't
+// be recorded, breaks the chain of reverse diffs and drops them all.
+func spillLayer(batch ethdb.KeyValueWriter, diskdb ethdb.KeyValueReader, root, parent common.Hash, reverse *reverseRecorder, limit int) {
+	roots := readSpill(diskdb)
+	if reverse == nil {
+		for _, root := range roots {
+			rawdb.DeleteSnapshotReverseDiff(batch, root)
+		}
+		rawdb.DeleteSnapshotSpill(batch)
+		return
+	}
+	rawdb.WriteSnapshotReverseDiff(batch, root, reverse.encode(parent))
+	roots = append(roots, root)
+	for len(roots) > limit {
+		rawdb.DeleteSnapshotReverseDiff(batch, roots[0])
+		roots = roots[1:]
+	}
+	writeSpill(batch, roots)
+}
+
+// Revert rewinds the disk layer to the state of an older block, whose layer was
+// flattened onto it and spilled to disk, by applying the reverse diffs of the
+// layers above it. It's meant for reorgs deeper than the diff layers, which would
+// otherwise leave the snapshot unusable until rebuilt. All diff layers are
+// dropped, as they're built on top of the reverted state.
+func (t *Tree) Revert(root common.Hash) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.layers[root] != nil {
+		return nil
+	}
+	base := t.disklayer()
+	if base == nil {
+		return fmt.Errorf("%w: snapshot missing", errNotRevertible)
+	}
+	base.lock.RLock()
+	generating := base.genMarker != nil
+	base.lock.RUnlock()
+	if generating {
+		return fmt.Errorf("%w: snapshot being generated", errNotRevertible)
+	}
+	// Gather the reverse diffs from the disk layer down to the requested root
+	var (
+		roots = readSpill(t.diskdb)
+		diffs []*reverseDiff
+	)
+	for current := base.root; current != root; {
+		if len(diffs) >= len(roots) {
+			return fmt.Errorf("%w: [%#x] not among the %d spilled layers below [%#x]", errNotRevertible, root, len(roots), base.root)
+		}
+		blob := rawdb.ReadSnapshotReverseDiff(t.diskdb, current)
+		if len(blob) == 0 {
+			return fmt.Errorf("%w: reverse diff of [%#x] missing", errNotRevertible, current)
+		}
+		diff := new(reverseDiff)
+		if err := rlp.DecodeBytes(blob, diff); err != nil {
+			return fmt.Errorf("failed to decode reverse diff of [%#x]: %v", current, err)
+		}
+		diffs = append(diffs, diff)
+		current = diff.Parent
+	}
+	// Mark the disk layer stale, along with the diffs on top of it, and apply the
+	// reverse diffs. The root goes missing until done, so a crash in between
+	// triggers a rebuild rather than leaving a corrupt snapshot.
+	base.lock.Lock()
+	base.stale = true
+	base.lock.Unlock()
+
+	batch := t.diskdb.NewBatch()
+	rawdb.DeleteSnapshotRoot(batch)
+	current := base.root
+	for _, diff := range diffs {
+		for _, account := range diff.Accounts {
+			if len(account.Blob) == 0 {
+				rawdb.DeleteAccountSnapshot(batch, account.Hash)
+				base.cache.Set(account.Hash[:], nil)
+			} else {
+				rawdb.WriteAccountSnapshot(batch, account.Hash, account.Blob)
+				base.cache.Set(account.Hash[:], account.Blob)
+			}
+		}
+		for _, storage := range diff.Storage {
+			for i, storageHash := range storage.Keys {
+				key := append(storage.Hash[:], storageHash[:]...)
+				if blob := storage.Vals[i]; len(blob) == 0 {
+					rawdb.DeleteStorageSnapshot(batch, storage.Hash, storageHash)
+					base.cache.Set(key, nil)
+				} else {
+					rawdb.WriteStorageSnapshot(batch, storage.Hash, storageHash, blob)
+					base.cache.Set(key, blob)
+				}
+			}
+		}
+		rawdb.DeleteSnapshotReverseDiff(batch, current)
+		current = diff.Parent
+
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				log.Crit("Failed to write reverted snapshot", "err", err)
+			}
+			batch.Reset()
+		}
+	}
+	writeSpill(batch, roots[:len(roots)-len(diffs)])
+	rawdb.WriteSnapshotRoot(batch, root)
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to write reverted snapshot", "err", err)
+	}
+	log.Info("Reverted state snapshot", "from", base.root, "to", root, "layers", len(diffs))
+
+	t.layers = map[common.Hash]snapshot{root: &diskLayer{
+		root:     root,
+		cache:    base.cache,
+		diskdb:   base.diskdb,
+		triedb:   base.triedb,
+		throttle: base.throttle,
+	}}
+	return nil
+}
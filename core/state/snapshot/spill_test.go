@@ -0,0 +1,111 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+)
+
+// Tests that the layers flattened onto disk in spill mode can be reverted, with
+// the disk layer ending up as it was before.
+func TestSpillRevert(t *testing.T) {
+	var (
+		db      = rawdb.NewMemoryDatabase()
+		a1, a2  = common.HexToHash("0xa1"), common.HexToHash("0xa2")
+		a3      = common.HexToHash("0xa3")
+		b1, b2  = common.HexToHash("0xb1"), common.HexToHash("0xb2")
+		acc0    = randomAccount()
+		acc2    = randomAccount()
+		genesis = common.HexToHash("0x01")
+	)
+	rawdb.WriteAccountSnapshot(db, a1, acc0)
+	rawdb.WriteStorageSnapshot(db, a1, b1, []byte{0x1})
+	rawdb.WriteAccountSnapshot(db, a2, acc2)
+	rawdb.WriteStorageSnapshot(db, a2, b1, []byte{0x2})
+	rawdb.WriteStorageSnapshot(db, a2, b2, []byte{0x3})
+	rawdb.WriteSnapshotRoot(db, genesis)
+
+	base := &diskLayer{diskdb: db, root: genesis, cache: fastcache.New(1024 * 500)}
+	snaps := &Tree{
+		config: Config{DiffLayers: 2, SpillLayers: 4},
+		diskdb: db,
+		layers: map[common.Hash]snapshot{base.root: base},
+	}
+	update := func(root, parent common.Hash, destructs map[common.Hash]struct{}, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) {
+		t.Helper()
+		if err := snaps.Update(root, parent, destructs, accounts, storage); err != nil {
+			t.Fatalf("failed to update snapshot: %v", err)
+		}
+		if err := snaps.Cap(root, snaps.DiffLayers()); err != nil {
+			t.Fatalf("failed to cap snapshot: %v", err)
+		}
+	}
+	update(common.HexToHash("0x02"), genesis, nil,
+		map[common.Hash][]byte{a1: randomAccount(), a3: randomAccount()},
+		map[common.Hash]map[common.Hash][]byte{a1: {b1: {0x4}}})
+	update(common.HexToHash("0x03"), common.HexToHash("0x02"), map[common.Hash]struct{}{a2: {}},
+		map[common.Hash][]byte{a1: randomAccount(), a2: randomAccount()},
+		map[common.Hash]map[common.Hash][]byte{a1: {b2: {0x5}}, a2: {b2: {0x6}}})
+	update(common.HexToHash("0x04"), common.HexToHash("0x03"), nil,
+		map[common.Hash][]byte{a1: randomAccount()}, nil)
+	update(common.HexToHash("0x05"), common.HexToHash("0x04"), nil,
+		map[common.Hash][]byte{a3: randomAccount()}, nil)
+
+	// Every layer below the last two is flattened onto disk separately
+	if root := rawdb.ReadSnapshotRoot(db); root != common.HexToHash("0x03") {
+		t.Fatalf("disk layer root mismatch: have %x, want %x", root, common.HexToHash("0x03"))
+	}
+	if n := len(readSpill(db)); n != 2 {
+		t.Fatalf("spilled layer count mismatch: have %d, want 2", n)
+	}
+	if err := snaps.Revert(common.HexToHash("0x09")); !errors.Is(err, errNotRevertible) {
+		t.Fatalf("revert to an unknown root: %v", err)
+	}
+	if err := snaps.Revert(genesis); err != nil {
+		t.Fatalf("failed to revert snapshot: %v", err)
+	}
+	if snaps.Snapshot(common.HexToHash("0x05")) != nil {
+		t.Fatal("diff layer above the reverted state retained")
+	}
+	snap := snaps.Snapshot(genesis)
+	if snap == nil || rawdb.ReadSnapshotRoot(db) != genesis || len(readSpill(db)) != 0 {
+		t.Fatal("snapshot not reverted to the genesis")
+	}
+	accounts := map[common.Hash][]byte{a1: acc0, a2: acc2, a3: nil}
+	for hash, want := range accounts {
+		if have, err := snap.(snapshot).AccountRLP(hash); err != nil || !bytes.Equal(have, want) {
+			t.Errorf("account %x mismatch: have %x, want %x (err %v)", hash, have, want, err)
+		}
+	}
+	slots := []struct {
+		account, slot common.Hash
+		want          []byte
+	}{
+		{a1, b1, []byte{0x1}}, {a1, b2, nil}, {a2, b1, []byte{0x2}}, {a2, b2, []byte{0x3}},
+	}
+	for _, slot := range slots {
+		if have, err := snap.Storage(slot.account, slot.slot); err != nil || !bytes.Equal(have, slot.want) {
+			t.Errorf("slot %x/%x mismatch: have %x, want %x (err %v)", slot.account, slot.slot, have, slot.want, err)
+		}
+	}
+}
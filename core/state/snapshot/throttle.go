@@ -0,0 +1,62 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"sync"
+	"time"
+)
+
+// GenerationThrottle paces the background generation of a snapshot, so that it
+// doesn't starve other users of the disk.
+type GenerationThrottle interface {
+	// Delay returns how long the generator should pause after flushing a batch
+	// of generated snapshot data of the given size in bytes.
+	Delay(size int) time.Duration
+}
+
+// throttleRef is the generation throttle shared by the successive disk layers of
+// a tree. It can be swapped while a generation is running.
+type throttleRef struct {
+	lock     sync.RWMutex
+	throttle GenerationThrottle
+}
+
+// delay returns the pause the throttle requests after flushing the given number
+// of bytes, zero if there's no throttle.
+func (r *throttleRef) delay(size int) time.Duration {
+	if r == nil {
+		return 0
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if r.throttle == nil {
+		return 0
+	}
+	return r.throttle.Delay(size)
+}
+
+// SetGenerationThrottle replaces the throttle pacing the snapshot generation,
+// including a generation already running. A nil throttle lets the generator run
+// at full speed.
+func (t *Tree) SetGenerationThrottle(throttle GenerationThrottle) {
+	t.throttle.lock.Lock()
+	defer t.throttle.lock.Unlock()
+
+	t.throttle.throttle = throttle
+}
@@ -99,10 +99,12 @@ func newObject(db *StateDB, address common.Address, data types.StateAccount) *st
 	if data.Root == (common.Hash{}) {
 		data.Root = types.EmptyRootHash
 	}
+	addrHash := crypto.Keccak256Hash(address[:])
+	db.recordKeyPreimage(addrHash, address[:])
 	return &stateObject{
 		db:             db,
 		address:        address,
-		addrHash:       crypto.Keccak256Hash(address[:]),
+		addrHash:       addrHash,
 		data:           data,
 		originStorage:  make(Storage),
 		pendingStorage: make(Storage),
@@ -155,6 +157,9 @@ func (s *stateObject) getTrie(db Database) (Trie, error) {
 
 // GetState retrieves a value from the account storage trie.
 func (s *stateObject) GetState(db Database, key common.Hash) common.Hash {
+	if s.db.accessRecorder != nil {
+		s.db.recordSlotRead(s.address, key)
+	}
 	// If we have a dirty value for this state entry, return it
 	value, dirty := s.dirtyStorage[key]
 	if dirty {
@@ -166,6 +171,9 @@ func (s *stateObject) GetState(db Database, key common.Hash) common.Hash {
 
 // GetCommittedState retrieves a value from the committed account storage trie.
 func (s *stateObject) GetCommittedState(db Database, key common.Hash) common.Hash {
+	if s.db.accessRecorder != nil {
+		s.db.recordSlotRead(s.address, key)
+	}
 	// If we have a pending write or clean cached, return that
 	if value, pending := s.pendingStorage[key]; pending {
 		return value
@@ -182,6 +190,12 @@ func (s *stateObject) GetCommittedState(db Database, key common.Hash) common.Has
 	if _, destructed := s.db.stateObjectsDestruct[s.address]; destructed {
 		return common.Hash{}
 	}
+	if s.db.interrupted() {
+		return common.Hash{}
+	}
+	if s.db.keyPreimages != nil {
+		s.db.recordKeyPreimage(crypto.Keccak256Hash(key.Bytes()), key.Bytes())
+	}
 	// If no live objects are available, attempt to use snapshots
 	var (
 		enc []byte
@@ -202,6 +216,7 @@ func (s *stateObject) GetCommittedState(db Database, key common.Hash) common.Has
 			s.db.setError(err)
 			return common.Hash{}
 		}
+		s.db.coldStorageRead()
 		enc, err = tr.GetStorage(s.address, key.Bytes())
 		if metrics.EnabledExpensive {
 			s.db.StorageReads += time.Since(start)
@@ -19,6 +19,7 @@ package state
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"math/big"
@@ -85,6 +86,10 @@ type StateDB struct {
 	stateObjectsDirty    map[common.Address]struct{} // State objects modified in the current execution
 	stateObjectsDestruct map[common.Address]struct{} // State objects destructed in the block
 
+	// State this one was forked from, whose live objects are copied on first
+	// access until the fork is detached, see Fork
+	parent *StateDB
+
 	// DB error.
 	// State objects are used by the consensus core and VM which are
 	// unable to deal with database-level errors. Any error that occurs
@@ -94,6 +99,16 @@ type StateDB struct {
 	// when accessing state of accounts.
 	dbErr error
 
+	// Optional context aborting database reads once cancelled, the
+	// cancellation is memoized in dbErr like any other read failure.
+	ctx context.Context
+
+	// Optional meter of the reads served by the tries, see SetReadMeter
+	readMeter *ReadMeter
+
+	// Number of storage trie committers of a pipelined commit, see SetCommitPipeline
+	commitWorkers int
+
 	// The refund counter, also used by state transitioning.
 	refund uint64
 
@@ -104,6 +119,14 @@ type StateDB struct {
 
 	preimages map[common.Hash][]byte
 
+	// Preimages of the hashed account and storage keys touched, only
+	// recorded if enabled via StartKeyPreimageRecording
+	keyPreimages map[common.Hash][]byte
+
+	// Records the state accessed by each transaction, only set if enabled
+	// via StartAccessRecording
+	accessRecorder *accessRecorder
+
 	// Per-transaction access list
 	accessList *accessList
 
@@ -171,6 +194,21 @@ func New(root common.Hash, db Database, snaps *snapshot.Tree) (*StateDB, error)
 	return sdb, nil
 }
 
+// SetSnapshotSlice makes the reads of the accounts and storage covered by the
+// snapshot slice hit its flat data instead of the tries. It's ignored if the
+// state is already backed by the snapshot tree or the slice was made for
+// another root. The slice stays valid until the state is committed, as the
+// accounts it covers are only read from it until they are first loaded.
+func (s *StateDB) SetSnapshotSlice(slice *snapshot.Slice) bool {
+	if s.snap != nil || slice.Root() != s.originalRoot {
+		return false
+	}
+	s.snap = slice
+	s.snapAccounts = make(map[common.Hash][]byte)
+	s.snapStorage = make(map[common.Hash]map[common.Hash][]byte)
+	return true
+}
+
 func NewDeterministic(root common.Hash, db Database) (*StateDB, error) {
 	sdb, err := New(root, db, nil)
 	if err != nil {
@@ -214,6 +252,26 @@ func (s *StateDB) Error() error {
 	return s.dbErr
 }
 
+// SetContext makes subsequent state reads hitting the database fail once the
+// given context is cancelled, so that long running executions can be aborted
+// promptly. The context is not inherited by copies of the state.
+func (s *StateDB) SetContext(ctx context.Context) {
+	s.ctx = ctx
+}
+
+// interrupted reports whether the state's context was cancelled, memoizing
+// the cancellation as a database error.
+func (s *StateDB) interrupted() bool {
+	if s.ctx == nil {
+		return false
+	}
+	if err := s.ctx.Err(); err != nil {
+		s.setError(fmt.Errorf("state access interrupted: %w", err))
+		return true
+	}
+	return false
+}
+
 func (s *StateDB) AddLog(log *types.Log) {
 	s.journal.append(addLogChange{txhash: s.thash})
 
@@ -258,6 +316,29 @@ func (s *StateDB) Preimages() map[common.Hash][]byte {
 	return s.preimages
 }
 
+// StartKeyPreimageRecording makes the state record the preimages of all the
+// hashed account and storage keys it touches from now on, discarding any
+// preimages recorded previously.
+func (s *StateDB) StartKeyPreimageRecording() {
+	s.keyPreimages = make(map[common.Hash][]byte)
+}
+
+// KeyPreimages returns the preimages of the hashed account and storage keys
+// touched since recording was started, or nil if it wasn't.
+func (s *StateDB) KeyPreimages() map[common.Hash][]byte {
+	return s.keyPreimages
+}
+
+// recordKeyPreimage records the preimage of a hashed trie key if enabled.
+func (s *StateDB) recordKeyPreimage(hash common.Hash, key []byte) {
+	if s.keyPreimages == nil {
+		return
+	}
+	if _, ok := s.keyPreimages[hash]; !ok {
+		s.keyPreimages[hash] = common.CopyBytes(key)
+	}
+}
+
 // AddRefund adds gas to the refund counter
 func (s *StateDB) AddRefund(gas uint64) {
 	s.journal.append(refundChange{prev: s.refund})
@@ -372,6 +453,15 @@ func (s *StateDB) GetStorageProof(a common.Address, key common.Hash) ([][]byte,
 	return proof, nil
 }
 
+// AccountRangeProof returns the accounts of the state trie from origin onwards,
+// keyed by address hash, along with the proofs of the range boundaries.
+func (s *StateDB) AccountRangeProof(origin, limit []byte, maxEntries, maxBytes int) (*trie.RangeProof, error) {
+	if s.Flat() {
+		return nil, errFlatState
+	}
+	return trie.ProveRange(s.trie, origin, limit, maxEntries, maxBytes)
+}
+
 // GetCommittedState retrieves a value from the given account's committed storage trie.
 func (s *StateDB) GetCommittedState(addr common.Address, hash common.Hash) common.Hash {
 	stateObject := s.getStateObject(addr)
@@ -401,6 +491,26 @@ func (s *StateDB) StorageTrie(addr common.Address) (Trie, error) {
 	return cpy.getTrie(s.db)
 }
 
+// DirtyCode returns the code hashes of the live accounts whose code was set
+// since the last commit, such as the contracts deployed by a block.
+func (s *StateDB) DirtyCode() map[common.Address]common.Hash {
+	s.unfork()
+
+	dirty := make(map[common.Address]common.Hash)
+	collect := func(addr common.Address) {
+		if obj := s.stateObjects[addr]; obj != nil && obj.dirtyCode && !obj.deleted && !obj.suicided {
+			dirty[addr] = common.BytesToHash(obj.CodeHash())
+		}
+	}
+	for addr := range s.stateObjectsDirty {
+		collect(addr)
+	}
+	for addr := range s.journal.dirties {
+		collect(addr)
+	}
+	return dirty
+}
+
 func (s *StateDB) HasSuicided(addr common.Address) bool {
 	stateObject := s.getStateObject(addr)
 	if stateObject != nil {
@@ -415,7 +525,9 @@ func (s *StateDB) HasSuicided(addr common.Address) bool {
 
 // AddBalance adds amount to the account associated with addr.
 func (s *StateDB) AddBalance(addr common.Address, amount *big.Int) {
+	done := s.recordBalanceChange()
 	stateObject := s.GetOrNewStateObject(addr)
+	done()
 	if stateObject != nil {
 		s.unexpectedBalanceDelta.Add(s.unexpectedBalanceDelta, amount)
 		stateObject.AddBalance(amount)
@@ -424,7 +536,9 @@ func (s *StateDB) AddBalance(addr common.Address, amount *big.Int) {
 
 // SubBalance subtracts amount from the account associated with addr.
 func (s *StateDB) SubBalance(addr common.Address, amount *big.Int) {
+	done := s.recordBalanceChange()
 	stateObject := s.GetOrNewStateObject(addr)
+	done()
 	if stateObject != nil {
 		s.unexpectedBalanceDelta.Sub(s.unexpectedBalanceDelta, amount)
 		stateObject.SubBalance(amount)
@@ -589,10 +703,19 @@ func (s *StateDB) getStateObject(addr common.Address) *stateObject {
 // flag set. This is needed by the state journal to revert to the correct s-
 // destructed object instead of wiping all knowledge about the state object.
 func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
+	if s.accessRecorder != nil {
+		s.recordAccountRead(addr)
+	}
 	// Prefer live objects if any is available
 	if obj := s.stateObjects[addr]; obj != nil {
 		return obj
 	}
+	if obj := s.forkedObject(addr); obj != nil {
+		return obj
+	}
+	if s.interrupted() {
+		return nil
+	}
 	// If no live objects are available, attempt to use snapshots
 	var data *types.StateAccount
 	if s.snap != nil {
@@ -623,6 +746,7 @@ func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
 	if data == nil {
 		start := time.Now()
 		var err error
+		s.coldAccountRead()
 		data, err = s.trie.GetAccount(addr)
 		if metrics.EnabledExpensive {
 			s.AccountReads += time.Since(start)
@@ -732,6 +856,8 @@ func (db *StateDB) ForEachStorage(addr common.Address, cb func(key, value common
 // Copy creates a deep, independent copy of the state.
 // Snapshots of the copied state cannot be applied to the copy.
 func (s *StateDB) Copy() *StateDB {
+	s.unfork()
+
 	// Copy all the basic fields, initialize the memory ones
 	state := &StateDB{
 		unexpectedBalanceDelta: new(big.Int).Set(s.unexpectedBalanceDelta),
@@ -797,6 +923,12 @@ func (s *StateDB) Copy() *StateDB {
 	for hash, preimage := range s.preimages {
 		state.preimages[hash] = preimage
 	}
+	if s.keyPreimages != nil {
+		state.keyPreimages = make(map[common.Hash][]byte, len(s.keyPreimages))
+		for hash, preimage := range s.keyPreimages {
+			state.keyPreimages[hash] = preimage
+		}
+	}
 	// Do we need to copy the access list and transient storage?
 	// In practice: No. At the start of a transaction, these two lists are empty.
 	// In practice, we only ever copy state _between_ transactions/blocks, never
@@ -859,7 +991,9 @@ func (s *StateDB) RevertToSnapshot(revid int) {
 	s.unexpectedBalanceDelta = new(big.Int).Set(revision.unexpectedBalanceDelta)
 
 	// Replay the journal to undo changes and remove invalidated snapshots
+	done := s.recordRevert()
 	s.journal.revert(s, snapshot)
+	done()
 	s.validRevisions = s.validRevisions[:idx]
 }
 
@@ -872,6 +1006,7 @@ func (s *StateDB) GetRefund() uint64 {
 // the journal as well as the refunds. Finalise, however, will not push any updates
 // into the tries just yet. Only IntermediateRoot or Commit will do that.
 func (s *StateDB) Finalise(deleteEmptyObjects bool) {
+	s.recordJournalWrites()
 	addressesToPrefetch := make([][]byte, 0, len(s.journal.dirties))
 	for addr := range s.journal.dirties {
 		obj, exist := s.stateObjects[addr]
@@ -886,6 +1021,7 @@ func (s *StateDB) Finalise(deleteEmptyObjects bool) {
 		}
 		if obj.suicided || (deleteEmptyObjects && obj.empty()) {
 			obj.deleted = true
+			s.recordAccountWrite(addr)
 
 			// We need to maintain account deletions explicitly (will remain
 			// set indefinitely).
@@ -922,6 +1058,7 @@ func (s *StateDB) Finalise(deleteEmptyObjects bool) {
 // goes into transaction receipts.
 func (s *StateDB) IntermediateRoot(deleteEmptyObjects bool) common.Hash {
 	// Finalise all the dirty storage states and write them into the tries
+	s.unfork()
 	s.Finalise(deleteEmptyObjects)
 
 	// If there was a trie prefetcher operating, it gets aborted and irrevocably
@@ -1012,99 +1149,60 @@ func (s *StateDB) clearJournalAndRefund() {
 // Commit writes the state to the underlying in-memory trie database.
 func (s *StateDB) Commit(deleteEmptyObjects bool) (common.Hash, error) {
 	// Short circuit in case any database failure occurred earlier.
-	if s.dbErr != nil {
-		return common.Hash{}, fmt.Errorf("commit aborted due to earlier error: %v", s.dbErr)
+	if s.interrupted() || s.dbErr != nil {
+		return common.Hash{}, fmt.Errorf("commit aborted due to earlier error: %w", s.dbErr)
+	}
+	if s.Flat() {
+		return common.Hash{}, errFlatState
 	}
 	// Finalize any pending changes and merge everything into the tries
 	s.IntermediateRoot(deleteEmptyObjects)
 
 	// Commit objects to the trie, measuring the elapsed time
 	var (
-		accountTrieNodesUpdated int
-		accountTrieNodesDeleted int
-		storageTrieNodesUpdated int
-		storageTrieNodesDeleted int
-		nodes                   = trienode.NewMergedNodeSet()
-		codeWriter              = s.db.DiskDB().NewBatch()
+		nodes = trienode.NewMergedNodeSet()
+		root  common.Hash
+		stats commitStats
+		err   error
 	)
-	for addr := range s.stateObjectsDirty {
-		if obj := s.stateObjects[addr]; !obj.deleted {
-			// Write any contract code associated with the state object
-			if obj.code != nil && obj.dirtyCode {
-				rawdb.WriteCode(codeWriter, common.BytesToHash(obj.CodeHash()), obj.code)
-				obj.dirtyCode = false
-			}
-			// Write any storage changes in the state object to its storage trie
-			set, err := obj.commitTrie(s.db)
-			if err != nil {
-				return common.Hash{}, err
-			}
-			// Merge the dirty nodes of storage trie into global set.
-			if set != nil {
-				if err := nodes.Merge(set); err != nil {
-					return common.Hash{}, err
-				}
-				updates, deleted := set.Size()
-				storageTrieNodesUpdated += updates
-				storageTrieNodesDeleted += deleted
-			}
-		}
-		// If the contract is destructed, the storage is still left in the
-		// database as dangling data. Theoretically it's should be wiped from
-		// database as well, but in hash-based-scheme it's extremely hard to
-		// determine that if the trie nodes are also referenced by other storage,
-		// and in path-based-scheme some technical challenges are still unsolved.
-		// Although it won't affect the correctness but please fix it TODO(rjl493456442).
+	if s.commitWorkers > 1 {
+		root, stats, err = s.commitPipelined(nodes)
+	} else {
+		root, stats, err = s.commitSequential(nodes)
+	}
+	if err != nil {
+		return common.Hash{}, err
 	}
 	if len(s.stateObjectsDirty) > 0 {
 		s.stateObjectsDirty = make(map[common.Address]struct{})
 	}
-	if codeWriter.ValueSize() > 0 {
-		if err := codeWriter.Write(); err != nil {
-			log.Crit("Failed to commit dirty codes", "error", err)
-		}
-	}
-	// Write the account trie changes, measuring the amount of wasted time
-	var start time.Time
-	if metrics.EnabledExpensive {
-		start = time.Now()
-	}
-	root, set := s.trie.Commit(true)
-	// Merge the dirty nodes of account trie into global set
-	if set != nil {
-		if err := nodes.Merge(set); err != nil {
-			return common.Hash{}, err
-		}
-		accountTrieNodesUpdated, accountTrieNodesDeleted = set.Size()
-	}
 	if metrics.EnabledExpensive {
-		s.AccountCommits += time.Since(start)
-
 		accountUpdatedMeter.Mark(int64(s.AccountUpdated))
 		storageUpdatedMeter.Mark(int64(s.StorageUpdated))
 		accountDeletedMeter.Mark(int64(s.AccountDeleted))
 		storageDeletedMeter.Mark(int64(s.StorageDeleted))
-		accountTrieUpdatedMeter.Mark(int64(accountTrieNodesUpdated))
-		accountTrieDeletedMeter.Mark(int64(accountTrieNodesDeleted))
-		storageTriesUpdatedMeter.Mark(int64(storageTrieNodesUpdated))
-		storageTriesDeletedMeter.Mark(int64(storageTrieNodesDeleted))
+		accountTrieUpdatedMeter.Mark(int64(stats.accountUpdated))
+		accountTrieDeletedMeter.Mark(int64(stats.accountDeleted))
+		storageTriesUpdatedMeter.Mark(int64(stats.storageUpdated))
+		storageTriesDeletedMeter.Mark(int64(stats.storageDeleted))
 		s.AccountUpdated, s.AccountDeleted = 0, 0
 		s.StorageUpdated, s.StorageDeleted = 0, 0
 	}
 	// If snapshotting is enabled, update the snapshot tree with this new version
 	if s.snap != nil {
 		start := time.Now()
-		// Only update if there's a state transition (skip empty Clique blocks)
-		if parent := s.snap.Root(); parent != root {
+		// Only update if there's a state transition (skip empty Clique blocks),
+		// a snapshot slice isn't part of the snapshot tree
+		if parent := s.snap.Root(); s.snaps != nil && parent != root {
 			if err := s.snaps.Update(root, parent, s.convertAccountSet(s.stateObjectsDestruct), s.snapAccounts, s.snapStorage); err != nil {
 				log.Warn("Failed to update snapshot tree", "from", parent, "to", root, "err", err)
 			}
-			// Keep 128 diff layers in the memory, persistent layer is 129th.
+			// Keep 128 diff layers in the memory by default, persistent layer is 129th.
 			// - head layer is paired with HEAD state
 			// - head-1 layer is paired with HEAD-1 state
 			// - head-127 layer(bottom-most diff layer) is paired with HEAD-127 state
-			if err := s.snaps.Cap(root, 128); err != nil {
-				log.Warn("Failed to cap snapshot tree", "root", root, "layers", 128, "err", err)
+			if err := s.snaps.Cap(root, s.snaps.DiffLayers()); err != nil {
+				log.Warn("Failed to cap snapshot tree", "root", root, "layers", s.snaps.DiffLayers(), "err", err)
 			}
 		}
 		if metrics.EnabledExpensive {
@@ -1138,6 +1236,66 @@ func (s *StateDB) Commit(deleteEmptyObjects bool) (common.Hash, error) {
 	return root, nil
 }
 
+// commitSequential collects the dirty nodes of the storage tries, then of the
+// account trie, into the node set, writing the dirty contract codes to disk.
+func (s *StateDB) commitSequential(nodes *trienode.MergedNodeSet) (common.Hash, commitStats, error) {
+	var (
+		stats      commitStats
+		codeWriter = s.db.DiskDB().NewBatch()
+	)
+	for addr := range s.stateObjectsDirty {
+		if obj := s.stateObjects[addr]; !obj.deleted {
+			// Write any contract code associated with the state object
+			if obj.code != nil && obj.dirtyCode {
+				rawdb.WriteCode(codeWriter, common.BytesToHash(obj.CodeHash()), obj.code)
+				obj.dirtyCode = false
+			}
+			// Write any storage changes in the state object to its storage trie
+			set, err := obj.commitTrie(s.db)
+			if err != nil {
+				return common.Hash{}, stats, err
+			}
+			// Merge the dirty nodes of storage trie into global set.
+			if set != nil {
+				if err := nodes.Merge(set); err != nil {
+					return common.Hash{}, stats, err
+				}
+				updates, deleted := set.Size()
+				stats.storageUpdated += updates
+				stats.storageDeleted += deleted
+			}
+		}
+		// If the contract is destructed, the storage is still left in the
+		// database as dangling data. Theoretically it's should be wiped from
+		// database as well, but in hash-based-scheme it's extremely hard to
+		// determine that if the trie nodes are also referenced by other storage,
+		// and in path-based-scheme some technical challenges are still unsolved.
+		// Although it won't affect the correctness but please fix it TODO(rjl493456442).
+	}
+	if codeWriter.ValueSize() > 0 {
+		if err := codeWriter.Write(); err != nil {
+			log.Crit("Failed to commit dirty codes", "error", err)
+		}
+	}
+	// Write the account trie changes, measuring the amount of wasted time
+	var start time.Time
+	if metrics.EnabledExpensive {
+		start = time.Now()
+	}
+	root, set := s.trie.Commit(true)
+	// Merge the dirty nodes of account trie into global set
+	if set != nil {
+		if err := nodes.Merge(set); err != nil {
+			return common.Hash{}, stats, err
+		}
+		stats.accountUpdated, stats.accountDeleted = set.Size()
+	}
+	if metrics.EnabledExpensive {
+		s.AccountCommits += time.Since(start)
+	}
+	return root, stats, nil
+}
+
 // Prepare handles the preparatory steps for executing a state transition with.
 // This method must be invoked before state transition.
 //
@@ -0,0 +1,178 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/metrics"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+)
+
+// commitStats counts the trie nodes updated and deleted by a commit.
+type commitStats struct {
+	accountUpdated int
+	accountDeleted int
+	storageUpdated int
+	storageDeleted int
+}
+
+// storageCommit is the outcome of committing a single storage trie.
+type storageCommit struct {
+	set     *trienode.NodeSet
+	elapsed time.Duration
+}
+
+// codeBlob is a dirty contract code queued for writing to disk.
+type codeBlob struct {
+	hash common.Hash
+	code []byte
+}
+
+// SetCommitPipeline makes Commit overlap the hashing of the storage tries, the
+// hashing of the account trie, the assembly of the dirty node set and the disk
+// writes of the contract codes across goroutines. The storage tries are spread
+// over the given number of workers, fed through queues bounded to the same
+// size. Zero or one worker keeps the sequential commit.
+func (s *StateDB) SetCommitPipeline(workers int) {
+	s.commitWorkers = workers
+}
+
+// commitPipelined collects the dirty nodes of all the tries into the node set,
+// and writes the dirty contract codes to disk, as the sequential commit does.
+// The storage changes must have been flushed into the tries already, by
+// IntermediateRoot, so committing a trie only hashes and collects its nodes.
+func (s *StateDB) commitPipelined(nodes *trienode.MergedNodeSet) (common.Hash, commitStats, error) {
+	var (
+		stats   commitStats
+		workers = s.commitWorkers
+		objects = make(chan *stateObject, workers)
+		results = make(chan storageCommit, workers)
+		codes   = make(chan codeBlob, workers)
+		hashers sync.WaitGroup
+		writer  = make(chan struct{})
+	)
+	// Write the dirty codes in batches, while the tries are being hashed
+	go func() {
+		defer close(writer)
+
+		batch := s.db.DiskDB().NewBatch()
+		for blob := range codes {
+			rawdb.WriteCode(batch, blob.hash, blob.code)
+			if batch.ValueSize() >= ethdb.IdealBatchSize {
+				if err := batch.Write(); err != nil {
+					log.Crit("Failed to commit dirty codes", "error", err)
+				}
+				batch.Reset()
+			}
+		}
+		if batch.ValueSize() > 0 {
+			if err := batch.Write(); err != nil {
+				log.Crit("Failed to commit dirty codes", "error", err)
+			}
+		}
+	}()
+	// Hash the storage tries, the account trie doesn't depend on them as their
+	// roots were already computed by IntermediateRoot
+	for i := 0; i < workers; i++ {
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+			for obj := range objects {
+				if obj.trie == nil {
+					continue
+				}
+				start := time.Now()
+				root, set := obj.trie.Commit(false)
+				obj.data.Root = root
+				if set != nil {
+					results <- storageCommit{set: set, elapsed: time.Since(start)}
+				}
+			}
+		}()
+	}
+	var (
+		accountRoot    common.Hash
+		accountSet     *trienode.NodeSet
+		accountElapsed time.Duration
+		accountDone    = make(chan struct{})
+	)
+	go func() {
+		defer close(accountDone)
+
+		start := time.Now()
+		accountRoot, accountSet = s.trie.Commit(true)
+		accountElapsed = time.Since(start)
+	}()
+	// Feed the workers, and close the results once they're all done
+	go func() {
+		for addr := range s.stateObjectsDirty {
+			obj := s.stateObjects[addr]
+			if obj.deleted {
+				continue
+			}
+			if obj.code != nil && obj.dirtyCode {
+				codes <- codeBlob{hash: common.BytesToHash(obj.CodeHash()), code: obj.code}
+				obj.dirtyCode = false
+			}
+			objects <- obj
+		}
+		close(codes)
+		close(objects)
+		hashers.Wait()
+		close(results)
+	}()
+	// Assemble the node set as the storage tries get committed
+	var (
+		storageElapsed time.Duration
+		err            error
+	)
+	for result := range results {
+		storageElapsed += result.elapsed
+		if err != nil {
+			continue // keep draining, so that no worker is left blocked
+		}
+		if err = nodes.Merge(result.set); err != nil {
+			continue
+		}
+		updates, deleted := result.set.Size()
+		stats.storageUpdated += updates
+		stats.storageDeleted += deleted
+	}
+	<-accountDone
+	<-writer
+
+	if metrics.EnabledExpensive {
+		s.StorageCommits += storageElapsed
+		s.AccountCommits += accountElapsed
+	}
+	if err != nil {
+		return common.Hash{}, stats, err
+	}
+	if accountSet != nil {
+		if err := nodes.Merge(accountSet); err != nil {
+			return common.Hash{}, stats, err
+		}
+		stats.accountUpdated, stats.accountDeleted = accountSet.Size()
+	}
+	return accountRoot, stats, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/state/snapshot"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/trie"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+)
+
+// errFlatState is returned by the operations needing the account trie of a state
+// backed by flat snapshot data only.
+var errFlatState = errors.New("state backed by flat snapshot data only")
+
+// NewFlat creates a state of the root backed by flat snapshot data only, for the
+// states whose account trie isn't available, like the older states recoverable
+// from the snapshot reverse diffs. The state can be read and modified, but not
+// hashed, committed nor proven: the operations needing the account trie fail.
+// The storage tries are only opened if the snapshot can't serve a slot.
+func NewFlat(root common.Hash, db Database, snap snapshot.Snapshot) *StateDB {
+	sdb := &StateDB{
+		unexpectedBalanceDelta: new(big.Int),
+
+		db:                   db,
+		trie:                 &flatTrie{root: root},
+		originalRoot:         root,
+		snap:                 snap,
+		snapAccounts:         make(map[common.Hash][]byte),
+		snapStorage:          make(map[common.Hash]map[common.Hash][]byte),
+		stateObjects:         make(map[common.Address]*stateObject),
+		stateObjectsPending:  make(map[common.Address]struct{}),
+		stateObjectsDirty:    make(map[common.Address]struct{}),
+		stateObjectsDestruct: make(map[common.Address]struct{}),
+		logs:                 make(map[common.Hash][]*types.Log),
+		preimages:            make(map[common.Hash][]byte),
+		journal:              newJournal(),
+		accessList:           newAccessList(),
+		transientStorage:     newTransientStorage(),
+		hasher:               crypto.NewKeccakState(),
+	}
+	return sdb
+}
+
+// Flat reports whether the state is backed by flat snapshot data only, see
+// NewFlat.
+func (s *StateDB) Flat() bool {
+	_, flat := s.trie.(*flatTrie)
+	return flat
+}
+
+// flatTrie stands for the missing account trie of a flat state, failing all the
+// accesses. Its hash is the root of the state, whatever the changes.
+type flatTrie struct {
+	root common.Hash
+}
+
+func (t *flatTrie) GetKey([]byte) []byte { return nil }
+
+func (t *flatTrie) GetStorage(common.Address, []byte) ([]byte, error) { return nil, errFlatState }
+
+func (t *flatTrie) GetAccount(common.Address) (*types.StateAccount, error) {
+	return nil, errFlatState
+}
+
+func (t *flatTrie) UpdateStorage(common.Address, []byte, []byte) error { return errFlatState }
+
+func (t *flatTrie) UpdateAccount(common.Address, *types.StateAccount) error { return errFlatState }
+
+func (t *flatTrie) DeleteStorage(common.Address, []byte) error { return errFlatState }
+
+func (t *flatTrie) DeleteAccount(common.Address) error { return errFlatState }
+
+func (t *flatTrie) Hash() common.Hash { return t.root }
+
+func (t *flatTrie) Commit(bool) (common.Hash, *trienode.NodeSet) { return t.root, nil }
+
+// NodeIterator returns an exhausted iterator, the callers iterating the account
+// trie having to check for flat states beforehand.
+func (t *flatTrie) NodeIterator([]byte) trie.NodeIterator {
+	return trie.NewEmpty(nil).NodeIterator(nil)
+}
+
+func (t *flatTrie) Prove([]byte, uint, ethdb.KeyValueWriter) error { return errFlatState }
@@ -0,0 +1,141 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+)
+
+// Fork creates a copy-on-write child of the state. Unlike Copy, which deep
+// copies every live object up front, a fork starts out empty and copies the
+// live objects of its parent on first access only, so that reads cached by the
+// parent are shared while writes stay private to the fork. Each fork has its
+// own journal, and snapshots taken on the parent cannot be reverted on it.
+//
+// The parent must not be modified or read while any of its forks are in use,
+// but it may be forked again, and its forks may be used concurrently with one
+// another. Forks may be forked too.
+func (s *StateDB) Fork() *StateDB {
+	state := &StateDB{
+		unexpectedBalanceDelta: new(big.Int).Set(s.unexpectedBalanceDelta),
+
+		db:                   s.db,
+		trie:                 s.db.CopyTrie(s.trie),
+		originalRoot:         s.originalRoot,
+		parent:               s,
+		stateObjects:         make(map[common.Address]*stateObject),
+		stateObjectsPending:  make(map[common.Address]struct{}, len(s.stateObjectsPending)),
+		stateObjectsDirty:    make(map[common.Address]struct{}, len(s.stateObjectsDirty)),
+		stateObjectsDestruct: make(map[common.Address]struct{}, len(s.stateObjectsDestruct)),
+		ctx:                  s.ctx,
+		refund:               s.refund,
+		logs:                 make(map[common.Hash][]*types.Log, len(s.logs)),
+		logSize:              s.logSize,
+		preimages:            make(map[common.Hash][]byte, len(s.preimages)),
+		accessList:           s.accessList.Copy(),
+		transientStorage:     s.transientStorage.Copy(),
+		journal:              newJournal(),
+		hasher:               crypto.NewKeccakState(),
+		deterministic:        s.deterministic,
+	}
+	// Objects modified by the parent's current transaction are marked as
+	// in Copy, since the fork does not inherit the journal applying them.
+	for addr := range s.journal.dirties {
+		if _, exist := s.stateObjects[addr]; exist {
+			state.stateObjectsDirty[addr] = struct{}{}
+			state.stateObjectsPending[addr] = struct{}{}
+		}
+	}
+	for addr := range s.stateObjectsPending {
+		state.stateObjectsPending[addr] = struct{}{}
+	}
+	for addr := range s.stateObjectsDirty {
+		state.stateObjectsDirty[addr] = struct{}{}
+	}
+	for addr := range s.stateObjectsDestruct {
+		state.stateObjectsDestruct[addr] = struct{}{}
+	}
+	for hash, logs := range s.logs {
+		cpy := make([]*types.Log, len(logs))
+		for i, l := range logs {
+			cpy[i] = new(types.Log)
+			*cpy[i] = *l
+		}
+		state.logs[hash] = cpy
+	}
+	for hash, preimage := range s.preimages {
+		state.preimages[hash] = preimage
+	}
+	if s.keyPreimages != nil {
+		state.keyPreimages = make(map[common.Hash][]byte, len(s.keyPreimages))
+		for hash, preimage := range s.keyPreimages {
+			state.keyPreimages[hash] = preimage
+		}
+	}
+	if s.snaps != nil {
+		state.snaps = s.snaps
+		state.snap = s.snap
+
+		state.snapAccounts = make(map[common.Hash][]byte, len(s.snapAccounts))
+		for k, v := range s.snapAccounts {
+			state.snapAccounts[k] = v
+		}
+		state.snapStorage = make(map[common.Hash]map[common.Hash][]byte, len(s.snapStorage))
+		for k, v := range s.snapStorage {
+			temp := make(map[common.Hash][]byte, len(v))
+			for kk, vv := range v {
+				temp[kk] = vv
+			}
+			state.snapStorage[k] = temp
+		}
+	}
+	return state
+}
+
+// forkedObject copies the live object of the given address from the closest
+// state the fork descends from that holds one, returning nil if none does.
+func (s *StateDB) forkedObject(addr common.Address) *stateObject {
+	for parent := s.parent; parent != nil; parent = parent.parent {
+		if obj := parent.stateObjects[addr]; obj != nil {
+			cpy := obj.deepCopy(s)
+			s.setStateObject(cpy)
+			return cpy
+		}
+	}
+	return nil
+}
+
+// unfork copies all modified objects still held by the states the fork
+// descends from, and detaches the fork from them. Anything not copied is
+// unmodified and can be read from the fork's own trie.
+func (s *StateDB) unfork() {
+	if s.parent == nil {
+		return
+	}
+	for _, set := range []map[common.Address]struct{}{s.stateObjectsPending, s.stateObjectsDirty} {
+		for addr := range set {
+			if _, exist := s.stateObjects[addr]; !exist {
+				s.forkedObject(addr)
+			}
+		}
+	}
+	s.parent = nil
+}
@@ -18,7 +18,9 @@ package state
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
@@ -32,6 +34,7 @@ import (
 	"github.com/chainupcloud/arb-geth/common"
 	"github.com/chainupcloud/arb-geth/core/rawdb"
 	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
 )
 
 // Tests that updating a state trie does not leak any database writes prior to
@@ -998,3 +1001,325 @@ func TestStateDBTransientStorage(t *testing.T) {
 		t.Fatalf("transient storage mismatch: have %x, want %x", got, value)
 	}
 }
+
+// Tests that the preimages of touched account and storage keys are recorded
+// once recording is enabled, including for read-only accesses.
+func TestKeyPreimageRecording(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+	state, _ := New(types.EmptyRootHash, db, nil)
+
+	var (
+		written = common.HexToAddress("0x01")
+		read    = common.HexToAddress("0x02")
+		slot    = common.HexToHash("0x03")
+	)
+	state.SetBalance(written, big.NewInt(1))
+	state.SetBalance(read, big.NewInt(1))
+	state.SetState(read, slot, common.HexToHash("0x04"))
+	root, _ := state.Commit(false)
+
+	state, _ = New(root, db, nil)
+	if state.KeyPreimages() != nil {
+		t.Fatal("key preimages recorded without recording being enabled")
+	}
+	state.StartKeyPreimageRecording()
+	state.SetNonce(written, 1)
+	state.GetState(read, slot)
+
+	preimages := state.KeyPreimages()
+	for _, key := range [][]byte{written.Bytes(), read.Bytes(), slot.Bytes()} {
+		preimage, ok := preimages[crypto.Keccak256Hash(key)]
+		if !ok {
+			t.Fatalf("missing preimage for key %x", key)
+		}
+		if !bytes.Equal(preimage, key) {
+			t.Fatalf("wrong preimage for key %x: have %x", key, preimage)
+		}
+	}
+	if len(preimages) != 3 {
+		t.Fatalf("wrong number of preimages: have %d, want 3", len(preimages))
+	}
+}
+
+// Tests that database reads fail once the state's context is cancelled, and
+// that the cancellation aborts the commit.
+func TestStateDBContextInterrupt(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+	state, _ := New(types.EmptyRootHash, db, nil)
+
+	addr := common.HexToAddress("0x01")
+	state.SetBalance(addr, big.NewInt(1))
+	root, _ := state.Commit(false)
+
+	state, _ = New(root, db, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	state.SetContext(ctx)
+	if balance := state.GetBalance(addr); balance.Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("wrong balance before cancellation: have %v, want 1", balance)
+	}
+	cancel()
+	if balance := state.GetBalance(common.HexToAddress("0x02")); balance.Sign() != 0 {
+		t.Fatalf("unexpected balance after cancellation: %v", balance)
+	}
+	if err := state.Error(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wrong error after cancellation: have %v, want %v", err, context.Canceled)
+	}
+	if _, err := state.Commit(false); !errors.Is(err, context.Canceled) {
+		t.Fatalf("commit not aborted: %v", err)
+	}
+	// Copies don't inherit the context
+	if copied := state.Copy(); copied.ctx != nil {
+		t.Fatal("context inherited by copy")
+	}
+}
+
+// Tests that the pipelined commit produces the same state root and writes the
+// same data to disk as the sequential one.
+func TestCommitPipeline(t *testing.T) {
+	var (
+		seqDisk  = rawdb.NewMemoryDatabase()
+		pipeDisk = rawdb.NewMemoryDatabase()
+		seqDb    = NewDatabase(seqDisk)
+		pipeDb   = NewDatabase(pipeDisk)
+		seqRoot  = types.EmptyRootHash
+		pipeRoot = types.EmptyRootHash
+	)
+	for round := byte(0); round < 3; round++ {
+		seqState, _ := New(seqRoot, seqDb, nil)
+		pipeState, _ := New(pipeRoot, pipeDb, nil)
+		pipeState.SetCommitPipeline(4)
+
+		for _, state := range []*StateDB{seqState, pipeState} {
+			for i := byte(0); i < 64; i++ {
+				addr := common.BytesToAddress([]byte{i})
+				state.AddBalance(addr, big.NewInt(int64(i)+1))
+				if i%3 == 0 {
+					state.SetCode(addr, []byte{i, round})
+				}
+				for j := byte(0); j < i%8; j++ {
+					var value common.Hash
+					if (i+j+round)%4 != 0 {
+						value = common.BytesToHash([]byte{i, j, round})
+					}
+					state.SetState(addr, common.BytesToHash([]byte{j}), value)
+				}
+				if round == 2 && i%16 == 0 {
+					state.Suicide(addr)
+				}
+			}
+		}
+		var err error
+		if seqRoot, err = seqState.Commit(true); err != nil {
+			t.Fatalf("round %d: sequential commit failed: %v", round, err)
+		}
+		if pipeRoot, err = pipeState.Commit(true); err != nil {
+			t.Fatalf("round %d: pipelined commit failed: %v", round, err)
+		}
+		if seqRoot != pipeRoot {
+			t.Fatalf("round %d: root mismatch: sequential %x, pipelined %x", round, seqRoot, pipeRoot)
+		}
+		if err := seqDb.TrieDB().Commit(seqRoot, false); err != nil {
+			t.Fatalf("round %d: failed to flush sequential state: %v", round, err)
+		}
+		if err := pipeDb.TrieDB().Commit(pipeRoot, false); err != nil {
+			t.Fatalf("round %d: failed to flush pipelined state: %v", round, err)
+		}
+	}
+	// Both databases must hold exactly the same data
+	seqIt, pipeIt := seqDisk.NewIterator(nil, nil), pipeDisk.NewIterator(nil, nil)
+	defer seqIt.Release()
+	defer pipeIt.Release()
+	for seqIt.Next() {
+		if !pipeIt.Next() {
+			t.Fatalf("pipelined database missing %x", seqIt.Key())
+		}
+		if !bytes.Equal(seqIt.Key(), pipeIt.Key()) || !bytes.Equal(seqIt.Value(), pipeIt.Value()) {
+			t.Fatalf("database mismatch: sequential %x -> %x, pipelined %x -> %x", seqIt.Key(), seqIt.Value(), pipeIt.Key(), pipeIt.Value())
+		}
+	}
+	if pipeIt.Next() {
+		t.Fatalf("pipelined database has extra entry %x", pipeIt.Key())
+	}
+}
+
+// Tests that account ranges are proven against the state root, both before and
+// after the state is committed.
+func TestAccountRangeProof(t *testing.T) {
+	state, _ := New(types.EmptyRootHash, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	for i := byte(0); i < 100; i++ {
+		state.SetBalance(common.BytesToAddress([]byte{i}), big.NewInt(int64(i)+1))
+	}
+	check := func(stage string, root common.Hash) {
+		t.Helper()
+		var (
+			origin []byte
+			have   int
+		)
+		for {
+			proof, err := state.AccountRangeProof(origin, nil, 30, 0)
+			if err != nil {
+				t.Fatalf("%s: failed to prove range: %v", stage, err)
+			}
+			more, err := proof.Verify(root)
+			if err != nil {
+				t.Fatalf("%s: invalid range: %v", stage, err)
+			}
+			have += len(proof.Keys)
+			if !more {
+				break
+			}
+			origin = new(big.Int).Add(new(big.Int).SetBytes(proof.Keys[len(proof.Keys)-1]), common.Big1).FillBytes(make([]byte, common.HashLength))
+		}
+		if have != 100 {
+			t.Fatalf("%s: ranges cover %d accounts, want 100", stage, have)
+		}
+	}
+	check("pending", state.IntermediateRoot(false))
+
+	root, err := state.Commit(false)
+	if err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	state, _ = New(root, state.db, nil)
+	check("committed", root)
+}
+
+// Tests that the state accessed by each transaction is recorded, leaving out
+// the reverted writes.
+func TestAccessRecording(t *testing.T) {
+	var (
+		state, _ = New(types.EmptyRootHash, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		addrA    = common.Address{0xa}
+		addrB    = common.Address{0xb}
+		addrC    = common.Address{0xc}
+		slot     = common.Hash{0x1}
+		lists    []*TxAccessList
+	)
+	state.SetBalance(addrA, big.NewInt(1))
+	state.SetBalance(addrB, big.NewInt(1))
+	state.Finalise(true)
+
+	state.StartAccessRecording(func(list *TxAccessList) { lists = append(lists, list) })
+	state.SetTxContext(common.Hash{0x1}, 0)
+	state.GetBalance(addrA)
+	state.SetState(addrB, slot, common.Hash{0x2})
+	snap := state.Snapshot()
+	state.AddBalance(addrC, big.NewInt(1))
+	state.RevertToSnapshot(snap)
+	state.Finalise(true)
+
+	state.SetTxContext(common.Hash{0x2}, 1)
+	state.GetState(addrB, slot)
+	state.StopAccessRecording()
+
+	want := []*TxAccessList{
+		{
+			TxHash:  common.Hash{0x1},
+			TxIndex: 0,
+			Reads: types.AccessList{
+				{Address: addrA, StorageKeys: []common.Hash{}},
+				{Address: addrB, StorageKeys: []common.Hash{slot}},
+				{Address: addrC, StorageKeys: []common.Hash{}},
+			},
+			Writes: types.AccessList{
+				{Address: addrB, StorageKeys: []common.Hash{slot}},
+			},
+			BalanceDeltas: []common.Address{addrC},
+		},
+		{
+			TxHash:        common.Hash{0x2},
+			TxIndex:       1,
+			Reads:         types.AccessList{{Address: addrB, StorageKeys: []common.Hash{slot}}},
+			Writes:        types.AccessList{},
+			BalanceDeltas: []common.Address{},
+		},
+	}
+	if len(lists) != len(want) {
+		t.Fatalf("have %d access lists, want %d", len(lists), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(lists[i], want[i]) {
+			t.Errorf("access list %d mismatch:\nhave %+v\nwant %+v", i, *lists[i], *want[i])
+		}
+	}
+}
+
+// Tests that forks of a state diverge independently of each other and of
+// their parent, and end up with the same roots as full copies would.
+func TestFork(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+	state, _ := New(types.EmptyRootHash, db, nil)
+	for i := byte(0); i < 16; i++ {
+		addr := common.BytesToAddress([]byte{i})
+		state.SetBalance(addr, big.NewInt(int64(i)))
+		state.SetState(addr, common.Hash{i}, common.Hash{i})
+	}
+	root, _ := state.Commit(false)
+	if err := state.Database().TrieDB().Commit(root, false); err != nil {
+		t.Fatalf("failed to commit state trie: %v", err)
+	}
+	// Build a base state with cached, pending and in-flight modifications
+	base, _ := New(root, db, nil)
+	for i := byte(0); i < 16; i++ {
+		base.GetBalance(common.BytesToAddress([]byte{i}))
+	}
+	base.AddBalance(common.BytesToAddress([]byte{1}), big.NewInt(100))
+	base.Finalise(true)
+	base.SetState(common.BytesToAddress([]byte{2}), common.Hash{2}, common.Hash{0xff})
+
+	mutate := func(s *StateDB, n byte) {
+		for i := byte(0); i < 16; i++ {
+			addr := common.BytesToAddress([]byte{i})
+			s.AddBalance(addr, big.NewInt(int64(n)))
+			s.SetState(addr, common.Hash{i}, common.Hash{n})
+		}
+		s.Suicide(common.BytesToAddress([]byte{n}))
+		s.SetNonce(common.Address{0xaa, n}, uint64(n))
+	}
+	var (
+		forks = make([]*StateDB, 4)
+		wg    sync.WaitGroup
+	)
+	for i := range forks {
+		forks[i] = base.Fork()
+		wg.Add(1)
+		go func(s *StateDB, n byte) {
+			defer wg.Done()
+			mutate(s, n)
+		}(forks[i], byte(i+1))
+	}
+	wg.Wait()
+
+	// The base state must be left untouched by its forks
+	if have := base.GetBalance(common.BytesToAddress([]byte{1})); have.Uint64() != 101 {
+		t.Errorf("base balance mismatch: have %v, want 101", have)
+	}
+	if have := base.GetState(common.BytesToAddress([]byte{2}), common.Hash{2}); have != (common.Hash{0xff}) {
+		t.Errorf("base storage mismatch: have %x, want %x", have, common.Hash{0xff})
+	}
+	if base.Exist(common.Address{0xaa, 1}) || base.HasSuicided(common.BytesToAddress([]byte{1})) {
+		t.Errorf("base state modified by forks")
+	}
+	// Every fork must match a full copy of the base with the same changes
+	for i, fork := range forks {
+		n := byte(i + 1)
+		if have := fork.GetBalance(common.BytesToAddress([]byte{9})); have.Uint64() != 9+uint64(n) {
+			t.Errorf("fork %d: balance mismatch: have %v, want %d", i, have, 9+n)
+		}
+		cpy := base.Copy()
+		mutate(cpy, n)
+		if have, want := fork.IntermediateRoot(true), cpy.IntermediateRoot(true); have != want {
+			t.Errorf("fork %d: root mismatch: have %x, want %x", i, have, want)
+		}
+	}
+	// Forks of forks must leave their parent fork untouched too
+	child := forks[0].Fork()
+	mutate(child, 8)
+	want := forks[0].Copy().IntermediateRoot(true)
+	if have := child.IntermediateRoot(true); have == want {
+		t.Errorf("child fork root matches parent fork")
+	}
+	if have, _ := forks[0].Commit(true); have != want {
+		t.Errorf("parent fork root changed: have %x, want %x", have, want)
+	}
+}
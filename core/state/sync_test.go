@@ -367,6 +367,146 @@ func TestIterativeDelayedStateSync(t *testing.T) {
 	checkStateAccounts(t, dstDb, srcRoot, srcAccounts)
 }
 
+// Tests that the storage tries and codes of prioritized accounts are retrieved
+// before the rest of the state.
+func TestPrioritizedStateSync(t *testing.T) {
+	// Create a random state to copy
+	_, srcDb, srcRoot, srcAccounts := makeTestState()
+	srcState, _ := New(srcRoot, srcDb, nil)
+
+	// Prioritize two accounts with storage, one of them with code too
+	prioritized := []*testAccount{srcAccounts[0], srcAccounts[5]}
+
+	dstDb := rawdb.NewMemoryDatabase()
+	sched := NewStateSync(srcRoot, dstDb, nil, srcDb.TrieDB().Scheme())
+	for _, acc := range prioritized {
+		sched.Prioritize(crypto.Keccak256Hash(acc.address[:]))
+	}
+	var done bool
+	for {
+		// Retrieve one item at a time, so the ordering is observable
+		paths, nodes, codes := sched.Missing(1)
+		if len(paths)+len(codes) == 0 {
+			break
+		}
+		for _, hash := range codes {
+			data, err := srcDb.ContractCode(common.Hash{}, hash)
+			if err != nil {
+				t.Fatalf("failed to retrieve contract bytecode for %x", hash)
+			}
+			if err := sched.ProcessCode(trie.CodeSyncResult{Hash: hash, Data: data}); err != nil {
+				t.Fatalf("failed to process result %v", err)
+			}
+		}
+		for i, path := range paths {
+			data, err := srcDb.TrieDB().Node(nodes[i])
+			if err != nil {
+				t.Fatalf("failed to retrieve node data for %x", nodes[i])
+			}
+			if err := sched.ProcessNode(trie.NodeSyncResult{Path: path, Data: data}); err != nil {
+				t.Fatalf("failed to process result %v", err)
+			}
+		}
+		batch := dstDb.NewBatch()
+		if err := sched.Commit(batch); err != nil {
+			t.Fatalf("failed to commit data: %v", err)
+		}
+		batch.Write()
+
+		if done || sched.UrgentPending() > 0 {
+			continue
+		}
+		done = true
+		if sched.Pending() == 0 {
+			t.Fatalf("prioritized accounts completed only with the rest of the state")
+		}
+		for _, acc := range prioritized {
+			obj := srcState.getStateObject(acc.address)
+			tr, err := trie.New(trie.StorageTrieID(srcRoot, crypto.Keccak256Hash(acc.address[:]), obj.data.Root), trie.NewDatabase(dstDb))
+			if err != nil {
+				t.Fatalf("storage trie of %x missing: %v", acc.address, err)
+			}
+			it := tr.NodeIterator(nil)
+			for it.Next(true) {
+			}
+			if err := it.Error(); err != nil {
+				t.Fatalf("storage trie of %x incomplete: %v", acc.address, err)
+			}
+			if len(acc.code) > 0 && !rawdb.HasCode(dstDb, crypto.Keccak256Hash(acc.code)) {
+				t.Fatalf("code of %x missing", acc.address)
+			}
+		}
+	}
+	if !done {
+		t.Fatalf("prioritized accounts never completed")
+	}
+	// Cross check that the two states are in sync
+	checkStateAccounts(t, dstDb, srcRoot, srcAccounts)
+}
+
+// Tests that storage trie nodes are handed out round robin across the accounts,
+// respecting the per-account and the overall concurrency caps.
+func TestStorageSyncConcurrency(t *testing.T) {
+	// Create a random state to copy
+	_, srcDb, srcRoot, srcAccounts := makeTestState()
+
+	// Create a destination state and sync with the scheduler
+	dstDb := rawdb.NewMemoryDatabase()
+	sched := NewStateSync(srcRoot, dstDb, nil, srcDb.TrieDB().Scheme())
+	sched.SetStorageConcurrency(1, 4)
+
+	for {
+		paths, nodes, codes := sched.Missing(0)
+		if len(paths)+len(codes) == 0 {
+			break
+		}
+		var (
+			storage int
+			owners  = make(map[string]int)
+		)
+		for _, path := range paths {
+			if len(path) < 2*common.HashLength {
+				continue
+			}
+			storage++
+			owners[path[:2*common.HashLength]]++
+		}
+		if storage > 4 {
+			t.Fatalf("storage fetches above the overall cap: have %d, want at most 4", storage)
+		}
+		for owner, fetches := range owners {
+			if fetches > 1 {
+				t.Fatalf("storage fetches of %x above the per-account cap: have %d, want at most 1", owner, fetches)
+			}
+		}
+		for _, hash := range codes {
+			data, err := srcDb.ContractCode(common.Hash{}, hash)
+			if err != nil {
+				t.Fatalf("failed to retrieve contract bytecode for %x", hash)
+			}
+			if err := sched.ProcessCode(trie.CodeSyncResult{Hash: hash, Data: data}); err != nil {
+				t.Fatalf("failed to process result %v", err)
+			}
+		}
+		for i, path := range paths {
+			data, err := srcDb.TrieDB().Node(nodes[i])
+			if err != nil {
+				t.Fatalf("failed to retrieve node data for %x", nodes[i])
+			}
+			if err := sched.ProcessNode(trie.NodeSyncResult{Path: path, Data: data}); err != nil {
+				t.Fatalf("failed to process result %v", err)
+			}
+		}
+		batch := dstDb.NewBatch()
+		if err := sched.Commit(batch); err != nil {
+			t.Fatalf("failed to commit data: %v", err)
+		}
+		batch.Write()
+	}
+	// Cross check that the two states are in sync
+	checkStateAccounts(t, dstDb, srcRoot, srcAccounts)
+}
+
 // Tests that given a root hash, a trie can sync iteratively on a single thread,
 // requesting retrieval tasks and returning all of them in one go, however in a
 // random order.
@@ -674,3 +814,80 @@ func TestIncompleteStateSync(t *testing.T) {
 		rawdb.WriteTrieNode(dstDb, owner, inner, hash, val, scheme)
 	}
 }
+
+// Tests that the code shared by clone contracts is retrieved once for all of them,
+// and that the codes already in the database aren't retrieved at all.
+func TestCloneCodeSyncDedup(t *testing.T) {
+	var (
+		srcDisk  = rawdb.NewMemoryDatabase()
+		srcDb    = NewDatabase(srcDisk)
+		state, _ = New(types.EmptyRootHash, srcDb, nil)
+
+		clone    = []byte{0x36, 0x3d, 0x3d, 0x37} // stands for a minimal proxy
+		local    = []byte{0x60, 0x00}
+		accounts []*testAccount
+	)
+	for i := 0; i < 300; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(i + 1)))
+		code := clone
+		if i%100 == 0 {
+			code = local
+		}
+		state.SetNonce(addr, 1)
+		state.SetCode(addr, code)
+		accounts = append(accounts, &testAccount{address: addr, balance: new(big.Int), nonce: 1, code: code})
+	}
+	srcRoot, _ := state.Commit(false)
+	srcDb.TrieDB().Commit(srcRoot, false)
+
+	// Sync into a database already holding one of the codes
+	dstDb := rawdb.NewMemoryDatabase()
+	rawdb.WriteCode(dstDb, crypto.Keccak256Hash(local), local)
+	sched := NewStateSync(srcRoot, dstDb, nil, srcDb.TrieDB().Scheme())
+
+	fetched := make(map[common.Hash]int)
+	for {
+		paths, nodes, codes := sched.Missing(0)
+		if len(paths)+len(codes) == 0 {
+			break
+		}
+		for _, hash := range codes {
+			fetched[hash]++
+			data, err := srcDb.ContractCode(common.Hash{}, hash)
+			if err != nil {
+				t.Fatalf("failed to retrieve contract bytecode for %x", hash)
+			}
+			if err := sched.ProcessCode(trie.CodeSyncResult{Hash: hash, Data: data}); err != nil {
+				t.Fatalf("failed to process result %v", err)
+			}
+		}
+		for i, path := range paths {
+			data, err := srcDb.TrieDB().Node(nodes[i])
+			if err != nil {
+				t.Fatalf("failed to retrieve node data for %x", nodes[i])
+			}
+			if err := sched.ProcessNode(trie.NodeSyncResult{Path: path, Data: data}); err != nil {
+				t.Fatalf("failed to process result %v", err)
+			}
+		}
+		batch := dstDb.NewBatch()
+		if err := sched.Commit(batch); err != nil {
+			t.Fatalf("failed to commit data: %v", err)
+		}
+		batch.Write()
+	}
+	// Codes found in the database may have completed the last nodes
+	batch := dstDb.NewBatch()
+	if err := sched.Commit(batch); err != nil {
+		t.Fatalf("failed to commit data: %v", err)
+	}
+	batch.Write()
+
+	if len(fetched) != 1 || fetched[crypto.Keccak256Hash(clone)] != 1 {
+		t.Errorf("codes retrieved: have %v, want the clone code once", fetched)
+	}
+	if stats := sched.Stats(); stats.CodeRefHits == 0 || stats.DatabaseHits == 0 {
+		t.Errorf("shared and known codes not accounted: %+v", stats)
+	}
+	checkStateAccounts(t, dstDb, srcRoot, accounts)
+}
@@ -287,6 +287,52 @@ func (sf *subfetcher) abort() {
 	<-sf.term
 }
 
+// storageBatchGetter is implemented by the tries resolving many storage slots
+// in a single traversal.
+type storageBatchGetter interface {
+	GetStorageBatch(addr common.Address, keys [][]byte) ([][]byte, error)
+}
+
+// prefetchBatchSize is the number of storage slots a storage trie supporting
+// batch lookups resolves at once, before checking for termination again.
+const prefetchBatchSize = 32
+
+// prefetch loads the first task, or the first storage slots at once if the trie
+// resolves them in batches, returning the number of tasks consumed.
+func (sf *subfetcher) prefetch(tasks [][]byte) int {
+	if batcher, ok := sf.trie.(storageBatchGetter); ok && sf.owner != (common.Hash{}) {
+		count := len(tasks)
+		if count > prefetchBatchSize {
+			count = prefetchBatchSize
+		}
+		keys := make([][]byte, 0, count)
+		for _, task := range tasks[:count] {
+			if _, ok := sf.seen[string(task)]; ok {
+				sf.dups++
+				continue
+			}
+			sf.seen[string(task)] = struct{}{}
+			keys = append(keys, task)
+		}
+		if len(keys) > 0 {
+			batcher.GetStorageBatch(sf.addr, keys)
+		}
+		return count
+	}
+	task := tasks[0]
+	if _, ok := sf.seen[string(task)]; ok {
+		sf.dups++
+		return 1
+	}
+	if len(task) == common.AddressLength {
+		sf.trie.GetAccount(common.BytesToAddress(task))
+	} else {
+		sf.trie.GetStorage(sf.addr, task)
+	}
+	sf.seen[string(task)] = struct{}{}
+	return 1
+}
+
 // loop waits for new tasks to be scheduled and keeps loading them until it runs
 // out of tasks or its underlying trie is retrieved for committing.
 func (sf *subfetcher) loop() {
@@ -320,7 +366,7 @@ func (sf *subfetcher) loop() {
 			sf.lock.Unlock()
 
 			// Prefetch any tasks until the loop is interrupted
-			for i, task := range tasks {
+			for i := 0; i < len(tasks); {
 				select {
 				case <-sf.stop:
 					// If termination is requested, add any leftover back and return
@@ -334,17 +380,8 @@ func (sf *subfetcher) loop() {
 					ch <- sf.db.CopyTrie(sf.trie)
 
 				default:
-					// No termination request yet, prefetch the next entry
-					if _, ok := sf.seen[string(task)]; ok {
-						sf.dups++
-					} else {
-						if len(task) == common.AddressLength {
-							sf.trie.GetAccount(common.BytesToAddress(task))
-						} else {
-							sf.trie.GetStorage(sf.addr, task)
-						}
-						sf.seen[string(task)] = struct{}{}
-					}
+					// No termination request yet, prefetch the next entries
+					i += sf.prefetch(tasks[i:])
 				}
 			}
 
@@ -17,8 +17,11 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"math/big"
+	"sync/atomic"
+	"time"
 
 	"github.com/chainupcloud/arb-geth/common"
 	"github.com/chainupcloud/arb-geth/consensus"
@@ -37,6 +40,9 @@ type StateProcessor struct {
 	config *params.ChainConfig // Chain configuration options
 	bc     *BlockChain         // Canonical block chain
 	engine consensus.Engine    // Consensus engine used for block rewards
+	hooks  txHooks             // Hooks called around the transactions
+
+	parallel atomic.Int32 // Number of transactions executed concurrently, see SetParallelExecution
 }
 
 // NewStateProcessor initialises a new StateProcessor.
@@ -48,6 +54,15 @@ func NewStateProcessor(config *params.ChainConfig, bc *BlockChain, engine consen
 	}
 }
 
+// configAt returns the chain config in effect for the given block, following
+// the runtime updates of the chain parameters.
+func (p *StateProcessor) configAt(number uint64) *params.ChainConfig {
+	if p.bc == nil {
+		return p.config
+	}
+	return p.bc.ConfigAt(number)
+}
+
 // Process processes the state changes according to the Ethereum rules by running
 // the transaction messages using the statedb and applying any rewards to both
 // the processor (coinbase) and any included uncles.
@@ -55,7 +70,16 @@ func NewStateProcessor(config *params.ChainConfig, bc *BlockChain, engine consen
 // Process returns the receipts and logs accumulated during the process and
 // returns the amount of gas that was used in the process. If any of the
 // transactions failed to execute due to insufficient gas it will return an error.
-func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg vm.Config) (types.Receipts, []*types.Log, uint64, error) {
+// If the context is cancelled, the transaction being executed is interrupted and
+// the context's error is returned.
+func (p *StateProcessor) Process(ctx context.Context, block *types.Block, statedb *state.StateDB, cfg vm.Config) (types.Receipts, []*types.Log, uint64, error) {
+	return p.ProcessStream(ctx, block, statedb, cfg, nil)
+}
+
+// ProcessStream is like Process, but streams the result of each transaction to
+// the stream as soon as it's executed, which may abort the processing early. The
+// transactions are executed serially if a stream is given.
+func (p *StateProcessor) ProcessStream(ctx context.Context, block *types.Block, statedb *state.StateDB, cfg vm.Config, stream *TxStream) (types.Receipts, []*types.Log, uint64, error) {
 	var (
 		receipts    types.Receipts
 		usedGas     = new(uint64)
@@ -64,39 +88,94 @@ func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg
 		blockNumber = block.Number()
 		allLogs     []*types.Log
 		gp          = new(GasPool).AddGas(block.GasLimit())
+		hooks       = p.hooks.forBlock()
+		replay      = isBlockReplay(ctx)
+		config      = p.configAt(block.NumberU64())
 	)
 	// Mutate the block and state according to any hard-fork specs
-	if p.config.DAOForkSupport && p.config.DAOForkBlock != nil && p.config.DAOForkBlock.Cmp(block.Number()) == 0 {
+	if config.DAOForkSupport && config.DAOForkBlock != nil && config.DAOForkBlock.Cmp(block.Number()) == 0 {
 		misc.ApplyDAOHardFork(statedb)
 	}
 	var (
 		context = NewEVMBlockContext(header, p.bc, nil)
-		vmenv   = vm.NewEVM(context, vm.TxContext{}, statedb, p.config, cfg)
-		signer  = types.MakeSigner(p.config, header.Number, header.Time)
+		vmenv   = vm.NewEVM(context, vm.TxContext{}, statedb, config, cfg)
+		signer  = types.MakeSigner(config, header.Number, header.Time)
 	)
+	// Interrupt the EVM if the context is cancelled mid-transaction
+	if done := ctx.Done(); done != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-done:
+				vmenv.Cancel()
+			case <-finished:
+			}
+		}()
+	}
+	// Execute the transactions optimistically in parallel if enabled
+	if workers := int(p.parallel.Load()); workers > 1 && hooks == nil && stream == nil && cfg.Tracer == nil && !statedb.RecordingAccesses() && config.IsByzantium(blockNumber) {
+		receipts, allLogs, err := p.processParallel(ctx, block, statedb, cfg, vmenv, signer, gp, usedGas, workers)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		return p.finalize(block, statedb, receipts, allLogs, *usedGas)
+	}
 	// Iterate over and process the individual transactions
 	for i, tx := range block.Transactions() {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, 0, fmt.Errorf("processing of block %d aborted at tx %d: %w", blockNumber, i, err)
+		}
 		msg, err := TransactionToMessage(tx, signer, header.BaseFee)
 		if err != nil {
 			return nil, nil, 0, fmt.Errorf("could not apply tx %d [%v]: %w", i, tx.Hash().Hex(), err)
 		}
 		statedb.SetTxContext(tx.Hash(), i)
-		receipt, _, err := applyTransaction(msg, p.config, gp, statedb, blockNumber, blockHash, tx, usedGas, vmenv, nil)
+		var env *TxHookEnv
+		if hooks != nil {
+			env = &TxHookEnv{Block: block, Tx: tx, Index: i, From: msg.From, State: statedb, Replay: replay}
+			hooks.runPre(env)
+		}
+		start := time.Now()
+		receipt, _, err := applyTransaction(msg, config, gp, statedb, blockNumber, blockHash, tx, usedGas, vmenv, nil)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// The result of an interrupted transaction can't be trusted
+			return nil, nil, 0, fmt.Errorf("processing of block %d aborted at tx %d: %w", blockNumber, i, ctxErr)
+		}
 		if err != nil {
 			return nil, nil, 0, fmt.Errorf("could not apply tx %d [%v]: %w", i, tx.Hash().Hex(), err)
 		}
+		if hooks != nil {
+			env.Receipt = receipt
+			hooks.runPost(env)
+		}
+		elapsed := time.Since(start)
 		receipts = append(receipts, receipt)
 		allLogs = append(allLogs, receipt.Logs...)
+
+		err = stream.send(i, tx, receipt, elapsed, func() common.Hash {
+			return statedb.IntermediateRoot(config.IsEIP158(blockNumber))
+		})
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("processing of block %d aborted at tx %d: %w", blockNumber, i, err)
+		}
 	}
+	return p.finalize(block, statedb, receipts, allLogs, *usedGas)
+}
+
+// finalize applies the withdrawals and the consensus engine specific extras of
+// the block once its transactions are executed.
+func (p *StateProcessor) finalize(block *types.Block, statedb *state.StateDB, receipts types.Receipts, allLogs []*types.Log, usedGas uint64) (types.Receipts, []*types.Log, uint64, error) {
+	header := block.Header()
 	// Fail if Shanghai not enabled and len(withdrawals) is non-zero.
 	withdrawals := block.Withdrawals()
-	if len(withdrawals) > 0 && !p.config.IsShanghai(block.Number(), block.Time(), types.DeserializeHeaderExtraInformation(header).ArbOSFormatVersion) {
+	if len(withdrawals) > 0 && !p.configAt(block.NumberU64()).IsShanghai(block.Number(), block.Time(), types.DeserializeHeaderExtraInformation(header).ArbOSFormatVersion) {
 		return nil, nil, 0, fmt.Errorf("withdrawals before shanghai")
 	}
 	// Finalize the block, applying any consensus engine specific extras (e.g. block rewards)
 	p.engine.Finalize(p.bc, header, statedb, block.Transactions(), block.Uncles(), withdrawals)
 
-	return receipts, allLogs, *usedGas, nil
+	return receipts, allLogs, usedGas, nil
 }
 
 func applyTransaction(msg *Message, config *params.ChainConfig, gp *GasPool, statedb *state.StateDB, blockNumber *big.Int, blockHash common.Hash, tx *types.Transaction, usedGas *uint64, evm *vm.EVM, resultFilter func(*ExecutionResult) error) (*types.Receipt, *ExecutionResult, error) {
@@ -126,9 +205,15 @@ func applyTransaction(msg *Message, config *params.ChainConfig, gp *GasPool, sta
 	}
 	*usedGas += result.UsedGas
 
+	return newReceipt(tx, result, root, *usedGas, statedb, blockNumber, blockHash, evm), result, err
+}
+
+// newReceipt creates the receipt of a transaction executed by the EVM, whose
+// logs are held by the statedb.
+func newReceipt(tx *types.Transaction, result *ExecutionResult, root []byte, usedGas uint64, statedb *state.StateDB, blockNumber *big.Int, blockHash common.Hash, evm *vm.EVM) *types.Receipt {
 	// Create a new receipt for the transaction, storing the intermediate root and gas used
 	// by the tx.
-	receipt := &types.Receipt{Type: tx.Type(), PostState: root, CumulativeGasUsed: *usedGas}
+	receipt := &types.Receipt{Type: tx.Type(), PostState: root, CumulativeGasUsed: usedGas}
 	if result.Failed() {
 		receipt.Status = types.ReceiptStatusFailed
 	} else {
@@ -149,7 +234,7 @@ func applyTransaction(msg *Message, config *params.ChainConfig, gp *GasPool, sta
 	receipt.BlockNumber = blockNumber
 	receipt.TransactionIndex = uint(statedb.TxIndex())
 	evm.ProcessingHook.FillReceiptInfo(receipt)
-	return receipt, result, err
+	return receipt
 }
 
 // ApplyTransaction attempts to apply a transaction to the given state database
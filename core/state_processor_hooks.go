@@ -0,0 +1,184 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"math/big"
+	"sync"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/core/types"
+)
+
+// TxHookEnv is the environment of a transaction passed to the processing hooks.
+// The state must not be modified by the hooks.
+type TxHookEnv struct {
+	Block   *types.Block
+	Tx      *types.Transaction
+	Index   int            // Index of the transaction in the block
+	From    common.Address // Sender of the transaction
+	State   *state.StateDB // State before the transaction for pre hooks, after it for post hooks
+	Receipt *types.Receipt // Receipt of the transaction, post hooks only
+	Replay  bool           // Whether the block is replayed to recreate its state, rather than imported
+}
+
+// TxHook is called by the state processor around the transactions it applies,
+// both when importing blocks and when replaying them to recreate their state.
+type TxHook func(env *TxHookEnv)
+
+type txHook struct {
+	fn        TxHook
+	addresses map[common.Address]struct{} // Addresses the hook is filtered by, nil for all transactions
+}
+
+// txHooks holds the hooks registered on a state processor.
+type txHooks struct {
+	pre, post map[uint64]*txHook
+	nextID    uint64
+	lock      sync.RWMutex
+}
+
+type blockReplayKey struct{}
+
+// WithBlockReplay returns a context marking the blocks processed with it as
+// replayed to recreate their state, which the transaction hooks are told about.
+func WithBlockReplay(ctx context.Context) context.Context {
+	return context.WithValue(ctx, blockReplayKey{}, true)
+}
+
+func isBlockReplay(ctx context.Context) bool {
+	replay, _ := ctx.Value(blockReplayKey{}).(bool)
+	return replay
+}
+
+// AddPreTxHook registers a hook called before every transaction sent from or to
+// one of the given addresses, or before every transaction if none is given. The
+// returned function unregisters the hook.
+func (p *StateProcessor) AddPreTxHook(fn TxHook, addresses ...common.Address) func() {
+	return p.hooks.add(&p.hooks.pre, fn, addresses)
+}
+
+// AddPostTxHook registers a hook called after every transaction sent from or to
+// one of the given addresses or changing the balance of one of them, or after
+// every transaction if none is given. The returned function unregisters the hook.
+func (p *StateProcessor) AddPostTxHook(fn TxHook, addresses ...common.Address) func() {
+	return p.hooks.add(&p.hooks.post, fn, addresses)
+}
+
+func (h *txHooks) add(hooks *map[uint64]*txHook, fn TxHook, addresses []common.Address) func() {
+	hook := &txHook{fn: fn}
+	if len(addresses) > 0 {
+		hook.addresses = make(map[common.Address]struct{}, len(addresses))
+		for _, addr := range addresses {
+			hook.addresses[addr] = struct{}{}
+		}
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if *hooks == nil {
+		*hooks = make(map[uint64]*txHook)
+	}
+	id := h.nextID
+	h.nextID++
+	(*hooks)[id] = hook
+
+	return func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		delete(*hooks, id)
+	}
+}
+
+// blockTxHooks is the snapshot of the hooks applying to the processing of a block.
+type blockTxHooks struct {
+	pre, post []*txHook
+	balances  map[common.Address]*big.Int // Balances of the addresses the post hooks are filtered by, before the transaction
+}
+
+// forBlock snapshots the registered hooks, nil if there are none.
+func (h *txHooks) forBlock() *blockTxHooks {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	if len(h.pre) == 0 && len(h.post) == 0 {
+		return nil
+	}
+	hooks := new(blockTxHooks)
+	for _, hook := range h.pre {
+		hooks.pre = append(hooks.pre, hook)
+	}
+	for _, hook := range h.post {
+		hooks.post = append(hooks.post, hook)
+		if hook.addresses != nil && hooks.balances == nil {
+			hooks.balances = make(map[common.Address]*big.Int)
+		}
+		for addr := range hook.addresses {
+			hooks.balances[addr] = nil
+		}
+	}
+	return hooks
+}
+
+// matches reports whether the transaction is sent from or to one of the addresses
+// of the hook.
+func (h *txHook) matches(env *TxHookEnv) bool {
+	if h.addresses == nil {
+		return true
+	}
+	if _, ok := h.addresses[env.From]; ok {
+		return true
+	}
+	if to := env.Tx.To(); to != nil {
+		if _, ok := h.addresses[*to]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// runPre calls the pre hooks matching the transaction, and records the balances
+// the post hooks are filtered by.
+func (h *blockTxHooks) runPre(env *TxHookEnv) {
+	for _, hook := range h.pre {
+		if hook.matches(env) {
+			hook.fn(env)
+		}
+	}
+	for addr := range h.balances {
+		h.balances[addr] = env.State.GetBalance(addr)
+	}
+}
+
+// runPost calls the post hooks matching the transaction or whose addresses had
+// their balance changed by it.
+func (h *blockTxHooks) runPost(env *TxHookEnv) {
+	for _, hook := range h.post {
+		match := hook.matches(env)
+		for addr := range hook.addresses {
+			if match {
+				break
+			}
+			match = env.State.GetBalance(addr).Cmp(h.balances[addr]) != 0
+		}
+		if match {
+			hook.fn(env)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that the transaction hooks are called around the transactions involving
+// their addresses, on import and on replay, until unregistered.
+func TestTxHooks(t *testing.T) {
+	var (
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		sender   = crypto.PubkeyToAddress(key.PublicKey)
+		alice    = common.Address{0xa}
+		bob      = common.Address{0xb}
+		coinbase = common.Address{0xc}
+		gspec    = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{sender: {Balance: big.NewInt(params.Ether)}},
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	// Every block pays alice then bob, tipping the coinbase
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 2, func(i int, gen *BlockGen) {
+		gen.SetCoinbase(coinbase)
+		price := new(big.Int).Add(gen.header.BaseFee, big.NewInt(1))
+		for _, to := range []common.Address{alice, bob} {
+			tx, err := types.SignTx(types.NewTransaction(gen.TxNonce(sender), to, big.NewInt(1), params.TxGas, price, nil), signer, key)
+			if err != nil {
+				t.Fatalf("failed to sign tx: %v", err)
+			}
+			gen.AddTx(tx)
+		}
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	var pre, post, tipped []*TxHookEnv
+	removePre := chain.Processor().AddPreTxHook(func(env *TxHookEnv) {
+		// alice is only paid in the hooked transactions
+		if env.Receipt != nil || (len(pre) == 0 && env.State.GetBalance(alice).Sign() != 0) {
+			t.Errorf("pre hook called after the transaction")
+		}
+		pre = append(pre, env)
+	}, alice)
+	chain.Processor().AddPostTxHook(func(env *TxHookEnv) { post = append(post, env) }, bob)
+	chain.Processor().AddPostTxHook(func(env *TxHookEnv) { tipped = append(tipped, env) }, coinbase)
+
+	if _, err := chain.InsertChain(blocks[:1]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if len(pre) != 1 || *pre[0].Tx.To() != alice || pre[0].From != sender || pre[0].Replay {
+		t.Fatalf("unexpected pre hook calls: %v", pre)
+	}
+	if len(post) != 1 || *post[0].Tx.To() != bob || post[0].Index != 1 || post[0].Receipt == nil {
+		t.Fatalf("unexpected post hook calls: %v", post)
+	}
+	// The coinbase is neither sender nor recipient, but its balance changes
+	if len(tipped) != 2 {
+		t.Fatalf("coinbase hook called %d times, want 2", len(tipped))
+	}
+	// Unregistered hooks aren't called anymore
+	removePre()
+	if _, err := chain.InsertChain(blocks[1:]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	if len(pre) != 1 || len(post) != 2 {
+		t.Fatalf("have %d pre and %d post hook calls, want 1 and 2", len(pre), len(post))
+	}
+	// Replays are told apart
+	statedb, _ := chain.StateAt(blocks[0].Root())
+	if _, _, _, err := chain.Processor().Process(WithBlockReplay(context.Background()), blocks[1], statedb, vm.Config{}); err != nil {
+		t.Fatalf("failed to replay block: %v", err)
+	}
+	if len(post) != 3 || !post[2].Replay {
+		t.Fatalf("replayed block not reported as such")
+	}
+}
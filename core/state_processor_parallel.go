@@ -0,0 +1,252 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/metrics"
+)
+
+var (
+	parallelSpeculatedMeter = metrics.NewRegisteredMeter("chain/parallel/speculated", nil)
+	parallelMergedMeter     = metrics.NewRegisteredMeter("chain/parallel/merged", nil)
+	parallelReexecutedMeter = metrics.NewRegisteredMeter("chain/parallel/reexecuted", nil)
+	parallelSerialMeter     = metrics.NewRegisteredMeter("chain/parallel/serial", nil)
+)
+
+// parallelWindowFactor bounds the number of transactions executed speculatively
+// at once, as a multiple of the number of workers.
+const parallelWindowFactor = 4
+
+// SetParallelExecution makes the processor execute up to the given number of
+// transactions of a block concurrently, or disables it if below 2. This is
+// experimental. The transactions are executed optimistically against the state
+// before them, recording the state they access, and merged in order as long as
+// none read the state modified by the transactions merged before it. Those
+// which do are executed again, serially. Blocks are processed serially when
+// transaction hooks or a tracer are set, or the state accesses are recorded.
+func (p *StateProcessor) SetParallelExecution(workers int) {
+	p.parallel.Store(int32(workers))
+}
+
+// SetParallelExecution sets the number of transactions of a block executed
+// concurrently when importing or replaying it, see StateProcessor.SetParallelExecution.
+func (bc *BlockChain) SetParallelExecution(workers int) {
+	if p, ok := bc.processor.(*StateProcessor); ok {
+		p.SetParallelExecution(workers)
+	}
+}
+
+// speculativeTx is a transaction executed on a copy of the state.
+type speculativeTx struct {
+	tx     *types.Transaction
+	msg    *Message
+	index  int
+	state  *state.StateDB
+	evm    *vm.EVM
+	gas    uint64 // Gas available in the block before the transaction
+	gp     *GasPool
+	result *ExecutionResult
+	access *state.TxAccessList
+	err    error
+}
+
+func (s *speculativeTx) run() {
+	s.state.StartAccessRecording(func(list *state.TxAccessList) { s.access = list })
+	s.state.SetTxContext(s.tx.Hash(), s.index)
+	s.evm.Reset(NewEVMTxContext(s.msg), s.state)
+	s.result, s.err = ApplyMessage(s.evm, s.msg, s.gp)
+	s.state.Finalise(true)
+	s.state.StopAccessRecording()
+}
+
+// processParallel executes the transactions of the block in rounds. Each round
+// executes a window of transactions concurrently on copies of the state, then
+// merges them in order until one clashes with those merged before it, which is
+// executed again on the state. The window shrinks as transactions clash, down
+// to serial execution, and grows back as rounds go through.
+func (p *StateProcessor) processParallel(ctx context.Context, block *types.Block, statedb *state.StateDB, cfg vm.Config, vmenv *vm.EVM, signer types.Signer, gp *GasPool, usedGas *uint64, workers int) (types.Receipts, []*types.Log, error) {
+	var (
+		txs         = block.Transactions()
+		blockHash   = block.Hash()
+		blockNumber = block.Number()
+		msgs        = make([]*Message, len(txs))
+		receipts    = make(types.Receipts, 0, len(txs))
+		allLogs     []*types.Log
+		maxWindow   = workers * parallelWindowFactor
+		window      = maxWindow
+		serialRun   int
+	)
+	for i, tx := range txs {
+		msg, err := TransactionToMessage(tx, signer, block.BaseFee())
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not apply tx %d [%v]: %w", i, tx.Hash().Hex(), err)
+		}
+		msgs[i] = msg
+	}
+	// applySerial executes the transaction on the state itself
+	applySerial := func(i int) error {
+		tx := txs[i]
+		statedb.SetTxContext(tx.Hash(), i)
+		receipt, _, err := applyTransaction(msgs[i], vmenv.ChainConfig(), gp, statedb, blockNumber, blockHash, tx, usedGas, vmenv, nil)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("processing of block %d aborted at tx %d: %w", blockNumber, i, ctxErr)
+		}
+		if err != nil {
+			return fmt.Errorf("could not apply tx %d [%v]: %w", i, tx.Hash().Hex(), err)
+		}
+		receipts = append(receipts, receipt)
+		allLogs = append(allLogs, receipt.Logs...)
+		return nil
+	}
+	for next := 0; next < len(txs); {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, fmt.Errorf("processing of block %d aborted at tx %d: %w", blockNumber, next, err)
+		}
+		if window < 2 || next == len(txs)-1 {
+			if err := applySerial(next); err != nil {
+				return nil, nil, err
+			}
+			parallelSerialMeter.Mark(1)
+			next++
+			// Probe for parallelism again after a while
+			if serialRun++; serialRun >= workers {
+				window, serialRun = 2, 0
+			}
+			continue
+		}
+		n := len(txs) - next
+		if n > window {
+			n = window
+		}
+		base, specs := p.speculate(ctx, block, statedb, cfg, txs, msgs, next, n, gp.Gas(), workers)
+		parallelSpeculatedMeter.Mark(int64(n))
+
+		var (
+			written = state.NewWriteSet()
+			merged  int
+		)
+		for _, spec := range specs {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, fmt.Errorf("processing of block %d aborted at tx %d: %w", blockNumber, spec.index, err)
+			}
+			if spec.err != nil || spec.access == nil || written.Conflicts(spec.access) || gp.Gas() < spec.msg.GasLimit {
+				break
+			}
+			writes, err := spec.state.ExtractTxWrites(base, spec.access)
+			if err != nil {
+				break
+			}
+			statedb.SetTxContext(spec.tx.Hash(), spec.index)
+			statedb.ApplyTxWrites(writes)
+			statedb.Finalise(true)
+			if err := gp.SubGas(spec.gas - spec.gp.Gas()); err != nil {
+				return nil, nil, fmt.Errorf("could not apply tx %d [%v]: %w", spec.index, spec.tx.Hash().Hex(), err)
+			}
+			*usedGas += spec.result.UsedGas
+			receipt := newReceipt(spec.tx, spec.result, nil, *usedGas, statedb, blockNumber, blockHash, spec.evm)
+			receipts = append(receipts, receipt)
+			allLogs = append(allLogs, receipt.Logs...)
+			written.Add(writes)
+			merged++
+		}
+		parallelMergedMeter.Mark(int64(merged))
+		next += merged
+		if merged == n {
+			if window *= 2; window > maxWindow {
+				window = maxWindow
+			}
+			continue
+		}
+		// Execute the clashing transaction again, now that the ones before it
+		// are merged
+		if err := applySerial(next); err != nil {
+			return nil, nil, err
+		}
+		parallelReexecutedMeter.Mark(1)
+		next++
+		window, serialRun = merged, 0
+	}
+	return receipts, allLogs, nil
+}
+
+// speculate executes n transactions from the given index concurrently, each on
+// its own copy of the state. It returns another copy of the state from before
+// them, to extract their writes.
+func (p *StateProcessor) speculate(ctx context.Context, block *types.Block, statedb *state.StateDB, cfg vm.Config, txs types.Transactions, msgs []*Message, from, n int, gas uint64, workers int) (*state.StateDB, []*speculativeTx) {
+	var (
+		header = block.Header()
+		base   = statedb.Copy()
+		specs  = make([]*speculativeTx, n)
+	)
+	for j := range specs {
+		st := statedb.Copy()
+		specs[j] = &speculativeTx{
+			tx:    txs[from+j],
+			msg:   msgs[from+j],
+			index: from + j,
+			state: st,
+			evm:   vm.NewEVM(NewEVMBlockContext(header, p.bc, nil), vm.TxContext{}, st, p.configAt(header.Number.Uint64()), cfg),
+			gas:   gas,
+			gp:    new(GasPool).AddGas(gas),
+		}
+	}
+	// Interrupt the EVMs if the context is cancelled mid-transaction
+	if done := ctx.Done(); done != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-done:
+				for _, spec := range specs {
+					spec.evm.Cancel()
+				}
+			case <-finished:
+			}
+		}()
+	}
+	if workers > n {
+		workers = n
+	}
+	var (
+		wg     sync.WaitGroup
+		cursor atomic.Int32
+	)
+	cursor.Store(-1)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				j := int(cursor.Add(1))
+				if j >= n {
+					return
+				}
+				specs[j].run()
+			}
+		}()
+	}
+	wg.Wait()
+	return base, specs
+}
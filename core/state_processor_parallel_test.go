@@ -0,0 +1,91 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that blocks executed in parallel end up in the same state as when
+// executed serially, with independent and clashing transactions alike.
+func TestParallelExecution(t *testing.T) {
+	var (
+		keys     = make([]*ecdsa.PrivateKey, 8)
+		coinbase = common.Address{0xc}
+		alloc    = make(GenesisAlloc)
+	)
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+		alloc[crypto.PubkeyToAddress(keys[i].PublicKey)] = GenesisAccount{Balance: big.NewInt(params.Ether)}
+	}
+	var (
+		gspec  = &Genesis{Config: params.TestChainConfig, Alloc: alloc}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	// Every sender pays a fresh account, then the first ones pay each other,
+	// reading the balances changed before, and sending a second transaction
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 3, func(i int, gen *BlockGen) {
+		gen.SetCoinbase(coinbase)
+		price := new(big.Int).Add(gen.header.BaseFee, big.NewInt(1))
+		send := func(key *ecdsa.PrivateKey, to common.Address) {
+			from := crypto.PubkeyToAddress(key.PublicKey)
+			tx, err := types.SignTx(types.NewTransaction(gen.TxNonce(from), to, big.NewInt(1000), params.TxGas, price, nil), signer, key)
+			if err != nil {
+				t.Fatalf("failed to sign tx: %v", err)
+			}
+			gen.AddTx(tx)
+		}
+		for j, key := range keys {
+			send(key, common.Address{byte(i + 1), byte(j + 1)})
+		}
+		for j := 0; j < 3; j++ {
+			send(keys[j], crypto.PubkeyToAddress(keys[j+1].PublicKey))
+		}
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	chain.SetParallelExecution(4)
+
+	// The block validation checks the state root and receipts
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	for _, block := range blocks {
+		receipts := chain.GetReceiptsByHash(block.Hash())
+		if len(receipts) != len(block.Transactions()) {
+			t.Fatalf("block %d: have %d receipts, want %d", block.NumberU64(), len(receipts), len(block.Transactions()))
+		}
+		for i, receipt := range receipts {
+			if receipt.TxHash != block.Transactions()[i].Hash() || receipt.Status != types.ReceiptStatusSuccessful {
+				t.Errorf("block %d: unexpected receipt %d: %+v", block.NumberU64(), i, receipt)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+)
+
+// TxResult is the result of a transaction streamed while processing its block.
+type TxResult struct {
+	Index   int // Index of the transaction in the block
+	Tx      *types.Transaction
+	Receipt *types.Receipt
+	Root    *common.Hash  // State root after the transaction, nil unless requested
+	Elapsed time.Duration // Execution time of the transaction
+}
+
+// TxStream receives the results of the transactions of a block one by one as
+// they're processed.
+type TxStream struct {
+	// OnTx is called after each transaction, before the next one is executed.
+	// Returning an error aborts the processing of the block with it.
+	OnTx func(result *TxResult) error
+
+	// IntermediateRoots makes the state root be computed after each transaction,
+	// which is costly as the state has to be hashed every time.
+	IntermediateRoots bool
+}
+
+// send streams the result of a transaction.
+func (s *TxStream) send(index int, tx *types.Transaction, receipt *types.Receipt, elapsed time.Duration, root func() common.Hash) error {
+	if s == nil || s.OnTx == nil {
+		return nil
+	}
+	result := &TxResult{Index: index, Tx: tx, Receipt: receipt, Elapsed: elapsed}
+	if s.IntermediateRoots {
+		hash := root()
+		result.Root = &hash
+	}
+	return s.OnTx(result)
+}
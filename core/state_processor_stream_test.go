@@ -0,0 +1,108 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that the results of the transactions are streamed one by one, with the
+// intermediate roots if requested, and that the stream can abort the processing.
+func TestProcessStream(t *testing.T) {
+	var (
+		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		sender = crypto.PubkeyToAddress(key.PublicKey)
+		gspec  = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  GenesisAlloc{sender: {Balance: big.NewInt(params.Ether)}},
+		}
+		signer = types.LatestSigner(gspec.Config)
+	)
+	_, blocks, _ := GenerateChainWithGenesis(gspec, ethash.NewFaker(), 1, func(i int, gen *BlockGen) {
+		price := new(big.Int).Add(gen.header.BaseFee, big.NewInt(1))
+		for j := 0; j < 3; j++ {
+			tx, err := types.SignTx(types.NewTransaction(gen.TxNonce(sender), common.Address{byte(j + 1)}, big.NewInt(1), params.TxGas, price, nil), signer, key)
+			if err != nil {
+				t.Fatalf("failed to sign tx: %v", err)
+			}
+			gen.AddTx(tx)
+		}
+	})
+	chain, err := NewBlockChain(rawdb.NewMemoryDatabase(), nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// Stream the whole block with the intermediate roots
+	var results []*TxResult
+	statedb, _ := chain.StateAt(chain.Genesis().Root())
+	stream := &TxStream{
+		OnTx: func(result *TxResult) error {
+			results = append(results, result)
+			return nil
+		},
+		IntermediateRoots: true,
+	}
+	receipts, _, _, err := chain.Processor().ProcessStream(context.Background(), blocks[0], statedb, vm.Config{}, stream)
+	if err != nil {
+		t.Fatalf("failed to process block: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("have %d streamed results, want 3", len(results))
+	}
+	for i, result := range results {
+		if result.Index != i || result.Tx != blocks[0].Transactions()[i] || result.Receipt != receipts[i] {
+			t.Errorf("result %d: unexpected result %+v", i, result)
+		}
+		if result.Root == nil {
+			t.Errorf("result %d: missing intermediate root", i)
+		}
+	}
+	// The block root also includes the block reward, so only check that every tx moved the state
+	if *results[0].Root == *results[1].Root || *results[1].Root == *results[2].Root {
+		t.Errorf("intermediate roots not updated: %x %x %x", *results[0].Root, *results[1].Root, *results[2].Root)
+	}
+	// Abort the processing at the second transaction
+	errAbort := errors.New("abort")
+	results = results[:0]
+	statedb, _ = chain.StateAt(chain.Genesis().Root())
+	stream = &TxStream{OnTx: func(result *TxResult) error {
+		results = append(results, result)
+		if result.Index == 1 {
+			return errAbort
+		}
+		return nil
+	}}
+	if _, _, _, err := chain.Processor().ProcessStream(context.Background(), blocks[0], statedb, vm.Config{}, stream); !errors.Is(err, errAbort) {
+		t.Fatalf("have error %v, want %v", err, errAbort)
+	}
+	if len(results) != 2 || results[0].Root != nil {
+		t.Fatalf("unexpected results after abort: %v", results)
+	}
+}
@@ -256,6 +256,7 @@ type TxPool struct {
 	eip1559  atomic.Bool // Fork indicator whether we are using EIP-1559 type transactions.
 	shanghai atomic.Bool // Fork indicator whether we are in the Shanghai stage.
 
+	currentHead   *types.Header  // Current head of the blockchain
 	currentState  *state.StateDB // Current state in the blockchain head
 	pendingNonces *noncer        // Pending state tracking virtual nonces
 	currentMaxGas atomic.Uint64  // Current gas limit for transaction caps
@@ -280,6 +281,8 @@ type TxPool struct {
 	initDoneCh      chan struct{}  // is closed once the pool is initialized (for tests)
 
 	changesSinceReorg int // A counter for how many drops we've performed in-between reorg.
+
+	validators []*namedValidator // Validation hooks run on transactions before admission
 }
 
 type txpoolResetRequest struct {
@@ -714,6 +717,12 @@ func (pool *TxPool) add(tx *types.Transaction, local bool) (replaced bool, err e
 		invalidTxMeter.Mark(1)
 		return false, err
 	}
+	// If the transaction is rejected by a validation hook, discard it
+	if err := pool.runValidators(tx, isLocal); err != nil {
+		log.Trace("Discarding transaction rejected by validation hook", "hash", hash, "err", err)
+		invalidTxMeter.Mark(1)
+		return false, err
+	}
 
 	// already validated by this point
 	from, _ := types.Sender(pool.signer, tx)
@@ -1383,6 +1392,7 @@ func (pool *TxPool) reset(oldHead, newHead *types.Header) {
 		log.Error("Failed to reset txpool state", "err", err)
 		return
 	}
+	pool.currentHead = newHead
 	pool.currentState = statedb
 	pool.pendingNonces = newNoncer(statedb)
 	pool.currentMaxGas.Store(newHead.GasLimit)
@@ -322,6 +322,48 @@ func TestInvalidTransactions(t *testing.T) {
 	}
 }
 
+// Tests that transactions rejected by a validation hook are discarded, and that
+// hooks can be replaced and removed.
+func TestValidatorHooks(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupPool()
+	defer pool.Stop()
+
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	testAddBalance(pool, from, big.NewInt(0xffffffffffffff))
+
+	errRejected := errors.New("rejected by hook")
+	var seen *ValidationContext
+	pool.AddValidator("gas", ValidatorFunc(func(tx *types.Transaction, ctx *ValidationContext) error {
+		seen = ctx
+		if tx.Gas() > 100000 {
+			return errRejected
+		}
+		return nil
+	}))
+	if err := pool.AddRemote(transaction(0, 200000, key)); !errors.Is(err, errRejected) {
+		t.Errorf("want %v have %v", errRejected, err)
+	}
+	if seen == nil || seen.From != from || seen.Local || seen.State == nil || seen.Head == nil {
+		t.Errorf("unexpected validation context: %+v", seen)
+	}
+	if err := pool.AddRemote(transaction(0, 100000, key)); err != nil {
+		t.Errorf("transaction accepted by hook rejected: %v", err)
+	}
+	// Replacing the hook drops the old rule
+	pool.AddValidator("gas", ValidatorFunc(func(tx *types.Transaction, ctx *ValidationContext) error {
+		return errRejected
+	}))
+	if err := pool.AddLocal(transaction(1, 200000, key)); !errors.Is(err, errRejected) {
+		t.Errorf("want %v have %v", errRejected, err)
+	}
+	pool.RemoveValidator("gas")
+	if err := pool.AddLocal(transaction(1, 200000, key)); err != nil {
+		t.Errorf("transaction rejected after removing the hook: %v", err)
+	}
+}
+
 func TestQueue(t *testing.T) {
 	t.Parallel()
 
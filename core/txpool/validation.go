@@ -0,0 +1,117 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package txpool
+
+import (
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/state"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/metrics"
+)
+
+// ValidationContext is what a validation hook knows of a transaction and of the
+// chain it's validated against.
+type ValidationContext struct {
+	From  common.Address // Sender of the transaction
+	Local bool           // Whether the transaction is treated as local
+	Head  *types.Header  // Head of the chain the pool is at
+	State *state.StateDB // State of the head, which must not be modified
+}
+
+// Validator is a hook validating transactions before they're admitted into the
+// pool, on top of the consensus and heuristic checks of the pool itself. It lets
+// the embedding process enforce chain specific admission rules (e.g. fee
+// affordability) without patching the pool.
+//
+// Hooks run with the pool lock held, on every transaction added, including the
+// ones reinjected on reorgs, so they must be fast and must not call the pool.
+type Validator interface {
+	ValidateTx(tx *types.Transaction, ctx *ValidationContext) error
+}
+
+// ValidatorFunc is an adapter to use functions as validation hooks.
+type ValidatorFunc func(tx *types.Transaction, ctx *ValidationContext) error
+
+// ValidateTx implements Validator.
+func (f ValidatorFunc) ValidateTx(tx *types.Transaction, ctx *ValidationContext) error {
+	return f(tx, ctx)
+}
+
+// namedValidator is a validation hook of the chain, with the meter counting the
+// transactions it rejected.
+type namedValidator struct {
+	name      string
+	validator Validator
+	rejected  metrics.Meter
+}
+
+// AddValidator appends a validation hook to the chain run on transactions before
+// admission, replacing the hook of the same name if there's one. Transactions
+// rejected by a hook are discarded with the error it returned.
+func (pool *TxPool) AddValidator(name string, validator Validator) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	hook := &namedValidator{
+		name:      name,
+		validator: validator,
+		rejected:  metrics.GetOrRegisterMeter("txpool/invalid/"+name, nil),
+	}
+	for i, existing := range pool.validators {
+		if existing.name == name {
+			pool.validators[i] = hook
+			return
+		}
+	}
+	pool.validators = append(pool.validators, hook)
+}
+
+// RemoveValidator removes a validation hook from the chain.
+func (pool *TxPool) RemoveValidator(name string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for i, existing := range pool.validators {
+		if existing.name == name {
+			pool.validators = append(pool.validators[:i:i], pool.validators[i+1:]...)
+			return
+		}
+	}
+}
+
+// runValidators runs the validation hooks on a transaction, in the order they
+// were added, stopping at the first rejection. The pool lock must be held.
+func (pool *TxPool) runValidators(tx *types.Transaction, local bool) error {
+	if len(pool.validators) == 0 {
+		return nil
+	}
+	// Signature has been checked already, this cannot error.
+	from, _ := types.Sender(pool.signer, tx)
+	ctx := &ValidationContext{
+		From:  from,
+		Local: local,
+		Head:  pool.currentHead,
+		State: pool.currentState,
+	}
+	for _, hook := range pool.validators {
+		if err := hook.validator.ValidateTx(tx, ctx); err != nil {
+			hook.rejected.Mark(1)
+			return err
+		}
+	}
+	return nil
+}
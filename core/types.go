@@ -17,8 +17,10 @@
 package core
 
 import (
+	"context"
 	"sync/atomic"
 
+	"github.com/chainupcloud/arb-geth/common"
 	"github.com/chainupcloud/arb-geth/core/state"
 	"github.com/chainupcloud/arb-geth/core/types"
 	"github.com/chainupcloud/arb-geth/core/vm"
@@ -48,6 +50,16 @@ type Prefetcher interface {
 type Processor interface {
 	// Process processes the state changes according to the Ethereum rules by running
 	// the transaction messages using the statedb and applying any rewards to both
-	// the processor (coinbase) and any included uncles.
-	Process(block *types.Block, statedb *state.StateDB, cfg vm.Config) (types.Receipts, []*types.Log, uint64, error)
+	// the processor (coinbase) and any included uncles. Processing is aborted
+	// as soon as the given context is cancelled.
+	Process(ctx context.Context, block *types.Block, statedb *state.StateDB, cfg vm.Config) (types.Receipts, []*types.Log, uint64, error)
+
+	// ProcessStream is like Process, but streams the result of each transaction
+	// as soon as it's executed, aborting if the stream returns an error.
+	ProcessStream(ctx context.Context, block *types.Block, statedb *state.StateDB, cfg vm.Config, stream *TxStream) (types.Receipts, []*types.Log, uint64, error)
+
+	// AddPreTxHook and AddPostTxHook register hooks called around the processed
+	// transactions involving the given addresses, returning their unregistration.
+	AddPreTxHook(fn TxHook, addresses ...common.Address) func()
+	AddPostTxHook(fn TxHook, addresses ...common.Address) func()
 }
@@ -33,6 +33,7 @@ import (
 	"github.com/chainupcloud/arb-geth/core/rawdb"
 	"github.com/chainupcloud/arb-geth/core/state"
 	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/eth/protocols/snap"
 	"github.com/chainupcloud/arb-geth/internal/ethapi"
 	"github.com/chainupcloud/arb-geth/log"
 	"github.com/chainupcloud/arb-geth/rlp"
@@ -141,6 +142,11 @@ func NewAdminAPI(eth *Ethereum) *AdminAPI {
 	return &AdminAPI{eth: eth}
 }
 
+// SnapHealProgress returns a detailed report of the snap sync state healing phase.
+func (api *AdminAPI) SnapHealProgress() *snap.HealProgress {
+	return api.eth.Downloader().SnapSyncer.HealProgress()
+}
+
 // ExportChain exports the current blockchain into a local file,
 // or a range of blocks if first and last are non-nil.
 func (api *AdminAPI) ExportChain(file string, first *uint64, last *uint64) (bool, error) {
@@ -294,7 +300,7 @@ func (api *DebugAPI) DumpBlock(blockNr rpc.BlockNumber) (state.Dump, error) {
 
 // Preimage is a debug API function that returns the preimage for a sha3 hash, if known.
 func (api *DebugAPI) Preimage(ctx context.Context, hash common.Hash) (hexutil.Bytes, error) {
-	if preimage := rawdb.ReadPreimage(api.eth.ChainDb(), hash); preimage != nil {
+	if preimage := api.eth.BlockChain().TrieDB().Preimage(hash); preimage != nil {
 		return preimage, nil
 	}
 	return nil, errors.New("unknown preimage")
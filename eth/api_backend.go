@@ -37,6 +37,7 @@ import (
 	"github.com/chainupcloud/arb-geth/eth/tracers"
 	"github.com/chainupcloud/arb-geth/ethdb"
 	"github.com/chainupcloud/arb-geth/event"
+	"github.com/chainupcloud/arb-geth/internal/ethapi"
 	"github.com/chainupcloud/arb-geth/miner"
 	"github.com/chainupcloud/arb-geth/params"
 	"github.com/chainupcloud/arb-geth/rpc"
@@ -239,6 +240,14 @@ func (b *EthAPIBackend) GetLogs(ctx context.Context, hash common.Hash, number ui
 	return rawdb.ReadLogs(b.eth.chainDb, hash, number, b.ChainConfig()), nil
 }
 
+func (b *EthAPIBackend) HeadersByRange(ctx context.Context, from, count uint64) ([]*types.Header, error) {
+	return b.eth.blockchain.GetHeadersByRange(from, count), nil
+}
+
+func (b *EthAPIBackend) ReceiptsByRange(ctx context.Context, from, count uint64) ([]types.Receipts, error) {
+	return b.eth.blockchain.GetReceiptsByRange(from, count), nil
+}
+
 func (b *EthAPIBackend) GetTd(ctx context.Context, hash common.Hash) *big.Int {
 	if header := b.eth.blockchain.GetHeaderByHash(hash); header != nil {
 		return b.eth.blockchain.GetTd(hash, header.Number.Uint64())
@@ -381,7 +390,7 @@ func (b *EthAPIBackend) RPCTxFeeCap() float64 {
 
 func (b *EthAPIBackend) BloomStatus() (uint64, uint64) {
 	sections, _, _ := b.eth.bloomIndexer.Sections()
-	return params.BloomBitsBlocks, sections
+	return b.eth.bloomIndexer.SectionSize(), sections
 }
 
 func (b *EthAPIBackend) ServiceFilter(ctx context.Context, session *bloombits.MatcherSession) {
@@ -417,3 +426,7 @@ func (b *EthAPIBackend) StateAtTransaction(ctx context.Context, block *types.Blo
 func (b *EthAPIBackend) FallbackClient() types.FallbackClient {
 	return nil
 }
+
+func (b *EthAPIBackend) CallCache() *ethapi.CallCache {
+	return nil
+}
@@ -56,6 +56,7 @@ import (
 	"github.com/chainupcloud/arb-geth/params"
 	"github.com/chainupcloud/arb-geth/rlp"
 	"github.com/chainupcloud/arb-geth/rpc"
+	"github.com/chainupcloud/arb-geth/trie"
 )
 
 // Config contains the configuration options of the ETH protocol.
@@ -196,6 +197,12 @@ func New(stack *node.Node, config *ethconfig.Config) (*Ethereum, error) {
 			TrieTimeLimit:       config.TrieTimeout,
 			SnapshotLimit:       config.SnapshotCache,
 			Preimages:           config.Preimages,
+			TrieDedup:           config.TrieDedup,
+			SnapshotSpillLayers: config.SnapshotHistory,
+
+			CodeCacheLimit:       config.CodeCache,
+			CodeCacheMaxCodeSize: config.CodeCacheMaxCodeSize,
+			CodeCacheNoAdmission: config.CodeCacheNoAdmission,
 		}
 	)
 	// Override the chain config with provided settings.
@@ -229,6 +236,17 @@ func New(stack *node.Node, config *ethconfig.Config) (*Ethereum, error) {
 	}); err != nil {
 		return nil, err
 	}
+	eth.handler.downloader.RecordPreimages(config.SnapSyncPreimages)
+	if config.SnapHealMemory > 0 {
+		eth.handler.downloader.SnapSyncer.SetHealMembership(&trie.SyncMembershipConfig{
+			Store:       rawdb.NewTable(chainDb, string(rawdb.SnapHealSpillTablePrefix)),
+			MemoryLimit: uint64(config.SnapHealMemory) * 1024 * 1024,
+			BloomSize:   uint64(config.SnapHealMemory) * 1024 * 1024 / 8,
+		})
+	}
+	if config.SnapHealAdaptive {
+		eth.handler.downloader.SnapSyncer.SetHealBatching(&trie.DefaultSyncBatchConfig)
+	}
 
 	eth.miner = miner.New(eth, &config.Miner, eth.blockchain.Config(), eth.EventMux(), eth.engine, eth.isLocalBlock)
 	eth.miner.SetExtra(makeExtraData(config.Miner.ExtraData))
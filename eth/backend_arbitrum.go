@@ -2,25 +2,96 @@ package eth
 
 import (
 	"context"
+	"time"
 
 	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/bloombits"
 	"github.com/chainupcloud/arb-geth/core/state"
 	"github.com/chainupcloud/arb-geth/core/types"
 	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/eth/ethconfig"
+	"github.com/chainupcloud/arb-geth/eth/gasprice"
 	"github.com/chainupcloud/arb-geth/eth/tracers"
 	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/event"
+	"github.com/chainupcloud/arb-geth/params"
 )
 
+// ArbEthereumConfig is the subset of the eth config used by an Ethereum embedded in an arbitrum node
+type ArbEthereumConfig struct {
+	GPO                 gasprice.Config
+	RPCGasCap           uint64
+	RPCEVMTimeout       time.Duration
+	RPCTxFeeCap         float64
+	FilterLogCacheSize  int
+	AllowUnprotectedTxs bool
+	ExtRPCEnabled       bool
+
+	// bloom bits maintained by the embedding node, which also serves their retrievals, if unset logs are filtered
+	// by scanning the blocks
+	BloomIndexer  *core.ChainIndexer
+	BloomRequests chan chan *bloombits.Retrieval
+}
+
+var DefaultArbEthereumConfig = ArbEthereumConfig{
+	GPO:                ethconfig.Defaults.GPO,
+	RPCGasCap:          ethconfig.Defaults.RPCGasCap,
+	RPCEVMTimeout:      ethconfig.Defaults.RPCEVMTimeout,
+	RPCTxFeeCap:        ethconfig.Defaults.RPCTxFeeCap,
+	FilterLogCacheSize: ethconfig.Defaults.FilterLogCacheSize,
+}
+
+// NewArbEthereum creates an Ethereum around the blockchain of an arbitrum node, with its API backend and gas price
+// oracle. The networking, transaction pool, miner and account manager are left to the arbitrum node, so the methods
+// relying on them aren't available. The blockchain is owned by the arbitrum node and its settings are left as is.
+// A nil config means DefaultArbEthereumConfig.
 func NewArbEthereum(
 	blockchain *core.BlockChain,
 	chainDb ethdb.Database,
+	config *ArbEthereumConfig,
 ) *Ethereum {
-	return &Ethereum{
-		blockchain: blockchain,
-		chainDb:    chainDb,
+	if config == nil {
+		config = &DefaultArbEthereumConfig
+	}
+	ethConfig := ethconfig.Defaults
+	ethConfig.NetworkId = blockchain.Config().ChainID.Uint64()
+	ethConfig.GPO = config.GPO
+	if ethConfig.GPO.Default == nil {
+		ethConfig.GPO.Default = ethConfig.Miner.GasPrice
 	}
+	ethConfig.RPCGasCap = config.RPCGasCap
+	ethConfig.RPCEVMTimeout = config.RPCEVMTimeout
+	ethConfig.RPCTxFeeCap = config.RPCTxFeeCap
+	ethConfig.FilterLogCacheSize = config.FilterLogCacheSize
+	ethConfig.TxLookupLimit = blockchain.TxLookupLimit()
+
+	eth := &Ethereum{
+		config:        &ethConfig,
+		blockchain:    blockchain,
+		chainDb:       chainDb,
+		eventMux:      new(event.TypeMux),
+		engine:        blockchain.Engine(),
+		bloomRequests: config.BloomRequests,
+		bloomIndexer:  config.BloomIndexer,
+		networkID:     ethConfig.NetworkId,
+		gasPrice:      ethConfig.GPO.Default,
+	}
+	if eth.bloomIndexer == nil || eth.bloomRequests == nil {
+		// never started, so it has no sections and the bloom bits are never retrieved
+		eth.bloomIndexer = core.NewBloomIndexer(chainDb, params.BloomBitsBlocks, params.BloomConfirms)
+		eth.bloomRequests = make(chan chan *bloombits.Retrieval)
+	}
+	eth.APIBackend = &EthAPIBackend{config.ExtRPCEnabled, config.AllowUnprotectedTxs, eth, nil}
+	eth.APIBackend.gpo = gasprice.NewOracle(eth.APIBackend, ethConfig.GPO)
+	return eth
 }
 
 func (eth *Ethereum) StateAtTransaction(ctx context.Context, block *types.Block, txIndex int, reexec uint64) (*core.Message, vm.BlockContext, *state.StateDB, tracers.StateReleaseFunc, error) {
 	return eth.stateAtTransaction(ctx, block, txIndex, reexec)
 }
+
+// StateAtTransactionFromParent returns the execution environment of a certain
+// transaction, re-executing the block on top of the provided parent state.
+func (eth *Ethereum) StateAtTransactionFromParent(ctx context.Context, block *types.Block, txIndex int, parent *state.StateDB, release tracers.StateReleaseFunc) (*core.Message, vm.BlockContext, *state.StateDB, tracers.StateReleaseFunc, error) {
+	return eth.stateAtTransactionFromParent(ctx, block, txIndex, parent, release)
+}
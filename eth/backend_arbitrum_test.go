@@ -0,0 +1,111 @@
+package eth
+
+import (
+	"context"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/bloombits"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/eth/filters"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// Tests that the logs of an embedded Ethereum are filtered with the bloom bits of
+// the arbitrum node, and that the settings of its blockchain are left as is.
+func TestArbEthereumBloomFilter(t *testing.T) {
+	const sectionSize = 8
+
+	var (
+		key, _   = crypto.GenerateKey()
+		address  = crypto.PubkeyToAddress(key.PublicKey)
+		contract = common.Address{0xaa}
+		gspec    = &core.Genesis{
+			Config: params.TestChainConfig,
+			Alloc: core.GenesisAlloc{
+				address: {Balance: big.NewInt(params.Ether)},
+				// PUSH1 0 PUSH1 0 LOG0
+				contract: {Balance: common.Big0, Code: []byte{0x60, 0x00, 0x60, 0x00, 0xa0}},
+			},
+		}
+		signer = types.LatestSigner(gspec.Config)
+		db     = rawdb.NewMemoryDatabase()
+	)
+	_, blocks, _ := core.GenerateChainWithGenesis(gspec, ethash.NewFaker(), 4*sectionSize, func(i int, gen *core.BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(gen.TxNonce(address), contract, common.Big0, 50000, gen.BaseFee(), nil), signer, key)
+		gen.AddTx(tx)
+	})
+	txLookupLimit := uint64(8)
+	chain, err := core.NewBlockChain(db, nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, &txLookupLimit)
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// The bloom bits and their retrievals of the arbitrum node
+	indexer := core.NewBloomIndexer(db, sectionSize, 0)
+	defer indexer.Close()
+	indexer.Start(chain)
+
+	var (
+		requests = make(chan chan *bloombits.Retrieval)
+		served   atomic.Int32
+		quit     = make(chan struct{})
+	)
+	defer close(quit)
+	go func() {
+		for {
+			select {
+			case <-quit:
+				return
+			case request := <-requests:
+				task := <-request
+				ServeBloombitRetrieval(task, db, sectionSize)
+				served.Add(1)
+				request <- task
+			}
+		}
+	}()
+	eth := NewArbEthereum(chain, db, &ArbEthereumConfig{
+		GPO:           DefaultArbEthereumConfig.GPO,
+		RPCGasCap:     DefaultArbEthereumConfig.RPCGasCap,
+		BloomIndexer:  indexer,
+		BloomRequests: requests,
+	})
+	if limit := chain.TxLookupLimit(); limit != txLookupLimit {
+		t.Errorf("blockchain tx lookup limit changed to %d, want %d", limit, txLookupLimit)
+	}
+	if limit := eth.config.TxLookupLimit; limit != txLookupLimit {
+		t.Errorf("tx lookup limit %d, want the one of the blockchain %d", limit, txLookupLimit)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if size, sections := eth.APIBackend.BloomStatus(); size == sectionSize && sections == 4 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			size, sections := eth.APIBackend.BloomStatus()
+			t.Fatalf("bloom status %d sections of %d blocks, want 4 of %d", sections, size, sectionSize)
+		}
+	}
+	system := filters.NewFilterSystem(eth.APIBackend, filters.Config{})
+	logs, err := system.NewRangeFilter(0, int64(len(blocks)), []common.Address{contract}, nil).Logs(context.Background())
+	if err != nil {
+		t.Fatalf("failed to filter logs: %v", err)
+	}
+	if len(logs) != len(blocks) {
+		t.Errorf("%d logs filtered, want %d", len(logs), len(blocks))
+	}
+	if served.Load() == 0 {
+		t.Error("logs filtered without the bloom bits of the arbitrum node")
+	}
+}
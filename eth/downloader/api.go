@@ -51,6 +51,12 @@ func NewDownloaderAPI(d *Downloader, m *event.TypeMux) *DownloaderAPI {
 	return api
 }
 
+// StateVerification returns the outcome of the verification of the last state
+// synced, proving random ranges of it against its root, or nil if none was synced.
+func (api *DownloaderAPI) StateVerification() *StateVerification {
+	return api.d.StateVerification()
+}
+
 // eventLoop runs a loop until the event mux closes. It will install and uninstall new
 // sync subscriptions and broadcasts sync status updates to the installed sync subscriptions.
 func (api *DownloaderAPI) eventLoop() {
@@ -0,0 +1,79 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package downloader
+
+import (
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/log"
+)
+
+// RecordPreimages sets whether the preimages of the account and storage keys
+// seen in the blocks imported by snap sync are recorded. Snap sync downloads the
+// state keyed by hashes, so the preimages of the keys are otherwise unknown for
+// the history before the pivot. It requires preimage recording to be enabled in
+// the trie database.
+func (d *Downloader) RecordPreimages(enable bool) {
+	d.recordPreimages.Store(enable)
+}
+
+// snapSyncPreimages collects the preimages of the keys touched by the blocks:
+// the senders and recipients of the transactions, the contracts they created or
+// that emitted logs, and the accounts and slots of the access lists.
+func snapSyncPreimages(blocks []*types.Block, receipts []types.Receipts) map[common.Hash][]byte {
+	preimages := make(map[common.Hash][]byte)
+	addAddress := func(addr common.Address) {
+		preimages[crypto.Keccak256Hash(addr.Bytes())] = common.CopyBytes(addr.Bytes())
+	}
+	for i, block := range blocks {
+		for _, tx := range block.Transactions() {
+			if from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx); err == nil {
+				addAddress(from)
+			}
+			if to := tx.To(); to != nil {
+				addAddress(*to)
+			}
+			for _, tuple := range tx.AccessList() {
+				addAddress(tuple.Address)
+				for _, slot := range tuple.StorageKeys {
+					preimages[crypto.Keccak256Hash(slot.Bytes())] = common.CopyBytes(slot.Bytes())
+				}
+			}
+		}
+		for _, receipt := range receipts[i] {
+			if receipt.ContractAddress != (common.Address{}) {
+				addAddress(receipt.ContractAddress)
+			}
+			for _, l := range receipt.Logs {
+				addAddress(l.Address)
+			}
+		}
+	}
+	return preimages
+}
+
+// recordSnapSyncPreimages records the preimages of the keys touched by the
+// blocks imported by snap sync, if enabled.
+func (d *Downloader) recordSnapSyncPreimages(blocks []*types.Block, receipts []types.Receipts) {
+	if !d.recordPreimages.Load() {
+		return
+	}
+	if err := d.blockchain.TrieDB().InsertPreimages(snapSyncPreimages(blocks, receipts)); err != nil {
+		log.Warn("Failed to record snap sync preimages", "err", err)
+	}
+}
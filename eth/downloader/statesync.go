@@ -105,6 +105,9 @@ func newStateSync(d *Downloader, root common.Hash) *stateSync {
 func (s *stateSync) run() {
 	close(s.started)
 	s.err = s.d.SnapSyncer.Sync(s.root, s.cancel)
+	if s.err == nil {
+		s.d.verifyState(s.root, s.cancel)
+	}
 	close(s.done)
 }
 
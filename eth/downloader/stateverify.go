@@ -0,0 +1,79 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package downloader
+
+import (
+	"context"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/trie"
+)
+
+const (
+	stateVerifySamples   = 256 // Number of random account ranges proven after a state sync
+	stateVerifyRangeSize = 32  // Number of accounts, and slots of each of them, per proven range
+)
+
+// StateVerification is the outcome of the verification of a synced state, which
+// proves random ranges of it from the local database against its root once the
+// sync claims completion.
+type StateVerification struct {
+	Root     common.Hash `json:"root"`
+	Verified bool        `json:"verified"`
+	Accounts int         `json:"accounts"` // Number of accounts proven
+	Slots    int         `json:"slots"`    // Number of storage slots proven
+	Error    string      `json:"error,omitempty"`
+}
+
+// verifyState samples the state with the given root, just synced, and records
+// the outcome. An incomplete state doesn't fail the sync, as resyncing would skip
+// the subtries whose roots are present; it's reported for the operator to act on.
+func (d *Downloader) verifyState(root common.Hash, cancel chan struct{}) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		select {
+		case <-cancel:
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+	start := time.Now()
+	result, err := trie.SampleState(ctx, trie.NewDatabase(d.stateDB), root, stateVerifySamples, stateVerifyRangeSize)
+	if ctx.Err() != nil {
+		return
+	}
+	verification := &StateVerification{Root: root, Verified: err == nil}
+	if result != nil {
+		verification.Accounts, verification.Slots = result.Accounts, result.Slots
+	}
+	if err != nil {
+		verification.Error = err.Error()
+		log.Error("Synced state failed verification", "root", root, "err", err)
+	} else {
+		log.Info("Verified synced state", "root", root, "accounts", result.Accounts, "slots", result.Slots, "elapsed", common.PrettyDuration(time.Since(start)))
+	}
+	d.stateVerification.Store(verification)
+}
+
+// StateVerification returns the outcome of the verification of the last synced
+// state, or nil if no state was synced yet.
+func (d *Downloader) StateVerification() *StateVerification {
+	return d.stateVerification.Load()
+}
@@ -131,6 +131,14 @@ type Config struct {
 	TrieTimeout             time.Duration
 	SnapshotCache           int
 	Preimages               bool
+	SnapSyncPreimages       bool `toml:",omitempty"` // Record the preimages of the keys seen in snap synced blocks
+	TrieDedup               bool `toml:",omitempty"` // Skip writing the storage trie nodes already persisted
+	SnapshotHistory         int  `toml:",omitempty"` // Number of blocks below the snapshot disk layer whose state is kept recoverable from reverse diffs
+	CodeCache               int  `toml:",omitempty"` // Memory allowance (MB) for caching contract code
+	CodeCacheMaxCodeSize    int  `toml:",omitempty"` // Largest contract code (bytes) cached
+	CodeCacheNoAdmission    bool `toml:",omitempty"` // Cache every code read rather than only those read more often than the ones they'd evict
+	SnapHealMemory          int  `toml:",omitempty"` // Memory allowance (MB) for the healed state not yet committed, spilled to disk beyond (0 = unbounded)
+	SnapHealAdaptive        bool `toml:",omitempty"` // Size the trie node heal requests after the measured performance of every peer
 
 	// This is the number of blocks for which logs will be cached in the filter system.
 	FilterLogCacheSize int
@@ -45,6 +45,14 @@ func (c Config) MarshalTOML() (interface{}, error) {
 		TrieTimeout             time.Duration
 		SnapshotCache           int
 		Preimages               bool
+		SnapSyncPreimages       bool `toml:",omitempty"`
+		TrieDedup               bool `toml:",omitempty"`
+		SnapshotHistory         int  `toml:",omitempty"`
+		CodeCache               int  `toml:",omitempty"`
+		CodeCacheMaxCodeSize    int  `toml:",omitempty"`
+		CodeCacheNoAdmission    bool `toml:",omitempty"`
+		SnapHealMemory          int  `toml:",omitempty"`
+		SnapHealAdaptive        bool `toml:",omitempty"`
 		FilterLogCacheSize      int
 		Miner                   miner.Config
 		TxPool                  txpool.Config
@@ -86,6 +94,14 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.TrieTimeout = c.TrieTimeout
 	enc.SnapshotCache = c.SnapshotCache
 	enc.Preimages = c.Preimages
+	enc.SnapSyncPreimages = c.SnapSyncPreimages
+	enc.TrieDedup = c.TrieDedup
+	enc.SnapshotHistory = c.SnapshotHistory
+	enc.CodeCache = c.CodeCache
+	enc.CodeCacheMaxCodeSize = c.CodeCacheMaxCodeSize
+	enc.CodeCacheNoAdmission = c.CodeCacheNoAdmission
+	enc.SnapHealMemory = c.SnapHealMemory
+	enc.SnapHealAdaptive = c.SnapHealAdaptive
 	enc.FilterLogCacheSize = c.FilterLogCacheSize
 	enc.Miner = c.Miner
 	enc.TxPool = c.TxPool
@@ -131,6 +147,14 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 		TrieTimeout             *time.Duration
 		SnapshotCache           *int
 		Preimages               *bool
+		SnapSyncPreimages       *bool `toml:",omitempty"`
+		TrieDedup               *bool `toml:",omitempty"`
+		SnapshotHistory         *int  `toml:",omitempty"`
+		CodeCache               *int  `toml:",omitempty"`
+		CodeCacheMaxCodeSize    *int  `toml:",omitempty"`
+		CodeCacheNoAdmission    *bool `toml:",omitempty"`
+		SnapHealMemory          *int  `toml:",omitempty"`
+		SnapHealAdaptive        *bool `toml:",omitempty"`
 		FilterLogCacheSize      *int
 		Miner                   *miner.Config
 		TxPool                  *txpool.Config
@@ -233,6 +257,30 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.Preimages != nil {
 		c.Preimages = *dec.Preimages
 	}
+	if dec.SnapSyncPreimages != nil {
+		c.SnapSyncPreimages = *dec.SnapSyncPreimages
+	}
+	if dec.TrieDedup != nil {
+		c.TrieDedup = *dec.TrieDedup
+	}
+	if dec.SnapshotHistory != nil {
+		c.SnapshotHistory = *dec.SnapshotHistory
+	}
+	if dec.CodeCache != nil {
+		c.CodeCache = *dec.CodeCache
+	}
+	if dec.CodeCacheMaxCodeSize != nil {
+		c.CodeCacheMaxCodeSize = *dec.CodeCacheMaxCodeSize
+	}
+	if dec.CodeCacheNoAdmission != nil {
+		c.CodeCacheNoAdmission = *dec.CodeCacheNoAdmission
+	}
+	if dec.SnapHealMemory != nil {
+		c.SnapHealMemory = *dec.SnapHealMemory
+	}
+	if dec.SnapHealAdaptive != nil {
+		c.SnapHealAdaptive = *dec.SnapHealAdaptive
+	}
 	if dec.FilterLogCacheSize != nil {
 		c.FilterLogCacheSize = *dec.FilterLogCacheSize
 	}
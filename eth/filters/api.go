@@ -59,6 +59,7 @@ type FilterAPI struct {
 	filtersMu sync.Mutex
 	filters   map[rpc.ID]*filter
 	timeout   time.Duration
+	logABIs   *logABIRegistry
 }
 
 // NewFilterAPI returns a new FilterAPI instance.
@@ -68,6 +69,7 @@ func NewFilterAPI(system *FilterSystem, lightMode bool) *FilterAPI {
 		events:  NewEventSystem(system, lightMode),
 		filters: make(map[rpc.ID]*filter),
 		timeout: system.cfg.Timeout,
+		logABIs: newLogABIRegistry(),
 	}
 	go api.timeoutLoop(system.cfg.Timeout)
 
@@ -247,11 +249,16 @@ func (api *FilterAPI) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
 }
 
 // Logs creates a subscription that fires for all new log that match the given filter criteria.
-func (api *FilterAPI) Logs(ctx context.Context, crit FilterCriteria) (*rpc.Subscription, error) {
+// If decoding is requested, the logs are decoded with the given ABI events.
+func (api *FilterAPI) Logs(ctx context.Context, crit FilterCriteria, decoding *LogDecoding) (*rpc.Subscription, error) {
 	notifier, supported := rpc.NotifierFromContext(ctx)
 	if !supported {
 		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
 	}
+	decoder, err := api.logABIs.decoder(decoding)
+	if err != nil {
+		return nil, err
+	}
 
 	var (
 		rpcSub      = notifier.CreateSubscription()
@@ -269,6 +276,10 @@ func (api *FilterAPI) Logs(ctx context.Context, crit FilterCriteria) (*rpc.Subsc
 			case logs := <-matchedLogs:
 				for _, log := range logs {
 					log := log
+					if decoder != nil {
+						notifier.Notify(rpcSub.ID, &DecodedLog{Log: log, Decoded: decoder.decode(log)})
+						continue
+					}
 					notifier.Notify(rpcSub.ID, &log)
 				}
 			case <-rpcSub.Err(): // client send an unsubscribe request
@@ -332,7 +343,13 @@ func (api *FilterAPI) NewFilter(crit FilterCriteria) (rpc.ID, error) {
 }
 
 // GetLogs returns logs matching the given argument that are stored within the state.
-func (api *FilterAPI) GetLogs(ctx context.Context, crit FilterCriteria) ([]*types.Log, error) {
+// If decoding is requested, the logs are returned along with their fields decoded
+// with the given ABI events.
+func (api *FilterAPI) GetLogs(ctx context.Context, crit FilterCriteria, decoding *LogDecoding) (interface{}, error) {
+	decoder, err := api.logABIs.decoder(decoding)
+	if err != nil {
+		return nil, err
+	}
 	var filter *Filter
 	if crit.BlockHash != nil {
 		// Block filter requested, construct a single-shot filter
@@ -355,6 +372,9 @@ func (api *FilterAPI) GetLogs(ctx context.Context, crit FilterCriteria) ([]*type
 	if err != nil {
 		return nil, err
 	}
+	if decoder != nil {
+		return decoder.decodeLogs(returnLogs(logs)), nil
+	}
 	return returnLogs(logs), err
 }
 
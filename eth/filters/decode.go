@@ -0,0 +1,261 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package filters
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/chainupcloud/arb-geth/accounts/abi"
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/common/lru"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+)
+
+const (
+	maxLogABIs    = 1024       // Maximum number of registered ABIs retained
+	maxLogABISize = 128 * 1024 // Maximum size of an ABI in bytes
+)
+
+var (
+	errLogABINotFound = errors.New("log ABI not registered")
+	errLogABIMissing  = errors.New("either abi or id must be given for log decoding")
+
+	bigT     = reflect.TypeOf((*big.Int)(nil))
+	addressT = reflect.TypeOf(common.Address{})
+	hashT    = reflect.TypeOf(common.Hash{})
+)
+
+// LogDecoding opts into decoding the returned logs with ABI event fragments,
+// either given inline or registered beforehand with eth_registerLogABI.
+type LogDecoding struct {
+	ABI json.RawMessage `json:"abi,omitempty"`
+	ID  *common.Hash    `json:"id,omitempty"`
+}
+
+// DecodedLog is a log along with its fields decoded by a matching ABI event.
+type DecodedLog struct {
+	*types.Log
+	Decoded *DecodedEvent
+}
+
+// DecodedEvent holds the fields of a log decoded by an ABI event.
+type DecodedEvent struct {
+	Event     string                 `json:"event"`
+	Signature string                 `json:"signature"`
+	Args      map[string]interface{} `json:"args"`
+}
+
+// MarshalJSON encodes the log as usual, with the decoded event added as the
+// decoded field if any event matched it.
+func (l *DecodedLog) MarshalJSON() ([]byte, error) {
+	enc, err := json.Marshal(l.Log)
+	if err != nil || l.Decoded == nil {
+		return enc, err
+	}
+	decoded, err := json.Marshal(l.Decoded)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(enc[:len(enc)-1])
+	buf.WriteString(`,"decoded":`)
+	buf.Write(decoded)
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// logDecoder decodes logs with the events of an ABI, indexed by their topic.
+type logDecoder struct {
+	events map[common.Hash][]abi.Event
+}
+
+// newLogDecoder parses the ABI fragments into a decoder, ignoring anything
+// but non-anonymous events.
+func newLogDecoder(raw json.RawMessage) (*logDecoder, error) {
+	if len(raw) > maxLogABISize {
+		return nil, fmt.Errorf("log ABI too large: %d bytes, limit %d", len(raw), maxLogABISize)
+	}
+	parsed, err := abi.JSON(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log ABI: %w", err)
+	}
+	dec := &logDecoder{events: make(map[common.Hash][]abi.Event)}
+	for _, event := range parsed.Events {
+		if event.Anonymous {
+			continue
+		}
+		// Name the unnamed arguments by position so they don't collide
+		inputs := make(abi.Arguments, len(event.Inputs))
+		for i, input := range event.Inputs {
+			if input.Name == "" {
+				input.Name = "arg" + strconv.Itoa(i)
+			}
+			inputs[i] = input
+		}
+		event.Inputs = inputs
+		dec.events[event.ID] = append(dec.events[event.ID], event)
+	}
+	if len(dec.events) == 0 {
+		return nil, errors.New("log ABI contains no events")
+	}
+	return dec, nil
+}
+
+// decode decodes the log with the first matching event, returning nil if none
+// of the events matches it.
+func (dec *logDecoder) decode(log *types.Log) *DecodedEvent {
+	if len(log.Topics) == 0 {
+		return nil
+	}
+	for _, event := range dec.events[log.Topics[0]] {
+		var indexed abi.Arguments
+		for _, input := range event.Inputs {
+			if input.Indexed {
+				indexed = append(indexed, input)
+			}
+		}
+		if len(indexed) != len(log.Topics)-1 {
+			continue
+		}
+		args := make(map[string]interface{}, len(event.Inputs))
+		if err := event.Inputs.UnpackIntoMap(args, log.Data); err != nil {
+			continue
+		}
+		if err := abi.ParseTopicsIntoMap(args, indexed, log.Topics[1:]); err != nil {
+			continue
+		}
+		for name, value := range args {
+			args[name] = formatLogArg(reflect.ValueOf(value))
+		}
+		return &DecodedEvent{Event: event.Name, Signature: event.Sig, Args: args}
+	}
+	return nil
+}
+
+// decodeLogs pairs the logs with their decoded events.
+func (dec *logDecoder) decodeLogs(logs []*types.Log) []*DecodedLog {
+	decoded := make([]*DecodedLog, len(logs))
+	for i, log := range logs {
+		decoded[i] = &DecodedLog{Log: log, Decoded: dec.decode(log)}
+	}
+	return decoded
+}
+
+// formatLogArg converts a decoded argument into its JSON form. Integers are
+// formatted as decimal strings to avoid losing precision in clients, byte
+// arrays as hex.
+func formatLogArg(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	switch v.Type() {
+	case bigT:
+		if v.IsNil() {
+			return nil
+		}
+		return v.Interface().(*big.Int).String()
+	case addressT, hashT:
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return formatLogArg(v.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Array, reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return hexutil.Bytes(b)
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = formatLogArg(v.Index(i))
+		}
+		return list
+	case reflect.Struct:
+		fields := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name := field.Name
+			if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" {
+				name = tag
+			}
+			fields[name] = formatLogArg(v.Field(i))
+		}
+		return fields
+	}
+	return v.Interface()
+}
+
+// logABIRegistry holds the ABIs registered for log decoding by their ID.
+type logABIRegistry struct {
+	decoders *lru.Cache[common.Hash, *logDecoder]
+}
+
+func newLogABIRegistry() *logABIRegistry {
+	return &logABIRegistry{decoders: lru.NewCache[common.Hash, *logDecoder](maxLogABIs)}
+}
+
+// register parses and stores an ABI, returning its ID.
+func (r *logABIRegistry) register(raw json.RawMessage) (common.Hash, error) {
+	dec, err := newLogDecoder(raw)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	id := crypto.Keccak256Hash(raw)
+	r.decoders.Add(id, dec)
+	return id, nil
+}
+
+// decoder resolves the decoder requested by the decoding options, returning
+// nil if no decoding was requested.
+func (r *logABIRegistry) decoder(opts *LogDecoding) (*logDecoder, error) {
+	switch {
+	case opts == nil:
+		return nil, nil
+	case len(opts.ABI) > 0:
+		return newLogDecoder(opts.ABI)
+	case opts.ID != nil:
+		if dec, ok := r.decoders.Get(*opts.ID); ok {
+			return dec, nil
+		}
+		return nil, errLogABINotFound
+	}
+	return nil, errLogABIMissing
+}
+
+// RegisterLogABI registers ABI event fragments for decoding logs, returning
+// the ID to refer to them by in eth_getLogs and eth_subscribe. Registered ABIs
+// are shared by all clients and evicted when too many are registered.
+func (api *FilterAPI) RegisterLogABI(abi json.RawMessage) (common.Hash, error) {
+	return api.logABIs.register(abi)
+}
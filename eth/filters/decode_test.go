@@ -0,0 +1,169 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package filters
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+const testLogABI = `[
+	{"type":"event","name":"Transfer","inputs":[
+		{"name":"from","type":"address","indexed":true},
+		{"name":"to","type":"address","indexed":true},
+		{"name":"value","type":"uint256","indexed":false}]},
+	{"type":"event","name":"Note","inputs":[
+		{"name":"","type":"bytes32","indexed":true},
+		{"name":"","type":"uint64[]","indexed":false}]},
+	{"type":"function","name":"transfer","inputs":[]}
+]`
+
+var (
+	transferTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+	noteTopic     = crypto.Keccak256Hash([]byte("Note(bytes32,uint64[])"))
+)
+
+// Tests that logs are decoded by the matching ABI events, with integers
+// formatted as decimal strings and unnamed arguments named by position.
+func TestLogDecoder(t *testing.T) {
+	dec, err := newLogDecoder(json.RawMessage(testLogABI))
+	if err != nil {
+		t.Fatalf("failed to parse ABI: %v", err)
+	}
+	value, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	transfer := &types.Log{
+		Address: common.Address{0xaa},
+		Topics:  []common.Hash{transferTopic, common.BytesToHash(common.Address{0x1}.Bytes()), common.BytesToHash(common.Address{0x2}.Bytes())},
+		Data:    common.LeftPadBytes(value.Bytes(), 32),
+	}
+	decoded := dec.decode(transfer)
+	if decoded == nil {
+		t.Fatalf("transfer not decoded")
+	}
+	if decoded.Event != "Transfer" || decoded.Signature != "Transfer(address,address,uint256)" {
+		t.Errorf("event mismatch: have %s %s", decoded.Event, decoded.Signature)
+	}
+	if have := decoded.Args["from"]; have != (common.Address{0x1}) {
+		t.Errorf("from mismatch: have %v", have)
+	}
+	if have := decoded.Args["value"]; have != value.String() {
+		t.Errorf("value mismatch: have %v, want %v", have, value)
+	}
+	enc, err := json.Marshal(&DecodedLog{Log: transfer, Decoded: decoded})
+	if err != nil {
+		t.Fatalf("failed to encode log: %v", err)
+	}
+	if !strings.Contains(string(enc), `"address":"0xaa00000000000000000000000000000000000000"`) ||
+		!strings.Contains(string(enc), `"decoded":{"event":"Transfer"`) {
+		t.Errorf("unexpected encoding: %s", enc)
+	}
+	// Unnamed arguments are named by their position
+	note := &types.Log{
+		Topics: []common.Hash{noteTopic, {0x3}},
+		Data:   common.FromHex("0x000000000000000000000000000000000000000000000000000000000000002000000000000000000000000000000000000000000000000000000000000000010000000000000000000000000000000000000000000000000000000000000007"),
+	}
+	if decoded := dec.decode(note); decoded == nil {
+		t.Errorf("note not decoded")
+	} else if have, _ := json.Marshal(decoded.Args); string(have) != `{"arg0":"0x0300000000000000000000000000000000000000000000000000000000000000","arg1":["7"]}` {
+		t.Errorf("note args mismatch: have %s", have)
+	}
+	// Logs not matching any event, or matching the topic but not the indexing,
+	// are left undecoded and encoded as usual
+	for _, log := range []*types.Log{
+		{Topics: []common.Hash{{0x4}}},
+		{Topics: []common.Hash{transferTopic}, Data: transfer.Data},
+	} {
+		if decoded := dec.decode(log); decoded != nil {
+			t.Errorf("unexpected decoding of %v: %v", log.Topics, decoded)
+		}
+		have, _ := json.Marshal(&DecodedLog{Log: log})
+		want, _ := json.Marshal(log)
+		if string(have) != string(want) {
+			t.Errorf("undecoded log encoding mismatch: have %s, want %s", have, want)
+		}
+	}
+}
+
+// Tests that eth_getLogs decodes logs with inline and registered ABIs.
+func TestGetDecodedLogs(t *testing.T) {
+	var (
+		db     = rawdb.NewMemoryDatabase()
+		_, sys = newTestFilterSystem(t, db, Config{})
+		api    = NewFilterAPI(sys, false)
+		gspec  = &core.Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	)
+	_, chain, receipts := core.GenerateChainWithGenesis(gspec, ethash.NewFaker(), 1, func(i int, gen *core.BlockGen) {
+		receipt := types.NewReceipt(nil, false, 0)
+		receipt.Logs = []*types.Log{{
+			Address: common.Address{0xaa},
+			Topics:  []common.Hash{transferTopic, {}, {}},
+			Data:    common.LeftPadBytes([]byte{42}, 32),
+		}}
+		gen.AddUncheckedReceipt(receipt)
+		gen.AddUncheckedTx(types.NewTransaction(0, common.Address{0x1}, big.NewInt(1), 1, gen.BaseFee(), nil))
+	})
+	gspec.MustCommit(db)
+	rawdb.WriteBlock(db, chain[0])
+	rawdb.WriteCanonicalHash(db, chain[0].Hash(), 1)
+	rawdb.WriteHeadBlockHash(db, chain[0].Hash())
+	rawdb.WriteReceipts(db, chain[0].Hash(), 1, receipts[0])
+
+	id, err := api.RegisterLogABI(json.RawMessage(testLogABI))
+	if err != nil {
+		t.Fatalf("failed to register ABI: %v", err)
+	}
+	hash := chain[0].Hash()
+	for _, decoding := range []*LogDecoding{{ABI: json.RawMessage(testLogABI)}, {ID: &id}} {
+		res, err := api.GetLogs(context.Background(), FilterCriteria{BlockHash: &hash}, decoding)
+		if err != nil {
+			t.Fatalf("failed to get logs: %v", err)
+		}
+		logs, ok := res.([]*DecodedLog)
+		if !ok || len(logs) != 1 {
+			t.Fatalf("unexpected result: %v", res)
+		}
+		if logs[0].Decoded == nil || logs[0].Decoded.Args["value"] != "42" {
+			t.Errorf("unexpected decoding: %+v", logs[0].Decoded)
+		}
+	}
+	// Unknown registrations and missing ABIs are rejected
+	unknown := common.Hash{0x1}
+	for _, decoding := range []*LogDecoding{{ID: &unknown}, {}, {ABI: json.RawMessage(`[{"type":"function","name":"f"}]`)}} {
+		if _, err := api.GetLogs(context.Background(), FilterCriteria{BlockHash: &hash}, decoding); err == nil {
+			t.Errorf("expected failure for decoding %+v", decoding)
+		}
+	}
+	// Without decoding, plain logs are returned
+	res, err := api.GetLogs(context.Background(), FilterCriteria{BlockHash: &hash}, nil)
+	if err != nil {
+		t.Fatalf("failed to get logs: %v", err)
+	}
+	if logs, ok := res.([]*types.Log); !ok || len(logs) != 1 {
+		t.Errorf("unexpected result: %v", res)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/chainupcloud/arb-geth/common"
 	"github.com/chainupcloud/arb-geth/core/bloombits"
 	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/internal/quota"
 	"github.com/chainupcloud/arb-geth/rpc"
 )
 
@@ -104,6 +105,9 @@ func (f *Filter) Logs(ctx context.Context) ([]*types.Log, error) {
 		if header == nil {
 			return nil, errors.New("unknown block")
 		}
+		if err := quota.Reserve(ctx, quota.LogBlocks, 1); err != nil {
+			return nil, err
+		}
 		return f.blockLogs(ctx, header)
 	}
 	// Short-cut if all we care about is pending logs
@@ -153,18 +157,30 @@ func (f *Filter) Logs(ctx context.Context) ([]*types.Log, error) {
 	if f.end, err = resolveSpecial(f.end); err != nil {
 		return nil, err
 	}
+	if f.end >= f.begin {
+		if err := quota.Reserve(ctx, quota.LogBlocks, uint64(f.end-f.begin+1)); err != nil {
+			return nil, err
+		}
+	}
 	// Gather all indexed logs, and finish with non indexed ones
 	var (
 		logs           []*types.Log
 		end            = uint64(f.end)
 		size, sections = f.sys.backend.BloomStatus()
 	)
-	if indexed := sections * size; indexed > uint64(f.begin) {
+	if index, ok := f.sys.backend.(LogIndexBackend); ok && f.begin <= f.end {
+		if logs, err = f.logIndexLogs(ctx, index, end); err != nil {
+			return logs, err
+		}
+	}
+	if indexed := sections * size; indexed > uint64(f.begin) && f.begin <= f.end {
+		var found []*types.Log
 		if indexed > end {
-			logs, err = f.indexedLogs(ctx, end)
+			found, err = f.indexedLogs(ctx, end)
 		} else {
-			logs, err = f.indexedLogs(ctx, indexed-1)
+			found, err = f.indexedLogs(ctx, indexed-1)
 		}
+		logs = append(logs, found...)
 		if err != nil {
 			return logs, err
 		}
@@ -181,6 +197,34 @@ func (f *Filter) Logs(ctx context.Context) ([]*types.Log, error) {
 	return logs, err
 }
 
+// logIndexLogs returns the logs matching the filter criteria within the blocks
+// covered by the backend's log index, moving the start of the filter past them.
+func (f *Filter) logIndexLogs(ctx context.Context, index LogIndexBackend, end uint64) ([]*types.Log, error) {
+	matches, last, ok, err := index.LogIndexMatches(ctx, uint64(f.begin), end, f.addresses, f.topics)
+	if !ok || err != nil {
+		return nil, err
+	}
+	var logs []*types.Log
+	for _, number := range matches {
+		if err := ctx.Err(); err != nil {
+			return logs, err
+		}
+		header, err := f.sys.backend.HeaderByNumber(ctx, rpc.BlockNumber(number))
+		if header == nil || err != nil {
+			return logs, err
+		}
+		f.begin = int64(number) + 1
+
+		found, err := f.checkMatches(ctx, header)
+		if err != nil {
+			return logs, err
+		}
+		logs = append(logs, found...)
+	}
+	f.begin = int64(last) + 1
+	return logs, nil
+}
+
 // indexedLogs returns the logs matching the filter criteria based on the bloom
 // bits indexed available locally or via the network.
 func (f *Filter) indexedLogs(ctx context.Context, end uint64) ([]*types.Log, error) {
@@ -228,9 +272,16 @@ func (f *Filter) indexedLogs(ctx context.Context, end uint64) ([]*types.Log, err
 	}
 }
 
+// unindexedRangeBatch is the number of blocks whose headers are read at once by
+// the searches of the blocks not covered by an index.
+const unindexedRangeBatch = 256
+
 // unindexedLogs returns the logs matching the filter criteria based on raw block
 // iteration and bloom matching.
 func (f *Filter) unindexedLogs(ctx context.Context, end uint64) ([]*types.Log, error) {
+	if ranges, ok := f.sys.backend.(RangeBackend); ok {
+		return f.unindexedRangeLogs(ctx, ranges, end)
+	}
 	var logs []*types.Log
 
 	for ; f.begin <= int64(end); f.begin++ {
@@ -250,6 +301,66 @@ func (f *Filter) unindexedLogs(ctx context.Context, end uint64) ([]*types.Log, e
 	return logs, nil
 }
 
+// unindexedRangeLogs is unindexedLogs reading the headers in batches, and the
+// receipts of the blocks of a batch whose bloom match in a single range.
+func (f *Filter) unindexedRangeLogs(ctx context.Context, backend RangeBackend, end uint64) ([]*types.Log, error) {
+	var logs []*types.Log
+
+	for f.begin <= int64(end) {
+		if err := ctx.Err(); err != nil {
+			return logs, err
+		}
+		count := uint64(unindexedRangeBatch)
+		if remaining := end - uint64(f.begin) + 1; remaining < count {
+			count = remaining
+		}
+		headers, err := backend.HeadersByRange(ctx, uint64(f.begin), count)
+		if err != nil {
+			return logs, err
+		}
+		first, last := -1, -1
+		for i, header := range headers {
+			if bloomFilter(header.Bloom, f.addresses, f.topics) {
+				if first < 0 {
+					first = i
+				}
+				last = i
+			}
+		}
+		if first >= 0 {
+			receipts, err := backend.ReceiptsByRange(ctx, headers[first].Number.Uint64(), uint64(last-first+1))
+			if err != nil {
+				return logs, err
+			}
+			for i, header := range headers[first : last+1] {
+				if !bloomFilter(header.Bloom, f.addresses, f.topics) {
+					continue
+				}
+				if i >= len(receipts) {
+					// The range stopped short, look the block up on its own
+					found, err := f.checkMatches(ctx, header)
+					if err != nil {
+						return logs, err
+					}
+					logs = append(logs, found...)
+					continue
+				}
+				var unfiltered []*types.Log
+				for _, receipt := range receipts[i] {
+					unfiltered = append(unfiltered, receipt.Logs...)
+				}
+				logs = append(logs, filterLogs(unfiltered, nil, nil, f.addresses, f.topics)...)
+			}
+		}
+		f.begin += int64(len(headers))
+		if uint64(len(headers)) < count {
+			// Missing header, stop as a lookup of it would
+			return logs, nil
+		}
+	}
+	return logs, nil
+}
+
 // blockLogs returns the logs matching the filter criteria within a single block.
 func (f *Filter) blockLogs(ctx context.Context, header *types.Header) ([]*types.Log, error) {
 	if bloomFilter(header.Bloom, f.addresses, f.topics) {
@@ -77,6 +77,26 @@ type Backend interface {
 	ServiceFilter(ctx context.Context, session *bloombits.MatcherSession)
 }
 
+// LogIndexBackend is implemented by the backends maintaining a log index, which
+// serves range queries ahead of the bloombits, over the blocks it covers.
+type LogIndexBackend interface {
+	// LogIndexMatches returns the numbers of the blocks in [begin, end] which may
+	// contain logs matching the filter criteria, along with the last block searched.
+	// It reports false if the index can't serve the query.
+	LogIndexMatches(ctx context.Context, begin, end uint64, addresses []common.Address, topics [][]common.Hash) ([]uint64, uint64, bool, error)
+}
+
+// RangeBackend is implemented by the backends reading ranges of canonical blocks
+// sequentially, which serve the searches of the blocks not covered by an index.
+type RangeBackend interface {
+	// HeadersByRange returns the canonical headers of the blocks [from, from+count),
+	// stopping before the first missing one.
+	HeadersByRange(ctx context.Context, from, count uint64) ([]*types.Header, error)
+	// ReceiptsByRange returns the receipts of the canonical blocks [from, from+count),
+	// with their metadata fields derived, stopping before the first missing ones.
+	ReceiptsByRange(ctx context.Context, from, count uint64) ([]types.Receipts, error)
+}
+
 // FilterSystem holds resources shared by all filters.
 type FilterSystem struct {
 	backend   Backend
@@ -242,3 +242,74 @@ func TestFilters(t *testing.T) {
 		}
 	}
 }
+
+// rangeTestBackend is a testBackend reading ranges of blocks sequentially.
+type rangeTestBackend struct {
+	*testBackend
+}
+
+func (b *rangeTestBackend) HeadersByRange(ctx context.Context, from, count uint64) ([]*types.Header, error) {
+	return rawdb.ReadHeadersRange(b.db, from, count), nil
+}
+
+func (b *rangeTestBackend) ReceiptsByRange(ctx context.Context, from, count uint64) ([]types.Receipts, error) {
+	var (
+		headers  = rawdb.ReadHeadersRange(b.db, from, count)
+		bodies   = rawdb.ReadBodiesRange(b.db, from, uint64(len(headers)))
+		receipts = rawdb.ReadRawReceiptsRange(b.db, from, uint64(len(bodies)))
+	)
+	for i, blockReceipts := range receipts {
+		header := headers[i]
+		if err := blockReceipts.DeriveFields(params.TestChainConfig, header.Hash(), header.Number.Uint64(), header.Time, header.BaseFee, bodies[i].Transactions); err != nil {
+			return nil, err
+		}
+	}
+	return receipts, nil
+}
+
+// Tests that the unindexed searches reading ranges of blocks find the same logs
+// as those looking the blocks up one by one.
+func TestRangeFilters(t *testing.T) {
+	var (
+		db, _    = rawdb.NewLevelDBDatabase(t.TempDir(), 0, 0, "", false)
+		_, sys   = newTestFilterSystem(t, db, Config{})
+		rangeSys = NewFilterSystem(&rangeTestBackend{&testBackend{db: db}}, Config{})
+		addr     = common.Address{0x01}
+		topic    = common.BytesToHash([]byte("topic"))
+		gspec    = &core.Genesis{Config: params.TestChainConfig, BaseFee: big.NewInt(params.InitialBaseFee)}
+	)
+	defer db.Close()
+
+	_, chain, receipts := core.GenerateChainWithGenesis(gspec, ethash.NewFaker(), 600, func(i int, gen *core.BlockGen) {
+		switch i {
+		case 1, 2, 254, 255, 256, 511, 598:
+			receipt := types.NewReceipt(nil, false, 0)
+			receipt.Logs = []*types.Log{{Address: addr, Topics: []common.Hash{topic}}, {Address: common.Address{0x02}}}
+			gen.AddUncheckedReceipt(receipt)
+			gen.AddUncheckedTx(types.NewTransaction(uint64(i), common.Address{0x03}, big.NewInt(1), 1, gen.BaseFee(), nil))
+		}
+	})
+	gspec.MustCommit(db)
+	for i, block := range chain {
+		rawdb.WriteBlock(db, block)
+		rawdb.WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+		rawdb.WriteHeadBlockHash(db, block.Hash())
+		rawdb.WriteReceipts(db, block.Hash(), block.NumberU64(), receipts[i])
+	}
+	for i, r := range [][2]int64{{0, int64(rpc.LatestBlockNumber)}, {3, 255}, {255, 257}, {500, 1000}} {
+		want, err := sys.NewRangeFilter(r[0], r[1], []common.Address{addr}, nil).Logs(context.Background())
+		if err != nil {
+			t.Fatalf("test %d: failed to filter logs: %v", i, err)
+		}
+		have, err := rangeSys.NewRangeFilter(r[0], r[1], []common.Address{addr}, nil).Logs(context.Background())
+		if err != nil {
+			t.Fatalf("test %d: failed to filter logs by range: %v", i, err)
+		}
+		if len(want) == 0 {
+			t.Fatalf("test %d: no logs found", i)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Fatalf("test %d: logs mismatch\nhave %v\nwant %v", i, have, want)
+		}
+	}
+}
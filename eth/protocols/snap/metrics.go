@@ -0,0 +1,53 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snap
+
+import (
+	"time"
+
+	"github.com/chainupcloud/arb-geth/metrics"
+)
+
+var (
+	healPendingNodesGauge   = metrics.NewRegisteredGauge("eth/protocols/snap/heal/pending/nodes", nil)
+	healPendingCodesGauge   = metrics.NewRegisteredGauge("eth/protocols/snap/heal/pending/codes", nil)
+	healQueuedGauge         = metrics.NewRegisteredGauge("eth/protocols/snap/heal/queued", nil)
+	healMemBatchGauge       = metrics.NewRegisteredGauge("eth/protocols/snap/heal/membatch/size", nil)
+	healCommittedNodesGauge = metrics.NewRegisteredGauge("eth/protocols/snap/heal/committed/nodes", nil)
+	healCommittedCodesGauge = metrics.NewRegisteredGauge("eth/protocols/snap/heal/committed/codes", nil)
+	healCommittedBytesGauge = metrics.NewRegisteredGauge("eth/protocols/snap/heal/committed/bytes", nil)
+	healHitRateGauge        = metrics.NewRegisteredGaugeFloat64("eth/protocols/snap/heal/membership/hitrate", nil)
+	healStallGauge          = metrics.NewRegisteredGauge("eth/protocols/snap/heal/stall", nil)
+)
+
+// updateHealMetrics publishes the given healing progress report as metrics.
+func (s *Syncer) updateHealMetrics(progress *HealProgress) {
+	if !metrics.Enabled {
+		return
+	}
+	healPendingNodesGauge.Update(int64(progress.Scheduler.PendingNodes))
+	healPendingCodesGauge.Update(int64(progress.Scheduler.PendingCodes))
+	healQueuedGauge.Update(int64(progress.Scheduler.Queued))
+	healMemBatchGauge.Update(int64(progress.Scheduler.MemBatchSize))
+	healCommittedNodesGauge.Update(int64(progress.Scheduler.CommittedNodes))
+	healCommittedCodesGauge.Update(int64(progress.Scheduler.CommittedCodes))
+	healCommittedBytesGauge.Update(int64(progress.Scheduler.CommittedBytes))
+	healHitRateGauge.Update(progress.MembershipHitRate)
+	if !progress.LastProgress.IsZero() {
+		healStallGauge.Update(int64(time.Since(progress.LastProgress) / time.Millisecond))
+	}
+}
@@ -255,7 +255,9 @@ type trienodeHealRequest struct {
 
 // trienodeHealResponse is an already verified remote response to a trie node request.
 type trienodeHealResponse struct {
-	task *healTask // Task which this request is filling
+	task    *healTask     // Task which this request is filling
+	peer    string        // Peer which delivered the response
+	elapsed time.Duration // Round trip time of the request
 
 	paths  []string      // Paths of the trie nodes
 	hashes []common.Hash // Hashes of the trie nodes to avoid double hashing
@@ -370,6 +372,27 @@ type SyncPending struct {
 	BytecodeHeal uint64 // Number of bytecodes pending
 }
 
+// HealProgress is a detailed report of the state healing phase, meant to help
+// distinguish a slow heal from a stuck one.
+type HealProgress struct {
+	Scheduler trie.SyncStats `json:"scheduler"` // Counters of the underlying trie sync scheduler
+
+	TrienodeHealSynced uint64             `json:"trienodeHealSynced"` // Number of state trie nodes downloaded
+	TrienodeHealBytes  common.StorageSize `json:"trienodeHealBytes"`  // Number of state trie bytes persisted to disk
+	TrienodeHealDups   uint64             `json:"trienodeHealDups"`   // Number of state trie nodes already processed
+	TrienodeHealNops   uint64             `json:"trienodeHealNops"`   // Number of state trie nodes not requested
+	BytecodeHealSynced uint64             `json:"bytecodeHealSynced"` // Number of bytecodes downloaded
+	BytecodeHealBytes  common.StorageSize `json:"bytecodeHealBytes"`  // Number of bytecodes persisted to disk
+	BytecodeHealDups   uint64             `json:"bytecodeHealDups"`   // Number of bytecodes already processed
+	BytecodeHealNops   uint64             `json:"bytecodeHealNops"`   // Number of bytecodes not requested
+
+	TrienodeHealRate     float64 `json:"trienodeHealRate"`     // Average heal rate for processing trie node data
+	TrienodeHealThrottle float64 `json:"trienodeHealThrottle"` // Divisor for throttling the amount of trienode heal data requested
+
+	MembershipHitRate float64   `json:"membershipHitRate"` // Ratio of scheduler membership lookups answered locally
+	LastProgress      time.Time `json:"lastProgress"`      // Time instance healing data was last delivered
+}
+
 // SyncPeer abstracts out the methods required for a peer to be synced against
 // with the goal of allowing the construction of mock peers without the full
 // blown networking.
@@ -409,8 +432,13 @@ type SyncPeer interface {
 //   - The peer delivers a stale response after a previous timeout
 //   - The peer delivers a refusal to serve the requested state
 type Syncer struct {
-	db     ethdb.KeyValueStore // Database to store the trie nodes into (and dedup)
-	scheme string              // Node scheme used in node database
+	db         ethdb.KeyValueStore        // Database to store the trie nodes into (and dedup)
+	scheme     string                     // Node scheme used in node database
+	membership *trie.SyncMembershipConfig // Memory bound of the healing scheduler, nil if unbounded
+	batching   *trie.SyncBatchConfig      // Adaptive sizing of the trie node heal requests, nil if disabled
+
+	priorities     []common.Hash // Accounts whose storage is retrieved ahead of the rest of the state
+	pendPriorities []common.Hash // Prioritized accounts not handed to the healing scheduler yet
 
 	root    common.Hash    // Current state trie root being synced
 	tasks   []*accountTask // Current account task set being synced
@@ -469,6 +497,9 @@ type Syncer struct {
 	storageHealed      uint64             // Number of storage slots downloaded during the healing stage
 	storageHealedBytes common.StorageSize // Number of raw storage bytes persisted to disk during the healing stage
 
+	healDelivered time.Time     // Time instance healing data was last delivered
+	extHeal       *HealProgress // Healing progress that can be exposed to external caller
+
 	startTime time.Time // Time instance when snapshot sync started
 	logTime   time.Time // Time instance when status was last reported
 
@@ -509,6 +540,56 @@ func NewSyncer(db ethdb.KeyValueStore, scheme string) *Syncer {
 	}
 }
 
+// SetHealMembership bounds the memory the healing scheduler uses to track the
+// trie nodes and codes it completed but didn't commit yet. It takes effect from
+// the next sync cycle.
+func (s *Syncer) SetHealMembership(config *trie.SyncMembershipConfig) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.membership = config
+}
+
+// SetHealBatching enables the sizing of the trie node heal requests of every
+// peer after its measured throughput and round trip time, or disables it if the
+// config is nil. It takes effect from the next sync cycle.
+func (s *Syncer) SetHealBatching(config *trie.SyncBatchConfig) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.batching = config
+}
+
+// Prioritize requests the storage tries of the given accounts, identified by the
+// hash of their address, to be retrieved ahead of the rest of the state, both
+// while syncing and healing, so that hot contracts become usable early. It takes
+// effect right away, and is kept for the next sync cycles.
+func (s *Syncer) Prioritize(accounts ...common.Hash) {
+	s.lock.Lock()
+	s.priorities = append(s.priorities, accounts...)
+	s.pendPriorities = append(s.pendPriorities, accounts...)
+	s.lock.Unlock()
+
+	select {
+	case s.update <- struct{}{}:
+	default:
+	}
+}
+
+// applyPriorities hands the accounts prioritized since the last call to the
+// healing scheduler. It must be called from the sync loop, which owns the
+// scheduler.
+func (s *Syncer) applyPriorities() {
+	s.lock.Lock()
+	accounts := s.pendPriorities
+	s.pendPriorities = nil
+	s.lock.Unlock()
+
+	if len(accounts) > 0 {
+		s.healer.scheduler.Prioritize(accounts...)
+	}
+}
+
 // Register injects a new data source into the syncer's peerset.
 func (s *Syncer) Register(peer SyncPeer) error {
 	// Make sure the peer is not registered yet
@@ -579,6 +660,9 @@ func (s *Syncer) Sync(root common.Hash, cancel chan struct{}) error {
 		trieTasks: make(map[string]common.Hash),
 		codeTasks: make(map[common.Hash]struct{}),
 	}
+	s.healer.scheduler.SetMembership(s.membership)
+	s.healer.scheduler.SetAdaptiveBatching(s.batching)
+	s.pendPriorities = append([]common.Hash(nil), s.priorities...)
 	s.statelessPeers = make(map[string]struct{})
 	s.lock.Unlock()
 
@@ -654,6 +738,8 @@ func (s *Syncer) Sync(root common.Hash, cancel chan struct{}) error {
 		if len(s.tasks) == 0 && s.healer.scheduler.Pending() == 0 {
 			return nil
 		}
+		s.applyPriorities()
+
 		// Assign all the data retrieval tasks to any free peers
 		s.assignAccountTasks(accountResps, accountReqFails, cancel)
 		s.assignBytecodeTasks(bytecodeResps, bytecodeReqFails, cancel)
@@ -678,7 +764,9 @@ func (s *Syncer) Sync(root common.Hash, cancel chan struct{}) error {
 			BytecodeHealSynced: s.bytecodeHealSynced,
 			BytecodeHealBytes:  s.bytecodeHealBytes,
 		}
+		s.extHeal = s.healReport()
 		s.lock.Unlock()
+		s.updateHealMetrics(s.extHeal)
 		// Wait for something to happen
 		select {
 		case <-s.update:
@@ -687,6 +775,7 @@ func (s *Syncer) Sync(root common.Hash, cancel chan struct{}) error {
 			// A new peer joined, try to schedule it new tasks
 		case id := <-peerDrop:
 			s.revertRequests(id)
+			s.healer.scheduler.DropConsumer(id)
 		case <-cancel:
 			return ErrCancelled
 
@@ -864,6 +953,42 @@ func (s *Syncer) Progress() (*SyncProgress, *SyncPending) {
 	return s.extProgress, pending
 }
 
+// HealProgress returns a detailed report of the state healing phase.
+func (s *Syncer) HealProgress() *HealProgress {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.extHeal == nil {
+		return new(HealProgress)
+	}
+	progress := *s.extHeal
+	return &progress
+}
+
+// healReport assembles a detailed report of the state healing phase. It must
+// be called from the sync loop.
+func (s *Syncer) healReport() *HealProgress {
+	stats := s.healer.scheduler.Stats()
+	progress := &HealProgress{
+		Scheduler:            stats,
+		TrienodeHealSynced:   s.trienodeHealSynced,
+		TrienodeHealBytes:    s.trienodeHealBytes,
+		TrienodeHealDups:     s.trienodeHealDups,
+		TrienodeHealNops:     s.trienodeHealNops,
+		BytecodeHealSynced:   s.bytecodeHealSynced,
+		BytecodeHealBytes:    s.bytecodeHealBytes,
+		BytecodeHealDups:     s.bytecodeHealDups,
+		BytecodeHealNops:     s.bytecodeHealNops,
+		TrienodeHealRate:     s.trienodeHealRate,
+		TrienodeHealThrottle: s.trienodeHealThrottle,
+		LastProgress:         s.healDelivered,
+	}
+	if lookups := stats.MemBatchHits + stats.DatabaseHits + stats.Misses; lookups > 0 {
+		progress.MembershipHitRate = float64(stats.MemBatchHits+stats.DatabaseHits) / float64(lookups)
+	}
+	return progress
+}
+
 // cleanAccountTasks removes account range retrieval tasks that have already been
 // completed.
 func (s *Syncer) cleanAccountTasks() {
@@ -1197,23 +1322,49 @@ func (s *Syncer) assignStorageTasks(success chan *storageResponse, fail chan *st
 			roots    = make([]common.Hash, 0, storageSets)
 			subtask  *storageTask
 		)
-		for account, subtasks := range task.SubTasks {
-			for _, st := range subtasks {
-				// Skip any subtasks already filling
-				if st.req != nil {
-					continue
+		// The prioritized accounts go first, large contract chunks before small ones
+		for _, account := range s.priorities {
+			for _, st := range task.SubTasks[account] {
+				if st.req == nil {
+					accounts = append(accounts, account)
+					roots = append(roots, st.root)
+					subtask = st
+					break
 				}
-				// Found an incomplete storage chunk, schedule it
-				accounts = append(accounts, account)
-				roots = append(roots, st.root)
-				subtask = st
-				break // Large contract chunks are downloaded individually
 			}
 			if subtask != nil {
-				break // Large contract chunks are downloaded individually
+				break
 			}
 		}
 		if subtask == nil {
+			for _, account := range s.priorities {
+				if root, ok := task.stateTasks[account]; ok && len(accounts) < storageSets {
+					delete(task.stateTasks, account)
+
+					accounts = append(accounts, account)
+					roots = append(roots, root)
+				}
+			}
+		}
+		if len(accounts) == 0 {
+			for account, subtasks := range task.SubTasks {
+				for _, st := range subtasks {
+					// Skip any subtasks already filling
+					if st.req != nil {
+						continue
+					}
+					// Found an incomplete storage chunk, schedule it
+					accounts = append(accounts, account)
+					roots = append(roots, st.root)
+					subtask = st
+					break // Large contract chunks are downloaded individually
+				}
+				if subtask != nil {
+					break // Large contract chunks are downloaded individually
+				}
+			}
+		}
+		if subtask == nil && len(accounts) < storageSets {
 			// No large contract required retrieval, but small ones available
 			for account, root := range task.stateTasks {
 				delete(task.stateTasks, account)
@@ -1349,7 +1500,11 @@ func (s *Syncer) assignTrienodeHealTasks(success chan *trienodeHealResponse, fai
 			}
 			break
 		}
-		// Generate the network query and send it to the peer
+		// Generate the network query and send it to the peer, sized after the
+		// measured performance of the peer if adaptive batching is enabled
+		if size := s.healer.scheduler.BatchSize(idle); size > 0 && size < cap {
+			cap = size
+		}
 		if cap > maxTrieRequestCount {
 			cap = maxTrieRequestCount
 		}
@@ -1743,6 +1898,7 @@ func (s *Syncer) revertTrienodeHealRequest(req *trienodeHealRequest) {
 	for i, path := range req.paths {
 		req.task.trieTasks[path] = req.hashes[i]
 	}
+	s.healer.scheduler.ReportBatch(req.peer, len(req.hashes), 0, time.Since(req.time))
 }
 
 // scheduleRevertBytecodeHealRequest asks the event loop to clean up a bytecode heal
@@ -2145,6 +2301,7 @@ func (s *Syncer) processTrienodeHealResponse(res *trienodeHealResponse) {
 			continue
 		}
 		fills++
+		s.healDelivered = time.Now()
 
 		// Push the trie node into the state syncer
 		s.trienodeHealSynced++
@@ -2161,6 +2318,7 @@ func (s *Syncer) processTrienodeHealResponse(res *trienodeHealResponse) {
 			log.Error("Invalid trienode processed", "hash", hash, "err", err)
 		}
 	}
+	s.healer.scheduler.ReportBatch(res.peer, len(res.hashes), fills, res.elapsed)
 	s.commitHealer(false)
 
 	// Calculate the processing rate of one filled trie node
@@ -2233,6 +2391,8 @@ func (s *Syncer) processBytecodeHealResponse(res *bytecodeHealResponse) {
 			res.task.codeTasks[hash] = struct{}{}
 			continue
 		}
+		s.healDelivered = time.Now()
+
 		// Push the trie node into the state syncer
 		s.bytecodeHealSynced++
 		s.bytecodeHealBytes += common.StorageSize(len(node))
@@ -2781,10 +2941,12 @@ func (s *Syncer) OnTrieNodes(peer SyncPeer, id uint64, trienodes [][]byte) error
 		s.trienodeHealPend.Add(^(fills - 1))
 	}()
 	response := &trienodeHealResponse{
-		paths:  req.paths,
-		task:   req.task,
-		hashes: req.hashes,
-		nodes:  nodes,
+		paths:   req.paths,
+		task:    req.task,
+		peer:    req.peer,
+		elapsed: time.Since(req.time),
+		hashes:  req.hashes,
+		nodes:   nodes,
 	}
 	select {
 	case req.deliver <- response:
@@ -1790,3 +1790,141 @@ func TestSlotEstimation(t *testing.T) {
 		}
 	}
 }
+
+// TestSyncPrioritizedStorage tests that the storage of the prioritized accounts
+// is requested ahead of the others.
+func TestSyncPrioritizedStorage(t *testing.T) {
+	t.Parallel()
+
+	var (
+		once   sync.Once
+		cancel = make(chan struct{})
+		term   = func() {
+			once.Do(func() {
+				close(cancel)
+			})
+		}
+		lock  sync.Mutex
+		first []common.Hash
+	)
+	nodeScheme, sourceAccountTrie, elems, storageTries, storageElems := makeAccountTrieWithStorageWithUniqueStorage(20, 50, false)
+	prioritized := common.BytesToHash(key32(15))
+
+	source := newTestPeer("source", t, term)
+	source.accountTrie = sourceAccountTrie.Copy()
+	source.accountValues = elems
+	source.setStorageTries(storageTries)
+	source.storageValues = storageElems
+	source.storageRequestHandler = func(t *testPeer, requestId uint64, root common.Hash, accounts []common.Hash, origin, limit []byte, max uint64) error {
+		lock.Lock()
+		if first == nil {
+			first = accounts
+		}
+		lock.Unlock()
+		return defaultStorageRequestHandler(t, requestId, root, accounts, origin, limit, max)
+	}
+	syncer := setupSyncer(nodeScheme, source)
+	syncer.Prioritize(prioritized)
+	done := checkStall(t, term)
+	if err := syncer.Sync(sourceAccountTrie.Hash(), cancel); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	close(done)
+	verifyTrie(syncer.db, sourceAccountTrie.Hash(), t)
+
+	if len(first) == 0 || first[0] != prioritized {
+		t.Fatalf("prioritized account not requested first: %v", first)
+	}
+}
+
+// TestSyncAdaptiveHealBatching tests that the trie node heal requests are sized
+// by the adaptive batching of the healing scheduler when it's enabled.
+func TestSyncAdaptiveHealBatching(t *testing.T) {
+	t.Parallel()
+
+	var (
+		once   sync.Once
+		cancel = make(chan struct{})
+		term   = func() {
+			once.Do(func() {
+				close(cancel)
+			})
+		}
+		lock     sync.Mutex
+		requests int
+		largest  int
+	)
+	// Sync a part of a stale state, so that it needs to be healed after moving
+	// on to the fresh one
+	nodeScheme, staleAccountTrie, staleElems := makeAccountTrieNoStorage(1000)
+
+	stale := newTestPeer("stale", t, term)
+	stale.accountTrie = staleAccountTrie.Copy()
+	stale.accountValues = staleElems
+	stale.accountRequestHandler = func(t *testPeer, requestId uint64, root common.Hash, origin common.Hash, limit common.Hash, cap uint64) error {
+		lock.Lock()
+		requests++
+		if requests == accountConcurrency/2 {
+			term()
+		}
+		lock.Unlock()
+		return defaultAccountRequestHandler(t, requestId, root, origin, limit, cap)
+	}
+	syncer := setupSyncer(nodeScheme, stale)
+	if err := syncer.Sync(staleAccountTrie.Hash(), cancel); err != ErrCancelled {
+		t.Fatalf("stale sync not cancelled: %v", err)
+	}
+	syncer.Unregister(stale.id)
+
+	var (
+		db      = trie.NewDatabase(rawdb.NewMemoryDatabase())
+		accTrie = trie.NewEmpty(db)
+		elems   entrySlice
+	)
+	for i := uint64(1); i <= 1000; i++ {
+		value, _ := rlp.EncodeToBytes(&types.StateAccount{
+			Nonce:    i + 1,
+			Balance:  big.NewInt(int64(i)),
+			Root:     types.EmptyRootHash,
+			CodeHash: getCodeHash(i),
+		})
+		accTrie.MustUpdate(key32(i), value)
+		elems = append(elems, &kv{key32(i), value})
+	}
+	sort.Sort(elems)
+	root, nodes := accTrie.Commit(false)
+	db.Update(root, types.EmptyRootHash, trienode.NewWithNodeSet(nodes))
+	accTrie, _ = trie.New(trie.StateTrieID(root), db)
+
+	cancel, once, requests = make(chan struct{}), sync.Once{}, 0
+	source := newTestPeer("source", t, term)
+	source.accountTrie = accTrie.Copy()
+	source.accountValues = elems
+	source.trieRequestHandler = func(t *testPeer, requestId uint64, root common.Hash, paths []TrieNodePathSet, cap uint64) error {
+		lock.Lock()
+		if requests++; len(paths) > largest {
+			largest = len(paths)
+		}
+		lock.Unlock()
+		return defaultTrieRequestHandler(t, requestId, root, paths, cap)
+	}
+	syncer.Register(source)
+	source.remote = syncer
+
+	// Lift the throttling of the local processing to let the batching size the requests
+	syncer.trienodeHealThrottle = minTrienodeHealThrottle
+	syncer.SetHealBatching(&trie.SyncBatchConfig{Initial: 2, Min: 1, Max: 4, TargetRTT: time.Second})
+	done := checkStall(t, term)
+	if err := syncer.Sync(root, cancel); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	close(done)
+	verifyTrie(syncer.db, root, t)
+
+	if requests < 2 {
+		t.Fatalf("%d heal requests, want the stale state healed", requests)
+	}
+	if largest > 4 {
+		t.Errorf("heal request of %d trie nodes, want at most 4", largest)
+	}
+}
@@ -39,6 +39,7 @@ import (
 	"github.com/chainupcloud/arb-geth/eth/tracers/logger"
 	"github.com/chainupcloud/arb-geth/ethdb"
 	"github.com/chainupcloud/arb-geth/internal/ethapi"
+	"github.com/chainupcloud/arb-geth/internal/quota"
 	"github.com/chainupcloud/arb-geth/log"
 	"github.com/chainupcloud/arb-geth/params"
 	"github.com/chainupcloud/arb-geth/rlp"
@@ -157,6 +158,9 @@ type TraceConfig struct {
 	// Config specific to given tracer. Note struct logger
 	// config are historically embedded in main object.
 	TracerConfig json.RawMessage
+	// FallbackToNearest makes block traces whose state is too expensive to
+	// recreate report the nearest affordable block instead of failing.
+	FallbackToNearest bool
 }
 
 // TraceCallConfig is the config for traceCall API. It holds one more
@@ -431,37 +435,37 @@ func (api *API) traceChain(start, end *types.Block, config *TraceConfig, closed
 
 // TraceBlockByNumber returns the structured logs created during the execution of
 // EVM and returns them as a JSON object.
-func (api *API) TraceBlockByNumber(ctx context.Context, number rpc.BlockNumber, config *TraceConfig) ([]*txTraceResult, error) {
+func (api *API) TraceBlockByNumber(ctx context.Context, number rpc.BlockNumber, config *TraceConfig) (interface{}, error) {
 	block, err := api.blockByNumber(ctx, number)
 	if err != nil {
 		return nil, err
 	}
-	return api.traceBlock(ctx, block, config)
+	return api.traceBlockOrNearest(ctx, block, config)
 }
 
 // TraceBlockByHash returns the structured logs created during the execution of
 // EVM and returns them as a JSON object.
-func (api *API) TraceBlockByHash(ctx context.Context, hash common.Hash, config *TraceConfig) ([]*txTraceResult, error) {
+func (api *API) TraceBlockByHash(ctx context.Context, hash common.Hash, config *TraceConfig) (interface{}, error) {
 	block, err := api.blockByHash(ctx, hash)
 	if err != nil {
 		return nil, err
 	}
-	return api.traceBlock(ctx, block, config)
+	return api.traceBlockOrNearest(ctx, block, config)
 }
 
 // TraceBlock returns the structured logs created during the execution of EVM
 // and returns them as a JSON object.
-func (api *API) TraceBlock(ctx context.Context, blob hexutil.Bytes, config *TraceConfig) ([]*txTraceResult, error) {
+func (api *API) TraceBlock(ctx context.Context, blob hexutil.Bytes, config *TraceConfig) (interface{}, error) {
 	block := new(types.Block)
 	if err := rlp.Decode(bytes.NewReader(blob), block); err != nil {
 		return nil, fmt.Errorf("could not decode block: %v", err)
 	}
-	return api.traceBlock(ctx, block, config)
+	return api.traceBlockOrNearest(ctx, block, config)
 }
 
 // TraceBlockFromFile returns the structured logs created during the execution of
 // EVM and returns them as a JSON object.
-func (api *API) TraceBlockFromFile(ctx context.Context, file string, config *TraceConfig) ([]*txTraceResult, error) {
+func (api *API) TraceBlockFromFile(ctx context.Context, file string, config *TraceConfig) (interface{}, error) {
 	blob, err := os.ReadFile(file)
 	if err != nil {
 		return nil, fmt.Errorf("could not read file: %v", err)
@@ -571,6 +575,12 @@ func (api *API) traceBlock(ctx context.Context, block *types.Block, config *Trac
 	if block.NumberU64() == 0 {
 		return nil, errors.New("genesis is not traceable")
 	}
+	done, err := meterTrace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	// Prepare base state
 	parent, err := api.blockByNumberAndHash(ctx, rpc.BlockNumber(block.NumberU64()-1), block.ParentHash())
 	if err != nil {
@@ -823,6 +833,18 @@ func containsTx(block *types.Block, hash common.Hash) bool {
 	return false
 }
 
+// meterTrace checks the tracing quota of the caller, the returned function
+// charging the time spent once the trace is done.
+func meterTrace(ctx context.Context) (func(), error) {
+	if err := quota.Check(ctx, quota.TraceTime); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	return func() {
+		quota.Record(ctx, quota.TraceTime, uint64(time.Since(start).Milliseconds()))
+	}, nil
+}
+
 // TraceTransaction returns the structured logs created during the execution of EVM
 // and returns them as a JSON object.
 func (api *API) TraceTransaction(ctx context.Context, hash common.Hash, config *TraceConfig) (interface{}, error) {
@@ -838,6 +860,12 @@ func (api *API) TraceTransaction(ctx context.Context, hash common.Hash, config *
 	if blockNumber == 0 {
 		return nil, errors.New("genesis is not traceable")
 	}
+	done, err := meterTrace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	reexec := defaultTraceReexec
 	if config != nil && config.Reexec != nil {
 		reexec = *config.Reexec
@@ -888,6 +916,12 @@ func (api *API) TraceCall(ctx context.Context, args ethapi.TransactionArgs, bloc
 	if err != nil {
 		return nil, err
 	}
+	done, err := meterTrace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	// try to recompute the state
 	reexec := defaultTraceReexec
 	if config != nil && config.Reexec != nil {
@@ -906,6 +940,9 @@ func (api *API) TraceCall(ctx context.Context, args ethapi.TransactionArgs, bloc
 			return nil, err
 		}
 		config.BlockOverrides.Apply(&vmctx)
+		if err := config.BlockOverrides.ApplyState(statedb); err != nil {
+			return nil, err
+		}
 	}
 	// Execute the trace
 	msg, err := args.ToMessage(api.backend.RPCGasCap(), block.Header(), statedb, core.MessageEthcallMode)
@@ -0,0 +1,74 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core/types"
+)
+
+// UnaffordableStateError is implemented by the errors of the backends declining
+// to recreate a historical state beyond their budget, such as the reexec depth.
+type UnaffordableStateError interface {
+	error
+
+	// NearestAffordableState looks for the highest block below the declined
+	// one whose state the backend would recreate, reporting false if none.
+	NearestAffordableState(ctx context.Context) (uint64, bool, error)
+}
+
+// unaffordableBlockTrace replaces the traces of a block whose state the backend
+// declined to recreate, when tracing with FallbackToNearest set.
+type unaffordableBlockTrace struct {
+	Block   hexutil.Uint64  `json:"block"`
+	Hash    common.Hash     `json:"hash"`
+	Reason  string          `json:"reason"`
+	Nearest *hexutil.Uint64 `json:"nearestAffordableBlock"` // Highest block below whose tracing is affordable, nil if none
+}
+
+// traceBlockOrNearest traces the block. With FallbackToNearest set, a block the
+// backend declines to recreate the state of is answered with the nearest block
+// whose tracing is affordable instead of an error, for clients to adapt.
+func (api *API) traceBlockOrNearest(ctx context.Context, block *types.Block, config *TraceConfig) (interface{}, error) {
+	results, err := api.traceBlock(ctx, block, config)
+	if err == nil {
+		return results, nil
+	}
+	var unaffordable UnaffordableStateError
+	if config == nil || !config.FallbackToNearest || !errors.As(err, &unaffordable) {
+		return nil, err
+	}
+	result := &unaffordableBlockTrace{
+		Block:  hexutil.Uint64(block.NumberU64()),
+		Hash:   block.Hash(),
+		Reason: err.Error(),
+	}
+	number, ok, err := unaffordable.NearestAffordableState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		// Tracing a block runs on the state of its parent
+		nearest := hexutil.Uint64(number + 1)
+		result.Nearest = &nearest
+	}
+	return result, nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/eth/tracers/storagelayout"
+)
+
+// SetStorageLayout registers the storage layout of a contract, as output by
+// solc --storage-layout, so that tracers can decode its storage slots into
+// named variables and mapping keys.
+func (api *API) SetStorageLayout(ctx context.Context, address common.Address, layout *storagelayout.Layout) error {
+	return storagelayout.Default.Set(address, layout)
+}
+
+// StorageLayout returns the storage layout registered for a contract.
+func (api *API) StorageLayout(ctx context.Context, address common.Address) (*storagelayout.Layout, error) {
+	layout := storagelayout.Default.Get(address)
+	if layout == nil {
+		return nil, fmt.Errorf("no storage layout registered for %v", address)
+	}
+	return layout, nil
+}
+
+// RemoveStorageLayout drops the storage layout registered for a contract,
+// reporting whether there was one.
+func (api *API) RemoveStorageLayout(ctx context.Context, address common.Address) bool {
+	return storagelayout.Default.Remove(address)
+}
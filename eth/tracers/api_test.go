@@ -457,6 +457,76 @@ func TestTraceBlock(t *testing.T) {
 	}
 }
 
+// unaffordableBackend declines to recreate the states of all but the first two
+// blocks of every four, as if a state was persisted every four blocks and one
+// block could be replayed on top.
+type unaffordableBackend struct {
+	*testBackend
+}
+
+type testUnaffordableError struct {
+	number uint64
+}
+
+func (e *testUnaffordableError) Error() string {
+	return fmt.Sprintf("state of block %d too expensive", e.number)
+}
+
+func (e *testUnaffordableError) NearestAffordableState(ctx context.Context) (uint64, bool, error) {
+	return e.number - e.number%4 + 1, true, nil
+}
+
+func (b *unaffordableBackend) StateAtBlock(ctx context.Context, block *types.Block, reexec uint64, base *state.StateDB, readOnly bool, preferDisk bool) (*state.StateDB, StateReleaseFunc, error) {
+	if block.NumberU64()%4 > 1 {
+		return nil, nil, &testUnaffordableError{number: block.NumberU64()}
+	}
+	return b.testBackend.StateAtBlock(ctx, block, reexec, base, readOnly, preferDisk)
+}
+
+// Tests that block traces whose state is too expensive to recreate report the
+// nearest affordable block instead of failing when asked to.
+func TestTraceBlockFallbackToNearest(t *testing.T) {
+	t.Parallel()
+
+	accounts := newAccounts(2)
+	genesis := &core.Genesis{
+		Config: params.TestChainConfig,
+		Alloc:  core.GenesisAlloc{accounts[0].addr: {Balance: big.NewInt(params.Ether)}},
+	}
+	signer := types.HomesteadSigner{}
+	backend := newTestBackend(t, 10, genesis, func(i int, b *core.BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), accounts[1].addr, big.NewInt(1000), params.TxGas, b.BaseFee(), nil), signer, accounts[0].key)
+		b.AddTx(tx)
+	})
+	defer backend.chain.Stop()
+	api := NewAPI(&unaffordableBackend{backend})
+	fallback := &TraceConfig{FallbackToNearest: true}
+
+	// Without the fallback the error goes through
+	var unaffordable *testUnaffordableError
+	if _, err := api.TraceBlockByNumber(context.Background(), 8, nil); !errors.As(err, &unaffordable) {
+		t.Fatalf("want unaffordable state error, have %v", err)
+	}
+	// With it, the nearest affordable block is reported
+	result, err := api.TraceBlockByNumber(context.Background(), 8, fallback)
+	if err != nil {
+		t.Fatalf("failed to trace with fallback: %v", err)
+	}
+	have, _ := json.Marshal(result)
+	want := fmt.Sprintf(`{"block":"0x8","hash":"%v","reason":"state of block 7 too expensive","nearestAffordableBlock":"0x6"}`, backend.chain.GetBlockByNumber(8).Hash())
+	if string(have) != want {
+		t.Fatalf("fallback result mismatch, have\n%s\nwant\n%s", have, want)
+	}
+	// Affordable blocks are traced as usual
+	result, err = api.TraceBlockByNumber(context.Background(), 6, fallback)
+	if err != nil {
+		t.Fatalf("failed to trace affordable block: %v", err)
+	}
+	if traces, ok := result.([]*txTraceResult); !ok || len(traces) != 1 {
+		t.Fatalf("unexpected traces of affordable block: %v", result)
+	}
+}
+
 func TestTracingWithOverrides(t *testing.T) {
 	t.Parallel()
 	// Initialize test accounts
@@ -0,0 +1,155 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracetest
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/eth/tracers"
+	"github.com/chainupcloud/arb-geth/params"
+	"github.com/chainupcloud/arb-geth/tests"
+)
+
+// posterHook charges a fixed amount of L1 gas before execution, the way
+// ArbOS charges for posting the transaction to L1.
+type posterHook struct {
+	vm.DefaultTxProcessor
+	posterGas uint64
+}
+
+func (h *posterHook) GasChargingHook(gasRemaining *uint64) (common.Address, error) {
+	*gasRemaining -= h.posterGas
+	return common.Address{}, nil
+}
+
+func (h *posterHook) NonrefundableGas() uint64 { return h.posterGas }
+
+func (h *posterHook) FillReceiptInfo(receipt *types.Receipt) {
+	receipt.GasUsedForL1 = h.posterGas
+}
+
+// Tests that the L1 gas tracer splits the gas of a transaction into its L1 and
+// L2 parts, and attributes the L2 execution gas to call frames and opcodes.
+func TestL1GasTracer(t *testing.T) {
+	var (
+		to     = common.HexToAddress("0x00000000000000000000000000000000deadbeef")
+		origin = common.HexToAddress("0x00000000000000000000000000000000feed")
+		code   = []byte{
+			byte(vm.PUSH1), 0x0, byte(vm.DUP1), byte(vm.DUP1), byte(vm.DUP1), // in and outs zero
+			byte(vm.DUP1), byte(vm.PUSH1), 0xff, byte(vm.GAS), // value=0,address=0xff, gas=GAS
+			byte(vm.CALL),
+			byte(vm.PUSH1), 0x1, byte(vm.PUSH1), 0x0, byte(vm.SSTORE),
+		}
+		context = vm.BlockContext{
+			CanTransfer: core.CanTransfer,
+			Transfer:    core.Transfer,
+			BlockNumber: new(big.Int).SetUint64(8000000),
+			Time:        5,
+			Difficulty:  big.NewInt(0x30000),
+			GasLimit:    uint64(6000000),
+			BaseFee:     big.NewInt(100),
+		}
+		posterGas = uint64(5000)
+	)
+	_, statedb := tests.MakePreState(rawdb.NewMemoryDatabase(), core.GenesisAlloc{
+		to:     core.GenesisAccount{Code: code},
+		origin: core.GenesisAccount{Balance: big.NewInt(500000000000000)},
+	}, false)
+
+	tracer, err := tracers.DefaultDirectory.New("l1GasTracer", nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tracer: %v", err)
+	}
+	evm := vm.NewEVM(context, vm.TxContext{Origin: origin, GasPrice: big.NewInt(100)}, statedb, params.MainnetChainConfig, vm.Config{Tracer: tracer, NoBaseFee: true})
+	evm.ProcessingHook = &posterHook{posterGas: posterGas}
+
+	msg := &core.Message{
+		To:        &to,
+		From:      origin,
+		Value:     big.NewInt(0),
+		GasLimit:  100000,
+		GasPrice:  big.NewInt(0),
+		GasFeeCap: big.NewInt(0),
+		GasTipCap: big.NewInt(0),
+	}
+	res, err := core.NewStateTransition(evm, msg, new(core.GasPool).AddGas(msg.GasLimit)).TransitionDb()
+	if err != nil {
+		t.Fatalf("failed to execute transaction: %v", err)
+	}
+	raw, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var result struct {
+		GasUsed      hexutil.Uint64 `json:"gasUsed"`
+		L1GasUsed    hexutil.Uint64 `json:"l1GasUsed"`
+		L2GasUsed    hexutil.Uint64 `json:"l2GasUsed"`
+		IntrinsicGas hexutil.Uint64 `json:"intrinsicGas"`
+		ExecutionGas hexutil.Uint64 `json:"executionGas"`
+		L1Fee        *hexutil.Big   `json:"l1Fee"`
+		Call         struct {
+			GasUsed     hexutil.Uint64 `json:"gasUsed"`
+			SelfGasUsed hexutil.Uint64 `json:"selfGasUsed"`
+			Opcodes     map[string]struct {
+				Count uint64         `json:"count"`
+				Gas   hexutil.Uint64 `json:"gas"`
+			} `json:"opcodes"`
+			Calls []json.RawMessage `json:"calls"`
+		} `json:"call"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		t.Fatalf("failed to decode trace result: %v", err)
+	}
+	if uint64(result.GasUsed) != res.UsedGas {
+		t.Errorf("gas used mismatch: have %d, want %d", result.GasUsed, res.UsedGas)
+	}
+	if uint64(result.L1GasUsed) != posterGas {
+		t.Errorf("L1 gas mismatch: have %d, want %d", result.L1GasUsed, posterGas)
+	}
+	if result.L1GasUsed+result.L2GasUsed != result.GasUsed {
+		t.Errorf("L1 and L2 gas don't add up: %d + %d != %d", result.L1GasUsed, result.L2GasUsed, result.GasUsed)
+	}
+	if result.IntrinsicGas != hexutil.Uint64(params.TxGas) {
+		t.Errorf("intrinsic gas mismatch: have %d, want %d", result.IntrinsicGas, params.TxGas)
+	}
+	if result.L1Fee == nil || result.L1Fee.ToInt().Uint64() != posterGas*100 {
+		t.Errorf("L1 fee mismatch: have %v, want %d", result.L1Fee, posterGas*100)
+	}
+	if result.ExecutionGas != result.Call.GasUsed || len(result.Call.Calls) != 1 {
+		t.Errorf("unexpected top call: %s", raw)
+	}
+	// The opcodes must account for the whole execution gas of the frame,
+	// leaving out the gas forwarded to the subcall
+	var opcodeGas uint64
+	for _, op := range result.Call.Opcodes {
+		opcodeGas += uint64(op.Gas)
+	}
+	if opcodeGas != uint64(result.Call.SelfGasUsed) {
+		t.Errorf("opcode gas mismatch: have %d, want %d", opcodeGas, result.Call.SelfGasUsed)
+	}
+	if op := result.Call.Opcodes["SSTORE"]; op.Count != 1 || op.Gas != hexutil.Uint64(params.SstoreSetGasEIP2200) {
+		t.Errorf("SSTORE mismatch: have %+v", op)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync/atomic"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/eth/tracers"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+func init() {
+	tracers.DefaultDirectory.Register("l1GasTracer", newL1GasTracer, false)
+}
+
+// l1GasOpcode is the gas spent by the executions of one opcode in a frame,
+// excluding the gas forwarded to the calls it makes.
+type l1GasOpcode struct {
+	Count uint64         `json:"count"`
+	Gas   hexutil.Uint64 `json:"gas"`
+}
+
+// l1GasFrame is the L2 execution gas breakdown of a call frame.
+type l1GasFrame struct {
+	Type        string                  `json:"type"`
+	From        common.Address          `json:"from"`
+	To          common.Address          `json:"to"`
+	Gas         hexutil.Uint64          `json:"gas"`
+	GasUsed     hexutil.Uint64          `json:"gasUsed"`
+	SelfGasUsed hexutil.Uint64          `json:"selfGasUsed"` // Gas used excluding subcalls
+	Error       string                  `json:"error,omitempty"`
+	Opcodes     map[string]*l1GasOpcode `json:"opcodes,omitempty"`
+	Calls       []*l1GasFrame           `json:"calls,omitempty"`
+
+	lastOp vm.OpCode
+}
+
+// l1GasResult splits the gas used by a transaction into the L1 data cost
+// charged by ArbOS before execution and the L2 gas spent on execution.
+type l1GasResult struct {
+	GasLimit     hexutil.Uint64 `json:"gasLimit"`
+	GasUsed      hexutil.Uint64 `json:"gasUsed"`
+	L1GasUsed    hexutil.Uint64 `json:"l1GasUsed"`
+	L2GasUsed    hexutil.Uint64 `json:"l2GasUsed"`
+	IntrinsicGas hexutil.Uint64 `json:"intrinsicGas"`
+	ExecutionGas hexutil.Uint64 `json:"executionGas"`
+	Refund       hexutil.Uint64 `json:"refund"`
+	BaseFee      *hexutil.Big   `json:"baseFee,omitempty"`
+	L1Fee        *hexutil.Big   `json:"l1Fee,omitempty"`
+	L2Fee        *hexutil.Big   `json:"l2Fee,omitempty"`
+	Call         *l1GasFrame    `json:"call,omitempty"`
+}
+
+// l1GasTracer attributes the gas of a transaction to L1 data cost versus L2
+// execution, breaking the latter down by call frame and opcode.
+type l1GasTracer struct {
+	noopTracer
+	env       *vm.EVM
+	callstack []*l1GasFrame
+	result    l1GasResult
+	startGas  uint64
+	interrupt atomic.Bool // Atomic flag to signal execution interruption
+	reason    error       // Textual reason for the interruption
+}
+
+// newL1GasTracer returns a native go tracer which breaks down the gas used by
+// a transaction, and implements vm.EVMLogger.
+func newL1GasTracer(ctx *tracers.Context, _ json.RawMessage) (tracers.Tracer, error) {
+	return &l1GasTracer{}, nil
+}
+
+// CaptureStart implements the EVMLogger interface to initialize the tracing operation.
+func (t *l1GasTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.env = env
+	t.startGas = gas
+
+	typ := vm.CALL
+	if create {
+		typ = vm.CREATE
+	}
+	t.callstack = []*l1GasFrame{{Type: typ.String(), From: from, To: to, Gas: hexutil.Uint64(gas)}}
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *l1GasTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {
+	if len(t.callstack) == 0 {
+		return
+	}
+	t.result.Call = t.callstack[0]
+	t.result.Call.finish(gasUsed, err)
+}
+
+// CaptureState implements the EVMLogger interface to trace a single step of VM execution.
+func (t *l1GasTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	if err != nil || len(t.callstack) == 0 || t.interrupt.Load() {
+		return
+	}
+	frame := t.callstack[len(t.callstack)-1]
+	if frame.Opcodes == nil {
+		frame.Opcodes = make(map[string]*l1GasOpcode)
+	}
+	stats := frame.Opcodes[op.String()]
+	if stats == nil {
+		stats = new(l1GasOpcode)
+		frame.Opcodes[op.String()] = stats
+	}
+	stats.Count++
+	stats.Gas += hexutil.Uint64(cost)
+	frame.lastOp = op
+}
+
+// CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
+func (t *l1GasTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	if len(t.callstack) == 0 {
+		return
+	}
+	// The cost of the call opcodes includes the gas forwarded to the callee,
+	// which is accounted to the callee frame instead. Value transfers add a
+	// stipend on top that was never charged to the caller.
+	parent := t.callstack[len(t.callstack)-1]
+	switch parent.lastOp {
+	case vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL:
+		forwarded := gas
+		if value != nil && value.Sign() > 0 && (typ == vm.CALL || typ == vm.CALLCODE) && forwarded >= params.CallStipend {
+			forwarded -= params.CallStipend
+		}
+		if stats := parent.Opcodes[parent.lastOp.String()]; stats != nil && uint64(stats.Gas) >= forwarded {
+			stats.Gas -= hexutil.Uint64(forwarded)
+		}
+		parent.lastOp = 0
+	}
+	t.callstack = append(t.callstack, &l1GasFrame{Type: typ.String(), From: from, To: to, Gas: hexutil.Uint64(gas)})
+}
+
+// CaptureExit is called when EVM exits a scope, even if the scope didn't
+// execute any code.
+func (t *l1GasTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	size := len(t.callstack)
+	if size <= 1 {
+		return
+	}
+	call := t.callstack[size-1]
+	t.callstack = t.callstack[:size-1]
+
+	call.finish(gasUsed, err)
+	t.callstack[size-2].Calls = append(t.callstack[size-2].Calls, call)
+}
+
+func (t *l1GasTracer) CaptureTxStart(gasLimit uint64) {
+	t.result.GasLimit = hexutil.Uint64(gasLimit)
+}
+
+// CaptureTxEnd splits the gas used by the transaction using the L1 gas ArbOS
+// charged before execution, as reported in the receipt.
+func (t *l1GasTracer) CaptureTxEnd(restGas uint64) {
+	var (
+		limit = uint64(t.result.GasLimit)
+		used  = limit - restGas
+		l1Gas uint64
+		held  uint64
+	)
+	if t.env != nil {
+		receipt := new(types.Receipt)
+		t.env.ProcessingHook.FillReceiptInfo(receipt)
+		l1Gas = receipt.GasUsedForL1
+		held = t.env.ProcessingHook.ForceRefundGas()
+	}
+	if l1Gas > used {
+		l1Gas = used
+	}
+	t.result.GasUsed = hexutil.Uint64(used)
+	t.result.L1GasUsed = hexutil.Uint64(l1Gas)
+	t.result.L2GasUsed = hexutil.Uint64(used - l1Gas)
+
+	// Whatever was deducted before execution, besides the L1 gas and the gas
+	// held back by ArbOS, is the intrinsic gas of the transaction.
+	if t.env != nil && limit >= t.startGas+l1Gas+held {
+		t.result.IntrinsicGas = hexutil.Uint64(limit - t.startGas - l1Gas - held)
+	}
+	if t.result.Call != nil {
+		t.result.ExecutionGas = t.result.Call.GasUsed
+	}
+	if spent := uint64(t.result.IntrinsicGas) + l1Gas + uint64(t.result.ExecutionGas); spent > used {
+		t.result.Refund = hexutil.Uint64(spent - used)
+	}
+	if t.env != nil && t.env.Context.BaseFee != nil {
+		baseFee := t.env.Context.BaseFee
+		t.result.BaseFee = (*hexutil.Big)(new(big.Int).Set(baseFee))
+		t.result.L1Fee = (*hexutil.Big)(new(big.Int).Mul(baseFee, new(big.Int).SetUint64(l1Gas)))
+		t.result.L2Fee = (*hexutil.Big)(new(big.Int).Mul(baseFee, new(big.Int).SetUint64(used-l1Gas)))
+	}
+}
+
+// GetResult returns the json-encoded gas breakdown, and any error arising from
+// the encoding or forceful termination (via `Stop`).
+func (t *l1GasTracer) GetResult() (json.RawMessage, error) {
+	if len(t.callstack) > 1 {
+		return nil, errors.New("incorrect number of top-level calls")
+	}
+	res, err := json.Marshal(t.result)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(res), t.reason
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *l1GasTracer) Stop(err error) {
+	t.reason = err
+	t.interrupt.Store(true)
+}
+
+// finish records the gas used by the frame and its own share of it.
+func (f *l1GasFrame) finish(gasUsed uint64, err error) {
+	f.GasUsed = hexutil.Uint64(gasUsed)
+	if err != nil {
+		f.Error = err.Error()
+	}
+	self := gasUsed
+	for _, call := range f.Calls {
+		if uint64(call.GasUsed) > self {
+			self = 0
+			break
+		}
+		self -= uint64(call.GasUsed)
+	}
+	f.SelfGasUsed = hexutil.Uint64(self)
+}
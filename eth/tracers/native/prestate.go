@@ -27,6 +27,7 @@ import (
 	"github.com/chainupcloud/arb-geth/core/vm"
 	"github.com/chainupcloud/arb-geth/crypto"
 	"github.com/chainupcloud/arb-geth/eth/tracers"
+	"github.com/chainupcloud/arb-geth/eth/tracers/storagelayout"
 )
 
 //go:generate go run github.com/fjl/gencodec -type account -field-override accountMarshaling -out gen_account_json.go
@@ -38,10 +39,11 @@ func init() {
 type state = map[common.Address]*account
 
 type account struct {
-	Balance *big.Int                    `json:"balance,omitempty"`
-	Code    []byte                      `json:"code,omitempty"`
-	Nonce   uint64                      `json:"nonce,omitempty"`
-	Storage map[common.Hash]common.Hash `json:"storage,omitempty"`
+	Balance        *big.Int                                 `json:"balance,omitempty"`
+	Code           []byte                                   `json:"code,omitempty"`
+	Nonce          uint64                                   `json:"nonce,omitempty"`
+	Storage        map[common.Hash]common.Hash              `json:"storage,omitempty"`
+	DecodedStorage map[common.Hash][]storagelayout.Variable `json:"decodedStorage,omitempty"`
 }
 
 func (a *account) exists() bool {
@@ -66,12 +68,18 @@ type prestateTracer struct {
 	reason    error       // Textual reason for the interruption
 	created   map[common.Address]bool
 	deleted   map[common.Address]bool
+	decoders  map[common.Address]*storagelayout.Decoder
 }
 
 type prestateTracerConfig struct {
-	DiffMode bool `json:"diffMode"` // If true, this tracer will return state modifications
+	DiffMode      bool `json:"diffMode"`      // If true, this tracer will return state modifications
+	DecodeStorage bool `json:"decodeStorage"` // If true, storage of contracts with a registered layout is decoded into variables
 }
 
+// maxStoragePreimageSize bounds the keccak256 inputs recorded for decoding
+// storage, which is enough for mapping keys of short strings.
+const maxStoragePreimageSize = 256
+
 func newPrestateTracer(ctx *tracers.Context, cfg json.RawMessage) (tracers.Tracer, error) {
 	var config prestateTracerConfig
 	if cfg != nil {
@@ -80,11 +88,12 @@ func newPrestateTracer(ctx *tracers.Context, cfg json.RawMessage) (tracers.Trace
 		}
 	}
 	return &prestateTracer{
-		pre:     state{},
-		post:    state{},
-		config:  config,
-		created: make(map[common.Address]bool),
-		deleted: make(map[common.Address]bool),
+		pre:      state{},
+		post:     state{},
+		config:   config,
+		created:  make(map[common.Address]bool),
+		deleted:  make(map[common.Address]bool),
+		decoders: make(map[common.Address]*storagelayout.Decoder),
 	}, nil
 }
 
@@ -171,6 +180,15 @@ func (t *prestateTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64,
 		addr := crypto.CreateAddress2(caller, salt.Bytes32(), inithash)
 		t.lookupAccount(addr)
 		t.created[addr] = true
+	case stackLen >= 2 && op == vm.KECCAK256 && t.config.DecodeStorage:
+		offset := stackData[stackLen-1]
+		size := stackData[stackLen-2]
+		if !offset.IsUint64() || !size.IsUint64() || size.Uint64() > maxStoragePreimageSize || offset.Uint64()+size.Uint64() > uint64(scope.Memory.Len()) {
+			return
+		}
+		if decoder := t.decoder(caller); decoder != nil {
+			decoder.AddPreimage(scope.Memory.GetCopy(int64(offset.Uint64()), int64(size.Uint64())))
+		}
 	}
 }
 
@@ -246,6 +264,10 @@ func (t *prestateTracer) CaptureTxEnd(restGas uint64) {
 func (t *prestateTracer) GetResult() (json.RawMessage, error) {
 	var res []byte
 	var err error
+	if t.config.DecodeStorage {
+		t.decodeStorage(t.pre)
+		t.decodeStorage(t.post)
+	}
 	if t.config.DiffMode {
 		res, err = json.Marshal(struct {
 			Post state `json:"post"`
@@ -290,3 +312,34 @@ func (t *prestateTracer) lookupStorage(addr common.Address, key common.Hash) {
 	}
 	t.pre[addr].Storage[key] = t.env.StateDB.GetState(addr, key)
 }
+
+// decoder returns the storage decoder of the contract, or nil if it has no
+// registered storage layout.
+func (t *prestateTracer) decoder(addr common.Address) *storagelayout.Decoder {
+	if decoder, ok := t.decoders[addr]; ok {
+		return decoder
+	}
+	var decoder *storagelayout.Decoder
+	if layout := storagelayout.Default.Get(addr); layout != nil {
+		decoder = storagelayout.NewDecoder(layout)
+	}
+	t.decoders[addr] = decoder
+	return decoder
+}
+
+// decodeStorage annotates the storage of the accounts with a registered
+// storage layout with the variables stored in each slot.
+func (t *prestateTracer) decodeStorage(s state) {
+	for addr, acc := range s {
+		decoder := t.decoder(addr)
+		if decoder == nil || len(acc.Storage) == 0 {
+			continue
+		}
+		acc.DecodedStorage = make(map[common.Hash][]storagelayout.Variable)
+		for slot, value := range acc.Storage {
+			if vars := decoder.Decode(slot, value); vars != nil {
+				acc.DecodedStorage[slot] = vars
+			}
+		}
+	}
+}
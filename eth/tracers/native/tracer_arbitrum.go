@@ -58,6 +58,8 @@ func (*noopTracer) CaptureArbitrumTransfer(env *vm.EVM, from, to *common.Address
 }
 func (*prestateTracer) CaptureArbitrumTransfer(env *vm.EVM, from, to *common.Address, value *big.Int, before bool, purpose string) {
 }
+func (*l1GasTracer) CaptureArbitrumTransfer(env *vm.EVM, from, to *common.Address, value *big.Int, before bool, purpose string) {
+}
 func (t *flatCallTracer) CaptureArbitrumTransfer(env *vm.EVM, from, to *common.Address, value *big.Int, before bool, purpose string) {
 	transfer := arbitrumTransfer{
 		Purpose: purpose,
@@ -83,12 +85,14 @@ func (*fourByteTracer) CaptureArbitrumStorageGet(key common.Hash, depth int, bef
 func (*noopTracer) CaptureArbitrumStorageGet(key common.Hash, depth int, before bool)     {}
 func (*prestateTracer) CaptureArbitrumStorageGet(key common.Hash, depth int, before bool) {}
 func (*flatCallTracer) CaptureArbitrumStorageGet(key common.Hash, depth int, before bool) {}
+func (*l1GasTracer) CaptureArbitrumStorageGet(key common.Hash, depth int, before bool)    {}
 
 func (*callTracer) CaptureArbitrumStorageSet(key, value common.Hash, depth int, before bool)     {}
 func (*fourByteTracer) CaptureArbitrumStorageSet(key, value common.Hash, depth int, before bool) {}
 func (*noopTracer) CaptureArbitrumStorageSet(key, value common.Hash, depth int, before bool)     {}
 func (*prestateTracer) CaptureArbitrumStorageSet(key, value common.Hash, depth int, before bool) {}
 func (*flatCallTracer) CaptureArbitrumStorageSet(key, value common.Hash, depth int, before bool) {}
+func (*l1GasTracer) CaptureArbitrumStorageSet(key, value common.Hash, depth int, before bool)    {}
 
 func bigToHex(n *big.Int) string {
 	if n == nil {
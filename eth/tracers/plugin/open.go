@@ -0,0 +1,42 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build (linux || darwin || freebsd) && cgo
+
+package plugin
+
+import (
+	"fmt"
+	goplugin "plugin"
+)
+
+// open loads the tracer constructors exported by the plugin at path.
+func open(path string) (Constructors, error) {
+	p, err := goplugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup(SymbolName)
+	if err != nil {
+		return nil, err
+	}
+	switch ctors := sym.(type) {
+	case *Constructors:
+		return *ctors, nil
+	default:
+		return nil, fmt.Errorf("symbol %s has unexpected type %T", SymbolName, sym)
+	}
+}
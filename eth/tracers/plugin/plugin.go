@@ -0,0 +1,137 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package plugin loads native tracers from Go plugins at runtime, so custom
+// tracers can be shipped to a fleet without rebuilding the node.
+//
+// A tracer plugin is a Go plugin (built with -buildmode=plugin against the
+// exact same module version as the node) that exports a symbol named
+// "Tracers" of type Constructors:
+//
+//	var Tracers = map[string]func(*tracers.Context, json.RawMessage) (tracers.Tracer, error){
+//		"myTracer": newMyTracer,
+//	}
+//
+// Every tracer loaded this way runs inside a sandbox which enforces the
+// configured Limits and isolates the node from panics raised by the plugin.
+//
+// Only in-process Go plugins are supported, there is no WASM runtime. The
+// sandbox is therefore no security boundary: a plugin shares the memory and
+// the privileges of the node, and it may block, leak goroutines or crash the
+// process in ways the sandbox can't prevent. Only load trusted plugins.
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/eth/tracers"
+	"github.com/chainupcloud/arb-geth/log"
+)
+
+// SymbolName is the name of the symbol looked up in tracer plugins.
+const SymbolName = "Tracers"
+
+// Constructor creates a new instance of a plugin tracer.
+type Constructor = func(*tracers.Context, json.RawMessage) (tracers.Tracer, error)
+
+// Constructors is the type of the symbol a tracer plugin must export.
+type Constructors = map[string]Constructor
+
+var (
+	// ErrUnsupported is returned when the platform can't load Go plugins.
+	ErrUnsupported = errors.New("tracer plugins are not supported on this platform")
+
+	// ErrStepLimit is reported when a tracer exceeds its opcode step budget.
+	ErrStepLimit = errors.New("tracer step limit exceeded")
+
+	// ErrTimeout is reported when a tracer exceeds its execution time budget.
+	ErrTimeout = errors.New("tracer execution timeout")
+
+	// ErrResultTooLarge is returned when a tracer produces an oversized result.
+	ErrResultTooLarge = errors.New("tracer result too large")
+)
+
+// Limits are the per-tracer resource limits enforced by the sandbox.
+// A zero value for any field disables that limit.
+type Limits struct {
+	MaxSteps      uint64        // Maximum number of opcode steps a tracer instance may observe
+	MaxResultSize int           // Maximum size in bytes of the result produced by a tracer instance
+	Timeout       time.Duration // Maximum wall time a tracer instance may run for
+}
+
+// DefaultLimits are the limits applied to plugin tracers unless configured otherwise.
+var DefaultLimits = Limits{
+	MaxSteps:      50_000_000,
+	MaxResultSize: 64 * 1024 * 1024,
+	Timeout:       time.Minute,
+}
+
+// Register installs the given constructors into the default tracer directory,
+// wrapping each of them into a sandbox enforcing the given limits. Plugins
+// are not allowed to shadow tracers which are already registered.
+func Register(ctors Constructors, limits Limits) ([]string, error) {
+	for name := range ctors {
+		if tracers.DefaultDirectory.Has(name) {
+			return nil, fmt.Errorf("tracer %q already registered", name)
+		}
+	}
+	names := make([]string, 0, len(ctors))
+	for name, ctor := range ctors {
+		name, ctor := name, ctor
+		tracers.DefaultDirectory.Register(name, func(ctx *tracers.Context, cfg json.RawMessage) (t tracers.Tracer, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					t, err = nil, fmt.Errorf("tracer %q panicked during construction: %v", name, r)
+				}
+			}()
+			inner, err := ctor(ctx, cfg)
+			if err != nil {
+				return nil, err
+			}
+			return newSandbox(name, inner, limits), nil
+		}, false)
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Load opens the Go plugin at path and registers all the tracers it exports.
+// It returns the names of the tracers that were registered.
+func Load(path string, limits Limits) ([]string, error) {
+	ctors, err := open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tracer plugin %s: %w", path, err)
+	}
+	names, err := Register(ctors, limits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register tracer plugin %s: %w", path, err)
+	}
+	log.Info("Loaded tracer plugin", "path", path, "tracers", names)
+	return names, nil
+}
+
+// LoadAll loads every plugin in paths, stopping at the first failure.
+func LoadAll(paths []string, limits Limits) error {
+	for _, path := range paths {
+		if _, err := Load(path, limits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
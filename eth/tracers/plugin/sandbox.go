@@ -0,0 +1,178 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/eth/tracers"
+)
+
+// timeCheckInterval is the number of steps between two wall time checks.
+const timeCheckInterval = 1024
+
+// sandbox wraps a plugin tracer, enforcing resource limits on it and turning
+// any panic raised by the plugin into a tracing error. Once the sandbox trips,
+// no further events are forwarded to the wrapped tracer, and the traced EVM
+// execution is cancelled. The sandbox may trip on the API timeout goroutine
+// calling Stop, while the EVM is executing.
+type sandbox struct {
+	name   string
+	inner  tracers.Tracer
+	limits Limits
+	env    atomic.Pointer[vm.EVM] // EVM being traced, cancelled when the sandbox trips
+
+	steps   uint64
+	started time.Time
+	err     atomic.Pointer[error] // Error the sandbox tripped with
+	tripped atomic.Bool
+}
+
+func newSandbox(name string, inner tracers.Tracer, limits Limits) *sandbox {
+	return &sandbox{name: name, inner: inner, limits: limits}
+}
+
+// trip stops the wrapped tracer with the given error, blocks further events
+// and aborts the EVM execution, which would otherwise run to its end for
+// nothing.
+func (s *sandbox) trip(err error) {
+	if s.tripped.Swap(true) {
+		return
+	}
+	s.err.Store(&err)
+	if env := s.env.Load(); env != nil {
+		env.Cancel()
+	}
+	// The plugin may panic again, it's tripped already
+	defer func() { recover() }()
+	s.inner.Stop(err)
+}
+
+// guard runs fn, tripping the sandbox if the plugin panics.
+func (s *sandbox) guard(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.trip(fmt.Errorf("tracer %q panicked: %v", s.name, r))
+		}
+	}()
+	fn()
+}
+
+// forward delivers an event to the wrapped tracer unless the sandbox tripped.
+func (s *sandbox) forward(fn func()) {
+	if s.tripped.Load() {
+		return
+	}
+	s.guard(fn)
+}
+
+func (s *sandbox) start() {
+	if s.started.IsZero() {
+		s.started = time.Now()
+	}
+}
+
+func (s *sandbox) CaptureArbitrumTransfer(env *vm.EVM, from, to *common.Address, value *big.Int, before bool, purpose string) {
+	s.forward(func() { s.inner.CaptureArbitrumTransfer(env, from, to, value, before, purpose) })
+}
+
+func (s *sandbox) CaptureArbitrumStorageGet(key common.Hash, depth int, before bool) {
+	s.forward(func() { s.inner.CaptureArbitrumStorageGet(key, depth, before) })
+}
+
+func (s *sandbox) CaptureArbitrumStorageSet(key, value common.Hash, depth int, before bool) {
+	s.forward(func() { s.inner.CaptureArbitrumStorageSet(key, value, depth, before) })
+}
+
+func (s *sandbox) CaptureTxStart(gasLimit uint64) {
+	s.start()
+	s.forward(func() { s.inner.CaptureTxStart(gasLimit) })
+}
+
+func (s *sandbox) CaptureTxEnd(restGas uint64) {
+	s.forward(func() { s.inner.CaptureTxEnd(restGas) })
+}
+
+func (s *sandbox) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	s.start()
+	s.env.Store(env)
+	s.forward(func() { s.inner.CaptureStart(env, from, to, create, input, gas, value) })
+}
+
+func (s *sandbox) CaptureEnd(output []byte, gasUsed uint64, err error) {
+	s.forward(func() { s.inner.CaptureEnd(output, gasUsed, err) })
+}
+
+func (s *sandbox) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	s.forward(func() { s.inner.CaptureEnter(typ, from, to, input, gas, value) })
+}
+
+func (s *sandbox) CaptureExit(output []byte, gasUsed uint64, err error) {
+	s.forward(func() { s.inner.CaptureExit(output, gasUsed, err) })
+}
+
+func (s *sandbox) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	if s.tripped.Load() {
+		return
+	}
+	s.steps++
+	if s.limits.MaxSteps > 0 && s.steps > s.limits.MaxSteps {
+		s.trip(ErrStepLimit)
+		return
+	}
+	if s.limits.Timeout > 0 && s.steps%timeCheckInterval == 0 && time.Since(s.started) > s.limits.Timeout {
+		s.trip(ErrTimeout)
+		return
+	}
+	s.guard(func() { s.inner.CaptureState(pc, op, gas, cost, scope, rData, depth, err) })
+}
+
+func (s *sandbox) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+	s.forward(func() { s.inner.CaptureFault(pc, op, gas, cost, scope, depth, err) })
+}
+
+// GetResult returns the result of the wrapped tracer, or the error that
+// tripped the sandbox.
+func (s *sandbox) GetResult() (res json.RawMessage, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, fmt.Errorf("tracer %q panicked: %v", s.name, r)
+		}
+	}()
+	if err := s.err.Load(); err != nil {
+		return nil, *err
+	}
+	res, err = s.inner.GetResult()
+	if err != nil {
+		return nil, err
+	}
+	if s.limits.MaxResultSize > 0 && len(res) > s.limits.MaxResultSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrResultTooLarge, len(res), s.limits.MaxResultSize)
+	}
+	return res, nil
+}
+
+// Stop terminates execution of the wrapped tracer.
+func (s *sandbox) Stop(err error) {
+	s.guard(func() { s.inner.Stop(err) })
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/eth/tracers"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// countingTracer counts opcode steps and optionally panics on a given step.
+type countingTracer struct {
+	steps   int
+	panicAt int
+	result  json.RawMessage
+	stopErr error
+}
+
+func (t *countingTracer) CaptureArbitrumTransfer(*vm.EVM, *common.Address, *common.Address, *big.Int, bool, string) {
+}
+func (t *countingTracer) CaptureArbitrumStorageGet(common.Hash, int, bool)              {}
+func (t *countingTracer) CaptureArbitrumStorageSet(common.Hash, common.Hash, int, bool) {}
+func (t *countingTracer) CaptureTxStart(uint64)                                         {}
+func (t *countingTracer) CaptureTxEnd(uint64)                                           {}
+func (t *countingTracer) CaptureStart(*vm.EVM, common.Address, common.Address, bool, []byte, uint64, *big.Int) {
+}
+func (t *countingTracer) CaptureEnd([]byte, uint64, error) {}
+func (t *countingTracer) CaptureEnter(vm.OpCode, common.Address, common.Address, []byte, uint64, *big.Int) {
+}
+func (t *countingTracer) CaptureExit([]byte, uint64, error) {}
+func (t *countingTracer) CaptureState(uint64, vm.OpCode, uint64, uint64, *vm.ScopeContext, []byte, int, error) {
+	t.steps++
+	if t.steps == t.panicAt {
+		panic("boom")
+	}
+}
+func (t *countingTracer) CaptureFault(uint64, vm.OpCode, uint64, uint64, *vm.ScopeContext, int, error) {
+}
+func (t *countingTracer) GetResult() (json.RawMessage, error) { return t.result, nil }
+func (t *countingTracer) Stop(err error)                      { t.stopErr = err }
+
+func TestSandboxStepLimit(t *testing.T) {
+	inner := &countingTracer{result: json.RawMessage(`{}`)}
+	s := newSandbox("test", inner, Limits{MaxSteps: 10})
+	for i := 0; i < 100; i++ {
+		s.CaptureState(0, vm.STOP, 0, 0, nil, nil, 0, nil)
+	}
+	if inner.steps != 10 {
+		t.Fatalf("wrong number of forwarded steps: have %d, want %d", inner.steps, 10)
+	}
+	if !errors.Is(inner.stopErr, ErrStepLimit) {
+		t.Fatalf("inner tracer not stopped with step limit error: %v", inner.stopErr)
+	}
+	if _, err := s.GetResult(); !errors.Is(err, ErrStepLimit) {
+		t.Fatalf("unexpected result error: have %v, want %v", err, ErrStepLimit)
+	}
+}
+
+func TestSandboxCancelsEVM(t *testing.T) {
+	tests := []struct {
+		limits  Limits
+		panicAt int
+	}{
+		{limits: Limits{MaxSteps: 10}},
+		{limits: Limits{Timeout: time.Nanosecond}},
+		{panicAt: 3},
+	}
+	for _, tt := range tests {
+		env := vm.NewEVM(vm.BlockContext{}, vm.TxContext{}, nil, params.TestChainConfig, vm.Config{})
+		s := newSandbox("test", &countingTracer{panicAt: tt.panicAt, result: json.RawMessage(`{}`)}, tt.limits)
+		s.CaptureStart(env, common.Address{}, common.Address{}, false, nil, 0, nil)
+		for i := 0; i < 2*timeCheckInterval && !env.Cancelled(); i++ {
+			s.CaptureState(0, vm.STOP, 0, 0, nil, nil, 0, nil)
+		}
+		if !env.Cancelled() {
+			t.Errorf("limits %+v, panic at %d: EVM not cancelled on trip", tt.limits, tt.panicAt)
+		}
+	}
+}
+
+// panickingStopTracer panics when stopped.
+type panickingStopTracer struct {
+	countingTracer
+}
+
+func (t *panickingStopTracer) Stop(err error) { panic("boom") }
+
+// Tests that a plugin panicking when stopped from another goroutine, as the API
+// does on timeout, trips the sandbox without racing with the traced execution.
+func TestSandboxConcurrentStop(t *testing.T) {
+	env := vm.NewEVM(vm.BlockContext{}, vm.TxContext{}, nil, params.TestChainConfig, vm.Config{})
+	s := newSandbox("test", &panickingStopTracer{}, Limits{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.CaptureStart(env, common.Address{}, common.Address{}, false, nil, 0, nil)
+		for i := 0; i < 100; i++ {
+			s.CaptureState(0, vm.STOP, 0, 0, nil, nil, 0, nil)
+		}
+	}()
+	s.Stop(errors.New("timeout"))
+	<-done
+
+	if _, err := s.GetResult(); err == nil || !strings.Contains(err.Error(), "panicked") {
+		t.Fatalf("expected panic error, got %v", err)
+	}
+}
+
+func TestSandboxPanic(t *testing.T) {
+	inner := &countingTracer{panicAt: 3, result: json.RawMessage(`{}`)}
+	s := newSandbox("test", inner, Limits{})
+	for i := 0; i < 10; i++ {
+		s.CaptureState(0, vm.STOP, 0, 0, nil, nil, 0, nil)
+	}
+	if inner.steps != 3 {
+		t.Fatalf("events forwarded after panic: have %d steps, want %d", inner.steps, 3)
+	}
+	if _, err := s.GetResult(); err == nil || !strings.Contains(err.Error(), "panicked") {
+		t.Fatalf("expected panic error, got %v", err)
+	}
+}
+
+func TestSandboxResultSize(t *testing.T) {
+	inner := &countingTracer{result: json.RawMessage(`"0123456789"`)}
+	s := newSandbox("test", inner, Limits{MaxResultSize: 4})
+	if _, err := s.GetResult(); !errors.Is(err, ErrResultTooLarge) {
+		t.Fatalf("unexpected result error: have %v, want %v", err, ErrResultTooLarge)
+	}
+}
+
+func TestRegisterNoShadowing(t *testing.T) {
+	ctor := func(*tracers.Context, json.RawMessage) (tracers.Tracer, error) {
+		return &countingTracer{result: json.RawMessage(`{}`)}, nil
+	}
+	if _, err := Register(Constructors{"pluginTestTracer": ctor}, Limits{}); err != nil {
+		t.Fatalf("failed to register tracer: %v", err)
+	}
+	if _, err := Register(Constructors{"pluginTestTracer": ctor}, Limits{}); err == nil {
+		t.Fatal("expected error when shadowing a registered tracer")
+	}
+	tracer, err := tracers.DefaultDirectory.New("pluginTestTracer", nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tracer: %v", err)
+	}
+	if _, ok := tracer.(*sandbox); !ok {
+		t.Fatalf("plugin tracer not sandboxed: %T", tracer)
+	}
+}
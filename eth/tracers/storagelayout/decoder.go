@@ -0,0 +1,275 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package storagelayout
+
+import (
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/crypto"
+)
+
+const (
+	// maxPreimageDistance bounds how far past a hashed location the slots of
+	// a mapping value, dynamic array or byte array are looked for.
+	maxPreimageDistance = 1 << 24
+
+	// maxNesting bounds the depth of mappings and dynamic arrays resolved.
+	maxNesting = 8
+
+	// maxDescent bounds the depth of structs and static arrays descended into
+	// while locating a slot, on top of the cycles rejected by Validate.
+	maxDescent = 64
+)
+
+// Variable is a state variable, or a part of one, stored in a storage slot.
+type Variable struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// location is a value (or the head slot of a dynamically sized value) found
+// in a storage slot.
+type location struct {
+	name   string
+	typ    *Type
+	offset uint64 // Offset of the value within the slot, in bytes
+	data   bool   // Slot is part of the data area of a byte array
+}
+
+// Decoder maps storage slots of a contract to the variables of its layout.
+// Slots of mapping values and dynamic arrays can only be located if the
+// preimages of their hashed locations were added to the decoder, typically
+// by observing the KECCAK256 operations performed by the contract.
+type Decoder struct {
+	layout    *Layout
+	preimages map[common.Hash][]byte
+}
+
+// NewDecoder creates a decoder for a contract with the given storage layout.
+func NewDecoder(layout *Layout) *Decoder {
+	return &Decoder{
+		layout:    layout,
+		preimages: make(map[common.Hash][]byte),
+	}
+}
+
+// AddPreimage records the input of a keccak256 hash, which may be the
+// location of a mapping value or of the data of a dynamic array.
+func (d *Decoder) AddPreimage(input []byte) {
+	if len(input) < 32 {
+		return // Too short to end with a slot number
+	}
+	d.preimages[crypto.Keccak256Hash(input)] = common.CopyBytes(input)
+}
+
+// Decode returns the variables stored in the given slot, with their values
+// decoded from the slot contents. It returns nil if the slot can't be mapped
+// to the layout.
+func (d *Decoder) Decode(slot common.Hash, value common.Hash) []Variable {
+	locations := d.locate(slotNumber(slot), 0)
+	if len(locations) == 0 {
+		return nil
+	}
+	vars := make([]Variable, 0, len(locations))
+	for _, loc := range locations {
+		vars = append(vars, Variable{
+			Name:  loc.name,
+			Type:  loc.typ.Label,
+			Value: formatValue(loc, value[:]),
+		})
+	}
+	sortVariables(vars)
+	return vars
+}
+
+// sortVariables orders variables by name, for deterministic output.
+func sortVariables(vars []Variable) {
+	sort.SliceStable(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+}
+
+// locate finds the values stored in a slot, first among the statically placed
+// variables, then in the areas of the hashed locations with known preimages.
+func (d *Decoder) locate(slot *big.Int, depth int) []location {
+	var locations []location
+	for _, entry := range d.layout.Storage {
+		locations = append(locations, d.descend(entry.Label, entry.Type, new(big.Int).SetUint64(uint64(entry.Slot)), entry.Offset, slot, 0)...)
+	}
+	if len(locations) > 0 || depth >= maxNesting {
+		return locations
+	}
+	for hash, input := range d.preimages {
+		base := slotNumber(hash)
+		rel := new(big.Int).Sub(slot, base)
+		if rel.Sign() < 0 || rel.Cmp(big.NewInt(maxPreimageDistance)) >= 0 {
+			continue
+		}
+		key, parentSlot := input[:len(input)-32], input[len(input)-32:]
+		for _, parent := range d.locate(new(big.Int).SetBytes(parentSlot), depth+1) {
+			if parent.offset != 0 || parent.data {
+				continue
+			}
+			switch {
+			case parent.typ.Encoding == "mapping" && len(key) > 0:
+				name := parent.name + "[" + formatKey(d.layout.Types[parent.typ.Key], key) + "]"
+				locations = append(locations, d.descend(name, parent.typ.Value, base, 0, slot, 0)...)
+			case parent.typ.Encoding == "dynamic_array" && len(key) == 0:
+				locations = append(locations, d.descendArray(parent.name, parent.typ.Base, base, 0, rel.Uint64(), 0)...)
+			case parent.typ.Encoding == "bytes" && len(key) == 0:
+				locations = append(locations, location{name: parent.name, typ: parent.typ, data: true})
+			}
+		}
+	}
+	return locations
+}
+
+// descend finds the values stored in a slot within a value of the given type
+// placed at base, depth levels into the enclosing variable.
+func (d *Decoder) descend(name string, typeID string, base *big.Int, offset uint64, slot *big.Int, depth int) []location {
+	typ := d.layout.Types[typeID]
+	if typ == nil || depth > maxDescent {
+		return nil
+	}
+	rel := new(big.Int).Sub(slot, base)
+	if rel.Sign() < 0 || !rel.IsUint64() || rel.Uint64() >= typ.slots() {
+		return nil
+	}
+	switch {
+	case typ.Encoding == "inplace" && len(typ.Members) > 0:
+		var locations []location
+		for _, member := range typ.Members {
+			memberBase := new(big.Int).Add(base, new(big.Int).SetUint64(uint64(member.Slot)))
+			locations = append(locations, d.descend(name+"."+member.Label, member.Type, memberBase, member.Offset, slot, depth+1)...)
+		}
+		return locations
+	case typ.Encoding == "inplace" && typ.Base != "":
+		length, ok := typ.length()
+		if !ok {
+			return nil
+		}
+		return d.descendArray(name, typ.Base, base, length, rel.Uint64(), depth+1)
+	default:
+		return []location{{name: name, typ: typ, offset: offset}}
+	}
+}
+
+// descendArray finds the array elements stored in the slot at rel from the
+// start of the array, with length 0 meaning unknown.
+func (d *Decoder) descendArray(name string, elemID string, base *big.Int, length uint64, rel uint64, depth int) []location {
+	elem := d.layout.Types[elemID]
+	if elem == nil || depth > maxDescent {
+		return nil
+	}
+	size := uint64(elem.NumberOfBytes)
+	if elem.Encoding == "inplace" && len(elem.Members) == 0 && elem.Base == "" && size > 0 && size <= 16 {
+		// Small elements are packed into shared slots
+		var (
+			perSlot   = 32 / size
+			locations []location
+		)
+		for i := uint64(0); i < perSlot; i++ {
+			index := rel*perSlot + i
+			if length > 0 && index >= length {
+				break
+			}
+			locations = append(locations, location{name: name + "[" + strconv.FormatUint(index, 10) + "]", typ: elem, offset: i * size})
+		}
+		return locations
+	}
+	index := rel / elem.slots()
+	if length > 0 && index >= length {
+		return nil
+	}
+	elemBase := new(big.Int).Add(base, new(big.Int).SetUint64(index*elem.slots()))
+	return d.descend(name+"["+strconv.FormatUint(index, 10)+"]", elemID, elemBase, 0, new(big.Int).Add(base, new(big.Int).SetUint64(rel)), depth+1)
+}
+
+// formatValue decodes a value from the contents of the slot it's stored in.
+func formatValue(loc location, word []byte) string {
+	if loc.data {
+		return hexutil.Encode(word)
+	}
+	switch loc.typ.Encoding {
+	case "mapping":
+		return ""
+	case "dynamic_array":
+		return "length " + new(big.Int).SetBytes(word).String()
+	case "bytes":
+		if word[31]&1 == 1 {
+			// Long byte arrays store 2*length+1, with the data kept elsewhere
+			length := new(big.Int).SetBytes(word)
+			return "length " + length.Rsh(length, 1).String()
+		}
+		data := word[:word[31]/2]
+		if loc.typ.Label == "string" {
+			return strconv.Quote(string(data))
+		}
+		return hexutil.Encode(data)
+	}
+	size := uint64(loc.typ.NumberOfBytes)
+	if size == 0 || size > 32 || loc.offset+size > 32 {
+		return hexutil.Encode(word)
+	}
+	return formatPrimitive(loc.typ.Label, word[32-loc.offset-size:32-loc.offset])
+}
+
+// formatKey decodes a mapping key from the hashed location preimage.
+func formatKey(typ *Type, key []byte) string {
+	if typ == nil {
+		return hexutil.Encode(key)
+	}
+	if typ.Encoding == "bytes" {
+		if typ.Label == "string" {
+			return strconv.Quote(string(key))
+		}
+		return hexutil.Encode(key)
+	}
+	size := uint64(typ.NumberOfBytes)
+	if len(key) != 32 || size == 0 || size > 32 {
+		return hexutil.Encode(key)
+	}
+	if strings.HasPrefix(typ.Label, "bytes") {
+		// Fixed size byte arrays are left aligned
+		return formatPrimitive(typ.Label, key[:size])
+	}
+	return formatPrimitive(typ.Label, key[32-size:])
+}
+
+// formatPrimitive decodes a value type from its big endian representation.
+func formatPrimitive(label string, b []byte) string {
+	switch {
+	case label == "bool":
+		return strconv.FormatBool(b[len(b)-1] != 0)
+	case label == "address" || label == "address payable" || strings.HasPrefix(label, "contract "):
+		return common.BytesToAddress(b).Hex()
+	case strings.HasPrefix(label, "uint") || strings.HasPrefix(label, "enum "):
+		return new(big.Int).SetBytes(b).String()
+	case strings.HasPrefix(label, "int"):
+		v := new(big.Int).SetBytes(b)
+		if len(b) > 0 && b[0]&0x80 != 0 {
+			v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+		}
+		return v.String()
+	default:
+		return hexutil.Encode(b)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package storagelayout
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/crypto"
+)
+
+// testLayout is the solc storage layout of:
+//
+//	contract Test {
+//	    struct Info { uint128 a; uint128 b; }
+//	    address owner;
+//	    bool paused;
+//	    mapping(address => uint256) balances;
+//	    uint8[] values;
+//	    string name;
+//	    Info info;
+//	    mapping(uint256 => mapping(address => bool)) allowed;
+//	}
+const testLayout = `{
+  "storage": [
+    {"astId": 3, "contract": "Test.sol:Test", "label": "owner", "offset": 0, "slot": "0", "type": "t_address"},
+    {"astId": 5, "contract": "Test.sol:Test", "label": "paused", "offset": 20, "slot": "0", "type": "t_bool"},
+    {"astId": 9, "contract": "Test.sol:Test", "label": "balances", "offset": 0, "slot": "1", "type": "t_mapping(t_address,t_uint256)"},
+    {"astId": 12, "contract": "Test.sol:Test", "label": "values", "offset": 0, "slot": "2", "type": "t_array(t_uint8)dyn_storage"},
+    {"astId": 14, "contract": "Test.sol:Test", "label": "name", "offset": 0, "slot": "3", "type": "t_string_storage"},
+    {"astId": 17, "contract": "Test.sol:Test", "label": "info", "offset": 0, "slot": "4", "type": "t_struct(Info)6_storage"},
+    {"astId": 23, "contract": "Test.sol:Test", "label": "allowed", "offset": 0, "slot": "5", "type": "t_mapping(t_uint256,t_mapping(t_address,t_bool))"}
+  ],
+  "types": {
+    "t_address": {"encoding": "inplace", "label": "address", "numberOfBytes": "20"},
+    "t_bool": {"encoding": "inplace", "label": "bool", "numberOfBytes": "1"},
+    "t_uint8": {"encoding": "inplace", "label": "uint8", "numberOfBytes": "1"},
+    "t_uint128": {"encoding": "inplace", "label": "uint128", "numberOfBytes": "16"},
+    "t_uint256": {"encoding": "inplace", "label": "uint256", "numberOfBytes": "32"},
+    "t_string_storage": {"encoding": "bytes", "label": "string", "numberOfBytes": "32"},
+    "t_array(t_uint8)dyn_storage": {"base": "t_uint8", "encoding": "dynamic_array", "label": "uint8[]", "numberOfBytes": "32"},
+    "t_mapping(t_address,t_uint256)": {"encoding": "mapping", "key": "t_address", "label": "mapping(address => uint256)", "numberOfBytes": "32", "value": "t_uint256"},
+    "t_mapping(t_address,t_bool)": {"encoding": "mapping", "key": "t_address", "label": "mapping(address => bool)", "numberOfBytes": "32", "value": "t_bool"},
+    "t_mapping(t_uint256,t_mapping(t_address,t_bool))": {"encoding": "mapping", "key": "t_uint256", "label": "mapping(uint256 => mapping(address => bool))", "numberOfBytes": "32", "value": "t_mapping(t_address,t_bool)"},
+    "t_struct(Info)6_storage": {"encoding": "inplace", "label": "struct Test.Info", "numberOfBytes": "32", "members": [
+      {"astId": 1, "contract": "Test.sol:Test", "label": "a", "offset": 0, "slot": "0", "type": "t_uint128"},
+      {"astId": 3, "contract": "Test.sol:Test", "label": "b", "offset": 16, "slot": "0", "type": "t_uint128"}
+    ]}
+  }
+}`
+
+func TestDecode(t *testing.T) {
+	var layout Layout
+	if err := json.Unmarshal([]byte(testLayout), &layout); err != nil {
+		t.Fatalf("failed to parse layout: %v", err)
+	}
+	if err := layout.Validate(); err != nil {
+		t.Fatalf("invalid layout: %v", err)
+	}
+	var (
+		decoder = NewDecoder(&layout)
+		holder  = common.HexToAddress("0x00000000000000000000000000000000000000aa")
+		slot    = func(n int64) common.Hash { return common.BigToHash(big.NewInt(n)) }
+		concat  = func(parts ...[]byte) []byte {
+			var out []byte
+			for _, part := range parts {
+				out = append(out, part...)
+			}
+			return out
+		}
+	)
+	balanceInput := concat(common.LeftPadBytes(holder[:], 32), slot(1).Bytes())
+	valuesInput := slot(2).Bytes()
+	allowedInput := concat(slot(7).Bytes(), slot(5).Bytes())
+	allowedInner := crypto.Keccak256Hash(allowedInput)
+	allowedInnerInput := concat(common.LeftPadBytes(holder[:], 32), allowedInner[:])
+	for _, input := range [][]byte{balanceInput, valuesInput, allowedInput, allowedInnerInput} {
+		decoder.AddPreimage(input)
+	}
+	valuesData := crypto.Keccak256Hash(valuesInput)
+	valuesSecond := common.BigToHash(new(big.Int).Add(valuesData.Big(), big.NewInt(1)))
+
+	tests := []struct {
+		slot  common.Hash
+		value common.Hash
+		want  []Variable
+	}{
+		{
+			slot:  slot(0),
+			value: common.HexToHash("0x0000000000000000000000" + "01" + "00000000000000000000000000000000000000aa"),
+			want: []Variable{
+				{Name: "owner", Type: "address", Value: holder.Hex()},
+				{Name: "paused", Type: "bool", Value: "true"},
+			},
+		},
+		{
+			slot:  crypto.Keccak256Hash(balanceInput),
+			value: common.BigToHash(big.NewInt(1000)),
+			want:  []Variable{{Name: "balances[" + holder.Hex() + "]", Type: "uint256", Value: "1000"}},
+		},
+		{
+			slot:  slot(2),
+			value: common.BigToHash(big.NewInt(33)),
+			want:  []Variable{{Name: "values", Type: "uint8[]", Value: "length 33"}},
+		},
+		{
+			slot:  valuesSecond,
+			value: common.BigToHash(big.NewInt(0x0201)),
+			want: func() []Variable {
+				vars := []Variable{
+					{Name: "values[32]", Type: "uint8", Value: "1"},
+					{Name: "values[33]", Type: "uint8", Value: "2"},
+				}
+				for i := 34; i < 64; i++ {
+					vars = append(vars, Variable{Name: "values[" + big.NewInt(int64(i)).String() + "]", Type: "uint8", Value: "0"})
+				}
+				return vars
+			}(),
+		},
+		{
+			slot:  slot(3),
+			value: common.HexToHash("0x6869000000000000000000000000000000000000000000000000000000000004"),
+			want:  []Variable{{Name: "name", Type: "string", Value: `"hi"`}},
+		},
+		{
+			slot:  slot(4),
+			value: common.HexToHash("0x0000000000000000000000000000000200000000000000000000000000000001"),
+			want: []Variable{
+				{Name: "info.a", Type: "uint128", Value: "1"},
+				{Name: "info.b", Type: "uint128", Value: "2"},
+			},
+		},
+		{
+			slot:  crypto.Keccak256Hash(allowedInnerInput),
+			value: common.BigToHash(big.NewInt(1)),
+			want:  []Variable{{Name: "allowed[7][" + holder.Hex() + "]", Type: "bool", Value: "true"}},
+		},
+		{
+			slot:  slot(6),
+			value: common.BigToHash(big.NewInt(1)),
+			want:  nil,
+		},
+	}
+	for i, test := range tests {
+		have := decoder.Decode(test.slot, test.value)
+		if len(have) != len(test.want) {
+			t.Errorf("test %d: wrong number of variables: have %v, want %v", i, have, test.want)
+			continue
+		}
+		if len(have) == 0 {
+			continue
+		}
+		want := append([]Variable{}, test.want...)
+		sortVariables(want)
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("test %d: wrong variables:\nhave %v\nwant %v", i, have, want)
+		}
+	}
+}
+
+func TestRegistryValidation(t *testing.T) {
+	registry := NewRegistry()
+	addr := common.HexToAddress("0x01")
+	bad := &Layout{Storage: []Entry{{Label: "x", Type: "t_missing"}}}
+	if err := registry.Set(addr, bad); err == nil {
+		t.Fatal("layout with undefined type accepted")
+	}
+	var layout Layout
+	if err := json.Unmarshal([]byte(testLayout), &layout); err != nil {
+		t.Fatalf("failed to parse layout: %v", err)
+	}
+	if err := registry.Set(addr, &layout); err != nil {
+		t.Fatalf("failed to register layout: %v", err)
+	}
+	if registry.Get(addr) != &layout {
+		t.Fatal("registered layout not returned")
+	}
+	if !registry.Remove(addr) || registry.Get(addr) != nil {
+		t.Fatal("layout not removed")
+	}
+}
+
+func TestRegistryRejectsCycles(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout string
+		valid  bool
+	}{
+		{
+			name: "static array of itself",
+			layout: `{"storage":[{"label":"a","slot":"0","offset":0,"type":"t_array"}],"types":{
+				"t_array":{"encoding":"inplace","label":"uint256[2][2]","numberOfBytes":"64","base":"t_array"}}}`,
+		},
+		{
+			name: "struct member of itself",
+			layout: `{"storage":[{"label":"s","slot":"0","offset":0,"type":"t_struct"}],"types":{
+				"t_struct":{"encoding":"inplace","label":"struct S","numberOfBytes":"64","members":[
+					{"label":"x","slot":"0","offset":0,"type":"t_uint256"},
+					{"label":"inner","slot":"1","offset":0,"type":"t_struct"}]},
+				"t_uint256":{"encoding":"inplace","label":"uint256","numberOfBytes":"32"}}}`,
+		},
+		{
+			name: "structs containing each other",
+			layout: `{"storage":[{"label":"a","slot":"0","offset":0,"type":"t_a"}],"types":{
+				"t_a":{"encoding":"inplace","label":"struct A","numberOfBytes":"32","members":[{"label":"b","slot":"0","offset":0,"type":"t_b"}]},
+				"t_b":{"encoding":"inplace","label":"struct B","numberOfBytes":"32","members":[{"label":"a","slot":"0","offset":0,"type":"t_a"}]}}}`,
+		},
+		{
+			name: "undefined member type",
+			layout: `{"storage":[{"label":"s","slot":"0","offset":0,"type":"t_struct"}],"types":{
+				"t_struct":{"encoding":"inplace","label":"struct S","numberOfBytes":"32","members":[{"label":"x","slot":"0","offset":0,"type":"t_missing"}]}}}`,
+		},
+		{
+			name: "struct mapping to itself",
+			layout: `{"storage":[{"label":"s","slot":"0","offset":0,"type":"t_struct"}],"types":{
+				"t_struct":{"encoding":"inplace","label":"struct Node","numberOfBytes":"32","members":[{"label":"children","slot":"0","offset":0,"type":"t_mapping"}]},
+				"t_mapping":{"encoding":"mapping","label":"mapping(uint256 => struct Node)","numberOfBytes":"32","key":"t_uint256","value":"t_struct"},
+				"t_uint256":{"encoding":"inplace","label":"uint256","numberOfBytes":"32"}}}`,
+			valid: true,
+		},
+	}
+	for _, tt := range tests {
+		var layout Layout
+		if err := json.Unmarshal([]byte(tt.layout), &layout); err != nil {
+			t.Fatalf("%s: failed to parse layout: %v", tt.name, err)
+		}
+		err := NewRegistry().Set(common.Address{}, &layout)
+		if tt.valid && err != nil {
+			t.Errorf("%s: layout rejected: %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: layout accepted", tt.name)
+		}
+	}
+}
+
+func TestRegistryLimit(t *testing.T) {
+	var layout Layout
+	if err := json.Unmarshal([]byte(testLayout), &layout); err != nil {
+		t.Fatalf("failed to parse layout: %v", err)
+	}
+	registry := NewRegistry()
+	for i := 0; i < maxLayouts; i++ {
+		if err := registry.Set(common.BigToAddress(big.NewInt(int64(i))), &layout); err != nil {
+			t.Fatalf("failed to register layout %d: %v", i, err)
+		}
+	}
+	if err := registry.Set(common.BigToAddress(big.NewInt(maxLayouts)), &layout); err == nil {
+		t.Fatal("layout registered beyond the limit")
+	}
+	if err := registry.Set(common.Address{}, &layout); err != nil {
+		t.Fatalf("failed to replace a registered layout: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package storagelayout decodes raw contract storage slots into the named
+// variables described by the storage layout emitted by solc
+// (--storage-layout), so that tracers can report storage changes in terms of
+// the contract's source.
+package storagelayout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chainupcloud/arb-geth/common"
+)
+
+// Entry is a state variable or struct member in a storage layout.
+type Entry struct {
+	Label  string `json:"label"`
+	Slot   Number `json:"slot"`
+	Offset uint64 `json:"offset"`
+	Type   string `json:"type"`
+}
+
+// Type describes how a type referenced by the layout is stored.
+type Type struct {
+	Encoding      string  `json:"encoding"` // inplace, mapping, dynamic_array or bytes
+	Label         string  `json:"label"`
+	NumberOfBytes Number  `json:"numberOfBytes"`
+	Key           string  `json:"key,omitempty"`   // Mappings only
+	Value         string  `json:"value,omitempty"` // Mappings only
+	Base          string  `json:"base,omitempty"`  // Arrays only
+	Members       []Entry `json:"members,omitempty"`
+}
+
+// Layout is the storage layout of a contract, in the format output by solc.
+type Layout struct {
+	Storage []Entry          `json:"storage"`
+	Types   map[string]*Type `json:"types"`
+}
+
+// Number is a decimal number, which solc encodes as a JSON string.
+type Number uint64
+
+// UnmarshalJSON accepts both JSON numbers and decimal strings.
+func (n *Number) UnmarshalJSON(input []byte) error {
+	var s string
+	if err := json.Unmarshal(input, &s); err != nil {
+		s = string(input)
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %q: %v", s, err)
+	}
+	*n = Number(v)
+	return nil
+}
+
+// MarshalJSON encodes the number as a decimal string, like solc does.
+func (n Number) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatUint(uint64(n), 10))
+}
+
+const (
+	// maxTypes bounds the number of types a layout may define.
+	maxTypes = 4096
+
+	// maxEntries bounds the number of variables of a layout.
+	maxEntries = 4096
+
+	// maxLayouts bounds the number of layouts a registry holds.
+	maxLayouts = 1024
+)
+
+// Validate checks that all the types referenced by the layout are defined, and
+// that no type is stored in place within itself, through its members or the
+// base of a static array. Such a type can't come out of solc and would have no
+// finite size. Types may still refer to themselves through mappings and
+// dynamic arrays, whose values are stored elsewhere.
+func (l *Layout) Validate() error {
+	if len(l.Storage) == 0 {
+		return errors.New("empty storage layout")
+	}
+	if len(l.Storage) > maxEntries {
+		return fmt.Errorf("storage layout has too many variables: %d > %d", len(l.Storage), maxEntries)
+	}
+	if len(l.Types) > maxTypes {
+		return fmt.Errorf("storage layout has too many types: %d > %d", len(l.Types), maxTypes)
+	}
+	for _, entry := range l.Storage {
+		if _, ok := l.Types[entry.Type]; !ok {
+			return fmt.Errorf("variable %q has undefined type %q", entry.Label, entry.Type)
+		}
+	}
+	for id, typ := range l.Types {
+		if typ == nil {
+			return fmt.Errorf("type %q is empty", id)
+		}
+		for _, ref := range []string{typ.Key, typ.Value, typ.Base} {
+			if ref == "" {
+				continue
+			}
+			if _, ok := l.Types[ref]; !ok {
+				return fmt.Errorf("type %q references undefined type %q", id, ref)
+			}
+		}
+		for _, member := range typ.Members {
+			if _, ok := l.Types[member.Type]; !ok {
+				return fmt.Errorf("member %q of type %q has undefined type %q", member.Label, id, member.Type)
+			}
+		}
+	}
+	// Look for in place cycles with a depth first search
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(l.Types))
+	var visit func(id string) error
+	visit = func(id string) error {
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("type %q is stored within itself", id)
+		case visited:
+			return nil
+		}
+		state[id] = visiting
+		typ := l.Types[id]
+		if typ.Encoding == "inplace" {
+			if typ.Base != "" {
+				if err := visit(typ.Base); err != nil {
+					return err
+				}
+			}
+			for _, member := range typ.Members {
+				if err := visit(member.Type); err != nil {
+					return err
+				}
+			}
+		}
+		state[id] = visited
+		return nil
+	}
+	for id := range l.Types {
+		if err := visit(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slots returns the number of storage slots a value of the type occupies.
+func (t *Type) slots() uint64 {
+	if t.Encoding != "inplace" {
+		return 1
+	}
+	return (uint64(t.NumberOfBytes) + 31) / 32
+}
+
+// length parses the length of a static array from its label, e.g. uint8[4].
+func (t *Type) length() (uint64, bool) {
+	if !strings.HasSuffix(t.Label, "]") {
+		return 0, false
+	}
+	start := strings.LastIndex(t.Label, "[")
+	if start < 0 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(t.Label[start+1:len(t.Label)-1], 10, 64)
+	return n, err == nil
+}
+
+// Registry holds the storage layouts of contracts, keyed by address.
+type Registry struct {
+	lock    sync.RWMutex
+	layouts map[common.Address]*Layout
+}
+
+// NewRegistry creates an empty storage layout registry.
+func NewRegistry() *Registry {
+	return &Registry{layouts: make(map[common.Address]*Layout)}
+}
+
+// Default is the registry consulted by the tracers.
+var Default = NewRegistry()
+
+// Set registers the storage layout of a contract, replacing any previous one.
+// At most maxLayouts contracts may have a layout registered.
+func (r *Registry) Set(addr common.Address, layout *Layout) error {
+	if layout == nil {
+		return errors.New("missing storage layout")
+	}
+	if err := layout.Validate(); err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.layouts[addr]; !ok && len(r.layouts) >= maxLayouts {
+		return fmt.Errorf("too many storage layouts registered: %d", len(r.layouts))
+	}
+	r.layouts[addr] = layout
+	return nil
+}
+
+// Get returns the storage layout of a contract, or nil if none is registered.
+func (r *Registry) Get(addr common.Address) *Layout {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.layouts[addr]
+}
+
+// Remove drops the storage layout of a contract, reporting whether there was one.
+func (r *Registry) Remove(addr common.Address) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.layouts[addr]
+	delete(r.layouts, addr)
+	return ok
+}
+
+// Addresses returns the addresses of all the contracts with a registered layout.
+func (r *Registry) Addresses() []common.Address {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	addrs := make([]common.Address, 0, len(r.layouts))
+	for addr := range r.layouts {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// slotNumber converts a storage key into a number for slot arithmetic.
+func slotNumber(slot common.Hash) *big.Int {
+	return new(big.Int).SetBytes(slot[:])
+}
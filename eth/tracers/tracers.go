@@ -87,6 +87,12 @@ func (d *directory) New(name string, ctx *Context, cfg json.RawMessage) (Tracer,
 	return d.jsEval(name, ctx, cfg)
 }
 
+// Has returns whether a tracer is registered under the given name.
+func (d *directory) Has(name string) bool {
+	_, ok := d.elems[name]
+	return ok
+}
+
 // IsJS will return true if the given tracer will evaluate
 // JS code. Because code evaluation has high overhead, this
 // info will be used in determining fast and slow code paths.
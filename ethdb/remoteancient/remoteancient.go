@@ -0,0 +1,216 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package remoteancient implements a read-only source of ancient chain data
+// fetched over HTTP. Every item is an object of its own, at <url>/<kind>/<number>
+// holding the raw item, the layout served by Handler, which a static file host
+// or an S3 bucket mirroring a freezer can serve just as well.
+package remoteancient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common/lru"
+	"github.com/chainupcloud/arb-geth/metrics"
+)
+
+// maxItemSize bounds the size of a fetched item.
+const maxItemSize = 256 * 1024 * 1024
+
+var (
+	// ErrNotFound is returned if the remote source doesn't hold an item.
+	ErrNotFound = errors.New("ancient item not found remotely")
+
+	fetchTimer     = metrics.NewRegisteredTimer("ethdb/remoteancient/fetch", nil)
+	fetchFailMeter = metrics.NewRegisteredMeter("ethdb/remoteancient/fail", nil)
+	cacheHitMeter  = metrics.NewRegisteredMeter("ethdb/remoteancient/cache/hit", nil)
+	cacheMissMeter = metrics.NewRegisteredMeter("ethdb/remoteancient/cache/miss", nil)
+)
+
+// Config is the configuration of a remote ancient source.
+type Config struct {
+	URL         string        // Base URL of the items, disabled if empty
+	AllowHTTP   bool          // Whether to accept a plain http URL rather than requiring https
+	CacheSize   uint64        // Bytes of fetched items cached in memory
+	ReadTimeout time.Duration // Timeout of the fetches blocking a database read
+	Timeout     time.Duration // Timeout of the background fetches, none if 0
+	Backfill    bool          // Whether to copy the items the local store misses in the background
+}
+
+// DefaultConfig contains the default settings of a remote ancient source.
+var DefaultConfig = Config{
+	CacheSize:   64 * 1024 * 1024,
+	ReadTimeout: 5 * time.Second,
+	Timeout:     30 * time.Second,
+	Backfill:    true,
+}
+
+type itemKey struct {
+	kind   string
+	number uint64
+}
+
+// Client fetches ancient items from a remote source. The items are returned as
+// served, it's up to the caller to verify them, and to cache the verified ones.
+type Client struct {
+	url         string
+	http        *http.Client
+	cache       *lru.SizeConstrainedCache[itemKey, []byte]
+	readTimeout time.Duration
+	timeout     time.Duration
+}
+
+// New creates a client fetching items from the configured URL.
+func New(config *Config) (*Client, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote ancients URL: %w", err)
+	}
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && config.AllowHTTP:
+	case u.Scheme == "http":
+		return nil, errors.New("remote ancients URL must use https unless plain http is explicitly allowed")
+	default:
+		return nil, fmt.Errorf("unsupported remote ancients URL scheme %q", u.Scheme)
+	}
+	return &Client{
+		url:         strings.TrimRight(config.URL, "/"),
+		http:        new(http.Client),
+		cache:       lru.NewSizeConstrainedCache[itemKey, []byte](config.CacheSize),
+		readTimeout: config.ReadTimeout,
+		timeout:     config.Timeout,
+	}, nil
+}
+
+// ReadContext returns a context bounding the fetches blocking a database read.
+func (c *Client) ReadContext() (context.Context, context.CancelFunc) {
+	return contextWithTimeout(context.Background(), c.readTimeout)
+}
+
+// FetchContext returns a context bounding the background fetches.
+func (c *Client) FetchContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return contextWithTimeout(parent, c.timeout)
+}
+
+func contextWithTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// Cached returns the item of the given kind and number if it's cached. The
+// returned item must not be modified.
+func (c *Client) Cached(kind string, number uint64) ([]byte, bool) {
+	item, ok := c.cache.Get(itemKey{kind, number})
+	if ok {
+		cacheHitMeter.Mark(1)
+	} else {
+		cacheMissMeter.Mark(1)
+	}
+	return item, ok
+}
+
+// Cache adds a fetched item to the cache, once the caller verified it. The item
+// must not be modified afterwards.
+func (c *Client) Cache(kind string, number uint64, item []byte) {
+	c.cache.Add(itemKey{kind, number}, item)
+}
+
+// Fetch retrieves the item of the given kind and number from the remote source,
+// bypassing the cache.
+func (c *Client) Fetch(ctx context.Context, kind string, number uint64) ([]byte, error) {
+	start := time.Now()
+	item, err := c.fetch(ctx, kind, number)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		fetchFailMeter.Mark(1)
+		return nil, err
+	}
+	fetchTimer.UpdateSince(start)
+	return item, err
+}
+
+func (c *Client) fetch(ctx context.Context, kind string, number uint64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/"+url.PathEscape(kind)+"/"+strconv.FormatUint(number, 10), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusForbidden: // S3 answers forbidden for missing objects unless listable
+		return nil, fmt.Errorf("%w: %s #%d", ErrNotFound, kind, number)
+	default:
+		return nil, fmt.Errorf("fetching %s #%d: %s", kind, number, resp.Status)
+	}
+	item, err := io.ReadAll(io.LimitReader(resp.Body, maxItemSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(item) > maxItemSize {
+		return nil, fmt.Errorf("%s #%d exceeds %d bytes", kind, number, maxItemSize)
+	}
+	return item, nil
+}
+
+// ItemReader is the source of the items served by Handler.
+type ItemReader interface {
+	Ancient(kind string, number uint64) ([]byte, error)
+}
+
+// Handler serves the items of the ancient store in the layout fetched by the
+// client, so that a node can be the remote source of others.
+func Handler(db ItemReader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		number, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		item, err := db.Ancient(parts[0], number)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(item)))
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Write(item)
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package era
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/chainupcloud/arb-geth/common"
+)
+
+// accumulatorDepth is the depth of the merkle tree over the header records of
+// an era file, fitting MaxSize leaves.
+const accumulatorDepth = 13
+
+// zeroHashes are the roots of empty subtrees of every height.
+var zeroHashes = func() [accumulatorDepth + 1][32]byte {
+	var hashes [accumulatorDepth + 1][32]byte
+	for i := 1; i <= accumulatorDepth; i++ {
+		hashes[i] = sha256.Sum256(append(hashes[i-1][:], hashes[i-1][:]...))
+	}
+	return hashes
+}()
+
+// ComputeAccumulator computes the accumulator root of the given block hashes
+// and total difficulties. It is the SSZ hash tree root of a list of header
+// records of up to MaxSize elements, the same as in era1 files.
+func ComputeAccumulator(hashes []common.Hash, tds []*big.Int) (common.Hash, error) {
+	if len(hashes) != len(tds) {
+		return common.Hash{}, fmt.Errorf("%d hashes for %d total difficulties", len(hashes), len(tds))
+	}
+	if len(hashes) > MaxSize {
+		return common.Hash{}, fmt.Errorf("too many records: %d > %d", len(hashes), MaxSize)
+	}
+	layer := make([][32]byte, len(hashes))
+	for i, hash := range hashes {
+		layer[i] = sha256.Sum256(append(hash.Bytes(), encodeDifficulty(tds[i])...))
+	}
+	for depth := 0; depth < accumulatorDepth; depth++ {
+		next := make([][32]byte, (len(layer)+1)/2)
+		for i := range next {
+			right := zeroHashes[depth]
+			if 2*i+1 < len(layer) {
+				right = layer[2*i+1]
+			}
+			next[i] = sha256.Sum256(append(layer[2*i][:], right[:]...))
+		}
+		if len(next) == 0 {
+			next = [][32]byte{zeroHashes[depth+1]}
+		}
+		layer = next
+	}
+	// Mix in the length of the list
+	var length [32]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(len(hashes)))
+	return sha256.Sum256(append(layer[0][:], length[:]...)), nil
+}
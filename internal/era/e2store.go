@@ -0,0 +1,82 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package era
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// headerSize is the size of the header preceding every entry: a 2 byte type,
+// a 4 byte length and 2 reserved bytes, all little endian.
+const headerSize = 8
+
+// entry is a type-length-value record of an e2store file.
+type entry struct {
+	Type  uint16
+	Value []byte
+}
+
+// entryWriter appends entries to an underlying writer, tracking the offset
+// of the next entry.
+type entryWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+// write appends an entry and returns the number of bytes written.
+func (w *entryWriter) write(typ uint16, value []byte) (int, error) {
+	if uint64(len(value)) > uint64(^uint32(0)) {
+		return 0, fmt.Errorf("entry value too large: %d bytes", len(value))
+	}
+	var header [headerSize]byte
+	binary.LittleEndian.PutUint16(header[:2], typ)
+	binary.LittleEndian.PutUint32(header[2:6], uint32(len(value)))
+	if n, err := w.w.Write(header[:]); err != nil {
+		w.offset += int64(n)
+		return n, err
+	}
+	n, err := w.w.Write(value)
+	w.offset += int64(headerSize + n)
+	return headerSize + n, err
+}
+
+// readEntryAt reads the entry at the given offset, returning it along with its
+// total length including the header.
+func readEntryAt(r io.ReaderAt, off int64) (*entry, int64, error) {
+	var header [headerSize]byte
+	if _, err := r.ReadAt(header[:], off); err != nil {
+		return nil, 0, err
+	}
+	if reserved := binary.LittleEndian.Uint16(header[6:]); reserved != 0 {
+		return nil, 0, fmt.Errorf("reserved bytes of entry at %d are non-zero: %#x", off, reserved)
+	}
+	var (
+		typ    = binary.LittleEndian.Uint16(header[:2])
+		length = binary.LittleEndian.Uint32(header[2:6])
+		value  = make([]byte, length)
+	)
+	if _, err := r.ReadAt(value, off+headerSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	return &entry{Type: typ, Value: value}, headerSize + int64(length), nil
+}
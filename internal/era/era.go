@@ -0,0 +1,370 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package era implements an era1-like archival format for chain history.
+//
+// An era file holds up to MaxSize consecutive blocks along with their receipts
+// and total difficulties, stored as snappy compressed e2store entries, followed
+// by an accumulator committing to the block hashes and total difficulties and
+// an index of the block offsets. Bodies and receipts can be verified against
+// the headers, and the headers against the accumulator, so a file whose
+// accumulator is known can be trusted without executing its blocks.
+package era
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/rlp"
+	"github.com/chainupcloud/arb-geth/trie"
+	"github.com/golang/snappy"
+)
+
+// Entry types of an era file.
+const (
+	typeVersion            uint16 = 0x3265
+	typeCompressedHeader   uint16 = 0x03
+	typeCompressedBody     uint16 = 0x04
+	typeCompressedReceipts uint16 = 0x05
+	typeTotalDifficulty    uint16 = 0x06
+	typeAccumulator        uint16 = 0x07
+	typeBlockIndex         uint16 = 0x3266
+)
+
+// MaxSize is the maximum number of blocks in an era file.
+const MaxSize = 8192
+
+var errEmpty = errors.New("era file contains no blocks")
+
+// Builder writes blocks into an era file.
+type Builder struct {
+	w       *entryWriter
+	started bool
+	start   uint64
+	offsets []int64
+	hashes  []common.Hash
+	tds     []*big.Int
+}
+
+// NewBuilder creates a builder writing an era file into w.
+func NewBuilder(w io.Writer) *Builder {
+	return &Builder{w: &entryWriter{w: w}}
+}
+
+// Add appends a block, its receipts and its total difficulty to the file.
+// Blocks must be added in ascending order without gaps.
+func (b *Builder) Add(block *types.Block, receipts types.Receipts, td *big.Int) error {
+	if len(b.offsets) >= MaxSize {
+		return fmt.Errorf("era file full: %d blocks", MaxSize)
+	}
+	if !b.started {
+		if _, err := b.w.write(typeVersion, nil); err != nil {
+			return err
+		}
+		b.started, b.start = true, block.NumberU64()
+	} else if want := b.start + uint64(len(b.offsets)); block.NumberU64() != want {
+		return fmt.Errorf("non contiguous block: have #%d, want #%d", block.NumberU64(), want)
+	}
+	header, err := rlp.EncodeToBytes(block.Header())
+	if err != nil {
+		return err
+	}
+	body, err := rlp.EncodeToBytes(block.Body())
+	if err != nil {
+		return err
+	}
+	stored := make([]*types.ReceiptForStorage, len(receipts))
+	for i, receipt := range receipts {
+		stored[i] = (*types.ReceiptForStorage)(receipt)
+	}
+	receiptsBlob, err := rlp.EncodeToBytes(stored)
+	if err != nil {
+		return err
+	}
+	b.offsets = append(b.offsets, b.w.offset)
+	b.hashes = append(b.hashes, block.Hash())
+	b.tds = append(b.tds, new(big.Int).Set(td))
+
+	for _, e := range []entry{
+		{typeCompressedHeader, snappy.Encode(nil, header)},
+		{typeCompressedBody, snappy.Encode(nil, body)},
+		{typeCompressedReceipts, snappy.Encode(nil, receiptsBlob)},
+		{typeTotalDifficulty, encodeDifficulty(td)},
+	} {
+		if _, err := b.w.write(e.Type, e.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finalize writes the accumulator and the block index, returning the root of
+// the accumulator. The builder must not be used afterwards.
+func (b *Builder) Finalize() (common.Hash, error) {
+	if !b.started {
+		return common.Hash{}, errEmpty
+	}
+	root, err := ComputeAccumulator(b.hashes, b.tds)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if _, err := b.w.write(typeAccumulator, root.Bytes()); err != nil {
+		return common.Hash{}, err
+	}
+	// The index holds the starting number, the offsets of the blocks relative
+	// to the index entry and the block count.
+	var (
+		count = len(b.offsets)
+		index = make([]byte, 16+8*count)
+		base  = b.w.offset
+	)
+	binary.LittleEndian.PutUint64(index, b.start)
+	for i, offset := range b.offsets {
+		binary.LittleEndian.PutUint64(index[8+8*i:], uint64(offset-base))
+	}
+	binary.LittleEndian.PutUint64(index[8+8*count:], uint64(count))
+	if _, err := b.w.write(typeBlockIndex, index); err != nil {
+		return common.Hash{}, err
+	}
+	return root, nil
+}
+
+// Era is a reader of an era file.
+type Era struct {
+	r       io.ReaderAt
+	closer  io.Closer
+	start   uint64
+	offsets []int64 // Absolute offsets of the blocks
+	index   int64   // Offset of the block index
+}
+
+// Open opens the era file at the given path.
+func Open(path string) (*Era, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	e, err := From(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	e.closer = f
+	return e, nil
+}
+
+// From reads an era file of the given size from r.
+func From(r io.ReaderAt, size int64) (*Era, error) {
+	if size < headerSize+16 {
+		return nil, errEmpty
+	}
+	var buf [8]byte
+	if _, err := r.ReadAt(buf[:], size-8); err != nil {
+		return nil, err
+	}
+	count := binary.LittleEndian.Uint64(buf[:])
+	if count == 0 || count > MaxSize {
+		return nil, fmt.Errorf("invalid block count %d", count)
+	}
+	index := size - headerSize - 16 - 8*int64(count)
+	if index < 0 {
+		return nil, fmt.Errorf("truncated block index")
+	}
+	e, _, err := readEntryAt(r, index)
+	if err != nil {
+		return nil, err
+	}
+	if e.Type != typeBlockIndex {
+		return nil, fmt.Errorf("invalid block index type %#x", e.Type)
+	}
+	era := &Era{
+		r:       r,
+		start:   binary.LittleEndian.Uint64(e.Value),
+		offsets: make([]int64, count),
+		index:   index,
+	}
+	for i := range era.offsets {
+		offset := index + int64(binary.LittleEndian.Uint64(e.Value[8+8*i:]))
+		if offset < 0 || offset >= index {
+			return nil, fmt.Errorf("invalid offset of block #%d", era.start+uint64(i))
+		}
+		era.offsets[i] = offset
+	}
+	return era, nil
+}
+
+// Close closes the underlying file, if the era was opened from one.
+func (e *Era) Close() error {
+	if e.closer != nil {
+		return e.closer.Close()
+	}
+	return nil
+}
+
+// Start returns the number of the first block in the file.
+func (e *Era) Start() uint64 {
+	return e.start
+}
+
+// Count returns the number of blocks in the file.
+func (e *Era) Count() uint64 {
+	return uint64(len(e.offsets))
+}
+
+// Accumulator returns the accumulator root stored in the file.
+func (e *Era) Accumulator() (common.Hash, error) {
+	entry, _, err := readEntryAt(e.r, e.index-headerSize-common.HashLength)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if entry.Type != typeAccumulator || len(entry.Value) != common.HashLength {
+		return common.Hash{}, errors.New("missing accumulator")
+	}
+	return common.BytesToHash(entry.Value), nil
+}
+
+// GetBlockByNumber returns the block of the given number along with its
+// receipts and total difficulty. The type and bloom of the receipts are
+// filled in, other derived fields are not.
+func (e *Era) GetBlockByNumber(number uint64) (*types.Block, types.Receipts, *big.Int, error) {
+	if number < e.start || number >= e.start+e.Count() {
+		return nil, nil, nil, fmt.Errorf("block #%d out of range [%d, %d)", number, e.start, e.start+e.Count())
+	}
+	var (
+		off    = e.offsets[number-e.start]
+		values [4][]byte
+	)
+	for i, typ := range []uint16{typeCompressedHeader, typeCompressedBody, typeCompressedReceipts, typeTotalDifficulty} {
+		entry, length, err := readEntryAt(e.r, off)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if entry.Type != typ {
+			return nil, nil, nil, fmt.Errorf("block #%d: unexpected entry type %#x, want %#x", number, entry.Type, typ)
+		}
+		values[i], off = entry.Value, off+length
+	}
+	var (
+		header   types.Header
+		body     types.Body
+		stored   []*types.ReceiptForStorage
+		blobs    [3][]byte
+		decodeTo = []interface{}{&header, &body, &stored}
+	)
+	for i := range blobs {
+		blob, err := snappy.Decode(nil, values[i])
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("block #%d: %w", number, err)
+		}
+		if err := rlp.DecodeBytes(blob, decodeTo[i]); err != nil {
+			return nil, nil, nil, fmt.Errorf("block #%d: %w", number, err)
+		}
+	}
+	if header.Number == nil || header.Number.Uint64() != number {
+		return nil, nil, nil, fmt.Errorf("block #%d: header number mismatch", number)
+	}
+	block := types.NewBlockWithHeader(&header).WithBody(body.Transactions, body.Uncles)
+	if body.Withdrawals != nil {
+		block = block.WithWithdrawals(body.Withdrawals)
+	}
+	if len(stored) != len(body.Transactions) {
+		return nil, nil, nil, fmt.Errorf("block #%d: %d receipts for %d transactions", number, len(stored), len(body.Transactions))
+	}
+	receipts := make(types.Receipts, len(stored))
+	for i, receipt := range stored {
+		receipts[i] = (*types.Receipt)(receipt)
+		if receipts[i].Type != types.ArbitrumLegacyTxType {
+			receipts[i].Type = body.Transactions[i].Type()
+		}
+	}
+	if len(values[3]) != 32 {
+		return nil, nil, nil, fmt.Errorf("block #%d: invalid total difficulty", number)
+	}
+	return block, receipts, decodeDifficulty(values[3]), nil
+}
+
+// Verify checks that the bodies and receipts in the file match their headers,
+// that the headers are chained and that the stored accumulator matches them,
+// returning the accumulator root.
+func (e *Era) Verify() (common.Hash, error) {
+	var (
+		hashes = make([]common.Hash, 0, e.Count())
+		tds    = make([]*big.Int, 0, e.Count())
+		parent common.Hash
+	)
+	for number := e.start; number < e.start+e.Count(); number++ {
+		block, receipts, td, err := e.GetBlockByNumber(number)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		if number > e.start && block.ParentHash() != parent {
+			return common.Hash{}, fmt.Errorf("block #%d: parent hash mismatch", number)
+		}
+		if hash := types.DeriveSha(block.Transactions(), trie.NewStackTrie(nil)); hash != block.TxHash() {
+			return common.Hash{}, fmt.Errorf("block #%d: transaction root mismatch: have %x, want %x", number, hash, block.TxHash())
+		}
+		if hash := types.CalcUncleHash(block.Uncles()); hash != block.UncleHash() {
+			return common.Hash{}, fmt.Errorf("block #%d: uncle root mismatch: have %x, want %x", number, hash, block.UncleHash())
+		}
+		if hash := types.DeriveSha(receipts, trie.NewStackTrie(nil)); hash != block.ReceiptHash() {
+			return common.Hash{}, fmt.Errorf("block #%d: receipt root mismatch: have %x, want %x", number, hash, block.ReceiptHash())
+		}
+		parent = block.Hash()
+		hashes, tds = append(hashes, parent), append(tds, td)
+	}
+	root, err := ComputeAccumulator(hashes, tds)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	stored, err := e.Accumulator()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if root != stored {
+		return common.Hash{}, fmt.Errorf("accumulator mismatch: have %x, want %x", root, stored)
+	}
+	return root, nil
+}
+
+// encodeDifficulty encodes a total difficulty as a little endian uint256.
+func encodeDifficulty(td *big.Int) []byte {
+	var buf [32]byte
+	td.FillBytes(buf[:])
+	for i := 0; i < 16; i++ {
+		buf[i], buf[31-i] = buf[31-i], buf[i]
+	}
+	return buf[:]
+}
+
+// decodeDifficulty decodes a little endian uint256 total difficulty.
+func decodeDifficulty(buf []byte) *big.Int {
+	be := make([]byte, len(buf))
+	for i := range buf {
+		be[len(buf)-1-i] = buf[i]
+	}
+	return new(big.Int).SetBytes(be)
+}
@@ -0,0 +1,202 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package era
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/consensus/ethash"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+var (
+	testKey, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	testAddress = crypto.PubkeyToAddress(testKey.PublicKey)
+)
+
+func newTestChain(t *testing.T, gspec *core.Genesis) *core.BlockChain {
+	chain, err := core.NewBlockChain(rawdb.NewMemoryDatabase(), nil, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	t.Cleanup(chain.Stop)
+	return chain
+}
+
+// exportTestChain generates a chain with transactions and exports it into era
+// files of the given step, returning the source chain and the export dir.
+func exportTestChain(t *testing.T, blocks int, step uint64) (*core.Genesis, *core.BlockChain, string) {
+	gspec := &core.Genesis{
+		Config: params.TestChainConfig,
+		Alloc:  core.GenesisAlloc{testAddress: {Balance: big.NewInt(params.Ether)}},
+	}
+	signer := types.LatestSigner(gspec.Config)
+	_, chain, _ := core.GenerateChainWithGenesis(gspec, ethash.NewFaker(), blocks, func(i int, gen *core.BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(gen.TxNonce(testAddress), common.Address{0xaa}, big.NewInt(1), params.TxGas, gen.BaseFee(), nil), signer, testKey)
+		gen.AddTx(tx)
+	})
+	source := newTestChain(t, gspec)
+	if _, err := source.InsertChain(chain); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	dir := t.TempDir()
+	if err := Export(source, dir, "test", 0, uint64(blocks), step); err != nil {
+		t.Fatalf("failed to export chain: %v", err)
+	}
+	return gspec, source, dir
+}
+
+// Tests that exported era files hold the blocks, receipts and total
+// difficulties of the chain, with the accumulators listed as checksums.
+func TestExport(t *testing.T) {
+	_, source, dir := exportTestChain(t, 40, 16)
+
+	checksums, err := ReadChecksums(filepath.Join(dir, ChecksumsFile))
+	if err != nil {
+		t.Fatalf("failed to read checksums: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "test-*.era1"))
+	if len(files) != 3 || len(checksums) != 3 {
+		t.Fatalf("have %d files and %d checksums, want 3", len(files), len(checksums))
+	}
+	for i, file := range files {
+		e, err := Open(file)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", file, err)
+		}
+		defer e.Close()
+
+		if want := filepath.Join(dir, Filename("test", i, checksums[i])); file != want {
+			t.Errorf("file %d: name mismatch: have %s, want %s", i, file, want)
+		}
+		root, err := e.Verify()
+		if err != nil {
+			t.Fatalf("file %d: verification failed: %v", i, err)
+		}
+		if root != checksums[i] {
+			t.Errorf("file %d: accumulator mismatch: have %x, want %x", i, root, checksums[i])
+		}
+		for number := e.Start(); number < e.Start()+e.Count(); number++ {
+			block, receipts, td, err := e.GetBlockByNumber(number)
+			if err != nil {
+				t.Fatalf("block #%d: %v", number, err)
+			}
+			if want := source.GetBlockByNumber(number); block.Hash() != want.Hash() {
+				t.Errorf("block #%d: hash mismatch: have %x, want %x", number, block.Hash(), want.Hash())
+			}
+			if want := source.GetReceiptsByHash(block.Hash()); len(receipts) != len(want) {
+				t.Errorf("block #%d: have %d receipts, want %d", number, len(receipts), len(want))
+			}
+			if want := source.GetTd(block.Hash(), number); td.Cmp(want) != 0 {
+				t.Errorf("block #%d: total difficulty mismatch: have %v, want %v", number, td, want)
+			}
+		}
+	}
+	if _, _, _, err := mustOpen(t, files[2]).GetBlockByNumber(41); err == nil {
+		t.Errorf("read block beyond the end of the file")
+	}
+}
+
+func mustOpen(t *testing.T, file string) *Era {
+	e, err := Open(file)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", file, err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+// Tests that era files with trusted accumulators are imported as history
+// without execution, while untrusted ones are fully verified.
+func TestImport(t *testing.T) {
+	gspec, source, dir := exportTestChain(t, 40, 16)
+	head := source.CurrentBlock()
+
+	checksums, err := ReadChecksums(filepath.Join(dir, ChecksumsFile))
+	if err != nil {
+		t.Fatalf("failed to read checksums: %v", err)
+	}
+	fast := newTestChain(t, gspec)
+	if err := Import(fast, dir, "test", checksums); err != nil {
+		t.Fatalf("failed to import trusted history: %v", err)
+	}
+	if have := fast.CurrentSnapBlock(); have.Hash() != head.Hash() {
+		t.Errorf("snap head mismatch: have #%d, want #%d", have.Number, head.Number)
+	}
+	if have := fast.CurrentBlock(); have.Number.Uint64() != 0 {
+		t.Errorf("trusted history executed up to #%d", have.Number)
+	}
+	if receipts := fast.GetReceiptsByHash(head.Hash()); len(receipts) != 1 {
+		t.Errorf("have %d receipts of head, want 1", len(receipts))
+	}
+	full := newTestChain(t, gspec)
+	if err := Import(full, dir, "test", nil); err != nil {
+		t.Fatalf("failed to import untrusted history: %v", err)
+	}
+	if have := full.CurrentBlock(); have.Hash() != head.Hash() {
+		t.Errorf("head mismatch: have #%d, want #%d", have.Number, head.Number)
+	}
+	// Importing again must skip the blocks already present
+	if err := Import(full, dir, "test", nil); err != nil {
+		t.Fatalf("failed to re-import history: %v", err)
+	}
+}
+
+// Tests that corrupted era files are rejected even if trusted.
+func TestImportCorrupted(t *testing.T) {
+	gspec, _, dir := exportTestChain(t, 10, 16)
+
+	checksums, err := ReadChecksums(filepath.Join(dir, ChecksumsFile))
+	if err != nil {
+		t.Fatalf("failed to read checksums: %v", err)
+	}
+	file := filepath.Join(dir, Filename("test", 0, checksums[0]))
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read era file: %v", err)
+	}
+	// Swap the total difficulties of two blocks, keeping the file decodable
+	e := mustOpen(t, file)
+	first, second := e.offsets[1], e.offsets[2]
+	tdOffset := func(off int64) int64 {
+		for i := 0; i < 3; i++ {
+			_, length, err := readEntryAt(e.r, off)
+			if err != nil {
+				t.Fatalf("failed to read entry: %v", err)
+			}
+			off += length
+		}
+		return off + headerSize
+	}
+	a, b := tdOffset(first), tdOffset(second)
+	data[a], data[b] = data[b]+1, data[a]
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatalf("failed to write era file: %v", err)
+	}
+	if err := Import(newTestChain(t, gspec), dir, "test", checksums); err == nil {
+		t.Fatalf("imported corrupted era file")
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package era
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/log"
+)
+
+// ChecksumsFile is the file listing the accumulator roots of the era files
+// written by Export, one per line in the order of the files.
+const ChecksumsFile = "checksums.txt"
+
+// importBatchSize is the number of blocks inserted into the chain at once.
+const importBatchSize = 1024
+
+// Filename returns the name of the era file of the given network and epoch.
+func Filename(network string, epoch int, root common.Hash) string {
+	return fmt.Sprintf("%s-%05d-%s.era1", network, epoch, root.Hex()[2:10])
+}
+
+// Export writes the blocks from first to last of the chain into era files of
+// step blocks each in dir, along with the checksums file listing their
+// accumulator roots.
+func Export(chain *core.BlockChain, dir, network string, first, last, step uint64) error {
+	if step == 0 || step > MaxSize {
+		return fmt.Errorf("invalid step %d, must be in (0, %d]", step, MaxSize)
+	}
+	if head := chain.CurrentSnapBlock().Number.Uint64(); last > head {
+		return fmt.Errorf("last block %d beyond head %d", last, head)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var checksums []string
+	for start := first; start <= last; start += step {
+		end := start + step - 1
+		if end > last {
+			end = last
+		}
+		root, err := exportEpoch(chain, dir, network, start, end, step)
+		if err != nil {
+			return err
+		}
+		checksums = append(checksums, root.Hex())
+	}
+	return os.WriteFile(filepath.Join(dir, ChecksumsFile), []byte(strings.Join(checksums, "\n")+"\n"), 0644)
+}
+
+// exportEpoch writes the blocks from start to end into a single era file.
+func exportEpoch(chain *core.BlockChain, dir, network string, start, end, step uint64) (common.Hash, error) {
+	f, err := os.CreateTemp(dir, network+"-*.era1.tmp")
+	if err != nil {
+		return common.Hash{}, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	builder := NewBuilder(w)
+	for number := start; number <= end; number++ {
+		block := chain.GetBlockByNumber(number)
+		if block == nil {
+			return common.Hash{}, fmt.Errorf("block #%d not found", number)
+		}
+		receipts := chain.GetReceiptsByHash(block.Hash())
+		if receipts == nil && len(block.Transactions()) > 0 {
+			return common.Hash{}, fmt.Errorf("receipts of block #%d not found", number)
+		}
+		td := chain.GetTd(block.Hash(), number)
+		if td == nil {
+			return common.Hash{}, fmt.Errorf("total difficulty of block #%d not found", number)
+		}
+		if err := builder.Add(block, receipts, td); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	root, err := builder.Finalize()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if err := w.Flush(); err != nil {
+		return common.Hash{}, err
+	}
+	if err := f.Close(); err != nil {
+		return common.Hash{}, err
+	}
+	name := filepath.Join(dir, Filename(network, int(start/step), root))
+	if err := os.Rename(f.Name(), name); err != nil {
+		return common.Hash{}, err
+	}
+	log.Info("Exported era file", "file", name, "first", start, "last", end, "accumulator", root)
+	return root, nil
+}
+
+// ReadChecksums reads the accumulator roots listed in a checksums file.
+func ReadChecksums(path string) ([]common.Hash, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var roots []common.Hash
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(line) != 2+2*common.HashLength || !strings.HasPrefix(line, "0x") {
+			return nil, fmt.Errorf("%s:%d: invalid checksum %q", path, i+1, line)
+		}
+		roots = append(roots, common.HexToHash(line))
+	}
+	return roots, nil
+}
+
+// Import inserts the blocks of the era files of the given network in dir into
+// the chain, skipping the ones already present. Files are always checked to be
+// internally consistent; those whose accumulator is among the trusted roots are
+// then imported as history without executing their blocks, while the others
+// are inserted with full verification.
+func Import(chain *core.BlockChain, dir, network string, trusted []common.Hash) error {
+	files, err := filepath.Glob(filepath.Join(dir, network+"-*.era1"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no era files of network %q in %s", network, dir)
+	}
+	sort.Strings(files)
+
+	trust := make(map[common.Hash]bool, len(trusted))
+	for _, root := range trusted {
+		trust[root] = true
+	}
+	for _, file := range files {
+		if err := importFile(chain, file, trust); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// importFile inserts the blocks of a single era file into the chain.
+func importFile(chain *core.BlockChain, file string, trust map[common.Hash]bool) error {
+	e, err := Open(file)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+
+	root, err := e.Verify()
+	if err != nil {
+		return err
+	}
+	fast := trust[root]
+	log.Info("Importing era file", "file", file, "first", e.Start(), "count", e.Count(), "accumulator", root, "trusted", fast)
+
+	var (
+		blocks   = make(types.Blocks, 0, importBatchSize)
+		receipts = make([]types.Receipts, 0, importBatchSize)
+	)
+	flush := func() error {
+		if len(blocks) == 0 {
+			return nil
+		}
+		defer func() { blocks, receipts = blocks[:0], receipts[:0] }()
+		if !fast {
+			if n, err := chain.InsertChain(blocks); err != nil {
+				return fmt.Errorf("invalid block #%d: %w", blocks[n].NumberU64(), err)
+			}
+			return nil
+		}
+		headers := make([]*types.Header, len(blocks))
+		for i, block := range blocks {
+			headers[i] = block.Header()
+		}
+		if n, err := chain.InsertHeaderChain(headers); err != nil {
+			return fmt.Errorf("invalid header #%d: %w", headers[n].Number, err)
+		}
+		_, err := chain.InsertReceiptChain(blocks, receipts, 0)
+		return err
+	}
+	for number := e.Start(); number < e.Start()+e.Count(); number++ {
+		block, blockReceipts, _, err := e.GetBlockByNumber(number)
+		if err != nil {
+			return err
+		}
+		if number == 0 {
+			if block.Hash() != chain.Genesis().Hash() {
+				return fmt.Errorf("genesis mismatch: have %x, want %x", block.Hash(), chain.Genesis().Hash())
+			}
+			continue
+		}
+		if chain.HasBlock(block.Hash(), number) {
+			continue
+		}
+		blocks, receipts = append(blocks, block), append(receipts, blockReceipts)
+		if len(blocks) == importBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
@@ -655,6 +655,9 @@ func (s *BlockChainAPI) GetProof(ctx context.Context, address common.Address, st
 	if state == nil || err != nil {
 		return nil, err
 	}
+	// Arbitrum: a state recreated by replaying blocks has its changes only
+	// finalised, hash them into the account trie before proving against it
+	state.IntermediateRoot(true)
 	storageTrie, err := state.StorageTrie(address)
 	if err != nil {
 		return nil, err
@@ -930,6 +933,9 @@ type BlockOverrides struct {
 	Coinbase   *common.Address
 	Random     *common.Hash
 	BaseFee    *hexutil.Big
+
+	// Arbitrum: run the call under the rules of another ArbOS version
+	ArbOSVersion *hexutil.Uint64
 }
 
 // Apply overrides the given header fields into the given block context.
@@ -962,6 +968,21 @@ func (diff *BlockOverrides) Apply(blockCtx *vm.BlockContext) {
 	if diff.BaseFee != nil {
 		blockCtx.BaseFee = diff.BaseFee.ToInt()
 	}
+	if diff.ArbOSVersion != nil {
+		blockCtx.ArbOSVersion = uint64(*diff.ArbOSVersion)
+	}
+}
+
+// ApplyState overrides the ArbOS version stored in the state, if requested,
+// so that ArbOS follows the rules of that version too.
+func (diff *BlockOverrides) ApplyState(state *state.StateDB) error {
+	if diff == nil || diff.ArbOSVersion == nil {
+		return nil
+	}
+	if core.OverrideArbOSVersion == nil {
+		return errors.New("overriding the ArbOS version is not supported")
+	}
+	return core.OverrideArbOSVersion(state, uint64(*diff.ArbOSVersion))
 }
 
 // ChainContextBackend provides methods required to implement ChainContext.
@@ -1027,6 +1048,9 @@ func DoCall(ctx context.Context, b Backend, args TransactionArgs, blockNrOrHash
 	blockCtx := core.NewEVMBlockContext(header, NewChainContext(ctx, b), nil)
 	if blockOverrides != nil {
 		blockOverrides.Apply(&blockCtx)
+		if err := blockOverrides.ApplyState(state); err != nil {
+			return nil, err
+		}
 	}
 
 	// Arbitrum: support NodeInterface.sol by swapping out the message if needed
@@ -1137,7 +1161,7 @@ func (e *revertError) ErrorData() interface{} {
 // Note, this function doesn't make and changes in the state/blockchain and is
 // useful to execute and retrieve values.
 func (s *BlockChainAPI) Call(ctx context.Context, args TransactionArgs, blockNrOrHash rpc.BlockNumberOrHash, overrides *StateOverride, blockOverrides *BlockOverrides) (hexutil.Bytes, error) {
-	result, err := DoCall(ctx, s.b, args, blockNrOrHash, overrides, blockOverrides, s.b.RPCEVMTimeout(), s.b.RPCGasCap(), core.MessageEthcallMode)
+	result, err := s.doCachedCall(ctx, args, blockNrOrHash, overrides, blockOverrides)
 	if err != nil {
 		if client := fallbackClientFor(s.b, err); client != nil {
 			var res hexutil.Bytes
@@ -1153,12 +1177,43 @@ func (s *BlockChainAPI) Call(ctx context.Context, args TransactionArgs, blockNrO
 	return result.Return(), result.Err
 }
 
+// doCachedCall runs DoCall, serving the result from the backend's call cache if
+// it has one. The call is pinned to the block it resolves to so that it matches
+// the block it's cached for.
+func (s *BlockChainAPI) doCachedCall(ctx context.Context, args TransactionArgs, blockNrOrHash rpc.BlockNumberOrHash, overrides *StateOverride, blockOverrides *BlockOverrides) (*core.ExecutionResult, error) {
+	cache, blockHash := callCacheFor(ctx, s.b, blockNrOrHash)
+	if cache == nil {
+		return DoCall(ctx, s.b, args, blockNrOrHash, overrides, blockOverrides, s.b.RPCEVMTimeout(), s.b.RPCGasCap(), core.MessageEthcallMode)
+	}
+	key, ok := callCacheKey("eth_call", blockHash, args, overrides, blockOverrides)
+	if ok {
+		if entry, ok := cache.get(key); ok {
+			return entry.result, nil
+		}
+	}
+	result, err := DoCall(ctx, s.b, args, rpc.BlockNumberOrHashWithHash(blockHash, false), overrides, blockOverrides, s.b.RPCEVMTimeout(), s.b.RPCGasCap(), core.MessageEthcallMode)
+	if ok && err == nil {
+		cache.add(key, &callCacheEntry{result: result})
+	}
+	return result, err
+}
+
 func DoEstimateGas(ctx context.Context, b Backend, args TransactionArgs, blockNrOrHash rpc.BlockNumberOrHash, gasCap uint64) (hexutil.Uint64, error) {
-	// Binary search the gas requirement, as it may be higher than the amount used
+	res, err := DoEstimateGasWithOptions(ctx, b, args, blockNrOrHash, gasCap, nil)
+	if err != nil {
+		return 0, err
+	}
+	return hexutil.Uint64(res.Gas), nil
+}
+
+// DoEstimateGasWithOptions estimates the gas of the call with the strategy of the
+// options, a binary search if nil, and returns the execution result at the
+// estimate along with it if requested.
+func DoEstimateGasWithOptions(ctx context.Context, b Backend, args TransactionArgs, blockNrOrHash rpc.BlockNumberOrHash, gasCap uint64, opts *EstimateGasOptions) (*EstimateGasResult, error) {
+	// Search the gas requirement, as it may be higher than the amount used
 	var (
-		lo  uint64 = params.TxGas - 1
-		hi  uint64
-		cap uint64
+		lo uint64 = params.TxGas - 1
+		hi uint64
 	)
 	// Use zero address if sender unspecified.
 	if args.From == nil {
@@ -1171,17 +1226,17 @@ func DoEstimateGas(ctx context.Context, b Backend, args TransactionArgs, blockNr
 		// Retrieve the block to act as the gas ceiling
 		block, err := b.BlockByNumberOrHash(ctx, blockNrOrHash)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 		if block == nil {
-			return 0, errors.New("block not found")
+			return nil, errors.New("block not found")
 		}
 		hi = block.GasLimit()
 	}
 	// Normalize the max fee per gas the call is willing to spend.
 	var feeCap *big.Int
 	if args.GasPrice != nil && (args.MaxFeePerGas != nil || args.MaxPriorityFeePerGas != nil) {
-		return 0, errors.New("both gasPrice and (maxFeePerGas or maxPriorityFeePerGas) specified")
+		return nil, errors.New("both gasPrice and (maxFeePerGas or maxPriorityFeePerGas) specified")
 	} else if args.GasPrice != nil {
 		feeCap = args.GasPrice.ToInt()
 	} else if args.MaxFeePerGas != nil {
@@ -1193,13 +1248,13 @@ func DoEstimateGas(ctx context.Context, b Backend, args TransactionArgs, blockNr
 	if feeCap.BitLen() != 0 {
 		state, _, err := b.StateAndHeaderByNumberOrHash(ctx, blockNrOrHash)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 		balance := state.GetBalance(*args.From) // from can't be nil
 		available := new(big.Int).Set(balance)
 		if args.Value != nil {
 			if args.Value.ToInt().Cmp(available) >= 0 {
-				return 0, core.ErrInsufficientFundsForTransfer
+				return nil, core.ErrInsufficientFundsForTransfer
 			}
 			available.Sub(available, args.Value.ToInt())
 		}
@@ -1222,11 +1277,11 @@ func DoEstimateGas(ctx context.Context, b Backend, args TransactionArgs, blockNr
 	{
 		state, header, err := b.StateAndHeaderByNumberOrHash(ctx, blockNrOrHash)
 		if state == nil || err != nil {
-			return 0, err
+			return nil, err
 		}
 		gasCap, err = args.L2OnlyGasCap(gasCap, header, state, core.MessageGasEstimationMode)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 	}
 
@@ -1235,7 +1290,6 @@ func DoEstimateGas(ctx context.Context, b Backend, args TransactionArgs, blockNr
 		log.Warn("Caller gas above allowance, capping", "requested", hi, "cap", gasCap)
 		hi = gasCap
 	}
-	cap = hi
 
 	// Create a helper to check if a gas allowance results in an executable transaction
 	executable := func(gas uint64) (bool, *core.ExecutionResult, error) {
@@ -1250,41 +1304,7 @@ func DoEstimateGas(ctx context.Context, b Backend, args TransactionArgs, blockNr
 		}
 		return result.Failed(), result, nil
 	}
-	// Execute the binary search and hone in on an executable gas limit
-	for lo+1 < hi {
-		mid := (hi + lo) / 2
-		failed, _, err := executable(mid)
-
-		// If the error is not nil(consensus error), it means the provided message
-		// call or transaction will never be accepted no matter how much gas it is
-		// assigned. Return the error directly, don't struggle any more.
-		if err != nil {
-			return 0, err
-		}
-		if failed {
-			lo = mid
-		} else {
-			hi = mid
-		}
-	}
-	// Reject the transaction as invalid if it still fails at the highest allowance
-	if hi == cap {
-		failed, result, err := executable(hi)
-		if err != nil {
-			return 0, err
-		}
-		if failed {
-			if result != nil && result.Err != vm.ErrOutOfGas {
-				if len(result.Revert()) > 0 {
-					return 0, newRevertError(result)
-				}
-				return 0, result.Err
-			}
-			// Otherwise, the specified gas cap is too low
-			return 0, fmt.Errorf("gas required exceeds allowance (%d)", cap)
-		}
-	}
-	return hexutil.Uint64(hi), nil
+	return searchGas(lo, hi, opts, executable)
 }
 
 // EstimateGas returns an estimate of the amount of gas needed to execute the
@@ -1294,7 +1314,7 @@ func (s *BlockChainAPI) EstimateGas(ctx context.Context, args TransactionArgs, b
 	if blockNrOrHash != nil {
 		bNrOrHash = *blockNrOrHash
 	}
-	res, err := DoEstimateGas(ctx, s.b, args, bNrOrHash, s.b.RPCGasCap())
+	res, err := s.doCachedEstimateGas(ctx, args, bNrOrHash)
 	if client := fallbackClientFor(s.b, err); client != nil {
 		var res hexutil.Uint64
 		err := client.CallContext(ctx, &res, "eth_estimateGas", args, blockNrOrHash)
@@ -1303,6 +1323,26 @@ func (s *BlockChainAPI) EstimateGas(ctx context.Context, args TransactionArgs, b
 	return res, err
 }
 
+// doCachedEstimateGas runs DoEstimateGas, serving the estimate from the backend's
+// call cache if it has one.
+func (s *BlockChainAPI) doCachedEstimateGas(ctx context.Context, args TransactionArgs, blockNrOrHash rpc.BlockNumberOrHash) (hexutil.Uint64, error) {
+	cache, blockHash := callCacheFor(ctx, s.b, blockNrOrHash)
+	if cache == nil {
+		return DoEstimateGas(ctx, s.b, args, blockNrOrHash, s.b.RPCGasCap())
+	}
+	key, ok := callCacheKey("eth_estimateGas", blockHash, args)
+	if ok {
+		if entry, ok := cache.get(key); ok {
+			return hexutil.Uint64(entry.gas), nil
+		}
+	}
+	gas, err := DoEstimateGas(ctx, s.b, args, rpc.BlockNumberOrHashWithHash(blockHash, false), s.b.RPCGasCap())
+	if ok && err == nil {
+		cache.add(key, &callCacheEntry{gas: uint64(gas)})
+	}
+	return gas, err
+}
+
 // RPCMarshalHeader converts the given header to the RPC output .
 func RPCMarshalHeader(head *types.Header) map[string]interface{} {
 	result := map[string]interface{}{
@@ -1823,7 +1863,7 @@ func (s *TransactionAPI) GetRawTransactionByHash(ctx context.Context, hash commo
 
 // GetTransactionReceipt returns the transaction receipt for the given transaction hash.
 func (s *TransactionAPI) GetTransactionReceipt(ctx context.Context, hash common.Hash) (map[string]interface{}, error) {
-	tx, blockHash, blockNumber, index, err := s.b.GetTransaction(ctx, hash)
+	tx, blockHash, _, index, err := s.b.GetTransaction(ctx, hash)
 	if err != nil {
 		// When the transaction doesn't exist, the RPC method should return JSON null
 		// as per specification.
@@ -1844,12 +1884,51 @@ func (s *TransactionAPI) GetTransactionReceipt(ctx context.Context, hash common.
 
 	// Derive the sender.
 	signer := types.MakeSigner(s.b.ChainConfig(), header.Number, header.Time)
+	return marshalReceipt(s.b.ChainConfig(), header, receipt, tx, signer, index), nil
+}
+
+// GetBlockReceipts returns the receipts of all the transactions in the block,
+// including the Arbitrum specific fields.
+func (s *BlockChainAPI) GetBlockReceipts(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash) ([]map[string]interface{}, error) {
+	block, err := s.b.BlockByNumberOrHash(ctx, blockNrOrHash)
+	if block == nil || err != nil {
+		// When the block doesn't exist, the RPC method should return JSON null
+		// as per specification.
+		return nil, nil
+	}
+	return BlockReceipts(ctx, s.b, block)
+}
+
+// BlockReceipts marshals the receipts of all the transactions in the block,
+// as returned by eth_getTransactionReceipt.
+func BlockReceipts(ctx context.Context, b Backend, block *types.Block) ([]map[string]interface{}, error) {
+	receipts, err := b.GetReceipts(ctx, block.Hash())
+	if err != nil {
+		return nil, err
+	}
+	txs := block.Transactions()
+	if len(txs) != len(receipts) {
+		return nil, fmt.Errorf("receipts length mismatch: %d vs %d", len(txs), len(receipts))
+	}
+	var (
+		header = block.Header()
+		signer = types.MakeSigner(b.ChainConfig(), header.Number, header.Time)
+		result = make([]map[string]interface{}, len(receipts))
+	)
+	for i, receipt := range receipts {
+		result[i] = marshalReceipt(b.ChainConfig(), header, receipt, txs[i], signer, uint64(i))
+	}
+	return result, nil
+}
+
+// marshalReceipt marshals a transaction receipt into a JSON object.
+func marshalReceipt(config *params.ChainConfig, header *types.Header, receipt *types.Receipt, tx *types.Transaction, signer types.Signer, index uint64) map[string]interface{} {
 	from, _ := types.Sender(signer, tx)
 
 	fields := map[string]interface{}{
-		"blockHash":         blockHash,
-		"blockNumber":       hexutil.Uint64(blockNumber),
-		"transactionHash":   hash,
+		"blockHash":         header.Hash(),
+		"blockNumber":       hexutil.Uint64(header.Number.Uint64()),
+		"transactionHash":   tx.Hash(),
 		"transactionIndex":  hexutil.Uint64(index),
 		"from":              from,
 		"to":                tx.To(),
@@ -1876,14 +1955,10 @@ func (s *TransactionAPI) GetTransactionReceipt(ctx context.Context, hash common.
 	if receipt.ContractAddress != (common.Address{}) {
 		fields["contractAddress"] = receipt.ContractAddress
 	}
-	if s.b.ChainConfig().IsArbitrum() {
+	if config.IsArbitrum() {
 		fields["gasUsedForL1"] = hexutil.Uint64(receipt.GasUsedForL1)
 
-		header, err := s.b.HeaderByHash(ctx, blockHash)
-		if err != nil {
-			return nil, err
-		}
-		if s.b.ChainConfig().IsArbitrumNitro(header.Number) {
+		if config.IsArbitrumNitro(header.Number) {
 			fields["effectiveGasPrice"] = hexutil.Uint64(header.BaseFee.Uint64())
 			fields["l1BlockNumber"] = hexutil.Uint64(types.DeserializeHeaderExtraInformation(header).L1BlockNumber)
 		} else {
@@ -1897,7 +1972,7 @@ func (s *TransactionAPI) GetTransactionReceipt(ctx context.Context, hash common.
 			}
 		}
 	}
-	return fields, nil
+	return fields
 }
 
 // sign is a helper function that signs a transaction with the private key of the given address.
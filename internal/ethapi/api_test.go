@@ -282,7 +282,7 @@ func (b testBackend) StateAndHeaderByNumberOrHash(ctx context.Context, blockNrOr
 }
 func (b testBackend) PendingBlockAndReceipts() (*types.Block, types.Receipts) { panic("implement me") }
 func (b testBackend) GetReceipts(ctx context.Context, hash common.Hash) (types.Receipts, error) {
-	panic("implement me")
+	return b.chain.GetReceiptsByHash(hash), nil
 }
 func (b testBackend) GetTd(ctx context.Context, hash common.Hash) *big.Int { panic("implement me") }
 func (b testBackend) GetEVM(ctx context.Context, msg *core.Message, state *state.StateDB, header *types.Header, vmConfig *vm.Config, blockContext *vm.BlockContext) (*vm.EVM, func() error) {
@@ -350,6 +350,10 @@ func (b testBackend) FallbackClient() types.FallbackClient {
 	return nil
 }
 
+func (b testBackend) CallCache() *CallCache {
+	return nil
+}
+
 func (b testBackend) SyncProgressMap() map[string]interface{} {
 	return map[string]interface{}{}
 }
@@ -435,6 +439,63 @@ func TestEstimateGas(t *testing.T) {
 	}
 }
 
+func TestEstimateGasStrategies(t *testing.T) {
+	t.Parallel()
+	var (
+		accounts = newAccounts(2)
+		genesis  = &core.Genesis{
+			Config: params.TestChainConfig,
+			Alloc: core.GenesisAlloc{
+				accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+			},
+		}
+		latest = rpc.BlockNumberOrHashWithNumber(rpc.LatestBlockNumber)
+	)
+	backend := newTestBackend(t, 1, genesis, func(i int, b *core.BlockGen) {})
+	calls := []struct {
+		call TransactionArgs
+		want uint64
+	}{
+		{TransactionArgs{From: &accounts[0].addr, To: &accounts[1].addr, Value: (*hexutil.Big)(big.NewInt(1000))}, 21000},
+		{TransactionArgs{}, 53000},
+	}
+	strategies := []*EstimateGasOptions{
+		nil,
+		{Strategy: EstimateBinary, ReturnResult: true},
+		{Strategy: EstimateOptimistic, Padding: 0.1, ReturnResult: true},
+		{Strategy: EstimateHybrid, ReturnResult: true},
+		{Strategy: EstimateBinary, ErrorRatio: 0.1},
+	}
+	for i, opts := range strategies {
+		for j, tc := range calls {
+			res, err := DoEstimateGasWithOptions(context.Background(), backend, tc.call, latest, 0, opts)
+			if err != nil {
+				t.Errorf("strategy %d call %d: estimation failed: %v", i, j, err)
+				continue
+			}
+			// The inexact estimates succeed too, within their bounds
+			max := tc.want
+			if opts != nil && opts.Strategy == EstimateOptimistic {
+				max = uint64(float64((tc.want+params.CallStipend)*64/63) * (1 + opts.Padding))
+			}
+			if opts != nil && opts.ErrorRatio > 0 {
+				max = uint64(float64(tc.want) / (1 - opts.ErrorRatio))
+			}
+			if res.Gas < tc.want || res.Gas > max {
+				t.Errorf("strategy %d call %d: estimate %d out of [%d, %d]", i, j, res.Gas, tc.want, max)
+			}
+			if wantResult := opts != nil && opts.ReturnResult; (res.Result != nil) != wantResult {
+				t.Errorf("strategy %d call %d: result returned %v, want %v", i, j, res.Result != nil, wantResult)
+			} else if wantResult && res.Result.Failed() {
+				t.Errorf("strategy %d call %d: failed result returned: %v", i, j, res.Result.Err)
+			}
+		}
+	}
+	if _, err := DoEstimateGasWithOptions(context.Background(), backend, calls[0].call, latest, 0, &EstimateGasOptions{Strategy: "random"}); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+}
+
 func TestCall(t *testing.T) {
 	t.Parallel()
 	// Initialize test accounts
@@ -733,3 +794,56 @@ func TestRPCMarshalBlock(t *testing.T) {
 		}
 	}
 }
+
+func TestRPCGetBlockReceipts(t *testing.T) {
+	t.Parallel()
+	var (
+		accounts = newAccounts(2)
+		genesis  = &core.Genesis{
+			Config: params.TestChainConfig,
+			Alloc: core.GenesisAlloc{
+				accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+			},
+		}
+		signer = types.HomesteadSigner{}
+	)
+	backend := newTestBackend(t, 3, genesis, func(i int, b *core.BlockGen) {
+		for j := 0; j < i; j++ {
+			tx, _ := types.SignTx(types.NewTx(&types.LegacyTx{Nonce: b.TxNonce(accounts[0].addr), To: &accounts[1].addr, Value: big.NewInt(1000), Gas: params.TxGas, GasPrice: b.BaseFee(), Data: nil}), signer, accounts[0].key)
+			b.AddTx(tx)
+		}
+	})
+	api := NewBlockChainAPI(backend)
+	for number := 0; number <= 3; number++ {
+		receipts, err := api.GetBlockReceipts(context.Background(), rpc.BlockNumberOrHashWithNumber(rpc.BlockNumber(number)))
+		if err != nil {
+			t.Fatalf("block %d: failed to get receipts: %v", number, err)
+		}
+		block := backend.chain.GetBlockByNumber(uint64(number))
+		if len(receipts) != len(block.Transactions()) {
+			t.Fatalf("block %d: receipt count mismatch: have %d, want %d", number, len(receipts), len(block.Transactions()))
+		}
+		for i, receipt := range receipts {
+			tx := block.Transactions()[i]
+			if receipt["transactionHash"] != tx.Hash() {
+				t.Errorf("block %d receipt %d: transaction hash mismatch: have %v, want %v", number, i, receipt["transactionHash"], tx.Hash())
+			}
+			if receipt["transactionIndex"] != hexutil.Uint64(i) {
+				t.Errorf("block %d receipt %d: index mismatch: have %v", number, i, receipt["transactionIndex"])
+			}
+			if receipt["blockHash"] != block.Hash() {
+				t.Errorf("block %d receipt %d: block hash mismatch: have %v, want %v", number, i, receipt["blockHash"], block.Hash())
+			}
+			if receipt["from"] != accounts[0].addr {
+				t.Errorf("block %d receipt %d: sender mismatch: have %v, want %v", number, i, receipt["from"], accounts[0].addr)
+			}
+			if receipt["gasUsed"] != hexutil.Uint64(params.TxGas) {
+				t.Errorf("block %d receipt %d: gas used mismatch: have %v", number, i, receipt["gasUsed"])
+			}
+		}
+	}
+	// Missing blocks yield null
+	if receipts, err := api.GetBlockReceipts(context.Background(), rpc.BlockNumberOrHashWithNumber(10)); receipts != nil || err != nil {
+		t.Fatalf("missing block: have %v, %v", receipts, err)
+	}
+}
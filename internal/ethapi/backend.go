@@ -41,6 +41,7 @@ import (
 // both full and light clients) with access to necessary functions.
 type Backend interface {
 	FallbackClient() types.FallbackClient
+	CallCache() *CallCache // cache of eth_call and eth_estimateGas results, nil if disabled
 
 	// General Ethereum API
 	SyncProgress() ethereum.SyncProgress
@@ -0,0 +1,186 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethapi
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/lru"
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/metrics"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+var (
+	callCacheHitMeter  = metrics.NewRegisteredMeter("rpc/callcache/hit", nil)
+	callCacheMissMeter = metrics.NewRegisteredMeter("rpc/callcache/miss", nil)
+)
+
+// callCacheEntryOverhead approximates the memory held by a cache entry besides
+// the returned data: the key, the list element and the result struct.
+const callCacheEntryOverhead = 256
+
+// callCacheEntry is a cached eth_call or eth_estimateGas result.
+type callCacheEntry struct {
+	result  *core.ExecutionResult // eth_call result
+	gas     uint64                // eth_estimateGas result
+	size    uint64
+	expires time.Time
+}
+
+// CallCache holds the results of eth_call and eth_estimateGas, which only depend
+// on the block they run against and their arguments, to absorb the identical
+// calls front-ends keep polling with. Entries are keyed by block hash and expire
+// after a ttl, the cache evicting the least recently used ones above maxSize bytes.
+type CallCache struct {
+	maxSize uint64
+	ttl     time.Duration
+
+	lru  lru.BasicLRU[common.Hash, *callCacheEntry]
+	size uint64
+	lock sync.Mutex
+}
+
+// NewCallCache creates a call cache bounded to maxSize bytes, whose entries expire
+// after ttl (0=never).
+func NewCallCache(maxSize uint64, ttl time.Duration) *CallCache {
+	return &CallCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		// The capacity is only bounded by the size, evictions are done by hand
+		lru: lru.NewBasicLRU[common.Hash, *callCacheEntry](int(maxSize/callCacheEntryOverhead) + 1),
+	}
+}
+
+// callCacheKey hashes the method, the block and the arguments of a call. It
+// returns false if the arguments can't be encoded, leaving the call uncached.
+func callCacheKey(method string, blockHash common.Hash, args ...interface{}) (common.Hash, bool) {
+	hasher := crypto.NewKeccakState()
+	hasher.Write([]byte(method))
+	hasher.Write(blockHash.Bytes())
+	for _, arg := range args {
+		// Maps are encoded with sorted keys, so equal overrides get the same key
+		enc, err := json.Marshal(arg)
+		if err != nil {
+			return common.Hash{}, false
+		}
+		hasher.Write(enc)
+		hasher.Write([]byte{0})
+	}
+	var key common.Hash
+	hasher.Read(key[:])
+	return key, true
+}
+
+func (c *CallCache) get(key common.Hash) (*callCacheEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.lru.Get(key)
+	if ok && c.ttl > 0 && time.Now().After(entry.expires) {
+		c.remove(key, entry)
+		ok = false
+	}
+	if ok {
+		callCacheHitMeter.Mark(1)
+	} else {
+		callCacheMissMeter.Mark(1)
+	}
+	return entry, ok
+}
+
+func (c *CallCache) add(key common.Hash, entry *callCacheEntry) {
+	entry.size = callCacheEntryOverhead
+	if entry.result != nil {
+		entry.size += uint64(len(entry.result.ReturnData))
+	}
+	if entry.size > c.maxSize {
+		return
+	}
+	entry.expires = time.Now().Add(c.ttl)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if old, ok := c.lru.Peek(key); ok {
+		c.size -= old.size
+	}
+	c.lru.Add(key, entry)
+	c.size += entry.size
+	for c.size > c.maxSize {
+		_, evicted, ok := c.lru.RemoveOldest()
+		if !ok {
+			break
+		}
+		c.size -= evicted.size
+	}
+}
+
+// remove drops an entry, the lock must be held.
+func (c *CallCache) remove(key common.Hash, entry *callCacheEntry) {
+	if c.lru.Remove(key) {
+		c.size -= entry.size
+	}
+}
+
+// Prune drops the expired entries, it's meant to be called on head changes as
+// the entries of the older blocks stop being requested.
+func (c *CallCache) Prune() {
+	if c.ttl == 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for _, key := range c.lru.Keys() {
+		if entry, ok := c.lru.Peek(key); ok && now.After(entry.expires) {
+			c.remove(key, entry)
+		}
+	}
+}
+
+// Size returns the number of entries and their approximate memory usage in bytes.
+func (c *CallCache) Size() (int, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.lru.Len(), c.size
+}
+
+// callCacheFor returns the call cache of the backend along with the hash of the
+// block a call runs against, or nil if the call can't be cached.
+func callCacheFor(ctx context.Context, b Backend, blockNrOrHash rpc.BlockNumberOrHash) (*CallCache, common.Hash) {
+	cache := b.CallCache()
+	if cache == nil {
+		return nil, common.Hash{}
+	}
+	// The pending block keeps changing under the same number
+	if number, ok := blockNrOrHash.Number(); ok && number == rpc.PendingBlockNumber {
+		return nil, common.Hash{}
+	}
+	header, err := b.HeaderByNumberOrHash(ctx, blockNrOrHash)
+	if header == nil || err != nil {
+		return nil, common.Hash{}
+	}
+	return cache, header.Hash()
+}
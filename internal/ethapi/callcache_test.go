@@ -0,0 +1,101 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/hexutil"
+	"github.com/chainupcloud/arb-geth/core"
+)
+
+// Tests that call results are keyed by all their inputs, and evicted once over
+// the size bound or expired.
+func TestCallCache(t *testing.T) {
+	var (
+		to    = common.Address{0x1}
+		data  = hexutil.Bytes{0x1, 0x2}
+		block = common.Hash{0xb}
+		args  = TransactionArgs{To: &to, Data: &data}
+	)
+	key, ok := callCacheKey("eth_call", block, args, (*StateOverride)(nil), (*BlockOverrides)(nil))
+	if !ok {
+		t.Fatal("failed to key the call")
+	}
+	// Equal overrides map to the same key, whatever their construction order
+	overrides := func(addrs ...common.Address) *StateOverride {
+		o := make(StateOverride)
+		for _, addr := range addrs {
+			o[addr] = OverrideAccount{Code: &data}
+		}
+		return &o
+	}
+	a, _ := callCacheKey("eth_call", block, args, overrides(common.Address{2}, common.Address{3}), nil)
+	b, _ := callCacheKey("eth_call", block, args, overrides(common.Address{3}, common.Address{2}), nil)
+	if a != b {
+		t.Error("equal overrides keyed differently")
+	}
+	for i, other := range []common.Hash{
+		callCacheKeyOf(t, "eth_estimateGas", block, args, (*StateOverride)(nil), (*BlockOverrides)(nil)),
+		callCacheKeyOf(t, "eth_call", common.Hash{0xc}, args, (*StateOverride)(nil), (*BlockOverrides)(nil)),
+		callCacheKeyOf(t, "eth_call", block, TransactionArgs{To: &to}, (*StateOverride)(nil), (*BlockOverrides)(nil)),
+		a,
+	} {
+		if other == key {
+			t.Errorf("key %d collides", i)
+		}
+	}
+	// Results are evicted least recently used first above the size bound
+	cache := NewCallCache(2*callCacheEntryOverhead+2, 0)
+	add := func(i byte) {
+		cache.add(common.Hash{i}, &callCacheEntry{result: &core.ExecutionResult{ReturnData: []byte{i}}})
+	}
+	add(0)
+	add(1)
+	if _, ok := cache.get(common.Hash{0}); !ok {
+		t.Fatal("first result missing")
+	}
+	add(2)
+	if n, size := cache.Size(); n != 2 || size != 2*callCacheEntryOverhead+2 {
+		t.Fatalf("have %d results of %d bytes, want 2 of %d", n, size, 2*callCacheEntryOverhead+2)
+	}
+	if _, ok := cache.get(common.Hash{1}); ok {
+		t.Error("least recently used result not evicted")
+	}
+	// Expired results are neither served nor kept
+	cache = NewCallCache(1024*1024, time.Millisecond)
+	cache.add(key, &callCacheEntry{gas: 21000})
+	if entry, ok := cache.get(key); !ok || entry.gas != 21000 {
+		t.Fatal("fresh result not served")
+	}
+	time.Sleep(5 * time.Millisecond)
+	cache.Prune()
+	if n, _ := cache.Size(); n != 0 {
+		t.Error("expired result not pruned")
+	}
+}
+
+func callCacheKeyOf(t *testing.T, method string, block common.Hash, args ...interface{}) common.Hash {
+	t.Helper()
+	key, ok := callCacheKey(method, block, args...)
+	if !ok {
+		t.Fatal("failed to key the call")
+	}
+	return key
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethapi
+
+import (
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/core"
+	"github.com/chainupcloud/arb-geth/core/vm"
+	"github.com/chainupcloud/arb-geth/params"
+)
+
+// EstimateStrategy selects how the gas of a call is estimated.
+type EstimateStrategy string
+
+const (
+	// EstimateBinary binary searches the gas between the intrinsic gas and the
+	// gas cap, executing the call about log2(cap) times.
+	EstimateBinary EstimateStrategy = "binary"
+
+	// EstimateOptimistic executes the call once at the gas cap, and checks the
+	// gas it used padded with the 63/64 rule and the padding of the options,
+	// falling back to a binary search above it if the call fails with it.
+	EstimateOptimistic EstimateStrategy = "optimistic"
+
+	// EstimateHybrid executes the call once at the gas cap as the optimistic
+	// strategy does, and binary searches the gas between the gas it used and
+	// the gas cap, probing the unpadded guess first.
+	EstimateHybrid EstimateStrategy = "hybrid"
+)
+
+// EstimateGasOptions configures DoEstimateGasWithOptions.
+type EstimateGasOptions struct {
+	Strategy     EstimateStrategy // Estimation algorithm, binary search if empty
+	ErrorRatio   float64          // Fraction of the estimate the binary search may overshoot it by (0 = exact)
+	Padding      float64          // Fraction of the gas used added to the optimistic guess
+	ReturnResult bool             // Whether to return the execution result at the estimate
+}
+
+// EstimateGasResult is the outcome of DoEstimateGasWithOptions.
+type EstimateGasResult struct {
+	Gas    uint64                // Gas limit the call succeeds with
+	Result *core.ExecutionResult // Execution result at the estimate, if requested
+}
+
+// estimateFunc executes the call with the given gas limit, reporting whether it
+// failed along with its result, the error meaning it can't ever succeed.
+type estimateFunc func(gas uint64) (bool, *core.ExecutionResult, error)
+
+// searchGas looks for the lowest gas limit above lo, up to hi, the call succeeds
+// with, using the strategy of the options.
+func searchGas(lo, hi uint64, opts *EstimateGasOptions, executable estimateFunc) (*EstimateGasResult, error) {
+	if opts == nil {
+		opts = new(EstimateGasOptions)
+	}
+	var (
+		cap  = hi
+		best *core.ExecutionResult // Result of the successful execution at hi
+	)
+	done := func() (*EstimateGasResult, error) {
+		res := &EstimateGasResult{Gas: hi}
+		if opts.ReturnResult {
+			res.Result = best
+		}
+		return res, nil
+	}
+	switch opts.Strategy {
+	case "", EstimateBinary:
+	case EstimateOptimistic, EstimateHybrid:
+		// Execute at the cap to learn the gas used, below which the call fails
+		failed, result, err := executable(hi)
+		if err != nil {
+			return nil, err
+		}
+		if failed {
+			return nil, estimateFailure(result, cap)
+		}
+		best = result
+		if result.UsedGas > lo+1 {
+			lo = result.UsedGas - 1
+		}
+		// The call may need more gas than it used, for the gas it leaves to its
+		// subcalls and the stipends they're given
+		guess := (result.UsedGas + params.CallStipend) * 64 / 63
+		if opts.Strategy == EstimateOptimistic {
+			guess += uint64(float64(guess) * opts.Padding)
+		}
+		if guess >= hi {
+			if opts.Strategy == EstimateOptimistic {
+				return done()
+			}
+			break
+		}
+		failed, result, err = executable(guess)
+		if err != nil {
+			return nil, err
+		}
+		if failed {
+			lo = guess
+			break
+		}
+		hi, best = guess, result
+		if opts.Strategy == EstimateOptimistic {
+			return done()
+		}
+	default:
+		return nil, fmt.Errorf("unknown gas estimation strategy %q", opts.Strategy)
+	}
+	// Execute the binary search and hone in on an executable gas limit
+	for lo+1 < hi {
+		if opts.ErrorRatio > 0 && float64(hi-lo)/float64(hi) < opts.ErrorRatio {
+			break
+		}
+		mid := (hi + lo) / 2
+		failed, result, err := executable(mid)
+
+		// If the error is not nil(consensus error), it means the provided message
+		// call or transaction will never be accepted no matter how much gas it is
+		// assigned. Return the error directly, don't struggle any more.
+		if err != nil {
+			return nil, err
+		}
+		if failed {
+			lo = mid
+		} else {
+			hi, best = mid, result
+		}
+	}
+	// Reject the transaction as invalid if it still fails at the highest allowance
+	if best == nil {
+		failed, result, err := executable(hi)
+		if err != nil {
+			return nil, err
+		}
+		if failed {
+			return nil, estimateFailure(result, cap)
+		}
+		best = result
+	}
+	return done()
+}
+
+// estimateFailure returns the error of a call failing with the gas cap.
+func estimateFailure(result *core.ExecutionResult, cap uint64) error {
+	if result != nil && result.Err != vm.ErrOutOfGas {
+		if len(result.Revert()) > 0 {
+			return newRevertError(result)
+		}
+		return result.Err
+	}
+	// Otherwise, the specified gas cap is too low
+	return fmt.Errorf("gas required exceeds allowance (%d)", cap)
+}
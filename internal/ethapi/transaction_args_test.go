@@ -348,6 +348,10 @@ func (b *backendMock) FallbackClient() types.FallbackClient {
 	return nil
 }
 
+func (b *backendMock) CallCache() *CallCache {
+	return nil
+}
+
 func (b *backendMock) SyncProgressMap() map[string]interface{} {
 	return nil
 }
@@ -0,0 +1,292 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package quota meters the expensive RPC calls of each client against budgets,
+// so that no single client can monopolize the state recreation, tracing or log
+// filtering capacity of a node.
+package quota
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common/lru"
+	"github.com/chainupcloud/arb-geth/metrics"
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+// Resource is a kind of work metered per client.
+type Resource int
+
+const (
+	StateRecreationGas Resource = iota // L2 gas replayed to recreate historical states
+	TraceTime                          // Time spent tracing, in milliseconds
+	LogBlocks                          // Blocks in the ranges of log queries
+	numResources
+)
+
+var resourceNames = [numResources]string{"state-recreation-gas", "trace-time", "log-blocks"}
+
+func (r Resource) String() string {
+	if r < 0 || r >= numResources {
+		return fmt.Sprintf("resource(%d)", int(r))
+	}
+	return resourceNames[r]
+}
+
+var rejectedMeters [numResources]metrics.Meter
+
+func init() {
+	for r := Resource(0); r < numResources; r++ {
+		rejectedMeters[r] = metrics.NewRegisteredMeter("rpc/quota/"+r.String()+"/rejected", nil)
+	}
+}
+
+// errorCodeExceeded is the code of quota errors, borrowed from the HTTP status
+// for too many requests.
+const errorCodeExceeded = 429
+
+// ExceededError is returned to the clients whose budget can't afford a call.
+type ExceededError struct {
+	Resource   string  `json:"resource"`
+	Budget     uint64  `json:"budget"`              // Budget of the client over a window
+	Used       uint64  `json:"used"`                // Part of the budget currently used
+	Requested  uint64  `json:"requested,omitempty"` // Amount requested by the call, if known upfront
+	RetryAfter float64 `json:"retryAfter"`          // Seconds until the call is affordable, 0 if it never is
+}
+
+func (e *ExceededError) Error() string {
+	if e.RetryAfter == 0 {
+		return fmt.Sprintf("%s quota exceeded: requested %d above the budget of %d", e.Resource, e.Requested, e.Budget)
+	}
+	return fmt.Sprintf("%s quota exceeded: used %d of %d, retry in %.1fs", e.Resource, e.Used, e.Budget, e.RetryAfter)
+}
+
+func (e *ExceededError) ErrorCode() int { return errorCodeExceeded }
+
+func (e *ExceededError) ErrorData() interface{} { return e }
+
+// Config is the budget of each client per resource, zero meaning unlimited.
+// Budgets refill continuously, a client at rest recovering its whole budget
+// over a window.
+type Config struct {
+	Window             time.Duration
+	StateRecreationGas uint64        // L2 gas replayed per window
+	TraceTime          time.Duration // Time spent tracing per window
+	LogBlocks          uint64        // Blocks queried for logs per window
+
+	// Keys multiply the budgets of the clients presenting them in the X-Api-Key
+	// header, 0 lifting the limits. Clients with unknown keys count as their IP.
+	Keys map[string]float64
+
+	// TrustForwardedFor identifies clients by the first address of the
+	// X-Forwarded-For header, to be set when the node is behind a proxy.
+	TrustForwardedFor bool
+
+	// MaxClients bounds the number of clients tracked, the least recently seen
+	// ones being forgotten.
+	MaxClients int
+}
+
+func (c *Config) budget(r Resource) uint64 {
+	switch r {
+	case StateRecreationGas:
+		return c.StateRecreationGas
+	case TraceTime:
+		return uint64(c.TraceTime.Milliseconds())
+	case LogBlocks:
+		return c.LogBlocks
+	}
+	return 0
+}
+
+// client is the usage of a client, which leaks out at the refill rate.
+type client struct {
+	scale   float64
+	used    [numResources]float64
+	updated time.Time
+}
+
+// Engine tracks the usage of the clients and enforces their budgets.
+type Engine struct {
+	config Config
+	now    func() time.Time
+	peer   func(context.Context) rpc.PeerInfo
+
+	clients lru.BasicLRU[string, *client]
+	lock    sync.Mutex
+}
+
+// New creates a quota engine enforcing the given budgets.
+func New(config Config) *Engine {
+	if config.Window <= 0 {
+		config.Window = time.Minute
+	}
+	if config.MaxClients <= 0 {
+		config.MaxClients = 65536
+	}
+	return &Engine{
+		config:  config,
+		now:     time.Now,
+		peer:    rpc.PeerInfoFromContext,
+		clients: lru.NewBasicLRU[string, *client](config.MaxClients),
+	}
+}
+
+// identify returns the identifier of the client making the call and the scale
+// of its budgets, or false if the client is not metered: in process and IPC
+// calls come from the operator, as do the clients with unlimited keys.
+func (e *Engine) identify(ctx context.Context) (string, float64, bool) {
+	info := e.peer(ctx)
+	if info.Transport == "" || info.Transport == "ipc" {
+		return "", 0, false
+	}
+	if key := info.HTTP.APIKey; key != "" {
+		if scale, ok := e.config.Keys[key]; ok {
+			if scale <= 0 {
+				return "", 0, false
+			}
+			return "key:" + key, scale, true
+		}
+	}
+	addr := info.RemoteAddr
+	if forwarded := info.HTTP.ForwardedFor; e.config.TrustForwardedFor && forwarded != "" {
+		addr = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	} else if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return "ip:" + addr, 1, true
+}
+
+// client returns the usage of a client brought up to date, the lock must be held.
+func (e *Engine) client(id string, scale float64) *client {
+	now := e.now()
+	c, ok := e.clients.Get(id)
+	if !ok {
+		c = &client{scale: scale, updated: now}
+		e.clients.Add(id, c)
+		return c
+	}
+	elapsed := float64(now.Sub(c.updated)) / float64(e.config.Window)
+	for r := Resource(0); r < numResources; r++ {
+		c.used[r] = math.Max(0, c.used[r]-elapsed*float64(e.config.budget(r))*c.scale)
+	}
+	c.updated = now
+	return c
+}
+
+// charge accounts amount to the usage of the caller if affordable. Calls of a
+// known cost must fit in the budget, while the others are let through as long
+// as it isn't exhausted.
+func (e *Engine) charge(ctx context.Context, r Resource, amount uint64) error {
+	base := e.config.budget(r)
+	if base == 0 {
+		return nil
+	}
+	id, scale, ok := e.identify(ctx)
+	if !ok {
+		return nil
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var (
+		c      = e.client(id, scale)
+		budget = float64(base) * scale
+		excess = c.used[r] + float64(amount) - budget
+	)
+	if excess < 0 || (amount > 0 && excess == 0) {
+		c.used[r] += float64(amount)
+		return nil
+	}
+	rejectedMeters[r].Mark(1)
+	err := &ExceededError{
+		Resource:  r.String(),
+		Budget:    uint64(budget),
+		Used:      uint64(c.used[r]),
+		Requested: amount,
+	}
+	if float64(amount) <= budget {
+		retry := excess / budget * e.config.Window.Seconds()
+		err.RetryAfter = math.Max(0.1, math.Ceil(10*retry)/10)
+	}
+	return err
+}
+
+// Reserve charges a call whose cost is known upfront to the budget of the caller,
+// failing if it doesn't fit.
+func (e *Engine) Reserve(ctx context.Context, r Resource, amount uint64) error {
+	return e.charge(ctx, r, amount)
+}
+
+// Check fails if the budget of the caller is exhausted, for calls whose cost is
+// only known once done and then reported with Record.
+func (e *Engine) Check(ctx context.Context, r Resource) error {
+	return e.charge(ctx, r, 0)
+}
+
+// Record charges the cost of a call to the budget of the caller after the fact.
+func (e *Engine) Record(ctx context.Context, r Resource, amount uint64) {
+	if e.config.budget(r) == 0 || amount == 0 {
+		return
+	}
+	id, scale, ok := e.identify(ctx)
+	if !ok {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.client(id, scale).used[r] += float64(amount)
+}
+
+// defaultEngine is the engine metering the calls of the node, nil if disabled.
+var defaultEngine atomic.Pointer[Engine]
+
+// SetDefault sets the engine used by the package level functions, nil disabling
+// the quotas.
+func SetDefault(e *Engine) {
+	defaultEngine.Store(e)
+}
+
+// Reserve charges a call to the default engine, see Engine.Reserve.
+func Reserve(ctx context.Context, r Resource, amount uint64) error {
+	if e := defaultEngine.Load(); e != nil {
+		return e.Reserve(ctx, r, amount)
+	}
+	return nil
+}
+
+// Check checks the budget of the caller in the default engine, see Engine.Check.
+func Check(ctx context.Context, r Resource) error {
+	if e := defaultEngine.Load(); e != nil {
+		return e.Check(ctx, r)
+	}
+	return nil
+}
+
+// Record charges a finished call to the default engine, see Engine.Record.
+func Record(ctx context.Context, r Resource, amount uint64) {
+	if e := defaultEngine.Load(); e != nil {
+		e.Record(ctx, r, amount)
+	}
+}
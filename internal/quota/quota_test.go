@@ -0,0 +1,112 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package quota
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/rpc"
+)
+
+type peerKey struct{}
+
+func withPeer(addr, key, forwarded string) context.Context {
+	info := rpc.PeerInfo{Transport: "http", RemoteAddr: addr}
+	info.HTTP.APIKey = key
+	info.HTTP.ForwardedFor = forwarded
+	return context.WithValue(context.Background(), peerKey{}, info)
+}
+
+// Tests that budgets are enforced per client, refill over the window and scale
+// with the API keys.
+func TestEngine(t *testing.T) {
+	var (
+		now    = time.Unix(0, 0)
+		engine = New(Config{
+			Window:            10 * time.Second,
+			LogBlocks:         100,
+			TraceTime:         time.Second,
+			Keys:              map[string]float64{"gold": 3, "ops": 0},
+			TrustForwardedFor: true,
+		})
+	)
+	engine.now = func() time.Time { return now }
+	engine.peer = func(ctx context.Context) rpc.PeerInfo {
+		info, _ := ctx.Value(peerKey{}).(rpc.PeerInfo)
+		return info
+	}
+	var (
+		alice  = withPeer("1.1.1.1:1000", "", "")
+		alice2 = withPeer("1.1.1.1:2000", "unknown", "")
+		bob    = withPeer("10.0.0.1:1000", "", "2.2.2.2, 10.0.0.1")
+		gold   = withPeer("1.1.1.1:3000", "gold", "")
+		ops    = withPeer("1.1.1.1:4000", "ops", "")
+	)
+	if err := engine.Reserve(alice, LogBlocks, 60); err != nil {
+		t.Fatalf("first reservation failed: %v", err)
+	}
+	// Connections of the same IP share the budget, unknown keys included
+	var qerr *ExceededError
+	if err := engine.Reserve(alice2, LogBlocks, 60); !errors.As(err, &qerr) {
+		t.Fatalf("reservation above the budget accepted: %v", err)
+	}
+	if qerr.ErrorCode() != 429 || qerr.Used != 60 || qerr.RetryAfter != 2 {
+		t.Fatalf("unexpected error: %+v", qerr)
+	}
+	// Calls above the whole budget are never affordable
+	if err := engine.Reserve(bob, LogBlocks, 101); !errors.As(err, &qerr) || qerr.RetryAfter != 0 {
+		t.Fatalf("reservation above the whole budget: %v", err)
+	}
+	if err := engine.Reserve(bob, LogBlocks, 100); err != nil {
+		t.Fatalf("forwarded client not metered apart: %v", err)
+	}
+	if err := engine.Reserve(gold, LogBlocks, 300); err != nil {
+		t.Fatalf("scaled budget not applied: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := engine.Reserve(ops, LogBlocks, 1000); err != nil {
+			t.Fatalf("unlimited key metered: %v", err)
+		}
+	}
+	if err := engine.Reserve(context.Background(), LogBlocks, 1000); err != nil {
+		t.Fatalf("in process call metered: %v", err)
+	}
+	// The budget refills over the window
+	now = now.Add(2 * time.Second)
+	if err := engine.Reserve(alice, LogBlocks, 60); err != nil {
+		t.Fatalf("reservation after refill failed: %v", err)
+	}
+	// Calls of unknown cost pass until the budget is exhausted
+	if err := engine.Check(alice, TraceTime); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	engine.Record(alice, TraceTime, 1500)
+	if err := engine.Check(alice, TraceTime); !errors.As(err, &qerr) || qerr.RetryAfter != 5 {
+		t.Fatalf("check after exhaustion: %v", err)
+	}
+	now = now.Add(5 * time.Second)
+	if err := engine.Check(alice, TraceTime); err == nil {
+		t.Fatal("check passed with the budget just exhausted")
+	}
+	now = now.Add(time.Second)
+	if err := engine.Check(alice, TraceTime); err != nil {
+		t.Fatalf("check after refill failed: %v", err)
+	}
+}
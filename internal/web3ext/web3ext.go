@@ -199,6 +199,10 @@ web3._extend({
 			name: 'peers',
 			getter: 'admin_peers'
 		}),
+		new web3._extend.Property({
+			name: 'snapHealProgress',
+			getter: 'admin_snapHealProgress'
+		}),
 		new web3._extend.Property({
 			name: 'datadir',
 			getter: 'admin_datadir'
@@ -436,6 +440,21 @@ web3._extend({
 			params: 3,
 			inputFormatter: [null, null, null]
 		}),
+		new web3._extend.Method({
+			name: 'setStorageLayout',
+			call: 'debug_setStorageLayout',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'storageLayout',
+			call: 'debug_storageLayout',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'removeStorageLayout',
+			call: 'debug_removeStorageLayout',
+			params: 1
+		}),
 		new web3._extend.Method({
 			name: 'preimage',
 			call: 'debug_preimage',
@@ -574,6 +593,11 @@ web3._extend({
 			call: 'eth_getRawTransactionByHash',
 			params: 1
 		}),
+		new web3._extend.Method({
+			name: 'getBlockReceipts',
+			call: 'eth_getBlockReceipts',
+			params: 1,
+		}),
 		new web3._extend.Method({
 			name: 'getRawTransactionFromBlock',
 			call: function(args) {
@@ -36,6 +36,7 @@ import (
 	"github.com/chainupcloud/arb-geth/eth/tracers"
 	"github.com/chainupcloud/arb-geth/ethdb"
 	"github.com/chainupcloud/arb-geth/event"
+	"github.com/chainupcloud/arb-geth/internal/ethapi"
 	"github.com/chainupcloud/arb-geth/light"
 	"github.com/chainupcloud/arb-geth/params"
 	"github.com/chainupcloud/arb-geth/rpc"
@@ -345,3 +346,7 @@ func (b *LesApiBackend) StateAtTransaction(ctx context.Context, block *types.Blo
 func (b *LesApiBackend) FallbackClient() types.FallbackClient {
 	return nil
 }
+
+func (b *LesApiBackend) CallCache() *ethapi.CallCache {
+	return nil
+}
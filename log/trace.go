@@ -0,0 +1,78 @@
+package log
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+)
+
+// TraceKey and OpKey are the context keys under which the loggers of traced
+// operations carry the operation trace ID and name.
+const (
+	TraceKey = "trace"
+	OpKey    = "op"
+)
+
+type traceCtxKey struct{}
+
+// traced is the logger of an operation, along with its trace ID.
+type traced struct {
+	id     string
+	logger Logger
+}
+
+// NewTraceID returns a new random operation trace ID.
+func NewTraceID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// WithTrace returns a context carrying a logger for the operation op, along
+// with that logger. If the context already belongs to a traced operation, the
+// operation is nested in it and shares its trace ID, so that all the log lines
+// of a request can be correlated.
+func WithTrace(ctx context.Context, op string, kv ...interface{}) (context.Context, Logger) {
+	id := TraceID(ctx)
+	if id == "" {
+		id = NewTraceID()
+	}
+	logger := Root().New(append([]interface{}{TraceKey, id, OpKey, op}, kv...)...)
+	return context.WithValue(ctx, traceCtxKey{}, &traced{id: id, logger: logger}), logger
+}
+
+// FromContext returns the logger of the traced operation the context belongs
+// to, or the root logger if there is none.
+func FromContext(ctx context.Context) Logger {
+	if t, ok := ctx.Value(traceCtxKey{}).(*traced); ok {
+		return t.logger
+	}
+	return Root()
+}
+
+// TraceID returns the trace ID of the operation the context belongs to, or an
+// empty string if there is none.
+func TraceID(ctx context.Context) string {
+	if t, ok := ctx.Value(traceCtxKey{}).(*traced); ok {
+		return t.id
+	}
+	return ""
+}
+
+// TraceJSONHandler returns a Handler writing the records of traced operations
+// as JSON objects to wr, one per line, for log aggregation systems to correlate
+// them by trace ID. The other records are passed to h.
+//
+//	log.Root().SetHandler(log.TraceJSONHandler(file, log.StderrHandler))
+func TraceJSONHandler(wr io.Writer, h Handler) Handler {
+	json := StreamHandler(wr, JSONFormat())
+	return FuncHandler(func(r *Record) error {
+		for i := 0; i < len(r.Ctx); i += 2 {
+			if r.Ctx[i] == TraceKey {
+				return json.Log(r)
+			}
+		}
+		return h.Log(r)
+	})
+}
@@ -0,0 +1,38 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTraceJSONHandler(t *testing.T) {
+	var traced, plain bytes.Buffer
+	l := New()
+	l.SetHandler(TraceJSONHandler(&traced, StreamHandler(&plain, LogfmtFormat())))
+
+	ctx, _ := WithTrace(context.Background(), "outer")
+	ctx, inner := WithTrace(ctx, "inner", "block", 1)
+	if FromContext(ctx) != inner {
+		t.Fatalf("context logger mismatch")
+	}
+	inner.SetHandler(l.GetHandler())
+	inner.Info("traced message")
+	l.Info("plain message")
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal(traced.Bytes(), &rec); err != nil {
+		t.Fatalf("traced record not json: %v: %s", err, traced.String())
+	}
+	if rec[TraceKey] != TraceID(ctx) || rec[OpKey] != "inner" || rec["msg"] != "traced message" {
+		t.Fatalf("unexpected traced record: %v", rec)
+	}
+	if !strings.Contains(plain.String(), "plain message") || strings.Contains(plain.String(), "traced") {
+		t.Fatalf("unexpected plain output: %s", plain.String())
+	}
+	if FromContext(context.Background()) != Root() || TraceID(context.Background()) != "" {
+		t.Fatalf("untraced context has a logger")
+	}
+}
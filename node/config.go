@@ -26,6 +26,7 @@ import (
 
 	"github.com/chainupcloud/arb-geth/common"
 	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/ethdb/remoteancient"
 	"github.com/chainupcloud/arb-geth/log"
 	"github.com/chainupcloud/arb-geth/p2p"
 	"github.com/chainupcloud/arb-geth/rpc"
@@ -214,6 +215,10 @@ type Config struct {
 	EnablePersonal bool `toml:"-"`
 
 	DBEngine string `toml:",omitempty"`
+
+	// RemoteAncients is the remote source the chain ancients missing locally,
+	// below the tail of the freezer, are read through from.
+	RemoteAncients remoteancient.Config `toml:",omitempty"`
 }
 
 // IPCEndpoint resolves an IPC endpoint based on a configured value, taking into
@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"runtime"
 
+	"github.com/chainupcloud/arb-geth/ethdb/remoteancient"
 	"github.com/chainupcloud/arb-geth/p2p"
 	"github.com/chainupcloud/arb-geth/p2p/nat"
 	"github.com/chainupcloud/arb-geth/rpc"
@@ -65,6 +66,8 @@ var DefaultConfig = Config{
 		NAT:        nat.Any(),
 	},
 	DBEngine: "", // Use whatever exists, will default to Pebble if non-existent and supported
+
+	RemoteAncients: remoteancient.DefaultConfig,
 }
 
 // DefaultDataDir is the default data directory to use for the databases and other
@@ -0,0 +1,331 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package grpcstream implements a gRPC server streaming block and state data,
+// for indexers that can't keep up with the chain over websocket subscriptions.
+//
+// The server speaks the gRPC protocol over cleartext HTTP/2 directly, encoding
+// the messages of stream.proto by hand, so that it needs no generated code.
+package grpcstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/event"
+	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/metrics"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// service is the full name of the gRPC service served.
+const service = "/arbgeth.stream.v1.BlockStream/"
+
+// reorgHistory is the number of streamed block hashes remembered to rewind the
+// streams on reorgs.
+const reorgHistory = 256
+
+var (
+	streamsGauge    = metrics.NewRegisteredGauge("grpc/streams", nil)
+	messagesMeter   = metrics.NewRegisteredMeter("grpc/messages", nil)
+	rejectionsMeter = metrics.NewRegisteredMeter("grpc/rejected", nil)
+)
+
+// Config is the configuration of the gRPC server.
+type Config struct {
+	Addr       string // Listening address, as host:port
+	MaxStreams int    // Number of concurrent streams served, 0 meaning unlimited
+}
+
+// Backend provides the chain data streamed.
+type Backend interface {
+	// CurrentHeader returns the head of the canonical chain.
+	CurrentHeader() *types.Header
+
+	// HeaderByNumber returns the canonical header of a number, nil if unknown.
+	HeaderByNumber(number uint64) *types.Header
+
+	// SubscribeNewHeads notifies the heads the canonical chain moves to.
+	SubscribeNewHeads(ch chan<- *types.Header) event.Subscription
+
+	// Receipts returns the receipts of a block, with their derived fields set.
+	Receipts(ctx context.Context, header *types.Header) (types.Receipts, error)
+
+	// TraceBlock traces a block with the given tracer, returning the JSON result.
+	TraceBlock(ctx context.Context, header *types.Header, tracer string, config json.RawMessage) ([]byte, error)
+
+	// StateDiff returns the state written by a block, nil if no longer available.
+	StateDiff(header *types.Header) (*StateDiff, error)
+}
+
+// Server serves the block streams over gRPC.
+type Server struct {
+	config  Config
+	backend Backend
+	streams chan struct{} // Semaphore of the streams served, nil if unlimited
+
+	lock     sync.Mutex
+	server   *http.Server
+	listener net.Listener
+}
+
+// New creates a gRPC server, not listening until started.
+func New(config Config, backend Backend) *Server {
+	s := &Server{config: config, backend: backend}
+	if config.MaxStreams > 0 {
+		s.streams = make(chan struct{}, config.MaxStreams)
+	}
+	return s
+}
+
+// Start listens on the configured address, implementing node.Lifecycle.
+func (s *Server) Start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	listener, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.server = &http.Server{Handler: h2c.NewHandler(s, &http2.Server{})}
+	go s.server.Serve(listener)
+	log.Info("gRPC stream server started", "endpoint", listener.Addr())
+	return nil
+}
+
+// Stop closes the listener and the open streams, implementing node.Lifecycle.
+func (s *Server) Stop() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.server == nil {
+		return nil
+	}
+	err := s.server.Close()
+	log.Info("gRPC stream server stopped", "endpoint", s.listener.Addr())
+	s.server, s.listener = nil, nil
+	return err
+}
+
+// Addr returns the address listened on, nil if not started.
+func (s *Server) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// statusError is an error ending a stream with a gRPC status code.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+func statusf(code int, format string, args ...interface{}) error {
+	return &statusError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// ServeHTTP serves a gRPC call.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC over HTTP/2 required", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+
+	// The status is sent in the trailers once streaming, or in the headers of a
+	// trailers-only response if the call is rejected upfront
+	err := s.serve(w, r)
+	code := codeOK
+	var status *statusError
+	switch {
+	case err == nil:
+	case errors.As(err, &status):
+		code = status.code
+	case errors.Is(err, context.Canceled):
+		code = codeCanceled
+	default:
+		code = codeUnknown
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if err != nil {
+		w.Header().Set("Grpc-Message", encodeStatusMessage(err.Error()))
+	}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) error {
+	if !strings.HasPrefix(r.URL.Path, service) {
+		return statusf(codeUnimplemented, "unknown service of %s", r.URL.Path)
+	}
+	method := strings.TrimPrefix(r.URL.Path, service)
+	msg, err := readMessage(r.Body)
+	if err != nil {
+		if errors.Is(err, errCompressed) {
+			return statusf(codeUnimplemented, "%v", err)
+		}
+		return statusf(codeInvalidArgument, "invalid request: %v", err)
+	}
+	req, err := decodeRequest(msg)
+	if err != nil {
+		return statusf(codeInvalidArgument, "invalid request: %v", err)
+	}
+	var encode func(ctx context.Context, header *types.Header) ([]byte, error)
+	switch method {
+	case "NewHeads":
+		encode = func(ctx context.Context, header *types.Header) ([]byte, error) {
+			return encodeHeader(header)
+		}
+	case "Receipts":
+		encode = func(ctx context.Context, header *types.Header) ([]byte, error) {
+			receipts, err := s.backend.Receipts(ctx, header)
+			if err != nil {
+				return nil, err
+			}
+			return encodeReceipts(header, receipts), nil
+		}
+	case "Traces":
+		encode = func(ctx context.Context, header *types.Header) ([]byte, error) {
+			result, err := s.backend.TraceBlock(ctx, header, req.tracer, req.tracerConfig)
+			if err != nil {
+				return nil, err
+			}
+			return encodeTraces(header, result), nil
+		}
+	case "StateDiffs":
+		encode = func(ctx context.Context, header *types.Header) ([]byte, error) {
+			diff, err := s.backend.StateDiff(header)
+			if err != nil {
+				log.Debug("State diff unavailable", "number", header.Number, "hash", header.Hash(), "err", err)
+				diff = nil
+			}
+			return encodeStateDiff(header, diff), nil
+		}
+	default:
+		return statusf(codeUnimplemented, "unknown method %s", method)
+	}
+	if s.streams != nil {
+		select {
+		case s.streams <- struct{}{}:
+			defer func() { <-s.streams }()
+		default:
+			rejectionsMeter.Mark(1)
+			return statusf(codeResourceExhausted, "too many streams, the limit is %d", s.config.MaxStreams)
+		}
+	}
+	streamsGauge.Inc(1)
+	defer streamsGauge.Dec(1)
+
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	return s.follow(r.Context(), req.start, func(header *types.Header) error {
+		msg, err := encode(r.Context(), header)
+		if err != nil {
+			return statusf(codeInternal, "block %d: %v", header.Number, err)
+		}
+		if err := writeMessage(w, msg); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		messagesMeter.Mark(1)
+		return nil
+	})
+}
+
+// follow calls emit on the canonical headers from the start block (the current
+// head if zero) until the context is cancelled, following the chain. On reorgs,
+// it rewinds to the last block still canonical, so that every header emitted is
+// the child of the previous one or of one emitted earlier.
+func (s *Server) follow(ctx context.Context, start uint64, emit func(*types.Header) error) error {
+	heads := make(chan *types.Header, 16)
+	sub := s.backend.SubscribeNewHeads(heads)
+	defer sub.Unsubscribe()
+
+	// Drain the heads apart from streaming, not to hold up the chain feed
+	wake := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case <-heads:
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			case <-sub.Err():
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	next := start
+	if next == 0 {
+		next = s.backend.CurrentHeader().Number.Uint64()
+	}
+	streamed := make(map[uint64]common.Hash)
+	for {
+		for head := s.backend.CurrentHeader().Number.Uint64(); next <= head; {
+			header := s.backend.HeaderByNumber(next)
+			if header == nil {
+				break
+			}
+			if parent, ok := streamed[next-1]; ok && next > 0 && header.ParentHash != parent {
+				next--
+				delete(streamed, next)
+				continue
+			}
+			if err := emit(header); err != nil {
+				return err
+			}
+			streamed[next] = header.Hash()
+			delete(streamed, next-reorgHistory)
+			next++
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-wake:
+		case <-time.After(time.Second):
+		case err := <-sub.Err():
+			if err == nil {
+				return statusf(codeCanceled, "server stopped")
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
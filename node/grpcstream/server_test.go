@@ -0,0 +1,202 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package grpcstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/event"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var big1 = big.NewInt(1)
+
+type testBackend struct {
+	lock  sync.Mutex
+	chain []*types.Header
+	feed  event.Feed
+}
+
+func (b *testBackend) CurrentHeader() *types.Header {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.chain[len(b.chain)-1]
+}
+
+func (b *testBackend) HeaderByNumber(number uint64) *types.Header {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if number >= uint64(len(b.chain)) {
+		return nil
+	}
+	return b.chain[number]
+}
+
+func (b *testBackend) SubscribeNewHeads(ch chan<- *types.Header) event.Subscription {
+	return b.feed.Subscribe(ch)
+}
+
+func (b *testBackend) Receipts(ctx context.Context, header *types.Header) (types.Receipts, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (b *testBackend) TraceBlock(ctx context.Context, header *types.Header, tracer string, config json.RawMessage) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (b *testBackend) StateDiff(header *types.Header) (*StateDiff, error) {
+	return nil, errors.New("not implemented")
+}
+
+// extend replaces the chain above the given number with n new headers, tagged
+// so that they differ from the replaced ones.
+func (b *testBackend) extend(number uint64, n int, tag byte) {
+	b.lock.Lock()
+	b.chain = b.chain[:number+1]
+	for i := 0; i < n; i++ {
+		parent := b.chain[len(b.chain)-1]
+		b.chain = append(b.chain, &types.Header{
+			Number:     new(big.Int).Add(parent.Number, big1),
+			ParentHash: parent.Hash(),
+			Extra:      []byte{tag},
+			Difficulty: big1,
+		})
+	}
+	head := b.chain[len(b.chain)-1]
+	b.lock.Unlock()
+	b.feed.Send(head)
+}
+
+// readHeader reads a streamed Header message, returning its number and hash.
+func readHeader(t *testing.T, body io.Reader) (uint64, []byte) {
+	t.Helper()
+	msg, err := readMessage(body)
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	var (
+		number uint64
+		hash   []byte
+	)
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		msg = msg[n:]
+		switch num {
+		case 1:
+			number, n = protowire.ConsumeVarint(msg)
+		case 2:
+			hash, n = protowire.ConsumeBytes(msg)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			t.Fatalf("invalid message: %v", protowire.ParseError(n))
+		}
+		msg = msg[n:]
+	}
+	return number, hash
+}
+
+func call(t *testing.T, ctx context.Context, addr net.Addr, method string, req []byte) *http.Response {
+	t.Helper()
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	var body bytes.Buffer
+	writeMessage(&body, req)
+	httpReq, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr.String()+service+method, &body)
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	res, err := client.Do(httpReq)
+	if err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	return res
+}
+
+// Tests that the heads are streamed from the start block, following the chain
+// and rewinding on reorgs.
+func TestNewHeads(t *testing.T) {
+	backend := &testBackend{chain: []*types.Header{{Number: new(big.Int), Difficulty: big1}}}
+	backend.extend(0, 3, 0)
+
+	server := New(Config{Addr: "127.0.0.1:0", MaxStreams: 1}, backend)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res := call(t, ctx, server.Addr(), "NewHeads", appendUint(nil, 1, 1))
+	defer res.Body.Close()
+
+	expect := func(from, to uint64) {
+		t.Helper()
+		for number := from; number <= to; number++ {
+			have, hash := readHeader(t, res.Body)
+			if have != number {
+				t.Fatalf("streamed number mismatch: have %d, want %d", have, number)
+			}
+			if want := backend.HeaderByNumber(number).Hash(); !bytes.Equal(hash, want[:]) {
+				t.Fatalf("streamed hash mismatch at %d: have %x, want %x", number, hash, want)
+			}
+		}
+	}
+	expect(1, 3)
+	backend.extend(3, 1, 0)
+	expect(4, 4)
+	backend.extend(2, 3, 1) // reorg of blocks 3 and 4
+	expect(3, 5)
+
+	// A second stream is rejected above the limit
+	rejected := call(t, ctx, server.Addr(), "NewHeads", nil)
+	rejected.Body.Close()
+	if status := rejected.Header.Get("Grpc-Status"); status != "8" {
+		t.Errorf("status mismatch above the stream limit: have %q, want 8", status)
+	}
+}
+
+// Tests that unknown methods are rejected with a trailers-only response.
+func TestUnknownMethod(t *testing.T) {
+	backend := &testBackend{chain: []*types.Header{{Number: new(big.Int), Difficulty: big1}}}
+	server := New(Config{Addr: "127.0.0.1:0"}, backend)
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	res := call(t, context.Background(), server.Addr(), "Blocks", nil)
+	res.Body.Close()
+	if status := res.Header.Get("Grpc-Status"); status != "12" {
+		t.Errorf("status mismatch: have %q, want 12", status)
+	}
+}
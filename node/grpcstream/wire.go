@@ -0,0 +1,250 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package grpcstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/rlp"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// gRPC status codes used by the server.
+const (
+	codeOK                = 0
+	codeCanceled          = 1
+	codeUnknown           = 2
+	codeInvalidArgument   = 3
+	codeResourceExhausted = 8
+	codeUnimplemented     = 12
+	codeInternal          = 13
+)
+
+// maxRequestSize is the largest request message accepted.
+const maxRequestSize = 1 << 20
+
+var errCompressed = errors.New("compressed messages not supported")
+
+// readMessage reads a length-prefixed gRPC message.
+func readMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errCompressed
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxRequestSize {
+		return nil, fmt.Errorf("request of %d bytes too large", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeMessage writes an uncompressed length-prefixed gRPC message.
+func writeMessage(w io.Writer, msg []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// encodeStatusMessage percent-encodes a status message as gRPC requires.
+func encodeStatusMessage(msg string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c >= 0x20 && c <= 0x7e && c != '%' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// request is the StreamRequest message.
+type request struct {
+	start        uint64
+	tracer       string
+	tracerConfig []byte
+}
+
+func decodeRequest(b []byte) (*request, error) {
+	req := new(request)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			req.start, n = protowire.ConsumeVarint(b)
+		case num == 2 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			req.tracer = string(v)
+		case num == 3 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			req.tracerConfig = common.CopyBytes(v)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return req, nil
+}
+
+func appendUint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendRepeated appends a repeated bytes field, empty elements included.
+func appendRepeated(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendBlock appends the block fields leading every streamed message.
+func appendBlock(b []byte, header *types.Header) []byte {
+	b = appendUint(b, 1, header.Number.Uint64())
+	b = appendBytes(b, 2, header.Hash().Bytes())
+	return appendBytes(b, 3, header.ParentHash.Bytes())
+}
+
+func encodeHeader(header *types.Header) ([]byte, error) {
+	blob, err := rlp.EncodeToBytes(header)
+	if err != nil {
+		return nil, err
+	}
+	return appendBytes(appendBlock(nil, header), 4, blob), nil
+}
+
+func encodeLog(l *types.Log) []byte {
+	b := appendBytes(nil, 1, l.Address.Bytes())
+	for _, topic := range l.Topics {
+		b = appendRepeated(b, 2, topic.Bytes())
+	}
+	b = appendBytes(b, 3, l.Data)
+	return appendUint(b, 4, uint64(l.Index))
+}
+
+func encodeReceipt(r *types.Receipt) []byte {
+	b := appendBytes(nil, 1, r.TxHash.Bytes())
+	b = appendUint(b, 2, uint64(r.Type))
+	b = appendUint(b, 3, r.Status)
+	b = appendUint(b, 4, r.CumulativeGasUsed)
+	b = appendUint(b, 5, r.GasUsed)
+	b = appendUint(b, 6, r.GasUsedForL1)
+	if r.ContractAddress != (common.Address{}) {
+		b = appendBytes(b, 7, r.ContractAddress.Bytes())
+	}
+	if r.EffectiveGasPrice != nil {
+		b = appendBytes(b, 8, r.EffectiveGasPrice.Bytes())
+	}
+	for _, l := range r.Logs {
+		b = appendRepeated(b, 9, encodeLog(l))
+	}
+	return b
+}
+
+func encodeReceipts(header *types.Header, receipts types.Receipts) []byte {
+	b := appendBlock(nil, header)
+	for _, r := range receipts {
+		b = appendRepeated(b, 4, encodeReceipt(r))
+	}
+	return b
+}
+
+func encodeTraces(header *types.Header, result []byte) []byte {
+	return appendBytes(appendBlock(nil, header), 4, result)
+}
+
+// StateDiff is the state written by a block, keyed by hash as in the snapshot.
+type StateDiff struct {
+	Destructs []common.Hash                          // Accounts deleted (and potentially recreated)
+	Accounts  map[common.Hash][]byte                 // Slim RLP of the accounts written, nil if deleted
+	Storage   map[common.Hash]map[common.Hash][]byte // RLP of the storage slots written, nil if deleted
+}
+
+func sortedHashes[V any](m map[common.Hash]V) []common.Hash {
+	hashes := make([]common.Hash, 0, len(m))
+	for hash := range m {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+	return hashes
+}
+
+// encodeStateDiff encodes the diff of a block, flagged incomplete if nil.
+func encodeStateDiff(header *types.Header, diff *StateDiff) []byte {
+	b := appendBlock(nil, header)
+	if diff == nil {
+		return protowire.AppendVarint(protowire.AppendTag(b, 6, protowire.VarintType), 1)
+	}
+	for _, hash := range diff.Destructs {
+		b = appendRepeated(b, 4, hash.Bytes())
+	}
+	accounts := make(map[common.Hash]struct{}, len(diff.Accounts))
+	for hash := range diff.Accounts {
+		accounts[hash] = struct{}{}
+	}
+	for hash := range diff.Storage {
+		accounts[hash] = struct{}{}
+	}
+	for _, hash := range sortedHashes(accounts) {
+		account := appendBytes(nil, 1, hash.Bytes())
+		account = appendBytes(account, 2, diff.Accounts[hash])
+		slots := diff.Storage[hash]
+		for _, slot := range sortedHashes(slots) {
+			entry := appendBytes(nil, 1, slot.Bytes())
+			account = appendRepeated(account, 3, appendBytes(entry, 2, slots[slot]))
+		}
+		b = appendRepeated(b, 5, account)
+	}
+	return b
+}
@@ -33,11 +33,13 @@ import (
 	"github.com/chainupcloud/arb-geth/common"
 	"github.com/chainupcloud/arb-geth/common/hexutil"
 	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
 	"github.com/chainupcloud/arb-geth/ethdb"
 	"github.com/chainupcloud/arb-geth/event"
 	"github.com/chainupcloud/arb-geth/log"
 	"github.com/chainupcloud/arb-geth/p2p"
 	"github.com/chainupcloud/arb-geth/rpc"
+	"github.com/chainupcloud/arb-geth/trie"
 	"github.com/gofrs/flock"
 )
 
@@ -784,6 +786,8 @@ func (n *Node) OpenDatabaseWithFreezer(name string, cache, handles int, ancient
 			Cache:             cache,
 			Handles:           handles,
 			ReadOnly:          readonly,
+			RemoteAncients:    n.config.RemoteAncients,
+			RemoteHasher:      func() types.TrieHasher { return trie.NewStackTrie(nil) },
 		})
 	}
 
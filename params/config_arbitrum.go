@@ -17,6 +17,8 @@
 package params
 
 import (
+	"errors"
+	"fmt"
 	"math/big"
 
 	"github.com/chainupcloud/arb-geth/common"
@@ -33,6 +35,34 @@ type ArbitrumChainParams struct {
 	MaxInitCodeSize           uint64 `json:"MaxInitCodeSize,omitempty"` // Maximum initcode to permit in a creation transaction and create instructions. 0 value implies params.MaxInitCodeSize
 }
 
+// ErrImmutableChainParam is returned when a runtime update of the Arbitrum chain
+// parameters changes one fixed by the genesis.
+var ErrImmutableChainParam = errors.New("chain parameter can't be updated at runtime")
+
+// CheckUpdate validates replacing the parameters with newParams on a running
+// chain. The parameters fixed by the genesis must stay the same, and the code
+// size limits consistent.
+func (p *ArbitrumChainParams) CheckUpdate(newParams *ArbitrumChainParams) error {
+	switch {
+	case newParams.EnableArbOS != p.EnableArbOS:
+		return fmt.Errorf("%w: EnableArbOS", ErrImmutableChainParam)
+	case newParams.GenesisBlockNum != p.GenesisBlockNum:
+		return fmt.Errorf("%w: GenesisBlockNum", ErrImmutableChainParam)
+	case newParams.InitialArbOSVersion != p.InitialArbOSVersion:
+		return fmt.Errorf("%w: InitialArbOSVersion", ErrImmutableChainParam)
+	case newParams.InitialChainOwner != p.InitialChainOwner:
+		return fmt.Errorf("%w: InitialChainOwner", ErrImmutableChainParam)
+	}
+	maxCodeSize := newParams.MaxCodeSize
+	if maxCodeSize == 0 {
+		maxCodeSize = MaxCodeSize
+	}
+	if newParams.MaxInitCodeSize != 0 && newParams.MaxInitCodeSize < maxCodeSize {
+		return fmt.Errorf("MaxInitCodeSize %d below MaxCodeSize %d", newParams.MaxInitCodeSize, maxCodeSize)
+	}
+	return nil
+}
+
 func (c *ChainConfig) IsArbitrum() bool {
 	return c.ArbitrumChainParams.EnableArbOS
 }
@@ -52,6 +52,60 @@ func TestClientRequest(t *testing.T) {
 	}
 }
 
+func TestClientMethodContext(t *testing.T) {
+	server := newTestServer()
+	defer server.Stop()
+	client := DialInProc(server)
+	defer client.Close()
+
+	var method string
+	if err := client.Call(&method, "test_method"); err != nil {
+		t.Fatal(err)
+	}
+	if method != "test_method" {
+		t.Errorf("incorrect method %q", method)
+	}
+}
+
+func TestClientCallObserver(t *testing.T) {
+	server := newTestServer()
+	defer server.Stop()
+	client := DialInProc(server)
+	defer client.Close()
+
+	var (
+		observed []string
+		errs     []error
+	)
+	SetCallObserver(func(ctx context.Context, method string, params json.RawMessage) (context.Context, func(error)) {
+		observed = append(observed, method+string(params))
+		return ctx, func(err error) { errs = append(errs, err) }
+	})
+	defer SetCallObserver(nil)
+
+	var result echoResult
+	if err := client.Call(&result, "test_echo", "x", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call(nil, "test_returnError"); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(observed) != 2 || observed[0] != `test_echo["x",1]` || observed[1] != "test_returnError" {
+		t.Fatalf("unexpected observed calls %q", observed)
+	}
+	if len(errs) != 2 || errs[0] != nil || errs[1] == nil {
+		t.Fatalf("unexpected observed errors %v", errs)
+	}
+	// Removed observers aren't called anymore
+	SetCallObserver(nil)
+	if err := client.Call(&result, "test_echo", "x", 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(observed) != 2 {
+		t.Fatalf("removed observer called")
+	}
+}
+
 func TestClientResponseType(t *testing.T) {
 	server := newTestServer()
 	defer server.Stop()
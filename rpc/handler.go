@@ -486,7 +486,9 @@ func (h *handler) handleCall(cp *callProc, msg *jsonrpcMessage) *jsonrpcMessage
 		return msg.errorResponse(&invalidParamsError{err.Error()})
 	}
 	start := time.Now()
+	serveLoad.begin()
 	answer := h.runMethod(cp.ctx, msg, callb, args)
+	serveLoad.end(time.Since(start))
 	// Collect the statistics for RPC calls if metrics is enabled.
 	// We only care about pure rpc call. Filter out subscription.
 	if callb != h.unsubscribeCb {
@@ -540,6 +542,13 @@ func (h *handler) handleSubscribe(cp *callProc, msg *jsonrpcMessage) *jsonrpcMes
 
 // runMethod runs the Go callback for an RPC method.
 func (h *handler) runMethod(ctx context.Context, msg *jsonrpcMessage, callb *callback, args []reflect.Value) *jsonrpcMessage {
+	ctx = context.WithValue(ctx, methodContextKey{}, msg.Method)
+	var err error
+	if observer := callObserver.Load(); observer != nil {
+		var done func(error)
+		ctx, done = (*observer)(ctx, msg.Method, msg.Params)
+		defer func() { done(err) }()
+	}
 	result, err := callb.call(ctx, msg.Method, args)
 	if err != nil {
 		return msg.errorResponse(err)
@@ -0,0 +1,108 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// loadSamples is the number of most recent calls the serving latency is
+	// tracked over.
+	loadSamples = 1024
+
+	// loadWindow is the age past which calls no longer count towards the latency.
+	loadWindow = 10 * time.Second
+)
+
+// serveLoad tracks the load of all the servers of the process, regardless of
+// whether metrics are enabled.
+var serveLoad = newLoadTracker(time.Now)
+
+// LoadStats is a summary of the load of the RPC servers.
+type LoadStats struct {
+	InFlight   int64         // Number of method calls being served
+	Calls      int           // Number of recent calls the latency is computed over
+	LatencyP99 time.Duration // 99th percentile of the serving time of the recent calls
+}
+
+// Load returns the current load of the RPC servers of the process, which lets
+// background work yield to the RPC traffic.
+func Load() LoadStats {
+	return serveLoad.stats()
+}
+
+type loadSample struct {
+	at      time.Time
+	elapsed time.Duration
+}
+
+// loadTracker counts the calls in flight and keeps a ring of the serving times
+// of the most recent ones.
+type loadTracker struct {
+	inFlight atomic.Int64
+	now      func() time.Time
+
+	lock    sync.Mutex
+	samples [loadSamples]loadSample
+	next    int
+}
+
+func newLoadTracker(now func() time.Time) *loadTracker {
+	return &loadTracker{now: now}
+}
+
+// begin marks the start of serving a call.
+func (t *loadTracker) begin() {
+	t.inFlight.Add(1)
+}
+
+// end marks the end of serving a call, which took the given time.
+func (t *loadTracker) end(elapsed time.Duration) {
+	t.inFlight.Add(-1)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.samples[t.next] = loadSample{at: t.now(), elapsed: elapsed}
+	t.next = (t.next + 1) % loadSamples
+}
+
+func (t *loadTracker) stats() LoadStats {
+	stats := LoadStats{InFlight: t.inFlight.Load()}
+
+	t.lock.Lock()
+	cutoff := t.now().Add(-loadWindow)
+	recent := make([]time.Duration, 0, loadSamples)
+	for _, sample := range t.samples {
+		if sample.at.After(cutoff) {
+			recent = append(recent, sample.elapsed)
+		}
+	}
+	t.lock.Unlock()
+
+	if len(recent) == 0 {
+		return stats
+	}
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	stats.Calls = len(recent)
+	stats.LatencyP99 = recent[(len(recent)*99+99)/100-1]
+	return stats
+}
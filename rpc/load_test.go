@@ -0,0 +1,54 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadTracker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := newLoadTracker(func() time.Time { return now })
+
+	if stats := tracker.stats(); stats != (LoadStats{}) {
+		t.Fatalf("idle tracker: have %+v", stats)
+	}
+	// 200 calls of 1ms to 200ms, the slowest 2 exceed the 99th percentile
+	for i := 1; i <= 200; i++ {
+		tracker.begin()
+		tracker.end(time.Duration(i) * time.Millisecond)
+	}
+	tracker.begin()
+	stats := tracker.stats()
+	if stats.InFlight != 1 || stats.Calls != 200 || stats.LatencyP99 != 198*time.Millisecond {
+		t.Fatalf("loaded tracker: have %+v", stats)
+	}
+	// Only the most recent calls are tracked
+	for i := 0; i < loadSamples; i++ {
+		tracker.begin()
+		tracker.end(time.Millisecond)
+	}
+	if stats := tracker.stats(); stats.Calls != loadSamples || stats.LatencyP99 != time.Millisecond {
+		t.Fatalf("overwritten tracker: have %+v", stats)
+	}
+	// Calls older than the window are forgotten
+	now = now.Add(loadWindow)
+	if stats := tracker.stats(); stats.InFlight != 1 || stats.Calls != 0 || stats.LatencyP99 != 0 {
+		t.Fatalf("expired tracker: have %+v", stats)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+)
+
+// CallObserver is called before serving a method call with its raw params. It
+// returns the context to serve the call with, which lets the observer attach
+// call-scoped state to it, and a function called once the call is served with
+// its error, if any.
+type CallObserver func(ctx context.Context, method string, params json.RawMessage) (context.Context, func(err error))
+
+// callObserver observes the calls of all the servers of the process.
+var callObserver atomic.Pointer[CallObserver]
+
+// SetCallObserver installs the observer of the method calls served by all the
+// RPC servers of the process, nil to remove it.
+func SetCallObserver(observer CallObserver) {
+	if observer == nil {
+		callObserver.Store(nil)
+		return
+	}
+	callObserver.Store(&observer)
+}
@@ -195,6 +195,10 @@ type PeerInfo struct {
 		UserAgent string
 		Origin    string
 		Host      string
+		// Value of the X-Api-Key header, identifying the client to the quotas.
+		APIKey string
+		// Value of the X-Forwarded-For header, set by the proxies in front.
+		ForwardedFor string
 	}
 }
 
@@ -208,3 +212,14 @@ func PeerInfoFromContext(ctx context.Context) PeerInfo {
 	info, _ := ctx.Value(peerInfoContextKey{}).(PeerInfo)
 	return info
 }
+
+type methodContextKey struct{}
+
+// MethodFromContext returns the name of the RPC method being served, e.g.
+// "eth_call". Use this with the context passed to RPC method handler functions.
+//
+// The empty string is returned outside of method calls.
+func MethodFromContext(ctx context.Context) string {
+	method, _ := ctx.Value(methodContextKey{}).(string)
+	return method
+}
@@ -17,9 +17,15 @@
 package trie
 
 import (
+	"fmt"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
 	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
 	"github.com/chainupcloud/arb-geth/ethdb"
 	"github.com/chainupcloud/arb-geth/trie/triedb/hashdb"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
 )
 
 // newTestDatabase initializes the trie database with specified scheme.
@@ -33,3 +39,36 @@ func newTestDatabase(diskdb ethdb.Database, scheme string) *Database {
 	//}
 	return db
 }
+
+// Tests that the nodes of a storage trie identical to a persisted one are only
+// cached and written again if deduplication is disabled.
+func TestDedupNodes(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		db := NewDatabaseWithConfig(rawdb.NewMemoryDatabase(), &Config{DedupNodes: dedup})
+		update := func(owner common.Hash) common.Hash {
+			tr, _ := New(StorageTrieID(types.EmptyRootHash, owner, types.EmptyRootHash), db)
+			for i := byte(0); i < 16; i++ {
+				tr.MustUpdate(common.Hash{i}.Bytes(), []byte(fmt.Sprintf("value-%d", i)))
+			}
+			root, set := tr.Commit(false)
+			if err := db.Update(root, types.EmptyRootHash, trienode.NewWithNodeSet(set)); err != nil {
+				t.Fatalf("failed to update database: %v", err)
+			}
+			return root
+		}
+		root := update(common.HexToHash("0x01"))
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("failed to commit database: %v", err)
+		}
+		if clone := update(common.HexToHash("0x02")); clone != root {
+			t.Fatalf("clone root mismatch: have %x, want %x", clone, root)
+		}
+		dirty, _ := db.Size()
+		if dedup && dirty != 0 {
+			t.Errorf("persisted nodes cached again: %v", dirty)
+		}
+		if !dedup && dirty == 0 {
+			t.Errorf("nodes not cached without deduplication")
+		}
+	}
+}
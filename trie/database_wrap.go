@@ -23,7 +23,9 @@ import (
 
 	"github.com/VictoriaMetrics/fastcache"
 	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
 	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/event"
 	"github.com/chainupcloud/arb-geth/log"
 	"github.com/chainupcloud/arb-geth/trie/triedb/hashdb"
 	"github.com/chainupcloud/arb-geth/trie/trienode"
@@ -31,9 +33,11 @@ import (
 
 // Config defines all necessary options for database.
 type Config struct {
-	Cache     int    // Memory allowance (MB) to use for caching trie nodes in memory
-	Journal   string // Journal of clean cache to survive node restarts
-	Preimages bool   // Flag whether the preimage of trie key is recorded
+	Cache           int             // Memory allowance (MB) to use for caching trie nodes in memory
+	Journal         string          // Journal of clean cache to survive node restarts
+	Preimages       bool            // Flag whether the preimage of trie key is recorded
+	PreimageBackend PreimageBackend // Store the preimages are recorded to, the disk database if nil
+	DedupNodes      bool            // Skip writing the storage trie nodes already persisted (hash scheme only)
 }
 
 // backend defines the methods needed to access/update trie nodes in different
@@ -72,6 +76,16 @@ type Database struct {
 	cleans    *fastcache.Cache // Megabytes permitted using for read caches
 	preimages *preimageStore   // The store for caching preimages
 	backend   backend          // The backend for managing trie nodes
+
+	updateFeed event.Feed // Feed of the state transitions committed by Update
+}
+
+// UpdateEvent is posted when the dirty nodes of a state transition are committed
+// into the database.
+type UpdateEvent struct {
+	Root   common.Hash
+	Parent common.Hash
+	Nodes  *trienode.MergedNodeSet // Shared with the database, must not be modified
 }
 
 // prepare initializes the database with provided configs, but the
@@ -88,7 +102,11 @@ func prepare(diskdb ethdb.Database, config *Config) *Database {
 	}
 	var preimages *preimageStore
 	if config != nil && config.Preimages {
-		preimages = newPreimageStore(diskdb)
+		backend := config.PreimageBackend
+		if backend == nil {
+			backend = NewKeyValuePreimages(diskdb)
+		}
+		preimages = newPreimageStore(backend)
 	}
 	return &Database{
 		config:    config,
@@ -116,7 +134,11 @@ func NewDatabase(diskdb ethdb.Database) *Database {
 // hash-based scheme by default.
 func NewDatabaseWithConfig(diskdb ethdb.Database, config *Config) *Database {
 	db := prepare(diskdb, config)
-	db.backend = hashdb.New(diskdb, db.cleans, mptResolver{})
+	hdb := hashdb.New(diskdb, db.cleans, mptResolver{})
+	if config != nil && config.DedupNodes {
+		hdb.SetDedup(true)
+	}
+	db.backend = hdb
 	return db
 }
 
@@ -134,7 +156,18 @@ func (db *Database) Update(root common.Hash, parent common.Hash, nodes *trienode
 	if db.preimages != nil {
 		db.preimages.commit(false)
 	}
-	return db.backend.Update(root, parent, nodes)
+	if err := db.backend.Update(root, parent, nodes); err != nil {
+		return err
+	}
+	db.updateFeed.Send(UpdateEvent{Root: root, Parent: parent, Nodes: nodes})
+	return nil
+}
+
+// SubscribeUpdates registers a subscription of the state transitions committed
+// into the database. The events are delivered synchronously by Update, so the
+// subscribers must keep up with the state commits.
+func (db *Database) SubscribeUpdates(ch chan<- UpdateEvent) event.Subscription {
+	return db.updateFeed.Subscribe(ch)
 }
 
 // Commit iterates over all the children of a particular node, writes them out
@@ -161,6 +194,35 @@ func (db *Database) Size() (common.StorageSize, common.StorageSize) {
 	return storages, preimages
 }
 
+// Preimage retrieves the preimage of a trie key hash from the recorded preimages,
+// or from the disk database if recording is disabled.
+func (db *Database) Preimage(hash common.Hash) []byte {
+	if db.preimages != nil {
+		return db.preimages.preimage(hash)
+	}
+	return rawdb.ReadPreimage(db.diskdb, hash)
+}
+
+// InsertPreimages records a batch of preimages learnt outside of the tries, such
+// as during sync. It's a noop if recording is disabled. The slices are not
+// copied and must not be changed afterwards.
+func (db *Database) InsertPreimages(preimages map[common.Hash][]byte) error {
+	if db.preimages == nil || len(preimages) == 0 {
+		return nil
+	}
+	db.preimages.insertPreimage(preimages)
+	return db.preimages.commit(false)
+}
+
+// PreimageBackend returns the store the preimages are recorded to, nil if the
+// recording is disabled.
+func (db *Database) PreimageBackend() PreimageBackend {
+	if db.preimages == nil {
+		return nil
+	}
+	return db.preimages.backend
+}
+
 // Initialized returns an indicator if the state data is already initialized
 // according to the state scheme.
 func (db *Database) Initialized(genesisRoot common.Hash) bool {
@@ -0,0 +1,231 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// DiffKind tells how an account or a storage slot differs between two states.
+type DiffKind uint8
+
+const (
+	DiffCreated DiffKind = iota // Present in the second state only
+	DiffUpdated                 // Present in both states, with different values
+	DiffDeleted                 // Present in the first state only
+)
+
+// String implements fmt.Stringer.
+func (k DiffKind) String() string {
+	switch k {
+	case DiffCreated:
+		return "created"
+	case DiffUpdated:
+		return "updated"
+	case DiffDeleted:
+		return "deleted"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(k))
+	}
+}
+
+// AccountDiff is an account differing between two states.
+type AccountDiff struct {
+	Kind DiffKind
+	Hash common.Hash         // Hash of the account address
+	Prev *types.StateAccount // Account in the first state, nil if created
+	Post *types.StateAccount // Account in the second state, nil if deleted
+}
+
+// StorageDiff is a storage slot differing between two states.
+type StorageDiff struct {
+	Kind    DiffKind
+	Account common.Hash // Hash of the owning account address
+	Slot    common.Hash // Hash of the slot key
+	Prev    []byte      // RLP encoded value in the first state, nil if created
+	Post    []byte      // RLP encoded value in the second state, nil if deleted
+}
+
+// StateDiff holds all the differences between two states.
+type StateDiff struct {
+	Accounts []*AccountDiff
+	Storage  []*StorageDiff
+}
+
+// Diff computes the accounts and storage slots differing between the states with
+// the given roots. All the differences are gathered in memory, use DiffStream to
+// process them as they are found.
+func Diff(db *Database, rootA, rootB common.Hash) (*StateDiff, error) {
+	diff := new(StateDiff)
+	err := DiffStream(db, rootA, rootB, func(account *AccountDiff) error {
+		diff.Accounts = append(diff.Accounts, account)
+		return nil
+	}, func(slot *StorageDiff) error {
+		diff.Storage = append(diff.Storage, slot)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// DiffStream walks the tries of the states with the given roots in lockstep and
+// calls onAccount for every differing account, followed by onStorage for every
+// differing slot of its storage. The subtries shared by both states are skipped
+// without being resolved, so the cost is proportional to the size of the diff
+// rather than of the states. Either callback may be nil, the storage tries aren't
+// walked if onStorage is. An error returned by a callback aborts the walk.
+func DiffStream(db *Database, rootA, rootB common.Hash, onAccount func(*AccountDiff) error, onStorage func(*StorageDiff) error) error {
+	trA, err := New(StateTrieID(rootA), db)
+	if err != nil {
+		return err
+	}
+	trB, err := New(StateTrieID(rootB), db)
+	if err != nil {
+		return err
+	}
+	return diffLeaves(trA.NodeIterator(nil), trB.NodeIterator(nil), func(key, prev, post []byte) error {
+		account := &AccountDiff{Hash: common.BytesToHash(key)}
+		if prev != nil {
+			account.Prev = new(types.StateAccount)
+			if err := rlp.DecodeBytes(prev, account.Prev); err != nil {
+				return fmt.Errorf("invalid account %x in state %x: %w", key, rootA, err)
+			}
+		}
+		if post != nil {
+			account.Post = new(types.StateAccount)
+			if err := rlp.DecodeBytes(post, account.Post); err != nil {
+				return fmt.Errorf("invalid account %x in state %x: %w", key, rootB, err)
+			}
+		}
+		storageA, storageB := types.EmptyRootHash, types.EmptyRootHash
+		switch {
+		case prev == nil:
+			account.Kind = DiffCreated
+			storageB = account.Post.Root
+		case post == nil:
+			account.Kind = DiffDeleted
+			storageA = account.Prev.Root
+		default:
+			account.Kind = DiffUpdated
+			storageA, storageB = account.Prev.Root, account.Post.Root
+		}
+		if onAccount != nil {
+			if err := onAccount(account); err != nil {
+				return err
+			}
+		}
+		if onStorage == nil || storageA == storageB {
+			return nil
+		}
+		return diffStorage(db, rootA, rootB, account.Hash, storageA, storageB, onStorage)
+	})
+}
+
+// diffStorage walks the two storage tries of the account in lockstep, calling
+// onStorage for every differing slot.
+func diffStorage(db *Database, stateA, stateB, owner, rootA, rootB common.Hash, onStorage func(*StorageDiff) error) error {
+	trA, err := New(StorageTrieID(stateA, owner, rootA), db)
+	if err != nil {
+		return err
+	}
+	trB, err := New(StorageTrieID(stateB, owner, rootB), db)
+	if err != nil {
+		return err
+	}
+	return diffLeaves(trA.NodeIterator(nil), trB.NodeIterator(nil), func(key, prev, post []byte) error {
+		slot := &StorageDiff{
+			Account: owner,
+			Slot:    common.BytesToHash(key),
+			Prev:    prev,
+			Post:    post,
+		}
+		switch {
+		case prev == nil:
+			slot.Kind = DiffCreated
+		case post == nil:
+			slot.Kind = DiffDeleted
+		default:
+			slot.Kind = DiffUpdated
+		}
+		return onStorage(slot)
+	})
+}
+
+// diffLeaves advances the two node iterators in lockstep, skipping the subtries
+// with the same hash, and calls onLeaf with the key and both values of every
+// leaf differing between them, in key order. The value missing from one of the
+// tries is nil.
+func diffLeaves(a, b NodeIterator, onLeaf func(key, prev, post []byte) error) error {
+	aOk, bOk := a.Next(true), b.Next(true)
+	for aOk || bOk {
+		var cmp int
+		switch {
+		case !aOk:
+			cmp = 1
+		case !bOk:
+			cmp = -1
+		default:
+			cmp = bytes.Compare(a.Path(), b.Path())
+		}
+		switch {
+		case cmp < 0:
+			// The node only exists in the first trie
+			if a.Leaf() {
+				if err := onLeaf(a.LeafKey(), common.CopyBytes(a.LeafBlob()), nil); err != nil {
+					return err
+				}
+			}
+			aOk = a.Next(true)
+
+		case cmp > 0:
+			// The node only exists in the second trie
+			if b.Leaf() {
+				if err := onLeaf(b.LeafKey(), nil, common.CopyBytes(b.LeafBlob())); err != nil {
+					return err
+				}
+			}
+			bOk = b.Next(true)
+
+		default:
+			// The node exists in both tries. Leaf paths end with the terminator,
+			// so either both are leaves or none is.
+			if a.Leaf() {
+				if prev, post := a.LeafBlob(), b.LeafBlob(); !bytes.Equal(prev, post) {
+					if err := onLeaf(a.LeafKey(), common.CopyBytes(prev), common.CopyBytes(post)); err != nil {
+						return err
+					}
+				}
+				aOk, bOk = a.Next(true), b.Next(true)
+				continue
+			}
+			// Skip the subtrie if shared, embedded nodes have no hash to compare
+			descend := a.Hash() == (common.Hash{}) || a.Hash() != b.Hash()
+			aOk, bOk = a.Next(descend), b.Next(descend)
+		}
+	}
+	if err := a.Error(); err != nil {
+		return err
+	}
+	return b.Error()
+}
@@ -0,0 +1,252 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/rlp"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+)
+
+type diffTestAccount struct {
+	nonce   uint64
+	storage map[common.Hash][]byte
+}
+
+// makeDiffTestState commits the given accounts, keyed by hash, into the database
+// and returns the state root.
+func makeDiffTestState(t *testing.T, db *Database, accounts map[common.Hash]*diffTestAccount) common.Hash {
+	nodes := trienode.NewMergedNodeSet()
+	accTrie := NewEmpty(db)
+	for hash, acc := range accounts {
+		root := types.EmptyRootHash
+		if len(acc.storage) > 0 {
+			storageTrie, _ := New(StorageTrieID(types.EmptyRootHash, hash, types.EmptyRootHash), db)
+			for slot, value := range acc.storage {
+				storageTrie.MustUpdate(slot[:], value)
+			}
+			var set *trienode.NodeSet
+			root, set = storageTrie.Commit(false)
+			if err := nodes.Merge(set); err != nil {
+				t.Fatalf("failed to merge storage nodes: %v", err)
+			}
+		}
+		blob, _ := rlp.EncodeToBytes(&types.StateAccount{
+			Nonce:    acc.nonce,
+			Balance:  new(big.Int),
+			Root:     root,
+			CodeHash: types.EmptyCodeHash.Bytes(),
+		})
+		accTrie.MustUpdate(hash[:], blob)
+	}
+	root, set := accTrie.Commit(true)
+	if err := nodes.Merge(set); err != nil {
+		t.Fatalf("failed to merge account nodes: %v", err)
+	}
+	if err := db.Update(root, types.EmptyRootHash, nodes); err != nil {
+		t.Fatalf("failed to update database: %v", err)
+	}
+	return root
+}
+
+func copyDiffTestState(accounts map[common.Hash]*diffTestAccount) map[common.Hash]*diffTestAccount {
+	cpy := make(map[common.Hash]*diffTestAccount, len(accounts))
+	for hash, acc := range accounts {
+		storage := make(map[common.Hash][]byte, len(acc.storage))
+		for slot, value := range acc.storage {
+			storage[slot] = value
+		}
+		cpy[hash] = &diffTestAccount{nonce: acc.nonce, storage: storage}
+	}
+	return cpy
+}
+
+// Tests that the diff of two states reports exactly the accounts and slots that
+// were created, updated and deleted.
+func TestStateDiff(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+
+	before := make(map[common.Hash]*diffTestAccount)
+	for i := 0; i < 200; i++ {
+		acc := &diffTestAccount{nonce: uint64(i), storage: make(map[common.Hash][]byte)}
+		for j := 0; j < i%7; j++ {
+			acc.storage[crypto.Keccak256Hash([]byte{byte(i), byte(j)})] = []byte{byte(i), byte(j), 1}
+		}
+		before[crypto.Keccak256Hash([]byte{byte(i)})] = acc
+	}
+	after := copyDiffTestState(before)
+	for i := 0; i < 200; i += 10 {
+		hash := crypto.Keccak256Hash([]byte{byte(i)})
+		switch i % 40 {
+		case 0:
+			delete(after, hash) // deleted, along with any storage
+		case 10:
+			after[hash].nonce++ // updated account only
+		case 20:
+			for slot := range after[hash].storage {
+				after[hash].storage[slot] = []byte{2} // updated slots
+				break
+			}
+			after[hash].storage[crypto.Keccak256Hash([]byte{byte(i), 0xff})] = []byte{3} // created slot
+		case 30:
+			for slot := range after[hash].storage {
+				delete(after[hash].storage, slot) // deleted slots
+				break
+			}
+		}
+	}
+	for i := 200; i < 210; i++ {
+		after[crypto.Keccak256Hash([]byte{byte(i)})] = &diffTestAccount{
+			nonce:   1,
+			storage: map[common.Hash][]byte{{byte(i)}: {byte(i)}},
+		}
+	}
+	rootA := makeDiffTestState(t, db, before)
+	rootB := makeDiffTestState(t, db, after)
+
+	diff, err := Diff(db, rootA, rootB)
+	if err != nil {
+		t.Fatalf("failed to diff states: %v", err)
+	}
+	// Cross check the accounts against the expected changes
+	accounts := make(map[common.Hash]*AccountDiff)
+	for _, account := range diff.Accounts {
+		accounts[account.Hash] = account
+	}
+	for hash, prev := range before {
+		post, ok := after[hash]
+		account := accounts[hash]
+		switch {
+		case !ok:
+			if account == nil || account.Kind != DiffDeleted || account.Prev.Nonce != prev.nonce || account.Post != nil {
+				t.Errorf("account %x: want deleted, have %+v", hash, account)
+			}
+		case !equalDiffTestAccounts(prev, post):
+			if account == nil || account.Kind != DiffUpdated || account.Prev.Nonce != prev.nonce || account.Post.Nonce != post.nonce {
+				t.Errorf("account %x: want updated, have %+v", hash, account)
+			}
+		default:
+			if account != nil {
+				t.Errorf("account %x: want unchanged, have %+v", hash, account)
+			}
+		}
+		delete(accounts, hash)
+	}
+	for hash := range after {
+		if _, ok := before[hash]; ok {
+			continue
+		}
+		if account := accounts[hash]; account == nil || account.Kind != DiffCreated || account.Prev != nil {
+			t.Errorf("account %x: want created, have %+v", hash, account)
+		}
+		delete(accounts, hash)
+	}
+	if len(accounts) != 0 {
+		t.Errorf("unexpected account diffs: %d", len(accounts))
+	}
+	// Cross check the storage slots against the expected changes
+	slots := make(map[[2]common.Hash]*StorageDiff)
+	for _, slot := range diff.Storage {
+		slots[[2]common.Hash{slot.Account, slot.Slot}] = slot
+	}
+	for hash := range mergeDiffTestKeys(before, after) {
+		var prevStorage, postStorage map[common.Hash][]byte
+		if acc := before[hash]; acc != nil {
+			prevStorage = acc.storage
+		}
+		if acc := after[hash]; acc != nil {
+			postStorage = acc.storage
+		}
+		for slot, prev := range prevStorage {
+			post, ok := postStorage[slot]
+			have := slots[[2]common.Hash{hash, slot}]
+			switch {
+			case !ok:
+				if have == nil || have.Kind != DiffDeleted || !bytes.Equal(have.Prev, prev) || have.Post != nil {
+					t.Errorf("slot %x/%x: want deleted, have %+v", hash, slot, have)
+				}
+			case !bytes.Equal(prev, post):
+				if have == nil || have.Kind != DiffUpdated || !bytes.Equal(have.Prev, prev) || !bytes.Equal(have.Post, post) {
+					t.Errorf("slot %x/%x: want updated, have %+v", hash, slot, have)
+				}
+			default:
+				if have != nil {
+					t.Errorf("slot %x/%x: want unchanged, have %+v", hash, slot, have)
+				}
+			}
+			delete(slots, [2]common.Hash{hash, slot})
+		}
+		for slot, post := range postStorage {
+			if _, ok := prevStorage[slot]; ok {
+				continue
+			}
+			have := slots[[2]common.Hash{hash, slot}]
+			if have == nil || have.Kind != DiffCreated || have.Prev != nil || !bytes.Equal(have.Post, post) {
+				t.Errorf("slot %x/%x: want created, have %+v", hash, slot, have)
+			}
+			delete(slots, [2]common.Hash{hash, slot})
+		}
+	}
+	if len(slots) != 0 {
+		t.Errorf("unexpected storage diffs: %d", len(slots))
+	}
+	// Diffing a state against itself yields nothing
+	if diff, err := Diff(db, rootA, rootA); err != nil || len(diff.Accounts)+len(diff.Storage) != 0 {
+		t.Errorf("self diff: have %d accounts, %d slots, err %v", len(diff.Accounts), len(diff.Storage), err)
+	}
+	// An error returned by a callback aborts the walk
+	errAbort := errors.New("abort")
+	var seen int
+	err = DiffStream(db, rootA, rootB, func(*AccountDiff) error {
+		seen++
+		return errAbort
+	}, nil)
+	if err != errAbort || seen != 1 {
+		t.Errorf("stream not aborted: err %v, accounts seen %d", err, seen)
+	}
+}
+
+func equalDiffTestAccounts(a, b *diffTestAccount) bool {
+	if a.nonce != b.nonce || len(a.storage) != len(b.storage) {
+		return false
+	}
+	for slot, value := range a.storage {
+		if !bytes.Equal(value, b.storage[slot]) {
+			return false
+		}
+	}
+	return true
+}
+
+func mergeDiffTestKeys(a, b map[common.Hash]*diffTestAccount) map[common.Hash]struct{} {
+	keys := make(map[common.Hash]struct{})
+	for hash := range a {
+		keys[hash] = struct{}{}
+	}
+	for hash := range b {
+		keys[hash] = struct{}{}
+	}
+	return keys
+}
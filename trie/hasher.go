@@ -19,18 +19,50 @@ package trie
 import (
 	"sync"
 
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
 	"github.com/chainupcloud/arb-geth/crypto"
 	"github.com/chainupcloud/arb-geth/rlp"
 	"golang.org/x/crypto/sha3"
 )
 
+// NodeHasher is an alternative hash function for the trie nodes, replacing
+// keccak256 so that the hashing of proving systems, such as domain-separated
+// hashing, can be checked against the same trie logic. The keys of the secure
+// tries are still hashed with keccak256.
+//
+// HashNode must be safe for concurrent use, as the trie hashes its subtries in
+// parallel.
+type NodeHasher interface {
+	HashNode(enc []byte) common.Hash
+}
+
+// KeccakNodeHasher is the NodeHasher matching the default hashing of the trie
+// nodes.
+type KeccakNodeHasher struct{}
+
+// HashNode implements NodeHasher.
+func (KeccakNodeHasher) HashNode(enc []byte) common.Hash {
+	return crypto.Keccak256Hash(enc)
+}
+
+// emptyRoot returns the root hash of an empty trie under the node hasher, which
+// is the hash of the encoding of an empty node.
+func emptyRoot(nodeHasher NodeHasher) common.Hash {
+	if nodeHasher == nil {
+		return types.EmptyRootHash
+	}
+	return nodeHasher.HashNode(rlp.EmptyString)
+}
+
 // hasher is a type used for the trie Hash operation. A hasher has some
 // internal preallocated temp space
 type hasher struct {
 	sha      crypto.KeccakState
 	tmp      []byte
 	encbuf   rlp.EncoderBuffer
-	parallel bool // Whether to use parallel threads when hashing
+	parallel bool       // Whether to use parallel threads when hashing
+	custom   NodeHasher // Hash function replacing keccak256, if any
 }
 
 // hasherPool holds pureHashers
@@ -50,7 +82,16 @@ func newHasher(parallel bool) *hasher {
 	return h
 }
 
+// newCustomHasher returns a hasher hashing the nodes with the node hasher, or
+// with keccak256 if it's nil.
+func newCustomHasher(parallel bool, nodeHasher NodeHasher) *hasher {
+	h := newHasher(parallel)
+	h.custom = nodeHasher
+	return h
+}
+
 func returnHasherToPool(h *hasher) {
+	h.custom = nil
 	hasherPool.Put(h)
 }
 
@@ -116,7 +157,7 @@ func (h *hasher) hashFullNodeChildren(n *fullNode) (collapsed *fullNode, cached
 		wg.Add(16)
 		for i := 0; i < 16; i++ {
 			go func(i int) {
-				hasher := newHasher(false)
+				hasher := newCustomHasher(false, h.custom)
 				if child := n.Children[i]; child != nil {
 					collapsed.Children[i], cached.Children[i] = hasher.hash(child, false)
 				} else {
@@ -183,6 +224,10 @@ func (h *hasher) encodedBytes() []byte {
 
 // hashData hashes the provided data
 func (h *hasher) hashData(data []byte) hashNode {
+	if h.custom != nil {
+		hash := h.custom.HashNode(data)
+		return hash.Bytes()
+	}
 	n := make(hashNode, 32)
 	h.sha.Reset()
 	h.sha.Write(data)
@@ -0,0 +1,178 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/ethdb/memorydb"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+)
+
+// domainHasher hashes the nodes with keccak256 under a domain separation tag.
+type domainHasher []byte
+
+func (h domainHasher) HashNode(enc []byte) common.Hash {
+	return crypto.Keccak256Hash(h, enc)
+}
+
+// fillHasherTrie inserts enough entries into the trie for the parallel hashing
+// of its subtries to kick in.
+func fillHasherTrie(tr *Trie) {
+	for i := 0; i < 500; i++ {
+		tr.MustUpdate(crypto.Keccak256([]byte(fmt.Sprint(i))), []byte(fmt.Sprintf("value-%d", i)))
+	}
+}
+
+// Tests that hashing the nodes with an explicit keccak256 node hasher produces
+// the same roots, nodes and proofs as the default hashing.
+func TestKeccakNodeHasher(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+	if root := emptyRoot(KeccakNodeHasher{}); root != types.EmptyRootHash {
+		t.Fatalf("empty root mismatch: have %x, want %x", root, types.EmptyRootHash)
+	}
+	def := NewEmpty(db)
+	custom, _ := NewWithHasher(TrieID(types.EmptyRootHash), db, KeccakNodeHasher{})
+	fillHasherTrie(def)
+	fillHasherTrie(custom)
+
+	key := crypto.Keccak256([]byte("7"))
+	defProof, customProof := memorydb.New(), memorydb.New()
+	if err := def.Prove(key, 0, defProof); err != nil {
+		t.Fatalf("failed to prove: %v", err)
+	}
+	if err := custom.Prove(key, 0, customProof); err != nil {
+		t.Fatalf("failed to prove with node hasher: %v", err)
+	}
+	if defProof.Len() != customProof.Len() {
+		t.Fatalf("proof size mismatch: have %d, want %d", customProof.Len(), defProof.Len())
+	}
+	it := defProof.NewIterator(nil, nil)
+	for it.Next() {
+		if have, _ := customProof.Get(it.Key()); !bytes.Equal(have, it.Value()) {
+			t.Fatalf("proof node %x mismatch", it.Key())
+		}
+	}
+	it.Release()
+
+	defRoot, defNodes := def.Commit(false)
+	customRoot, customNodes := custom.Commit(false)
+	if defRoot != customRoot {
+		t.Fatalf("root mismatch: have %x, want %x", customRoot, defRoot)
+	}
+	if len(defNodes.Nodes) != len(customNodes.Nodes) {
+		t.Fatalf("node count mismatch: have %d, want %d", len(customNodes.Nodes), len(defNodes.Nodes))
+	}
+	for path, n := range defNodes.Nodes {
+		if have := customNodes.Nodes[path]; have == nil || have.Hash != n.Hash || !bytes.Equal(have.Blob, n.Blob) {
+			t.Fatalf("node %x mismatch", path)
+		}
+	}
+}
+
+// Tests that a trie hashed with another node hasher is committed, reopened and
+// proven consistently with its own roots.
+func TestCustomNodeHasher(t *testing.T) {
+	var (
+		db     = NewDatabase(rawdb.NewMemoryDatabase())
+		hasher = domainHasher("arbitrum")
+		empty  = emptyRoot(hasher)
+	)
+	tr, _ := NewWithHasher(TrieID(empty), db, hasher)
+	if root := tr.Hash(); root != empty || root == types.EmptyRootHash {
+		t.Fatalf("unexpected empty root %x", root)
+	}
+	fillHasherTrie(tr)
+
+	def := NewEmpty(db)
+	fillHasherTrie(def)
+	if tr.Hash() == def.Hash() {
+		t.Fatal("node hasher ignored")
+	}
+	root, nodes := tr.Commit(false)
+	for path, n := range nodes.Nodes {
+		if n.Hash != hasher.HashNode(n.Blob) {
+			t.Fatalf("node %x not hashed by the node hasher", path)
+		}
+	}
+	if err := db.Update(root, empty, trienode.NewWithNodeSet(nodes)); err != nil {
+		t.Fatalf("failed to update database: %v", err)
+	}
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit database: %v", err)
+	}
+	tr, err := NewWithHasher(TrieID(root), db, hasher)
+	if err != nil {
+		t.Fatalf("failed to reopen trie: %v", err)
+	}
+	if tr.Hash() != root {
+		t.Fatalf("root mismatch after reopening: have %x, want %x", tr.Hash(), root)
+	}
+	for i := 0; i < 500; i += 50 {
+		key := crypto.Keccak256([]byte(fmt.Sprint(i)))
+		want := []byte(fmt.Sprintf("value-%d", i))
+		if have, err := tr.Get(key); err != nil || !bytes.Equal(have, want) {
+			t.Fatalf("key %d: have %q (err %v), want %q", i, have, err, want)
+		}
+		proof := memorydb.New()
+		if err := tr.Prove(key, 0, proof); err != nil {
+			t.Fatalf("key %d: failed to prove: %v", i, err)
+		}
+		if have, err := VerifyProof(root, key, proof); err != nil || !bytes.Equal(have, want) {
+			t.Fatalf("key %d: proof verified %q (err %v), want %q", i, have, err, want)
+		}
+	}
+	// Changes made on top of the reopened trie keep using the node hasher
+	tr.MustUpdate(crypto.Keccak256([]byte("0")), []byte("changed"))
+	def.MustUpdate(crypto.Keccak256([]byte("0")), []byte("changed"))
+	if tr.Copy().Hash() == def.Hash() {
+		t.Fatal("node hasher dropped")
+	}
+}
+
+// Tests that the state trie hashes its nodes, but not its keys, with the node
+// hasher.
+func TestStateTrieNodeHasher(t *testing.T) {
+	var (
+		db     = NewDatabase(rawdb.NewMemoryDatabase())
+		hasher = domainHasher("arbitrum")
+	)
+	def, _ := NewStateTrie(TrieID(types.EmptyRootHash), db)
+	custom, _ := NewStateTrieWithHasher(TrieID(emptyRoot(hasher)), db, hasher)
+	for _, tr := range []*StateTrie{def, custom} {
+		tr.MustUpdate([]byte("foo"), []byte("bar"))
+		tr.MustUpdate([]byte("baz"), []byte("qux"))
+	}
+	if def.Hash() == custom.Hash() {
+		t.Fatal("node hasher ignored")
+	}
+	it := NewIterator(custom.NodeIterator(nil))
+	for it.Next() {
+		if want := def.MustGet(custom.GetKey(it.Key)); !bytes.Equal(it.Value, want) {
+			t.Fatalf("key %x: have %q, want %q", it.Key, it.Value, want)
+		}
+	}
+	if value := custom.MustGet([]byte("foo")); !bytes.Equal(value, []byte("bar")) {
+		t.Fatalf("have %q, want %q", value, "bar")
+	}
+}
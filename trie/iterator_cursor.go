@@ -0,0 +1,112 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+)
+
+// iteratorCursorVersion is the leading byte of the cursor tokens, bumped whenever
+// their layout changes.
+const iteratorCursorVersion = 1
+
+var (
+	// ErrInvalidCursor is returned when decoding a malformed cursor token.
+	ErrInvalidCursor = errors.New("invalid iterator cursor")
+
+	// ErrCursorRootMismatch is returned when resuming an iteration against a trie
+	// with a different root than the one the cursor was taken on.
+	ErrCursorRootMismatch = errors.New("iterator cursor taken on another root")
+)
+
+// IteratorCursor serializes the position of a node iterator over the trie with
+// the given root into a compact token, from which NodeIteratorFromCursor resumes
+// the iteration later, possibly in another process. The iterator must be
+// positioned at a node, that is its last call to Next must have returned true.
+//
+// The token consists of a version byte, the root, and the compact encoding of
+// the path of the current node.
+func IteratorCursor(root common.Hash, it NodeIterator) []byte {
+	path := hexToCompact(it.Path())
+	cursor := make([]byte, 0, 1+common.HashLength+len(path))
+	cursor = append(cursor, iteratorCursorVersion)
+	cursor = append(cursor, root[:]...)
+	return append(cursor, path...)
+}
+
+// DecodeIteratorCursor returns the root of the trie the cursor was taken on, and
+// the hex encoded path of the node it points at.
+func DecodeIteratorCursor(cursor []byte) (common.Hash, []byte, error) {
+	if len(cursor) < 2+common.HashLength || cursor[0] != iteratorCursorVersion {
+		return common.Hash{}, nil, ErrInvalidCursor
+	}
+	flag := cursor[1+common.HashLength]
+	if flag>>4 > 3 || (flag&0x10 == 0 && flag&0x0f != 0) {
+		return common.Hash{}, nil, ErrInvalidCursor
+	}
+	path := compactToHex(common.CopyBytes(cursor[1+common.HashLength:]))
+	return common.BytesToHash(cursor[1 : 1+common.HashLength]), path, nil
+}
+
+// NodeIteratorFromCursor returns a node iterator positioned at the node the
+// cursor was taken at. Its first call to Next moves past that node, descending
+// into its children if requested, just as the original iterator would have.
+func (t *Trie) NodeIteratorFromCursor(cursor []byte) (NodeIterator, error) {
+	root, path, err := DecodeIteratorCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	if root != t.Hash() {
+		return nil, ErrCursorRootMismatch
+	}
+	it := &nodeIterator{trie: t}
+	if err := it.seekPath(path); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// NodeIteratorFromCursor returns a node iterator over the underlying trie,
+// positioned at the node the cursor was taken at.
+func (t *StateTrie) NodeIteratorFromCursor(cursor []byte) (NodeIterator, error) {
+	return t.trie.NodeIteratorFromCursor(cursor)
+}
+
+// seekPath moves the iterator onto the node with the given hex encoded path,
+// resolving only the nodes leading to it.
+func (it *nodeIterator) seekPath(path []byte) error {
+	for {
+		state, parentIndex, nodePath, err := it.peekSeek(path)
+		if err == errIteratorEnd {
+			return fmt.Errorf("iterator cursor path %x not found", path)
+		} else if err != nil {
+			return err
+		}
+		switch cmp := bytes.Compare(nodePath, path); {
+		case cmp == 0:
+			it.push(state, parentIndex, nodePath)
+			return nil
+		case cmp > 0:
+			return fmt.Errorf("iterator cursor path %x not found", path)
+		}
+		it.push(state, parentIndex, nodePath)
+	}
+}
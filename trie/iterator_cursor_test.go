@@ -0,0 +1,92 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+)
+
+// Tests that an iteration resumed from a cursor, on a trie opened afresh, visits
+// exactly the nodes the original iteration visits after the cursor was taken.
+func TestIteratorCursorResume(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+	tr := NewEmpty(db)
+	for i := 0; i < 500; i++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(i))
+		tr.MustUpdate(crypto.Keccak256(key), key) // short values, some nodes get embedded
+	}
+	tr.MustUpdate([]byte{0x01}, []byte("short key"))
+	root, nodes := tr.Commit(false)
+	db.Update(root, types.EmptyRootHash, trienode.NewWithNodeSet(nodes))
+
+	// Collect the paths of the full iteration, skipping some subtries
+	descend := func(path []byte) bool { return len(path) != 3 || path[2]%3 != 0 }
+	tr, _ = New(TrieID(root), db)
+	var (
+		paths   [][]byte
+		cursors [][]byte
+		it      = tr.NodeIterator(nil)
+	)
+	for it.Next(len(paths) == 0 || descend(paths[len(paths)-1])) {
+		paths = append(paths, common.CopyBytes(it.Path()))
+		cursors = append(cursors, IteratorCursor(root, it))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("iteration failed: %v", err)
+	}
+	for i := 0; i < len(paths); i += 7 {
+		tr, _ := New(TrieID(root), db)
+		resumed, err := tr.NodeIteratorFromCursor(cursors[i])
+		if err != nil {
+			t.Fatalf("cursor %d: failed to resume: %v", i, err)
+		}
+		if !bytes.Equal(resumed.Path(), paths[i]) {
+			t.Fatalf("cursor %d: resumed at %x, want %x", i, resumed.Path(), paths[i])
+		}
+		j := i
+		for resumed.Next(descend(paths[j])) {
+			j++
+			if j >= len(paths) || !bytes.Equal(resumed.Path(), paths[j]) {
+				t.Fatalf("cursor %d: node %d at %x mismatch", i, j, resumed.Path())
+			}
+		}
+		if err := resumed.Error(); err != nil {
+			t.Fatalf("cursor %d: resumed iteration failed: %v", i, err)
+		}
+		if j != len(paths)-1 {
+			t.Fatalf("cursor %d: resumed iteration stopped at node %d of %d", i, j, len(paths))
+		}
+	}
+	// Cursors are bound to their root
+	if _, err := NewEmpty(db).NodeIteratorFromCursor(cursors[1]); err != ErrCursorRootMismatch {
+		t.Errorf("resuming on another root: have %v, want %v", err, ErrCursorRootMismatch)
+	}
+	for _, cursor := range [][]byte{nil, cursors[1][:common.HashLength], append([]byte{0xff}, cursors[1][1:]...)} {
+		if _, err := tr.NodeIteratorFromCursor(cursor); err != ErrInvalidCursor {
+			t.Errorf("resuming from %x: have %v, want %v", cursor, err, ErrInvalidCursor)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/chainupcloud/arb-geth/common"
+)
+
+// maxSplitDepth bounds the number of subtrees a trie is split into to 65536.
+const maxSplitDepth = 4
+
+// ParallelIteratorConfig tunes the concurrent iteration of a trie.
+type ParallelIteratorConfig struct {
+	Workers    int  // Number of subtrees iterated concurrently, GOMAXPROCS if 0
+	SplitDepth int  // Depth in nibbles the trie is split at, 2 (up to 256 subtrees) if 0, at most 4
+	Ordered    bool // Deliver the entries in iteration order from a single goroutine
+	Buffer     int  // Number of entries buffered per subtree ahead of the ordered delivery, 1024 if 0
+}
+
+// parallelEntry is a trie entry on its way to the ordered delivery.
+type parallelEntry struct {
+	key, value []byte
+}
+
+// subtree is a unit of work of the parallel iteration: either the subtree below
+// the node with the given path, or a single entry found above the split depth.
+type subtree struct {
+	path  []byte
+	entry *parallelEntry
+}
+
+// ParallelIterate iterates the entries of the trie with the given id, splitting
+// it into the subtrees below the nodes at the split depth and iterating them on
+// a pool of workers, each with its own view of the trie. This speeds up the jobs
+// walking the whole state, which are bound by the latency of the node reads
+// rather than by the processing of the entries.
+//
+// If the iteration is ordered, fn is called with the entries in the order of a
+// sequential iteration from a single goroutine. Otherwise fn is called
+// concurrently by the workers, with the entries in order within each subtree
+// only. The iteration stops at the first error returned by fn or hit by a
+// worker, or once ctx is cancelled. The key and value passed to fn may be retained.
+func ParallelIterate(ctx context.Context, id *ID, db NodeReader, config ParallelIteratorConfig, fn func(key, value []byte) error) error {
+	if config.Workers <= 0 {
+		config.Workers = runtime.GOMAXPROCS(0)
+	}
+	if config.SplitDepth <= 0 {
+		config.SplitDepth = 2
+	} else if config.SplitDepth > maxSplitDepth {
+		config.SplitDepth = maxSplitDepth
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = 1024
+	}
+	tr, err := New(id, db)
+	if err != nil {
+		return err
+	}
+	subtrees, err := splitTrie(tr, config.SplitDepth)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		tasks = make(chan int)
+		outs  []chan parallelEntry
+		wg    sync.WaitGroup
+
+		errOnce sync.Once
+	)
+	fail := func(e error) {
+		errOnce.Do(func() {
+			err = e
+			cancel()
+		})
+	}
+	if config.Ordered {
+		outs = make([]chan parallelEntry, len(subtrees))
+		for i := range outs {
+			outs[i] = make(chan parallelEntry, config.Buffer)
+		}
+	}
+	// Start the workers, each iterating the subtrees it's handed on its own trie
+	for i := 0; i < config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			tr, e := New(id, db)
+			if e != nil {
+				fail(e)
+				return
+			}
+			for task := range tasks {
+				deliver := fn
+				if config.Ordered {
+					out := outs[task]
+					deliver = func(key, value []byte) error {
+						select {
+						case out <- parallelEntry{key, value}:
+							return nil
+						case <-ctx.Done():
+							return ctx.Err()
+						}
+					}
+				}
+				var e error
+				if entry := subtrees[task].entry; entry != nil {
+					e = deliver(entry.key, entry.value)
+				} else {
+					e = iterateSubtree(ctx, tr, subtrees[task].path, deliver)
+				}
+				if e != nil {
+					fail(e)
+				}
+				if config.Ordered {
+					close(outs[task])
+				}
+			}
+		}()
+	}
+	// Hand out the subtrees in order, the ordered delivery relies on it
+	go func() {
+		defer close(tasks)
+		for i := range subtrees {
+			select {
+			case tasks <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if config.Ordered {
+	deliver:
+		for _, out := range outs {
+			for {
+				var (
+					entry parallelEntry
+					ok    bool
+				)
+				select {
+				case entry, ok = <-out:
+				case <-ctx.Done():
+					break deliver
+				}
+				if !ok {
+					break
+				}
+				if e := fn(entry.key, entry.value); e != nil {
+					fail(e)
+					break deliver
+				}
+			}
+		}
+	}
+	wg.Wait()
+
+	if err == nil {
+		// The parent context may have been cancelled with no worker noticing
+		err = ctx.Err()
+	}
+	return err
+}
+
+// splitTrie walks the top of the trie down to the given depth in nibbles, and
+// returns in iteration order the subtrees below the nodes found there, along
+// with the entries found above.
+func splitTrie(tr *Trie, depth int) ([]subtree, error) {
+	var (
+		subtrees []subtree
+		it       = tr.NodeIterator(nil)
+		descend  = true
+	)
+	for it.Next(descend) {
+		path := it.Path()
+		switch {
+		case it.Leaf() && len(path) <= depth:
+			// Leaf paths end with a terminator, the entry is above the split depth
+			subtrees = append(subtrees, subtree{entry: &parallelEntry{
+				key:   common.CopyBytes(it.LeafKey()),
+				value: common.CopyBytes(it.LeafBlob()),
+			}})
+			descend = true
+		case len(path) >= depth:
+			subtrees = append(subtrees, subtree{path: common.CopyBytes(path)})
+			descend = false
+		default:
+			descend = true
+		}
+	}
+	return subtrees, it.Error()
+}
+
+// iterateSubtree passes the entries below the node with the given path to fn.
+func iterateSubtree(ctx context.Context, tr *Trie, path []byte, fn func(key, value []byte) error) error {
+	it := &nodeIterator{trie: tr}
+	if err := it.seekPath(path); err != nil {
+		return err
+	}
+	for ok := true; ok; ok = it.Next(true) {
+		if !bytes.HasPrefix(it.Path(), path) {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if it.Leaf() {
+			if err := fn(common.CopyBytes(it.LeafKey()), common.CopyBytes(it.LeafBlob())); err != nil {
+				return err
+			}
+		}
+	}
+	return it.Error()
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+)
+
+// Tests that the parallel iteration yields every entry of the trie exactly once,
+// in the order of a sequential iteration if requested, and stops at the first error.
+func TestParallelIterate(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+	tr := NewEmpty(db)
+	for i := 0; i < 3000; i++ {
+		var index [8]byte
+		binary.BigEndian.PutUint64(index[:], uint64(i))
+		tr.MustUpdate(crypto.Keccak256(index[:]), index[:])
+	}
+	// A short key ending before the split depth
+	tr.MustUpdate([]byte{0x12}, []byte{0x1})
+
+	root, nodes := tr.Commit(false)
+	if err := db.Update(root, types.EmptyRootHash, trienode.NewWithNodeSet(nodes)); err != nil {
+		t.Fatalf("failed to update database: %v", err)
+	}
+	tr, _ = New(TrieID(root), db)
+
+	var want [][]byte
+	it := NewIterator(tr.NodeIterator(nil))
+	for it.Next() {
+		want = append(want, common.CopyBytes(it.Key))
+	}
+	for _, depth := range []int{1, 2, 3} {
+		var have [][]byte
+		config := ParallelIteratorConfig{Workers: 4, SplitDepth: depth, Ordered: true, Buffer: 16}
+		err := ParallelIterate(context.Background(), TrieID(root), db, config, func(key, value []byte) error {
+			have = append(have, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("depth %d: ordered iteration failed: %v", depth, err)
+		}
+		if len(have) != len(want) {
+			t.Fatalf("depth %d: have %d entries, want %d", depth, len(have), len(want))
+		}
+		for i := range have {
+			if !bytes.Equal(have[i], want[i]) {
+				t.Fatalf("depth %d: entry %d out of order", depth, i)
+			}
+		}
+		var lock sync.Mutex
+		have = have[:0]
+		config.Ordered = false
+		err = ParallelIterate(context.Background(), TrieID(root), db, config, func(key, value []byte) error {
+			lock.Lock()
+			defer lock.Unlock()
+			have = append(have, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("depth %d: unordered iteration failed: %v", depth, err)
+		}
+		if len(have) != len(want) {
+			t.Fatalf("depth %d: have %d unordered entries, want %d", depth, len(have), len(want))
+		}
+		sorted := append([][]byte{}, want...)
+		sort.Slice(have, func(i, j int) bool { return bytes.Compare(have[i], have[j]) < 0 })
+		sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+		for i := range have {
+			if !bytes.Equal(have[i], sorted[i]) {
+				t.Fatalf("depth %d: unordered entry %d mismatch", depth, i)
+			}
+		}
+	}
+	// Errors abort the iteration
+	errStop := errors.New("stop")
+	for _, ordered := range []bool{true, false} {
+		var (
+			lock  sync.Mutex
+			count int
+		)
+		config := ParallelIteratorConfig{Workers: 4, Ordered: ordered, Buffer: 1}
+		err := ParallelIterate(context.Background(), TrieID(root), db, config, func(key, value []byte) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if count++; count == 100 {
+				return errStop
+			}
+			return nil
+		})
+		if err != errStop {
+			t.Errorf("ordered %v: have error %v, want %v", ordered, err, errStop)
+		}
+	}
+}
@@ -22,20 +22,98 @@ import (
 	"github.com/chainupcloud/arb-geth/common"
 	"github.com/chainupcloud/arb-geth/core/rawdb"
 	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/ethdb/memorydb"
 )
 
+// PreimageBackend is the persistent store the preimages of trie keys are flushed
+// to, letting tools resolve hashed account and storage keys.
+type PreimageBackend interface {
+	// Preimage retrieves the preimage of a hash, nil if unknown.
+	Preimage(hash common.Hash) []byte
+
+	// Preimages retrieves the preimages of a batch of hashes, nil for the unknown ones.
+	Preimages(hashes []common.Hash) [][]byte
+
+	// WritePreimages stores a batch of preimages.
+	WritePreimages(preimages map[common.Hash][]byte) error
+
+	// IteratePreimages calls fn on the stored preimages in ascending hash order
+	// starting at start, until it returns false.
+	IteratePreimages(start common.Hash, fn func(hash common.Hash, preimage []byte) bool) error
+}
+
+// keyValuePreimages is a preimage backend on top of a key-value store.
+type keyValuePreimages struct {
+	db ethdb.KeyValueStore
+}
+
+// NewKeyValuePreimages creates a preimage backend storing the preimages in a
+// key-value store with the schema of the chain database. Besides the chain
+// database itself, the store can be a table of it, a database of their own or
+// an external one.
+func NewKeyValuePreimages(db ethdb.KeyValueStore) PreimageBackend {
+	return &keyValuePreimages{db: db}
+}
+
+// NewMemoryPreimages creates a preimage backend holding the preimages in memory.
+func NewMemoryPreimages() PreimageBackend {
+	return NewKeyValuePreimages(memorydb.New())
+}
+
+func (b *keyValuePreimages) Preimage(hash common.Hash) []byte {
+	return rawdb.ReadPreimage(b.db, hash)
+}
+
+func (b *keyValuePreimages) Preimages(hashes []common.Hash) [][]byte {
+	preimages := make([][]byte, len(hashes))
+	for i, hash := range hashes {
+		preimages[i] = rawdb.ReadPreimage(b.db, hash)
+	}
+	return preimages
+}
+
+func (b *keyValuePreimages) WritePreimages(preimages map[common.Hash][]byte) error {
+	batch := b.db.NewBatch()
+	for hash, preimage := range preimages {
+		rawdb.WritePreimages(batch, map[common.Hash][]byte{hash: preimage})
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return batch.Write()
+}
+
+func (b *keyValuePreimages) IteratePreimages(start common.Hash, fn func(hash common.Hash, preimage []byte) bool) error {
+	it := b.db.NewIterator(rawdb.PreimagePrefix, start.Bytes())
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(rawdb.PreimagePrefix)+common.HashLength {
+			continue
+		}
+		if !fn(common.BytesToHash(key[len(rawdb.PreimagePrefix):]), common.CopyBytes(it.Value())) {
+			break
+		}
+	}
+	return it.Error()
+}
+
 // preimageStore is the store for caching preimages of node key.
 type preimageStore struct {
 	lock          sync.RWMutex
-	disk          ethdb.KeyValueStore
+	backend       PreimageBackend
 	preimages     map[common.Hash][]byte // Preimages of nodes from the secure trie
 	preimagesSize common.StorageSize     // Storage size of the preimages cache
 }
 
 // newPreimageStore initializes the store for caching preimages.
-func newPreimageStore(disk ethdb.KeyValueStore) *preimageStore {
+func newPreimageStore(backend PreimageBackend) *preimageStore {
 	return &preimageStore{
-		disk:      disk,
+		backend:   backend,
 		preimages: make(map[common.Hash][]byte),
 	}
 }
@@ -57,7 +135,7 @@ func (store *preimageStore) insertPreimage(preimages map[common.Hash][]byte) {
 }
 
 // preimage retrieves a cached trie node pre-image from memory. If it cannot be
-// found cached, the method queries the persistent database for the content.
+// found cached, the method queries the backend for the content.
 func (store *preimageStore) preimage(hash common.Hash) []byte {
 	store.lock.RLock()
 	preimage := store.preimages[hash]
@@ -66,10 +144,10 @@ func (store *preimageStore) preimage(hash common.Hash) []byte {
 	if preimage != nil {
 		return preimage
 	}
-	return rawdb.ReadPreimage(store.disk, hash)
+	return store.backend.Preimage(hash)
 }
 
-// commit flushes the cached preimages into the disk.
+// commit flushes the cached preimages into the backend.
 func (store *preimageStore) commit(force bool) error {
 	store.lock.Lock()
 	defer store.lock.Unlock()
@@ -77,9 +155,7 @@ func (store *preimageStore) commit(force bool) error {
 	if store.preimagesSize <= 4*1024*1024 && !force {
 		return nil
 	}
-	batch := store.disk.NewBatch()
-	rawdb.WritePreimages(batch, store.preimages)
-	if err := batch.Write(); err != nil {
+	if err := store.backend.WritePreimages(store.preimages); err != nil {
 		return err
 	}
 	store.preimages, store.preimagesSize = make(map[common.Hash][]byte), 0
@@ -0,0 +1,112 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+)
+
+// Tests that the preimages of a state trie are flushed to a custom backend, and
+// can be read back in batches and iterated in hash order.
+func TestPreimageBackend(t *testing.T) {
+	var (
+		diskdb  = rawdb.NewMemoryDatabase()
+		backend = NewMemoryPreimages()
+		triedb  = NewDatabaseWithConfig(diskdb, &Config{Preimages: true, PreimageBackend: backend})
+		keys    [][]byte
+	)
+	tr, _ := NewStateTrie(TrieID(types.EmptyRootHash), triedb)
+	for i := byte(0); i < 16; i++ {
+		key := bytes.Repeat([]byte{i}, 20)
+		keys = append(keys, key)
+		tr.MustUpdate(key, []byte{i + 1})
+	}
+	root, nodes := tr.Commit(false)
+	if err := triedb.Update(root, types.EmptyRootHash, trienode.NewWithNodeSet(nodes)); err != nil {
+		t.Fatalf("failed to update trie database: %v", err)
+	}
+	if err := triedb.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit trie database: %v", err)
+	}
+	// The preimages went to the backend only
+	hashes := make([]common.Hash, len(keys))
+	for i, key := range keys {
+		hashes[i] = crypto.Keccak256Hash(key)
+		if rawdb.ReadPreimage(diskdb, hashes[i]) != nil {
+			t.Fatalf("preimage %d written to the disk database", i)
+		}
+		if preimage := triedb.Preimage(hashes[i]); !bytes.Equal(preimage, key) {
+			t.Fatalf("preimage %d mismatch: have %x, want %x", i, preimage, key)
+		}
+	}
+	unknown := common.Hash{0xff}
+	preimages := backend.Preimages(append(hashes, unknown))
+	for i, key := range keys {
+		if !bytes.Equal(preimages[i], key) {
+			t.Fatalf("batch preimage %d mismatch: have %x, want %x", i, preimages[i], key)
+		}
+	}
+	if preimages[len(keys)] != nil {
+		t.Fatal("unknown preimage returned")
+	}
+	// Iteration is ordered and honours the start and the callback
+	var (
+		start = hashes[3]
+		seen  []common.Hash
+	)
+	if err := backend.IteratePreimages(start, func(hash common.Hash, preimage []byte) bool {
+		if crypto.Keccak256Hash(preimage) != hash {
+			t.Fatalf("preimage of %x mismatch", hash)
+		}
+		seen = append(seen, hash)
+		return len(seen) < 5
+	}); err != nil {
+		t.Fatalf("failed to iterate preimages: %v", err)
+	}
+	var want []common.Hash
+	for _, hash := range hashes {
+		if bytes.Compare(hash[:], start[:]) >= 0 {
+			want = append(want, hash)
+		}
+	}
+	if len(want) > 5 {
+		want = want[:5]
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("iterated %d preimages, want %d", len(seen), len(want))
+	}
+	for i := 1; i < len(seen); i++ {
+		if bytes.Compare(seen[i-1][:], seen[i][:]) >= 0 {
+			t.Fatalf("preimages not iterated in order")
+		}
+	}
+	// Preimages learnt out of the tries are recorded too
+	external := map[common.Hash][]byte{unknown: {0x1}}
+	if err := triedb.InsertPreimages(external); err != nil {
+		t.Fatalf("failed to insert preimages: %v", err)
+	}
+	if preimage := triedb.Preimage(unknown); !bytes.Equal(preimage, []byte{0x1}) {
+		t.Fatalf("inserted preimage mismatch: have %x", preimage)
+	}
+}
@@ -77,7 +77,7 @@ func (t *Trie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) e
 			panic(fmt.Sprintf("%T: invalid node: %v", tn, tn))
 		}
 	}
-	hasher := newHasher(false)
+	hasher := newCustomHasher(false, t.nodeHasher)
 	defer returnHasherToPool(hasher)
 
 	for i, n := range nodes {
@@ -0,0 +1,115 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/ethdb/memorydb"
+)
+
+// ProvableTrie is a trie whose ranges of entries can be proven, such as Trie
+// and StateTrie.
+type ProvableTrie interface {
+	NodeIterator(start []byte) NodeIterator
+	Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) error
+}
+
+// RangeProof is a contiguous range of trie entries along with the Merkle proofs
+// of its boundaries, which can be verified against the trie root alone.
+type RangeProof struct {
+	Origin []byte   // Key the range starts at, which may be absent from the trie
+	Keys   [][]byte // Keys of the entries in the range, in ascending order
+	Values [][]byte // Values of the entries in the range
+	Proof  [][]byte // Trie nodes proving the boundaries, nil if the range is the whole trie
+}
+
+// ProveRange collects the entries of the trie from origin onwards, up to limit
+// along with the first entry past it if any, so that the range provably covers
+// everything up to limit. A nil origin starts at the beginning of the trie and
+// a nil limit doesn't bound the range. The range is cut short once it holds
+// maxEntries entries or maxBytes of keys and values, zero meaning no bound.
+func ProveRange(tr ProvableTrie, origin, limit []byte, maxEntries, maxBytes int) (*RangeProof, error) {
+	var (
+		it    = NewIterator(tr.NodeIterator(origin))
+		proof = &RangeProof{Origin: common.CopyBytes(origin)}
+		size  int
+		more  bool
+	)
+	for it.Next() {
+		if (maxEntries > 0 && len(proof.Keys) >= maxEntries) || (maxBytes > 0 && size >= maxBytes) {
+			more = true
+			break
+		}
+		proof.Keys = append(proof.Keys, common.CopyBytes(it.Key))
+		proof.Values = append(proof.Values, common.CopyBytes(it.Value))
+		size += len(it.Key) + len(it.Value)
+
+		if limit != nil && bytes.Compare(it.Key, limit) >= 0 {
+			more = true
+			break
+		}
+	}
+	if it.Err != nil {
+		return nil, it.Err
+	}
+	// The whole trie needs no proof, it's checked by rebuilding it
+	if len(origin) == 0 && !more {
+		return proof, nil
+	}
+	if len(origin) == 0 && len(proof.Keys) > 0 {
+		proof.Origin = proof.Keys[0]
+	}
+	nodes := memorydb.New()
+	if err := tr.Prove(proof.Origin, 0, nodes); err != nil {
+		return nil, err
+	}
+	if len(proof.Keys) > 0 {
+		if err := tr.Prove(proof.Keys[len(proof.Keys)-1], 0, nodes); err != nil {
+			return nil, err
+		}
+	}
+	nodeIt := nodes.NewIterator(nil, nil)
+	defer nodeIt.Release()
+
+	proof.Proof = [][]byte{}
+	for nodeIt.Next() {
+		proof.Proof = append(proof.Proof, common.CopyBytes(nodeIt.Value()))
+	}
+	return proof, nil
+}
+
+// Verify checks the range against the root of the trie it was taken from, and
+// reports whether the trie holds more entries past the range.
+func (p *RangeProof) Verify(root common.Hash) (bool, error) {
+	var nodes ethdb.KeyValueReader
+	if p.Proof != nil {
+		db := memorydb.New()
+		for _, node := range p.Proof {
+			db.Put(crypto.Keccak256(node), node)
+		}
+		nodes = db
+	}
+	last := p.Origin
+	if len(p.Keys) > 0 {
+		last = p.Keys[len(p.Keys)-1]
+	}
+	return VerifyRangeProof(root, p.Origin, last, p.Keys, p.Values, nodes)
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+)
+
+// Tests that a trie served in chunks by ProveRange is fully covered by proofs
+// which verify, and that tampered ranges are rejected.
+func TestProveRange(t *testing.T) {
+	tr, vals := randomTrie(2048)
+	root := tr.Hash()
+
+	var entries entrySlice
+	for _, kv := range vals {
+		entries = append(entries, kv)
+	}
+	sort.Sort(entries)
+
+	// Walk the trie in chunks, each continuing where the previous one ended
+	var (
+		origin []byte
+		have   int
+	)
+	for i := 0; ; i++ {
+		proof, err := ProveRange(tr, origin, nil, 100, 0)
+		if err != nil {
+			t.Fatalf("chunk %d: failed to prove range: %v", i, err)
+		}
+		more, err := proof.Verify(root)
+		if err != nil {
+			t.Fatalf("chunk %d: invalid range: %v", i, err)
+		}
+		for j, key := range proof.Keys {
+			if !bytes.Equal(key, entries[have+j].k) || !bytes.Equal(proof.Values[j], entries[have+j].v) {
+				t.Fatalf("chunk %d: entry %d mismatch", i, j)
+			}
+		}
+		have += len(proof.Keys)
+		if !more {
+			break
+		}
+		last := proof.Keys[len(proof.Keys)-1]
+		origin = common.BigToHash(new(big.Int).Add(new(big.Int).SetBytes(last), big.NewInt(1))).Bytes()
+	}
+	if have != len(entries) {
+		t.Fatalf("chunks cover %d entries, want %d", have, len(entries))
+	}
+	// A range bounded by a limit includes the first entry past it
+	limit := common.CopyBytes(entries[500].k)
+	limit[len(limit)-1]--
+	proof, err := ProveRange(tr, entries[400].k, limit, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to prove bounded range: %v", err)
+	}
+	if len(proof.Keys) != 101 {
+		t.Errorf("bounded range: have %d entries, want %d", len(proof.Keys), 101)
+	}
+	if more, err := proof.Verify(root); err != nil || !more {
+		t.Errorf("bounded range: more %v, err %v", more, err)
+	}
+	// The whole trie is proven without boundary proofs
+	proof, err = ProveRange(tr, nil, nil, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to prove whole trie: %v", err)
+	}
+	if proof.Proof != nil || len(proof.Keys) != len(entries) {
+		t.Errorf("whole trie: %d entries, %d proof nodes", len(proof.Keys), len(proof.Proof))
+	}
+	if more, err := proof.Verify(root); err != nil || more {
+		t.Errorf("whole trie: more %v, err %v", more, err)
+	}
+	// Tampered ranges are rejected
+	proof, _ = ProveRange(tr, entries[10].k, nil, 20, 0)
+	proof.Values[5] = []byte{0xff}
+	if _, err := proof.Verify(root); err == nil {
+		t.Error("modified value accepted")
+	}
+	proof, _ = ProveRange(tr, entries[10].k, nil, 20, 0)
+	proof.Keys, proof.Values = append(proof.Keys[:5], proof.Keys[6:]...), append(proof.Values[:5], proof.Values[6:]...)
+	if _, err := proof.Verify(root); err == nil {
+		t.Error("range with a gap accepted")
+	}
+}
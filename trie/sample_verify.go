@@ -0,0 +1,108 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// ErrSampleIncomplete is returned when a sampled range of a state can't be proven
+// from the local database, or its proof doesn't match the state root.
+var ErrSampleIncomplete = errors.New("sampled state range incomplete")
+
+// StateSample summarizes a sampling verification of a state.
+type StateSample struct {
+	Root     common.Hash // Root of the sampled state
+	Ranges   int         // Number of account ranges proven
+	Accounts int         // Number of accounts proven
+	Slots    int         // Number of storage slots proven, from the storage of the sampled accounts
+	Codes    int         // Number of contract codes found
+}
+
+// SampleState checks that the state with the given root is complete in the local
+// database by proving ranges of accounts starting at random positions, along with
+// a range of the storage of each of the accounts found there, and verifying the
+// proofs against their roots. The code of the sampled contracts must be present
+// too. Unlike walking the whole state, this only gives a statistical confidence
+// that no part of the state is missing, growing with the number of samples.
+func SampleState(ctx context.Context, db *Database, root common.Hash, samples, rangeSize int) (*StateSample, error) {
+	tr, err := New(StateTrieID(root), db)
+	if err != nil {
+		return nil, err
+	}
+	result := &StateSample{Root: root}
+	for i := 0; i < samples; i++ {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		proof, err := proveRandomRange(tr, rangeSize)
+		if err != nil {
+			return result, fmt.Errorf("%w: accounts: %v", ErrSampleIncomplete, err)
+		}
+		if _, err := proof.Verify(root); err != nil {
+			return result, fmt.Errorf("%w: accounts from %x: %v", ErrSampleIncomplete, proof.Origin, err)
+		}
+		result.Ranges++
+		result.Accounts += len(proof.Keys)
+
+		for j, key := range proof.Keys {
+			var account types.StateAccount
+			if err := rlp.DecodeBytes(proof.Values[j], &account); err != nil {
+				return result, fmt.Errorf("%w: account %x: %v", ErrSampleIncomplete, key, err)
+			}
+			if codeHash := common.BytesToHash(account.CodeHash); codeHash != types.EmptyCodeHash {
+				if !rawdb.HasCode(db.diskdb, codeHash) {
+					return result, fmt.Errorf("%w: account %x: missing code %x", ErrSampleIncomplete, key, codeHash)
+				}
+				result.Codes++
+			}
+			if account.Root == types.EmptyRootHash {
+				continue
+			}
+			storage, err := New(StorageTrieID(root, common.BytesToHash(key), account.Root), db)
+			if err != nil {
+				return result, fmt.Errorf("%w: storage of %x: %v", ErrSampleIncomplete, key, err)
+			}
+			slots, err := proveRandomRange(storage, rangeSize)
+			if err != nil {
+				return result, fmt.Errorf("%w: storage of %x: %v", ErrSampleIncomplete, key, err)
+			}
+			if _, err := slots.Verify(account.Root); err != nil {
+				return result, fmt.Errorf("%w: storage of %x from %x: %v", ErrSampleIncomplete, key, slots.Origin, err)
+			}
+			result.Slots += len(slots.Keys)
+		}
+	}
+	return result, nil
+}
+
+// proveRandomRange proves up to rangeSize entries of the trie from a random key.
+func proveRandomRange(tr *Trie, rangeSize int) (*RangeProof, error) {
+	origin := make([]byte, common.HashLength)
+	if _, err := rand.Read(origin); err != nil {
+		return nil, err
+	}
+	return ProveRange(tr, origin, nil, rangeSize, 0)
+}
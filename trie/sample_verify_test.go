@@ -0,0 +1,74 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// Tests that sampling a complete state succeeds, while sampling a state missing
+// part of its storage is caught.
+func TestSampleState(t *testing.T) {
+	var (
+		diskdb   = rawdb.NewMemoryDatabase()
+		db       = NewDatabase(diskdb)
+		accounts = make(map[common.Hash]*diffTestAccount)
+		last     common.Hash
+	)
+	for i := byte(0); i < 20; i++ {
+		hash := crypto.Keccak256Hash([]byte{i})
+		storage := make(map[common.Hash][]byte)
+		for j := byte(1); j <= 10; j++ {
+			storage[crypto.Keccak256Hash([]byte{i, j})] = []byte{j}
+		}
+		accounts[hash] = &diffTestAccount{nonce: uint64(i), storage: storage}
+		if bytes.Compare(hash[:], last[:]) > 0 {
+			last = hash
+		}
+	}
+	root := makeDiffTestState(t, db, accounts)
+	if err := db.Commit(root, false); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	result, err := SampleState(context.Background(), NewDatabase(diskdb), root, 32, 64)
+	if err != nil {
+		t.Fatalf("failed to sample complete state: %v", err)
+	}
+	if result.Ranges != 32 || result.Accounts == 0 || result.Slots == 0 {
+		t.Fatalf("unexpected sample: %+v", result)
+	}
+	// Drop the storage of the last account, which nearly every sample covers
+	tr, _ := New(StateTrieID(root), NewDatabase(diskdb))
+	var account types.StateAccount
+	if err := rlp.DecodeBytes(tr.MustGet(last[:]), &account); err != nil {
+		t.Fatalf("failed to decode account: %v", err)
+	}
+	rawdb.DeleteLegacyTrieNode(diskdb, account.Root)
+
+	if _, err := SampleState(context.Background(), NewDatabase(diskdb), root, 32, 64); !errors.Is(err, ErrSampleIncomplete) {
+		t.Fatalf("sampling incomplete state: have %v, want %v", err, ErrSampleIncomplete)
+	}
+}
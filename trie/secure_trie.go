@@ -62,10 +62,17 @@ type StateTrie struct {
 // trie is initially empty. Otherwise, New will panic if db is nil
 // and returns MissingNodeError if the root node cannot be found.
 func NewStateTrie(id *ID, db *Database) (*StateTrie, error) {
+	return NewStateTrieWithHasher(id, db, nil)
+}
+
+// NewStateTrieWithHasher creates a state trie like NewStateTrie, with its nodes
+// hashed by the node hasher instead of keccak256. The keys are still hashed with
+// keccak256. A nil node hasher stands for keccak256.
+func NewStateTrieWithHasher(id *ID, db *Database, nodeHasher NodeHasher) (*StateTrie, error) {
 	if db == nil {
 		panic("trie.NewStateTrie called without a database")
 	}
-	trie, err := New(id, db)
+	trie, err := NewWithHasher(id, db, nodeHasher)
 	if err != nil {
 		return nil, err
 	}
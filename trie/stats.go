@@ -0,0 +1,94 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+
+	"github.com/chainupcloud/arb-geth/common"
+)
+
+// Stats summarizes the shape and size of a trie, or of the part of it walked
+// when sampling.
+type Stats struct {
+	Leaves     uint64   // Number of entries
+	KeyBytes   uint64   // Size of the keys of the entries
+	ValueBytes uint64   // Size of the values of the entries
+	Nodes      uint64   // Number of nodes stored on their own, not embedded in their parent
+	NodeBytes  uint64   // Size of the nodes stored on their own
+	Depths     []uint64 // Number of entries by the number of nodes on their path from the root
+	Coverage   float64  // Fraction of the keyspace walked, 1 unless sampled
+}
+
+// CollectStats walks the trie and summarizes it. If maxLeaves is non-zero and
+// the trie holds more entries, the walk stops there and covers only the start
+// of the keyspace. Keys being hashes, the entries are spread evenly across the
+// keyspace, so the sample extrapolates to the whole trie by its coverage.
+func CollectStats(ctx context.Context, tr interface{ NodeIterator([]byte) NodeIterator }, maxLeaves uint64) (*Stats, error) {
+	var (
+		stats = &Stats{Coverage: 1}
+		it    = tr.NodeIterator(nil)
+		path  [][]byte // Paths of the nodes from the root down to the current one
+	)
+	for it.Next(true) {
+		for len(path) > 0 && !bytes.HasPrefix(it.Path(), path[len(path)-1]) {
+			path = path[:len(path)-1]
+		}
+		if it.Leaf() {
+			if maxLeaves > 0 && stats.Leaves >= maxLeaves {
+				stats.Coverage = keyspaceFraction(it.LeafKey())
+				break
+			}
+			depth := len(path)
+			for len(stats.Depths) <= depth {
+				stats.Depths = append(stats.Depths, 0)
+			}
+			stats.Depths[depth]++
+			stats.Leaves++
+			stats.KeyBytes += uint64(len(it.LeafKey()))
+			stats.ValueBytes += uint64(len(it.LeafBlob()))
+
+			if stats.Leaves%10000 == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		path = append(path, append([]byte{}, it.Path()...))
+		if it.Hash() != (common.Hash{}) {
+			if blob := it.NodeBlob(); blob != nil {
+				stats.Nodes++
+				stats.NodeBytes += uint64(len(blob))
+			}
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// keyspaceFraction returns the fraction of the keyspace before the key.
+func keyspaceFraction(key []byte) float64 {
+	var prefix [8]byte
+	copy(prefix[:], key)
+	return float64(binary.BigEndian.Uint64(prefix[:])) / math.Exp2(64)
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+)
+
+// Tests that the stats account for every entry of the trie, and that a sample
+// extrapolates to about the size of the whole trie.
+func TestCollectStats(t *testing.T) {
+	const entries = 4000
+
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+	tr := NewEmpty(db)
+	var valueBytes uint64
+	for i := 0; i < entries; i++ {
+		var index [8]byte
+		binary.BigEndian.PutUint64(index[:], uint64(i))
+		value := make([]byte, 1+i%40)
+		tr.MustUpdate(crypto.Keccak256(index[:]), value)
+		valueBytes += uint64(len(value))
+	}
+	root, nodes := tr.Commit(false)
+	if err := db.Update(root, types.EmptyRootHash, trienode.NewWithNodeSet(nodes)); err != nil {
+		t.Fatalf("failed to update database: %v", err)
+	}
+	tr, _ = New(TrieID(root), db)
+
+	stats, err := CollectStats(context.Background(), tr, 0)
+	if err != nil {
+		t.Fatalf("failed to collect stats: %v", err)
+	}
+	if stats.Leaves != entries || stats.KeyBytes != 32*entries || stats.ValueBytes != valueBytes || stats.Coverage != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	var depths uint64
+	for depth, count := range stats.Depths {
+		if depth < 2 && count > 0 {
+			t.Fatalf("%d entries at depth %d", count, depth)
+		}
+		depths += count
+	}
+	if depths != entries {
+		t.Fatalf("depth distribution covers %d entries, want %d", depths, entries)
+	}
+	if stats.Nodes == 0 || stats.NodeBytes <= stats.ValueBytes {
+		t.Fatalf("unexpected node stats: %d nodes, %d bytes", stats.Nodes, stats.NodeBytes)
+	}
+	sample, err := CollectStats(context.Background(), tr, entries/4)
+	if err != nil {
+		t.Fatalf("failed to collect sampled stats: %v", err)
+	}
+	if sample.Leaves != entries/4 {
+		t.Fatalf("sampled %d entries, want %d", sample.Leaves, entries/4)
+	}
+	if estimate := float64(sample.Leaves) / sample.Coverage; math.Abs(estimate-entries) > entries/5 {
+		t.Fatalf("sample extrapolates to %.0f entries, want about %d", estimate, entries)
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/chainupcloud/arb-geth/core/types"
 	"github.com/chainupcloud/arb-geth/ethdb"
 	"github.com/chainupcloud/arb-geth/log"
+	"github.com/chainupcloud/arb-geth/trie/syncpath"
 )
 
 // ErrNotRequested is returned by the trie sync when it's requested to process a
@@ -43,36 +44,13 @@ var ErrAlreadyProcessed = errors.New("already processed")
 const maxFetchesPerDepth = 16384
 
 // SyncPath is a path tuple identifying a particular trie node either in a single
-// trie (account) or a layered trie (account -> storage).
-//
-// Content wise the tuple either has 1 element if it addresses a node in a single
-// trie or 2 elements if it addresses a node in a stacked trie.
-//
-// To support aiming arbitrary trie nodes, the path needs to support odd nibble
-// lengths. To avoid transferring expanded hex form over the network, the last
-// part of the tuple (which needs to index into the middle of a trie) is compact
-// encoded. In case of a 2-tuple, the first item is always 32 bytes so that is
-// simple binary encoded.
-//
-// Examples:
-//   - Path 0x9  -> {0x19}
-//   - Path 0x99 -> {0x0099}
-//   - Path 0x01234567890123456789012345678901012345678901234567890123456789019  -> {0x0123456789012345678901234567890101234567890123456789012345678901, 0x19}
-//   - Path 0x012345678901234567890123456789010123456789012345678901234567890199 -> {0x0123456789012345678901234567890101234567890123456789012345678901, 0x0099}
-type SyncPath [][]byte
+// trie (account) or a layered trie (account -> storage), see syncpath.Path.
+type SyncPath = syncpath.Path
 
 // NewSyncPath converts an expanded trie path from nibble form into a compact
 // version that can be sent over the network.
 func NewSyncPath(path []byte) SyncPath {
-	// If the hash is from the account trie, append a single item, if it
-	// is from a storage trie, append a tuple. Note, the length 64 is
-	// clashing between account leaf and storage root. It's fine though
-	// because having a trie node at 64 depth means a hash collision was
-	// found and we're long dead.
-	if len(path) < 64 {
-		return SyncPath{hexToCompact(path)}
-	}
-	return SyncPath{hexToKeybytes(path[:64]), hexToCompact(path[64:])}
+	return syncpath.New(path)
 }
 
 // LeafCallback is a callback type invoked when a trie operation reaches a leaf
@@ -100,6 +78,8 @@ type nodeRequest struct {
 	parent   *nodeRequest // Parent state node referencing this entry
 	deps     int          // Number of dependencies before allowed to commit this node
 	callback LeafCallback // Callback to invoke if a leaf node it reached on this branch
+	urgent   bool         // Whether the node belongs to a prioritized account
+	inflight bool         // Whether the node holds a storage concurrency slot
 }
 
 // codeRequest represents a scheduled or already in-flight bytecode retrieval request.
@@ -108,6 +88,9 @@ type codeRequest struct {
 	path    []byte         // Merkle path leading to this node for prioritization
 	data    []byte         // Data content of the node, cached until all subtrees complete
 	parents []*nodeRequest // Parent state nodes referencing this entry (notify all upon completion)
+	refs    int            // Number of references to the code awaiting it, clone contracts share theirs
+	urgent  bool           // Whether the code belongs to a prioritized account
+	checked bool           // Whether the database was checked for the code
 }
 
 // NodeSyncResult is a response with requested trie node along with its node path.
@@ -152,6 +135,29 @@ func (batch *syncMemBatch) hasCode(hash common.Hash) bool {
 	return ok
 }
 
+// SyncStats is a snapshot of the internal counters of a Sync scheduler, meant
+// to allow telling apart a slow sync (counters increasing) from a stuck one.
+type SyncStats struct {
+	PendingNodes   int    // Number of trie node requests pending completion
+	PendingCodes   int    // Number of bytecode requests pending completion
+	Queued         int    // Number of requests scheduled but not yet handed out for retrieval
+	UrgentPending  int    // Number of requests and unreached accounts pending for the prioritized accounts
+	StorageFetches int    // Number of storage trie node requests handed out but not delivered yet
+	MemBatchNodes  int    // Number of completed trie nodes held in memory
+	MemBatchCodes  int    // Number of completed bytecodes held in memory
+	MemBatchSize   uint64 // Estimated size of the data held in memory
+	CommittedNodes uint64 // Number of trie nodes flushed to disk
+	CommittedCodes uint64 // Number of bytecodes flushed to disk
+	CommittedBytes uint64 // Number of trie node and bytecode bytes flushed to disk
+	MemBatchHits   uint64 // Membership lookups answered by the in-memory batch
+	DatabaseHits   uint64 // Membership lookups answered by the persistent database
+	Misses         uint64 // Membership lookups resulting in a new retrieval request
+	CodeRefHits    uint64 // Code references served by a pending request for the same code
+	SpilledNodes   uint64 // Number of completed trie nodes moved to the scratch database
+	SpilledCodes   uint64 // Number of completed bytecodes moved to the scratch database
+	SpilledSize    uint64 // Estimated size of the data moved to the scratch database
+}
+
 // Sync is the main state trie synchronisation scheduler, which provides yet
 // unknown trie hashes to retrieve, accepts node data associated with said hashes
 // and reconstructs the trie step by step until all is done.
@@ -162,7 +168,30 @@ type Sync struct {
 	nodeReqs map[string]*nodeRequest      // Pending requests pertaining to a trie node path
 	codeReqs map[common.Hash]*codeRequest // Pending requests pertaining to a code hash
 	queue    *prque.Prque[int64, any]     // Priority queue with the pending requests
+	urgent   *prque.Prque[int64, any]     // Priority queue with the pending requests of prioritized accounts
 	fetches  map[int]int                  // Number of active fetches per trie node depth
+	spill    *syncSpill                   // Scratch store for completed entries beyond the memory limit, if enabled
+
+	storage         map[string]*storageTask // Storage trie node requests per account, with their fetches in flight
+	owners          []*storageTask          // Accounts with queued storage trie node requests, in round robin order
+	storageInflight int                     // Number of storage trie node fetches in flight
+	storagePerOwner int                     // Maximum number of storage trie node fetches in flight per account
+	storageTotal    int                     // Maximum number of storage trie node fetches in flight overall
+
+	prioritized   [][]byte            // Hex paths of the accounts to retrieve ahead of the rest of the state
+	unreached     map[string]struct{} // Hex paths of the prioritized accounts not reached yet
+	urgentPending int                 // Number of requests pending for the prioritized accounts
+
+	batching  *SyncBatchConfig         // Adaptive batch sizing of MissingFor, nil if disabled
+	consumers map[string]*syncConsumer // Batch sizing state per consumer
+
+	committedNodes uint64 // Number of trie nodes flushed to disk
+	committedCodes uint64 // Number of bytecodes flushed to disk
+	committedBytes uint64 // Number of trie node and bytecode bytes flushed to disk
+	membatchHits   uint64 // Membership lookups answered by the in-memory batch
+	databaseHits   uint64 // Membership lookups answered by the persistent database
+	misses         uint64 // Membership lookups resulting in a new retrieval request
+	codeRefHits    uint64 // Code references served by a pending request for the same code
 }
 
 // NewSync creates a new trie data download scheduler.
@@ -174,27 +203,75 @@ func NewSync(root common.Hash, database ethdb.KeyValueReader, callback LeafCallb
 		nodeReqs: make(map[string]*nodeRequest),
 		codeReqs: make(map[common.Hash]*codeRequest),
 		queue:    prque.New[int64, any](nil), // Ugh, can contain both string and hash, whyyy
+		urgent:   prque.New[int64, any](nil),
 		fetches:  make(map[int]int),
+
+		storage:         make(map[string]*storageTask),
+		storagePerOwner: DefaultStorageFetchesPerOwner,
+		storageTotal:    DefaultStorageFetches,
+
+		unreached: make(map[string]struct{}),
 	}
 	ts.AddSubTrie(root, nil, common.Hash{}, nil, callback)
 	return ts
 }
 
+// SetMembership bounds the memory used to track the completed but not yet
+// committed entries, spilling them to a scratch database beyond the configured
+// limit. It must be called before any data is processed.
+func (s *Sync) SetMembership(config *SyncMembershipConfig) {
+	if config == nil || config.Store == nil {
+		s.spill = nil
+		return
+	}
+	s.spill = newSyncSpill(config)
+}
+
+// hasNode reports whether the trie node with the specific path was completed
+// but not yet committed.
+func (s *Sync) hasNode(path []byte) bool {
+	return s.membatch.hasNode(path) || (s.spill != nil && s.spill.hasNode(path))
+}
+
+// hasCode reports whether the contract code with the specific hash was
+// completed but not yet committed.
+func (s *Sync) hasCode(hash common.Hash) bool {
+	return s.membatch.hasCode(hash) || (s.spill != nil && s.spill.hasCode(hash))
+}
+
+// maybeSpill moves the completed entries to the scratch database if they
+// exceed the memory limit.
+func (s *Sync) maybeSpill() error {
+	if s.spill == nil || s.membatch.size <= s.spill.limit {
+		return nil
+	}
+	if err := s.spill.spill(s.membatch); err != nil {
+		return err
+	}
+	s.membatch = newSyncMemBatch()
+	return nil
+}
+
 // AddSubTrie registers a new trie to the sync code, rooted at the designated
 // parent for completion tracking. The given path is a unique node path in
 // hex format and contain all the parent path if it's layered trie node.
 func (s *Sync) AddSubTrie(root common.Hash, path []byte, parent common.Hash, parentPath []byte, callback LeafCallback) {
+	s.markReached(path)
+
 	// Short circuit if the trie is empty or already known
 	if root == types.EmptyRootHash {
 		return
 	}
-	if s.membatch.hasNode(path) {
+	if s.hasNode(path) {
+		s.membatchHits++
 		return
 	}
 	owner, inner := ResolvePath(path)
 	if rawdb.HasTrieNode(s.database, owner, inner, root, s.scheme) {
+		s.databaseHits++
 		return
 	}
+	s.misses++
 	// Assemble the new sub-trie sync request
 	req := &nodeRequest{
 		hash:     root,
@@ -216,34 +293,45 @@ func (s *Sync) AddSubTrie(root common.Hash, path []byte, parent common.Hash, par
 // AddCodeEntry schedules the direct retrieval of a contract code that should not
 // be interpreted as a trie node, but rather accepted and stored into the database
 // as is.
+//
+// References to a code already pending are attached to its request, without any
+// further lookup. The database is checked for new codes when they are handed out
+// by Missing, in a single batch, so they are counted as pending until then.
 func (s *Sync) AddCodeEntry(hash common.Hash, path []byte, parent common.Hash, parentPath []byte) {
+	s.markReached(path)
+
 	// Short circuit if the entry is empty or already known
 	if hash == types.EmptyCodeHash {
 		return
 	}
-	if s.membatch.hasCode(hash) {
+	if s.hasCode(hash) {
+		s.membatchHits++
 		return
 	}
-	// If database says duplicate, the blob is present for sure.
-	// Note we only check the existence with new code scheme, snap
-	// sync is expected to run with a fresh new node. Even there
-	// exists the code with legacy format, fetch and store with
-	// new scheme anyway.
-	if rawdb.HasCodeWithPrefix(s.database, hash) {
+	// Link the reference to its parent, which can ONLY be a node request
+	var ancestor *nodeRequest
+	if parent != (common.Hash{}) {
+		ancestor = s.nodeReqs[string(parentPath)]
+		if ancestor == nil {
+			panic(fmt.Sprintf("raw-entry ancestor not found: %x", parent))
+		}
+		ancestor.deps++
+	}
+	if req, ok := s.codeReqs[hash]; ok {
+		s.codeRefHits++
+		req.refs++
+		if ancestor != nil {
+			req.parents = append(req.parents, ancestor)
+		}
 		return
 	}
 	// Assemble the new sub-trie sync request
 	req := &codeRequest{
 		path: path,
 		hash: hash,
+		refs: 1,
 	}
-	// If this sub-trie has a designated parent, link them together
-	if parent != (common.Hash{}) {
-		ancestor := s.nodeReqs[string(parentPath)] // the parent of codereq can ONLY be nodereq
-		if ancestor == nil {
-			panic(fmt.Sprintf("raw-entry ancestor not found: %x", parent))
-		}
-		ancestor.deps++
+	if ancestor != nil {
 		req.parents = append(req.parents, ancestor)
 	}
 	s.scheduleCodeRequest(req)
@@ -252,39 +340,123 @@ func (s *Sync) AddCodeEntry(hash common.Hash, path []byte, parent common.Hash, p
 // Missing retrieves the known missing nodes from the trie for retrieval. To aid
 // both eth/6x style fast sync and snap/1x style state sync, the paths of trie
 // nodes are returned too, as well as separate hash list for codes.
+//
+// The codes handed out for the first time are checked against the database, the
+// known ones complete their requests right away. This may complete trie nodes
+// too, so Commit must be called once nothing is missing anymore.
 func (s *Sync) Missing(max int) ([]string, []common.Hash, []common.Hash) {
 	var (
 		nodePaths  []string
 		nodeHashes []common.Hash
 		codeHashes []common.Hash
 	)
-	for !s.queue.Empty() && (max == 0 || len(nodeHashes)+len(codeHashes) < max) {
-		// Retrieve the next item in line
-		item, prio := s.queue.Peek()
-
-		// If we have too many already-pending tasks for this depth, throttle
-		depth := int(prio >> 56)
-		if s.fetches[depth] > maxFetchesPerDepth {
-			break
+	for {
+		unchecked := s.missing(max, &nodePaths, &nodeHashes, &codeHashes)
+		if len(unchecked) == 0 {
+			return nodePaths, nodeHashes, codeHashes
+		}
+		fetch := s.checkCodes(unchecked)
+		codeHashes = append(codeHashes, fetch...)
+		if len(fetch) == len(unchecked) {
+			return nodePaths, nodeHashes, codeHashes
+		}
+		// Some codes were found in the database, fill their slots
+	}
+}
+
+// missing collects the requests to hand out into the given lists, up to max
+// entries overall, except for the codes not checked against the database yet,
+// which are returned instead.
+func (s *Sync) missing(max int, nodePaths *[]string, nodeHashes *[]common.Hash, codeHashes *[]common.Hash) []common.Hash {
+	var unchecked []common.Hash
+
+	// Hand out the requests of the prioritized accounts first, then the storage
+	// trie nodes of all accounts in parallel, and the rest of the state last
+	for _, queue := range []*prque.Prque[int64, any]{s.urgent, nil, s.queue} {
+		if queue == nil {
+			limit := max
+			if limit != 0 {
+				limit -= len(*codeHashes) + len(unchecked)
+			}
+			*nodePaths, *nodeHashes = s.missingStorage(limit, *nodePaths, *nodeHashes)
+			continue
 		}
-		// Item is allowed to be scheduled, add it to the task list
-		s.queue.Pop()
-		s.fetches[depth]++
-
-		switch item := item.(type) {
-		case common.Hash:
-			codeHashes = append(codeHashes, item)
-		case string:
-			req, ok := s.nodeReqs[item]
-			if !ok {
-				log.Error("Missing node request", "path", item)
-				continue // System very wrong, shouldn't happen
+		for !queue.Empty() && (max == 0 || len(*nodeHashes)+len(*codeHashes)+len(unchecked) < max) {
+			// Retrieve the next item in line
+			item, prio := queue.Peek()
+
+			// If we have too many already-pending tasks for this depth, throttle
+			depth := int(prio >> 56)
+			if s.fetches[depth] > maxFetchesPerDepth {
+				break
+			}
+			// Item is allowed to be scheduled, add it to the task list
+			queue.Pop()
+			s.fetches[depth]++
+
+			switch item := item.(type) {
+			case common.Hash:
+				if req := s.codeReqs[item]; req != nil && !req.checked {
+					unchecked = append(unchecked, item)
+				} else {
+					*codeHashes = append(*codeHashes, item)
+				}
+			case string:
+				req, ok := s.nodeReqs[item]
+				if !ok {
+					log.Error("Missing node request", "path", item)
+					continue // System very wrong, shouldn't happen
+				}
+				*nodePaths = append(*nodePaths, item)
+				*nodeHashes = append(*nodeHashes, req.hash)
 			}
-			nodePaths = append(nodePaths, item)
-			nodeHashes = append(nodeHashes, req.hash)
 		}
 	}
-	return nodePaths, nodeHashes, codeHashes
+	return unchecked
+}
+
+// codeCheckers is the number of goroutines checking the database for codes.
+const codeCheckers = 16
+
+// checkCodes checks the database for the codes about to be handed out for the
+// first time, resolving the requests of the ones already present, and returns
+// the hashes of the codes to retrieve.
+func (s *Sync) checkCodes(hashes []common.Hash) []common.Hash {
+	// If database says duplicate, the blob is present for sure.
+	// Note we only check the existence with new code scheme, snap
+	// sync is expected to run with a fresh new node. Even there
+	// exists the code with legacy format, fetch and store with
+	// new scheme anyway.
+	var (
+		known   = make([]bool, len(hashes))
+		pending sync.WaitGroup
+	)
+	for w := 0; w < codeCheckers && w < len(hashes); w++ {
+		pending.Add(1)
+		go func(w int) {
+			defer pending.Done()
+			for i := w; i < len(hashes); i += codeCheckers {
+				known[i] = rawdb.HasCodeWithPrefix(s.database, hashes[i])
+			}
+		}(w)
+	}
+	pending.Wait()
+
+	var fetch []common.Hash
+	for i, hash := range hashes {
+		req := s.codeReqs[hash]
+		req.checked = true
+		if !known[i] {
+			s.misses++
+			fetch = append(fetch, hash)
+			continue
+		}
+		s.databaseHits += uint64(req.refs)
+		if err := s.completeCodeRequest(req); err != nil {
+			log.Error("Failed to complete known code request", "hash", hash, "err", err)
+		}
+	}
+	return fetch
 }
 
 // ProcessCode injects the received data for requested item. Note it can
@@ -303,7 +475,10 @@ func (s *Sync) ProcessCode(result CodeSyncResult) error {
 		return ErrAlreadyProcessed
 	}
 	req.data = result.Data
-	return s.commitCodeRequest(req)
+	if err := s.commitCodeRequest(req); err != nil {
+		return err
+	}
+	return s.maybeSpill()
 }
 
 // ProcessNode injects the received data for requested item. Note it can
@@ -327,6 +502,7 @@ func (s *Sync) ProcessNode(result NodeSyncResult) error {
 		return err
 	}
 	req.data = result.Data
+	s.storageDelivered(req)
 
 	// Create and schedule a request for all the children nodes
 	requests, err := s.children(req, node)
@@ -341,12 +517,25 @@ func (s *Sync) ProcessNode(result NodeSyncResult) error {
 			s.scheduleNodeRequest(child)
 		}
 	}
-	return nil
+	return s.maybeSpill()
 }
 
 // Commit flushes the data stored in the internal membatch out to persistent
-// storage, returning any occurred error.
+// storage, returning any occurred error. The data spilled to the scratch
+// database is added to the batch too, ahead of the membatch since it completed
+// earlier, and is only deleted from the scratch database once the scheduler
+// spills or commits again, so the batch must be written before processing more
+// data.
 func (s *Sync) Commit(dbw ethdb.Batch) error {
+	if s.spill != nil {
+		nodes, codes, size := s.spill.nodes, s.spill.codes, s.spill.size
+		if err := s.spill.commit(dbw, s.scheme); err != nil {
+			return err
+		}
+		s.committedNodes += nodes
+		s.committedCodes += codes
+		s.committedBytes += size
+	}
 	// Dump the membatch into a database dbw
 	for path, value := range s.membatch.nodes {
 		owner, inner := ResolvePath([]byte(path))
@@ -355,6 +544,10 @@ func (s *Sync) Commit(dbw ethdb.Batch) error {
 	for hash, value := range s.membatch.codes {
 		rawdb.WriteCode(dbw, hash, value)
 	}
+	s.committedNodes += uint64(len(s.membatch.nodes))
+	s.committedCodes += uint64(len(s.membatch.codes))
+	s.committedBytes += s.membatch.size
+
 	// Drop the membatch data and return
 	s.membatch = newSyncMemBatch()
 	return nil
@@ -370,6 +563,33 @@ func (s *Sync) Pending() int {
 	return len(s.nodeReqs) + len(s.codeReqs)
 }
 
+// Stats returns a snapshot of the scheduler's progress counters.
+func (s *Sync) Stats() SyncStats {
+	stats := SyncStats{
+		PendingNodes:   len(s.nodeReqs),
+		PendingCodes:   len(s.codeReqs),
+		Queued:         s.queue.Size() + s.urgent.Size() + s.queuedStorage(),
+		UrgentPending:  s.UrgentPending(),
+		StorageFetches: s.storageInflight,
+		MemBatchNodes:  len(s.membatch.nodes),
+		MemBatchCodes:  len(s.membatch.codes),
+		MemBatchSize:   s.membatch.size,
+		CommittedNodes: s.committedNodes,
+		CommittedCodes: s.committedCodes,
+		CommittedBytes: s.committedBytes,
+		MemBatchHits:   s.membatchHits,
+		DatabaseHits:   s.databaseHits,
+		Misses:         s.misses,
+		CodeRefHits:    s.codeRefHits,
+	}
+	if s.spill != nil {
+		stats.SpilledNodes = s.spill.nodes
+		stats.SpilledCodes = s.spill.codes
+		stats.SpilledSize = s.spill.size
+	}
+	return stats
+}
+
 // schedule inserts a new state retrieval request into the fetch queue. If there
 // is already a pending request for this node, the new request will be discarded
 // and only a parent reference added to the old one.
@@ -382,18 +602,16 @@ func (s *Sync) scheduleNodeRequest(req *nodeRequest) {
 	for i := 0; i < 14 && i < len(req.path); i++ {
 		prio |= int64(15-req.path[i]) << (52 - i*4) // 15-nibble => lexicographic order
 	}
-	s.queue.Push(string(req.path), prio)
+	queue := s.queueFor(req.path, &req.urgent)
+	if queue == s.queue && isStorage(req.path) {
+		queue = s.storageQueue(req.path)
+	}
+	queue.Push(string(req.path), prio)
 }
 
-// schedule inserts a new state retrieval request into the fetch queue. If there
-// is already a pending request for this node, the new request will be discarded
-// and only a parent reference added to the old one.
+// scheduleCodeRequest inserts a new code retrieval request into the fetch queue.
+// Further references to the same code are attached to it by AddCodeEntry.
 func (s *Sync) scheduleCodeRequest(req *codeRequest) {
-	// If we're already requesting this node, add a new reference and stop
-	if old, ok := s.codeReqs[req.hash]; ok {
-		old.parents = append(old.parents, req.parents...)
-		return
-	}
 	s.codeReqs[req.hash] = req
 
 	// Schedule the request for future retrieval. This queue is shared
@@ -402,7 +620,7 @@ func (s *Sync) scheduleCodeRequest(req *codeRequest) {
 	for i := 0; i < 14 && i < len(req.path); i++ {
 		prio |= int64(15-req.path[i]) << (52 - i*4) // 15-nibble => lexicographic order
 	}
-	s.queue.Push(req.hash, prio)
+	s.queueFor(req.path, &req.urgent).Push(req.hash, prio)
 }
 
 // children retrieves all the missing children of a state trie entry for future
@@ -441,6 +659,7 @@ func (s *Sync) children(req *nodeRequest, object node) ([]*nodeRequest, error) {
 	var (
 		missing = make(chan *nodeRequest, len(children))
 		pending sync.WaitGroup
+		checked int // Number of children checked against the database
 	)
 	for _, child := range children {
 		// Notify any external watcher of a new key/value node
@@ -461,9 +680,12 @@ func (s *Sync) children(req *nodeRequest, object node) ([]*nodeRequest, error) {
 		// If the child references another node, resolve or schedule
 		if node, ok := (child.node).(hashNode); ok {
 			// Try to resolve the node from the local database
-			if s.membatch.hasNode(child.path) {
+			if s.hasNode(child.path) {
+				s.membatchHits++
+				s.markReached(child.path)
 				continue
 			}
+			checked++
 			// Check the presence of children concurrently
 			pending.Add(1)
 			go func(child childNode) {
@@ -499,6 +721,24 @@ func (s *Sync) children(req *nodeRequest, object node) ([]*nodeRequest, error) {
 			done = true
 		}
 	}
+	s.databaseHits += uint64(checked - len(requests))
+	s.misses += uint64(len(requests))
+
+	// Account subtries present in the database hold their prioritized accounts
+	if len(s.unreached) > 0 && checked > len(requests) {
+		scheduled := make(map[string]struct{}, len(requests))
+		for _, req := range requests {
+			scheduled[string(req.path)] = struct{}{}
+		}
+		for _, child := range children {
+			if _, ok := child.node.(hashNode); !ok {
+				continue
+			}
+			if _, ok := scheduled[string(child.path)]; !ok {
+				s.markReached(child.path)
+			}
+		}
+	}
 	return requests, nil
 }
 
@@ -515,6 +755,9 @@ func (s *Sync) commitNodeRequest(req *nodeRequest) error {
 	s.membatch.size += common.HashLength + uint64(len(req.data))
 	delete(s.nodeReqs, string(req.path))
 	s.fetches[len(req.path)]--
+	if req.urgent {
+		s.urgentPending--
+	}
 
 	// Check parent for completion
 	if req.parent != nil {
@@ -535,8 +778,18 @@ func (s *Sync) commitCodeRequest(req *codeRequest) error {
 	// Write the node content to the membatch
 	s.membatch.codes[req.hash] = req.data
 	s.membatch.size += common.HashLength + uint64(len(req.data))
+	return s.completeCodeRequest(req)
+}
+
+// completeCodeRequest drops a handed out code request, either retrieved or found
+// in the database, and commits the referencing parents which don't depend on any
+// other request anymore.
+func (s *Sync) completeCodeRequest(req *codeRequest) error {
 	delete(s.codeReqs, req.hash)
 	s.fetches[len(req.path)]--
+	if req.urgent {
+		s.urgentPending--
+	}
 
 	// Check all parents for completion
 	for _, parent := range req.parents {
@@ -553,10 +806,5 @@ func (s *Sync) commitCodeRequest(req *codeRequest) error {
 // ResolvePath resolves the provided composite node path by separating the
 // path in account trie if it's existent.
 func ResolvePath(path []byte) (common.Hash, []byte) {
-	var owner common.Hash
-	if len(path) >= 2*common.HashLength {
-		owner = common.BytesToHash(hexToKeybytes(path[:2*common.HashLength]))
-		path = path[2*common.HashLength:]
-	}
-	return owner, path
+	return syncpath.Resolve(path)
 }
@@ -0,0 +1,181 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"time"
+
+	"github.com/chainupcloud/arb-geth/common"
+)
+
+const (
+	// DefaultSyncBatchMin is the default smallest batch handed out to a consumer.
+	DefaultSyncBatchMin = 16
+
+	// DefaultSyncBatchMax is the default largest batch handed out to a consumer.
+	DefaultSyncBatchMax = 1024
+
+	// DefaultSyncBatchTargetRTT is the default round trip time the batches of a
+	// consumer are sized to be served within.
+	DefaultSyncBatchTargetRTT = 2 * time.Second
+
+	// syncBatchSmoothing is the weight of the latest measurement in the running
+	// estimates of the round trip time and throughput of a consumer.
+	syncBatchSmoothing = 0.25
+
+	// syncBatchProbe is the growth of the ceiling of a consumer which served a
+	// batch at its ceiling in full, to find out whether it can serve more.
+	syncBatchProbe = 1.0625
+)
+
+// SyncBatchConfig enables the adaptive sizing of the batches handed out by
+// MissingFor. Every consumer, typically a peer, starts with the initial size,
+// which then follows its measured throughput so that a batch is delivered in
+// about the target round trip time, without outgrowing the batches it served
+// in full if it only partially serves larger ones. Failed deliveries halve the
+// size.
+type SyncBatchConfig struct {
+	Initial   int           // Batch size of a consumer without measurements yet
+	Min       int           // Smallest batch size handed out
+	Max       int           // Largest batch size handed out
+	TargetRTT time.Duration // Round trip time the batches are sized to be delivered within
+}
+
+// DefaultSyncBatchConfig is the default adaptive batch sizing configuration.
+var DefaultSyncBatchConfig = SyncBatchConfig{
+	Initial:   DefaultSyncBatchMin * 4,
+	Min:       DefaultSyncBatchMin,
+	Max:       DefaultSyncBatchMax,
+	TargetRTT: DefaultSyncBatchTargetRTT,
+}
+
+// syncConsumer holds the batch sizing state of a single consumer.
+type syncConsumer struct {
+	size       float64       // Current batch size
+	rtt        time.Duration // Smoothed round trip time of the delivered batches
+	throughput float64       // Smoothed number of entries delivered per second
+	ceiling    float64       // Largest batch the consumer fully served lately, 0 if unknown
+}
+
+// SetAdaptiveBatching enables the adaptive batch sizing of MissingFor, or
+// disables it if the config is nil, dropping the state of all consumers.
+func (s *Sync) SetAdaptiveBatching(config *SyncBatchConfig) {
+	s.consumers = nil
+	s.batching = nil
+	if config == nil {
+		return
+	}
+	cfg := *config
+	if cfg.Min <= 0 {
+		cfg.Min = 1
+	}
+	if cfg.Max < cfg.Min {
+		cfg.Max = cfg.Min
+	}
+	if cfg.Initial < cfg.Min {
+		cfg.Initial = cfg.Min
+	} else if cfg.Initial > cfg.Max {
+		cfg.Initial = cfg.Max
+	}
+	if cfg.TargetRTT <= 0 {
+		cfg.TargetRTT = DefaultSyncBatchTargetRTT
+	}
+	s.batching = &cfg
+	s.consumers = make(map[string]*syncConsumer)
+}
+
+// consumer returns the batch sizing state of the given consumer, creating it
+// if needed.
+func (s *Sync) consumer(id string) *syncConsumer {
+	c := s.consumers[id]
+	if c == nil {
+		c = &syncConsumer{size: float64(s.batching.Initial)}
+		s.consumers[id] = c
+	}
+	return c
+}
+
+// BatchSize returns the number of entries to hand out to the given consumer
+// next, or 0 if adaptive batching is disabled.
+func (s *Sync) BatchSize(id string) int {
+	if s.batching == nil {
+		return 0
+	}
+	return int(s.consumer(id).size)
+}
+
+// MissingFor is like Missing, but hands out at most the adaptive batch size of
+// the given consumer, capped by max unless it's 0. The consumer is expected to
+// report the outcome of the retrieval with ReportBatch.
+func (s *Sync) MissingFor(id string, max int) ([]string, []common.Hash, []common.Hash) {
+	if size := s.BatchSize(id); size > 0 && (max == 0 || size < max) {
+		max = size
+	}
+	return s.Missing(max)
+}
+
+// ReportBatch updates the batch size of the given consumer with the outcome of
+// a retrieval: the number of entries requested, the number delivered, and the
+// round trip time. Nothing delivered counts as a failure.
+func (s *Sync) ReportBatch(id string, requested, delivered int, elapsed time.Duration) {
+	if s.batching == nil || requested <= 0 {
+		return
+	}
+	c := s.consumer(id)
+	if delivered <= 0 {
+		c.size = s.clampBatch(c.size / 2)
+		return
+	}
+	if elapsed <= 0 {
+		elapsed = time.Millisecond
+	}
+	throughput := float64(delivered) / elapsed.Seconds()
+	if c.rtt == 0 {
+		c.rtt, c.throughput = elapsed, throughput
+	} else {
+		c.rtt += time.Duration(syncBatchSmoothing * float64(elapsed-c.rtt))
+		c.throughput += syncBatchSmoothing * (throughput - c.throughput)
+	}
+	// Move towards the size delivered within the target round trip time, but
+	// not past what the consumer served in full, as it may cap its responses
+	if delivered < requested {
+		c.ceiling = float64(delivered)
+	} else if c.ceiling > 0 && float64(requested) >= c.ceiling {
+		c.ceiling *= syncBatchProbe
+	}
+	target := c.throughput * s.batching.TargetRTT.Seconds()
+	if c.ceiling > 0 && target > c.ceiling {
+		target = c.ceiling
+	}
+	c.size = s.clampBatch(c.size + syncBatchSmoothing*(target-c.size))
+}
+
+// DropConsumer forgets the batch sizing state of the given consumer.
+func (s *Sync) DropConsumer(id string) {
+	delete(s.consumers, id)
+}
+
+// clampBatch bounds the batch size to the configured limits.
+func (s *Sync) clampBatch(size float64) float64 {
+	if size < float64(s.batching.Min) {
+		return float64(s.batching.Min)
+	}
+	if size > float64(s.batching.Max) {
+		return float64(s.batching.Max)
+	}
+	return size
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/prque"
+)
+
+// Prioritize requests the complete retrieval of the given accounts, including
+// their storage tries and contract codes, ahead of the rest of the state. The
+// accounts are identified by the hash of their address, the way they are keyed
+// in the account trie. Already scheduled requests are reprioritized.
+func (s *Sync) Prioritize(accounts ...common.Hash) {
+	for _, account := range accounts {
+		path := keybytesToHex(account[:])[:2*common.HashLength]
+		s.prioritized = append(s.prioritized, path)
+		s.unreached[string(path)] = struct{}{}
+	}
+	if len(s.nodeReqs) == 0 && len(s.codeReqs) == 0 {
+		s.markReached(nil) // Nothing left to retrieve, the state is complete
+	}
+	// Flag the pending requests that became urgent
+	for _, req := range s.nodeReqs {
+		s.trackUrgent(req.path, &req.urgent)
+	}
+	for _, req := range s.codeReqs {
+		s.trackUrgent(req.path, &req.urgent)
+	}
+	// Move the queued urgent requests to the urgent queue
+	queue := prque.New[int64, any](nil)
+	for !s.queue.Empty() {
+		item, prio := s.queue.Pop()
+		var path []byte
+		switch item := item.(type) {
+		case common.Hash:
+			if req := s.codeReqs[item]; req != nil {
+				path = req.path
+			}
+		case string:
+			path = []byte(item)
+		}
+		if path != nil && s.isUrgent(path) {
+			s.urgent.Push(item, prio)
+		} else {
+			queue.Push(item, prio)
+		}
+	}
+	s.queue = queue
+
+	// Move the queued storage trie nodes of the prioritized accounts too
+	owners := s.owners[:0]
+	for _, task := range s.owners {
+		if !s.isUrgent([]byte(task.owner)) {
+			owners = append(owners, task)
+			continue
+		}
+		for !task.queue.Empty() {
+			item, prio := task.queue.Pop()
+			s.urgent.Push(item, prio)
+		}
+		if task.inflight == 0 {
+			delete(s.storage, task.owner)
+		}
+	}
+	s.owners = owners
+}
+
+// UrgentPending returns the number of requests pending for the prioritized
+// accounts, plus the number of prioritized accounts not reached yet. Once it
+// drops to zero, all the data of these accounts has been retrieved, and is
+// available locally after the next commit.
+func (s *Sync) UrgentPending() int {
+	return s.urgentPending + len(s.unreached)
+}
+
+// isUrgent reports whether the node or code at the given path belongs to a
+// prioritized account, or lies on the account trie path leading to one.
+func (s *Sync) isUrgent(path []byte) bool {
+	for _, account := range s.prioritized {
+		if len(path) >= len(account) {
+			if bytes.Equal(path[:len(account)], account) {
+				return true
+			}
+		} else if bytes.HasPrefix(account, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackUrgent counts the request with the given path as pending for a
+// prioritized account if it belongs to one. Account trie nodes on the way to
+// the prioritized accounts are retrieved early too, but aren't counted since
+// they only complete once their whole subtrie does.
+func (s *Sync) trackUrgent(path []byte, urgent *bool) {
+	if *urgent || len(path) < 2*common.HashLength || !s.isUrgent(path) {
+		return
+	}
+	*urgent = true
+	s.urgentPending++
+}
+
+// markReached records that the account trie below the given path is either
+// available locally or being retrieved, for the prioritized accounts in it.
+func (s *Sync) markReached(path []byte) {
+	if len(s.unreached) == 0 {
+		return
+	}
+	if len(path) > 2*common.HashLength {
+		path = path[:2*common.HashLength]
+	}
+	for account := range s.unreached {
+		if strings.HasPrefix(account, string(path)) {
+			delete(s.unreached, account)
+		}
+	}
+}
+
+// queueFor returns the queue a request with the given path is scheduled into.
+func (s *Sync) queueFor(path []byte, urgent *bool) *prque.Prque[int64, any] {
+	if len(s.prioritized) == 0 || !s.isUrgent(path) {
+		return s.queue
+	}
+	s.trackUrgent(path, urgent)
+	return s.urgent
+}
@@ -0,0 +1,244 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"hash/fnv"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/log"
+	bloomfilter "github.com/holiman/bloomfilter/v2"
+)
+
+var (
+	spillNodePrefix = []byte("n") // spillNodePrefix + path -> hash + node data
+	spillCodePrefix = []byte("c") // spillCodePrefix + hash -> code
+)
+
+// bloomHashFuncs is the number of hash functions used by the bloom filter
+// fronting the spilled entries.
+const bloomHashFuncs = 4
+
+// SyncMembershipConfig bounds the memory a Sync scheduler uses to track the
+// trie nodes and codes it completed but didn't commit yet. Once the completed
+// data held in memory exceeds MemoryLimit, it's moved to a scratch database
+// until the next commit, optionally fronted by a bloom filter to avoid most of
+// the database lookups when deduplicating requests.
+type SyncMembershipConfig struct {
+	Store       ethdb.KeyValueStore // Scratch database for the spilled entries, its previous content is discarded
+	MemoryLimit uint64              // Size of the completed data held in memory before spilling it
+	BloomSize   uint64              // Size of the bloom filter fronting the spilled entries in bytes, 0 to disable it
+}
+
+// syncSpill holds the completed but not yet committed entries moved out of the
+// in-memory batch of a Sync scheduler.
+type syncSpill struct {
+	store ethdb.KeyValueStore
+	limit uint64
+	bloom *bloomfilter.Filter
+	bits  uint64
+
+	nodes uint64 // Number of trie nodes currently spilled
+	codes uint64 // Number of bytecodes currently spilled
+	size  uint64 // Estimated size of the spilled data, same accounting as the membatch
+
+	committed bool // Whether the entries left in the scratch database were committed
+}
+
+func newSyncSpill(config *SyncMembershipConfig) *syncSpill {
+	spill := &syncSpill{
+		store: config.Store,
+		limit: config.MemoryLimit,
+		bits:  config.BloomSize * 8,
+	}
+	spill.resetBloom()
+	spill.wipe()
+	return spill
+}
+
+// resetBloom drops all the entries of the bloom filter.
+func (spill *syncSpill) resetBloom() {
+	spill.bloom = nil
+	if spill.bits == 0 {
+		return
+	}
+	bloom, err := bloomfilter.New(spill.bits, bloomHashFuncs)
+	if err != nil {
+		log.Warn("Failed to create sync membership bloom filter", "err", err)
+		return
+	}
+	spill.bloom = bloom
+}
+
+// wipe deletes any entries left in the scratch database, e.g. by a previous
+// run that was interrupted before committing them.
+func (spill *syncSpill) wipe() {
+	for _, prefix := range [][]byte{spillNodePrefix, spillCodePrefix} {
+		if err := spill.drain(prefix); err != nil {
+			log.Warn("Failed to wipe sync membership store", "err", err)
+		}
+	}
+}
+
+func bloomKey(key []byte) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write(key)
+	return hasher.Sum64()
+}
+
+// has reports whether the entry was spilled, consulting the bloom filter first.
+func (spill *syncSpill) has(key []byte) bool {
+	if spill.nodes == 0 && spill.codes == 0 {
+		return false
+	}
+	if spill.bloom != nil && !spill.bloom.ContainsHash(bloomKey(key)) {
+		return false
+	}
+	ok, err := spill.store.Has(key)
+	// A failed lookup is treated as a miss, retrieving the entry again is harmless
+	return ok && err == nil
+}
+
+func (spill *syncSpill) hasNode(path []byte) bool {
+	return spill.has(append(common.CopyBytes(spillNodePrefix), path...))
+}
+
+func (spill *syncSpill) hasCode(hash common.Hash) bool {
+	return spill.has(append(common.CopyBytes(spillCodePrefix), hash[:]...))
+}
+
+// spill moves the content of the batch to the scratch database, deleting the
+// entries of the previous commit first.
+func (spill *syncSpill) spill(batch *syncMemBatch) error {
+	if err := spill.release(); err != nil {
+		return err
+	}
+	dbw := spill.store.NewBatch()
+	for path, data := range batch.nodes {
+		key := append(common.CopyBytes(spillNodePrefix), path...)
+		hash := batch.hashes[path]
+		if err := dbw.Put(key, append(hash[:], data...)); err != nil {
+			return err
+		}
+		if spill.bloom != nil {
+			spill.bloom.AddHash(bloomKey(key))
+		}
+	}
+	for hash, code := range batch.codes {
+		key := append(common.CopyBytes(spillCodePrefix), hash[:]...)
+		if err := dbw.Put(key, code); err != nil {
+			return err
+		}
+		if spill.bloom != nil {
+			spill.bloom.AddHash(bloomKey(key))
+		}
+	}
+	if err := dbw.Write(); err != nil {
+		return err
+	}
+	spill.nodes += uint64(len(batch.nodes))
+	spill.codes += uint64(len(batch.codes))
+	spill.size += batch.size
+	return nil
+}
+
+// commit adds the spilled entries to the database batch. The batch is left for
+// the caller to write, so the entries are kept in the scratch database until
+// the next spill or commit, by which time the batch is expected to be written.
+func (spill *syncSpill) commit(dbw ethdb.Batch, scheme string) error {
+	if err := spill.release(); err != nil {
+		return err
+	}
+	if spill.nodes == 0 && spill.codes == 0 {
+		return nil
+	}
+	err := spill.iterate(spillNodePrefix, func(path []byte, value []byte) error {
+		if len(value) < common.HashLength {
+			return nil // Can't happen, written by spill
+		}
+		owner, inner := ResolvePath(path)
+		rawdb.WriteTrieNode(dbw, owner, inner, common.BytesToHash(value[:common.HashLength]), common.CopyBytes(value[common.HashLength:]), scheme)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = spill.iterate(spillCodePrefix, func(hash []byte, code []byte) error {
+		rawdb.WriteCode(dbw, common.BytesToHash(hash), common.CopyBytes(code))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	spill.nodes, spill.codes, spill.size = 0, 0, 0
+	spill.committed = true
+	spill.resetBloom()
+	return nil
+}
+
+// release deletes the entries of the previous commit from the scratch database.
+func (spill *syncSpill) release() error {
+	if !spill.committed {
+		return nil
+	}
+	for _, prefix := range [][]byte{spillNodePrefix, spillCodePrefix} {
+		if err := spill.drain(prefix); err != nil {
+			return err
+		}
+	}
+	spill.committed = false
+	return nil
+}
+
+// iterate passes the spilled entries with the given prefix to the callback,
+// stripped of the prefix.
+func (spill *syncSpill) iterate(prefix []byte, callback func(key []byte, value []byte) error) error {
+	it := spill.store.NewIterator(prefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		if err := callback(common.CopyBytes(it.Key()[len(prefix):]), it.Value()); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// drain deletes the spilled entries with the given prefix.
+func (spill *syncSpill) drain(prefix []byte) error {
+	it := spill.store.NewIterator(prefix, nil)
+	defer it.Release()
+
+	deletes := spill.store.NewBatch()
+	for it.Next() {
+		if err := deletes.Delete(common.CopyBytes(it.Key())); err != nil {
+			return err
+		}
+		if deletes.ValueSize() >= ethdb.IdealBatchSize {
+			if err := deletes.Write(); err != nil {
+				return err
+			}
+			deletes.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return deletes.Write()
+}
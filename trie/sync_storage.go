@@ -0,0 +1,140 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/common/prque"
+)
+
+const (
+	// DefaultStorageFetchesPerOwner is the default maximum number of storage
+	// trie nodes of a single account being retrieved concurrently.
+	DefaultStorageFetchesPerOwner = 256
+
+	// DefaultStorageFetches is the default maximum number of storage trie nodes
+	// being retrieved concurrently, across all accounts.
+	DefaultStorageFetches = 4096
+)
+
+// storageTask holds the queued storage trie node requests of a single account.
+type storageTask struct {
+	owner    string                   // Hex path of the account owning the storage trie
+	queue    *prque.Prque[int64, any] // Queued storage trie node requests of the account
+	inflight int                      // Number of requests handed out but not delivered yet
+}
+
+// SetStorageConcurrency caps the number of storage trie nodes being retrieved
+// concurrently, both per account and overall. Storage trie nodes are handed out
+// round robin across the accounts, so that giant storage tries are retrieved in
+// parallel without starving the small ones. Zero means no cap.
+func (s *Sync) SetStorageConcurrency(perOwner, total int) {
+	s.storagePerOwner = perOwner
+	s.storageTotal = total
+}
+
+// isStorage reports whether the path belongs to a storage trie.
+func isStorage(path []byte) bool {
+	return len(path) >= 2*common.HashLength
+}
+
+// storageQueue returns the queue of the storage trie with the given node path,
+// creating it if needed.
+func (s *Sync) storageQueue(path []byte) *prque.Prque[int64, any] {
+	owner := string(path[:2*common.HashLength])
+	task := s.storage[owner]
+	if task == nil {
+		task = &storageTask{owner: owner, queue: prque.New[int64, any](nil)}
+		s.storage[owner] = task
+	}
+	if task.queue.Empty() {
+		s.owners = append(s.owners, task)
+	}
+	return task.queue
+}
+
+// missingStorage hands out queued storage trie node requests, one per account
+// at a time, until the caps or max are reached.
+func (s *Sync) missingStorage(max int, nodePaths []string, nodeHashes []common.Hash) ([]string, []common.Hash) {
+	for progress := true; progress; {
+		progress = false
+		for i := 0; i < len(s.owners); i++ {
+			if max != 0 && len(nodeHashes) >= max {
+				return nodePaths, nodeHashes
+			}
+			if s.storageTotal != 0 && s.storageInflight >= s.storageTotal {
+				return nodePaths, nodeHashes
+			}
+			task := s.owners[i]
+			if task.queue.Empty() {
+				// Drained by prioritization, drop the account from the rotation
+				s.owners = append(s.owners[:i], s.owners[i+1:]...)
+				i--
+				continue
+			}
+			if s.storagePerOwner != 0 && task.inflight >= s.storagePerOwner {
+				continue
+			}
+			item, prio := task.queue.Pop()
+			path := item.(string)
+			req, ok := s.nodeReqs[path]
+			if !ok {
+				continue // System very wrong, shouldn't happen
+			}
+			s.fetches[int(prio>>56)]++
+			req.inflight = true
+			task.inflight++
+			s.storageInflight++
+
+			nodePaths = append(nodePaths, path)
+			nodeHashes = append(nodeHashes, req.hash)
+			progress = true
+
+			if task.queue.Empty() {
+				s.owners = append(s.owners[:i], s.owners[i+1:]...)
+				i--
+			}
+		}
+	}
+	return nodePaths, nodeHashes
+}
+
+// storageDelivered releases the concurrency slot of a storage trie node request.
+func (s *Sync) storageDelivered(req *nodeRequest) {
+	if !req.inflight {
+		return
+	}
+	req.inflight = false
+	s.storageInflight--
+
+	owner := string(req.path[:2*common.HashLength])
+	if task := s.storage[owner]; task != nil {
+		task.inflight--
+		if task.inflight == 0 && task.queue.Empty() {
+			delete(s.storage, owner)
+		}
+	}
+}
+
+// queuedStorage returns the number of queued storage trie node requests.
+func (s *Sync) queuedStorage() int {
+	var queued int
+	for _, task := range s.owners {
+		queued += task.queue.Size()
+	}
+	return queued
+}
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/chainupcloud/arb-geth/common"
 	"github.com/chainupcloud/arb-geth/core/rawdb"
@@ -204,6 +205,116 @@ func testIterativeSync(t *testing.T, count int, bypath bool, scheme string) {
 	checkTrieContents(t, diskdb, srcDb.Scheme(), srcTrie.Hash().Bytes(), srcData)
 }
 
+// Tests that the sync scheduler statistics account for every retrieved node.
+func TestSyncStats(t *testing.T) {
+	_, srcDb, srcTrie, _ := makeTestTrie(rawdb.HashScheme)
+
+	diskdb := rawdb.NewMemoryDatabase()
+	sched := NewSync(srcTrie.Hash(), diskdb, nil, srcDb.Scheme())
+
+	var fetched uint64
+	for paths, nodes, _ := sched.Missing(0); len(paths) > 0; paths, nodes, _ = sched.Missing(0) {
+		if stats := sched.Stats(); stats.PendingNodes < len(paths) {
+			t.Fatalf("pending node count too low: have %d, want at least %d", stats.PendingNodes, len(paths))
+		}
+		for i, path := range paths {
+			owner, inner := ResolvePath([]byte(path))
+			data, err := srcDb.Reader(srcTrie.Hash()).Node(owner, inner, nodes[i])
+			if err != nil {
+				t.Fatalf("failed to retrieve node data for hash %x: %v", nodes[i], err)
+			}
+			if err := sched.ProcessNode(NodeSyncResult{path, data}); err != nil {
+				t.Fatalf("failed to process result %v", err)
+			}
+			fetched++
+		}
+		batch := diskdb.NewBatch()
+		if err := sched.Commit(batch); err != nil {
+			t.Fatalf("failed to commit data: %v", err)
+		}
+		batch.Write()
+	}
+	stats := sched.Stats()
+	if stats.PendingNodes != 0 || stats.Queued != 0 || stats.MemBatchNodes != 0 {
+		t.Fatalf("sync not finished: %+v", stats)
+	}
+	if stats.CommittedNodes != fetched {
+		t.Errorf("committed node count mismatch: have %d, want %d", stats.CommittedNodes, fetched)
+	}
+	if stats.Misses != fetched {
+		t.Errorf("miss count mismatch: have %d, want %d", stats.Misses, fetched)
+	}
+	if stats.CommittedBytes == 0 {
+		t.Errorf("no committed bytes accounted")
+	}
+}
+
+// Tests that the sync scheduler reconstructs the trie when the completed nodes
+// are spilled to a scratch database instead of being held in memory.
+func TestSyncMembershipSpill(t *testing.T) {
+	_, srcDb, srcTrie, srcData := makeTestTrie(rawdb.HashScheme)
+
+	diskdb := rawdb.NewMemoryDatabase()
+	sched := NewSync(srcTrie.Hash(), diskdb, nil, srcDb.Scheme())
+
+	// Entries left by an interrupted run must not be taken as completed
+	spilldb := memorydb.New()
+	stale := append(common.CopyBytes(spillNodePrefix), 0x0)
+	spilldb.Put(stale, make([]byte, common.HashLength))
+	sched.SetMembership(&SyncMembershipConfig{Store: spilldb, MemoryLimit: 1024, BloomSize: 1024})
+	if ok, _ := spilldb.Has(stale); ok {
+		t.Fatalf("stale spilled entry not wiped")
+	}
+
+	var spilled bool
+	for paths, nodes, _ := sched.Missing(0); len(paths) > 0; paths, nodes, _ = sched.Missing(0) {
+		for i, path := range paths {
+			owner, inner := ResolvePath([]byte(path))
+			data, err := srcDb.Reader(srcTrie.Hash()).Node(owner, inner, nodes[i])
+			if err != nil {
+				t.Fatalf("failed to retrieve node data for hash %x: %v", nodes[i], err)
+			}
+			if err := sched.ProcessNode(NodeSyncResult{path, data}); err != nil {
+				t.Fatalf("failed to process result %v", err)
+			}
+		}
+		if stats := sched.Stats(); stats.SpilledNodes > 0 {
+			spilled = true
+			if stats.MemBatchSize > 1024 {
+				t.Fatalf("memory limit exceeded: have %d, limit %d", stats.MemBatchSize, 1024)
+			}
+		}
+	}
+	if !spilled {
+		t.Fatalf("no nodes spilled to the scratch database")
+	}
+	// Commit only once everything was retrieved
+	batch := diskdb.NewBatch()
+	if err := sched.Commit(batch); err != nil {
+		t.Fatalf("failed to commit data: %v", err)
+	}
+	// Nothing may be persisted or dropped before the batch is written
+	if _, err := diskdb.Get(srcTrie.Hash().Bytes()); err == nil {
+		t.Fatalf("root persisted before the batch was written")
+	}
+	if spilldb.Len() == 0 {
+		t.Fatalf("scratch database emptied before the batch was written")
+	}
+	batch.Write()
+
+	if stats := sched.Stats(); stats.SpilledNodes != 0 || stats.SpilledSize != 0 {
+		t.Fatalf("spilled entries left after commit: %+v", stats)
+	}
+	// The committed entries are deleted on the next commit
+	if err := sched.Commit(diskdb.NewBatch()); err != nil {
+		t.Fatalf("failed to commit data: %v", err)
+	}
+	if spilldb.Len() != 0 {
+		t.Fatalf("scratch database not emptied: %d entries left", spilldb.Len())
+	}
+	checkTrieContents(t, diskdb, srcDb.Scheme(), srcTrie.Hash().Bytes(), srcData)
+}
+
 // Tests that the trie scheduler can correctly reconstruct the state even if only
 // partial results are returned, and the others sent only later.
 func TestIterativeDelayedSync(t *testing.T) {
@@ -746,3 +857,77 @@ func testSyncMovingTarget(t *testing.T, scheme string) {
 	syncWith(t, srcTrie.Hash(), diskdb, srcDb)
 	checkTrieContents(t, diskdb, srcDb.Scheme(), srcTrie.Hash().Bytes(), reverted)
 }
+
+// Tests that adaptive batching sizes the batches of each consumer after its
+// throughput, while still completing the sync.
+func TestAdaptiveSyncBatching(t *testing.T) {
+	_, srcDb, srcTrie, srcData := makeTestTrie(rawdb.HashScheme)
+
+	diskdb := rawdb.NewMemoryDatabase()
+	sched := NewSync(srcTrie.Hash(), diskdb, nil, srcDb.Scheme())
+	sched.SetAdaptiveBatching(&SyncBatchConfig{Initial: 32, Min: 4, Max: 512, TargetRTT: time.Second})
+
+	// The fast consumer delivers 400 entries per second, the slow one 20, and
+	// the failing one nothing at all
+	rates := map[string]float64{"fast": 400, "slow": 20}
+	for i := 0; sched.Pending() > 0; i++ {
+		for _, id := range []string{"fast", "slow"} {
+			paths, hashes, _ := sched.MissingFor(id, 0)
+			if size := sched.BatchSize(id); len(paths) > size {
+				t.Fatalf("consumer %s: handed out %d entries, batch size %d", id, len(paths), size)
+			}
+			for j, path := range paths {
+				owner, inner := ResolvePath([]byte(path))
+				data, err := srcDb.Reader(srcTrie.Hash()).Node(owner, inner, hashes[j])
+				if err != nil {
+					t.Fatalf("failed to retrieve node data for path %x: %v", path, err)
+				}
+				if err := sched.ProcessNode(NodeSyncResult{path, data}); err != nil {
+					t.Fatalf("failed to process result %v", err)
+				}
+			}
+			elapsed := time.Duration(float64(len(paths)) / rates[id] * float64(time.Second))
+			sched.ReportBatch(id, len(paths), len(paths), elapsed)
+		}
+		batch := diskdb.NewBatch()
+		if err := sched.Commit(batch); err != nil {
+			t.Fatalf("failed to commit data: %v", err)
+		}
+		batch.Write()
+	}
+	checkTrieContents(t, diskdb, srcDb.Scheme(), srcTrie.Hash().Bytes(), srcData)
+
+	// Keep measuring until the sizes settle, away from any trie to sync
+	for i := 0; i < 50; i++ {
+		for id, rate := range rates {
+			size := sched.BatchSize(id)
+			sched.ReportBatch(id, size, size, time.Duration(float64(size)/rate*float64(time.Second)))
+		}
+		sched.ReportBatch("failing", sched.BatchSize("failing"), 0, time.Second)
+	}
+	if size := sched.BatchSize("fast"); size < 380 || size > 400 {
+		t.Errorf("fast consumer batch size %d, want about 400", size)
+	}
+	if size := sched.BatchSize("slow"); size < 19 || size > 20 {
+		t.Errorf("slow consumer batch size %d, want about 20", size)
+	}
+	if size := sched.BatchSize("failing"); size != 4 {
+		t.Errorf("failing consumer batch size %d, want 4", size)
+	}
+	// Partial deliveries cap the batch size, despite the throughput allowing more
+	for i := 0; i < 50; i++ {
+		size := sched.BatchSize("fast")
+		if size > 100 {
+			sched.ReportBatch("fast", size, 100, 100*time.Millisecond)
+		} else {
+			sched.ReportBatch("fast", size, size, time.Duration(size)*time.Millisecond)
+		}
+	}
+	if size := sched.BatchSize("fast"); size < 90 || size > 110 {
+		t.Errorf("partially delivering consumer batch size %d, want about 100", size)
+	}
+	sched.SetAdaptiveBatching(nil)
+	if size := sched.BatchSize("fast"); size != 0 {
+		t.Errorf("batch size %d with adaptive batching disabled", size)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package syncpath
+
+import "errors"
+
+var (
+	errInvalidNibble  = errors.New("invalid nibble")
+	errMisplacedTerm  = errors.New("terminator before the end of the path")
+	errEmptyCompact   = errors.New("empty compact path")
+	errInvalidFlag    = errors.New("invalid compact path flag")
+	errInvalidPadding = errors.New("non-zero padding of even compact path")
+)
+
+// HexToCompact compact encodes a hex path, the terminator of a value node path
+// being folded into the flag.
+func HexToCompact(hex []byte) []byte {
+	term := byte(0)
+	if hasTerm(hex) {
+		term = 1
+		hex = hex[:len(hex)-1]
+	}
+	buf := make([]byte, len(hex)/2+1)
+	buf[0] = term << 5 // the flag byte
+	if len(hex)&1 == 1 {
+		buf[0] |= 1 << 4 // odd flag
+		buf[0] |= hex[0] // first nibble is contained in the first byte
+		hex = hex[1:]
+	}
+	decodeNibbles(hex, buf[1:])
+	return buf
+}
+
+// CompactToHex expands a compact path into hex. The path is assumed valid, see
+// ValidateCompact.
+func CompactToHex(compact []byte) []byte {
+	if len(compact) == 0 {
+		return compact
+	}
+	base := KeybytesToHex(compact)
+	// delete terminator flag
+	if base[0] < 2 {
+		base = base[:len(base)-1]
+	}
+	// apply odd flag
+	chop := 2 - base[0]&1
+	return base[chop:]
+}
+
+// KeybytesToHex expands a key into its hex path, terminated as a value node's.
+func KeybytesToHex(key []byte) []byte {
+	l := len(key)*2 + 1
+	var nibbles = make([]byte, l)
+	for i, b := range key {
+		nibbles[i*2] = b / 16
+		nibbles[i*2+1] = b % 16
+	}
+	nibbles[l-1] = terminator
+	return nibbles
+}
+
+// HexToKeybytes turns hex nibbles into key bytes. It can only be used for paths
+// of even length, see ValidateHex.
+func HexToKeybytes(hex []byte) []byte {
+	if hasTerm(hex) {
+		hex = hex[:len(hex)-1]
+	}
+	if len(hex)&1 != 0 {
+		panic("can't convert hex key of odd length")
+	}
+	key := make([]byte, len(hex)/2)
+	decodeNibbles(hex, key)
+	return key
+}
+
+// ValidateHex checks that a hex path only holds nibbles, terminated or not.
+func ValidateHex(hex []byte) error {
+	for i, nibble := range hex {
+		if nibble == terminator {
+			if i != len(hex)-1 {
+				return errMisplacedTerm
+			}
+		} else if nibble > 0xf {
+			return errInvalidNibble
+		}
+	}
+	return nil
+}
+
+// ValidateCompact checks that a compact path has a valid flag and padding.
+func ValidateCompact(compact []byte) error {
+	if len(compact) == 0 {
+		return errEmptyCompact
+	}
+	flag := compact[0] >> 4
+	if flag > 3 {
+		return errInvalidFlag
+	}
+	if flag&1 == 0 && compact[0]&0xf != 0 {
+		return errInvalidPadding
+	}
+	return nil
+}
+
+func decodeNibbles(nibbles []byte, bytes []byte) {
+	for bi, ni := 0, 0; ni < len(nibbles); bi, ni = bi+1, ni+2 {
+		bytes[bi] = nibbles[ni]<<4 | nibbles[ni+1]
+	}
+}
+
+// hasTerm returns whether a hex path has the terminator flag.
+func hasTerm(s []byte) bool {
+	return len(s) > 0 && s[len(s)-1] == terminator
+}
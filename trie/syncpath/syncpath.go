@@ -0,0 +1,165 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package syncpath converts between the forms trie node paths take: expanded hex
+// (nibble) paths, compact encoded paths, composite paths of storage trie nodes
+// prefixed with their owner, and the path tuples of the snap protocol.
+//
+// It's a stable API for external tools serving or auditing trie nodes over the
+// snap protocol, the trie package using it for its own path conversions.
+package syncpath
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+)
+
+// terminator is the nibble terminating the hex path of a value node.
+const terminator = 16
+
+// ownerLength is the length of the owner prefix of a composite path in nibbles.
+const ownerLength = 2 * common.HashLength
+
+var (
+	errEmptyPath    = errors.New("empty path tuple")
+	errPathTooLong  = errors.New("path tuple of more than 2 elements")
+	errInvalidOwner = errors.New("owner of storage trie path not 32 bytes")
+)
+
+// Path is a path tuple identifying a particular trie node either in a single
+// trie (account) or a layered trie (account -> storage).
+//
+// Content wise the tuple either has 1 element if it addresses a node in a single
+// trie or 2 elements if it addresses a node in a stacked trie.
+//
+// To support aiming arbitrary trie nodes, the path needs to support odd nibble
+// lengths. To avoid transferring expanded hex form over the network, the last
+// part of the tuple (which needs to index into the middle of a trie) is compact
+// encoded. In case of a 2-tuple, the first item is always 32 bytes so that is
+// simple binary encoded.
+//
+// Examples:
+//   - Path 0x9  -> {0x19}
+//   - Path 0x99 -> {0x0099}
+//   - Path 0x01234567890123456789012345678901012345678901234567890123456789019  -> {0x0123456789012345678901234567890101234567890123456789012345678901, 0x19}
+//   - Path 0x012345678901234567890123456789010123456789012345678901234567890199 -> {0x0123456789012345678901234567890101234567890123456789012345678901, 0x0099}
+type Path [][]byte
+
+// New converts a composite hex path into a path tuple that can be sent over the
+// network.
+func New(path []byte) Path {
+	// If the hash is from the account trie, append a single item, if it
+	// is from a storage trie, append a tuple. Note, the length 64 is
+	// clashing between account leaf and storage root. It's fine though
+	// because having a trie node at 64 depth means a hash collision was
+	// found and we're long dead.
+	if len(path) < ownerLength {
+		return Path{HexToCompact(path)}
+	}
+	return Path{HexToKeybytes(path[:ownerLength]), HexToCompact(path[ownerLength:])}
+}
+
+// Validate checks that the tuple is well formed, addressing a node either in the
+// account trie or in a storage trie.
+func (p Path) Validate() error {
+	switch len(p) {
+	case 0:
+		return errEmptyPath
+	case 1:
+	case 2:
+		if len(p[0]) != common.HashLength {
+			return errInvalidOwner
+		}
+	default:
+		return errPathTooLong
+	}
+	return ValidateCompact(p[len(p)-1])
+}
+
+// Owner returns the owner of the storage trie the tuple addresses a node of, the
+// zero hash for the account trie.
+func (p Path) Owner() common.Hash {
+	if len(p) == 2 {
+		return common.BytesToHash(p[0])
+	}
+	return common.Hash{}
+}
+
+// Hex converts the tuple back into a composite hex path.
+func (p Path) Hex() ([]byte, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	path := CompactToHex(p[len(p)-1])
+	if len(p) == 1 {
+		return path, nil
+	}
+	return Join(p.Owner(), path), nil
+}
+
+// Resolve splits the tuple into the owner of the trie addressed and the hex path
+// of the node within it.
+func (p Path) Resolve() (common.Hash, []byte, error) {
+	if err := p.Validate(); err != nil {
+		return common.Hash{}, nil, err
+	}
+	return p.Owner(), CompactToHex(p[len(p)-1]), nil
+}
+
+// ValidatePathSet checks a path set of a snap protocol trie node request, which
+// is either the path of an account trie node, or the owner of a storage trie
+// followed by one or more paths of nodes within it.
+func ValidatePathSet(set [][]byte) error {
+	switch len(set) {
+	case 0:
+		return errEmptyPath
+	case 1:
+		return ValidateCompact(set[0])
+	}
+	if len(set[0]) != common.HashLength {
+		return errInvalidOwner
+	}
+	for i, path := range set[1:] {
+		if err := ValidateCompact(path); err != nil {
+			return fmt.Errorf("path %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Resolve resolves the provided composite node path by separating the path in
+// account trie if it's existent.
+func Resolve(path []byte) (common.Hash, []byte) {
+	var owner common.Hash
+	if len(path) >= ownerLength {
+		owner = common.BytesToHash(HexToKeybytes(path[:ownerLength]))
+		path = path[ownerLength:]
+	}
+	return owner, path
+}
+
+// Join builds the composite path of a node of the given trie, the inverse of
+// Resolve. The zero owner denotes the account trie.
+func Join(owner common.Hash, path []byte) []byte {
+	if owner == (common.Hash{}) {
+		return common.CopyBytes(path)
+	}
+	joined := make([]byte, 0, ownerLength+len(path))
+	joined = append(joined, KeybytesToHex(owner[:])[:ownerLength]...)
+	return append(joined, path...)
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package syncpath
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+)
+
+func TestNew(t *testing.T) {
+	owner := common.FromHex("0x0123456789012345678901234567890101234567890123456789012345678901")
+	hexOwner := KeybytesToHex(owner)[:ownerLength]
+	tests := []struct {
+		path []byte
+		want Path
+	}{
+		{[]byte{0x9}, Path{{0x19}}},
+		{[]byte{0x9, 0x9}, Path{{0x00, 0x99}}},
+		{append(common.CopyBytes(hexOwner), 0x9), Path{owner, {0x19}}},
+		{append(common.CopyBytes(hexOwner), 0x9, 0x9), Path{owner, {0x00, 0x99}}},
+	}
+	for i, tt := range tests {
+		have := New(tt.path)
+		if len(have) != len(tt.want) {
+			t.Fatalf("test %d: tuple length mismatch: have %d, want %d", i, len(have), len(tt.want))
+		}
+		for j := range have {
+			if !bytes.Equal(have[j], tt.want[j]) {
+				t.Errorf("test %d: element %d mismatch: have %x, want %x", i, j, have[j], tt.want[j])
+			}
+		}
+		if err := have.Validate(); err != nil {
+			t.Errorf("test %d: invalid tuple: %v", i, err)
+		}
+		path, err := have.Hex()
+		if err != nil || !bytes.Equal(path, tt.path) {
+			t.Errorf("test %d: hex path mismatch: have %x (%v), want %x", i, path, err, tt.path)
+		}
+		resolvedOwner, resolved := Resolve(tt.path)
+		if resolvedOwner != have.Owner() {
+			t.Errorf("test %d: owner mismatch: have %x, want %x", i, resolvedOwner, have.Owner())
+		}
+		if joined := Join(resolvedOwner, resolved); !bytes.Equal(joined, tt.path) {
+			t.Errorf("test %d: joined path mismatch: have %x, want %x", i, joined, tt.path)
+		}
+	}
+}
+
+func TestCompactRoundtrip(t *testing.T) {
+	for _, hex := range [][]byte{
+		{},
+		{16},
+		{1, 2, 3, 4, 5},
+		{0, 1, 2, 3, 4, 5},
+		{0xf, 1, 0xc, 0xb, 8, 16},
+		{0, 0xf, 1, 0xc, 0xb, 8, 16},
+	} {
+		if err := ValidateHex(hex); err != nil {
+			t.Fatalf("path %x: invalid hex: %v", hex, err)
+		}
+		compact := HexToCompact(hex)
+		if err := ValidateCompact(compact); err != nil {
+			t.Errorf("path %x: invalid compact %x: %v", hex, compact, err)
+		}
+		if have := CompactToHex(compact); !bytes.Equal(have, hex) {
+			t.Errorf("path %x: roundtrip mismatch: have %x", hex, have)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	owner := make([]byte, common.HashLength)
+	tests := []struct {
+		path Path
+		ok   bool
+	}{
+		{Path{}, false},
+		{Path{{0x19}}, true},
+		{Path{{0x40}}, false},       // unknown flag
+		{Path{{0x05}}, false},       // padding of even path
+		{Path{{}}, false},           // empty compact path
+		{Path{owner, {0x00}}, true}, // storage trie root
+		{Path{owner[1:], {0x00}}, false},
+		{Path{owner, {0x00}, {0x00}}, false},
+	}
+	for i, tt := range tests {
+		if err := tt.path.Validate(); (err == nil) != tt.ok {
+			t.Errorf("test %d: validity mismatch: have %v, want ok=%v", i, err, tt.ok)
+		}
+	}
+	if err := ValidateHex([]byte{1, 16, 2}); err == nil {
+		t.Errorf("misplaced terminator accepted")
+	}
+	if err := ValidatePathSet([][]byte{owner, {0x00}, {0x19}}); err != nil {
+		t.Errorf("valid path set rejected: %v", err)
+	}
+	if err := ValidatePathSet([][]byte{owner, {0x00}, {0x40}}); err == nil {
+		t.Errorf("invalid path set accepted")
+	}
+}
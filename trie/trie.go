@@ -50,6 +50,9 @@ type Trie struct {
 	// tracer is the tool to track the trie changes.
 	// It will be reset after each commit operation.
 	tracer *tracer
+
+	// nodeHasher replaces keccak256 for hashing the nodes, if set.
+	nodeHasher NodeHasher
 }
 
 // newFlag returns the cache flag value for a newly created node.
@@ -60,11 +63,12 @@ func (t *Trie) newFlag() nodeFlag {
 // Copy returns a copy of Trie.
 func (t *Trie) Copy() *Trie {
 	return &Trie{
-		root:     t.root,
-		owner:    t.owner,
-		unhashed: t.unhashed,
-		reader:   t.reader,
-		tracer:   t.tracer.copy(),
+		root:       t.root,
+		owner:      t.owner,
+		unhashed:   t.unhashed,
+		reader:     t.reader,
+		tracer:     t.tracer.copy(),
+		nodeHasher: t.nodeHasher,
 	}
 }
 
@@ -75,16 +79,25 @@ func (t *Trie) Copy() *Trie {
 // empty, otherwise, the root node must be present in database or returns
 // a MissingNodeError if not.
 func New(id *ID, db NodeReader) (*Trie, error) {
+	return NewWithHasher(id, db, nil)
+}
+
+// NewWithHasher creates the trie instance like New, with its nodes hashed by
+// the node hasher instead of keccak256. The trie root specified by trie id must
+// have been derived with the same node hasher. A nil node hasher stands for
+// keccak256.
+func NewWithHasher(id *ID, db NodeReader, nodeHasher NodeHasher) (*Trie, error) {
 	reader, err := newTrieReader(id.StateRoot, id.Owner, db)
 	if err != nil {
 		return nil, err
 	}
 	trie := &Trie{
-		owner:  id.Owner,
-		reader: reader,
-		tracer: newTracer(),
+		owner:      id.Owner,
+		reader:     reader,
+		tracer:     newTracer(),
+		nodeHasher: nodeHasher,
 	}
-	if id.Root != (common.Hash{}) && id.Root != types.EmptyRootHash {
+	if id.Root != (common.Hash{}) && id.Root != types.EmptyRootHash && id.Root != emptyRoot(nodeHasher) {
 		rootnode, err := trie.resolveAndTrack(id.Root[:], nil)
 		if err != nil {
 			return nil, err
@@ -582,7 +595,7 @@ func (t *Trie) Commit(collectLeaf bool) (common.Hash, *trienode.NodeSet) {
 	// - The trie was empty and no update happens
 	// - The trie was non-empty and all nodes are dropped
 	if t.root == nil {
-		return types.EmptyRootHash, nodes
+		return emptyRoot(t.nodeHasher), nodes
 	}
 	// Derive the hash for all dirty nodes first. We hold the assumption
 	// in the following procedure that all nodes are hashed.
@@ -603,10 +616,10 @@ func (t *Trie) Commit(collectLeaf bool) (common.Hash, *trienode.NodeSet) {
 // hashRoot calculates the root hash of the given trie
 func (t *Trie) hashRoot() (node, node) {
 	if t.root == nil {
-		return hashNode(types.EmptyRootHash.Bytes()), nil
+		return hashNode(emptyRoot(t.nodeHasher).Bytes()), nil
 	}
 	// If the number of changes is below 100, we let one thread handle it
-	h := newHasher(t.unhashed >= 100)
+	h := newCustomHasher(t.unhashed >= 100, t.nodeHasher)
 	defer func() {
 		returnHasherToPool(h)
 		t.unhashed = 0
@@ -0,0 +1,170 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/crypto"
+	"github.com/chainupcloud/arb-geth/rlp"
+)
+
+// batchKey is a key looked up by GetBatch, along with its position in the batch.
+type batchKey struct {
+	hex   []byte
+	index int
+}
+
+// GetBatch returns the values for the keys stored in the trie, in the order of
+// the keys, nil standing for the absent ones. The keys are sorted and resolved
+// in a single traversal, the nodes on their shared paths being loaded once.
+// The value bytes must not be modified by the caller.
+//
+// If a trie node is not present in the database, a MissingNodeError is returned.
+func (t *Trie) GetBatch(keys [][]byte) ([][]byte, error) {
+	batch := make([]batchKey, len(keys))
+	for i, key := range keys {
+		batch[i] = batchKey{hex: keybytesToHex(key), index: i}
+	}
+	sort.Slice(batch, func(i, j int) bool { return bytes.Compare(batch[i].hex, batch[j].hex) < 0 })
+
+	values := make([][]byte, len(keys))
+	newroot, didResolve, err := t.getBatch(t.root, batch, 0, values)
+	if err != nil {
+		return nil, err
+	}
+	if didResolve {
+		t.root = newroot
+	}
+	return values, nil
+}
+
+// getBatch looks the sorted keys up below the node at the position of their
+// hex paths, storing the values found.
+func (t *Trie) getBatch(origNode node, keys []batchKey, pos int, values [][]byte) (newnode node, didResolve bool, err error) {
+	switch n := (origNode).(type) {
+	case nil:
+		return nil, false, nil
+	case valueNode:
+		for _, key := range keys {
+			values[key.index] = n
+		}
+		return n, false, nil
+	case *shortNode:
+		// The sorted keys sharing the path of the node are contiguous
+		start := sort.Search(len(keys), func(i int) bool {
+			return bytes.Compare(keyPath(keys[i].hex, pos, len(n.Key)), n.Key) >= 0
+		})
+		end := start
+		for end < len(keys) && bytes.Equal(keyPath(keys[end].hex, pos, len(n.Key)), n.Key) {
+			end++
+		}
+		if start == end {
+			return n, false, nil
+		}
+		newnode, didResolve, err = t.getBatch(n.Val, keys[start:end], pos+len(n.Key), values)
+		if err == nil && didResolve {
+			n = n.copy()
+			n.Val = newnode
+		}
+		return n, didResolve, err
+	case *fullNode:
+		var resolved *fullNode
+		for start := 0; start < len(keys); {
+			nibble := keys[start].hex[pos]
+			end := start + 1
+			for end < len(keys) && keys[end].hex[pos] == nibble {
+				end++
+			}
+			child, childResolved, err := t.getBatch(n.Children[nibble], keys[start:end], pos+1, values)
+			if err != nil {
+				return n, true, err
+			}
+			if childResolved {
+				if resolved == nil {
+					resolved = n.copy()
+				}
+				resolved.Children[nibble] = child
+			}
+			start = end
+		}
+		if resolved == nil {
+			return n, false, nil
+		}
+		return resolved, true, nil
+	case hashNode:
+		child, err := t.resolveAndTrack(n, keys[0].hex[:pos])
+		if err != nil {
+			return n, true, err
+		}
+		newnode, _, err := t.getBatch(child, keys, pos, values)
+		return newnode, true, err
+	default:
+		panic(fmt.Sprintf("%T: invalid node: %v", origNode, origNode))
+	}
+}
+
+// keyPath returns the part of the hex key of the given length from the position,
+// truncated if the key is shorter.
+func keyPath(hex []byte, pos, length int) []byte {
+	if end := pos + length; end < len(hex) {
+		return hex[pos:end]
+	}
+	return hex[pos:]
+}
+
+// GetStorageBatch retrieves the storage slots of the keys, in the order of the
+// keys, nil standing for the absent ones, resolving them in a single traversal.
+// If a trie node is not found in the database, a MissingNodeError is returned.
+func (t *StateTrie) GetStorageBatch(_ common.Address, keys [][]byte) ([][]byte, error) {
+	hashed := make([][]byte, len(keys))
+	for i, key := range keys {
+		hashed[i] = crypto.Keccak256(key)
+	}
+	return t.trie.GetBatch(hashed)
+}
+
+// GetAccountBatch retrieves the accounts of the addresses, in the order of the
+// addresses, nil standing for the absent ones, resolving them in a single
+// traversal. If a trie node is not found in the database, a MissingNodeError
+// is returned.
+func (t *StateTrie) GetAccountBatch(addresses []common.Address) ([]*types.StateAccount, error) {
+	hashed := make([][]byte, len(addresses))
+	for i, address := range addresses {
+		hashed[i] = crypto.Keccak256(address.Bytes())
+	}
+	blobs, err := t.trie.GetBatch(hashed)
+	if err != nil {
+		return nil, err
+	}
+	accounts := make([]*types.StateAccount, len(addresses))
+	for i, blob := range blobs {
+		if blob == nil {
+			continue
+		}
+		account := new(types.StateAccount)
+		if err := rlp.DecodeBytes(blob, account); err != nil {
+			return nil, err
+		}
+		accounts[i] = account
+	}
+	return accounts, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/core/rawdb"
+	"github.com/chainupcloud/arb-geth/core/types"
+	"github.com/chainupcloud/arb-geth/ethdb"
+	"github.com/chainupcloud/arb-geth/ethdb/memorydb"
+	"github.com/chainupcloud/arb-geth/trie/trienode"
+)
+
+// readCountingStore counts the reads of a key-value store.
+type readCountingStore struct {
+	ethdb.KeyValueStore
+	reads int
+}
+
+func (s *readCountingStore) Get(key []byte) ([]byte, error) {
+	s.reads++
+	return s.KeyValueStore.Get(key)
+}
+
+func TestGetBatch(t *testing.T) {
+	var (
+		store  = &readCountingStore{KeyValueStore: memorydb.New()}
+		triedb = NewDatabase(rawdb.NewDatabase(store))
+		tr     = NewEmpty(triedb)
+		keys   [][]byte
+	)
+	for i := 0; i < 1000; i++ {
+		key, value := make([]byte, 32), make([]byte, 1+rand.Intn(40))
+		rand.Read(key)
+		rand.Read(value)
+		tr.MustUpdate(key, value)
+		keys = append(keys, key)
+	}
+	// Also have shorter keys diverging from the others within short nodes
+	tr.MustUpdate([]byte{0x01}, []byte{0x01})
+	tr.MustUpdate([]byte{0x01, 0x02}, []byte{0x02})
+	keys = append(keys, []byte{0x01}, []byte{0x01, 0x02})
+
+	root, nodes := tr.Commit(false)
+	triedb.Update(root, types.EmptyRootHash, trienode.NewWithNodeSet(nodes))
+	triedb.Commit(root, false)
+
+	// Look up a sample of the keys, some absent and some twice
+	batch := append([][]byte{}, keys[:200]...)
+	batch = append(batch, keys[len(keys)-2:]...)
+	batch = append(batch, keys[10], keys[20], []byte{0x01, 0x03}, common.Hash{0xff}.Bytes(), nil)
+	for i := 0; i < 50; i++ {
+		absent := make([]byte, 32)
+		rand.Read(absent)
+		batch = append(batch, absent)
+	}
+	rand.Shuffle(len(batch), func(i, j int) { batch[i], batch[j] = batch[j], batch[i] })
+
+	single, _ := New(TrieID(root), triedb)
+	store.reads = 0
+	want := make([][]byte, len(batch))
+	for i, key := range batch {
+		value, err := single.Get(key)
+		if err != nil {
+			t.Fatalf("failed to get key %x: %v", key, err)
+		}
+		want[i] = value
+	}
+	singleReads := store.reads
+
+	batched, _ := New(TrieID(root), triedb)
+	store.reads = 0
+	have, err := batched.GetBatch(batch)
+	if err != nil {
+		t.Fatalf("failed to get batch: %v", err)
+	}
+	if len(have) != len(want) {
+		t.Fatalf("value count mismatch: have %d, want %d", len(have), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(have[i], want[i]) {
+			t.Errorf("key %x: value mismatch: have %x, want %x", batch[i], have[i], want[i])
+		}
+	}
+	if store.reads > singleReads {
+		t.Errorf("batch read %d nodes, single lookups %d", store.reads, singleReads)
+	}
+	// The resolved nodes are kept, a second batch loads nothing
+	store.reads = 0
+	if _, err := batched.GetBatch(batch); err != nil {
+		t.Fatalf("failed to get batch again: %v", err)
+	}
+	if store.reads != 0 {
+		t.Errorf("second batch read %d nodes", store.reads)
+	}
+}
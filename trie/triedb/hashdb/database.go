@@ -55,6 +55,9 @@ var (
 	memcacheCommitTimeTimer  = metrics.NewRegisteredResettingTimer("trie/memcache/commit/time", nil)
 	memcacheCommitNodesMeter = metrics.NewRegisteredMeter("trie/memcache/commit/nodes", nil)
 	memcacheCommitSizeMeter  = metrics.NewRegisteredMeter("trie/memcache/commit/size", nil)
+
+	memcacheDedupNodesMeter = metrics.NewRegisteredMeter("trie/memcache/dedup/nodes", nil)
+	memcacheDedupSizeMeter  = metrics.NewRegisteredMeter("trie/memcache/dedup/size", nil)
 )
 
 // ChildResolver defines the required method to decode the provided
@@ -74,6 +77,7 @@ type ChildResolver interface {
 type Database struct {
 	diskdb   ethdb.Database // Persistent storage for matured trie nodes
 	resolver ChildResolver  // The handler to resolve children of nodes
+	dedup    bool           // Whether to skip storage trie nodes already persisted
 
 	cleans  *fastcache.Cache            // GC friendly memory cache of clean node RLPs
 	dirties map[common.Hash]*cachedNode // Data and references relationships of dirty trie nodes
@@ -129,6 +133,31 @@ func New(diskdb ethdb.Database, cleans *fastcache.Cache, resolver ChildResolver)
 	}
 }
 
+// SetDedup toggles skipping the storage trie nodes already persisted instead of
+// caching and writing them again. Nodes are content addressed in the hash scheme,
+// so identical subtries of different storage tries (e.g. of cloned contracts)
+// share their nodes, at the cost of a database lookup for every new node.
+//
+// It's safe as the hash scheme never deletes nodes from disk on its own, and a
+// node is only ever persisted after its whole subtrie.
+func (db *Database) SetDedup(dedup bool) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.dedup = dedup
+}
+
+// persisted reports whether a node not cached as dirty is already stored on disk.
+func (db *Database) persisted(hash common.Hash) bool {
+	if _, ok := db.dirties[hash]; ok {
+		return false
+	}
+	if db.cleans != nil && db.cleans.Has(hash[:]) {
+		return true
+	}
+	return rawdb.HasLegacyTrieNode(db.diskdb, hash)
+}
+
 // insert inserts a simplified trie node into the memory database.
 // All nodes inserted by this function will be reference tracked
 // and in theory should only used for **trie nodes** insertion.
@@ -163,16 +192,23 @@ func (db *Database) insert(hash common.Hash, node []byte) {
 // Node retrieves an encoded cached trie node from memory. If it cannot be found
 // cached, the method queries the persistent database for the content.
 func (db *Database) Node(hash common.Hash) ([]byte, error) {
+	enc, _, err := db.node(hash)
+	return enc, err
+}
+
+// node retrieves an encoded trie node like Node, also returning where it was
+// found.
+func (db *Database) node(hash common.Hash) ([]byte, nodeSource, error) {
 	// It doesn't make sense to retrieve the metaroot
 	if hash == (common.Hash{}) {
-		return nil, errors.New("not found")
+		return nil, sourceMissing, errors.New("not found")
 	}
 	// Retrieve the node from the clean cache if available
 	if db.cleans != nil {
 		if enc := db.cleans.Get(nil, hash[:]); enc != nil {
 			memcacheCleanHitMeter.Mark(1)
 			memcacheCleanReadMeter.Mark(int64(len(enc)))
-			return enc, nil
+			return enc, sourceClean, nil
 		}
 	}
 	// Retrieve the node from the dirty cache if available
@@ -183,7 +219,7 @@ func (db *Database) Node(hash common.Hash) ([]byte, error) {
 	if dirty != nil {
 		memcacheDirtyHitMeter.Mark(1)
 		memcacheDirtyReadMeter.Mark(int64(len(dirty.node)))
-		return dirty.node, nil
+		return dirty.node, sourceDirty, nil
 	}
 	memcacheDirtyMissMeter.Mark(1)
 
@@ -195,9 +231,9 @@ func (db *Database) Node(hash common.Hash) ([]byte, error) {
 			memcacheCleanMissMeter.Mark(1)
 			memcacheCleanWriteMeter.Mark(int64(len(enc)))
 		}
-		return enc, nil
+		return enc, sourceDisk, nil
 	}
-	return nil, errors.New("not found")
+	return nil, sourceMissing, errors.New("not found")
 }
 
 // Nodes retrieves the hashes of all the nodes cached within the memory database.
@@ -588,12 +624,20 @@ func (db *Database) Update(root common.Hash, parent common.Hash, nodes *trienode
 	if _, ok := nodes.Sets[common.Hash{}]; ok {
 		order = append(order, common.Hash{})
 	}
+	// Storage trie nodes already on disk are skipped if deduplication is on, the
+	// account trie nodes being rarely shared.
 	for _, owner := range order {
 		subset := nodes.Sets[owner]
+		dedup := db.dedup && owner != (common.Hash{})
 		subset.ForEachWithOrder(func(path string, n *trienode.Node) {
 			if n.IsDeleted() {
 				return // ignore deletion
 			}
+			if dedup && db.persisted(n.Hash) {
+				memcacheDedupNodesMeter.Mark(1)
+				memcacheDedupSizeMeter.Mark(int64(len(n.Blob)))
+				return
+			}
 			db.insert(n.Hash, n.Blob)
 		})
 	}
@@ -647,6 +691,9 @@ type reader struct {
 // Node retrieves the trie node with the given node hash.
 // No error will be returned if the node is not found.
 func (reader *reader) Node(owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
-	blob, _ := reader.db.Node(hash)
+	blob, source, _ := reader.db.node(hash)
+	if metrics.Enabled {
+		markRead(owner, path, source)
+	}
 	return blob, nil
 }
@@ -0,0 +1,69 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package hashdb
+
+import (
+	"fmt"
+
+	"github.com/chainupcloud/arb-geth/common"
+	"github.com/chainupcloud/arb-geth/metrics"
+)
+
+// nodeSource is where a trie node read was served from.
+type nodeSource int
+
+const (
+	sourceClean   nodeSource = iota // Clean cache
+	sourceDirty                     // Dirty cache
+	sourceDisk                      // Persistent database
+	sourceMissing                   // Not found
+	numSources
+)
+
+var sourceNames = [numSources]string{"clean", "dirty", "disk", "miss"}
+
+// readerMaxDepth is the depth from which the node reads are counted together,
+// deeper nodes being rare in both the account and storage tries.
+const readerMaxDepth = 16
+
+// readerMeters counts the node reads by owner type (account or storage trie),
+// depth in nibbles and source, as trie/reader/<owner>/depth<depth>/<source>,
+// so that the hit rate of the caches is known at every level of the tries.
+var readerMeters [2][readerMaxDepth + 1][numSources]metrics.Meter
+
+func init() {
+	for owner, ownerName := range []string{"account", "storage"} {
+		for depth := 0; depth <= readerMaxDepth; depth++ {
+			for source, sourceName := range sourceNames {
+				readerMeters[owner][depth][source] = metrics.NewRegisteredMeter(fmt.Sprintf("trie/reader/%s/depth%02d/%s", ownerName, depth, sourceName), nil)
+			}
+		}
+	}
+}
+
+// markRead counts a node read by the owner of its trie, its depth and source.
+func markRead(owner common.Hash, path []byte, source nodeSource) {
+	var ownerType int
+	if owner != (common.Hash{}) {
+		ownerType = 1
+	}
+	depth := len(path)
+	if depth > readerMaxDepth {
+		depth = readerMaxDepth
+	}
+	readerMeters[ownerType][depth][source].Mark(1)
+}